@@ -1470,6 +1470,16 @@ func (lc *LocalClient) DebugDERPRegion(ctx context.Context, regionIDOrCode strin
 	return decodeJSON[*ipnstate.DebugDERPRegionReport](body)
 }
 
+// DebugNetcheckKernel runs a netcheck of the STUN RTT of every DERP region,
+// timed by kernel RX/TX timestamps where the platform supports them.
+func (lc *LocalClient) DebugNetcheckKernel(ctx context.Context) (*ipnstate.DebugNetcheckKernelReport, error) {
+	body, err := lc.send(ctx, "POST", "/localapi/v0/debug-kernel-netcheck", 200, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error %w: %s", err, body)
+	}
+	return decodeJSON[*ipnstate.DebugNetcheckKernelReport](body)
+}
+
 // DebugPacketFilterRules returns the packet filter rules for the current device.
 func (lc *LocalClient) DebugPacketFilterRules(ctx context.Context) ([]tailcfg.FilterRule, error) {
 	body, err := lc.send(ctx, "POST", "/localapi/v0/debug-packet-filter-rules", 200, nil)
@@ -42,6 +42,7 @@
 	"tailscale.com/metrics"
 	"tailscale.com/net/ktimeout"
 	"tailscale.com/net/stunserver"
+	tsrate "tailscale.com/tstime/rate"
 	"tailscale.com/tsweb"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
@@ -72,6 +73,12 @@
 	acceptConnLimit = flag.Float64("accept-connection-limit", math.Inf(+1), "rate limit for accepting new connection")
 	acceptConnBurst = flag.Int("accept-connection-burst", math.MaxInt, "burst limit for accepting new connection")
 
+	stunRateLimit     = flag.Float64("stun-rate-limit", math.Inf(+1), "per-client rate limit of STUN requests per second; clients are single IPv4 addresses or IPv6 /64s, and requests over the limit are dropped")
+	stunRateBurst     = flag.Int("stun-rate-burst", 10, "per-client burst limit of STUN requests")
+	stunClientMetrics = flag.Bool("stun-client-metrics", false, "whether to count STUN requests by client /24 (IPv4) or /56 (IPv6), for up to 1024 prefixes")
+
+	logProbeIDs = flag.Bool("log-probe-ids", false, "whether to log the measurement IDs of latency probes carrying one, e.g. from stunstamp, rate limited to 10 per second")
+
 	// tcpKeepAlive is intentionally long, to reduce battery cost. There is an L7 keepalive on a higher frequency schedule.
 	tcpKeepAlive = flag.Duration("tcp-keepalive-time", 10*time.Minute, "TCP keepalive time")
 	// tcpUserTimeout is intentionally short, so that hung connections are cleaned up promptly. DERPs should be nearby users.
@@ -161,6 +168,8 @@ func main() {
 
 	if *runSTUN {
 		ss := stunserver.New(ctx)
+		ss.SetRateLimit(tsrate.Limit(*stunRateLimit), *stunRateBurst)
+		ss.SetClientMetrics(*stunClientMetrics)
 		go ss.ListenAndServe(net.JoinHostPort(listenHost, fmt.Sprint(*stunPort)))
 	}
 
@@ -203,8 +212,12 @@ func main() {
 
 	// These two endpoints are the same. Different versions of the clients
 	// have assumes different paths over time so we support both.
-	mux.HandleFunc("/derp/probe", derphttp.ProbeHandler)
-	mux.HandleFunc("/derp/latency-check", derphttp.ProbeHandler)
+	probeHandler := http.HandlerFunc(derphttp.ProbeHandler)
+	if *logProbeIDs {
+		probeHandler = derphttp.ProbeHandlerWithLogf(logger.RateLimitedFn(log.Printf, 100*time.Millisecond, 100, 1))
+	}
+	mux.Handle("/derp/probe", probeHandler)
+	mux.Handle("/derp/latency-check", probeHandler)
 
 	go refreshBootstrapDNSLoop()
 	mux.HandleFunc("/bootstrap-dns", tsweb.BrowserHeaderHandlerFunc(handleBootstrapDNS))
@@ -0,0 +1,482 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"tailscale.com/net/stun"
+)
+
+const (
+	abRTTMetricName     = "stunstamp_ab_rtt_s"
+	abLossMetricName    = "stunstamp_ab_loss_ratio"
+	abDiffMetricName    = "stunstamp_ab_rtt_diff_s"
+	abDiffCIMetricName  = "stunstamp_ab_rtt_diff_ci95_s"
+	abPairsMetricName   = "stunstamp_ab_pairs"
+	abDefaultRounds     = 5
+	abMaxRounds         = 50
+	abSpacing           = 5 * time.Millisecond
+	abProfileFamilyIPv4 = "ipv4"
+	abProfileFamilyIPv6 = "ipv6"
+)
+
+// abConfig configures the comparison of two probe profiles, A and B, e.g.
+// DSCP marked vs. unmarked, IPv4 vs. IPv6, or fwmark A vs. B. Every full
+// window, Rounds pairs of STUN probes, one per profile, are sent to every
+// STUN target, alternating which profile goes first, and the paired
+// differences of their RTTs are exported.
+type abConfig struct {
+	A, B abProfile
+	// Rounds is the number of pairs of probes per target and window, 5 if
+	// zero.
+	Rounds int `json:",omitempty"`
+}
+
+// abProfile is a profile compared by an abConfig.
+type abProfile struct {
+	// Name identifies the profile in the profile label of metrics.
+	Name string
+	// DSCP is the DSCP probes are marked with.
+	DSCP int `json:",omitempty"`
+	// Mark is the fwmark (SO_MARK) of probes on Linux, e.g. to route them
+	// via another uplink by policy routing. It requires CAP_NET_ADMIN.
+	Mark int `json:",omitempty"`
+	// Family is the address family of the target's address probed,
+	// "ipv4" or "ipv6", or "ipv4" if empty.
+	Family string `json:",omitempty"`
+}
+
+func (c *abConfig) validate() error {
+	if c.Rounds < 0 || c.Rounds > abMaxRounds {
+		return fmt.Errorf("rounds must be >= 0 and <= %d", abMaxRounds)
+	}
+	for _, p := range []abProfile{c.A, c.B} {
+		if p.Name == "" {
+			return errors.New("profile with empty name")
+		}
+		if p.DSCP < 0 || p.DSCP > 63 {
+			return fmt.Errorf("profile %q: DSCP must be >= 0 and <= 63", p.Name)
+		}
+		if p.Mark < 0 {
+			return fmt.Errorf("profile %q: invalid mark %d", p.Name, p.Mark)
+		}
+		if p.Family != "" && p.Family != abProfileFamilyIPv4 && p.Family != abProfileFamilyIPv6 {
+			return fmt.Errorf("profile %q: unknown family %q, want %s or %s", p.Name, p.Family, abProfileFamilyIPv4, abProfileFamilyIPv6)
+		}
+	}
+	if c.A.Name == c.B.Name {
+		return fmt.Errorf("profiles share the name %q", c.A.Name)
+	}
+	a, b := c.A, c.B
+	a.Name, b.Name = "", ""
+	a.Family, b.Family = cmp.Or(a.Family, abProfileFamilyIPv4), cmp.Or(b.Family, abProfileFamilyIPv4)
+	if a == b {
+		return errors.New("profiles are identical")
+	}
+	return nil
+}
+
+func (c *abConfig) rounds() int {
+	return cmp.Or(c.Rounds, abDefaultRounds)
+}
+
+// abResult is the outcome of the pairs of probes of an abConfig to a target
+// in a window.
+type abResult struct {
+	meta nodeMeta // of the address probed with profile A
+	port int
+	at   time.Time
+	// rtts are the RTTs of every round by profile, nil if lost.
+	rtts [2][]*time.Duration
+}
+
+// abStats are the statistics of an abResult.
+type abStats struct {
+	Hostname string
+	Port     int
+	At       time.Time
+	// Medians and Loss are by profile, A first.
+	Medians [2]time.Duration
+	Loss    [2]float64
+	// Pairs is the number of rounds in which both profiles were answered,
+	// MeanDiff the mean of their differences in RTT, B minus A, and CI95
+	// the half-width of its 95% confidence interval, by the normal
+	// approximation, if Pairs > 1.
+	Pairs    int
+	MeanDiff time.Duration
+	CI95     time.Duration
+}
+
+func (r abResult) stats() abStats {
+	st := abStats{Hostname: r.meta.hostname, Port: r.port, At: r.at}
+	var diffs []float64
+	for p := range r.rtts {
+		var got []time.Duration
+		for _, rtt := range r.rtts[p] {
+			if rtt != nil {
+				got = append(got, *rtt)
+			}
+		}
+		if len(got) > 0 {
+			st.Medians[p] = medianOf(got)
+		}
+		if n := len(r.rtts[p]); n > 0 {
+			st.Loss[p] = float64(n-len(got)) / float64(n)
+		}
+	}
+	for i := range min(len(r.rtts[0]), len(r.rtts[1])) {
+		if a, b := r.rtts[0][i], r.rtts[1][i]; a != nil && b != nil {
+			diffs = append(diffs, float64(*b-*a))
+		}
+	}
+	st.Pairs = len(diffs)
+	if st.Pairs == 0 {
+		return st
+	}
+	var sum float64
+	for _, d := range diffs {
+		sum += d
+	}
+	mean := sum / float64(len(diffs))
+	st.MeanDiff = time.Duration(mean)
+	if len(diffs) > 1 {
+		var ss float64
+		for _, d := range diffs {
+			ss += (d - mean) * (d - mean)
+		}
+		sd := math.Sqrt(ss / float64(len(diffs)-1))
+		st.CI95 = time.Duration(1.96 * sd / math.Sqrt(float64(len(diffs))))
+	}
+	return st
+}
+
+// abConn is a socket probing with an abProfile.
+type abConn struct {
+	c   *net.UDPConn
+	dst netip.AddrPort
+}
+
+// listenAB returns a socket sending to dst with the markings of p.
+func listenAB(p abProfile, dst netip.AddrPort) (*net.UDPConn, error) {
+	network := "udp4"
+	if dst.Addr().Is6() {
+		network = "udp6"
+	}
+	c, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.DSCP != 0 {
+		if dst.Addr().Is4() {
+			err = ipv4.NewConn(c).SetTOS(p.DSCP << 2)
+		} else {
+			err = ipv6.NewConn(c).SetTrafficClass(p.DSCP << 2)
+		}
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("error setting DSCP: %w", err)
+		}
+	}
+	if p.Mark != 0 {
+		if err := setSocketMark(c, p.Mark); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("error setting mark: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// measureAB sends the rounds of pairs of STUN probes of cfg to dsts, the
+// addresses of the target to probe with profiles A and B respectively.
+func measureAB(ctx context.Context, cfg *abConfig, meta nodeMeta, dsts [2]netip.AddrPort) (abResult, error) {
+	rounds := cfg.rounds()
+	r := abResult{meta: meta, port: int(dsts[0].Port()), at: time.Now()}
+	deadline := deadlineWithin(ctx, txRxTimeout+time.Duration(2*rounds)*abSpacing)
+	var conns [2]*net.UDPConn
+	for i, p := range []abProfile{cfg.A, cfg.B} {
+		c, err := listenAB(p, dsts[i])
+		if err != nil {
+			for _, c := range conns[:i] {
+				c.Close()
+			}
+			return r, err
+		}
+		defer c.Close()
+		c.SetReadDeadline(deadline)
+		conns[i] = c
+		r.rtts[i] = make([]*time.Duration, rounds)
+	}
+
+	type probe struct {
+		profile, round int
+		txAt           time.Time
+	}
+	var (
+		mu     sync.Mutex
+		probes = make(map[stun.TxID]probe)
+		wg     sync.WaitGroup
+	)
+	for _, c := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := make([]byte, 1500)
+			for {
+				n, err := c.Read(b)
+				rxAt := time.Now()
+				if err != nil {
+					return
+				}
+				txID, _, err := stun.ParseResponse(b[:n])
+				if err != nil {
+					continue
+				}
+				mu.Lock()
+				if p, ok := probes[txID]; ok {
+					rtt := rxAt.Sub(p.txAt)
+					r.rtts[p.profile][p.round] = &rtt
+					delete(probes, txID)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for round := range rounds {
+		// Alternate which profile goes first, so that neither
+		// systematically pays for waking the path.
+		order := []int{0, 1}
+		if round%2 == 1 {
+			order = []int{1, 0}
+		}
+		for _, profile := range order {
+			txID := stun.NewTxID()
+			mu.Lock()
+			probes[txID] = probe{profile: profile, round: round, txAt: time.Now()}
+			mu.Unlock()
+			if _, err := conns[profile].WriteToUDPAddrPort(stun.Request(txID), dsts[profile]); err != nil {
+				probeLog.Debug("error sending A/B probe", "hostname", meta.hostname, "profile", profile, "err", err)
+			}
+			time.Sleep(abSpacing)
+		}
+	}
+	for {
+		mu.Lock()
+		outstanding := len(probes)
+		mu.Unlock()
+		if outstanding == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(abSpacing)
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	wg.Wait()
+	return r, nil
+}
+
+// abTargets returns the addresses to probe with profiles A and B of cfg of
+// every hostname of targets, by the target of profile A. Hostnames lacking
+// an address of the family of either profile are omitted.
+func abTargets(cfg *abConfig, targets map[netip.Addr]nodeMeta) map[nodeMeta][2]netip.Addr {
+	byHost := make(map[string]map[string]nodeMeta)
+	for addr, meta := range targets {
+		family := abProfileFamilyIPv4
+		if addr.Is6() {
+			family = abProfileFamilyIPv6
+		}
+		if byHost[meta.hostname] == nil {
+			byHost[meta.hostname] = make(map[string]nodeMeta)
+		}
+		byHost[meta.hostname][family] = meta
+	}
+	ret := make(map[nodeMeta][2]netip.Addr)
+	for _, families := range byHost {
+		a, okA := families[cmp.Or(cfg.A.Family, abProfileFamilyIPv4)]
+		b, okB := families[cmp.Or(cfg.B.Family, abProfileFamilyIPv4)]
+		if okA && okB {
+			ret[a] = [2]netip.Addr{a.addr, b.addr}
+		}
+	}
+	return ret
+}
+
+// measureAllAB measures the profiles of cfg to every target on each of its
+// STUN ports concurrently. It returns nil if cfg is nil.
+func measureAllAB(ctx context.Context, cfg *abConfig, targets map[netip.Addr]nodeMeta, portsFor func(nodeMeta) []int) []abResult {
+	if cfg == nil {
+		return nil
+	}
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results []abResult
+	)
+	for meta, addrs := range abTargets(cfg, targets) {
+		for _, port := range portsFor(meta) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				dsts := [2]netip.AddrPort{netip.AddrPortFrom(addrs[0], uint16(port)), netip.AddrPortFrom(addrs[1], uint16(port))}
+				r, err := measureAB(ctx, cfg, meta, dsts)
+				if err != nil {
+					probeLog.Debug("error measuring A/B profiles", "hostname", meta.hostname, "port", port, "err", err)
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				results = append(results, r)
+			}()
+		}
+	}
+	wg.Wait()
+	return results
+}
+
+// abKey identifies the timeseries of a target compared by A/B profiles.
+type abKey struct {
+	meta     nodeMeta
+	port     int
+	profiles [2]string
+}
+
+// abTracker exports the statistics of A/B comparisons and tracks the
+// timeseries written. It is safe for concurrent use.
+type abTracker struct {
+	mu     sync.Mutex
+	seen   map[abKey]bool
+	latest []abStats
+}
+
+func newABTracker() *abTracker {
+	return &abTracker{seen: make(map[abKey]bool)}
+}
+
+// active reports whether timeseries were written that may need stale
+// markers.
+func (t *abTracker) active() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.seen) > 0
+}
+
+func abTimeSeriesLabels(metricName string, k abKey, profile, instance string) []prompb.Label {
+	labels := timeSeriesLabels(metricName, k.meta, instance, timestampSourceUserspace, unstableConn, protocolSTUN, k.port)
+	labels = append(labels,
+		prompb.Label{Name: "profile_a", Value: k.profiles[0]},
+		prompb.Label{Name: "profile_b", Value: k.profiles[1]},
+	)
+	if profile != "" {
+		labels = append(labels, prompb.Label{Name: "profile", Value: profile})
+	}
+	slices.SortFunc(labels, func(a, b prompb.Label) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return labels
+}
+
+// abSeries returns the timeseries of k, by profile where applicable, with
+// the values of st, or stale markers if st is nil.
+func abSeries(k abKey, st *abStats, instance string, at time.Time) []prompb.TimeSeries {
+	value := func(v float64) float64 {
+		if st == nil {
+			return math.Float64frombits(staleNaN)
+		}
+		return v
+	}
+	var ts []prompb.TimeSeries
+	add := func(name, profile string, v float64) {
+		ts = append(ts, prompb.TimeSeries{
+			Labels:  abTimeSeriesLabels(name, k, profile, instance),
+			Samples: []prompb.Sample{{Timestamp: at.UnixMilli(), Value: value(v)}},
+		})
+	}
+	var s abStats
+	if st != nil {
+		s = *st
+	}
+	for i, profile := range k.profiles {
+		rtt := math.NaN()
+		if s.Loss[i] < 1 {
+			rtt = s.Medians[i].Seconds()
+		}
+		add(abRTTMetricName, profile, rtt)
+		add(abLossMetricName, profile, s.Loss[i])
+	}
+	diff, ci := math.NaN(), math.NaN()
+	if s.Pairs > 0 {
+		diff = s.MeanDiff.Seconds()
+	}
+	if s.Pairs > 1 {
+		ci = s.CI95.Seconds()
+	}
+	add(abDiffMetricName, "", diff)
+	add(abDiffCIMetricName, "", ci)
+	add(abPairsMetricName, "", float64(s.Pairs))
+	return ts
+}
+
+// update records the results of the profiles of cfg, returning their
+// timeseries, and stale markers for those absent from results.
+func (t *abTracker) update(cfg *abConfig, results []abResult, instance string) []prompb.TimeSeries {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var ts []prompb.TimeSeries
+	current := make(map[abKey]bool)
+	t.latest = t.latest[:0]
+	for _, r := range results {
+		k := abKey{r.meta, r.port, [2]string{cfg.A.Name, cfg.B.Name}}
+		current[k] = true
+		t.seen[k] = true
+		st := r.stats()
+		t.latest = append(t.latest, st)
+		ts = append(ts, abSeries(k, &st, instance, r.at)...)
+	}
+	slices.SortFunc(t.latest, func(a, b abStats) int {
+		return cmp.Or(cmp.Compare(a.Hostname, b.Hostname), cmp.Compare(a.Port, b.Port))
+	})
+	now := time.Now()
+	for k := range t.seen {
+		if current[k] {
+			continue
+		}
+		ts = append(ts, abSeries(k, nil, instance, now)...)
+		delete(t.seen, k)
+	}
+	return ts
+}
+
+// staleMarkers returns stale markers for the A/B series of every target
+// compared.
+func (t *abTracker) staleMarkers(instance string) []prompb.TimeSeries {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	var ts []prompb.TimeSeries
+	for k := range t.seen {
+		ts = append(ts, abSeries(k, nil, instance, now)...)
+	}
+	return ts
+}
+
+// stats returns the statistics of the last full window, by target.
+func (t *abTracker) stats() []abStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.latest)
+}
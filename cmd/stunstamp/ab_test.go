@@ -0,0 +1,129 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"math"
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/net/stun/stuntest"
+)
+
+func TestABConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cfg  abConfig
+		ok   bool
+	}{
+		{"dscp", abConfig{A: abProfile{Name: "unmarked"}, B: abProfile{Name: "ef", DSCP: 46}}, true},
+		{"families", abConfig{A: abProfile{Name: "v4"}, B: abProfile{Name: "v6", Family: "ipv6"}}, true},
+		{"identical", abConfig{A: abProfile{Name: "a"}, B: abProfile{Name: "b", Family: "ipv4"}}, false},
+		{"same name", abConfig{A: abProfile{Name: "a"}, B: abProfile{Name: "a", DSCP: 46}}, false},
+		{"no name", abConfig{A: abProfile{}, B: abProfile{Name: "b", DSCP: 46}}, false},
+		{"dscp range", abConfig{A: abProfile{Name: "a"}, B: abProfile{Name: "b", DSCP: 64}}, false},
+		{"family", abConfig{A: abProfile{Name: "a"}, B: abProfile{Name: "b", Family: "inet6"}}, false},
+		{"rounds", abConfig{A: abProfile{Name: "a"}, B: abProfile{Name: "b", DSCP: 46}, Rounds: abMaxRounds + 1}, false},
+	} {
+		if err := tt.cfg.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestMeasureAB(t *testing.T) {
+	stunAddr, cleanup := stuntest.Serve(t)
+	defer cleanup()
+	meta := nodeMeta{hostname: "local", addr: netip.MustParseAddr("127.0.0.1")}
+	cfg := &abConfig{A: abProfile{Name: "unmarked"}, B: abProfile{Name: "ef", DSCP: 46}, Rounds: 4}
+	dst := netip.AddrPortFrom(meta.addr, uint16(stunAddr.Port))
+	r, err := measureAB(context.Background(), cfg, meta, [2]netip.AddrPort{dst, dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := r.stats()
+	if st.Pairs != 4 || st.Loss != [2]float64{0, 0} || st.Medians[0] <= 0 || st.Medians[1] <= 0 {
+		t.Errorf("stats = %+v, want 4 pairs without loss", st)
+	}
+}
+
+func TestABStats(t *testing.T) {
+	ms := func(v ...float64) []*time.Duration {
+		var ret []*time.Duration
+		for _, v := range v {
+			if v < 0 {
+				ret = append(ret, nil)
+				continue
+			}
+			d := time.Duration(v * float64(time.Millisecond))
+			ret = append(ret, &d)
+		}
+		return ret
+	}
+	r := abResult{rtts: [2][]*time.Duration{
+		ms(10, 12, -1, 11),
+		ms(11, 14, 13, 13),
+	}}
+	st := r.stats()
+	// The third round lacks A's reply, leaving differences of 1, 2, and 2ms.
+	if st.Pairs != 3 || st.Loss != [2]float64{0.25, 0} {
+		t.Fatalf("stats = %+v, want 3 pairs and A losing 1 of 4", st)
+	}
+	if want := 5 * time.Millisecond / 3; st.MeanDiff != want {
+		t.Errorf("mean diff = %v, want %v", st.MeanDiff, want)
+	}
+	// The sample standard deviation of 1, 2, and 2ms is 1/sqrt(3)ms.
+	want := 1960 * time.Microsecond / 3
+	if d := st.CI95 - want; d < -time.Microsecond || d > time.Microsecond {
+		t.Errorf("CI95 = %v, want %v", st.CI95, want)
+	}
+	if st.Medians[0] != 11*time.Millisecond || st.Medians[1] != 13*time.Millisecond {
+		t.Errorf("medians = %v", st.Medians)
+	}
+}
+
+func TestABTargets(t *testing.T) {
+	v4 := nodeMeta{hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	v6 := nodeMeta{hostname: "1a", addr: netip.MustParseAddr("2001:db8::1")}
+	only4 := nodeMeta{hostname: "2a", addr: netip.MustParseAddr("192.0.2.2")}
+	targets := map[netip.Addr]nodeMeta{v4.addr: v4, v6.addr: v6, only4.addr: only4}
+
+	cfg := &abConfig{A: abProfile{Name: "v4"}, B: abProfile{Name: "v6", Family: abProfileFamilyIPv6}}
+	got := abTargets(cfg, targets)
+	if len(got) != 1 || got[v4] != [2]netip.Addr{v4.addr, v6.addr} {
+		t.Errorf("abTargets = %v, want only the dual-stack target", got)
+	}
+	cfg = &abConfig{A: abProfile{Name: "a"}, B: abProfile{Name: "b", DSCP: 46}}
+	if got := abTargets(cfg, targets); len(got) != 2 || got[only4] != [2]netip.Addr{only4.addr, only4.addr} {
+		t.Errorf("abTargets = %v, want both IPv4 targets", got)
+	}
+}
+
+func TestABTracker(t *testing.T) {
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	cfg := &abConfig{A: abProfile{Name: "a"}, B: abProfile{Name: "b", DSCP: 46}}
+	a, b := time.Millisecond, 2*time.Millisecond
+	tr := newABTracker()
+	// RTT and loss per profile, and the difference, its CI, and pairs.
+	const perTarget = 7
+	ts := tr.update(cfg, []abResult{{meta: meta, port: 3478, at: time.Now(), rtts: [2][]*time.Duration{{&a, &a}, {&b, &b}}}}, "test")
+	if len(ts) != perTarget {
+		t.Fatalf("got %d timeseries, want %d", len(ts), perTarget)
+	}
+	if st := tr.stats(); len(st) != 1 || st[0].MeanDiff != time.Millisecond || st[0].CI95 != 0 {
+		t.Errorf("stats = %+v", st)
+	}
+	if !tr.active() {
+		t.Error("tracker with timeseries not active")
+	}
+	ts = tr.update(nil, nil, "test")
+	if len(ts) != perTarget || math.Float64bits(ts[0].Samples[0].Value) != staleNaN {
+		t.Errorf("expected stale markers once unconfigured, got %v", ts)
+	}
+	if tr.active() || len(tr.staleMarkers("test")) != 0 {
+		t.Error("unconfigured comparison still tracked")
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// annotationSource is the origin of an annotation.
+type annotationSource string
+
+const (
+	// annotationSourceManual annotations are created via the API or CLI.
+	annotationSourceManual annotationSource = "manual"
+	// annotationSourceAuto annotations are created by stunstamp itself,
+	// e.g. on restart or a change in hop count.
+	annotationSourceAuto annotationSource = "auto"
+)
+
+// annotation is a note attached to a time range, e.g. "ISP maintenance" or
+// "firmware upgraded", explaining a discontinuity in results.
+type annotation struct {
+	ID   string
+	From time.Time
+	// To is equal to From for annotations of a point in time.
+	To   time.Time
+	Text string
+	// Hostname optionally scopes the annotation to a single target.
+	Hostname string `json:",omitempty"`
+	Source   annotationSource
+	// Deleted marks a record in the store as deleting the annotation with
+	// the same ID.
+	Deleted bool `json:",omitempty"`
+}
+
+const (
+	annotationMetricName = "stunstamp_annotation"
+	annotationsFileName  = "annotations.jsonl"
+	maxAnnotationTextLen = 1024
+)
+
+var (
+	errAnnotationNotFound  = errors.New("annotation not found")
+	errAnnotationsReadOnly = errors.New("annotations are read-only")
+	errInvalidAnnotation   = errors.New("invalid annotation")
+)
+
+// annotationStore holds annotations, persisting them to an append-only file
+// in the store directory if configured. It is safe for concurrent use.
+type annotationStore struct {
+	mu       sync.Mutex
+	path     string // empty if not persisting
+	readOnly bool
+	byID     map[string]annotation
+}
+
+// annotations is the process-wide annotationStore.
+var annotations = &annotationStore{byID: make(map[string]annotation)}
+
+// open loads the annotations persisted in the store directory dir, and
+// configures s to persist to it unless readOnly.
+func (s *annotationStore) open(dir string, readOnly bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = filepath.Join(dir, annotationsFileName)
+	s.readOnly = readOnly
+	return s.loadLocked()
+}
+
+// reload reloads annotations from the store directory, picking up those
+// written by another process.
+func (s *annotationStore) reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadLocked()
+}
+
+func (s *annotationStore) loadLocked() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	byID := make(map[string]annotation)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var a annotation
+		if err := json.Unmarshal(scanner.Bytes(), &a); err != nil {
+			continue // e.g. torn trailing write
+		}
+		if a.Deleted {
+			delete(byID, a.ID)
+		} else {
+			byID[a.ID] = a
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading %s: %w", s.path, err)
+	}
+	s.byID = byID
+	return nil
+}
+
+func (s *annotationStore) writeLocked(a annotation) error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (a *annotation) validate() error {
+	if len(a.Text) == 0 || len(a.Text) > maxAnnotationTextLen {
+		return fmt.Errorf("%w: Text must be between 1 and %d bytes", errInvalidAnnotation, maxAnnotationTextLen)
+	}
+	if a.From.IsZero() {
+		return fmt.Errorf("%w: From is unset", errInvalidAnnotation)
+	}
+	if a.To.Before(a.From) {
+		return fmt.Errorf("%w: To is before From", errInvalidAnnotation)
+	}
+	return nil
+}
+
+// add assigns a an ID and stores it. A zero a.To is set to a.From.
+func (s *annotationStore) add(a annotation) (annotation, error) {
+	if a.To.IsZero() {
+		a.To = a.From
+	}
+	a.ID = newMeasurementID()
+	a.Deleted = false
+	if err := a.validate(); err != nil {
+		return annotation{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readOnly {
+		return annotation{}, errAnnotationsReadOnly
+	}
+	if err := s.writeLocked(a); err != nil {
+		return annotation{}, err
+	}
+	s.byID[a.ID] = a
+	return a, nil
+}
+
+// annotateAuto adds an automatic annotation, logging any error.
+func (s *annotationStore) annotateAuto(from, to time.Time, hostname, text string) {
+	_, err := s.add(annotation{
+		From:     from,
+		To:       to,
+		Text:     text,
+		Hostname: hostname,
+		Source:   annotationSourceAuto,
+	})
+	if err != nil {
+		storeLog.Error("error adding annotation", "text", text, "err", err)
+	}
+}
+
+// remove deletes the annotation with id.
+func (s *annotationStore) remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readOnly {
+		return errAnnotationsReadOnly
+	}
+	a, ok := s.byID[id]
+	if !ok {
+		return errAnnotationNotFound
+	}
+	a.Deleted = true
+	if err := s.writeLocked(a); err != nil {
+		return err
+	}
+	delete(s.byID, id)
+	return nil
+}
+
+// overlapping returns the annotations overlapping the closed interval
+// [from, to], ordered by From.
+func (s *annotationStore) overlapping(from, to time.Time) []annotation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret []annotation
+	for _, a := range s.byID {
+		if !a.From.After(to) && !a.To.Before(from) {
+			ret = append(ret, a)
+		}
+	}
+	slices.SortFunc(ret, func(a, b annotation) int {
+		if c := a.From.Compare(b.From); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return ret
+}
+
+// toPromTimeSeries returns a sample at to with value 1 for every annotation
+// overlapping [from, to), the time since the previous call. Annotations are
+// thereby exported while they are in effect, and once for a point in time.
+// Annotations added retroactively for a range that has since ended are only
+// available via the API.
+func (s *annotationStore) toPromTimeSeries(from, to time.Time, instance string) []prompb.TimeSeries {
+	var ts []prompb.TimeSeries
+	for _, a := range s.overlapping(from, to) {
+		if !a.From.Before(to) {
+			continue
+		}
+		t := instanceTimeSeries(annotationMetricName, instance, to, 1)
+		t.Labels = append(t.Labels,
+			prompb.Label{Name: "annotation_id", Value: a.ID},
+			prompb.Label{Name: "source", Value: string(a.Source)},
+			prompb.Label{Name: "text", Value: a.Text},
+		)
+		if a.Hostname != "" {
+			t.Labels = append(t.Labels, prompb.Label{Name: "hostname", Value: a.Hostname})
+		}
+		slices.SortFunc(t.Labels, func(a, b prompb.Label) int {
+			return cmp.Compare(a.Name, b.Name)
+		})
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+// runAnnotate adds a manual annotation via the API of the stunstamp process
+// serving on httpAddr, and prints it as JSON.
+func runAnnotate(httpAddr, text, from, to, hostname string) error {
+	a := annotation{
+		Text:     text,
+		Hostname: hostname,
+		From:     time.Now(),
+	}
+	var err error
+	if from != "" {
+		if a.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return fmt.Errorf("invalid annotate-from: %w", err)
+		}
+	}
+	if to != "" {
+		if a.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return fmt.Errorf("invalid annotate-to: %w", err)
+		}
+	}
+	host, port, err := net.SplitHostPort(httpAddr)
+	if err != nil {
+		return fmt.Errorf("invalid http-addr: %w", err)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post("http://"+net.JoinHostPort(host, port)+"/api/annotations", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	_, err = os.Stdout.Write(body)
+	return err
+}
@@ -0,0 +1,118 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnnotationStore(t *testing.T) {
+	dir := t.TempDir()
+	s := &annotationStore{byID: make(map[string]annotation)}
+	if err := s.open(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2024, 7, 1, 2, 0, 0, 0, time.UTC)
+	maint, err := s.add(annotation{From: t0, To: t0.Add(2 * time.Hour), Text: "ISP maintenance", Source: annotationSourceManual})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgrade, err := s.add(annotation{From: t0.Add(3 * time.Hour), Text: "firmware upgraded", Source: annotationSourceManual})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !upgrade.To.Equal(upgrade.From) {
+		t.Errorf("point annotation To = %v, want %v", upgrade.To, upgrade.From)
+	}
+	if _, err := s.add(annotation{From: t0, To: t0.Add(-time.Second), Text: "backwards"}); err == nil {
+		t.Error("add of annotation with To before From unexpectedly succeeded")
+	}
+
+	ids := func(anns []annotation) []string {
+		var ret []string
+		for _, a := range anns {
+			ret = append(ret, a.ID)
+		}
+		return ret
+	}
+	if got := ids(s.overlapping(t0.Add(time.Hour), t0.Add(4*time.Hour))); len(got) != 2 || got[0] != maint.ID || got[1] != upgrade.ID {
+		t.Errorf("overlapping() = %v, want [%s %s]", got, maint.ID, upgrade.ID)
+	}
+	if got := s.overlapping(t0.Add(2*time.Hour+time.Second), t0.Add(3*time.Hour-time.Second)); len(got) != 0 {
+		t.Errorf("overlapping() between annotations = %v, want none", ids(got))
+	}
+
+	// Exported once for the window holding a point in time, and for every
+	// window overlapping a range.
+	if got := s.toPromTimeSeries(t0.Add(3*time.Hour), t0.Add(3*time.Hour+time.Minute), "i"); len(got) != 1 {
+		t.Errorf("got %d time series for window starting at point annotation, want 1", len(got))
+	}
+	if got := s.toPromTimeSeries(t0.Add(3*time.Hour-time.Minute), t0.Add(3*time.Hour), "i"); len(got) != 0 {
+		t.Errorf("got %d time series for window ending at point annotation, want 0", len(got))
+	}
+	if got := s.toPromTimeSeries(t0.Add(time.Hour), t0.Add(time.Hour+time.Minute), "i"); len(got) != 1 {
+		t.Errorf("got %d time series for window within range annotation, want 1", len(got))
+	}
+
+	if err := s.remove(maint.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.remove(maint.ID); err != errAnnotationNotFound {
+		t.Errorf("second remove() = %v, want %v", err, errAnnotationNotFound)
+	}
+
+	ro := &annotationStore{byID: make(map[string]annotation)}
+	if err := ro.open(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(ro.overlapping(t0, t0.Add(24*time.Hour))); len(got) != 1 || got[0] != upgrade.ID {
+		t.Errorf("reloaded annotations = %v, want [%s]", got, upgrade.ID)
+	}
+	if _, err := ro.add(annotation{From: t0, Text: "x"}); err != errAnnotationsReadOnly {
+		t.Errorf("add() to read-only store = %v, want %v", err, errAnnotationsReadOnly)
+	}
+}
+
+func TestAnnotationsAPI(t *testing.T) {
+	old := annotations
+	annotations = &annotationStore{byID: make(map[string]annotation)}
+	defer func() { annotations = old }()
+
+	srv := httptest.NewServer((&httpServer{baselines: newBaselineTracker()}).mux())
+	defer srv.Close()
+	httpAddr := strings.TrimPrefix(srv.URL, "http://")
+
+	from := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	if err := runAnnotate(httpAddr, "ISP maintenance", from.Format(time.RFC3339), "", "derp1a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runAnnotate(httpAddr, "", "", "", ""); err == nil {
+		t.Error("annotating with empty text unexpectedly succeeded")
+	}
+
+	rec := httptest.NewRecorder()
+	srv.Config.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/annotations", nil))
+	var got []annotation
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Text != "ISP maintenance" || got[0].Source != annotationSourceManual || got[0].Hostname != "derp1a" || !got[0].From.Equal(from) {
+		t.Fatalf("GET /api/annotations = %+v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.Config.Handler.ServeHTTP(rec, httptest.NewRequest("DELETE", "/api/annotations/"+got[0].ID, nil))
+	if rec.Code != 204 {
+		t.Errorf("DELETE status = %d, want 204", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	srv.Config.Handler.ServeHTTP(rec, httptest.NewRequest("DELETE", "/api/annotations/"+got[0].ID, nil))
+	if rec.Code != 404 {
+		t.Errorf("second DELETE status = %d, want 404", rec.Code)
+	}
+}
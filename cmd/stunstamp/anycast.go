@@ -0,0 +1,172 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// eventKindInstanceChange is a change of the server instance answering
+// probes of a target, e.g. an anycast address being routed to a different
+// site, which commonly explains a step in RTT.
+const eventKindInstanceChange eventKind = "instance_change"
+
+const (
+	stunAttrSoftware       = 0x8022
+	stunAttrResponseOrigin = 0x802b
+	stunHeaderLen          = 20
+)
+
+// stunResponseInstance returns the identity of the STUN server instance that
+// sent the response b, if it says: its RESPONSE-ORIGIN address (RFC 5780),
+// which for an anycast service is typically the instance's unicast address,
+// or failing that its SOFTWARE description. Malformed attributes are
+// ignored.
+func stunResponseInstance(b []byte) string {
+	if len(b) < stunHeaderLen {
+		return ""
+	}
+	var software string
+	for b = b[stunHeaderLen:]; len(b) >= 4; {
+		typ := binary.BigEndian.Uint16(b)
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			break
+		}
+		v := b[4 : 4+n]
+		switch typ {
+		case stunAttrResponseOrigin:
+			// Family at v[1], port at v[2:4], address following.
+			if len(v) >= 8 {
+				if addr, ok := netip.AddrFromSlice(v[4:]); ok {
+					return "origin=" + addr.Unmap().String()
+				}
+			}
+		case stunAttrSoftware:
+			software = strings.TrimRight(string(v), "\x00")
+		}
+		// Attributes are padded to a multiple of 4 bytes.
+		b = b[min(len(b), 4+(n+3)&^3):]
+	}
+	if software != "" {
+		return "software=" + software
+	}
+	return ""
+}
+
+// instanceHeaders are HTTP response headers identifying the instance of a
+// CDN or load balancer that served a request, along with how to extract the
+// identity from their values.
+var instanceHeaders = []struct {
+	name    string
+	extract func(string) string
+}{
+	// Cloudflare's ray ID ends with the serving colo, e.g. 8a1b2c3d4e5f-FRA.
+	{"Cf-Ray", func(v string) string {
+		if _, colo, ok := strings.Cut(v, "-"); ok {
+			return colo
+		}
+		return ""
+	}},
+	{"X-Amz-Cf-Pop", strings.TrimSpace},
+	{"X-Served-By", strings.TrimSpace},
+}
+
+// httpsResponseInstance returns the identity of the server instance that sent
+// resp over a connection in state cs: a CDN instance identifying header, or
+// failing that a fingerprint of the leaf certificate, as the instances of an
+// anycast service commonly hold distinct certificates for the same names.
+func httpsResponseInstance(resp *http.Response, cs tls.ConnectionState) string {
+	for _, h := range instanceHeaders {
+		if v := resp.Header.Get(h.name); v != "" {
+			if id := h.extract(v); id != "" {
+				return strings.ToLower(h.name) + "=" + id
+			}
+		}
+	}
+	if len(cs.PeerCertificates) > 0 {
+		sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+		return "cert=" + hex.EncodeToString(sum[:8])
+	}
+	return ""
+}
+
+// instanceTracker tracks the server instance last answering the probes of
+// every stable conn. Unstable conns are not tracked, as a different 5-tuple
+// every window may legitimately be hashed to a different instance. It is
+// only used from the main loop.
+type instanceTracker struct {
+	last map[resultKey]string
+}
+
+func newInstanceTracker() *instanceTracker {
+	return &instanceTracker{last: make(map[resultKey]string)}
+}
+
+// observe records the instances that answered results at at, returning
+// events describing changes, at most one per target, protocol, and port,
+// ordered by hostname. Proxied results are ignored, as they take a
+// different path.
+func (t *instanceTracker) observe(results []result, at time.Time) []event {
+	var ret []event
+	changed := make(map[stableConnKey]bool)
+	for _, r := range results {
+		if r.instance == "" || r.key.proxy != "" || r.key.connStability != stableConn {
+			continue
+		}
+		prev, ok := t.last[r.key]
+		t.last[r.key] = r.instance
+		k := stableConnKey{r.key.meta.addr, r.key.protocol, r.key.dstPort}
+		if !ok || prev == r.instance || changed[k] {
+			continue
+		}
+		changed[k] = true
+		ret = append(ret, event{
+			At:         at,
+			Kind:       eventKindInstanceChange,
+			Addr:       r.key.meta.addr,
+			RegionID:   r.key.meta.regionID,
+			RegionCode: r.key.meta.regionCode,
+			Hostname:   r.key.meta.hostname,
+			Protocol:   r.key.protocol,
+			Attrs: map[string]string{
+				"port": fmt.Sprint(r.key.dstPort),
+				"old":  prev,
+				"new":  r.instance,
+			},
+		})
+	}
+	slices.SortFunc(ret, func(a, b event) int {
+		if c := cmp.Compare(a.Hostname, b.Hostname); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Protocol, b.Protocol)
+	})
+	return ret
+}
+
+// forget drops the instances of keys for which keep returns false, e.g. of
+// targets no longer probed.
+func (t *instanceTracker) forget(keep func(resultKey) bool) {
+	for k := range t.last {
+		if !keep(k) {
+			delete(t.last, k)
+		}
+	}
+}
+
+// instanceChangeText returns annotation text for an instance change event.
+func instanceChangeText(ev event) string {
+	return fmt.Sprintf("%s instance of %s port %s changed from %s to %s", ev.Protocol, ev.Hostname, ev.Attrs["port"], ev.Attrs["old"], ev.Attrs["new"])
+}
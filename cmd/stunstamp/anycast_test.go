@@ -0,0 +1,88 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/net/stun"
+)
+
+func TestSTUNResponseInstance(t *testing.T) {
+	resp := stun.Response(stun.NewTxID(), netip.MustParseAddrPort("198.51.100.1:1234"))
+	software := []byte{0x80, 0x22, 0, 5, 'd', 'e', 'r', 'p', '1', 0, 0, 0}
+	origin := []byte{0x80, 0x2b, 0, 8, 0, 1, 0x0d, 0x96, 192, 0, 2, 7}
+
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"none", resp, ""},
+		{"software", append(append([]byte{}, resp...), software...), "software=derp1"},
+		{"origin preferred", append(append(append([]byte{}, resp...), software...), origin...), "origin=192.0.2.7"},
+		{"truncated", append(append([]byte{}, resp...), origin[:6]...), ""},
+		{"short", resp[:10], ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stunResponseInstance(tt.b); got != tt.want {
+				t.Errorf("stunResponseInstance() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPSResponseInstance(t *testing.T) {
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Raw: []byte("cert")}}}
+	resp := &http.Response{Header: http.Header{}}
+	if got := httpsResponseInstance(resp, cs); got != "cert=06298432e8066b29" {
+		t.Errorf("cert instance = %q", got)
+	}
+	resp.Header.Set("Cf-Ray", "8a1b2c3d4e5f-FRA")
+	if got := httpsResponseInstance(resp, cs); got != "cf-ray=FRA" {
+		t.Errorf("Cf-Ray instance = %q", got)
+	}
+	if got := httpsResponseInstance(&http.Response{Header: http.Header{}}, tls.ConnectionState{}); got != "" {
+		t.Errorf("empty instance = %q", got)
+	}
+}
+
+func TestInstanceTracker(t *testing.T) {
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	res := func(source timestampSource, stable connStability, instance string) result {
+		return result{
+			key:      resultKey{meta: meta, timestampSource: source, connStability: stable, protocol: protocolSTUN, dstPort: 3478},
+			instance: instance,
+		}
+	}
+	tr := newInstanceTracker()
+	now := time.Now()
+	if evs := tr.observe([]result{res(timestampSourceUserspace, stableConn, "a"), res(timestampSourceKernel, stableConn, "a")}, now); len(evs) != 0 {
+		t.Fatalf("first observation: got %d events, want 0", len(evs))
+	}
+	// Unstable conns may be hashed to different instances.
+	if evs := tr.observe([]result{res(timestampSourceUserspace, unstableConn, "b")}, now); len(evs) != 0 {
+		t.Fatalf("unstable conn: got %d events, want 0", len(evs))
+	}
+	evs := tr.observe([]result{res(timestampSourceUserspace, stableConn, "b"), res(timestampSourceKernel, stableConn, "b")}, now)
+	if len(evs) != 1 {
+		t.Fatalf("change: got %d events, want 1", len(evs))
+	}
+	if ev := evs[0]; ev.Kind != eventKindInstanceChange || ev.Attrs["old"] != "a" || ev.Attrs["new"] != "b" || ev.Attrs["port"] != "3478" {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+	if got, want := instanceChangeText(evs[0]), "stun instance of 1a port 3478 changed from a to b"; got != want {
+		t.Errorf("instanceChangeText() = %q, want %q", got, want)
+	}
+	tr.forget(func(resultKey) bool { return false })
+	if len(tr.last) != 0 {
+		t.Errorf("forget left %d instances", len(tr.last))
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"tailscale.com/util/zstdframe"
+)
+
+// Days of results older than --archive-after are sealed into archive
+// segments: one zstd-compressed, checksummed file per day holding the day's
+// results in the format of results files, minus unparseable lines. Sealed days are listed in
+// the archive index, and their results files removed. Segments are immutable
+// and read transparently by resultsStore.readRange, so that years of results
+// can be kept at a fraction of the disk cost while recent results remain
+// cheap to append to and read.
+const (
+	archiveFilePrefix    = "archive-"
+	archiveFileSuffix    = ".jsonl.zst"
+	archiveIndexFileName = "archive-index.json"
+)
+
+// archiveSegment describes a sealed day of results.
+type archiveSegment struct {
+	Day     string // in storeDayLayout
+	Results int
+	// Size is the compressed size of the segment in bytes, and RawSize the
+	// size of the results it holds.
+	Size    int64
+	RawSize int64
+	// SHA256 is the hex-encoded SHA-256 digest of the segment file, verified
+	// on every read in addition to zstd's own frame checksum.
+	SHA256 string
+}
+
+// archiveIndex lists the sealed days of a store in ascending order.
+type archiveIndex struct {
+	Segments []archiveSegment
+}
+
+func (idx *archiveIndex) segment(day string) (archiveSegment, bool) {
+	i, ok := slices.BinarySearchFunc(idx.Segments, day, func(s archiveSegment, day string) int {
+		return cmp.Compare(s.Day, day)
+	})
+	if !ok {
+		return archiveSegment{}, false
+	}
+	return idx.Segments[i], true
+}
+
+func archiveFileName(day string) string {
+	return archiveFilePrefix + day + archiveFileSuffix
+}
+
+// loadArchiveIndex reads the archive index, returning an empty index if
+// nothing has been archived.
+func (s *resultsStore) loadArchiveIndex() (*archiveIndex, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, archiveIndexFileName))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &archiveIndex{}, nil
+		}
+		return nil, err
+	}
+	idx := &archiveIndex{}
+	if err := json.Unmarshal(b, idx); err != nil {
+		return nil, fmt.Errorf("error parsing archive index: %w", err)
+	}
+	return idx, nil
+}
+
+// writeFileAtomic writes b to path via a synced temporary file, so that
+// readers observe either the old or the new contents.
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// archive seals every day of results ending at or before before, except a
+// day being appended to, returning the number of days sealed.
+func (s *resultsStore) archive(before time.Time) (int, error) {
+	if s.readOnly {
+		return 0, errors.New("store is read-only")
+	}
+	days, err := s.resultsFileDays()
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx, err := s.loadArchiveIndex()
+	if err != nil {
+		return 0, err
+	}
+	var sealed int
+	for _, day := range days {
+		t, _ := time.Parse(storeDayLayout, day)
+		if t.AddDate(0, 0, 1).After(before) || (s.f != nil && day == s.day) {
+			continue
+		}
+		path := filepath.Join(s.dir, resultsFileName(day))
+		if _, ok := idx.segment(day); ok {
+			// Sealed, but not removed before a crash.
+			if err := os.Remove(path); err != nil {
+				return sealed, err
+			}
+			continue
+		}
+		seg, err := s.sealLocked(day)
+		if err != nil {
+			return sealed, fmt.Errorf("error sealing %s: %w", day, err)
+		}
+		i, _ := slices.BinarySearchFunc(idx.Segments, day, func(s archiveSegment, day string) int {
+			return cmp.Compare(s.Day, day)
+		})
+		idx.Segments = slices.Insert(idx.Segments, i, seg)
+		b, err := json.MarshalIndent(idx, "", "\t")
+		if err != nil {
+			return sealed, err
+		}
+		if err := writeFileAtomic(filepath.Join(s.dir, archiveIndexFileName), b); err != nil {
+			return sealed, err
+		}
+		if err := os.Remove(path); err != nil {
+			return sealed, err
+		}
+		storeLog.Info("sealed results into archive segment", "day", day, "results", seg.Results, "size", seg.Size, "raw_size", seg.RawSize)
+		sealed++
+	}
+	return sealed, nil
+}
+
+// sealLocked writes the archive segment of day, returning its description.
+func (s *resultsStore) sealLocked(day string) (archiveSegment, error) {
+	seg := archiveSegment{Day: day}
+	var raw []byte
+	err := readResultsFile(filepath.Join(s.dir, resultsFileName(day)), func(sr storedResult) error {
+		b, err := json.Marshal(sr)
+		if err != nil {
+			return err
+		}
+		raw = append(raw, b...)
+		raw = append(raw, '\n')
+		seg.Results++
+		return nil
+	})
+	if err != nil {
+		return seg, err
+	}
+	compressed := zstdframe.AppendEncode(nil, raw, zstdframe.BetterCompression)
+	sum := sha256.Sum256(compressed)
+	seg.Size = int64(len(compressed))
+	seg.RawSize = int64(len(raw))
+	seg.SHA256 = hex.EncodeToString(sum[:])
+	return seg, writeFileAtomic(filepath.Join(s.dir, archiveFileName(day)), compressed)
+}
+
+// readSegment calls fn for every result in seg, after verifying its
+// integrity.
+func (s *resultsStore) readSegment(seg archiveSegment, fn func(storedResult) error) error {
+	path := filepath.Join(s.dir, archiveFileName(seg.Day))
+	compressed, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if sum := sha256.Sum256(compressed); hex.EncodeToString(sum[:]) != seg.SHA256 {
+		return fmt.Errorf("checksum mismatch in %s", path)
+	}
+	raw, err := zstdframe.AppendDecode(nil, compressed, zstdframe.MaxDecodedSize(uint64(seg.RawSize)))
+	if err != nil {
+		return fmt.Errorf("error decompressing %s: %w", path, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var sr storedResult
+		if err := json.Unmarshal(scanner.Bytes(), &sr); err != nil {
+			return fmt.Errorf("error parsing %s: %w", path, err)
+		}
+		if err := fn(sr); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// archiveLoop seals the days of s older than after every hour, returning when
+// stop is closed.
+func archiveLoop(s *resultsStore, after time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if _, err := s.archive(time.Now().Add(-after)); err != nil {
+			storeLog.Error("error archiving results", "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
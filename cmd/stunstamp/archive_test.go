@@ -0,0 +1,106 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResultsStoreArchive(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openResultsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	day0 := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	rtt := time.Millisecond
+	for d := range 3 {
+		var results []result
+		for i := range 10 {
+			results = append(results, result{
+				key: resultKey{meta: meta, protocol: protocolSTUN, dstPort: 3478},
+				at:  day0.AddDate(0, 0, d).Add(time.Duration(i) * time.Minute),
+				rtt: &rtt,
+			})
+		}
+		if err := s.append(results); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Append a torn line to the first day, which is dropped on sealing.
+	f, err := os.OpenFile(filepath.Join(dir, resultsFileName("2024-07-01")), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"At":"2024-07-01T`)
+	f.Close()
+
+	count := func(s *resultsStore) int {
+		t.Helper()
+		var n int
+		if err := s.readRange(day0, day0.AddDate(0, 0, 3), func(storedResult) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// The last day is being appended to, and is not sealed.
+	sealed, err := s.archive(day0.AddDate(1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed != 2 {
+		t.Errorf("sealed %d days, want 2", sealed)
+	}
+	for day, want := range map[string]bool{"2024-07-01": false, "2024-07-02": false, "2024-07-03": true} {
+		if _, err := os.Stat(filepath.Join(dir, resultsFileName(day))); (err == nil) != want {
+			t.Errorf("results file of %s exists = %v, want %v", day, err == nil, want)
+		}
+	}
+	days, err := s.days()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(days) != 3 {
+		t.Errorf("days() = %v, want 3 days", days)
+	}
+	if got := count(s); got != 30 {
+		t.Errorf("read %d results after archiving, want 30", got)
+	}
+	ro, err := openResultsStoreReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := count(ro); got != 30 {
+		t.Errorf("read-only store read %d results after archiving, want 30", got)
+	}
+
+	// Sealing is idempotent.
+	if sealed, err := s.archive(day0.AddDate(1, 0, 0)); err != nil || sealed != 0 {
+		t.Errorf("second archive() = %d, %v; want 0, nil", sealed, err)
+	}
+
+	// Corruption is detected.
+	path := filepath.Join(dir, archiveFileName("2024-07-02"))
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/2] ^= 0xff
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ro.readRange(day0, day0.AddDate(0, 0, 3), func(storedResult) error { return nil }); err == nil {
+		t.Error("reading a corrupt segment unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	// baselineDays is the number of previous days considered for a baseline.
+	baselineDays = 7
+	// minBaselineDays is the minimum number of previous days with data for
+	// a given hour-of-day before we consider a baseline to be meaningful.
+	minBaselineDays = 3
+
+	baselineMetricName  = "stunstamp_derp_rtt_baseline_ns"
+	deviationMetricName = "stunstamp_derp_rtt_baseline_deviation_percent"
+)
+
+// baselineHourKey identifies the baseline for a given timeseries and local
+// hour-of-day. Baselines are per hour-of-day so that diurnal congestion (e.g.
+// an evening CGNAT busy hour) is compared against the same hour on previous
+// days rather than flagged as a regression.
+type baselineHourKey struct {
+	key  resultKey
+	hour int
+}
+
+// hourMedian is the median RTT of successful probes for a single hour.
+type hourMedian struct {
+	hourStart time.Time
+	median    time.Duration
+}
+
+// hourSamples holds the successful probe RTTs of the hour in progress.
+type hourSamples struct {
+	hourStart time.Time
+	samples   []time.Duration
+}
+
+// baselineTracker computes rolling per-hour-of-day baselines from results.
+// It is safe for concurrent use.
+type baselineTracker struct {
+	mu sync.Mutex
+	// history holds, oldest first, up to baselineDays hourly medians for
+	// every baselineHourKey.
+	history map[baselineHourKey][]hourMedian
+	current map[resultKey]*hourSamples
+}
+
+func newBaselineTracker() *baselineTracker {
+	return &baselineTracker{
+		history: make(map[baselineHourKey][]hourMedian),
+		current: make(map[resultKey]*hourSamples),
+	}
+}
+
+func hourStartOf(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, time.Local)
+}
+
+func medianOf(d []time.Duration) time.Duration {
+	sorted := slices.Clone(d)
+	slices.Sort(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// add accounts results against the tracker. Failed probes are excluded as
+// they are accounted by the timeouts metric, as are those of warm-up and
+// cool-down windows, see lifecyclePhase.
+func (b *baselineTracker) add(results []result) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range results {
+		// First transactions over stable conns pay setup penalties that
+		// would skew the baseline of steady-state RTTs.
+		if r.rtt == nil || r.first || !r.phase.inAggregates() {
+			continue
+		}
+		hs := hourStartOf(r.at)
+		cur, ok := b.current[r.key]
+		if ok && !cur.hourStart.Equal(hs) {
+			if hs.Before(cur.hourStart) {
+				// out of order, e.g. clock step; drop it
+				continue
+			}
+			b.closeHourLocked(r.key, cur)
+			ok = false
+		}
+		if !ok {
+			cur = &hourSamples{hourStart: hs}
+			b.current[r.key] = cur
+		}
+		cur.samples = append(cur.samples, *r.rtt)
+	}
+}
+
+func (b *baselineTracker) closeHourLocked(k resultKey, cur *hourSamples) {
+	if len(cur.samples) == 0 {
+		return
+	}
+	hk := baselineHourKey{key: k, hour: cur.hourStart.Hour()}
+	hist := append(b.history[hk], hourMedian{
+		hourStart: cur.hourStart,
+		median:    medianOf(cur.samples),
+	})
+	cutoff := cur.hourStart.AddDate(0, 0, -baselineDays)
+	for len(hist) > 0 && !hist[0].hourStart.After(cutoff) {
+		hist = hist[1:]
+	}
+	b.history[hk] = hist
+}
+
+// forget drops all state for keys not present in keep.
+func (b *baselineTracker) forget(keep func(resultKey) bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for k := range b.current {
+		if !keep(k) {
+			delete(b.current, k)
+		}
+	}
+	for hk := range b.history {
+		if !keep(hk.key) {
+			delete(b.history, hk)
+		}
+	}
+}
+
+// baselineStatus describes the current-vs-baseline comparison for a single
+// timeseries.
+type baselineStatus struct {
+	key resultKey
+	// current is the median RTT of the hour in progress.
+	current time.Duration
+	// baseline is the median of hourly medians for the same hour-of-day on
+	// previous days.
+	baseline time.Duration
+	// days is the number of previous days contributing to baseline.
+	days int
+}
+
+// deviationPercent returns the deviation of current from baseline as a
+// percentage of baseline. Positive values indicate a regression.
+func (s baselineStatus) deviationPercent() float64 {
+	if s.baseline == 0 {
+		return math.NaN()
+	}
+	return float64(s.current-s.baseline) / float64(s.baseline) * 100
+}
+
+// statuses returns the baselineStatus of every timeseries with enough history
+// for a baseline, in a stable order.
+func (b *baselineTracker) statuses() []baselineStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ret := make([]baselineStatus, 0, len(b.current))
+	for k, cur := range b.current {
+		if len(cur.samples) == 0 {
+			continue
+		}
+		hist := b.history[baselineHourKey{key: k, hour: cur.hourStart.Hour()}]
+		if len(hist) < minBaselineDays {
+			continue
+		}
+		medians := make([]time.Duration, 0, len(hist))
+		for _, h := range hist {
+			medians = append(medians, h.median)
+		}
+		ret = append(ret, baselineStatus{
+			key:      k,
+			current:  medianOf(cur.samples),
+			baseline: medianOf(medians),
+			days:     len(hist),
+		})
+	}
+	slices.SortFunc(ret, func(a, b baselineStatus) int {
+		return cmp.Or(
+			cmp.Compare(a.key.meta.regionID, b.key.meta.regionID),
+			cmp.Compare(a.key.meta.hostname, b.key.meta.hostname),
+			a.key.meta.addr.Compare(b.key.meta.addr),
+			cmp.Compare(a.key.protocol, b.key.protocol),
+			cmp.Compare(a.key.dstPort, b.key.dstPort),
+			cmp.Compare(a.key.timestampSource, b.key.timestampSource),
+			compareBool(bool(a.key.connStability), bool(b.key.connStability)),
+		)
+	})
+	return ret
+}
+
+// toPromTimeSeries returns baseline and deviation timeseries for every
+// timeseries with a baseline.
+func (b *baselineTracker) toPromTimeSeries(instance string, at time.Time) []prompb.TimeSeries {
+	statuses := b.statuses()
+	all := make([]prompb.TimeSeries, 0, len(statuses)*2)
+	for _, s := range statuses {
+		k := s.key
+		all = append(all, prompb.TimeSeries{
+			Labels:  resultKeyLabels(baselineMetricName, k, instance),
+			Samples: []prompb.Sample{{Timestamp: at.UnixMilli(), Value: float64(s.baseline)}},
+		})
+		all = append(all, prompb.TimeSeries{
+			Labels:  resultKeyLabels(deviationMetricName, k, instance),
+			Samples: []prompb.Sample{{Timestamp: at.UnixMilli(), Value: s.deviationPercent()}},
+		})
+	}
+	return all
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case !a:
+		return -1
+	default:
+		return 1
+	}
+}
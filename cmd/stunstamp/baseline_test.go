@@ -0,0 +1,139 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestBaselineTracker(t *testing.T) {
+	key := resultKey{
+		meta:     nodeMeta{regionID: 1, regionCode: "nyc", hostname: "derp1a", addr: netip.MustParseAddr("192.0.2.1")},
+		protocol: protocolSTUN,
+		dstPort:  3478,
+	}
+	mk := func(at time.Time, rtt time.Duration) result {
+		return result{key: key, at: at, rtt: &rtt}
+	}
+
+	b := newBaselineTracker()
+	now := time.Date(2024, 6, 10, 20, 30, 0, 0, time.Local)
+	// 20:00-21:00 on the previous 4 days had a median RTT of 10ms, and the
+	// following hour is different, which must not influence the baseline.
+	for day := 4; day >= 1; day-- {
+		base := now.AddDate(0, 0, -day)
+		b.add([]result{
+			mk(base, 9*time.Millisecond),
+			mk(base.Add(time.Minute), 10*time.Millisecond),
+			mk(base.Add(2*time.Minute), 11*time.Millisecond),
+			mk(base.Add(time.Hour), 50*time.Millisecond),
+		})
+	}
+	b.add([]result{mk(now, 15*time.Millisecond)})
+	got := b.statuses()
+	if len(got) != 1 {
+		t.Fatalf("got %d statuses, want 1", len(got))
+	}
+	if got[0].baseline != 10*time.Millisecond {
+		t.Errorf("baseline = %v, want 10ms", got[0].baseline)
+	}
+	if got[0].days != 4 {
+		t.Errorf("days = %d, want 4", got[0].days)
+	}
+	if dev := got[0].deviationPercent(); dev != 50 {
+		t.Errorf("deviation = %v, want 50", dev)
+	}
+
+	b.forget(func(resultKey) bool { return false })
+	if got := b.statuses(); len(got) != 0 {
+		t.Fatalf("unexpected statuses after forget: %+v", got)
+	}
+}
+
+func TestResultsStoreRoundTrip(t *testing.T) {
+	s, err := openResultsStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	rtt := 5 * time.Millisecond
+	at := time.Date(2024, 6, 10, 23, 59, 59, 0, time.UTC)
+	in := []result{
+		{key: resultKey{meta: nodeMeta{regionID: 1, addr: netip.MustParseAddr("192.0.2.1")}, protocol: protocolSTUN, timestampSource: timestampSourceKernel, connStability: stableConn}, at: at, rtt: &rtt},
+		{key: resultKey{meta: nodeMeta{regionID: 2, addr: netip.MustParseAddr("2001:db8::1")}, protocol: protocolICMP}, at: at},
+	}
+	if err := s.append(in); err != nil {
+		t.Fatal(err)
+	}
+	var out []result
+	err = s.readRange(at.Add(-time.Minute), at.Add(time.Minute), func(sr storedResult) error {
+		out = append(out, sr.toResult())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(in) {
+		t.Fatalf("got %d results, want %d", len(out), len(in))
+	}
+	for i := range in {
+		if out[i].key != in[i].key || !out[i].at.Equal(in[i].at) || (out[i].rtt == nil) != (in[i].rtt == nil) {
+			t.Errorf("result %d: got %+v, want %+v", i, out[i], in[i])
+		}
+	}
+}
+
+func TestFirstTransactions(t *testing.T) {
+	key := resultKey{
+		meta:          nodeMeta{regionID: 1, regionCode: "nyc", hostname: "derp1a", addr: netip.MustParseAddr("192.0.2.1")},
+		protocol:      protocolHTTPS,
+		dstPort:       443,
+		connStability: stableConn,
+	}
+	first, steady := 40*time.Millisecond, 10*time.Millisecond
+	at := time.Date(2024, 6, 10, 20, 30, 0, 0, time.UTC)
+	in := []result{
+		{key: key, at: at, rtt: &first, first: true},
+		{key: key, at: at.Add(time.Second), rtt: &steady},
+	}
+
+	for i, r := range in {
+		ts := resultsToPromTimeSeries([]result{r}, "test", make(map[resultKey]uint64), false)
+		want := rttMetricName
+		if r.first {
+			want = firstRTTMetricName
+		}
+		if got := labelValue(ts[0].Labels, "__name__"); got != want {
+			t.Errorf("result %d: metric %q, want %q", i, got, want)
+		}
+	}
+
+	b := newBaselineTracker()
+	b.add(in)
+	if cur := b.current[key]; cur == nil || len(cur.samples) != 1 || cur.samples[0] != steady {
+		t.Errorf("baseline samples = %+v, want steady-state RTT only", cur)
+	}
+
+	s, err := openResultsStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if err := s.append(in); err != nil {
+		t.Fatal(err)
+	}
+	var out []result
+	err = s.readRange(at.Add(-time.Minute), at.Add(time.Minute), func(sr storedResult) error {
+		out = append(out, sr.toResult())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || !out[0].first || out[1].first {
+		t.Errorf("stored results = %+v, want first transaction flagged", out)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"maps"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const deferredProbesMetricName = "stunstamp_budget_deferred_probes"
+
+// fairShares divides budget between the demands of protocols by weight, max-min
+// fairly: no protocol is allotted more than it demands, and what one does not
+// use is redistributed between the others by weight. Protocols without a
+// weight weigh 1.
+func fairShares(budget float64, demands, weights map[protocol]float64) map[protocol]float64 {
+	shares := make(map[protocol]float64)
+	active := make(map[protocol]bool)
+	for p, d := range demands {
+		if d > 0 {
+			active[p] = true
+		}
+	}
+	weightOf := func(p protocol) float64 {
+		if w, ok := weights[p]; ok {
+			return w
+		}
+		return 1
+	}
+	for len(active) > 0 && budget > 0 {
+		var total float64
+		for p := range active {
+			total += weightOf(p)
+		}
+		var satisfied []protocol
+		for p := range active {
+			if demands[p] <= budget*weightOf(p)/total {
+				satisfied = append(satisfied, p)
+			}
+		}
+		if len(satisfied) == 0 {
+			for p := range active {
+				shares[p] = budget * weightOf(p) / total
+			}
+			break
+		}
+		for _, p := range satisfied {
+			shares[p] = demands[p]
+			budget -= demands[p]
+			delete(active, p)
+		}
+	}
+	return shares
+}
+
+// probeBudget defers due probes in excess of schedulingConfig's
+// MaxMessagesPerSecond to later windows. The budget of a window is shared
+// between protocols by fairShares, so that enabling a protocol only ever
+// takes from others what exceeds their weighted share. Within a protocol
+// over its share, critical targets are probed first, and best-effort
+// targets in rotation, so that deferral is spread evenly between them
+// rather than starving the same ones every window. A budget too small for
+// any probe of a window still admits one, of each protocol in turn, so that
+// probing slows down rather than stops. The messages of a probe are
+// estimated from its last window. It is not safe for concurrent use.
+type probeBudget struct {
+	// messages holds the messages sent by the last probe of each target
+	// and protocol.
+	messages map[intervalKey]float64
+	// next holds the address of the best-effort target of each protocol
+	// to probe first in the next window it is over its share.
+	next map[protocol]netip.Addr
+	// deferred holds the number of probes of each protocol deferred in
+	// the last window.
+	deferred map[protocol]int
+	// starved is the protocol of the last probe admitted over budget as
+	// the budget admitted none.
+	starved protocol
+}
+
+func newProbeBudget() *probeBudget {
+	return &probeBudget{
+		messages: make(map[intervalKey]float64),
+		next:     make(map[protocol]netip.Addr),
+		deferred: make(map[protocol]int),
+	}
+}
+
+// observe accounts the messages sent by the probes of results.
+func (b *probeBudget) observe(results []result) {
+	messages := make(map[intervalKey]float64)
+	for _, r := range results {
+		messages[intervalKey{r.key.meta.addr, r.key.protocol}] += float64(max(1, len(r.attempts)))
+	}
+	maps.Copy(b.messages, messages)
+}
+
+// messagesOf returns the estimated messages of a probe of k: those it last
+// sent, or else the mean of those of its protocol, or else 1.
+func (b *probeBudget) messagesOf(k intervalKey) float64 {
+	if m, ok := b.messages[k]; ok {
+		return m
+	}
+	var sum, n float64
+	for o, m := range b.messages {
+		if o.protocol == k.protocol {
+			sum += m
+			n++
+		}
+	}
+	if n == 0 {
+		return 1
+	}
+	return sum / n
+}
+
+// filter returns due without the probes deferred to keep the window, ticking
+// every tick, within the budget of c, which may be nil to probe all of due.
+// Deferred probes are next probed when they are next due.
+func (b *probeBudget) filter(due map[intervalKey]bool, targets map[netip.Addr]nodeMeta, c *schedulingConfig, tick time.Duration) map[intervalKey]bool {
+	for k := range b.messages {
+		if _, ok := targets[k.addr]; !ok {
+			delete(b.messages, k)
+		}
+	}
+	if c == nil || c.MaxMessagesPerSecond == 0 {
+		clear(b.deferred)
+		return due
+	}
+	byProtocol := make(map[protocol][]intervalKey)
+	demands := make(map[protocol]float64)
+	for k := range due {
+		byProtocol[k.protocol] = append(byProtocol[k.protocol], k)
+		demands[k.protocol] += b.messagesOf(k)
+	}
+	shares := fairShares(c.MaxMessagesPerSecond*tick.Seconds(), demands, c.ProtocolWeights)
+
+	ret := make(map[intervalKey]bool, len(due))
+	deferred := make(map[protocol]int)
+	// deferredKeys holds the deferred probes of each protocol in rotation
+	// order.
+	deferredKeys := make(map[protocol][]intervalKey)
+	for p, keys := range byProtocol {
+		deferred[p] = 0
+		if demands[p] <= shares[p] {
+			for _, k := range keys {
+				ret[k] = true
+			}
+			continue
+		}
+		var critical, bestEffort []intervalKey
+		for _, k := range keys {
+			if c.Critical.matches(targets[k.addr]) {
+				critical = append(critical, k)
+			} else {
+				bestEffort = append(bestEffort, k)
+			}
+		}
+		// Critical targets are never deferred, as they are never shed.
+		used := 0.0
+		for _, k := range critical {
+			ret[k] = true
+			used += b.messagesOf(k)
+		}
+		slices.SortFunc(bestEffort, func(a, b intervalKey) int { return a.addr.Compare(b.addr) })
+		start, _ := slices.BinarySearchFunc(bestEffort, b.next[p], func(k intervalKey, addr netip.Addr) int {
+			return k.addr.Compare(addr)
+		})
+		delete(b.next, p)
+		for i := range bestEffort {
+			k := bestEffort[(start+i)%len(bestEffort)]
+			if m := b.messagesOf(k); used+m <= shares[p] {
+				ret[k] = true
+				used += m
+				continue
+			}
+			if deferred[p] == 0 {
+				b.next[p] = k.addr
+			}
+			deferred[p]++
+			deferredKeys[p] = append(deferredKeys[p], k)
+		}
+	}
+	if len(ret) == 0 && len(deferredKeys) > 0 {
+		ps := slices.Sorted(maps.Keys(deferredKeys))
+		i, found := slices.BinarySearch(ps, b.starved)
+		if found {
+			i++
+		}
+		p := ps[i%len(ps)]
+		keys := deferredKeys[p]
+		ret[keys[0]] = true
+		deferred[p]--
+		if len(keys) > 1 {
+			b.next[p] = keys[1].addr
+		} else {
+			delete(b.next, p)
+		}
+		b.starved = p
+	}
+	for p, n := range deferred {
+		if n > 0 && b.deferred[p] == 0 {
+			probeLog.Warn("deferring probes over their protocol's share of MaxMessagesPerSecond", "protocol", p, "deferred", n, "due", len(byProtocol[p]), "share_per_second", shares[p]/tick.Seconds())
+		}
+	}
+	b.deferred = deferred
+	return ret
+}
+
+// toPromTimeSeries returns the number of probes of every protocol due in
+// the last window that were deferred.
+func (b *probeBudget) toPromTimeSeries(instance string, at time.Time) []prompb.TimeSeries {
+	var ts []prompb.TimeSeries
+	for _, p := range slices.Sorted(maps.Keys(b.deferred)) {
+		t := instanceTimeSeries(deferredProbesMetricName, instance, at, float64(b.deferred[p]))
+		t.Labels = append(t.Labels, prompb.Label{Name: "protocol", Value: string(p)})
+		slices.SortFunc(t.Labels, func(a, b prompb.Label) int {
+			return cmp.Compare(a.Name, b.Name)
+		})
+		ts = append(ts, t)
+	}
+	return ts
+}
@@ -0,0 +1,169 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"math"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestFairShares(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		budget  float64
+		demands map[protocol]float64
+		weights map[protocol]float64
+		want    map[protocol]float64
+	}{
+		{
+			name:    "under budget",
+			budget:  100,
+			demands: map[protocol]float64{protocolSTUN: 20, protocolICMP: 10},
+			want:    map[protocol]float64{protocolSTUN: 20, protocolICMP: 10},
+		},
+		{
+			name:    "surplus redistributed",
+			budget:  30,
+			demands: map[protocol]float64{protocolSTUN: 40, protocolICMP: 5},
+			want:    map[protocol]float64{protocolSTUN: 25, protocolICMP: 5},
+		},
+		{
+			name:    "equal weights",
+			budget:  30,
+			demands: map[protocol]float64{protocolSTUN: 20, protocolICMP: 20, protocolHTTPS: 20},
+			want:    map[protocol]float64{protocolSTUN: 10, protocolICMP: 10, protocolHTTPS: 10},
+		},
+		{
+			name:    "weighted",
+			budget:  30,
+			demands: map[protocol]float64{protocolSTUN: 40, protocolHTTPS: 40},
+			weights: map[protocol]float64{protocolSTUN: 2},
+			want:    map[protocol]float64{protocolSTUN: 20, protocolHTTPS: 10},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fairShares(tt.budget, tt.demands, tt.weights)
+			for p, want := range tt.want {
+				if math.Abs(got[p]-want) > 1e-9 {
+					t.Errorf("%s: got %v, want %v", p, got[p], want)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeBudget(t *testing.T) {
+	targets := make(map[netip.Addr]nodeMeta)
+	due := make(map[intervalKey]bool)
+	var results []result
+	for i := range 10 {
+		meta := nodeMeta{regionID: i + 1, addr: netip.AddrFrom4([4]byte{192, 0, 2, byte(i + 1)})}
+		targets[meta.addr] = meta
+		// Two STUN ports and one ICMP probe, i.e. 30 messages per window.
+		for _, p := range []protocol{protocolSTUN, protocolSTUN, protocolICMP} {
+			due[intervalKey{meta.addr, p}] = true
+			results = append(results, result{key: resultKey{meta: meta, protocol: p}})
+		}
+	}
+	b := newProbeBudget()
+	b.observe(results)
+	c := &schedulingConfig{MaxMessagesPerSecond: 3}
+	if got := b.filter(due, targets, c, 10*time.Second); len(got) != len(due) {
+		t.Fatalf("got %d probes within budget, want all %d", len(got), len(due))
+	}
+
+	// Enabling HTTPS takes from STUN only what exceeds its share.
+	for addr := range targets {
+		due[intervalKey{addr, protocolHTTPS}] = true
+	}
+	probed := make(map[intervalKey]int)
+	for range 2 {
+		got := b.filter(due, targets, c, 10*time.Second)
+		for k := range got {
+			probed[k]++
+		}
+		if b.deferred[protocolSTUN] != 5 || b.deferred[protocolICMP] != 0 || b.deferred[protocolHTTPS] != 0 {
+			t.Fatalf("got deferred %v, want 5 STUN probes", b.deferred)
+		}
+	}
+	// Deferral rotates between targets.
+	for addr := range targets {
+		if n := probed[intervalKey{addr, protocolSTUN}]; n != 1 {
+			t.Errorf("STUN to %v probed in %d of 2 windows, want 1", addr, n)
+		}
+	}
+
+	// Critical targets are never deferred.
+	c.Critical = targetSelector{RegionIDs: []int{1, 2, 3, 4, 5, 6, 7, 8}}
+	got := b.filter(due, targets, c, 10*time.Second)
+	for i := range 8 {
+		if !got[intervalKey{netip.AddrFrom4([4]byte{192, 0, 2, byte(i + 1)}), protocolSTUN}] {
+			t.Errorf("STUN to critical target %d deferred", i+1)
+		}
+	}
+
+	// Weights reserve STUN's share.
+	c.Critical = targetSelector{}
+	c.ProtocolWeights = map[protocol]float64{protocolSTUN: 4}
+	b.filter(due, targets, c, 10*time.Second)
+	if b.deferred[protocolSTUN] != 0 || b.deferred[protocolHTTPS] == 0 {
+		t.Errorf("got deferred %v, want no STUN probes", b.deferred)
+	}
+	if ts := b.toPromTimeSeries("i", time.Now()); len(ts) != 3 {
+		t.Errorf("got %d timeseries, want 3", len(ts))
+	}
+}
+
+func TestProbeBudgetBelowOneProbe(t *testing.T) {
+	targets := make(map[netip.Addr]nodeMeta)
+	due := make(map[intervalKey]bool)
+	for i := range 2 {
+		meta := nodeMeta{regionID: i + 1, addr: netip.AddrFrom4([4]byte{192, 0, 2, byte(i + 1)})}
+		targets[meta.addr] = meta
+		due[intervalKey{meta.addr, protocolSTUN}] = true
+	}
+	b := newProbeBudget()
+	// 0.6 messages per window.
+	c := &schedulingConfig{MaxMessagesPerSecond: 0.01}
+	var last intervalKey
+	for i := range 4 {
+		got := b.filter(due, targets, c, time.Minute)
+		if len(got) != 1 || b.deferred[protocolSTUN] != 1 {
+			t.Fatalf("window %d: got %v with deferred %v, want one probe admitted", i, got, b.deferred)
+		}
+		for k := range got {
+			if k == last {
+				t.Errorf("window %d: probed %v again, want alternating targets", i, k)
+			}
+			last = k
+		}
+	}
+}
+
+func TestProbeBudgetBelowOneProbeProbesEveryTarget(t *testing.T) {
+	targets := make(map[netip.Addr]nodeMeta)
+	due := make(map[intervalKey]bool)
+	for i := range 5 {
+		meta := nodeMeta{regionID: i + 1, addr: netip.AddrFrom4([4]byte{192, 0, 2, byte(i + 1)})}
+		targets[meta.addr] = meta
+		for _, p := range []protocol{protocolSTUN, protocolICMP} {
+			due[intervalKey{meta.addr, p}] = true
+		}
+	}
+	b := newProbeBudget()
+	c := &schedulingConfig{MaxMessagesPerSecond: 0.01}
+	probed := make(map[intervalKey]bool)
+	for range 2 * len(due) {
+		for k := range b.filter(due, targets, c, time.Minute) {
+			probed[k] = true
+		}
+	}
+	for k := range due {
+		if !probed[k] {
+			t.Errorf("%v never probed in %d windows", k, 2*len(due))
+		}
+	}
+}
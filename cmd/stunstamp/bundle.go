@@ -0,0 +1,273 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"tailscale.com/version"
+)
+
+// bundleInfo describes a support bundle and the stunstamp that produced it.
+type bundleInfo struct {
+	Version   string
+	GoVersion string
+	OS        string
+	Arch      string
+	Hostname  string
+	At        time.Time
+	From      time.Time
+	To        time.Time
+	Results   int
+	Events    int
+	// Errors holds the parts of the bundle that could not be collected.
+	Errors []string `json:",omitempty"`
+}
+
+// bundlePlatform is the capability and privilege report of a bundle.
+type bundlePlatform struct {
+	Capabilities []capability
+	Privileges   []privilege
+}
+
+// runBundle implements the bundle subcommand, writing a gzipped tar archive
+// to attach to ISP or Tailscale support tickets. It holds the results and
+// events of the store in --store-dir since --since ago, annotations, the
+// config file and flags with secrets redacted, the timestamping capabilities
+// and privileges of this platform, and version information. Flags given
+// before the subcommand are included, so that the bundle reflects the
+// deployment when run with the same flags:
+//
+//	stunstamp --stun-dst-ports=3478 bundle --store-dir=/var/lib/stunstamp --config=stunstamp.hujson
+//
+// args are the subcommand's arguments, and a summary is written to w.
+func runBundle(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("bundle", flag.ContinueOnError)
+	storeDir := fs.String("store-dir", "", "directory of the store to bundle results and events of")
+	configPath := fs.String("config", "", "path to the HuJSON config file to include, with secrets redacted")
+	since := fs.Duration("since", 24*time.Hour, "bundle results and events since this long ago")
+	out := fs.String("out", "", `path of the archive to write, or "-" for stdout; defaults to stunstamp-bundle-HOSTNAME-TIME.tar.gz`)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(*storeDir) < 1 {
+		return errors.New("bundle requires the store-dir flag")
+	}
+	if *since <= 0 {
+		return errors.New("since must be positive")
+	}
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	info := &bundleInfo{
+		Version:   version.Long(),
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Hostname:  hostname,
+		At:        now,
+		From:      now.Add(-*since),
+		To:        now,
+	}
+
+	path := *out
+	if path == "" {
+		path = fmt.Sprintf("stunstamp-bundle-%s-%s.tar.gz", hostname, now.UTC().Format("20060102T150405Z"))
+	}
+	var dst io.Writer = w
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		dst = f
+	}
+	if err := writeBundle(dst, *storeDir, *configPath, info); err != nil {
+		return err
+	}
+	if path != "-" {
+		fmt.Fprintf(w, "wrote %s: %d results and %d events since %s\n", path, info.Results, info.Events, info.From.Format(time.RFC3339))
+		for _, e := range info.Errors {
+			fmt.Fprintf(w, "  incomplete: %s\n", e)
+		}
+	}
+	return nil
+}
+
+// writeBundle writes the bundle of the store in storeDir and the config file
+// at configPath, if any, to w. Parts that cannot be collected are recorded
+// in info.Errors rather than failing the bundle.
+func writeBundle(w io.Writer, storeDir, configPath string, info *bundleInfo) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	add := func(name string, b []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(b)), ModTime: info.At}); err != nil {
+			return err
+		}
+		_, err := tw.Write(b)
+		return err
+	}
+	addJSON := func(name string, v any) error {
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return add(name, append(b, '\n'))
+	}
+	fail := func(part string, err error) {
+		info.Errors = append(info.Errors, fmt.Sprintf("%s: %v", part, err))
+	}
+
+	var results bytes.Buffer
+	if store, err := openResultsStoreReadOnly(storeDir); err != nil {
+		fail("results", err)
+	} else {
+		enc := json.NewEncoder(&results)
+		err := store.readRange(info.From, info.To, func(sr storedResult) error {
+			info.Results++
+			return enc.Encode(sr)
+		})
+		if err != nil {
+			fail("results", err)
+		}
+	}
+	if err := add("results.jsonl", results.Bytes()); err != nil {
+		return err
+	}
+
+	evs, err := bundleEvents(storeDir, info.From, info.To)
+	if err != nil {
+		fail("events", err)
+	}
+	info.Events = bytes.Count(evs, []byte("\n"))
+	if err := add("events.jsonl", evs); err != nil {
+		return err
+	}
+	anns, err := bundleAnnotations(storeDir, info.From)
+	if err != nil {
+		fail("annotations", err)
+	}
+	if err := add("annotations.jsonl", anns); err != nil {
+		return err
+	}
+
+	flags := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = redactFlag(f.Name, f.Value.String())
+	})
+	if err := addJSON("flags.json", flags); err != nil {
+		return err
+	}
+	if configPath != "" {
+		cfg, err := loadConfig(configPath)
+		if err != nil {
+			fail("config", err)
+		} else if err := addJSON("config.json", redactConfig(cfg)); err != nil {
+			return err
+		}
+	}
+
+	caps, _ := detectCapabilities(timestampProviders, *flagIPv6)
+	if err := addJSON("platform.json", bundlePlatform{Capabilities: caps, Privileges: detectPrivileges()}); err != nil {
+		return err
+	}
+	// The info is written last, so that it holds the counts and errors.
+	if err := addJSON("info.json", info); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// bundleEvents returns the persisted events in storeDir with from <= At < to,
+// as JSON lines.
+func bundleEvents(storeDir string, from, to time.Time) ([]byte, error) {
+	var ret []byte
+	fromDay, toDay := from.UTC().Format(storeDayLayout), to.UTC().Format(storeDayLayout)
+	for day := fromDay; day <= toDay; {
+		err := readJSONLines(filepath.Join(storeDir, eventsFilePrefix+day+resultsFileSuffix), func(line []byte) {
+			var ev event
+			if json.Unmarshal(line, &ev) == nil && !ev.At.Before(from) && ev.At.Before(to) {
+				ret = append(append(ret, line...), '\n')
+			}
+		})
+		if err != nil {
+			return ret, err
+		}
+		t, _ := time.Parse(storeDayLayout, day)
+		day = t.AddDate(0, 0, 1).Format(storeDayLayout)
+	}
+	return ret, nil
+}
+
+// bundleAnnotations returns the annotation records in storeDir of
+// annotations ending at or after from, and all deletions, as JSON lines.
+func bundleAnnotations(storeDir string, from time.Time) ([]byte, error) {
+	var ret []byte
+	err := readJSONLines(filepath.Join(storeDir, annotationsFileName), func(line []byte) {
+		var a annotation
+		if json.Unmarshal(line, &a) == nil && (a.Deleted || !a.To.Before(from)) {
+			ret = append(append(ret, line...), '\n')
+		}
+	})
+	return ret, err
+}
+
+// readJSONLines calls fn for every non-empty line of the file at path. A
+// missing file has no lines.
+func readJSONLines(path string, fn func([]byte)) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		if line := bytes.TrimSpace(sc.Bytes()); len(line) > 0 {
+			fn(line)
+		}
+	}
+	return sc.Err()
+}
+
+// redactConfig returns a copy of c with the credentials of URLs and the
+// values of HTTPS request headers, e.g. Authorization, redacted.
+func redactConfig(c *config) *config {
+	ret := *c
+	ret.Funnels = nil
+	for _, f := range c.Funnels {
+		f.URL = redactFlag("", f.URL)
+		ret.Funnels = append(ret.Funnels, f)
+	}
+	ret.HTTPSRequests = nil
+	for _, hr := range c.HTTPSRequests {
+		if hr.Headers != nil {
+			headers := make(map[string]string, len(hr.Headers))
+			for k := range hr.Headers {
+				headers[k] = "REDACTED"
+			}
+			hr.Headers = headers
+		}
+		ret.HTTPSRequests = append(ret.HTTPSRequests, hr)
+	}
+	return &ret
+}
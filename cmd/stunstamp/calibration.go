@@ -0,0 +1,292 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"tailscale.com/net/stun"
+)
+
+const (
+	latencyFloorMetricName = "stunstamp_host_latency_floor_ns"
+	// calibrationSamples is the number of loopback RTTs measured per
+	// source, protocol, and address family, the minimum of which is the
+	// floor.
+	calibrationSamples = 10
+)
+
+// eventKindCalibration is a calibration of the latency floor of this host,
+// see calibrate.
+const eventKindCalibration eventKind = "calibration"
+
+// calibrationProtocols are the protocols calibrated, those with a responder
+// on loopback.
+var calibrationProtocols = []protocol{protocolSTUN, protocolICMP, protocolTCP}
+
+// latencyFloor is the minimum RTT measured to this host itself over loopback,
+// with the same conns and measureFns as probes. It is the latency this host's
+// stack and timestamping contribute to every RTT, so subtracting it allows
+// RTTs measured from different hosts to be compared.
+type latencyFloor struct {
+	Source        string
+	Protocol      protocol
+	AddressFamily string
+	FloorNanos    int64
+}
+
+// calibration is the outcome of calibrating the latency floor of this host.
+type calibration struct {
+	At     time.Time
+	Floors []latencyFloor
+}
+
+// loopbackResponder answers STUN binding requests and accepts TCP
+// connections on a loopback address, as targets to calibrate against. ICMP
+// echo requests are answered by the kernel.
+type loopbackResponder struct {
+	pc *net.UDPConn
+	ln *net.TCPListener
+}
+
+func newLoopbackResponder(addr netip.Addr) (*loopbackResponder, error) {
+	pc, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, 0)))
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, 0)))
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, from, err := pc.ReadFromUDPAddrPort(b)
+			if err != nil {
+				return
+			}
+			txID, err := stun.ParseBindingRequest(b[:n])
+			if err != nil {
+				continue
+			}
+			pc.WriteToUDPAddrPort(stun.Response(txID, from), from)
+		}
+	}()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	return &loopbackResponder{pc: pc, ln: ln}, nil
+}
+
+// addrPort returns the address to probe p at.
+func (l *loopbackResponder) addrPort(p protocol) netip.AddrPort {
+	switch p {
+	case protocolSTUN:
+		return l.pc.LocalAddr().(*net.UDPAddr).AddrPort()
+	case protocolTCP:
+		return l.ln.Addr().(*net.TCPAddr).AddrPort()
+	}
+	return netip.AddrPortFrom(l.addrPort(protocolSTUN).Addr(), 0)
+}
+
+func (l *loopbackResponder) close() {
+	l.pc.Close()
+	l.ln.Close()
+}
+
+// calibrate measures the latency floor of this host over loopback for every
+// protocol in calibrationProtocols supported by the providers in tps, for
+// IPv4, and IPv6 if ipv6. Combinations this host is unable to measure, e.g.
+// ICMP without the privileges for ICMP sockets, are omitted.
+func calibrate(ctx context.Context, tps [2]timestampProvider, ipv6 bool) calibration {
+	c := calibration{At: time.Now()}
+	addrs := []netip.Addr{netip.AddrFrom4([4]byte{127, 0, 0, 1})}
+	if ipv6 {
+		addrs = append(addrs, netip.IPv6Loopback())
+	}
+	for _, addr := range addrs {
+		family := "ipv4"
+		if addr.Is6() {
+			family = "ipv6"
+		}
+		lr, err := newLoopbackResponder(addr)
+		if err != nil {
+			probeLog.Warn("unable to calibrate latency floor", "address_family", family, "err", err)
+			continue
+		}
+		for _, tp := range tps {
+			if tp == nil {
+				continue
+			}
+			for _, p := range calibrationProtocols {
+				floor, err := measureLatencyFloor(ctx, tp, p, lr.addrPort(p))
+				if errors.Is(err, errUnsupportedCalibration) {
+					continue
+				}
+				if err != nil {
+					probeLog.Debug("unable to calibrate latency floor", "source", tp.source(), "protocol", p, "address_family", family, "err", err)
+					continue
+				}
+				c.Floors = append(c.Floors, latencyFloor{
+					Source:        tp.source().String(),
+					Protocol:      p,
+					AddressFamily: family,
+					FloorNanos:    floor.Nanoseconds(),
+				})
+			}
+		}
+		lr.close()
+	}
+	return c
+}
+
+// errUnsupportedCalibration is returned by measureLatencyFloor if the
+// provider does not support the protocol.
+var errUnsupportedCalibration = errors.New("unsupported by provider")
+
+// measureLatencyFloor returns the minimum of calibrationSamples RTTs to dst
+// measured by tp over an unstable conn with p, failing on the first error.
+func measureLatencyFloor(ctx context.Context, tp timestampProvider, p protocol, dst netip.AddrPort) (time.Duration, error) {
+	if !tp.supports(p, unstableConn) {
+		return 0, errUnsupportedCalibration
+	}
+	cf, err := tp.newConn(dst.Addr(), p, unstableConn, 0)
+	if err != nil {
+		return 0, err
+	}
+	if cf == nil {
+		return 0, errUnsupportedCalibration
+	}
+	defer cf.conn.Close()
+	floor := time.Duration(math.MaxInt64)
+	for range calibrationSamples {
+		mctx, cancel := context.WithTimeout(ctx, txRxTimeout)
+		m, err := cf.fn(mctx, cf.conn, "localhost", dst)
+		cancel()
+		if err != nil {
+			return 0, err
+		}
+		floor = min(floor, m.rtt)
+	}
+	return floor, nil
+}
+
+// calibrator calibrates the latency floor of this host on startup and every
+// interval thereafter, persisting and exporting the floors. It is safe for
+// concurrent use.
+type calibrator struct {
+	interval time.Duration // zero to calibrate on startup only
+
+	mu     sync.Mutex
+	latest calibration
+	// seen holds the floors exported, so that they can be marked stale.
+	seen map[latencyFloor]bool
+}
+
+func newCalibrator(interval time.Duration) *calibrator {
+	return &calibrator{interval: interval, seen: make(map[latencyFloor]bool)}
+}
+
+// due reports whether a calibration is due at now.
+func (c *calibrator) due(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.latest.At.IsZero() || c.interval > 0 && now.Sub(c.latest.At) >= c.interval
+}
+
+// run calibrates the latency floor with tps, persisting the result as an
+// event.
+func (c *calibrator) run(ctx context.Context, tps [2]timestampProvider, ipv6 bool) {
+	cal := calibrate(ctx, tps, ipv6)
+	c.mu.Lock()
+	c.latest = cal
+	c.mu.Unlock()
+	ev := event{At: cal.At, Kind: eventKindCalibration, Attrs: make(map[string]string)}
+	for _, f := range cal.Floors {
+		ev.Attrs[f.Source+"_"+string(f.Protocol)+"_"+f.AddressFamily] = time.Duration(f.FloorNanos).String()
+	}
+	probeLog.Debug("calibrated latency floor", "floors", ev.Attrs)
+	events.persist(ev)
+}
+
+// calibration returns the latest calibration, zero if none.
+func (c *calibrator) calibration() calibration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.latest
+}
+
+func latencyFloorTimeSeries(f latencyFloor, instance string, at time.Time, value float64) prompb.TimeSeries {
+	labels := []prompb.Label{
+		{Name: "__name__", Value: latencyFloorMetricName},
+		{Name: "instance", Value: instance},
+		{Name: "job", Value: "stunstamp-rw"},
+		{Name: "timestamp_source", Value: f.Source},
+		{Name: "protocol", Value: string(f.Protocol)},
+		{Name: "address_family", Value: f.AddressFamily},
+	}
+	slices.SortFunc(labels, func(a, b prompb.Label) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return prompb.TimeSeries{
+		Labels:  labels,
+		Samples: []prompb.Sample{{Timestamp: at.UnixMilli(), Value: value}},
+	}
+}
+
+// floorKey returns f without its value, identifying its timeseries.
+func floorKey(f latencyFloor) latencyFloor {
+	f.FloorNanos = 0
+	return f
+}
+
+// toPromTimeSeries returns timeseries at at for the floors of the latest
+// calibration, and stale markers for those absent from it.
+func (c *calibrator) toPromTimeSeries(instance string, at time.Time) []prompb.TimeSeries {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ts []prompb.TimeSeries
+	current := make(map[latencyFloor]bool)
+	for _, f := range c.latest.Floors {
+		k := floorKey(f)
+		current[k] = true
+		c.seen[k] = true
+		ts = append(ts, latencyFloorTimeSeries(f, instance, at, float64(f.FloorNanos)))
+	}
+	for k := range c.seen {
+		if !current[k] {
+			ts = append(ts, latencyFloorTimeSeries(k, instance, at, math.Float64frombits(staleNaN)))
+			delete(c.seen, k)
+		}
+	}
+	return ts
+}
+
+// staleMarkers returns stale markers for all timeseries exported.
+func (c *calibrator) staleMarkers(instance string) []prompb.TimeSeries {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var ts []prompb.TimeSeries
+	for k := range c.seen {
+		ts = append(ts, latencyFloorTimeSeries(k, instance, now, math.Float64frombits(staleNaN)))
+	}
+	return ts
+}
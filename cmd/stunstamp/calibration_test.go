@@ -0,0 +1,75 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"math"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCalibrate(t *testing.T) {
+	// ICMP is negotiated away, as it is where ICMP datagram sockets are not
+	// permitted.
+	userspace := &negotiatedProvider{
+		timestampProvider: userspaceProvider{},
+		unavailable:       map[capabilityKey]error{{protocolICMP, false}: syscall.EACCES},
+	}
+	tps := [2]timestampProvider{userspace, tcpInfoProvider{}}
+	c := calibrate(context.Background(), tps, false)
+	got := make(map[protocol]latencyFloor)
+	for _, f := range c.Floors {
+		got[f.Protocol] = f
+	}
+	for _, p := range []protocol{protocolSTUN, protocolTCP} {
+		f, ok := got[p]
+		if !ok {
+			t.Errorf("no floor for %s", p)
+			continue
+		}
+		if f.FloorNanos <= 0 || f.AddressFamily != "ipv4" {
+			t.Errorf("floor for %s = %+v", p, f)
+		}
+	}
+	if _, ok := got[protocolICMP]; ok {
+		t.Error("got ICMP floor from provider without ICMP support")
+	}
+}
+
+func TestCalibratorTimeSeries(t *testing.T) {
+	c := newCalibrator(time.Hour)
+	now := time.Now()
+	if !c.due(now) {
+		t.Error("not due before first calibration")
+	}
+	floor := latencyFloor{Source: "userspace", Protocol: protocolSTUN, AddressFamily: "ipv4", FloorNanos: 20000}
+	c.latest = calibration{At: now, Floors: []latencyFloor{floor}}
+	if c.due(now.Add(time.Minute)) {
+		t.Error("due within interval")
+	}
+	if !c.due(now.Add(time.Hour)) {
+		t.Error("not due after interval")
+	}
+	ts := c.toPromTimeSeries("test", now)
+	if len(ts) != 1 || ts[0].Samples[0].Value != 20000 {
+		t.Fatalf("got timeseries %v", ts)
+	}
+	// A recalibration with a different floor replaces the sample rather
+	// than marking the series stale.
+	floor.FloorNanos = 25000
+	c.latest = calibration{At: now, Floors: []latencyFloor{floor}}
+	if ts := c.toPromTimeSeries("test", now); len(ts) != 1 || ts[0].Samples[0].Value != 25000 {
+		t.Fatalf("got timeseries %v", ts)
+	}
+	c.latest = calibration{At: now}
+	ts = c.toPromTimeSeries("test", now)
+	if len(ts) != 1 || math.Float64bits(ts[0].Samples[0].Value) != staleNaN {
+		t.Errorf("expected stale marker for vanished floor, got %v", ts)
+	}
+	if len(c.staleMarkers("test")) != 0 {
+		t.Error("vanished floor still tracked")
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// capability describes whether this host is able to measure a protocol with
+// timestamps from a source, e.g. whether it holds the privileges needed for
+// ICMP datagram sockets or SO_TIMESTAMPING.
+type capability struct {
+	Source    string
+	Protocol  protocol
+	Available bool
+	// Error is why the capability is unavailable for some or all address
+	// families, if it is, by address family.
+	Error string `json:",omitempty"`
+}
+
+// detectCapabilities returns the capabilities of the providers in tps, and a
+// copy of tps restricted to them by negotiatedProvider. Capabilities are
+// detected by creating, and immediately closing, an unstable conn for every
+// protocol a provider supports, for each destination address family in use,
+// rather than assumed per platform, so that e.g. ICMP datagram sockets are
+// used wherever the kernel permits them. Protocols a provider is unable to
+// create conns for with any address family are reported as unsupported by
+// the returned provider, degrading probing to the remaining sources rather
+// than failing every window.
+func detectCapabilities(tps [2]timestampProvider, ipv6 bool) ([]capability, [2]timestampProvider) {
+	dsts := []netip.Addr{netip.AddrFrom4([4]byte{127, 0, 0, 1})}
+	if ipv6 {
+		dsts = append(dsts, netip.IPv6Loopback())
+	}
+	var caps []capability
+	for i, tp := range tps {
+		if tp == nil {
+			continue
+		}
+		np := &negotiatedProvider{
+			timestampProvider: tp,
+			ipv6:              ipv6,
+			unavailable:       make(map[capabilityKey]error),
+		}
+		for _, p := range allProtocols {
+			if !tp.supports(p, unstableConn) && !tp.supports(p, stableConn) {
+				continue
+			}
+			var errs []string
+			for _, dst := range dsts {
+				cf, err := tp.newConn(dst, p, unstableConn, 0)
+				if err != nil {
+					np.unavailable[capabilityKey{p, dst.Is6()}] = err
+					errs = append(errs, fmt.Sprintf("%s: %s", addressFamilyOf(nodeMeta{addr: dst}), explainCapabilityError(p, err)))
+					continue
+				}
+				if cf != nil {
+					cf.conn.Close()
+				}
+			}
+			caps = append(caps, capability{
+				Source:    tp.source().String(),
+				Protocol:  p,
+				Available: len(errs) < len(dsts),
+				Error:     strings.Join(errs, "; "),
+			})
+		}
+		tps[i] = np
+	}
+	return caps, tps
+}
+
+// explainCapabilityError returns the message of err, an error creating a
+// conn for p, followed by its likely cause if known.
+func explainCapabilityError(p protocol, err error) string {
+	var cause string
+	switch {
+	case errors.Is(err, errors.ErrUnsupported):
+		cause = "not implemented on " + runtime.GOOS
+	case p == protocolICMP && (errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM)):
+		cause = "ICMP datagram sockets require the group of this process to be within net.ipv4.ping_group_range, see /api/privileges"
+	case errors.Is(err, syscall.ENOPROTOOPT):
+		cause = "the kernel lacks the socket option"
+	case errors.Is(err, syscall.EAFNOSUPPORT):
+		cause = "the kernel lacks the address family, e.g. IPv6 is disabled"
+	case errors.Is(err, syscall.EPROTONOSUPPORT):
+		cause = "the kernel lacks the protocol"
+	default:
+		return err.Error()
+	}
+	return fmt.Sprintf("%v (%s)", err, cause)
+}
+
+// isPermanentCapabilityError reports whether err, an error creating a conn,
+// is due to a lack of privileges or of platform support, which retrying
+// will not resolve.
+func isPermanentCapabilityError(err error) bool {
+	for _, target := range []error{errors.ErrUnsupported, syscall.EACCES, syscall.EPERM, syscall.ENOPROTOOPT, syscall.EAFNOSUPPORT, syscall.EPROTONOSUPPORT} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// unmeasurableProtocols returns the protocols in caps which no source is able
+// to measure.
+func unmeasurableProtocols(caps []capability) []protocol {
+	var ret []protocol
+	for _, p := range allProtocols {
+		measurable, known := false, false
+		for _, c := range caps {
+			if c.Protocol == p {
+				known = true
+				measurable = measurable || c.Available
+			}
+		}
+		if known && !measurable {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+type capabilityKey struct {
+	protocol protocol
+	is6      bool
+}
+
+// negotiatedProvider is a timestampProvider restricted to the capabilities
+// detected at runtime. Errors creating conns that retrying will not resolve,
+// whether at detection or later, e.g. once privileges are dropped, are cached
+// by protocol and address family, so that later conns fail fast with them
+// rather than every window attempting them anew. It is safe for concurrent
+// use.
+type negotiatedProvider struct {
+	timestampProvider
+	ipv6 bool // whether IPv6 destinations are in use
+
+	mu          sync.Mutex
+	unavailable map[capabilityKey]error
+}
+
+func (n *negotiatedProvider) supports(p protocol, stable connStability) bool {
+	if !n.timestampProvider.supports(p, stable) {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.unavailable[capabilityKey{p, false}]; !ok {
+		return true
+	}
+	_, ok := n.unavailable[capabilityKey{p, true}]
+	return n.ipv6 && !ok
+}
+
+func (n *negotiatedProvider) newConn(forDst netip.Addr, p protocol, stable connStability, lport int) (*connAndMeasureFn, error) {
+	k := capabilityKey{p, forDst.Is6()}
+	n.mu.Lock()
+	err, ok := n.unavailable[k]
+	n.mu.Unlock()
+	if ok {
+		return nil, err
+	}
+	cf, err := n.timestampProvider.newConn(forDst, p, stable, lport)
+	if err != nil && isPermanentCapabilityError(err) {
+		n.mu.Lock()
+		n.unavailable[k] = err
+		n.mu.Unlock()
+		probeLog.Warn("timestamp source became unavailable for protocol", "source", n.source(), "protocol", p, "address_family", addressFamilyOf(nodeMeta{addr: forDst}), "err", explainCapabilityError(p, err))
+	}
+	return cf, err
+}
+
+// logCapabilities logs the unavailable capabilities in caps, as warnings for
+// the protocols in probed.
+func logCapabilities(caps []capability, probed []protocol) {
+	for _, c := range caps {
+		if c.Available && c.Error == "" {
+			continue
+		}
+		if c.Available && slices.Contains(probed, c.Protocol) {
+			probeLog.Warn("timestamp source unavailable for protocol with some address families", "source", c.Source, "protocol", c.Protocol, "err", c.Error)
+			continue
+		} else if c.Available {
+			probeLog.Debug("timestamp source unavailable for protocol with some address families", "source", c.Source, "protocol", c.Protocol, "err", c.Error)
+			continue
+		}
+		if slices.Contains(probed, c.Protocol) {
+			probeLog.Warn("timestamp source unavailable for protocol, measuring it with other sources only", "source", c.Source, "protocol", c.Protocol, "err", c.Error)
+		} else {
+			probeLog.Debug("timestamp source unavailable for protocol", "source", c.Source, "protocol", c.Protocol, "err", c.Error)
+		}
+	}
+	for _, p := range unmeasurableProtocols(caps) {
+		if slices.Contains(probed, p) {
+			probeLog.Error("no timestamp source is able to measure protocol, it will not be probed", "protocol", p)
+		}
+	}
+}
+
+// privilege is an OS privilege or setting that some probe types depend on,
+// e.g. CAP_NET_RAW for --raw-iface.
+type privilege struct {
+	Name string
+	Held bool
+	// Detail describes how the privilege is or is not held.
+	Detail string `json:",omitempty"`
+	// Enables lists the features depending on the privilege.
+	Enables []string
+	// Remediation is how to obtain the privilege, if it is not held.
+	Remediation string `json:",omitempty"`
+}
+
+const privilegeHeldMetricName = "stunstamp_privilege_held"
+
+// logPrivileges logs the privileges in privs that are not held, as warnings
+// with their remediation for those enabling a feature in inUse.
+func logPrivileges(privs []privilege, inUse []string) {
+	for _, p := range privs {
+		if p.Held {
+			probeLog.Debug("privilege held", "privilege", p.Name, "detail", p.Detail)
+			continue
+		}
+		var needed []string
+		for _, f := range p.Enables {
+			if slices.Contains(inUse, f) {
+				needed = append(needed, f)
+			}
+		}
+		if len(needed) > 0 {
+			probeLog.Warn("privilege required by enabled features not held", "privilege", p.Name, "features", needed, "detail", p.Detail, "remediation", p.Remediation)
+		} else {
+			probeLog.Debug("privilege not held", "privilege", p.Name, "enables", p.Enables, "detail", p.Detail)
+		}
+	}
+}
+
+// privilegesToPromTimeSeries returns a timeseries per privilege in privs,
+// valued 1 if it is held and 0 otherwise, recording the privileges that
+// results were measured with.
+func privilegesToPromTimeSeries(privs []privilege, instance string, at time.Time) []prompb.TimeSeries {
+	ts := make([]prompb.TimeSeries, 0, len(privs))
+	for _, p := range privs {
+		held := 0.0
+		if p.Held {
+			held = 1
+		}
+		t := instanceTimeSeries(privilegeHeldMetricName, instance, at, held)
+		t.Labels = append(t.Labels, prompb.Label{Name: "privilege", Value: p.Name})
+		slices.SortFunc(t.Labels, func(a, b prompb.Label) int {
+			return cmp.Compare(a.Name, b.Name)
+		})
+		ts = append(ts, t)
+	}
+	return ts
+}
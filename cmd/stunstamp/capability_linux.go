@@ -0,0 +1,143 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"tailscale.com/net/ktimestamp"
+)
+
+// Privileges detected by detectPrivileges.
+const (
+	privilegeCapNetRaw      = "cap_net_raw"
+	privilegeCapNetAdmin    = "cap_net_admin"
+	privilegePingGroupRange = "ping_group_range"
+	privilegeSOTimestamping = "so_timestamping"
+)
+
+// parseProcStatusCaps returns the effective and ambient capability sets from
+// the contents of /proc/self/status.
+func parseProcStatusCaps(b []byte) (eff, amb uint64, err error) {
+	var sawEff bool
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		name, value, ok := strings.Cut(s.Text(), ":")
+		if !ok {
+			continue
+		}
+		switch name {
+		case "CapEff":
+			eff, err = strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+			sawEff = true
+		case "CapAmb":
+			amb, err = strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	if !sawEff {
+		return 0, 0, fmt.Errorf("no CapEff")
+	}
+	return eff, amb, nil
+}
+
+// pingGroupRangeIncludes reports whether any of gids is in the range held by
+// net.ipv4.ping_group_range, in the format of its file in /proc/sys, which
+// permits creating ICMP datagram sockets for both IPv4 and IPv6.
+func pingGroupRangeIncludes(b []byte, gids []int) (bool, error) {
+	f := strings.Fields(string(b))
+	if len(f) != 2 {
+		return false, fmt.Errorf("invalid ping_group_range %q", b)
+	}
+	lo, err := strconv.ParseUint(f[0], 10, 32)
+	if err != nil {
+		return false, err
+	}
+	hi, err := strconv.ParseUint(f[1], 10, 32)
+	if err != nil {
+		return false, err
+	}
+	for _, gid := range gids {
+		if uint64(gid) >= lo && uint64(gid) <= hi {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// capabilityPrivilege returns the privilege of holding the capability bit
+// given the sets in /proc/self/status.
+func capabilityPrivilege(name string, bit uint, eff, amb uint64, enables []string, exe string) privilege {
+	p := privilege{Name: name, Enables: enables}
+	switch {
+	case eff&(1<<bit) != 0 && amb&(1<<bit) != 0:
+		p.Held, p.Detail = true, "effective, inherited as an ambient capability"
+	case eff&(1<<bit) != 0:
+		p.Held, p.Detail = true, "effective"
+	default:
+		p.Detail = "not in the effective capability set"
+		upper := strings.ToUpper(name)
+		p.Remediation = fmt.Sprintf("run `setcap %s+ep %s`, or set AmbientCapabilities=%s in its systemd unit, or add it to the container's securityContext.capabilities", name, exe, upper)
+	}
+	return p
+}
+
+// detectPrivileges returns the privileges held by this process.
+func detectPrivileges() []privilege {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = "/path/to/stunstamp"
+	}
+	var privs []privilege
+
+	rawEnables := []string{"--raw-iface"}
+	adminEnables := []string{"--raw-iface hardware timestamps"}
+	if b, err := os.ReadFile("/proc/self/status"); err != nil {
+		privs = append(privs,
+			privilege{Name: privilegeCapNetRaw, Detail: err.Error(), Enables: rawEnables},
+			privilege{Name: privilegeCapNetAdmin, Detail: err.Error(), Enables: adminEnables})
+	} else if eff, amb, err := parseProcStatusCaps(b); err != nil {
+		privs = append(privs,
+			privilege{Name: privilegeCapNetRaw, Detail: err.Error(), Enables: rawEnables},
+			privilege{Name: privilegeCapNetAdmin, Detail: err.Error(), Enables: adminEnables})
+	} else {
+		privs = append(privs,
+			capabilityPrivilege(privilegeCapNetRaw, unix.CAP_NET_RAW, eff, amb, rawEnables, exe),
+			capabilityPrivilege(privilegeCapNetAdmin, unix.CAP_NET_ADMIN, eff, amb, adminEnables, exe))
+	}
+
+	ping := privilege{Name: privilegePingGroupRange, Enables: []string{"--icmp", "--hop-count"}}
+	gids, _ := os.Getgroups()
+	gids = append(gids, os.Getegid())
+	if b, err := os.ReadFile("/proc/sys/net/ipv4/ping_group_range"); err != nil {
+		ping.Detail = err.Error()
+	} else if ping.Held, err = pingGroupRangeIncludes(b, gids); err != nil {
+		ping.Detail = err.Error()
+	} else {
+		ping.Detail = fmt.Sprintf("net.ipv4.ping_group_range is %s", strings.Join(strings.Fields(string(b)), " "))
+	}
+	if !ping.Held {
+		ping.Remediation = fmt.Sprintf("run `sysctl -w net.ipv4.ping_group_range=\"%[1]d %[1]d\"`, and persist it in /etc/sysctl.d, to permit ICMP datagram sockets for group %[1]d", os.Getegid())
+	}
+	privs = append(privs, ping)
+
+	ts := privilege{Name: privilegeSOTimestamping, Enables: []string{"kernel timestamps"}}
+	if opt, err := ktimestamp.NegotiatedOpt(); err != nil {
+		ts.Detail = err.Error()
+		ts.Remediation = "upgrade to Linux 5.1 or later"
+	} else {
+		ts.Held = true
+		ts.Detail = "negotiated " + opt
+	}
+	privs = append(privs, ts)
+	return privs
+}
@@ -0,0 +1,74 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseProcStatusCaps(t *testing.T) {
+	status := []byte("Name:\tstunstamp\nCapInh:\t0000000000000000\nCapPrm:\t0000000000002000\nCapEff:\t0000000000002000\nCapBnd:\t000001ffffffffff\nCapAmb:\t0000000000002000\n")
+	eff, amb, err := parseProcStatusCaps(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := capabilityPrivilege(privilegeCapNetRaw, unix.CAP_NET_RAW, eff, amb, nil, "/usr/bin/stunstamp")
+	if !raw.Held || raw.Detail != "effective, inherited as an ambient capability" {
+		t.Errorf("cap_net_raw = %+v, want held as an ambient capability", raw)
+	}
+	admin := capabilityPrivilege(privilegeCapNetAdmin, unix.CAP_NET_ADMIN, eff, amb, nil, "/usr/bin/stunstamp")
+	if admin.Held || admin.Remediation == "" {
+		t.Errorf("cap_net_admin = %+v, want not held with a remediation", admin)
+	}
+	if _, _, err := parseProcStatusCaps([]byte("Name:\tstunstamp\n")); err == nil {
+		t.Error("status without CapEff parsed")
+	}
+}
+
+func TestPingGroupRangeIncludes(t *testing.T) {
+	tests := []struct {
+		contents string
+		gids     []int
+		want     bool
+	}{
+		{"1\t0\n", []int{0, 1000}, false}, // kernel default, nobody
+		{"0\t2147483647\n", []int{1000}, true},
+		{"100\t200\n", []int{50, 150}, true},
+		{"100\t200\n", []int{50}, false},
+	}
+	for _, tt := range tests {
+		got, err := pingGroupRangeIncludes([]byte(tt.contents), tt.gids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("pingGroupRangeIncludes(%q, %v) = %v, want %v", tt.contents, tt.gids, got, tt.want)
+		}
+	}
+	if _, err := pingGroupRangeIncludes([]byte("x"), nil); err == nil {
+		t.Error("invalid range parsed")
+	}
+}
+
+func TestDetectPrivileges(t *testing.T) {
+	privs := detectPrivileges()
+	names := make(map[string]bool)
+	for _, p := range privs {
+		names[p.Name] = true
+		if !p.Held && p.Remediation == "" && p.Detail == "" {
+			t.Errorf("privilege %s not held without detail or remediation", p.Name)
+		}
+	}
+	for _, name := range []string{privilegeCapNetRaw, privilegeCapNetAdmin, privilegePingGroupRange, privilegeSOTimestamping} {
+		if !names[name] {
+			t.Errorf("privilege %s not detected", name)
+		}
+	}
+	if ts := privilegesToPromTimeSeries(privs, "test", time.Now()); len(ts) != len(privs) {
+		t.Errorf("privilegesToPromTimeSeries() = %d timeseries, want %d", len(ts), len(privs))
+	}
+}
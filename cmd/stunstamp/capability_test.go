@@ -0,0 +1,144 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// fakeProvider supports STUN and ICMP, failing to create ICMP conns.
+type fakeProvider struct{}
+
+func (fakeProvider) source() timestampSource { return timestampSourceKernel }
+
+func (fakeProvider) supports(p protocol, _ connStability) bool {
+	return p == protocolSTUN || p == protocolICMP
+}
+
+func (fakeProvider) newConn(_ netip.Addr, p protocol, _ connStability, _ int) (*connAndMeasureFn, error) {
+	if p == protocolICMP {
+		return nil, syscall.EACCES
+	}
+	return &connAndMeasureFn{conn: new(lportForTCPConn)}, nil
+}
+
+func TestDetectCapabilities(t *testing.T) {
+	caps, tps := detectCapabilities([2]timestampProvider{timestampSourceKernel: fakeProvider{}}, true)
+	want := []capability{
+		{Source: "kernel", Protocol: protocolSTUN, Available: true},
+		{Source: "kernel", Protocol: protocolICMP, Error: "ipv4: " + explainCapabilityError(protocolICMP, syscall.EACCES) + "; ipv6: " + explainCapabilityError(protocolICMP, syscall.EACCES)},
+	}
+	if !slices.Equal(caps, want) {
+		t.Errorf("capabilities = %+v, want %+v", caps, want)
+	}
+	if tps[timestampSourceUserspace] != nil {
+		t.Error("nil provider unexpectedly replaced")
+	}
+	tp := tps[timestampSourceKernel]
+	if !tp.supports(protocolSTUN, stableConn) {
+		t.Error("STUN unexpectedly unsupported")
+	}
+	if tp.supports(protocolICMP, unstableConn) {
+		t.Error("ICMP unexpectedly supported after failing detection")
+	}
+	if got := unmeasurableProtocols(caps); !slices.Equal(got, []protocol{protocolICMP}) {
+		t.Errorf("unmeasurable protocols = %v, want [icmp]", got)
+	}
+
+	caps = append(caps, capability{Source: "userspace", Protocol: protocolICMP, Available: true})
+	if got := unmeasurableProtocols(caps); len(got) != 0 {
+		t.Errorf("unmeasurable protocols = %v, want none", got)
+	}
+	if _, err := tp.newConn(netip.IPv6Loopback(), protocolICMP, unstableConn, 0); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("newConn error = %v, want retained %v", err, syscall.EACCES)
+	}
+}
+
+// flakyProvider supports STUN, failing to create conns for IPv6 or once
+// failErr is set.
+type flakyProvider struct {
+	failErr error
+	calls   int
+}
+
+func (*flakyProvider) source() timestampSource { return timestampSourceKernel }
+
+func (*flakyProvider) supports(p protocol, _ connStability) bool {
+	return p == protocolSTUN
+}
+
+func (f *flakyProvider) newConn(dst netip.Addr, _ protocol, _ connStability, _ int) (*connAndMeasureFn, error) {
+	f.calls++
+	if dst.Is6() {
+		return nil, syscall.EAFNOSUPPORT
+	}
+	if f.failErr != nil {
+		return nil, f.failErr
+	}
+	return &connAndMeasureFn{conn: new(lportForTCPConn)}, nil
+}
+
+func TestNegotiatedProvider(t *testing.T) {
+	fp := &flakyProvider{}
+	caps, tps := detectCapabilities([2]timestampProvider{timestampSourceKernel: fp}, true)
+	if len(caps) != 1 || !caps[0].Available || !strings.HasPrefix(caps[0].Error, "ipv6: ") {
+		t.Fatalf("capabilities = %+v, want STUN available with an IPv6 error", caps)
+	}
+	tp := tps[timestampSourceKernel]
+	if !tp.supports(protocolSTUN, stableConn) {
+		t.Error("STUN unsupported despite IPv4 being available")
+	}
+	calls := fp.calls
+	if _, err := tp.newConn(netip.IPv6Loopback(), protocolSTUN, stableConn, 0); !errors.Is(err, syscall.EAFNOSUPPORT) {
+		t.Errorf("IPv6 newConn error = %v, want %v", err, syscall.EAFNOSUPPORT)
+	}
+	if fp.calls != calls {
+		t.Error("IPv6 conn attempted again despite failing detection")
+	}
+
+	fp.failErr = errors.New("transient")
+	for range 2 {
+		tp.newConn(netip.AddrFrom4([4]byte{127, 0, 0, 1}), protocolSTUN, stableConn, 0)
+	}
+	if !tp.supports(protocolSTUN, stableConn) {
+		t.Error("STUN unsupported after a transient error")
+	}
+	fp.failErr = syscall.EPERM
+	for range 2 {
+		tp.newConn(netip.AddrFrom4([4]byte{127, 0, 0, 1}), protocolSTUN, stableConn, 0)
+	}
+	if got := fp.calls - calls; got != 3 {
+		t.Errorf("got %d conn attempts, want 3 as permanent errors are cached", got)
+	}
+	if tp.supports(protocolSTUN, stableConn) {
+		t.Error("STUN supported after permanent errors for both address families")
+	}
+}
+
+func TestExplainCapabilityError(t *testing.T) {
+	tests := []struct {
+		p    protocol
+		err  error
+		want string
+	}{
+		{protocolICMP, fmt.Errorf("ICMP datagram sockets: %w", errors.ErrUnsupported), "not implemented on " + runtime.GOOS},
+		{protocolICMP, syscall.EACCES, "ping_group_range"},
+		{protocolSTUN, syscall.ENOPROTOOPT, "lacks the socket option"},
+	}
+	for _, tt := range tests {
+		if got := explainCapabilityError(tt.p, tt.err); !strings.HasPrefix(got, tt.err.Error()) || !strings.Contains(got, tt.want) {
+			t.Errorf("explainCapabilityError(%s, %v) = %q, want it to explain %q", tt.p, tt.err, got, tt.want)
+		}
+	}
+	if got := explainCapabilityError(protocolSTUN, errors.New("other")); got != "other" {
+		t.Errorf("got %q for an unknown error, want it unchanged", got)
+	}
+}
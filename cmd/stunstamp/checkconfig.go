@@ -0,0 +1,342 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// checkConfigTimeout bounds every network check of --check-config.
+const checkConfigTimeout = 10 * time.Second
+
+// secretFlags are flags whose values are redacted from the effective
+// configuration. URL flags additionally have their passwords redacted.
+var secretFlags = []string{"snmp-community", "twamp-auth-keys"}
+
+// configCheck is the outcome of a check run by --check-config.
+type configCheck struct {
+	Name  string
+	OK    bool
+	Error string `json:",omitempty"`
+}
+
+// effectiveTarget is a target that would be probed, with its ports.
+type effectiveTarget struct {
+	RegionID   int
+	RegionCode string
+	Hostname   string
+	Addr       netip.Addr
+	Ports      map[protocol][]int
+}
+
+// effectiveConfig is the configuration stunstamp would run with, as printed
+// by --check-config.
+type effectiveConfig struct {
+	Instance string
+	// Flags holds the value of every flag, whether set or defaulted.
+	Flags map[string]string
+	// Ports are the destination ports by protocol from flags.
+	Ports map[protocol][]int
+	// Config is the config file, with defaults applied.
+	Config       *config
+	Targets      []effectiveTarget
+	Capabilities []capability
+	Checks       []configCheck
+}
+
+// failed returns the number of failed checks.
+func (e *effectiveConfig) failed() int {
+	n := 0
+	for _, c := range e.Checks {
+		if !c.OK {
+			n++
+		}
+	}
+	return n
+}
+
+func (e *effectiveConfig) check(name string, err error) {
+	c := configCheck{Name: name, OK: err == nil}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	e.Checks = append(e.Checks, c)
+}
+
+// runCheckConfig validates the configuration beyond what is possible
+// offline, fetching the DERP map to resolve targets, connecting to every
+// output and endpoint, and checking that every protocol probed has a
+// timestamp source available on this platform, per caps. It writes the
+// effective configuration as JSON to w, and returns an error if any check
+// failed.
+func runCheckConfig(ctx context.Context, w io.Writer, cfg *config, portsByProtocol map[protocol][]int, caps []capability, probed []protocol) error {
+	e := &effectiveConfig{
+		Instance:     *flagInstance,
+		Flags:        make(map[string]string),
+		Ports:        portsByProtocol,
+		Config:       cfg,
+		Capabilities: caps,
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		e.Flags[f.Name] = redactFlag(f.Name, f.Value.String())
+	})
+	if *flagQualityScore {
+		full := cfg.QualityScore.withDefaults()
+		resolved := *cfg
+		resolved.QualityScore = &full
+		e.Config = &resolved
+	}
+
+	e.Targets = checkTargets(ctx, e, cfg, portsByProtocol)
+
+	slices.Sort(probed)
+	for _, p := range slices.Compact(probed) {
+		var available bool
+		var errs []string
+		for _, c := range caps {
+			if c.Protocol != p {
+				continue
+			}
+			available = available || c.Available
+			if c.Error != "" {
+				errs = append(errs, fmt.Sprintf("%s: %s", c.Source, c.Error))
+			}
+		}
+		var err error
+		if !available && len(errs) > 0 {
+			err = fmt.Errorf("no timestamp source available (%s)", strings.Join(errs, "; "))
+		}
+		e.check(fmt.Sprintf("timestamp sources for %s", p), err)
+	}
+
+	for _, name := range []string{"rw-url", "otlp-url", "webhook-url", "derp-map-webhook-url", "control-url", "proxy"} {
+		if v := flag.Lookup(name).Value.String(); v != "" {
+			e.check("reachable "+name, dialURL(ctx, v))
+		}
+	}
+	for _, f := range cfg.Funnels {
+		e.check("reachable funnel "+f.URL, dialFunnel(ctx, f))
+	}
+	if len(*flagStoreDir) > 0 {
+		var err error
+		if fi, statErr := os.Stat(*flagStoreDir); statErr == nil && !fi.IsDir() {
+			err = fmt.Errorf("%s is not a directory", *flagStoreDir)
+		} else if statErr != nil && !os.IsNotExist(statErr) {
+			err = statErr
+		}
+		e.check("store-dir", err)
+	}
+
+	b, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", b); err != nil {
+		return err
+	}
+	if n := e.failed(); n > 0 {
+		return fmt.Errorf("%d of %d checks failed", n, len(e.Checks))
+	}
+	return nil
+}
+
+// checkTargets fetches the DERP map and returns the targets selected from it
+// by cfg, recording the outcome as checks of e.
+func checkTargets(ctx context.Context, e *effectiveConfig, cfg *config, portsByProtocol map[protocol][]int) []effectiveTarget {
+	ctx, cancel := context.WithTimeout(ctx, checkConfigTimeout)
+	defer cancel()
+	dm, err := getDERPMap(ctx, *flagDERPMap)
+	e.check("derp-map", err)
+	if err != nil {
+		return nil
+	}
+	metas := make(map[netip.Addr]nodeMeta)
+	_, err = nodeMetaFromDERPMap(cfg.Targets.apply(dm), metas, *flagIPv6)
+	if err == nil && len(metas) == 0 {
+		err = fmt.Errorf("no targets selected from %d regions", len(dm.Regions))
+	}
+	e.check("targets", err)
+	if err != nil {
+		return nil
+	}
+	stunPorts := derpSTUNPorts(dm)
+	var targets []effectiveTarget
+	for _, meta := range metas {
+		ports := cfg.portsFor(meta, portsByProtocol)
+		if *flagDERPSTUNPorts {
+			ports = addSTUNPort(ports, stunPorts[meta.hostname])
+		}
+		targets = append(targets, effectiveTarget{
+			RegionID:   meta.regionID,
+			RegionCode: meta.regionCode,
+			Hostname:   meta.hostname,
+			Addr:       meta.addr,
+			Ports:      ports,
+		})
+	}
+	slices.SortFunc(targets, func(a, b effectiveTarget) int {
+		return cmp.Or(
+			cmp.Compare(a.RegionID, b.RegionID),
+			cmp.Compare(a.Hostname, b.Hostname),
+			a.Addr.Compare(b.Addr),
+		)
+	})
+	return targets
+}
+
+// redactFlag returns value of the flag name with secrets redacted.
+func redactFlag(name, value string) string {
+	if value == "" {
+		return value
+	}
+	if slices.Contains(secretFlags, name) {
+		return "REDACTED"
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return value
+}
+
+// dialURL connects to the host of rawURL over TCP, on the default port of its
+// scheme if it has none.
+func dialURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf("URL %q has no host", rawURL)
+	}
+	port := u.Port()
+	if port == "" {
+		port, err = lookupSchemePort(u.Scheme)
+		if err != nil {
+			return err
+		}
+	}
+	return dialCheck(ctx, net.JoinHostPort(u.Hostname(), port))
+}
+
+func lookupSchemePort(scheme string) (string, error) {
+	switch scheme {
+	case "http":
+		return "80", nil
+	case "https":
+		return "443", nil
+	case "socks5":
+		return "1080", nil
+	}
+	return "", fmt.Errorf("unknown default port for scheme %q", scheme)
+}
+
+// dialFunnel connects to the Funnel ingress of f.
+func dialFunnel(ctx context.Context, f funnelConfig) error {
+	if f.Addr == "" {
+		return dialURL(ctx, f.URL)
+	}
+	u, _ := url.Parse(f.URL) // validated
+	return dialCheck(ctx, net.JoinHostPort(f.Addr, cmp.Or(u.Port(), "443")))
+}
+
+func dialCheck(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, checkConfigTimeout)
+	defer cancel()
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// configSchema returns a JSON Schema describing the config file, for editors
+// to validate and complete it with.
+func configSchema() map[string]any {
+	s := jsonSchemaOf(reflect.TypeFor[config]())
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["title"] = "stunstamp config"
+	return s
+}
+
+// jsonSchemaOf returns the JSON Schema of values of t as encoded by
+// encoding/json.
+func jsonSchemaOf(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case reflect.TypeFor[time.Time]():
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeFor[netip.Addr]():
+		return map[string]any{"type": "string", "format": "ip"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		if t == reflect.TypeFor[protocol]() {
+			return map[string]any{"type": "string", "enum": allProtocols}
+		}
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": jsonSchemaOf(t.Elem())}
+	case reflect.Map:
+		s := map[string]any{"type": "object", "additionalProperties": jsonSchemaOf(t.Elem())}
+		if t.Key() == reflect.TypeFor[protocol]() {
+			s["propertyNames"] = map[string]any{"enum": allProtocols}
+		}
+		return s
+	case reflect.Struct:
+		props := make(map[string]any)
+		addStructProperties(t, props)
+		// The config is decoded with unknown fields disallowed.
+		return map[string]any{"type": "object", "properties": props, "additionalProperties": false}
+	}
+	return map[string]any{}
+}
+
+// addStructProperties adds the schemas of the fields of the struct type t to
+// props, flattening embedded structs as encoding/json does.
+func addStructProperties(t reflect.Type, props map[string]any) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch {
+		case name == "-":
+		case f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct:
+			addStructProperties(f.Type, props)
+		case f.IsExported():
+			props[cmp.Or(name, f.Name)] = jsonSchemaOf(f.Type)
+		}
+	}
+}
+
+// runPrintSchema writes the JSON Schema of the config file to w.
+func runPrintSchema(w io.Writer) error {
+	b, err := json.MarshalIndent(configSchema(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
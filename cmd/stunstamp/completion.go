@@ -0,0 +1,161 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// subcommands are the subcommands of stunstamp and their own subcommands,
+// as completed by the completion script.
+var subcommands = map[string][]string{
+	"bundle":         nil,
+	"completion":     {"bash", "zsh"},
+	"config":         {"effective"},
+	"db":             {"import", "merge", "prune", "verify"},
+	"loaded-latency": nil,
+	"report":         nil,
+	"scaffold":       nil,
+	"simulate":       nil,
+	"slo-report":     nil,
+	"targets":        {"list"},
+}
+
+// targetsListFlags are the flags of the targets list subcommand, see
+// runTargets.
+var targetsListFlags = []string{"--http-addr", "--json", "--names", "--protocol"}
+
+// runCompletion implements the completion subcommand, writing a completion
+// script for the shell in args to w. The script completes subcommands,
+// flags, protocols, and the hostnames of the targets of the stunstamp
+// process serving on --http-addr, or $STUNSTAMP_HTTP_ADDR, via targets list.
+func runCompletion(args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: stunstamp completion bash|zsh")
+	}
+	switch args[0] {
+	case "bash", "zsh":
+	default:
+		return fmt.Errorf("unsupported shell %q, want bash or zsh", args[0])
+	}
+	var flags []string
+	// Flags taking a value, whose values are not subcommands.
+	valueFlags := []string{"hostname", "protocol"}
+	flag.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, "--"+f.Name)
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !bf.IsBoolFlag() {
+			valueFlags = append(valueFlags, f.Name)
+		}
+	})
+	var subs, nested []string
+	for _, sub := range slices.Sorted(maps.Keys(subcommands)) {
+		subs = append(subs, sub)
+		if len(subcommands[sub]) > 0 {
+			nested = append(nested, fmt.Sprintf("%s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;", sub, strings.Join(subcommands[sub], " ")))
+		}
+	}
+	protos := make([]string, len(allProtocols))
+	for i, p := range allProtocols {
+		protos[i] = string(p)
+	}
+	return completionTemplate.Execute(w, map[string]any{
+		"Zsh":         args[0] == "zsh",
+		"Flags":       strings.Join(flags, " "),
+		"ValueFlags":  strings.Join(valueFlags, " "),
+		"TargetsList": strings.Join(targetsListFlags, " "),
+		"Subcommands": strings.Join(subs, " "),
+		"Nested":      nested,
+		"Protocols":   strings.Join(protos, " "),
+	})
+}
+
+var completionTemplate = template.Must(template.New("completion").Parse(`# stunstamp completion, generated by "stunstamp completion". Load with:
+#	source <(stunstamp completion {{if .Zsh}}zsh{{else}}bash{{end}})
+{{- if .Zsh}}
+autoload -U +X bashcompinit && bashcompinit
+{{- end}}
+
+_stunstamp_targets() {
+	stunstamp targets list --names ${1:+--http-addr="$1"} 2>/dev/null
+}
+
+_stunstamp() {
+	local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"
+	local sub="" nested="" addr="${STUNSTAMP_HTTP_ADDR:-}" i w
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		w="${COMP_WORDS[i]}"
+		case "$w" in
+		=)
+			# The value of --flag=value, split by COMP_WORDBREAKS.
+			((i++))
+			[[ "${COMP_WORDS[i-2]}" == *-http-addr ]] && addr="${COMP_WORDS[i]}"
+			;;
+		-*)
+			local name="${w#-}"
+			name="${name#-}"
+			if [[ " {{.ValueFlags}} " == *" $name "* && "${COMP_WORDS[i+1]}" != "=" ]]; then
+				((i++))
+				[[ "$name" == http-addr ]] && addr="${COMP_WORDS[i]}"
+			fi ;;
+		*)
+			if [[ -z "$sub" ]]; then
+				sub="$w"
+			elif [[ -z "$nested" ]]; then
+				nested="$w"
+			fi ;;
+		esac
+	done
+
+	# Complete flag values, given as --flag value or --flag=value.
+	local flag="$prev"
+	if [[ "$cur" == "=" ]]; then
+		cur=""
+	elif [[ "$prev" == "=" ]]; then
+		flag="${COMP_WORDS[COMP_CWORD-2]}"
+	fi
+	case "$flag" in
+	--hostname|-hostname|--annotate-hostname|-annotate-hostname)
+		COMPREPLY=($(compgen -W "$(_stunstamp_targets "$addr")" -- "$cur"))
+		return ;;
+	--protocol|-protocol)
+		COMPREPLY=($(compgen -W "{{.Protocols}}" -- "$cur"))
+		return ;;
+	--store-dir|-store-dir)
+		COMPREPLY=($(compgen -d -- "$cur"))
+		return ;;
+	--config|-config)
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return ;;
+	esac
+
+	if [[ -z "$sub" ]]; then
+		if [[ "$cur" == -* ]]; then
+			COMPREPLY=($(compgen -W "{{.Flags}}" -- "$cur"))
+		else
+			COMPREPLY=($(compgen -W "{{.Subcommands}}" -- "$cur"))
+		fi
+		return
+	fi
+	if [[ -z "$nested" ]]; then
+		case "$sub" in
+		{{- range .Nested}}
+		{{.}}
+		{{- end}}
+		esac
+		return
+	fi
+	if [[ "$sub $nested" == "targets list" && "$cur" == -* ]]; then
+		COMPREPLY=($(compgen -W "{{.TargetsList}}" -- "$cur"))
+	fi
+}
+
+complete -F _stunstamp stunstamp
+`))
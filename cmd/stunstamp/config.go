@@ -0,0 +1,349 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/tailscale/hujson"
+)
+
+// config is the optional HuJSON config file passed via --config. Flags remain
+// the primary means of configuration; the config file holds structured
+// settings that do not map well to flags. Changes to the file are applied
+// without a restart, see watchConfig.
+type config struct {
+	// Groups are named sets of targets for which composite metrics are
+	// computed every probe window.
+	Groups []groupConfig `json:",omitempty"`
+	// Retry holds per-protocol retry policies. Protocols without a policy
+	// send a single probe per window.
+	Retry map[protocol]retryPolicy `json:",omitempty"`
+	// TargetPorts holds per-target destination ports. The first entry
+	// matching a target replaces the ports given by flags for the protocols
+	// it holds, e.g. to probe STUN on both 3478 and 443 against some regions.
+	TargetPorts []targetPortsConfig `json:",omitempty"`
+	// Targets selects the DERP map nodes to probe with expressions over
+	// their attributes. All nodes are probed if unset.
+	Targets *targetFilter `json:",omitempty"`
+	// QualityScore configures the weights and thresholds of the network
+	// quality score computed with --quality-score. Defaults apply if unset.
+	QualityScore *qualityScoreConfig `json:",omitempty"`
+	// Funnels are Tailscale Funnel endpoints to probe over HTTPS every
+	// window, measuring their reachability from the public internet.
+	Funnels []funnelConfig `json:",omitempty"`
+	// Scheduling marks targets critical, so that best-effort targets are
+	// shed first under resource pressure.
+	Scheduling *schedulingConfig `json:",omitempty"`
+	// Intervals holds per-protocol probe intervals, optionally per target,
+	// e.g. to probe STUN every second and HTTPS every 30 seconds. Protocols
+	// without an interval are probed every --interval.
+	Intervals []intervalConfig `json:",omitempty"`
+	// Pruning demotes targets unreachable by every protocol for a duration
+	// to slow rediscovery probing.
+	Pruning *pruningConfig `json:",omitempty"`
+	// SLOs are latency service level objectives evaluated continuously,
+	// with monthly reports written to --store-dir.
+	SLOs []sloConfig `json:",omitempty"`
+	// HTTPSRequests customize the request of the https protocol per
+	// target, e.g. its method, path, headers, and expected status, to
+	// measure the latency of services other than DERPs. The first entry
+	// matching a target applies.
+	HTTPSRequests []httpsRequestConfig `json:",omitempty"`
+	// AB compares two probe profiles, e.g. DSCP marked vs. unmarked, by
+	// STUN probes to every STUN target every full window, exporting the
+	// paired differences of their RTTs.
+	AB *abConfig `json:",omitempty"`
+}
+
+// targetSelector selects targets by region or hostname. A node matches if it
+// matches any of the non-empty selectors.
+type targetSelector struct {
+	RegionIDs   []int    `json:",omitempty"`
+	RegionCodes []string `json:",omitempty"`
+	Hostnames   []string `json:",omitempty"`
+}
+
+// matches reports whether meta is selected by s.
+func (s *targetSelector) matches(meta nodeMeta) bool {
+	return slices.Contains(s.RegionIDs, meta.regionID) ||
+		slices.Contains(s.RegionCodes, meta.regionCode) ||
+		slices.Contains(s.Hostnames, meta.hostname)
+}
+
+func (s *targetSelector) empty() bool {
+	return len(s.RegionIDs) == 0 && len(s.RegionCodes) == 0 && len(s.Hostnames) == 0
+}
+
+// groupConfig describes a named group of targets.
+type groupConfig struct {
+	Name string
+	targetSelector
+}
+
+// targetPortsConfig holds the destination ports by protocol of the selected
+// targets.
+type targetPortsConfig struct {
+	targetSelector
+	Ports map[protocol][]int
+}
+
+// portsFor returns the destination ports by protocol to probe meta with,
+// given defaults from flags.
+func (c *config) portsFor(meta nodeMeta, defaults map[protocol][]int) map[protocol][]int {
+	for _, tp := range c.TargetPorts {
+		if !tp.matches(meta) {
+			continue
+		}
+		ret := maps.Clone(defaults)
+		if ret == nil {
+			ret = make(map[protocol][]int)
+		}
+		maps.Copy(ret, tp.Ports)
+		return ret
+	}
+	return defaults
+}
+
+// removedPorts returns the ports by protocol in before that are not in after.
+func removedPorts(before, after map[protocol][]int) map[protocol][]int {
+	ret := make(map[protocol][]int)
+	for p, ports := range before {
+		for _, port := range ports {
+			if !slices.Contains(after[p], port) {
+				ret[p] = append(ret[p], port)
+			}
+		}
+	}
+	return ret
+}
+
+// portsByAddr returns the destination ports by protocol of targets whose
+// ports differ from defaults.
+func (c *config) portsByAddr(targets map[netip.Addr]nodeMeta, defaults map[protocol][]int) map[netip.Addr]map[protocol][]int {
+	ret := make(map[netip.Addr]map[protocol][]int)
+	if len(c.TargetPorts) == 0 {
+		return ret
+	}
+	for addr, meta := range targets {
+		if ports := c.portsFor(meta, defaults); !maps.EqualFunc(ports, defaults, slices.Equal) {
+			ret[addr] = ports
+		}
+	}
+	return ret
+}
+
+// loadConfig reads and validates the HuJSON config file at path, or the
+// config merged from the layers at the comma-separated paths in it, see
+// mergeConfigLayers.
+func loadConfig(path string) (*config, error) {
+	layers, err := readConfigLayers(splitConfigPaths(path))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := mergeConfigLayers(layers)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(raw)
+}
+
+func parseConfig(raw []byte) (*config, error) {
+	std, err := hujson.Standardize(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config HuJSON/JSON: %w", err)
+	}
+	c := &config{}
+	jd := json.NewDecoder(bytes.NewReader(std))
+	jd.DisallowUnknownFields()
+	err = jd.Decode(c)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config: %w", err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *config) validate() error {
+	seen := make(map[string]bool)
+	for _, g := range c.Groups {
+		if len(g.Name) == 0 {
+			return errors.New("group with empty name")
+		}
+		if seen[g.Name] {
+			return fmt.Errorf("duplicate group name: %q", g.Name)
+		}
+		seen[g.Name] = true
+		if g.empty() {
+			return fmt.Errorf("group %q has no selectors", g.Name)
+		}
+	}
+	for i, tp := range c.TargetPorts {
+		if tp.empty() {
+			return fmt.Errorf("target ports %d have no selectors", i)
+		}
+		for p, ports := range tp.Ports {
+			if !slices.Contains(allProtocols, p) {
+				return fmt.Errorf("target ports %d for unknown protocol %q", i, p)
+			}
+			if p == protocolICMP {
+				return fmt.Errorf("target ports %d for protocol %q, which has no ports", i, p)
+			}
+			for j, port := range ports {
+				if port < 1 || port > 65535 {
+					return fmt.Errorf("target ports %d for protocol %q: invalid port %d", i, p, port)
+				}
+				if slices.Contains(ports[:j], port) {
+					return fmt.Errorf("target ports %d for protocol %q: duplicate port %d", i, p, port)
+				}
+			}
+		}
+	}
+	if c.Targets != nil {
+		if err := c.Targets.validate(); err != nil {
+			return fmt.Errorf("invalid targets: %w", err)
+		}
+	}
+	for i, f := range c.Funnels {
+		if err := f.validate(); err != nil {
+			return fmt.Errorf("funnel %d: %w", i, err)
+		}
+	}
+	if c.QualityScore != nil {
+		if err := c.QualityScore.validate(); err != nil {
+			return fmt.Errorf("invalid quality score: %w", err)
+		}
+	}
+	if c.Scheduling != nil {
+		if err := c.Scheduling.validate(); err != nil {
+			return fmt.Errorf("invalid scheduling: %w", err)
+		}
+	}
+	for i, ic := range c.Intervals {
+		if err := ic.validate(); err != nil {
+			return fmt.Errorf("intervals %d: %w", i, err)
+		}
+	}
+	if c.Pruning != nil {
+		if err := c.Pruning.validate(); err != nil {
+			return fmt.Errorf("invalid pruning: %w", err)
+		}
+	}
+	sloNames := make(map[string]bool)
+	for i, slo := range c.SLOs {
+		if err := slo.validate(); err != nil {
+			return fmt.Errorf("SLO %d: %w", i, err)
+		}
+		if sloNames[slo.Name] {
+			return fmt.Errorf("duplicate SLO name %q", slo.Name)
+		}
+		sloNames[slo.Name] = true
+	}
+	for i, hr := range c.HTTPSRequests {
+		if err := hr.validate(); err != nil {
+			return fmt.Errorf("https request %d: %w", i, err)
+		}
+	}
+	if c.AB != nil {
+		if err := c.AB.validate(); err != nil {
+			return fmt.Errorf("invalid AB: %w", err)
+		}
+	}
+	for p, policy := range c.Retry {
+		if !slices.Contains(allProtocols, p) {
+			return fmt.Errorf("retry policy for unknown protocol %q", p)
+		}
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("invalid retry policy for protocol %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// configPollInterval is how often watchConfig re-reads the config file if
+// fsnotify is unavailable.
+const configPollInterval = 30 * time.Second
+
+// watchConfig watches the config file at path, or the layers of it at the
+// comma-separated paths in it, sending it to ch whenever its contents change
+// and it is valid. Invalid configs are logged and ignored,
+// leaving the previous config in effect. It never returns.
+//
+// The parent directories are watched rather than the files, as Kubernetes
+// updates mounted ConfigMaps by atomically swapping a symlink in them.
+func watchConfig(path string, ch chan<- *config) {
+	paths := splitConfigPaths(path)
+	var tickChan <-chan time.Time
+	var eventChan <-chan fsnotify.Event
+	if w, err := fsnotify.NewWatcher(); err != nil {
+		probeLog.Warn("error creating fsnotify watcher, polling config instead", "err", err)
+	} else if err := watchConfigDirs(w, paths); err != nil {
+		w.Close()
+		probeLog.Warn("error watching config directory, polling config instead", "err", err)
+	} else {
+		eventChan = w.Events
+	}
+	if eventChan == nil {
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		tickChan = ticker.C
+	}
+
+	prev, _ := readConfigLayers(paths)
+	for {
+		select {
+		case <-tickChan:
+		case <-eventChan:
+			// Events for the mounted files are indirect, see above, so
+			// re-read them on any event in their directories.
+		}
+		layers, err := readConfigLayers(paths)
+		if err != nil {
+			probeLog.Error("error reading config, keeping previous config", "err", err)
+			continue
+		}
+		if slices.EqualFunc(layers, prev, func(a, b configLayer) bool { return bytes.Equal(a.raw, b.raw) }) {
+			continue
+		}
+		prev = layers
+		raw, err := mergeConfigLayers(layers)
+		if err != nil {
+			probeLog.Error("invalid config, keeping previous config", "err", err)
+			continue
+		}
+		c, err := parseConfig(raw)
+		if err != nil {
+			probeLog.Error("invalid config, keeping previous config", "err", err)
+			continue
+		}
+		probeLog.Info("config changed, reloading")
+		ch <- c
+	}
+}
+
+// watchConfigDirs adds the parent directories of paths to w.
+func watchConfigDirs(w *fsnotify.Watcher, paths []string) error {
+	var dirs []string
+	for _, p := range paths {
+		dirs = append(dirs, filepath.Dir(p))
+	}
+	slices.Sort(dirs)
+	for _, d := range slices.Compact(dirs) {
+		if err := w.Add(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
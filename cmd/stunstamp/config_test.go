@@ -0,0 +1,102 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfigTargetPorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			raw:  `{"TargetPorts": [{"RegionCodes": ["fra"], "Ports": {"stun": [3478, 443]}}]}`,
+		},
+		{
+			name: "disable protocol",
+			raw:  `{"TargetPorts": [{"Hostnames": ["derp4a"], "Ports": {"https": []}}]}`,
+		},
+		{
+			name:    "no selectors",
+			raw:     `{"TargetPorts": [{"Ports": {"stun": [3478]}}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown protocol",
+			raw:     `{"TargetPorts": [{"RegionIDs": [4], "Ports": {"quic": [443]}}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "icmp",
+			raw:     `{"TargetPorts": [{"RegionIDs": [4], "Ports": {"icmp": [1]}}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid port",
+			raw:     `{"TargetPorts": [{"RegionIDs": [4], "Ports": {"stun": [65536]}}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "duplicate port",
+			raw:     `{"TargetPorts": [{"RegionIDs": [4], "Ports": {"stun": [3478, 3478]}}]}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig([]byte(tt.raw))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseConfig() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigPortsFor(t *testing.T) {
+	c, err := parseConfig([]byte(`{
+		"TargetPorts": [
+			{"RegionCodes": ["fra"], "Ports": {"stun": [3478, 443]}},
+			{"RegionIDs": [4, 5], "Ports": {"tcp": [443]}},
+		],
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := map[protocol][]int{protocolSTUN: {3478}, protocolICMP: {0}}
+	fra := nodeMeta{regionID: 4, regionCode: "fra", hostname: "derp4a", addr: netip.MustParseAddr("192.0.2.1")}
+	ams := nodeMeta{regionID: 5, regionCode: "ams", hostname: "derp5a", addr: netip.MustParseAddr("192.0.2.2")}
+	nyc := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "derp1a", addr: netip.MustParseAddr("192.0.2.3")}
+
+	// The first matching entry applies.
+	want := map[protocol][]int{protocolSTUN: {3478, 443}, protocolICMP: {0}}
+	if got := c.portsFor(fra, defaults); !reflect.DeepEqual(got, want) {
+		t.Errorf("portsFor(fra) = %v, want %v", got, want)
+	}
+	want = map[protocol][]int{protocolSTUN: {3478}, protocolICMP: {0}, protocolTCP: {443}}
+	if got := c.portsFor(ams, defaults); !reflect.DeepEqual(got, want) {
+		t.Errorf("portsFor(ams) = %v, want %v", got, want)
+	}
+	if got := c.portsFor(nyc, defaults); !reflect.DeepEqual(got, defaults) {
+		t.Errorf("portsFor(nyc) = %v, want defaults", got)
+	}
+	if defaults[protocolSTUN][0] != 3478 || len(defaults) != 2 {
+		t.Errorf("portsFor modified defaults: %v", defaults)
+	}
+
+	got := c.portsByAddr(map[netip.Addr]nodeMeta{fra.addr: fra, ams.addr: ams, nyc.addr: nyc}, defaults)
+	if len(got) != 2 || got[nyc.addr] != nil {
+		t.Errorf("portsByAddr() = %v, want entries for fra and ams only", got)
+	}
+
+	removed := removedPorts(c.portsFor(fra, defaults), defaults)
+	if want := map[protocol][]int{protocolSTUN: {443}}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removedPorts() = %v, want %v", removed, want)
+	}
+}
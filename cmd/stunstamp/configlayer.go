@@ -0,0 +1,304 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/tailscale/hujson"
+)
+
+// The config may be split into layers: --config takes a comma-separated list
+// of files, each a partial config merged over the layers before it, e.g.
+// global defaults shared by every prober, then a site's differences from
+// them, then overrides for some of its targets:
+//
+//	stunstamp --config=defaults.hujson,site-fra.hujson,targets-fra.hujson
+//
+// Layers are merged as follows:
+//
+//   - objects are merged field by field, and a null value removes the field
+//     as set by earlier layers;
+//   - the entries of configTargetSections, of which the first entry matching
+//     a target applies, take precedence over those of earlier layers, so
+//     that a layer overrides the settings of the targets it selects only;
+//   - the entries of configNamedSections replace the entries of the same
+//     name of earlier layers, and are appended otherwise;
+//   - any other value, including other lists, replaces that of earlier
+//     layers.
+//
+// Field names match case-insensitively, as when decoding. Only the merged
+// config is validated, so a layer need not be valid on its own.
+var (
+	configTargetSections = []string{"TargetPorts", "Intervals", "HTTPSRequests"}
+	// configNamedSections maps sections to the field naming their entries.
+	configNamedSections = map[string]string{
+		"Groups":  "Name",
+		"SLOs":    "Name",
+		"Funnels": "URL",
+	}
+)
+
+// configLayer is a config file as read.
+type configLayer struct {
+	path string
+	raw  []byte
+}
+
+// splitConfigPaths returns the paths of the config layers in the --config
+// flag value s.
+func splitConfigPaths(s string) []string {
+	var ret []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+func readConfigLayers(paths []string) ([]configLayer, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no config files")
+	}
+	layers := make([]configLayer, 0, len(paths))
+	for _, p := range paths {
+		raw, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, configLayer{path: p, raw: raw})
+	}
+	return layers, nil
+}
+
+// mergeConfigLayers returns the config merged from layers, as JSON, for
+// parseConfig. A single layer is returned as is.
+func mergeConfigLayers(layers []configLayer) ([]byte, error) {
+	if len(layers) == 1 {
+		return layers[0].raw, nil
+	}
+	merged := make(map[string]any)
+	for _, l := range layers {
+		std, err := hujson.Standardize(l.raw)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing config %s HuJSON/JSON: %w", l.path, err)
+		}
+		// Decode every layer on its own first, so that errors such as
+		// unknown fields name the layer and position they are at.
+		jd := json.NewDecoder(bytes.NewReader(std))
+		jd.DisallowUnknownFields()
+		if err := jd.Decode(new(config)); err != nil {
+			return nil, fmt.Errorf("error parsing config %s: %w", l.path, err)
+		}
+		var obj map[string]any
+		jd = json.NewDecoder(bytes.NewReader(std))
+		jd.UseNumber()
+		if err := jd.Decode(&obj); err != nil {
+			return nil, fmt.Errorf("error parsing config %s: %w", l.path, err)
+		}
+		mergeConfigLayer(merged, obj)
+	}
+	return json.Marshal(merged)
+}
+
+// mergeConfigLayer merges the top-level sections of the layer over into
+// base.
+func mergeConfigLayer(base, over map[string]any) {
+	for k, v := range over {
+		bk := foldKey(base, k)
+		bv, ok := base[bk]
+		switch {
+		case v == nil:
+			delete(base, bk)
+			continue
+		case !ok:
+		case slices.ContainsFunc(configTargetSections, func(s string) bool { return strings.EqualFold(s, k) }):
+			bl, bok := bv.([]any)
+			ol, ook := v.([]any)
+			if bok && ook {
+				v = append(slices.Clone(ol), bl...)
+			}
+		case namedSection(k) != "":
+			bl, bok := bv.([]any)
+			ol, ook := v.([]any)
+			if bok && ook {
+				v = mergeNamedEntries(bl, ol, namedSection(k))
+			}
+		default:
+			v = mergeJSON(bv, v)
+		}
+		delete(base, bk)
+		base[k] = v
+	}
+}
+
+// namedSection returns the field naming the entries of the section k, or ""
+// if k is not one of configNamedSections.
+func namedSection(k string) string {
+	for s, name := range configNamedSections {
+		if strings.EqualFold(s, k) {
+			return name
+		}
+	}
+	return ""
+}
+
+// mergeNamedEntries returns the entries of base with those of over named by
+// the field name replacing those of the same name, and the others appended.
+func mergeNamedEntries(base, over []any, name string) []any {
+	ret := slices.Clone(base)
+	for _, o := range over {
+		n, ok := entryName(o, name)
+		i := -1
+		if ok {
+			i = slices.IndexFunc(ret, func(b any) bool {
+				bn, ok := entryName(b, name)
+				return ok && bn == n
+			})
+		}
+		if i >= 0 {
+			ret[i] = o
+		} else {
+			ret = append(ret, o)
+		}
+	}
+	return ret
+}
+
+func entryName(v any, name string) (string, bool) {
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return "", false
+	}
+	n, ok := obj[foldKey(obj, name)].(string)
+	return n, ok
+}
+
+// mergeJSON returns the JSON value over merged over base: objects are merged
+// field by field, with null values removing fields, and other values
+// replaced.
+func mergeJSON(base, over any) any {
+	bo, bok := base.(map[string]any)
+	oo, ook := over.(map[string]any)
+	if !bok || !ook {
+		return over
+	}
+	for k, v := range oo {
+		bk := foldKey(bo, k)
+		bv, ok := bo[bk]
+		delete(bo, bk)
+		switch {
+		case v == nil:
+			continue
+		case ok:
+			v = mergeJSON(bv, v)
+		}
+		bo[k] = v
+	}
+	return bo
+}
+
+// foldKey returns the key of obj equal to k under Unicode case-folding, as
+// encoding/json matches fields, or k if there is none.
+func foldKey(obj map[string]any, k string) string {
+	if _, ok := obj[k]; ok {
+		return k
+	}
+	for ok := range obj {
+		if strings.EqualFold(ok, k) {
+			return ok
+		}
+	}
+	return k
+}
+
+// targetConfig is the config applying to a target, as printed by config
+// effective --hostname.
+type targetConfig struct {
+	Hostname   string
+	RegionID   int    `json:",omitempty"`
+	RegionCode string `json:",omitempty"`
+	// Groups are the names of the groups the target is in.
+	Groups []string `json:",omitempty"`
+	// Ports are the destination ports by protocol replacing those given by
+	// flags, if any.
+	Ports map[protocol][]int `json:",omitempty"`
+	// Intervals are the probe intervals by protocol replacing --interval,
+	// if any.
+	Intervals map[protocol]string `json:",omitempty"`
+	// HTTPSRequest is the request of the https protocol, if customized.
+	HTTPSRequest *httpsRequestConfig `json:",omitempty"`
+}
+
+// forTarget returns the settings of c applying to meta.
+func (c *config) forTarget(meta nodeMeta) targetConfig {
+	tc := targetConfig{
+		Hostname:     meta.hostname,
+		RegionID:     meta.regionID,
+		RegionCode:   meta.regionCode,
+		Ports:        c.portsFor(meta, nil),
+		HTTPSRequest: httpsRequestFor(c.HTTPSRequests, meta),
+	}
+	for _, g := range c.Groups {
+		if g.matches(meta) {
+			tc.Groups = append(tc.Groups, g.Name)
+		}
+	}
+	for _, p := range allProtocols {
+		for _, ic := range c.Intervals {
+			if s, ok := ic.Intervals[p]; ok && ic.matches(meta) {
+				if tc.Intervals == nil {
+					tc.Intervals = make(map[protocol]string)
+				}
+				tc.Intervals[p] = s
+				break
+			}
+		}
+	}
+	return tc
+}
+
+// runConfig implements the config subcommand. Its effective subcommand
+// prints the config merged from the layers of --config as JSON, or with
+// --hostname the settings applying to a target, to check the outcome of
+// overriding settings across layers. args are the subcommand's arguments,
+// output is written to w.
+func runConfig(args []string, w io.Writer) error {
+	if len(args) < 1 || args[0] != "effective" {
+		return errors.New("usage: stunstamp config effective [flags]")
+	}
+	fs := flag.NewFlagSet("config effective", flag.ContinueOnError)
+	configPath := fs.String("config", *flagConfig, "path to the HuJSON config file, or comma-separated paths of its layers, lowest precedence first")
+	hostname := fs.String("hostname", "", "if set, print the settings applying to the target with this hostname")
+	regionID := fs.Int("region-id", 0, "region ID of the target of --hostname, for settings selecting regions")
+	regionCode := fs.String("region-code", "", "region code of the target of --hostname, for settings selecting regions")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if len(*configPath) < 1 {
+		return errors.New("config effective requires the config flag")
+	}
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	var v any = cfg
+	if *hostname != "" {
+		v = cfg.forTarget(nodeMeta{regionID: *regionID, regionCode: *regionCode, hostname: *hostname})
+	} else if *regionID != 0 || *regionCode != "" {
+		return errors.New("--region-id and --region-code require --hostname")
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
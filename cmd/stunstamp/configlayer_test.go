@@ -0,0 +1,144 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfigLayers(t *testing.T, layers ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	var paths []string
+	for i, l := range layers {
+		p := filepath.Join(dir, string(rune('a'+i))+".hujson")
+		if err := os.WriteFile(p, []byte(l), 0600); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	return strings.Join(paths, ",")
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	defaults := `{
+		// Shared by every prober.
+		"Groups": [
+			{"Name": "eu", "RegionCodes": ["fra", "ams"]},
+			{"Name": "us", "RegionCodes": ["nyc"]},
+		],
+		"Retry": {"icmp": {"Attempts": 3, "MinSuccesses": 2, "Aggregate": "min"}},
+		"TargetPorts": [{"RegionCodes": ["fra", "ams"], "Ports": {"stun": [3478, 443]}}],
+		"Intervals": [{"Intervals": {"stun": "5s"}}],
+	}`
+	site := `{
+		"groups": [{"Name": "eu", "RegionCodes": ["ams"]}, {"Name": "lab", "Hostnames": ["lab1"]}],
+		"Retry": {"icmp": {"Attempts": 2}},
+		"Intervals": [{"RegionCodes": ["fra"], "Intervals": {"stun": "1s"}}],
+	}`
+	targets := `{
+		"TargetPorts": [{"Hostnames": ["derp4a"], "Ports": {"tcp": [443]}}],
+		"Retry": null,
+	}`
+	c, err := loadConfig(writeConfigLayers(t, defaults, site, targets))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var groups []string
+	for _, g := range c.Groups {
+		groups = append(groups, g.Name+":"+strings.Join(g.RegionCodes, "/")+strings.Join(g.Hostnames, "/"))
+	}
+	if want := []string{"eu:ams", "us:nyc", "lab:lab1"}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("Groups = %v, want %v", groups, want)
+	}
+	if c.Retry != nil {
+		t.Errorf("Retry = %v, want removed", c.Retry)
+	}
+
+	fra := nodeMeta{regionID: 4, regionCode: "fra", hostname: "derp4a"}
+	ams := nodeMeta{regionID: 5, regionCode: "ams", hostname: "derp5a"}
+	if got, want := c.forTarget(fra), (targetConfig{
+		Hostname:   "derp4a",
+		RegionID:   4,
+		RegionCode: "fra",
+		Ports:      map[protocol][]int{protocolTCP: {443}},
+		Intervals:  map[protocol]string{protocolSTUN: "1s"},
+	}); !reflect.DeepEqual(got, want) {
+		t.Errorf("forTarget(fra) = %+v, want %+v", got, want)
+	}
+	if got, want := c.forTarget(ams), (targetConfig{
+		Hostname:   "derp5a",
+		RegionID:   5,
+		RegionCode: "ams",
+		Groups:     []string{"eu"},
+		Ports:      map[protocol][]int{protocolSTUN: {3478, 443}},
+		Intervals:  map[protocol]string{protocolSTUN: "5s"},
+	}); !reflect.DeepEqual(got, want) {
+		t.Errorf("forTarget(ams) = %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadConfigLayersMergesObjects(t *testing.T) {
+	c, err := loadConfig(writeConfigLayers(t,
+		`{"Retry": {"icmp": {"Attempts": 3, "MinSuccesses": 2, "Aggregate": "min"}}}`,
+		`{"Retry": {"icmp": {"attempts": 2}, "stun": {"Attempts": 2}}}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Retry[protocolICMP]; got.Attempts != 2 || got.MinSuccesses != 2 || got.Aggregate != "min" {
+		t.Errorf("Retry[icmp] = %+v, want Attempts 2 merged over the rest", got)
+	}
+	if got := c.Retry[protocolSTUN]; got.Attempts != 2 {
+		t.Errorf("Retry[stun] = %+v, want Attempts 2", got)
+	}
+}
+
+func TestLoadConfigLayersErrors(t *testing.T) {
+	// Layers need not be valid on their own, only merged.
+	if _, err := loadConfig(writeConfigLayers(t,
+		`{"TargetPorts": [{"Ports": {"stun": [3478]}}]}`,
+		`{"TargetPorts": null}`,
+	)); err != nil {
+		t.Errorf("loadConfig() with invalid section removed = %v", err)
+	}
+	if _, err := loadConfig(writeConfigLayers(t, `{}`, `{"Retry": {"icmp": {"Attempts": -1}}}`)); err == nil {
+		t.Errorf("loadConfig() with invalid merged config succeeded")
+	}
+	path := writeConfigLayers(t, `{}`, `{"Typo": 1}`)
+	_, err := loadConfig(path)
+	if second := strings.Split(path, ",")[1]; err == nil || !strings.Contains(err.Error(), second) {
+		t.Errorf("loadConfig() with unknown field = %v, want error naming %s", err, second)
+	}
+}
+
+func TestRunConfigEffective(t *testing.T) {
+	path := writeConfigLayers(t,
+		`{"HTTPSRequests": [{"RegionCodes": ["fra"], "Path": "/a"}]}`,
+		`{"HTTPSRequests": [{"Hostnames": ["derp4b"], "Path": "/b"}]}`,
+	)
+	var buf bytes.Buffer
+	if err := runConfig([]string{"effective", "--config=" + path}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); strings.Index(got, `"/b"`) > strings.Index(got, `"/a"`) || !strings.Contains(got, `"/a"`) {
+		t.Errorf("config effective = %s, want /b before /a", got)
+	}
+	buf.Reset()
+	if err := runConfig([]string{"effective", "--config=" + path, "--hostname=derp4a", "--region-code=fra"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); !strings.Contains(got, `"Path": "/a"`) || strings.Contains(got, `"/b"`) {
+		t.Errorf("config effective --hostname = %s, want the /a request only", got)
+	}
+	if err := runConfig([]string{"effective", "--config=" + path, "--region-id=4"}, &buf); err == nil {
+		t.Errorf("config effective --region-id without --hostname succeeded")
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// consistencyProtocols are the protocols whose RTTs are compared for
+// consistency. Each measures a single round trip; HTTPS and DERP include
+// handshakes, and are excluded.
+var consistencyProtocols = []protocol{protocolICMP, protocolSTUN, protocolTCP, protocolTWAMP}
+
+const (
+	// consistencyWindows is the number of recent windows a target is
+	// classified over.
+	consistencyWindows = 10
+	// consistencyMinWindows is the number of windows in which a protocol
+	// must be compared before it can be classified.
+	consistencyMinWindows = 6
+	// consistencyPersistence is the fraction of compared windows in which a
+	// protocol must be slow for it to be persistently so, rather than by
+	// chance, e.g. due to a single queue.
+	consistencyPersistence = 0.8
+	// A protocol is slow in a window if its RTT exceeds that of the fastest
+	// protocol by both consistencySlowRatio and consistencySlowDelta, so
+	// that neither small absolute differences on short paths nor small
+	// relative differences on long paths count.
+	consistencySlowRatio = 1.5
+	consistencySlowDelta = 10 * time.Millisecond
+)
+
+// consistencyClass is the classification of a target by the consistency of
+// the RTTs of its protocols.
+type consistencyClass string
+
+const (
+	consistencyConsistent       consistencyClass = "consistent"
+	consistencyProtocolShaping  consistencyClass = "protocol_shaping"
+	consistencyInsufficientData consistencyClass = "insufficient_data"
+)
+
+// eventKindProtocolShaping is a change in whether a target's protocols
+// disagree persistently, e.g. due to a CGNAT shaping UDP but not ICMP.
+const eventKindProtocolShaping eventKind = "protocol_shaping"
+
+// protocolRTTs are the RTTs of the protocols of a target in a window.
+type protocolRTTs map[protocol]time.Duration
+
+// protocolRTTsByTarget returns the lowest RTT of every consistencyProtocols
+// protocol of every target in results. Only direct results are considered.
+// The lowest RTT of a protocol over timestamp sources, conns, and ports is
+// the closest to its path RTT.
+func protocolRTTsByTarget(results []result) map[nodeMeta]protocolRTTs {
+	ret := make(map[nodeMeta]protocolRTTs)
+	for _, r := range results {
+		if r.rtt == nil || r.key.proxy != "" || r.key.xlat != "" || !slices.Contains(consistencyProtocols, r.key.protocol) {
+			continue
+		}
+		rtts, ok := ret[r.key.meta]
+		if !ok {
+			rtts = make(protocolRTTs)
+			ret[r.key.meta] = rtts
+		}
+		if prev, ok := rtts[r.key.protocol]; !ok || *r.rtt < prev {
+			rtts[r.key.protocol] = *r.rtt
+		}
+	}
+	return ret
+}
+
+// consistencyStatus is the classification of a target over recent windows,
+// as served by the API and included in reports.
+type consistencyStatus struct {
+	Hostname       string
+	Addr           string
+	Classification consistencyClass
+	// Medians are the median RTTs of every protocol over the windows.
+	Medians map[protocol]time.Duration
+	// Slow are the protocols persistently slower than the fastest.
+	Slow []protocol `json:",omitempty"`
+	// Windows is the number of windows in which protocols were compared.
+	Windows int
+}
+
+// slowText describes the slow protocols of s relative to the fastest.
+func (s consistencyStatus) slowText() string {
+	var fastest protocol
+	for p, m := range s.Medians {
+		if fastest == "" || m < s.Medians[fastest] || m == s.Medians[fastest] && p < fastest {
+			fastest = p
+		}
+	}
+	var parts []string
+	for _, p := range s.Slow {
+		parts = append(parts, fmt.Sprintf("%s %v", p, s.Medians[p].Round(time.Millisecond)))
+	}
+	return fmt.Sprintf("%s vs. %s %v", strings.Join(parts, ", "), fastest, s.Medians[fastest].Round(time.Millisecond))
+}
+
+// classifyConsistency classifies meta from the RTTs of its protocols in
+// windows.
+func classifyConsistency(meta nodeMeta, windows []protocolRTTs) consistencyStatus {
+	st := consistencyStatus{
+		Hostname:       meta.hostname,
+		Addr:           meta.addr.String(),
+		Classification: consistencyInsufficientData,
+		Medians:        make(map[protocol]time.Duration),
+	}
+	compared := make(map[protocol]int)
+	slow := make(map[protocol]int)
+	all := make(map[protocol][]time.Duration)
+	for _, w := range windows {
+		for p, rtt := range w {
+			all[p] = append(all[p], rtt)
+		}
+		if len(w) < 2 {
+			continue
+		}
+		st.Windows++
+		fastest := slices.Min(slices.Collect(maps.Values(w)))
+		for p, rtt := range w {
+			compared[p]++
+			if rtt-fastest >= consistencySlowDelta && float64(rtt) >= float64(fastest)*consistencySlowRatio {
+				slow[p]++
+			}
+		}
+	}
+	for p, rtts := range all {
+		st.Medians[p] = medianOf(rtts)
+	}
+	for p, n := range compared {
+		if n >= consistencyMinWindows && float64(slow[p]) >= consistencyPersistence*float64(n) {
+			st.Slow = append(st.Slow, p)
+		}
+	}
+	slices.Sort(st.Slow)
+	switch {
+	case len(st.Slow) > 0:
+		st.Classification = consistencyProtocolShaping
+	case st.Windows >= consistencyMinWindows:
+		st.Classification = consistencyConsistent
+	}
+	return st
+}
+
+// consistencyTracker classifies every target by the consistency of the RTTs
+// of its protocols over recent windows. It is safe for concurrent use.
+type consistencyTracker struct {
+	mu      sync.Mutex
+	windows map[nodeMeta][]protocolRTTs // up to consistencyWindows, oldest first
+	shaping map[nodeMeta]bool
+}
+
+func newConsistencyTracker() *consistencyTracker {
+	return &consistencyTracker{
+		windows: make(map[nodeMeta][]protocolRTTs),
+		shaping: make(map[nodeMeta]bool),
+	}
+}
+
+// observe accounts the results of a window, recording an event for every
+// target that starts or stops being classified as protocol shaping.
+func (t *consistencyTracker) observe(results []result, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for meta, rtts := range protocolRTTsByTarget(results) {
+		w := append(t.windows[meta], rtts)
+		if len(w) > consistencyWindows {
+			w = slices.Delete(w, 0, len(w)-consistencyWindows)
+		}
+		t.windows[meta] = w
+		st := classifyConsistency(meta, w)
+		shaping := st.Classification == consistencyProtocolShaping
+		if shaping == t.shaping[meta] {
+			continue
+		}
+		t.shaping[meta] = shaping
+		ev := event{
+			At:         at,
+			Kind:       eventKindProtocolShaping,
+			Addr:       meta.addr,
+			RegionID:   meta.regionID,
+			RegionCode: meta.regionCode,
+			Hostname:   meta.hostname,
+			Attrs:      map[string]string{"state": "ended"},
+		}
+		if shaping {
+			ev.Attrs = map[string]string{"state": "started", "slow": st.slowText()}
+			annotations.annotateAuto(at, at, meta.hostname, "protocols disagree persistently: "+st.slowText())
+		}
+		events.record(ev)
+	}
+}
+
+// forget drops the windows and shaping verdicts of targets for which keep
+// returns false.
+func (t *consistencyTracker) forget(keep func(resultKey) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for meta := range t.windows {
+		if !keep(resultKey{meta: meta}) {
+			delete(t.windows, meta)
+			delete(t.shaping, meta)
+		}
+	}
+}
+
+// statuses returns the classification of every target, targets with protocol
+// shaping first.
+func (t *consistencyTracker) statuses() []consistencyStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ret := make([]consistencyStatus, 0, len(t.windows))
+	for meta, w := range t.windows {
+		ret = append(ret, classifyConsistency(meta, w))
+	}
+	sortConsistencyStatuses(ret)
+	return ret
+}
+
+func sortConsistencyStatuses(s []consistencyStatus) {
+	slices.SortFunc(s, func(a, b consistencyStatus) int {
+		return cmp.Or(
+			-compareBool(a.Classification == consistencyProtocolShaping, b.Classification == consistencyProtocolShaping),
+			cmp.Compare(a.Hostname, b.Hostname),
+			cmp.Compare(a.Addr, b.Addr),
+		)
+	})
+}
@@ -0,0 +1,101 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestClassifyConsistency(t *testing.T) {
+	meta := nodeMeta{hostname: "derp1a", addr: netip.MustParseAddr("192.0.2.1")}
+	repeat := func(n int, w protocolRTTs) []protocolRTTs {
+		var ret []protocolRTTs
+		for range n {
+			ret = append(ret, w)
+		}
+		return ret
+	}
+	ms := time.Millisecond
+	tests := []struct {
+		name    string
+		windows []protocolRTTs
+		want    consistencyClass
+		slow    []protocol
+	}{
+		{"single protocol", repeat(10, protocolRTTs{protocolICMP: 20 * ms}), consistencyInsufficientData, nil},
+		{"too few windows", repeat(5, protocolRTTs{protocolICMP: 20 * ms, protocolSTUN: 80 * ms}), consistencyInsufficientData, nil},
+		{"consistent", repeat(10, protocolRTTs{protocolICMP: 20 * ms, protocolSTUN: 22 * ms}), consistencyConsistent, nil},
+		// 3ms vs. 6ms is twice as slow, but by too little to matter.
+		{"small delta", repeat(10, protocolRTTs{protocolICMP: 3 * ms, protocolSTUN: 6 * ms}), consistencyConsistent, nil},
+		// 200ms vs. 215ms differs by more than 10ms, but not relatively.
+		{"small ratio", repeat(10, protocolRTTs{protocolICMP: 200 * ms, protocolSTUN: 215 * ms}), consistencyConsistent, nil},
+		{"shaped", repeat(10, protocolRTTs{protocolICMP: 20 * ms, protocolSTUN: 80 * ms, protocolTCP: 21 * ms}), consistencyProtocolShaping, []protocol{protocolSTUN}},
+		{"transient", append(
+			repeat(7, protocolRTTs{protocolICMP: 20 * ms, protocolSTUN: 21 * ms}),
+			repeat(3, protocolRTTs{protocolICMP: 20 * ms, protocolSTUN: 80 * ms})...,
+		), consistencyConsistent, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := classifyConsistency(meta, tt.windows)
+			if st.Classification != tt.want || !slices.Equal(st.Slow, tt.slow) {
+				t.Errorf("got %s %v, want %s %v", st.Classification, st.Slow, tt.want, tt.slow)
+			}
+		})
+	}
+}
+
+func TestConsistencyTracker(t *testing.T) {
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	countEvents := func() int {
+		n := 0
+		for _, ev := range events.recentEvents() {
+			if ev.Kind == eventKindProtocolShaping && ev.Addr == meta.addr {
+				n++
+			}
+		}
+		return n
+	}
+	before := countEvents()
+	window := func(icmp, stun time.Duration) []result {
+		userspace := stun + 10*time.Millisecond
+		return []result{
+			{key: resultKey{meta: meta, protocol: protocolICMP}, rtt: &icmp},
+			{key: resultKey{meta: meta, protocol: protocolSTUN, timestampSource: timestampSourceKernel}, rtt: &stun},
+			// The lowest RTT of a protocol counts.
+			{key: resultKey{meta: meta, protocol: protocolSTUN}, rtt: &userspace},
+			// Proxied results are excluded.
+			{key: resultKey{meta: meta, protocol: protocolICMP, proxy: "socks5"}, rtt: &stun},
+		}
+	}
+	ct := newConsistencyTracker()
+	at := time.Now()
+	for range consistencyWindows {
+		ct.observe(window(20*time.Millisecond, 80*time.Millisecond), at)
+	}
+	st := ct.statuses()
+	if len(st) != 1 || st[0].Classification != consistencyProtocolShaping {
+		t.Fatalf("got %+v, want protocol shaping", st)
+	}
+	if got := st[0].Medians[protocolSTUN]; got != 80*time.Millisecond {
+		t.Errorf("got STUN median %v, want 80ms", got)
+	}
+	for range consistencyWindows {
+		ct.observe(window(20*time.Millisecond, 20*time.Millisecond), at)
+	}
+	if st := ct.statuses(); st[0].Classification != consistencyConsistent {
+		t.Errorf("got %s after shaping stopped, want consistent", st[0].Classification)
+	}
+	if got := countEvents() - before; got != 2 {
+		t.Errorf("got %d events, want 2", got)
+	}
+
+	ct.forget(func(resultKey) bool { return false })
+	if st := ct.statuses(); len(st) != 0 {
+		t.Errorf("got %d statuses after forget", len(st))
+	}
+}
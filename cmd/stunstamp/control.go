@@ -0,0 +1,283 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"golang.org/x/net/http2"
+	"tailscale.com/control/controlhttp"
+	"tailscale.com/internal/noiseconn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime"
+	"tailscale.com/types/key"
+)
+
+// controlPhase is a step of a Tailscale client's interaction with the control
+// plane (coordination server) that we measure independently.
+type controlPhase string
+
+const (
+	// controlPhaseKey is the fetch of the control server's public keys over
+	// HTTPS on a fresh connection.
+	controlPhaseKey controlPhase = "key"
+	// controlPhaseNoise is TCP connect + HTTP upgrade + Noise handshake, as
+	// performed by controlhttp.Dialer.
+	controlPhaseNoise controlPhase = "noise"
+	// controlPhaseMap is the time from sending a streaming map request over
+	// an established Noise connection until response headers arrive. Our
+	// ephemeral machine/node keys are unknown to control, so the request is
+	// rejected, but the rejection takes the same path through the
+	// coordination server's frontends as long-poll establishment.
+	controlPhaseMap controlPhase = "map"
+)
+
+var controlPhases = []controlPhase{controlPhaseKey, controlPhaseNoise, controlPhaseMap}
+
+const (
+	controlRTTMetricName      = "stunstamp_control_rtt_ns"
+	controlTimeoutsMetricName = "stunstamp_control_timeouts_total"
+
+	// controlProbeTimeout bounds all phases of a single control probe.
+	controlProbeTimeout = time.Second * 15
+)
+
+// controlResult is the measurement of a single controlPhase. A nil rtt
+// signifies failure, e.g. timeout.
+type controlResult struct {
+	phase controlPhase
+	at    time.Time
+	rtt   *time.Duration
+}
+
+// controlProber measures control plane latency for a single control URL. It
+// holds ephemeral machine and node keys for the lifetime of the process.
+type controlProber struct {
+	serverURL *url.URL
+	machine   key.MachinePrivate
+	node      key.NodePrivate
+	disco     key.DiscoPrivate
+	h2t       *http2.Transport
+	timeouts  map[controlPhase]uint64
+}
+
+func newControlProber(serverURL string) (*controlProber, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported control URL scheme: %q", u.Scheme)
+	}
+	// Mirror control/controlclient.NewNoiseClient, which creates the HTTP/2
+	// Transport via a net/http.Transport in order to configure it.
+	h2t, err := http2.ConfigureTransports(&http.Transport{
+		IdleConnTimeout: time.Minute,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &controlProber{
+		serverURL: u,
+		machine:   key.NewMachine(),
+		node:      key.NewNode(),
+		disco:     key.NewDisco(),
+		h2t:       h2t,
+		timeouts:  make(map[controlPhase]uint64),
+	}, nil
+}
+
+// probe measures every controlPhase in order. A failure in one phase results
+// in failure of the phases that depend on it.
+func (c *controlProber) probe(ctx context.Context) []controlResult {
+	ctx, cancel := context.WithTimeout(ctx, controlProbeTimeout)
+	defer cancel()
+	at := time.Now()
+	results := make([]controlResult, 0, len(controlPhases))
+	record := func(phase controlPhase, start time.Time, err error) bool {
+		r := controlResult{phase: phase, at: at}
+		if err != nil {
+			probeLog.Warn("error measuring control phase", "phase", phase, "control_host", c.serverURL.Host, "err", err)
+		} else {
+			rtt := time.Since(start)
+			r.rtt = &rtt
+		}
+		results = append(results, r)
+		return err == nil
+	}
+	fail := func(phases ...controlPhase) []controlResult {
+		for _, p := range phases {
+			results = append(results, controlResult{phase: p, at: at})
+		}
+		return results
+	}
+
+	start := time.Now()
+	keys, err := c.fetchKeys(ctx)
+	if !record(controlPhaseKey, start, err) {
+		return fail(controlPhaseNoise, controlPhaseMap)
+	}
+
+	start = time.Now()
+	cc, err := (&controlhttp.Dialer{
+		Hostname:        c.serverURL.Hostname(),
+		HTTPPort:        cmp.Or(c.portFor("http"), "80"),
+		HTTPSPort:       cmp.Or(c.portFor("https"), "443"),
+		MachineKey:      c.machine,
+		ControlKey:      keys.PublicKey,
+		ProtocolVersion: uint16(tailcfg.CurrentCapabilityVersion),
+		Clock:           tstime.StdClock{},
+	}).Dial(ctx)
+	if !record(controlPhaseNoise, start, err) {
+		return fail(controlPhaseMap)
+	}
+	nc, err := noiseconn.New(cc.Conn, c.h2t, 0, nil)
+	if err != nil {
+		cc.Close()
+		return fail(controlPhaseMap)
+	}
+	defer nc.Close()
+
+	start = time.Now()
+	err = c.mapRequest(ctx, nc)
+	record(controlPhaseMap, start, err)
+	return results
+}
+
+// portFor returns the explicit port in the control URL if its scheme matches
+// scheme, otherwise the empty string.
+func (c *controlProber) portFor(scheme string) string {
+	if c.serverURL.Scheme != scheme {
+		return ""
+	}
+	return c.serverURL.Port()
+}
+
+func (c *controlProber) fetchKeys(ctx context.Context) (*tailcfg.OverTLSPublicKeyResponse, error) {
+	keyURL := fmt.Sprintf("%s://%s/key?v=%d", c.serverURL.Scheme, c.serverURL.Host, tailcfg.CurrentCapabilityVersion)
+	req, err := http.NewRequestWithContext(ctx, "GET", keyURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Use a fresh transport every time so that we measure connection setup
+	// just like a client fetching keys on startup.
+	tr := &http.Transport{
+		DisableKeepAlives: true,
+	}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return nil, tempError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, tempError{fmt.Errorf("unexpected status code: %d", resp.StatusCode)}
+	}
+	var out tailcfg.OverTLSPublicKeyResponse
+	err = json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&out)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding control key response: %w", err)
+	}
+	if out.PublicKey.IsZero() {
+		return nil, errors.New("control key response has no Noise public key")
+	}
+	return &out, nil
+}
+
+func (c *controlProber) mapRequest(ctx context.Context, nc *noiseconn.Conn) error {
+	body, err := json.Marshal(&tailcfg.MapRequest{
+		Version:   tailcfg.CurrentCapabilityVersion,
+		NodeKey:   c.node.Public(),
+		DiscoKey:  c.disco.Public(),
+		Stream:    true,
+		KeepAlive: true,
+		Compress:  "zstd",
+		Hostinfo:  &tailcfg.Hostinfo{App: "stunstamp"},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://"+c.serverURL.Hostname()+"/machine/map", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := nc.RoundTrip(req)
+	if err != nil {
+		return tempError{err}
+	}
+	// Any response from control is a successful measurement, as we expect
+	// our unregistered node key to be rejected.
+	resp.Body.Close()
+	return nil
+}
+
+func controlTimeSeriesLabels(metricName, host string, phase controlPhase, instance string) []prompb.Label {
+	labels := []prompb.Label{
+		{Name: "__name__", Value: metricName},
+		{Name: "job", Value: "stunstamp-rw"},
+		{Name: "instance", Value: instance},
+		{Name: "control_host", Value: host},
+		{Name: "phase", Value: string(phase)},
+	}
+	slices.SortFunc(labels, func(a, b prompb.Label) int {
+		// prometheus remote-write spec requires lexicographically sorted label names
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return labels
+}
+
+// toPromTimeSeries returns prometheus TimeSeries for results, updating the
+// timeout counts held by c.
+func (c *controlProber) toPromTimeSeries(results []controlResult, instance string) []prompb.TimeSeries {
+	all := make([]prompb.TimeSeries, 0, len(results)*2)
+	for _, r := range results {
+		value := math.NaN()
+		if r.rtt != nil {
+			value = float64(*r.rtt)
+		} else {
+			c.timeouts[r.phase]++
+		}
+		all = append(all, prompb.TimeSeries{
+			Labels:  controlTimeSeriesLabels(controlRTTMetricName, c.serverURL.Host, r.phase, instance),
+			Samples: []prompb.Sample{{Timestamp: r.at.UnixMilli(), Value: value}},
+		})
+		all = append(all, prompb.TimeSeries{
+			Labels:  controlTimeSeriesLabels(controlTimeoutsMetricName, c.serverURL.Host, r.phase, instance),
+			Samples: []prompb.Sample{{Timestamp: r.at.UnixMilli(), Value: float64(c.timeouts[r.phase])}},
+		})
+	}
+	return all
+}
+
+func (c *controlProber) staleMarkers(instance string) []prompb.TimeSeries {
+	samples := []prompb.Sample{
+		{
+			Timestamp: time.Now().UnixMilli(),
+			Value:     math.Float64frombits(staleNaN),
+		},
+	}
+	all := make([]prompb.TimeSeries, 0, len(controlPhases)*2)
+	for _, phase := range controlPhases {
+		for _, name := range []string{controlRTTMetricName, controlTimeoutsMetricName} {
+			all = append(all, prompb.TimeSeries{
+				Labels:  controlTimeSeriesLabels(name, c.serverURL.Host, phase, instance),
+				Samples: samples,
+			})
+		}
+	}
+	return all
+}
@@ -0,0 +1,39 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"tailscale.com/tstest/integration/testcontrol"
+)
+
+func TestControlProber(t *testing.T) {
+	ctl := &testcontrol.Server{}
+	hs := httptest.NewServer(ctl)
+	defer hs.Close()
+
+	cp, err := newControlProber(hs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := cp.probe(context.Background())
+	if len(results) != len(controlPhases) {
+		t.Fatalf("got %d results, want %d", len(results), len(controlPhases))
+	}
+	for i, r := range results {
+		if r.phase != controlPhases[i] {
+			t.Errorf("result %d phase = %s, want %s", i, r.phase, controlPhases[i])
+		}
+		if r.rtt == nil {
+			t.Errorf("%s phase failed", r.phase)
+		}
+	}
+	ts := cp.toPromTimeSeries(results, "test")
+	if len(ts) != len(controlPhases)*2 {
+		t.Errorf("got %d timeseries, want %d", len(ts), len(controlPhases)*2)
+	}
+}
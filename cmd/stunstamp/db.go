@@ -0,0 +1,432 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// runDB implements the db subcommand, maintaining stores offline: importing
+// the history of other tools, merging the results of stores of multiple
+// probes, pruning results past retention, and verifying and repairing
+// results files after power loss. args are the subcommand's arguments,
+// output is written to w.
+//
+// Commands that modify a store lock it, and so fail while a probe is writing
+// to it. They apply to the jsonl layout only; ring stores are constant in
+// size and rewritten in place.
+func runDB(args []string, w io.Writer) error {
+	if len(args) < 1 {
+		return errors.New("usage: stunstamp db import|merge|prune|verify [flags]")
+	}
+	switch args[0] {
+	case "import":
+		return runDBImport(args[1:], w)
+	case "merge":
+		return runDBMerge(args[1:], w)
+	case "prune":
+		return runDBPrune(args[1:], w)
+	case "verify":
+		return runDBVerify(args[1:], w)
+	}
+	return fmt.Errorf("unknown db command %q, want import, merge, prune, or verify", args[0])
+}
+
+// openStoreForMaintenance opens the jsonl store rooted at dir for writing.
+func openStoreForMaintenance(dir string) (*resultsStore, error) {
+	layout, _, err := readStoreLayout(dir)
+	if err != nil {
+		return nil, err
+	}
+	if layout != storeLayoutJSONL {
+		return nil, fmt.Errorf("store directory %s holds the %s layout, db maintenance requires jsonl", dir, layout)
+	}
+	return openResultsStoreLayout(dir, storeLayoutJSONL)
+}
+
+// runDBMerge merges the results of the stores in args into the store in
+// --store-dir, skipping results it already holds, so that merging is
+// idempotent.
+func runDBMerge(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("db merge", flag.ContinueOnError)
+	storeDir := fs.String("store-dir", "", "directory of the store to merge into, created if needed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(*storeDir) < 1 || fs.NArg() < 1 {
+		return errors.New("usage: stunstamp db merge --store-dir=DST SRC...")
+	}
+	dst, err := openStoreForMaintenance(*storeDir)
+	if err != nil {
+		return err
+	}
+	defer dst.close()
+	for _, srcDir := range fs.Args() {
+		src, err := openResultsStoreReadOnly(srcDir)
+		if err != nil {
+			return err
+		}
+		if src.ring != nil || src.shards != nil {
+			return fmt.Errorf("store directory %s holds the %s layout, db maintenance requires jsonl", srcDir, src.layout())
+		}
+		days, err := src.days()
+		if err != nil {
+			return err
+		}
+		var added int
+		for _, day := range days {
+			var incoming []storedResult
+			if err := src.readDay(day, func(sr storedResult) error {
+				incoming = append(incoming, sr)
+				return nil
+			}); err != nil {
+				return fmt.Errorf("error reading %s of %s: %w", day, srcDir, err)
+			}
+			n, err := dst.mergeDay(day, incoming)
+			if err != nil {
+				return fmt.Errorf("error merging %s of %s: %w", day, srcDir, err)
+			}
+			added += n
+		}
+		fmt.Fprintf(w, "merged %s: %d days, %d results added\n", srcDir, len(days), added)
+	}
+	return nil
+}
+
+// mergeKey identifies a stored result for deduplication: by its ID, or its
+// encoding if it predates IDs.
+func mergeKey(sr storedResult) (string, error) {
+	if sr.ID != "" {
+		return sr.ID, nil
+	}
+	b, err := json.Marshal(sr)
+	return string(b), err
+}
+
+// mergeDay adds the results of incoming that s does not hold to the results
+// file of day, which is rewritten in order of At, returning the number of
+// results added. A sealed day is unsealed first; it is sealed again by the
+// next archive run.
+func (s *resultsStore) mergeDay(day string, incoming []storedResult) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.unsealLocked(day); err != nil {
+		return 0, err
+	}
+	path := filepath.Join(s.dir, resultsFileName(day))
+	var merged []storedResult
+	seen := make(map[string]bool)
+	if err := readResultsFile(path, func(sr storedResult) error {
+		k, err := mergeKey(sr)
+		if err != nil {
+			return err
+		}
+		seen[k] = true
+		merged = append(merged, sr)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	added := 0
+	for _, sr := range incoming {
+		k, err := mergeKey(sr)
+		if err != nil {
+			return added, err
+		}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		merged = append(merged, sr)
+		added++
+	}
+	if added == 0 {
+		return 0, nil
+	}
+	slices.SortStableFunc(merged, func(a, b storedResult) int {
+		return a.At.Compare(b.At)
+	})
+	var buf []byte
+	for _, sr := range merged {
+		b, err := json.Marshal(sr)
+		if err != nil {
+			return 0, err
+		}
+		buf = append(buf, b...)
+		buf = append(buf, '\n')
+	}
+	if err := writeFileAtomic(path, buf); err != nil {
+		return 0, err
+	}
+	return added, s.rebuildDigestsLocked(day)
+}
+
+// unsealLocked restores the results file of day from its archive segment, if
+// it is sealed, removing the segment.
+func (s *resultsStore) unsealLocked(day string) error {
+	idx, err := s.loadArchiveIndex()
+	if err != nil {
+		return err
+	}
+	seg, ok := idx.segment(day)
+	if !ok {
+		return nil
+	}
+	var buf []byte
+	if err := s.readSegment(seg, func(sr storedResult) error {
+		b, err := json.Marshal(sr)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b...)
+		buf = append(buf, '\n')
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, resultsFileName(day)), buf); err != nil {
+		return err
+	}
+	if err := s.dropSegmentLocked(idx, day); err != nil {
+		return err
+	}
+	storeLog.Info("unsealed archive segment", "day", day, "results", seg.Results)
+	return nil
+}
+
+// dropSegmentLocked removes the segment of day from idx, persisting it, and
+// deletes the segment file.
+func (s *resultsStore) dropSegmentLocked(idx *archiveIndex, day string) error {
+	idx.Segments = slices.DeleteFunc(idx.Segments, func(seg archiveSegment) bool {
+		return seg.Day == day
+	})
+	b, err := json.MarshalIndent(idx, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, archiveIndexFileName), b); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.dir, archiveFileName(day))); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// runDBPrune removes the days of results, sealed or not, that ended more
+// than --older-than ago.
+func runDBPrune(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("db prune", flag.ContinueOnError)
+	storeDir := fs.String("store-dir", "", "directory of the store to prune")
+	olderThan := fs.Duration("older-than", 0, "remove days of results that ended more than this long ago")
+	dryRun := fs.Bool("dry-run", false, "list the days that would be removed without removing them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(*storeDir) < 1 || *olderThan <= 0 {
+		return errors.New("prune requires the store-dir and older-than flags")
+	}
+	s, err := openStoreForMaintenance(*storeDir)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	pruned, err := s.prune(time.Now().Add(-*olderThan), *dryRun)
+	for _, day := range pruned {
+		fmt.Fprintf(w, "pruned %s\n", day)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%d days pruned\n", len(pruned))
+	return nil
+}
+
+// prune removes every day of results ending at or before before, returning
+// the days removed, or that would be if dryRun.
+func (s *resultsStore) prune(before time.Time, dryRun bool) ([]string, error) {
+	days, err := s.days()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx, err := s.loadArchiveIndex()
+	if err != nil {
+		return nil, err
+	}
+	var pruned []string
+	for _, day := range days {
+		t, _ := time.Parse(storeDayLayout, day)
+		if t.AddDate(0, 0, 1).After(before) {
+			continue
+		}
+		if !dryRun {
+			for _, name := range []string{resultsFileName(day), digestsFileName(day)} {
+				if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return pruned, err
+				}
+			}
+			if _, ok := idx.segment(day); ok {
+				if err := s.dropSegmentLocked(idx, day); err != nil {
+					return pruned, err
+				}
+			}
+		}
+		pruned = append(pruned, day)
+	}
+	return pruned, nil
+}
+
+// runDBVerify checks the integrity of every results file and archive segment
+// of a store, and with --repair rewrites results files without their
+// damaged lines, salvaging results appended to torn lines. It fails if
+// problems remain.
+func runDBVerify(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("db verify", flag.ContinueOnError)
+	storeDir := fs.String("store-dir", "", "directory of the store to verify")
+	repair := fs.Bool("repair", false, "rewrite damaged results files, keeping every intact and salvageable result")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(*storeDir) < 1 {
+		return errors.New("verify requires the store-dir flag")
+	}
+	var s *resultsStore
+	var err error
+	if *repair {
+		s, err = openStoreForMaintenance(*storeDir)
+	} else {
+		s, err = openResultsStoreReadOnly(*storeDir)
+	}
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	if s.ring != nil || s.shards != nil {
+		return fmt.Errorf("store directory %s holds the %s layout, db maintenance requires jsonl", *storeDir, s.layout())
+	}
+
+	var problems int
+	days, err := s.resultsFileDays()
+	if err != nil {
+		return err
+	}
+	for _, day := range days {
+		path := filepath.Join(s.dir, resultsFileName(day))
+		v, err := verifyResultsFile(path)
+		if err != nil {
+			return err
+		}
+		if v.damaged == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s: %d of %d lines damaged, %d results salvageable\n", path, v.damaged, v.lines, v.salvaged)
+		if !*repair {
+			problems++
+			continue
+		}
+		s.mu.Lock()
+		err = writeFileAtomic(path, v.intact)
+		if err == nil {
+			err = s.rebuildDigestsLocked(day)
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s: repaired\n", path)
+	}
+	idx, err := s.loadArchiveIndex()
+	if err != nil {
+		return err
+	}
+	for _, seg := range idx.Segments {
+		if err := s.readSegment(seg, func(storedResult) error { return nil }); err != nil {
+			// Segments are immutable and checksummed; a damaged one is
+			// unrecoverable here, and must be restored from a backup.
+			fmt.Fprintf(w, "%s: %v\n", archiveFileName(seg.Day), err)
+			problems++
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d damaged files", problems)
+	}
+	fmt.Fprintf(w, "%d results files and %d archive segments verified\n", len(days), len(idx.Segments))
+	return nil
+}
+
+// resultsFileVerification is the outcome of verifying a results file.
+type resultsFileVerification struct {
+	lines    int
+	damaged  int // lines not parsing as a single result
+	salvaged int // results recovered from damaged lines
+	// intact holds every result that parsed or was salvaged, as lines.
+	intact []byte
+}
+
+// verifyResultsFile verifies the results file at path line by line. A write
+// torn by power loss leaves a partial line, possibly followed by NULs, which
+// the next write after restart is appended to; such results are salvaged
+// from the end of the damaged line.
+func verifyResultsFile(path string) (resultsFileVerification, error) {
+	var v resultsFileVerification
+	f, err := os.Open(path)
+	if err != nil {
+		return v, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			v.lines++
+			complete := line[len(line)-1] == '\n'
+			line = bytes.TrimSuffix(line, []byte("\n"))
+			if b, ok := salvageResultLine(line); ok && complete && len(b) == len(line) {
+				v.intact = append(v.intact, line...)
+				v.intact = append(v.intact, '\n')
+			} else {
+				v.damaged++
+				if ok {
+					v.salvaged++
+					v.intact = append(v.intact, b...)
+					v.intact = append(v.intact, '\n')
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return v, fmt.Errorf("error reading %s: %w", path, err)
+		}
+	}
+	return v, nil
+}
+
+// salvageResultLine returns the longest suffix of line that parses as a
+// stored result, starting at an object.
+func salvageResultLine(line []byte) ([]byte, bool) {
+	for i := 0; i < len(line); i++ {
+		if line[i] != '{' {
+			continue
+		}
+		var sr storedResult
+		if json.Unmarshal(line[i:], &sr) == nil && !sr.At.IsZero() {
+			return line[i:], true
+		}
+	}
+	return nil, false
+}
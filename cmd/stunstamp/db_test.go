@@ -0,0 +1,162 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestStore writes days of 10 results each from hostname, starting at
+// day0, to a new store, returning its directory.
+func writeTestStore(t *testing.T, hostname string, day0 time.Time, days int) string {
+	t.Helper()
+	dir := t.TempDir()
+	s, err := openResultsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: hostname, addr: netip.MustParseAddr("192.0.2.1")}
+	rtt := time.Millisecond
+	for d := range days {
+		var results []result
+		for i := range 10 {
+			results = append(results, result{
+				key: resultKey{meta: meta, protocol: protocolSTUN, dstPort: 3478},
+				at:  day0.AddDate(0, 0, d).Add(time.Duration(i) * time.Minute),
+				rtt: &rtt,
+			})
+		}
+		if err := s.append(results); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func countStoredResults(t *testing.T, dir string) int {
+	t.Helper()
+	s, err := openResultsStoreReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := s.readRange(time.Time{}, time.Now(), func(storedResult) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestDBMerge(t *testing.T) {
+	day0 := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	a := writeTestStore(t, "1a", day0, 2)
+	b := writeTestStore(t, "1b", day0.AddDate(0, 0, 1), 2)
+
+	// Seal a day of the destination, which merging unseals.
+	s, err := openResultsStore(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed, err := s.archive(day0.AddDate(1, 0, 0)); err != nil || sealed != 2 {
+		t.Fatalf("archive() = %d, %v; want 2 sealed", sealed, err)
+	}
+	s.close()
+
+	for range 2 {
+		if err := runDB([]string{"merge", "--store-dir=" + a, b}, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		// Merging again adds nothing.
+		if got := countStoredResults(t, a); got != 40 {
+			t.Errorf("merged store holds %d results, want 40", got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(a, archiveFileName("2024-07-02"))); !os.IsNotExist(err) {
+		t.Errorf("segment of merged day not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(a, archiveFileName("2024-07-01"))); err != nil {
+		t.Errorf("segment of unmerged day removed: %v", err)
+	}
+}
+
+func TestDBPrune(t *testing.T) {
+	day0 := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -3)
+	dir := writeTestStore(t, "1a", day0, 3)
+	s, err := openResultsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.archive(day0.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	// Days ending more than 24h ago are the first two, one of them sealed.
+	var out strings.Builder
+	if err := runDB([]string{"prune", "--store-dir=" + dir, "--older-than=24h", "--dry-run"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got := countStoredResults(t, dir); got != 30 {
+		t.Errorf("dry run pruned to %d results, want 30", got)
+	}
+	if err := runDB([]string{"prune", "--store-dir=" + dir, "--older-than=24h"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got := countStoredResults(t, dir); got != 10 {
+		t.Errorf("pruned store holds %d results, want 10", got)
+	}
+	s, err = openResultsStoreReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx, err := s.loadArchiveIndex(); err != nil || len(idx.Segments) != 0 {
+		t.Errorf("archive index after pruning = %v, %v; want empty", idx, err)
+	}
+}
+
+func TestDBVerify(t *testing.T) {
+	day0 := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	dir := writeTestStore(t, "1a", day0, 1)
+	if err := runDB([]string{"verify", "--store-dir=" + dir}, io.Discard); err != nil {
+		t.Fatalf("verify of intact store: %v", err)
+	}
+
+	// A write torn by power loss, padded with NULs, to which a write after
+	// restart is appended, and a torn trailing write.
+	path := filepath.Join(dir, resultsFileName("2024-07-01"))
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	damaged := lines[0][:20] + strings.Repeat("\x00", 8) + lines[1] + lines[2][:10]
+	if err := os.WriteFile(path, []byte(damaged), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := runDB([]string{"verify", "--store-dir=" + dir}, io.Discard); err == nil {
+		t.Fatal("verify of damaged store succeeded")
+	}
+	var out strings.Builder
+	if err := runDB([]string{"verify", "--store-dir=" + dir, "--repair"}, &out); err != nil {
+		t.Fatalf("repair: %v", err)
+	}
+	if !strings.Contains(out.String(), "2 lines damaged, 1 results salvageable") {
+		t.Errorf("repair output = %q", out.String())
+	}
+	if err := runDB([]string{"verify", "--store-dir=" + dir}, io.Discard); err != nil {
+		t.Errorf("verify after repair: %v", err)
+	}
+	if got := countStoredResults(t, dir); got != 1 {
+		t.Errorf("repaired store holds %d results, want 1", got)
+	}
+}
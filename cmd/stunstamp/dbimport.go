@@ -0,0 +1,305 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of history imported by db import.
+const (
+	importFormatSmokeping = "smokeping"
+	importFormatRIPEAtlas = "ripe-atlas"
+)
+
+// runDBImport converts the latency history of other tools into stored
+// results and merges them into the store in --store-dir, so that teams
+// migrating to stunstamp keep the continuity of their history. Like db
+// merge, importing is idempotent.
+func runDBImport(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("db import", flag.ContinueOnError)
+	storeDir := fs.String("store-dir", "", "directory of the store to import into, created if needed")
+	format := fs.String("format", "", `format of the files imported: "smokeping" (rrdtool dump XML) or "ripe-atlas" (ping results JSON)`)
+	hostname := fs.String("hostname", "", "with --format=smokeping, the hostname of the target of the RRDs; defaults to their file name without extension")
+	addr := fs.String("addr", "", "with --format=smokeping, the address of the target of the RRDs, if known")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(*storeDir) < 1 || fs.NArg() < 1 {
+		return errors.New("usage: stunstamp db import --store-dir=DST --format=smokeping|ripe-atlas FILE...")
+	}
+	var target netip.Addr
+	if *addr != "" {
+		var err error
+		if target, err = netip.ParseAddr(*addr); err != nil {
+			return fmt.Errorf("invalid addr flag value: %w", err)
+		}
+	}
+	var parse func(path string, r io.Reader) ([]storedResult, error)
+	switch *format {
+	case importFormatSmokeping:
+		parse = func(path string, r io.Reader) ([]storedResult, error) {
+			host := *hostname
+			if host == "" {
+				host = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+			}
+			return parseSmokepingDump(r, host, target)
+		}
+	case importFormatRIPEAtlas:
+		parse = func(_ string, r io.Reader) ([]storedResult, error) {
+			return parseRIPEAtlas(r)
+		}
+	default:
+		return fmt.Errorf("unknown format %q, want %s or %s", *format, importFormatSmokeping, importFormatRIPEAtlas)
+	}
+
+	dst, err := openStoreForMaintenance(*storeDir)
+	if err != nil {
+		return err
+	}
+	defer dst.close()
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		srs, err := parse(path, bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("error parsing %s: %w", path, err)
+		}
+		byDay := make(map[string][]storedResult)
+		for _, sr := range srs {
+			day := sr.At.Format(storeDayLayout)
+			byDay[day] = append(byDay[day], sr)
+		}
+		var added int
+		for _, day := range slices.Sorted(maps.Keys(byDay)) {
+			n, err := dst.mergeDay(day, byDay[day])
+			if err != nil {
+				return fmt.Errorf("error importing %s of %s: %w", day, path, err)
+			}
+			added += n
+		}
+		fmt.Fprintf(w, "imported %s: %d results, %d added\n", path, len(srs), added)
+	}
+	return nil
+}
+
+// rrdDump is the XML of "rrdtool dump" of a smokeping RRD.
+type rrdDump struct {
+	Step       int64 `xml:"step"`
+	LastUpdate int64 `xml:"lastupdate"`
+	DS         []struct {
+		Name string `xml:"name"`
+	} `xml:"ds"`
+	RRA []rrdRRA `xml:"rra"`
+}
+
+// rrdRRA is a round robin archive of an rrdDump.
+type rrdRRA struct {
+	CF        string `xml:"cf"`
+	PDPPerRow int64  `xml:"pdp_per_row"`
+	Rows      []struct {
+		V []string `xml:"v"`
+	} `xml:"database>row"`
+}
+
+// parseSmokepingDump converts the "rrdtool dump" XML of the smokeping RRD of
+// hostname at addr into ICMP results, one per row of its AVERAGE RRAs. Rows
+// of coarser RRAs are used only before the start of finer ones, so that the
+// full history is imported at the finest resolution retained. The RTT of a
+// result is the row's median, its attempts the row's pings, and it failed if
+// every ping was lost.
+func parseSmokepingDump(r io.Reader, hostname string, addr netip.Addr) ([]storedResult, error) {
+	var d rrdDump
+	if err := xml.NewDecoder(r).Decode(&d); err != nil {
+		return nil, err
+	}
+	if d.Step <= 0 {
+		return nil, errors.New("not an RRD dump: no step")
+	}
+	loss, median := -1, -1
+	var pings []int
+	for i, ds := range d.DS {
+		switch name := strings.TrimSpace(ds.Name); {
+		case name == "loss":
+			loss = i
+		case name == "median":
+			median = i
+		case strings.HasPrefix(name, "ping"):
+			pings = append(pings, i)
+		}
+	}
+	if loss < 0 || median < 0 || len(pings) == 0 {
+		return nil, errors.New("not a smokeping RRD: missing loss, median, or ping data sources")
+	}
+
+	rras := slices.Clone(d.RRA)
+	rras = slices.DeleteFunc(rras, func(rra rrdRRA) bool {
+		return strings.TrimSpace(rra.CF) != "AVERAGE" || rra.PDPPerRow <= 0
+	})
+	slices.SortFunc(rras, func(a, b rrdRRA) int {
+		return cmp.Compare(a.PDPPerRow, b.PDPPerRow)
+	})
+
+	var ret []storedResult
+	covered := int64(math.MaxInt64) // start of the rows of finer RRAs
+	for _, rra := range rras {
+		rowStep := d.Step * rra.PDPPerRow
+		last := d.LastUpdate - d.LastUpdate%rowStep
+		first := last - int64(len(rra.Rows)-1)*rowStep
+		for i, row := range rra.Rows {
+			at := first + int64(i)*rowStep
+			if at >= covered || len(row.V) != len(d.DS) {
+				continue
+			}
+			v := func(i int) (float64, bool) {
+				f, err := strconv.ParseFloat(strings.TrimSpace(row.V[i]), 64)
+				return f, err == nil && !math.IsNaN(f)
+			}
+			lost, ok := v(loss)
+			if !ok {
+				continue // no data, e.g. before smokeping was started
+			}
+			sr := storedResult{
+				At:              time.Unix(at, 0).UTC(),
+				Hostname:        hostname,
+				Addr:            addr,
+				Protocol:        protocolICMP,
+				TimestampSource: timestampSourceUserspace.String(),
+				Source:          importFormatSmokeping,
+			}
+			for _, p := range pings {
+				if f, ok := v(p); ok {
+					ns := int64(f * float64(time.Second))
+					sr.AttemptsNanos = append(sr.AttemptsNanos, &ns)
+				}
+			}
+			for range min(int(math.Round(lost)), len(pings)-len(sr.AttemptsNanos)) {
+				sr.AttemptsNanos = append(sr.AttemptsNanos, nil)
+			}
+			if f, ok := v(median); ok && int(math.Round(lost)) < len(pings) {
+				ns := int64(f * float64(time.Second))
+				sr.RTTNanos = &ns
+			}
+			ret = append(ret, sr)
+		}
+		if len(rra.Rows) > 0 {
+			covered = min(covered, first)
+		}
+	}
+	slices.SortStableFunc(ret, func(a, b storedResult) int {
+		return a.At.Compare(b.At)
+	})
+	return ret, nil
+}
+
+// ripeAtlasPing is a RIPE Atlas ping measurement result.
+type ripeAtlasPing struct {
+	Type      string `json:"type"`
+	MsmID     int64  `json:"msm_id"`
+	PrbID     int64  `json:"prb_id"`
+	Timestamp int64  `json:"timestamp"`
+	DstAddr   string `json:"dst_addr"`
+	DstName   string `json:"dst_name"`
+	Result    []struct {
+		RTT *float64 `json:"rtt"` // ms, nil if lost
+		Dup int      `json:"dup"` // nonzero for duplicate replies
+	} `json:"result"`
+}
+
+// parseRIPEAtlas converts RIPE Atlas ping measurement results, as a JSON
+// array or newline-delimited JSON as downloaded from the API, into ICMP
+// results, one per result. The RTT of a result is the median of its
+// replies, and its attempts every packet sent. Results of other types, e.g.
+// traceroute, are skipped.
+func parseRIPEAtlas(r io.Reader) ([]storedResult, error) {
+	br := bufio.NewReader(r)
+	// Results are either a JSON array or a stream of objects.
+	var array bool
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.ContainsRune([]byte(" \t\r\n"), rune(c)) {
+			array = c == '['
+			br.UnreadByte()
+			break
+		}
+	}
+	dec := json.NewDecoder(br)
+	if array {
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+	var ret []storedResult
+	for dec.More() {
+		var p ripeAtlasPing
+		if err := dec.Decode(&p); err != nil {
+			return nil, err
+		}
+		if p.Type != "ping" || p.Timestamp == 0 {
+			continue
+		}
+		addr, err := netip.ParseAddr(p.DstAddr)
+		if err != nil {
+			return nil, fmt.Errorf("result of measurement %d: invalid dst_addr: %w", p.MsmID, err)
+		}
+		hostname := p.DstName
+		if hostname == "" {
+			hostname = p.DstAddr
+		}
+		sr := storedResult{
+			At:              time.Unix(p.Timestamp, 0).UTC(),
+			Hostname:        hostname,
+			Addr:            addr,
+			Protocol:        protocolICMP,
+			TimestampSource: timestampSourceUserspace.String(),
+			Source:          fmt.Sprintf("%s/msm=%d/prb=%d", importFormatRIPEAtlas, p.MsmID, p.PrbID),
+		}
+		var rtts []time.Duration
+		for _, res := range p.Result {
+			if res.Dup != 0 {
+				continue
+			}
+			if res.RTT == nil {
+				sr.AttemptsNanos = append(sr.AttemptsNanos, nil)
+				continue
+			}
+			rtt := time.Duration(*res.RTT * float64(time.Millisecond))
+			rtts = append(rtts, rtt)
+			ns := int64(rtt)
+			sr.AttemptsNanos = append(sr.AttemptsNanos, &ns)
+		}
+		if len(rtts) > 0 {
+			ns := int64(medianOf(rtts))
+			sr.RTTNanos = &ns
+		}
+		ret = append(ret, sr)
+	}
+	return ret, nil
+}
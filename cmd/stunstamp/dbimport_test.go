@@ -0,0 +1,136 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSmokepingDump is the "rrdtool dump" of a smokeping RRD of 3 pings with
+// a 300s step, abridged, with a 1-step and a 2-step AVERAGE RRA.
+const testSmokepingDump = `<?xml version="1.0" encoding="utf-8"?>
+<rrd>
+	<version>0003</version>
+	<step>300</step>
+	<lastupdate>1717243500</lastupdate>
+	<ds><name> uptime </name><type> GAUGE </type></ds>
+	<ds><name> loss </name><type> GAUGE </type></ds>
+	<ds><name> median </name><type> GAUGE </type></ds>
+	<ds><name> ping1 </name><type> GAUGE </type></ds>
+	<ds><name> ping2 </name><type> GAUGE </type></ds>
+	<ds><name> ping3 </name><type> GAUGE </type></ds>
+	<rra>
+		<cf>MAX</cf>
+		<pdp_per_row>1</pdp_per_row>
+		<database>
+			<row><v>1</v><v>0</v><v>1</v><v>1</v><v>1</v><v>1</v></row>
+		</database>
+	</rra>
+	<rra>
+		<cf>AVERAGE</cf>
+		<pdp_per_row>1</pdp_per_row>
+		<database>
+			<!-- 2024-06-01 12:00:00 UTC / 1717243200 --> <row><v>NaN</v><v>NaN</v><v>NaN</v><v>NaN</v><v>NaN</v><v>NaN</v></row>
+			<!-- 2024-06-01 12:05:00 UTC / 1717243500 --> <row><v>1.0e+05</v><v>1.0000000000e+00</v><v>1.2000000000e-02</v><v>1.0000000000e-02</v><v>1.4000000000e-02</v><v>NaN</v></row>
+		</database>
+	</rra>
+	<rra>
+		<cf>AVERAGE</cf>
+		<pdp_per_row>2</pdp_per_row>
+		<database>
+			<!-- 2024-06-01 11:50:00 UTC / 1717242600 --> <row><v>1.0e+05</v><v>3.0000000000e+00</v><v>NaN</v><v>NaN</v><v>NaN</v><v>NaN</v></row>
+			<!-- 2024-06-01 12:00:00 UTC / 1717243200 --> <row><v>1.0e+05</v><v>0.0000000000e+00</v><v>2.0000000000e-02</v><v>2.0000000000e-02</v><v>2.0000000000e-02</v><v>2.0000000000e-02</v></row>
+		</database>
+	</rra>
+</rrd>
+`
+
+func TestParseSmokepingDump(t *testing.T) {
+	addr := netip.MustParseAddr("192.0.2.1")
+	got, err := parseSmokepingDump(strings.NewReader(testSmokepingDump), "derp1a", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The 12:00 row of the 2-step RRA is covered by the 1-step RRA, whose
+	// row of it holds no data.
+	if len(got) != 2 {
+		t.Fatalf("got %d results, want 2: %+v", len(got), got)
+	}
+	lost, ok := got[0], got[1]
+	if !lost.At.Equal(time.Date(2024, 6, 1, 11, 50, 0, 0, time.UTC)) || lost.RTTNanos != nil || len(lost.AttemptsNanos) != 3 {
+		t.Errorf("lost row = %+v, want a failure of 3 attempts at 11:50", lost)
+	}
+	if !ok.At.Equal(time.Date(2024, 6, 1, 12, 5, 0, 0, time.UTC)) || ok.RTTNanos == nil || *ok.RTTNanos != int64(12*time.Millisecond) {
+		t.Errorf("row = %+v, want a 12ms median at 12:05", ok)
+	}
+	if len(ok.AttemptsNanos) != 3 || ok.AttemptsNanos[2] != nil || ok.Hostname != "derp1a" || ok.Addr != addr || ok.Protocol != protocolICMP || ok.Source != importFormatSmokeping {
+		t.Errorf("row = %+v", ok)
+	}
+
+	if _, err := parseSmokepingDump(strings.NewReader(`<rrd><step>300</step><ds><name>x</name></ds></rrd>`), "x", addr); err == nil {
+		t.Error("parsed an RRD without smokeping data sources")
+	}
+}
+
+const testRIPEAtlas = `{"fw":5080,"af":4,"dst_addr":"192.0.2.1","dst_name":"derp1a.example.com","msm_id":1001,"prb_id":42,"timestamp":1717243200,"type":"ping","proto":"ICMP","result":[{"rtt":10.5},{"x":"*"},{"rtt":12.5},{"rtt":14.5},{"rtt":12.5,"dup":1}]}
+{"fw":5080,"af":6,"dst_addr":"2001:db8::1","msm_id":1002,"prb_id":42,"timestamp":1717243260,"type":"ping","result":[{"x":"*"},{"x":"*"}]}
+{"fw":5080,"af":4,"dst_addr":"192.0.2.1","msm_id":1003,"prb_id":42,"timestamp":1717243300,"type":"traceroute","result":[]}
+`
+
+func TestParseRIPEAtlas(t *testing.T) {
+	lines := strings.Split(strings.TrimSpace(testRIPEAtlas), "\n")
+	for name, in := range map[string]string{
+		"ndjson": testRIPEAtlas,
+		"array":  " \n[" + strings.Join(lines, ",\n") + "]\n",
+	} {
+		got, err := parseRIPEAtlas(strings.NewReader(in))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(got) != 2 {
+			t.Fatalf("%s: got %d results, want 2 pings: %+v", name, len(got), got)
+		}
+		if r := got[0]; r.Hostname != "derp1a.example.com" || r.RTTNanos == nil || *r.RTTNanos != int64(12500*time.Microsecond) || len(r.AttemptsNanos) != 4 || r.AttemptsNanos[1] != nil || r.Source != "ripe-atlas/msm=1001/prb=42" {
+			t.Errorf("%s: first = %+v", name, r)
+		}
+		if r := got[1]; r.Hostname != "2001:db8::1" || r.RTTNanos != nil || len(r.AttemptsNanos) != 2 {
+			t.Errorf("%s: second = %+v, want a failure", name, r)
+		}
+	}
+	if got, err := parseRIPEAtlas(strings.NewReader("  \n")); err != nil || len(got) != 0 {
+		t.Errorf("empty input = %v, %v", got, err)
+	}
+}
+
+func TestDBImport(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(t.TempDir(), "derp1a.xml")
+	if err := os.WriteFile(src, []byte(testSmokepingDump), 0600); err != nil {
+		t.Fatal(err)
+	}
+	storeDir := filepath.Join(dir, "store")
+	var buf bytes.Buffer
+	for range 2 {
+		buf.Reset()
+		if err := runDB([]string{"import", "--store-dir=" + storeDir, "--format=smokeping", src}, &buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Importing is idempotent.
+	if !strings.Contains(buf.String(), "2 results, 0 added") {
+		t.Errorf("second import = %q, want none added", buf.String())
+	}
+	if n := countStoredResults(t, storeDir); n != 2 {
+		t.Errorf("store holds %d results, want 2", n)
+	}
+	if err := runDB([]string{"import", "--store-dir=" + storeDir, "--format=mrtg", src}, &buf); err == nil {
+		t.Error("import of an unknown format unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestMeasureHTTPSRTTHonorsDeadline(t *testing.T) {
+	// A listener that completes TCP handshakes (via the kernel backlog) but
+	// never speaks TLS.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	lport := lportForTCPConn(0)
+	start := time.Now()
+	_, err = measureHTTPSRTT(ctx, &lport, "example.com", netip.MustParseAddrPort(ln.Addr().String()))
+	if err == nil {
+		t.Fatal("unexpected success")
+	}
+	if !isTemporaryOrTimeoutErr(err) {
+		t.Errorf("got non-temporary error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("measureHTTPSRTT took %v, want ~200ms", elapsed)
+	}
+}
+
+func TestDeadlineWithin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if got := deadlineWithin(ctx, time.Hour); time.Until(got) > time.Millisecond {
+		t.Errorf("deadlineWithin() = %v from now, want <= 1ms", time.Until(got))
+	}
+	if got := deadlineWithin(context.Background(), time.Second); time.Until(got) > time.Second || time.Until(got) < 0 {
+		t.Errorf("deadlineWithin() = %v from now, want ~1s", time.Until(got))
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"tailscale.com/tailcfg"
+)
+
+const (
+	recommendedRegionMetricName = "stunstamp_recommended_derp_region_id"
+	// homeHistoryMaxAge is how long netcheck remembers the latency of a
+	// region for, picking the region with the best latency in that time.
+	homeHistoryMaxAge = 5 * time.Minute
+	// homeAbsoluteDiff is netcheck's preferredDERPAbsoluteDiff: a reachable
+	// home region is kept unless another is at least this much faster.
+	homeAbsoluteDiff = 10 * time.Millisecond
+	// homeRelativeDiff is the fraction of the latency of the home region
+	// another must be below to replace it, i.e. at least 1/3 faster.
+	homeRelativeDiff = 2.0 / 3
+)
+
+// eventKindDERPHomeChange is a change of the DERP region recommended as
+// home region, see homeRecommender.
+const eventKindDERPHomeChange eventKind = "derp_home_change"
+
+// homeReport is the latency of every region measured in a window.
+type homeReport struct {
+	at      time.Time
+	latency map[int]time.Duration // by region ID
+}
+
+// homeRecommender continuously recommends the DERP home region tailscaled's
+// netcheck would pick given the measurements of stunstamp, so that operators
+// can compare it with the regions their nodes actually pick. It mirrors
+// netcheck: the latency of a region in a window is its fastest direct,
+// userspace-timestamped STUN RTT, or HTTPS RTT if UDP is blocked; the region
+// with the best latency over the last homeHistoryMaxAge, scaled by the DERP
+// map's home params, is recommended, unless the current home is still
+// reachable and not beaten by 1/3 and 10ms. A DERP ping to the current home
+// counts as reaching it, as the DERP frames tailscaled hears from it do.
+// Regions to avoid per the DERP map are never recommended. It is safe for
+// concurrent use.
+type homeRecommender struct {
+	mu      sync.Mutex
+	reports []homeReport // within homeHistoryMaxAge, oldest first
+	home    int          // recommended region ID, or 0
+	since   time.Time    // of home
+	codes   map[int]string
+	scored  map[int]time.Duration // best recent latency, scaled, by region ID
+	scores  map[int]float64
+}
+
+func newHomeRecommender() *homeRecommender {
+	return &homeRecommender{codes: make(map[int]string)}
+}
+
+// update accounts the results of the window starting at, given the DERP map
+// dm, which may be nil.
+func (h *homeRecommender) update(results []result, dm *tailcfg.DERPMap, at time.Time) {
+	avoid := func(regionID int) bool {
+		if dm == nil {
+			return false
+		}
+		r := dm.Regions[regionID]
+		return r != nil && r.Avoid
+	}
+	report := homeReport{at: at, latency: make(map[int]time.Duration)}
+	heard := make(map[int]bool)
+	for _, p := range []protocol{protocolSTUN, protocolHTTPS} {
+		for _, r := range results {
+			if r.rtt == nil || r.key.proxy != "" || avoid(r.key.meta.regionID) {
+				continue
+			}
+			if r.key.protocol == protocolDERP {
+				heard[r.key.meta.regionID] = true
+			}
+			if r.key.protocol != p || r.key.timestampSource != timestampSourceUserspace {
+				continue
+			}
+			if d, ok := report.latency[r.key.meta.regionID]; !ok || *r.rtt < d {
+				report.latency[r.key.meta.regionID] = *r.rtt
+			}
+		}
+		// netcheck measures HTTPS latency only if UDP is blocked.
+		if len(report.latency) > 0 {
+			break
+		}
+	}
+	var scores map[int]float64
+	if dm != nil && dm.HomeParams != nil {
+		scores = dm.HomeParams.RegionScore
+	}
+	scale := func(regionID int, d time.Duration) time.Duration {
+		if score := scores[regionID]; score > 0 {
+			return time.Duration(float64(d) * score)
+		}
+		return d
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range results {
+		h.codes[r.key.meta.regionID] = r.key.meta.regionCode
+	}
+	h.reports = append(h.reports, report)
+	h.reports = slices.DeleteFunc(h.reports, func(r homeReport) bool {
+		return at.Sub(r.at) > homeHistoryMaxAge
+	})
+	h.scores = scores
+	h.scored = make(map[int]time.Duration)
+	for _, r := range h.reports {
+		for regionID, d := range r.latency {
+			if avoid(regionID) {
+				continue
+			}
+			d = scale(regionID, d)
+			if best, ok := h.scored[regionID]; !ok || d < best {
+				h.scored[regionID] = d
+			}
+		}
+	}
+	// Like magicsock, keep the home region if nothing was reached.
+	if len(report.latency) == 0 {
+		return
+	}
+
+	var best int
+	var bestAny, oldCur time.Duration
+	for _, regionID := range slices.Sorted(maps.Keys(report.latency)) {
+		if regionID == h.home {
+			oldCur = scale(regionID, report.latency[regionID])
+		}
+		if d := h.scored[regionID]; best == 0 || d < bestAny {
+			best, bestAny = regionID, d
+		}
+	}
+	prev := h.home
+	if prev != 0 && best != prev && !avoid(prev) && (oldCur != 0 || heard[prev]) {
+		if oldCur-bestAny < homeAbsoluteDiff || float64(bestAny) > float64(oldCur)*homeRelativeDiff {
+			best = prev
+		}
+	}
+	if best == prev {
+		return
+	}
+	h.home, h.since = best, at
+	attrs := map[string]string{
+		"current":            h.codes[best],
+		"current_latency_ns": strconv.FormatInt(int64(bestAny), 10),
+	}
+	if prev != 0 {
+		attrs["previous"] = h.codes[prev]
+		if oldCur != 0 {
+			attrs["previous_latency_ns"] = strconv.FormatInt(int64(oldCur), 10)
+		}
+	}
+	events.record(event{
+		At:         at,
+		Kind:       eventKindDERPHomeChange,
+		RegionID:   best,
+		RegionCode: h.codes[best],
+		Attrs:      attrs,
+	})
+	if prev != 0 {
+		annotations.annotateAuto(at, at, "", fmt.Sprintf("recommended DERP home region changed from %s to %s", h.codes[prev], h.codes[best]))
+	}
+}
+
+// homeRegionLatency is the latency of a region compared by homeRecommender.
+type homeRegionLatency struct {
+	RegionID   int
+	RegionCode string
+	// LatencyNanos is the best latency of the region in the last 5
+	// minutes, scaled by Score.
+	LatencyNanos int64
+	Score        float64 `json:",omitempty"`
+}
+
+// homeStatus is the recommendation of homeRecommender as served by the API.
+type homeStatus struct {
+	// RegionID is the recommended home region, or 0 if none yet.
+	RegionID   int
+	RegionCode string `json:",omitempty"`
+	Since      time.Time
+	// Regions holds the latency of every region compared, best first.
+	Regions []homeRegionLatency
+}
+
+func (h *homeRecommender) status() homeStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := homeStatus{RegionID: h.home, Since: h.since, Regions: []homeRegionLatency{}}
+	if h.home != 0 {
+		s.RegionCode = h.codes[h.home]
+	}
+	for regionID, d := range h.scored {
+		s.Regions = append(s.Regions, homeRegionLatency{
+			RegionID:     regionID,
+			RegionCode:   h.codes[regionID],
+			LatencyNanos: int64(d),
+			Score:        h.scores[regionID],
+		})
+	}
+	slices.SortFunc(s.Regions, func(a, b homeRegionLatency) int {
+		return cmp.Or(cmp.Compare(a.LatencyNanos, b.LatencyNanos), cmp.Compare(a.RegionID, b.RegionID))
+	})
+	return s
+}
+
+// toPromTimeSeries returns the ID of the recommended home region, if any.
+func (h *homeRecommender) toPromTimeSeries(instance string, at time.Time) []prompb.TimeSeries {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.home == 0 {
+		return nil
+	}
+	return []prompb.TimeSeries{instanceTimeSeries(recommendedRegionMetricName, instance, at, float64(h.home))}
+}
+
+// serveDERPHome serves the recommended DERP home region as JSON, see
+// homeRecommender.
+func (s *httpServer) serveDERPHome(w http.ResponseWriter, r *http.Request) {
+	if s.home == nil {
+		http.Error(w, "not probing", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.home.status())
+}
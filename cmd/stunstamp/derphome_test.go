@@ -0,0 +1,93 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestHomeRecommender(t *testing.T) {
+	nyc := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	sfo := nodeMeta{regionID: 2, regionCode: "sfo", hostname: "2a", addr: netip.MustParseAddr("192.0.2.2")}
+	res := func(meta nodeMeta, p protocol, source timestampSource, rtt time.Duration) result {
+		return result{key: resultKey{meta: meta, protocol: p, timestampSource: source}, rtt: &rtt}
+	}
+	stun := func(nycRTT, sfoRTT time.Duration) []result {
+		return []result{
+			res(nyc, protocolSTUN, timestampSourceUserspace, nycRTT),
+			res(sfo, protocolSTUN, timestampSourceUserspace, sfoRTT),
+			// Kernel timestamps are not what tailscaled measures.
+			res(sfo, protocolSTUN, timestampSourceKernel, time.Millisecond),
+		}
+	}
+	countChanges := func() int {
+		n := 0
+		for _, ev := range events.recentEvents() {
+			if ev.Kind == eventKindDERPHomeChange {
+				n++
+			}
+		}
+		return n
+	}
+	before := countChanges()
+
+	h := newHomeRecommender()
+	start := time.Now()
+	for i, tt := range []struct {
+		results []result
+		want    string
+	}{
+		{stun(20*time.Millisecond, 50*time.Millisecond), "nyc"},
+		// Not 10ms faster.
+		{stun(20*time.Millisecond, 15*time.Millisecond), "nyc"},
+		// Both 10ms and 1/3 faster than nyc currently is.
+		{stun(30*time.Millisecond, 5*time.Millisecond), "sfo"},
+		// Unreachable by STUN, but nothing else was either.
+		{nil, "sfo"},
+	} {
+		h.update(tt.results, nil, start.Add(time.Duration(i)*time.Minute))
+		if got := h.status().RegionCode; got != tt.want {
+			t.Fatalf("window %d: got %q, want %q", i, got, tt.want)
+		}
+	}
+	if n := countChanges() - before; n != 2 {
+		t.Errorf("got %d change events, want 2", n)
+	}
+	if ts := h.toPromTimeSeries("i", start); len(ts) != 1 || ts[0].Samples[0].Value != 2 {
+		t.Errorf("got %+v, want region 2", ts)
+	}
+	if s := h.status(); len(s.Regions) != 2 || s.Regions[0].RegionCode != "sfo" || s.Regions[0].LatencyNanos != int64(5*time.Millisecond) {
+		t.Errorf("got regions %+v", s.Regions)
+	}
+
+	// Regions to avoid are never recommended, and home params scale
+	// latencies.
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{1: {RegionID: 1}, 2: {RegionID: 2, Avoid: true}}}
+	h = newHomeRecommender()
+	h.update(stun(20*time.Millisecond, 5*time.Millisecond), dm, start)
+	if got := h.status().RegionCode; got != "nyc" {
+		t.Errorf("got %q, want nyc as sfo is to be avoided", got)
+	}
+	dm.Regions[2].Avoid = false
+	dm.HomeParams = &tailcfg.DERPHomeParams{RegionScore: map[int]float64{2: 10}}
+	h = newHomeRecommender()
+	h.update(stun(20*time.Millisecond, 5*time.Millisecond), dm, start)
+	if got := h.status().RegionCode; got != "nyc" {
+		t.Errorf("got %q, want nyc as sfo is scored down", got)
+	}
+
+	// HTTPS latency is used if UDP is blocked.
+	h = newHomeRecommender()
+	h.update([]result{
+		res(nyc, protocolHTTPS, timestampSourceUserspace, 80*time.Millisecond),
+		res(sfo, protocolHTTPS, timestampSourceUserspace, 40*time.Millisecond),
+	}, nil, start)
+	if got := h.status().RegionCode; got != "sfo" {
+		t.Errorf("got %q, want sfo by HTTPS latency", got)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// eventKindDERPMapChange is a change in the DERP map affecting a target
+// hostname: its addition, removal, or a change of its region or addresses.
+// Tailscale rebalancing regions can shift latency in a way that would
+// otherwise be misread as an ISP issue.
+const eventKindDERPMapChange eventKind = "derp_map_change"
+
+// derpHost is the DERP map entry for a hostname.
+type derpHost struct {
+	regionID   int
+	regionCode string
+	v4, v6     netip.Addr
+	stunPort   int
+}
+
+func derpHostsByHostname(nodeMetaByAddr map[netip.Addr]nodeMeta, stunPorts map[string]int) map[string]derpHost {
+	ret := make(map[string]derpHost)
+	for addr, meta := range nodeMetaByAddr {
+		h := ret[meta.hostname]
+		h.regionID = meta.regionID
+		h.regionCode = meta.regionCode
+		h.stunPort = stunPorts[meta.hostname]
+		if addr.Is4() {
+			h.v4 = addr
+		} else {
+			h.v6 = addr
+		}
+		ret[meta.hostname] = h
+	}
+	return ret
+}
+
+func regionString(h derpHost) string {
+	return h.regionCode + " (" + strconv.Itoa(h.regionID) + ")"
+}
+
+// derpSTUNPorts returns the STUN ports of the nodes in dm by hostname, with
+// zero for nodes not serving STUN.
+func derpSTUNPorts(dm *tailcfg.DERPMap) map[string]int {
+	ret := make(map[string]int)
+	for _, region := range dm.Regions {
+		for _, node := range region.Nodes {
+			switch {
+			case node.STUNPort < 0:
+				ret[node.HostName] = 0
+			case node.STUNPort == 0:
+				ret[node.HostName] = 3478
+			default:
+				ret[node.HostName] = node.STUNPort
+			}
+		}
+	}
+	return ret
+}
+
+// addSTUNPort returns ports with the addition of the STUN port port, if
+// nonzero and not already present. ports is not modified.
+func addSTUNPort(ports map[protocol][]int, port int) map[protocol][]int {
+	if port == 0 || slices.Contains(ports[protocolSTUN], port) {
+		return ports
+	}
+	ret := maps.Clone(ports)
+	if ret == nil {
+		ret = make(map[protocol][]int)
+	}
+	ret[protocolSTUN] = append(slices.Clone(ret[protocolSTUN]), port)
+	return ret
+}
+
+// derpMapChanges returns events at at describing how the targets of a DERP
+// map changed from before to after, by hostname, ordered by hostname.
+// beforeSTUN and afterSTUN hold the STUN ports of the targets, see
+// derpSTUNPorts.
+func derpMapChanges(before, after map[netip.Addr]nodeMeta, beforeSTUN, afterSTUN map[string]int, at time.Time) []event {
+	beforeHosts, afterHosts := derpHostsByHostname(before, beforeSTUN), derpHostsByHostname(after, afterSTUN)
+	var ret []event
+	change := func(hostname string, h derpHost, change string, attrs ...string) {
+		ev := event{
+			At:         at,
+			Kind:       eventKindDERPMapChange,
+			Addr:       h.v4,
+			RegionID:   h.regionID,
+			RegionCode: h.regionCode,
+			Hostname:   hostname,
+			Attrs:      map[string]string{"change": change},
+		}
+		for i := 0; i+1 < len(attrs); i += 2 {
+			ev.Attrs[attrs[i]] = attrs[i+1]
+		}
+		ret = append(ret, ev)
+	}
+	for hostname, b := range beforeHosts {
+		a, ok := afterHosts[hostname]
+		if !ok {
+			change(hostname, b, "removed")
+			continue
+		}
+		if a.regionID != b.regionID || a.regionCode != b.regionCode {
+			change(hostname, a, "region", "old", regionString(b), "new", regionString(a))
+		}
+		if a.v4 != b.v4 {
+			change(hostname, a, "ipv4", "old", b.v4.String(), "new", a.v4.String())
+		}
+		if a.v6 != b.v6 && a.v6.IsValid() && b.v6.IsValid() {
+			change(hostname, a, "ipv6", "old", b.v6.String(), "new", a.v6.String())
+		}
+		if a.stunPort != b.stunPort {
+			change(hostname, a, "stun_port", "old", strconv.Itoa(b.stunPort), "new", strconv.Itoa(a.stunPort))
+		}
+	}
+	for hostname, a := range afterHosts {
+		if _, ok := beforeHosts[hostname]; !ok {
+			change(hostname, a, "added", "region", regionString(a))
+		}
+	}
+	slices.SortFunc(ret, func(a, b event) int {
+		if c := cmp.Compare(a.Hostname, b.Hostname); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Attrs["change"], b.Attrs["change"])
+	})
+	return ret
+}
+
+// derpMapChangeText returns annotation text for ev, or the empty string if ev
+// does not warrant an annotation. Removals are annotated separately.
+func derpMapChangeText(ev event) string {
+	switch c := ev.Attrs["change"]; c {
+	case "region", "ipv4", "ipv6":
+		return fmt.Sprintf("DERP map %s of %s changed from %s to %s", c, ev.Hostname, ev.Attrs["old"], ev.Attrs["new"])
+	case "stun_port":
+		return fmt.Sprintf("DERP map STUN port of %s changed from %s to %s", ev.Hostname, ev.Attrs["old"], ev.Attrs["new"])
+	}
+	return ""
+}
+
+// derpMapWebhookPayload is the body of --derp-map-webhook-url requests.
+type derpMapWebhookPayload struct {
+	Instance string
+	Changes  []event
+}
+
+// postDERPMapChanges POSTs changes, as returned by derpMapChanges, to url as
+// a JSON derpMapWebhookPayload.
+func postDERPMapChanges(ctx context.Context, c *http.Client, url, instance string, changes []event) error {
+	body, err := json.Marshal(derpMapWebhookPayload{Instance: instance, Changes: changes})
+	if err != nil {
+		return err
+	}
+	return postDERPMapWebhook(ctx, c, url, body)
+}
+
+// postDERPMapWebhook POSTs the JSON derpMapWebhookPayload body to url,
+// returning a recoverableErr if it should be retried.
+func postDERPMapWebhook(ctx context.Context, c *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create DERP map webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "stunstamp")
+	resp, err := c.Do(req)
+	if err != nil {
+		return recoverableErr{fmt.Errorf("error performing DERP map webhook request: %w", err)}
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("DERP map webhook %s returned HTTP status %d", url, resp.StatusCode)
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableErr{err}
+	}
+	return err
+}
+
+// sendSpooledDERPMapChanges returns a function delivering spooled
+// derpMapWebhookPayloads to url with c, merged into as few requests as
+// possible.
+func sendSpooledDERPMapChanges(c *http.Client, url string) func(context.Context, [][]byte) error {
+	return func(ctx context.Context, payloads [][]byte) error {
+		bodies, err := mergeDERPMapWebhookPayloads(payloads)
+		if err != nil {
+			return err
+		}
+		for _, body := range bodies {
+			if err := postDERPMapWebhook(ctx, c, url, body); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
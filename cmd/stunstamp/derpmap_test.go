@@ -0,0 +1,159 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestDERPMapChanges(t *testing.T) {
+	dm := func(nodes map[int][]*tailcfg.DERPNode) *tailcfg.DERPMap {
+		ret := &tailcfg.DERPMap{Regions: make(map[int]*tailcfg.DERPRegion)}
+		for id, n := range nodes {
+			ret.Regions[id] = &tailcfg.DERPRegion{RegionID: id, RegionCode: map[int]string{1: "nyc", 2: "sfo"}[id], Nodes: n}
+		}
+		return ret
+	}
+	nodeMetaByAddr := make(map[netip.Addr]nodeMeta)
+	_, err := nodeMetaFromDERPMap(dm(map[int][]*tailcfg.DERPNode{
+		1: {
+			{HostName: "derp1a", IPv4: "192.0.2.1"},
+			{HostName: "derp1b", IPv4: "192.0.2.2"},
+			{HostName: "derp1c", IPv4: "192.0.2.3"},
+		},
+	}), nodeMetaByAddr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := maps.Clone(nodeMetaByAddr)
+	stale, err := nodeMetaFromDERPMap(dm(map[int][]*tailcfg.DERPNode{
+		1: {
+			{HostName: "derp1a", IPv4: "192.0.2.1"},
+			{HostName: "derp1b", IPv4: "192.0.2.12"},
+		},
+		2: {
+			{HostName: "derp1c", IPv4: "192.0.2.3"},
+			{HostName: "derp2a", IPv4: "192.0.2.4"},
+		},
+	}), nodeMetaByAddr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 2 {
+		t.Errorf("got %d stale nodeMeta, want 2 (derp1b's old address, derp1c's old region)", len(stale))
+	}
+	if _, ok := nodeMetaByAddr[netip.MustParseAddr("192.0.2.2")]; ok {
+		t.Error("removed address still a target")
+	}
+
+	at := time.Now()
+	got := derpMapChanges(before, nodeMetaByAddr, nil, nil, at)
+	type change struct{ hostname, change, old, new string }
+	want := []change{
+		{"derp1b", "ipv4", "192.0.2.2", "192.0.2.12"},
+		{"derp1c", "region", "nyc (1)", "sfo (2)"},
+		{"derp2a", "added", "", ""},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d changes, want %d: %+v", len(got), len(want), got)
+	}
+	for i, ev := range got {
+		c := change{ev.Hostname, ev.Attrs["change"], ev.Attrs["old"], ev.Attrs["new"]}
+		if c != want[i] || ev.Kind != eventKindDERPMapChange || !ev.At.Equal(at) {
+			t.Errorf("change %d = %+v, want %+v", i, ev, want[i])
+		}
+	}
+	if text := derpMapChangeText(got[1]); text != "DERP map region of derp1c changed from nyc (1) to sfo (2)" {
+		t.Errorf("derpMapChangeText() = %q", text)
+	}
+	if text := derpMapChangeText(got[2]); text != "" {
+		t.Errorf("derpMapChangeText() of addition = %q, want none", text)
+	}
+
+	removed := derpMapChanges(nodeMetaByAddr, map[netip.Addr]nodeMeta{}, nil, nil, at)
+	if len(removed) != 4 || removed[0].Attrs["change"] != "removed" {
+		t.Errorf("got removals %+v", removed)
+	}
+}
+
+func TestDERPSTUNPorts(t *testing.T) {
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, RegionCode: "nyc", Nodes: []*tailcfg.DERPNode{
+			{HostName: "derp1a", IPv4: "192.0.2.1"},
+			{HostName: "derp1b", IPv4: "192.0.2.2", STUNPort: 443},
+			{HostName: "derp1c", IPv4: "192.0.2.3", STUNPort: -1},
+		}},
+	}}
+	got := derpSTUNPorts(dm)
+	want := map[string]int{"derp1a": 3478, "derp1b": 443, "derp1c": 0}
+	if !maps.Equal(got, want) {
+		t.Errorf("derpSTUNPorts() = %v, want %v", got, want)
+	}
+
+	nodeMetaByAddr := make(map[netip.Addr]nodeMeta)
+	if _, err := nodeMetaFromDERPMap(dm, nodeMetaByAddr, false); err != nil {
+		t.Fatal(err)
+	}
+	after := maps.Clone(got)
+	after["derp1a"] = 3479
+	changes := derpMapChanges(nodeMetaByAddr, nodeMetaByAddr, got, after, time.Now())
+	if len(changes) != 1 || changes[0].Hostname != "derp1a" || changes[0].Attrs["change"] != "stun_port" {
+		t.Fatalf("got changes %+v, want derp1a stun_port", changes)
+	}
+	if text := derpMapChangeText(changes[0]); text != "DERP map STUN port of derp1a changed from 3478 to 3479" {
+		t.Errorf("derpMapChangeText() = %q", text)
+	}
+
+	defaults := map[protocol][]int{protocolSTUN: {3478}, protocolTCP: {443}}
+	if ports := addSTUNPort(defaults, 3478); !maps.EqualFunc(ports, defaults, slices.Equal) {
+		t.Errorf("addSTUNPort() of probed port = %v", ports)
+	}
+	if ports := addSTUNPort(defaults, 0); !maps.EqualFunc(ports, defaults, slices.Equal) {
+		t.Errorf("addSTUNPort() of no port = %v", ports)
+	}
+	ports := addSTUNPort(defaults, 443)
+	if !slices.Equal(ports[protocolSTUN], []int{3478, 443}) || !slices.Equal(ports[protocolTCP], []int{443}) {
+		t.Errorf("addSTUNPort() = %v", ports)
+	}
+	if !slices.Equal(defaults[protocolSTUN], []int{3478}) {
+		t.Errorf("addSTUNPort() modified its argument: %v", defaults)
+	}
+	if ports := addSTUNPort(nil, 443); !slices.Equal(ports[protocolSTUN], []int{443}) {
+		t.Errorf("addSTUNPort(nil) = %v", ports)
+	}
+}
+
+func TestPostDERPMapChanges(t *testing.T) {
+	var got derpMapWebhookPayload
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	changes := []event{{Kind: eventKindDERPMapChange, Hostname: "derp1a", Attrs: map[string]string{"change": "removed"}}}
+	if err := postDERPMapChanges(context.Background(), srv.Client(), srv.URL, "test", changes); err != nil {
+		t.Fatal(err)
+	}
+	if got.Instance != "test" || len(got.Changes) != 1 || got.Changes[0].Hostname != "derp1a" {
+		t.Errorf("got payload %+v", got)
+	}
+	status = http.StatusInternalServerError
+	if err := postDERPMapChanges(context.Background(), srv.Client(), srv.URL, "test", changes); err == nil {
+		t.Error("unexpected success despite HTTP 500")
+	}
+}
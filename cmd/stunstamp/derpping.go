@@ -0,0 +1,146 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/net/netmon"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// derpScheme is the URL scheme DERP probes connect with; tests use plain
+// HTTP.
+var derpScheme = "https"
+
+// derpConn is the conn of DERP probes. It holds a persistent local port for
+// stable conns like lportForTCPConn, and the DERP client of a stable conn,
+// which stays connected across windows, so that stable conns measure a
+// long-lived session as relayed WireGuard traffic uses.
+type derpConn struct {
+	lport  lportForTCPConn
+	stable connStability
+
+	mu sync.Mutex
+	c  *derphttp.Client // connected client of a stable conn, or nil
+}
+
+func newDERPConnAndMeasureFn(stable connStability, lport int) *connAndMeasureFn {
+	cf := newLportConnAndMeasureFn(stable, lport, measureDERPRTT)
+	cf.conn = &derpConn{lport: *cf.conn.(*lportForTCPConn), stable: stable}
+	return cf
+}
+
+func (d *derpConn) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.c != nil {
+		d.c.Close()
+		d.c = nil
+	}
+	return d.lport.Close()
+}
+
+func (d *derpConn) Write([]byte) (int, error) {
+	return 0, errors.New("unimplemented")
+}
+
+func (d *derpConn) Read([]byte) (int, error) {
+	return 0, errors.New("unimplemented")
+}
+
+// client returns a DERP client connected to the DERP node hostname at dst,
+// reusing the client of a stable conn if it is connected, and whether it
+// connected a new client.
+func (d *derpConn) client(ctx context.Context, hostname string, dst netip.AddrPort) (_ *derphttp.Client, connected bool, _ error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.c != nil {
+		return d.c, false, nil
+	}
+	c, err := derphttp.NewClient(key.NewNode(), derpScheme+"://"+hostname+"/derp", logger.Discard, netmon.NewStatic())
+	if err != nil {
+		return nil, false, err
+	}
+	c.IsProber = true
+	c.SetURLDialer(func(ctx context.Context, _, _ string) (net.Conn, error) {
+		// 1.5s mirrors derp/derphttp.dialnodeTimeout used in derp/derphttp.DialNode().
+		dialCtx, dialCancel := context.WithTimeout(ctx, time.Millisecond*1500)
+		defer dialCancel()
+		return tcpDial(dialCtx, &d.lport, dst)
+	})
+	err = c.Connect(ctx)
+	state, _ := c.TLSConnectionState()
+	if state == nil {
+		state = new(tls.ConnectionState)
+	}
+	tlsCerts.observe(protocolDERP, hostname, dst, *state, err, time.Now())
+	if err != nil {
+		c.Close()
+		return nil, false, err
+	}
+	// Pongs are only handled while receiving. The loop ends when the
+	// connection breaks or c is closed; the client is not reconnected.
+	go func() {
+		for {
+			if _, err := c.Recv(); err != nil {
+				return
+			}
+		}
+	}()
+	if d.stable {
+		d.c = c
+	}
+	return c, true, nil
+}
+
+// drop closes c and, if it is the client of a stable conn, forgets it, so
+// that the next measurement reconnects.
+func (d *derpConn) drop(c *derphttp.Client) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.c == c {
+		d.c = nil
+	}
+	c.Close()
+}
+
+// measureDERPRTT measures the RTT of a DERP ping frame to the DERP node at
+// dst, which must be answered by a pong frame. It completes the DERP
+// handshake first if conn holds no connected client, excluding it from the
+// RTT: unlike HTTPS RTT, this is the latency of the DERP server's
+// application layer which relayed packets pay, beyond connection setup.
+func measureDERPRTT(ctx context.Context, conn io.ReadWriteCloser, hostname string, dst netip.AddrPort) (m measurement, err error) {
+	d, ok := conn.(*derpConn)
+	if !ok {
+		return measurement{}, fmt.Errorf("unexpected conn type: %T", conn)
+	}
+	// 5s mirrors the maximum wait of derphttp.Client.Ping.
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	c, connected, err := d.client(ctx, hostname, dst)
+	if err != nil {
+		return measurement{}, tempError{err}
+	}
+	if !d.stable {
+		defer c.Close()
+	}
+	start := time.Now()
+	if err := c.Ping(ctx); err != nil {
+		d.drop(c)
+		return measurement{}, tempError{err}
+	}
+	rtt := time.Since(start)
+	return measurement{rtt: rtt, instance: "key=" + c.ServerPublicKey().ShortString(), first: bool(d.stable) && connected}, nil
+}
@@ -0,0 +1,50 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/types/key"
+)
+
+func TestMeasureDERPRTT(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: derphttp.Handler(s)}
+	go srv.Serve(ln)
+	defer srv.Close()
+	derpScheme = "http"
+	defer func() { derpScheme = "https" }()
+	dst := ln.Addr().(*net.TCPAddr).AddrPort()
+	wantInstance := "key=" + s.PublicKey().ShortString()
+
+	for _, stable := range []connStability{unstableConn, stableConn} {
+		cf := newDERPConnAndMeasureFn(stable, 0)
+		for range 2 {
+			m, err := cf.fn(context.Background(), cf.conn, "localhost", netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), dst.Port()))
+			if err != nil {
+				t.Fatalf("stable=%v: %v", stable, err)
+			}
+			if m.rtt <= 0 || m.instance != wantInstance {
+				t.Errorf("stable=%v: got %+v", stable, m)
+			}
+		}
+		d := cf.conn.(*derpConn)
+		if connected := d.c != nil; connected != bool(stable) {
+			t.Errorf("stable=%v: client kept connected = %v", stable, connected)
+		}
+		cf.conn.Close()
+	}
+}
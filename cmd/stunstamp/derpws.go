@@ -0,0 +1,267 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"tailscale.com/derp"
+	"tailscale.com/net/wsconn"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// This file implements probes of DERP over WebSocket, the fallback of clients
+// on networks that block DERP's own HTTP upgrade, e.g. behind proxies and
+// some CGNATs that only pass WebSockets. protocolDERPWebSocket measures DERP
+// ping frames over a WebSocket like protocolDERP, and
+// protocolDERPWebSocketUpgrade the latency of the WebSocket upgrade itself.
+
+// derpWSSubprotocol is the WebSocket subprotocol DERP servers require.
+const derpWSSubprotocol = "derp"
+
+// dialDERPWebSocket performs the WebSocket upgrade of /derp on the DERP node
+// hostname at dst over a TCP conn dialed from lport, returning the conn and
+// the upgrade latency: the time from writing the upgrade request to the first
+// byte of the response.
+func dialDERPWebSocket(ctx context.Context, lport *lportForTCPConn, hostname string, dst netip.AddrPort) (*websocket.Conn, time.Duration, error) {
+	// The trace is called from the transport's goroutines.
+	var mu sync.Mutex
+	var wrote, gotFirstByte time.Time
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			wrote = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			gotFirstByte = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			tlsCerts.observe(protocolDERPWebSocket, hostname, dst, state, err, time.Now())
+		},
+	})
+	hc := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				// 1.5s mirrors derp/derphttp.dialnodeTimeout used in derp/derphttp.DialNode().
+				dialCtx, dialCancel := context.WithTimeout(ctx, time.Millisecond*1500)
+				defer dialCancel()
+				return tcpDial(dialCtx, lport, dst)
+			},
+			TLSClientConfig: &tls.Config{ServerName: hostname},
+		},
+	}
+	header := make(http.Header)
+	if id := measurementIDKey.Value(ctx); id != "" {
+		header.Set(measurementIDHeader, id)
+	}
+	c, _, err := websocket.Dial(ctx, derpScheme+"://"+hostname+"/derp", &websocket.DialOptions{
+		HTTPClient:      hc,
+		HTTPHeader:      header,
+		Subprotocols:    []string{derpWSSubprotocol},
+		CompressionMode: websocket.CompressionDisabled,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.Subprotocol() != derpWSSubprotocol {
+		c.CloseNow()
+		return nil, 0, fmt.Errorf("server negotiated subprotocol %q", c.Subprotocol())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return c, gotFirstByte.Sub(wrote), nil
+}
+
+// measureDERPWebSocketUpgradeRTT measures the latency of the WebSocket upgrade
+// of /derp on the DERP node at dst over a new TCP conn, closing it after the
+// upgrade. Like the HTTPS RTT, it excludes connection setup.
+func measureDERPWebSocketUpgradeRTT(ctx context.Context, conn io.ReadWriteCloser, hostname string, dst netip.AddrPort) (m measurement, err error) {
+	lport, ok := conn.(*lportForTCPConn)
+	if !ok {
+		return measurement{}, fmt.Errorf("unexpected conn type: %T", conn)
+	}
+	// 5s mirrors net/netcheck.overallProbeTimeout, as for HTTPS.
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	c, upgrade, err := dialDERPWebSocket(ctx, lport, hostname, dst)
+	if err != nil {
+		return measurement{}, tempError{err}
+	}
+	c.CloseNow()
+	return measurement{rtt: upgrade}, nil
+}
+
+// derpWSConn is the conn of protocolDERPWebSocket probes. Like derpConn, it
+// holds a persistent local port for stable conns, and the DERP client of a
+// stable conn, which stays connected across windows.
+type derpWSConn struct {
+	lport  lportForTCPConn
+	stable connStability
+
+	mu sync.Mutex
+	c  *derpWSClient // connected client of a stable conn, or nil
+}
+
+func newDERPWebSocketConnAndMeasureFn(stable connStability, lport int) *connAndMeasureFn {
+	cf := newLportConnAndMeasureFn(stable, lport, measureDERPWebSocketRTT)
+	cf.conn = &derpWSConn{lport: *cf.conn.(*lportForTCPConn), stable: stable}
+	return cf
+}
+
+func (d *derpWSConn) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.c != nil {
+		d.c.close()
+		d.c = nil
+	}
+	return d.lport.Close()
+}
+
+func (d *derpWSConn) Write([]byte) (int, error) {
+	return 0, errors.New("unimplemented")
+}
+
+func (d *derpWSConn) Read([]byte) (int, error) {
+	return 0, errors.New("unimplemented")
+}
+
+// derpWSClient is a DERP client connected over a WebSocket.
+type derpWSClient struct {
+	nc    net.Conn
+	c     *derp.Client
+	pongs chan derp.PongMessage // closed when the connection breaks
+}
+
+func (w *derpWSClient) close() {
+	w.nc.Close()
+}
+
+// client returns a DERP client connected over a WebSocket to the DERP node
+// hostname at dst, reusing the client of a stable conn if it is connected,
+// and whether it connected a new client.
+func (d *derpWSConn) client(ctx context.Context, hostname string, dst netip.AddrPort) (_ *derpWSClient, connected bool, _ error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.c != nil {
+		return d.c, false, nil
+	}
+	ws, _, err := dialDERPWebSocket(ctx, &d.lport, hostname, dst)
+	if err != nil {
+		return nil, false, err
+	}
+	nc := wsconn.NetConn(context.Background(), ws, websocket.MessageBinary, dst.String())
+	// The DERP handshake reads the server's key, which must arrive within
+	// ctx.
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+	c, err := derp.NewClient(key.NewNode(), nc, brw, logger.Discard, derp.IsProber(true))
+	if err != nil {
+		nc.Close()
+		return nil, false, err
+	}
+	nc.SetDeadline(time.Time{})
+	w := &derpWSClient{nc: nc, c: c, pongs: make(chan derp.PongMessage, 1)}
+	// The loop ends when the connection breaks or is closed; the client is
+	// not reconnected.
+	go func() {
+		defer close(w.pongs)
+		for {
+			m, err := c.Recv()
+			if err != nil {
+				return
+			}
+			if pong, ok := m.(derp.PongMessage); ok {
+				select {
+				case w.pongs <- pong:
+				default:
+				}
+			}
+		}
+	}()
+	if d.stable {
+		d.c = w
+	}
+	return w, true, nil
+}
+
+// drop closes w and, if it is the client of a stable conn, forgets it, so
+// that the next measurement reconnects.
+func (d *derpWSConn) drop(w *derpWSClient) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.c == w {
+		d.c = nil
+	}
+	w.close()
+}
+
+// ping sends a DERP ping frame and waits for its pong, returning the RTT.
+func (w *derpWSClient) ping(ctx context.Context) (time.Duration, error) {
+	var data [8]byte
+	rand.Read(data[:])
+	start := time.Now()
+	if err := w.c.SendPing(data); err != nil {
+		return 0, err
+	}
+	for {
+		select {
+		case pong, ok := <-w.pongs:
+			if !ok {
+				return 0, errors.New("connection closed")
+			}
+			if pong == data {
+				return time.Since(start), nil
+			}
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// measureDERPWebSocketRTT measures the RTT of a DERP ping frame over a
+// WebSocket to the DERP node at dst, i.e. the keepalive RTT of clients
+// falling back to DERP over WebSocket. Like measureDERPRTT, it connects first
+// if conn holds no connected client, excluding it from the RTT.
+func measureDERPWebSocketRTT(ctx context.Context, conn io.ReadWriteCloser, hostname string, dst netip.AddrPort) (m measurement, err error) {
+	d, ok := conn.(*derpWSConn)
+	if !ok {
+		return measurement{}, fmt.Errorf("unexpected conn type: %T", conn)
+	}
+	// 5s mirrors the maximum wait of derphttp.Client.Ping.
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	w, connected, err := d.client(ctx, hostname, dst)
+	if err != nil {
+		return measurement{}, tempError{err}
+	}
+	if !d.stable {
+		defer w.close()
+	}
+	rtt, err := w.ping(ctx)
+	if err != nil {
+		d.drop(w)
+		return measurement{}, tempError{err}
+	}
+	return measurement{rtt: rtt, instance: "key=" + w.c.ServerPublicKey().ShortString(), first: bool(d.stable) && connected}, nil
+}
@@ -0,0 +1,74 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/coder/websocket"
+	"tailscale.com/derp"
+	"tailscale.com/net/wsconn"
+	"tailscale.com/types/key"
+)
+
+func TestMeasureDERPWebSocketRTT(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As cmd/derper serves DERP over WebSocket.
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{derpWSSubprotocol}})
+		if err != nil {
+			return
+		}
+		defer c.CloseNow()
+		wc := wsconn.NetConn(r.Context(), c, websocket.MessageBinary, r.RemoteAddr)
+		brw := bufio.NewReadWriter(bufio.NewReader(wc), bufio.NewWriter(wc))
+		s.Accept(r.Context(), wc, brw, r.RemoteAddr)
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+	derpScheme = "http"
+	defer func() { derpScheme = "https" }()
+	dst := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), ln.Addr().(*net.TCPAddr).AddrPort().Port())
+	// Resolve the hostname in URLs to the server.
+	hostname := dst.String()
+	wantInstance := "key=" + s.PublicKey().ShortString()
+
+	for _, stable := range []connStability{unstableConn, stableConn} {
+		cf := newDERPWebSocketConnAndMeasureFn(stable, 0)
+		for range 2 {
+			m, err := cf.fn(context.Background(), cf.conn, hostname, dst)
+			if err != nil {
+				t.Fatalf("stable=%v: %v", stable, err)
+			}
+			if m.rtt <= 0 || m.instance != wantInstance {
+				t.Errorf("stable=%v: got %+v", stable, m)
+			}
+		}
+		d := cf.conn.(*derpWSConn)
+		if connected := d.c != nil; connected != bool(stable) {
+			t.Errorf("stable=%v: client kept connected = %v", stable, connected)
+		}
+		cf.conn.Close()
+
+		cf = newLportConnAndMeasureFn(stable, 0, measureDERPWebSocketUpgradeRTT)
+		m, err := cf.fn(context.Background(), cf.conn, hostname, dst)
+		if err != nil {
+			t.Fatalf("stable=%v: upgrade: %v", stable, err)
+		}
+		if m.rtt <= 0 {
+			t.Errorf("stable=%v: upgrade: got %+v", stable, m)
+		}
+		cf.conn.Close()
+	}
+}
@@ -0,0 +1,506 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"math"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// digestWindow is the aggregation window of latency digests.
+	digestWindow = time.Hour
+	// digestAccuracy is the relative accuracy of RTT quantiles estimated
+	// from latency digests.
+	digestAccuracy = 0.01
+	// digestBackfillDays is how many days before today digests are
+	// backfilled from results for on opening a store for writing, e.g.
+	// for the windows that were open when the last writer crashed.
+	digestBackfillDays = 1
+
+	digestsFilePrefix = "digests-"
+)
+
+var digestLogGamma = math.Log((1 + digestAccuracy) / (1 - digestAccuracy))
+
+// latencyDigest is a mergeable summary of the RTTs of a series, from which
+// any quantile can be estimated to within digestAccuracy of the true RTT,
+// in the manner of DDSketch: RTTs are counted in buckets whose bounds grow
+// geometrically, so a digest of RTTs between 1µs and 10s holds at most some
+// 800 buckets however many RTTs it summarizes.
+type latencyDigest struct {
+	// Buckets holds the number of RTTs in each bucket by index; bucket i
+	// holds RTTs in (γ^(i-1), γ^i] nanoseconds.
+	Buckets  map[int]uint64
+	Count    uint64 // of successful RTTs
+	Failures uint64
+	MinNanos int64 `json:",omitempty"`
+	MaxNanos int64 `json:",omitempty"`
+}
+
+func newLatencyDigest() *latencyDigest {
+	return &latencyDigest{Buckets: make(map[int]uint64)}
+}
+
+// add accounts an RTT, or a failure if rttNanos is nil.
+func (d *latencyDigest) add(rttNanos *int64) {
+	if rttNanos == nil {
+		d.Failures++
+		return
+	}
+	v := max(*rttNanos, 1)
+	d.Buckets[int(math.Ceil(math.Log(float64(v))/digestLogGamma))]++
+	if d.Count == 0 || v < d.MinNanos {
+		d.MinNanos = v
+	}
+	if d.Count == 0 || v > d.MaxNanos {
+		d.MaxNanos = v
+	}
+	d.Count++
+}
+
+// merge accounts every RTT and failure of o.
+func (d *latencyDigest) merge(o *latencyDigest) {
+	for i, n := range o.Buckets {
+		d.Buckets[i] += n
+	}
+	if o.Count > 0 {
+		if d.Count == 0 || o.MinNanos < d.MinNanos {
+			d.MinNanos = o.MinNanos
+		}
+		if d.Count == 0 || o.MaxNanos > d.MaxNanos {
+			d.MaxNanos = o.MaxNanos
+		}
+	}
+	d.Count += o.Count
+	d.Failures += o.Failures
+}
+
+// quantile returns an estimate of the q-quantile of the RTTs, with q in
+// [0, 1], or false if the digest holds none.
+func (d *latencyDigest) quantile(q float64) (time.Duration, bool) {
+	if d.Count == 0 {
+		return 0, false
+	}
+	rank := uint64(q * float64(d.Count-1))
+	var seen uint64
+	for _, i := range slices.Sorted(maps.Keys(d.Buckets)) {
+		seen += d.Buckets[i]
+		if seen > rank {
+			// The midpoint of the bucket in relative terms.
+			v := int64(2 * math.Exp(float64(i)*digestLogGamma) / (1 + math.Exp(digestLogGamma)))
+			return time.Duration(min(max(v, d.MinNanos), d.MaxNanos)), true
+		}
+	}
+	return time.Duration(d.MaxNanos), true
+}
+
+// digestSeries identifies the series a latencyDigest summarizes: a result
+// less its time, instance, and measurements.
+type digestSeries struct {
+	RegionID        int
+	RegionCode      string
+	Hostname        string
+	Addr            netip.Addr
+	Protocol        protocol
+	DstPort         int
+	TimestampSource string
+	StableConn      bool
+	Proxy           string `json:",omitempty"`
+	Xlat            string `json:",omitempty"`
+	Netns           string `json:",omitempty"`
+}
+
+func digestSeriesOf(sr storedResult) digestSeries {
+	return digestSeries{
+		RegionID:        sr.RegionID,
+		RegionCode:      sr.RegionCode,
+		Hostname:        sr.Hostname,
+		Addr:            sr.Addr,
+		Protocol:        sr.Protocol,
+		DstPort:         sr.DstPort,
+		TimestampSource: sr.TimestampSource,
+		StableConn:      sr.StableConn,
+		Proxy:           sr.Proxy,
+		Xlat:            sr.Xlat,
+		Netns:           sr.Netns,
+	}
+}
+
+func compareDigestSeries(a, b digestSeries) int {
+	return cmp.Or(
+		cmp.Compare(a.RegionID, b.RegionID),
+		cmp.Compare(a.Hostname, b.Hostname),
+		a.Addr.Compare(b.Addr),
+		cmp.Compare(a.Protocol, b.Protocol),
+		cmp.Compare(a.DstPort, b.DstPort),
+		cmp.Compare(a.TimestampSource, b.TimestampSource),
+		compareBool(a.StableConn, b.StableConn),
+		cmp.Compare(a.Proxy, b.Proxy),
+		cmp.Compare(a.Xlat, b.Xlat),
+		cmp.Compare(a.Netns, b.Netns),
+	)
+}
+
+// storedDigest is the on-disk representation of the digest of a series over
+// a window. A window may have several storedDigests for a series, e.g. for
+// results stored after it was first flushed, which are merged on reading.
+type storedDigest struct {
+	Start  time.Time
+	Series digestSeries
+	Digest *latencyDigest
+}
+
+func digestsFileName(day string) string {
+	return digestsFilePrefix + day + resultsFileSuffix
+}
+
+// digestWindows holds the digests of the windows a writer of a store is
+// adding results to, until they are flushed to the digests files of the
+// store, one per UTC day of window starts, when results of a later window
+// are added. It is guarded by the mutex of its store.
+type digestWindows struct {
+	dir    string
+	open   map[time.Time]map[digestSeries]*latencyDigest
+	latest time.Time // start of the latest window added to
+}
+
+func newDigestWindows(dir string) *digestWindows {
+	return &digestWindows{dir: dir, open: make(map[time.Time]map[digestSeries]*latencyDigest)}
+}
+
+func (w *digestWindows) add(sr storedResult) {
+	start := sr.At.UTC().Truncate(digestWindow)
+	series := w.open[start]
+	if series == nil {
+		series = make(map[digestSeries]*latencyDigest)
+		w.open[start] = series
+	}
+	k := digestSeriesOf(sr)
+	d := series[k]
+	if d == nil {
+		d = newLatencyDigest()
+		series[k] = d
+	}
+	d.add(sr.RTTNanos)
+	if start.After(w.latest) {
+		w.latest = start
+	}
+}
+
+// flush writes the digests of the windows that started before w.latest,
+// i.e. that results are no longer expected for, or of all windows if all,
+// and forgets them.
+func (w *digestWindows) flush(all bool) error {
+	byDay := make(map[string][]byte)
+	for start, series := range w.open {
+		if !all && !start.Before(w.latest) {
+			continue
+		}
+		day := start.Format(storeDayLayout)
+		for k, d := range series {
+			b, err := json.Marshal(storedDigest{Start: start, Series: k, Digest: d})
+			if err != nil {
+				return err
+			}
+			byDay[day] = append(append(byDay[day], b...), '\n')
+		}
+	}
+	var errs []error
+	for day, buf := range byDay {
+		errs = append(errs, appendFile(filepath.Join(w.dir, digestsFileName(day)), buf))
+	}
+	// Windows are forgotten even if flushing failed, so that one bad disk
+	// write neither grows memory without bound nor duplicates digests on
+	// retry; queries fall back to results for windows without digests.
+	for start := range w.open {
+		if all || start.Before(w.latest) {
+			delete(w.open, start)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func appendFile(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	return errors.Join(err, f.Close())
+}
+
+// readDigests calls fn for every digest stored for windows starting on day.
+func (s *resultsStore) readDigests(day string, fn func(storedDigest)) error {
+	f, err := os.Open(filepath.Join(s.dir, digestsFileName(day)))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var sd storedDigest
+		if err := json.Unmarshal(scanner.Bytes(), &sd); err != nil || sd.Digest == nil {
+			continue
+		}
+		if sd.Digest.Buckets == nil {
+			sd.Digest.Buckets = make(map[int]uint64)
+		}
+		fn(sd)
+	}
+	return scanner.Err()
+}
+
+// backfillDigestsLocked adds the results of the windows of the last
+// digestBackfillDays days and today that have no digests to the open
+// windows, flushing those that have ended, so that digests cover the
+// results stored before the store was opened by this process, e.g. by a
+// writer that crashed or predates digests.
+func (s *resultsStore) backfillDigestsLocked(now time.Time) error {
+	days, err := s.resultsFileDays()
+	if err != nil {
+		return err
+	}
+	since := now.UTC().AddDate(0, 0, -digestBackfillDays).Format(storeDayLayout)
+	for _, day := range days {
+		if day < since {
+			continue
+		}
+		covered := make(map[time.Time]bool)
+		if err := s.readDigests(day, func(sd storedDigest) { covered[sd.Start] = true }); err != nil {
+			return err
+		}
+		if err := s.readDay(day, func(sr storedResult) error {
+			if !covered[sr.At.UTC().Truncate(digestWindow)] {
+				s.digests.add(sr)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	if current := now.UTC().Truncate(digestWindow); current.After(s.digests.latest) {
+		s.digests.latest = current
+	}
+	return s.digests.flush(false)
+}
+
+// rebuildDigestsLocked rewrites the digests of day from its results, after
+// they were rewritten by maintenance, superseding its open windows.
+func (s *resultsStore) rebuildDigestsLocked(day string) error {
+	if s.digests != nil {
+		for start := range s.digests.open {
+			if start.Format(storeDayLayout) == day {
+				delete(s.digests.open, start)
+			}
+		}
+	}
+	w := newDigestWindows(s.dir)
+	if err := s.readDay(day, func(sr storedResult) error {
+		w.add(sr)
+		return nil
+	}); err != nil {
+		return err
+	}
+	var buf []byte
+	for start, series := range w.open {
+		for k, d := range series {
+			b, err := json.Marshal(storedDigest{Start: start, Series: k, Digest: d})
+			if err != nil {
+				return err
+			}
+			buf = append(append(buf, b...), '\n')
+		}
+	}
+	return writeFileAtomic(filepath.Join(s.dir, digestsFileName(day)), buf)
+}
+
+// digestRange returns the digests of the RTTs of the series matching match
+// over [from, to). Windows wholly within the range are merged from their
+// stored digests, and the open windows of this process if it is the writer;
+// results are only read at the edges of the range and for windows without
+// digests, e.g. predating them, or held by the ring layout.
+func (s *resultsStore) digestRange(from, to time.Time, match func(digestSeries) bool) (map[digestSeries]*latencyDigest, error) {
+	ret := make(map[digestSeries]*latencyDigest)
+	mergeInto := func(k digestSeries, d *latencyDigest) {
+		if !match(k) {
+			return
+		}
+		if ret[k] == nil {
+			ret[k] = newLatencyDigest()
+		}
+		ret[k].merge(d)
+	}
+	from, to = from.UTC(), to.UTC()
+	first := from.Truncate(digestWindow)
+	if first.Before(from) {
+		first = first.Add(digestWindow)
+	}
+	last := to.Truncate(digestWindow)
+
+	covered := make(map[time.Time]bool)
+	if s.ring == nil && s.shards == nil && first.Before(last) {
+		// The writer is held off while digests are read, lest it flush a
+		// window between the files being read and its open windows.
+		s.mu.Lock()
+		for day := first.Truncate(24 * time.Hour); day.Before(last); day = day.AddDate(0, 0, 1) {
+			if err := s.readDigests(day.Format(storeDayLayout), func(sd storedDigest) {
+				if sd.Start.Before(first) || !sd.Start.Before(last) {
+					return
+				}
+				covered[sd.Start] = true
+				mergeInto(sd.Series, sd.Digest)
+			}); err != nil {
+				s.mu.Unlock()
+				return nil, err
+			}
+		}
+		if s.digests != nil {
+			for start, series := range s.digests.open {
+				if start.Before(first) || !start.Before(last) {
+					continue
+				}
+				covered[start] = true
+				for k, d := range series {
+					mergeInto(k, d)
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	// Read results for the uncovered parts of the range, a day at a time.
+	needsResults := func(t time.Time) bool {
+		start := t.Truncate(digestWindow)
+		return start.Before(first) || !start.Before(last) || !covered[start]
+	}
+	for day := from.Truncate(24 * time.Hour); day.Before(to); day = day.AddDate(0, 0, 1) {
+		dayFrom, dayTo := day, day.AddDate(0, 0, 1)
+		if dayFrom.Before(from) {
+			dayFrom = from
+		}
+		if dayTo.After(to) {
+			dayTo = to
+		}
+		needed := false
+		for t := dayFrom.Truncate(digestWindow); t.Before(dayTo); t = t.Add(digestWindow) {
+			if needsResults(t) {
+				needed = true
+				break
+			}
+		}
+		if !needed {
+			continue
+		}
+		err := s.readRange(dayFrom, dayTo, func(sr storedResult) error {
+			if !needsResults(sr.At.UTC()) {
+				return nil
+			}
+			d := newLatencyDigest()
+			d.add(sr.RTTNanos)
+			mergeInto(digestSeriesOf(sr), d)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+const defaultPercentilesQueryRange = 24 * time.Hour
+
+var defaultPercentiles = []float64{50, 90, 99}
+
+// parsePercentiles parses a comma-separated list of percentiles in (0, 100].
+func parsePercentiles(v string) ([]float64, error) {
+	var ps []float64
+	for _, f := range strings.Split(v, ",") {
+		p, err := strconv.ParseFloat(f, 64)
+		if err != nil || !(p > 0 && p <= 100) {
+			return nil, fmt.Errorf("invalid percentile %q", f)
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// percentilesRow is the RTT percentiles of a series over a time range.
+type percentilesRow struct {
+	digestSeries
+	Count    uint64
+	Failures uint64
+	// PercentilesNanos maps percentiles, e.g. "p99", to RTTs. It is empty
+	// if all probes of the series failed.
+	PercentilesNanos map[string]int64
+}
+
+// servePercentiles serves estimates of the RTT percentiles of every series
+// over a time range as a JSON array, computed from latency digests so that
+// long ranges are cheap to query. Query parameters:
+//
+//   - from, to: RFC 3339 time range, defaulting to the last 24 hours
+//   - hostname, region_code, protocol: optional exact match filters
+//   - percentiles: comma-separated percentiles, defaulting to 50,90,99
+func (s *httpServer) servePercentiles(w http.ResponseWriter, r *http.Request) {
+	if s.store == nil {
+		http.Error(w, "results are not being persisted", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	from, to, err := parseTimeRange(q, defaultPercentilesQueryRange)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ps := defaultPercentiles
+	if v := q.Get("percentiles"); v != "" {
+		if ps, err = parsePercentiles(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	hostname, regionCode, proto := q.Get("hostname"), q.Get("region_code"), protocol(q.Get("protocol"))
+	digests, err := s.store.digestRange(from, to, func(k digestSeries) bool {
+		return (hostname == "" || k.Hostname == hostname) &&
+			(regionCode == "" || k.RegionCode == regionCode) &&
+			(proto == "" || k.Protocol == proto)
+	})
+	if err != nil {
+		apiLog.Error("error computing percentiles", "err", err)
+		http.Error(w, "error reading store", http.StatusInternalServerError)
+		return
+	}
+	rows := []percentilesRow{}
+	for _, k := range slices.SortedFunc(maps.Keys(digests), compareDigestSeries) {
+		d := digests[k]
+		row := percentilesRow{digestSeries: k, Count: d.Count, Failures: d.Failures, PercentilesNanos: make(map[string]int64)}
+		for _, p := range ps {
+			if v, ok := d.quantile(p / 100); ok {
+				row.PercentilesNanos["p"+strconv.FormatFloat(p, 'f', -1, 64)] = v.Nanoseconds()
+			}
+		}
+		rows = append(rows, row)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rows)
+}
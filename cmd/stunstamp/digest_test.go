@@ -0,0 +1,242 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand/v2"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLatencyDigest(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	var rtts []int64
+	all, a, b := newLatencyDigest(), newLatencyDigest(), newLatencyDigest()
+	for i := range 10000 {
+		rtt := int64(math.Exp(rng.NormFloat64()*0.5) * float64(20*time.Millisecond))
+		rtts = append(rtts, rtt)
+		all.add(&rtt)
+		if i%2 == 0 {
+			a.add(&rtt)
+		} else {
+			b.add(&rtt)
+		}
+	}
+	all.add(nil)
+	b.add(nil)
+	slices.Sort(rtts)
+	a.merge(b)
+	for _, q := range []float64{0, 0.5, 0.9, 0.99, 0.999, 1} {
+		want := float64(rtts[int(q*float64(len(rtts)-1))])
+		got, ok := all.quantile(q)
+		if !ok {
+			t.Fatalf("q%v: got no estimate", q)
+		}
+		if relErr := math.Abs(float64(got)-want) / want; relErr > digestAccuracy {
+			t.Errorf("q%v: got %v, want %v within %v, off by %.4f", q, got, time.Duration(want), digestAccuracy, relErr)
+		}
+		if merged, _ := a.quantile(q); merged != got {
+			t.Errorf("q%v: got %v from merged digests, want %v", q, merged, got)
+		}
+	}
+	if all.Count != 10000 || all.Failures != 1 || a.Count != 10000 || a.Failures != 1 {
+		t.Errorf("got counts %d/%d and merged %d/%d, want 10000/1", all.Count, all.Failures, a.Count, a.Failures)
+	}
+	if _, ok := newLatencyDigest().quantile(0.5); ok {
+		t.Error("got estimate from empty digest")
+	}
+}
+
+// rawDigests returns the digests of the results of s over [from, to), read
+// from results alone.
+func rawDigests(t *testing.T, s *resultsStore, from, to time.Time) map[digestSeries]*latencyDigest {
+	t.Helper()
+	ret := make(map[digestSeries]*latencyDigest)
+	if err := s.readRange(from, to, func(sr storedResult) error {
+		k := digestSeriesOf(sr)
+		if ret[k] == nil {
+			ret[k] = newLatencyDigest()
+		}
+		ret[k].add(sr.RTTNanos)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func checkDigests(t *testing.T, name string, got, want map[digestSeries]*latencyDigest) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d series, want %d", name, len(got), len(want))
+	}
+	for k, w := range want {
+		g := got[k]
+		if g == nil || g.Count != w.Count || g.Failures != w.Failures {
+			t.Errorf("%s: %s: got %+v, want %+v", name, k.Hostname, g, w)
+			continue
+		}
+		for _, q := range []float64{0.5, 0.99} {
+			if gq, _ := g.quantile(q); gq != must(w.quantile(q)) {
+				t.Errorf("%s: %s: got q%v %v, want %v", name, k.Hostname, q, gq, must(w.quantile(q)))
+			}
+		}
+	}
+}
+
+func must(d time.Duration, _ bool) time.Duration { return d }
+
+// writeHourlyResults appends ten results of each of two targets to w for each
+// of hours hours from start, one of which fails.
+func writeHourlyResults(t *testing.T, w *resultsStore, start time.Time, hours int) {
+	t.Helper()
+	for h := range hours {
+		var results []result
+		for i := range 10 {
+			for _, hostname := range []string{"1a", "1b"} {
+				rtt := time.Duration(h+1)*time.Millisecond + time.Duration(i)*time.Microsecond
+				r := result{
+					key: resultKey{
+						meta:     nodeMeta{regionID: 1, regionCode: "nyc", hostname: hostname, addr: netip.MustParseAddr("192.0.2.1")},
+						protocol: protocolSTUN,
+						dstPort:  3478,
+					},
+					at:  start.Add(time.Duration(h)*time.Hour + time.Duration(i)*time.Minute),
+					rtt: &rtt,
+				}
+				if i == 9 {
+					r.rtt = nil
+				}
+				results = append(results, r)
+			}
+		}
+		if err := w.append(results); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResultsStoreDigests(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openResultsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().UTC().Truncate(time.Hour).Add(-5 * time.Hour)
+	end := start.Add(6 * time.Hour)
+	writeHourlyResults(t, w, start, 6)
+	ro, err := openResultsStoreReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct{ from, to time.Time }{
+		{start, end},
+		{start.Add(30 * time.Minute), end.Add(-30 * time.Minute)},
+		{start.Add(10 * time.Minute), start.Add(20 * time.Minute)},
+	} {
+		want := rawDigests(t, ro, r.from, r.to)
+		for name, s := range map[string]*resultsStore{"writer": w, "reader": ro} {
+			got, err := s.digestRange(r.from, r.to, func(digestSeries) bool { return true })
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkDigests(t, name, got, want)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Whole windows are read from digests alone.
+	want := rawDigests(t, ro, start, end)
+	days, err := ro.resultsFileDays()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, day := range days {
+		if err := os.Rename(filepath.Join(dir, resultsFileName(day)), filepath.Join(dir, resultsFileName(day)+".bak")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := ro.digestRange(start, end, func(k digestSeries) bool { return k.Hostname == "1a" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range want {
+		if k.Hostname != "1a" {
+			delete(want, k)
+		}
+	}
+	checkDigests(t, "digests only", got, want)
+
+	// Digests are backfilled from results on opening for writing.
+	for _, day := range days {
+		if err := os.Rename(filepath.Join(dir, resultsFileName(day)+".bak"), filepath.Join(dir, resultsFileName(day))); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(filepath.Join(dir, digestsFileName(day))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err = openResultsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.close()
+	var n int
+	for _, day := range days {
+		if err := ro.readDigests(day, func(storedDigest) { n++ }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n != 12 {
+		t.Errorf("got %d digests backfilled, want 12", n)
+	}
+	got, err = ro.digestRange(start, end, func(digestSeries) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDigests(t, "backfilled", got, rawDigests(t, ro, start, end))
+}
+
+func TestPercentilesAPI(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openResultsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+	start := time.Now().UTC().Truncate(time.Hour).Add(-2 * time.Hour)
+	writeHourlyResults(t, w, start, 3)
+	mux := (&httpServer{store: w}).mux()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/percentiles?hostname=1a&percentiles=50,99.9", nil))
+	if rec.Code != 200 {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var rows []percentilesRow
+	if err := json.Unmarshal(rec.Body.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Hostname != "1a" || rows[0].Count != 27 || rows[0].Failures != 3 {
+		t.Fatalf("got %+v, want one row of 1a with 27 RTTs and 3 failures", rows)
+	}
+	if p := rows[0].PercentilesNanos; p["p50"] < int64(time.Millisecond) || p["p99.9"] < p["p50"] || len(p) != 2 {
+		t.Errorf("got percentiles %v", p)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/percentiles?percentiles=0", nil))
+	if rec.Code != 400 {
+		t.Errorf("got status %d for invalid percentile, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,456 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// This file implements probes of DNS resolvers over plain DNS, DNS-over-TLS
+// (RFC 7858), and DNS-over-QUIC (RFC 9250), recording the latency of
+// establishing a session separately from that of a query over it, to guide
+// which encrypted DNS transport to configure for clients behind the CGNAT.
+
+// dnsTransport is the transport of DNS queries to a resolver.
+type dnsTransport string
+
+const (
+	dnsTransportUDP  dnsTransport = "udp"
+	dnsTransportTLS  dnsTransport = "tls"
+	dnsTransportQUIC dnsTransport = "quic"
+)
+
+// dnsDefaultPorts are the default ports of transports.
+var dnsDefaultPorts = map[dnsTransport]string{
+	dnsTransportUDP:  "53",
+	dnsTransportTLS:  "853",
+	dnsTransportQUIC: "853",
+}
+
+// dnsQUICALPN is the ALPN token of DNS-over-QUIC, RFC 9250 section 4.1.1.
+const dnsQUICALPN = "doq"
+
+// dnsPhase is a step of a DNS probe that we measure independently.
+type dnsPhase string
+
+const (
+	// dnsPhaseSession is the establishment of a session with the resolver:
+	// the TCP and TLS handshakes for DNS-over-TLS, and the QUIC handshake
+	// for DNS-over-QUIC. Plain DNS over UDP has none.
+	dnsPhaseSession dnsPhase = "session"
+	// dnsPhaseQuery is the time from sending a query over an established
+	// session until its response.
+	dnsPhaseQuery dnsPhase = "query"
+)
+
+var dnsPhases = []dnsPhase{dnsPhaseSession, dnsPhaseQuery}
+
+const (
+	dnsRTTMetricName      = "stunstamp_dns_rtt_ns"
+	dnsTimeoutsMetricName = "stunstamp_dns_timeouts_total"
+	// dnsProbeTimeout bounds a single DNS probe.
+	dnsProbeTimeout = 5 * time.Second
+)
+
+// dnsResolver is a resolver probed by --dns-resolvers.
+type dnsResolver struct {
+	transport dnsTransport
+	hostPort  string
+	// serverName is the TLS server name of DNS-over-TLS and DNS-over-QUIC
+	// resolvers.
+	serverName string
+}
+
+// String returns r in the form of --dns-resolvers, with the port explicit.
+func (r dnsResolver) String() string {
+	s := string(r.transport) + "://" + r.hostPort
+	if host, _, _ := net.SplitHostPort(r.hostPort); r.serverName != "" && r.serverName != host {
+		s += "#" + r.serverName
+	}
+	return s
+}
+
+// parseDNSResolvers parses a comma-separated list of resolvers in the form
+// transport://host[:port][#servername], transport being udp, tls, or quic,
+// and servername overriding the TLS server name, host by default.
+func parseDNSResolvers(s string) ([]dnsResolver, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	var ret []dnsResolver
+	for _, v := range strings.Split(s, ",") {
+		u, err := url.Parse(v)
+		if err != nil || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("invalid DNS resolver %q, want transport://host[:port]", v)
+		}
+		transport := dnsTransport(u.Scheme)
+		port, ok := dnsDefaultPorts[transport]
+		if !ok {
+			return nil, fmt.Errorf("DNS resolver %q: unknown transport %q, want udp, tls, or quic", v, u.Scheme)
+		}
+		r := dnsResolver{
+			transport: transport,
+			hostPort:  net.JoinHostPort(u.Hostname(), cmp.Or(u.Port(), port)),
+		}
+		if transport != dnsTransportUDP {
+			r.serverName = cmp.Or(u.Fragment, u.Hostname())
+		} else if u.Fragment != "" {
+			return nil, fmt.Errorf("DNS resolver %q: server name of a plain DNS resolver", v)
+		}
+		ret = append(ret, r)
+	}
+	slices.SortFunc(ret, func(a, b dnsResolver) int {
+		return cmp.Compare(a.String(), b.String())
+	})
+	return slices.Compact(ret), nil
+}
+
+// dnsResult is the measurement of a resolver. A nil rtts signifies failure.
+type dnsResult struct {
+	resolver dnsResolver
+	addr     netip.Addr
+	at       time.Time
+	rtts     map[dnsPhase]time.Duration
+}
+
+// dnsRootCAs are the roots DNS-over-TLS and DNS-over-QUIC resolvers are
+// verified against, or nil for the system's. Tests override it.
+var dnsRootCAs *x509.CertPool
+
+// dnsQuery returns a recursive query of the A records of name, and its ID.
+func dnsQuery(name string) ([]byte, uint16, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	var idb [2]byte
+	rand.Read(idb[:])
+	id := binary.BigEndian.Uint16(idb[:])
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: n, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, err
+	}
+	msg, err := b.Finish()
+	return msg, id, err
+}
+
+// errUnexpectedDNSMessage is returned for messages that are not a response
+// to our query, e.g. late responses to a previous one.
+var errUnexpectedDNSMessage = errors.New("unexpected message")
+
+// checkDNSResponse validates a response to the query with id. Responses
+// that the name does not exist are successful; the resolver answered.
+func checkDNSResponse(b []byte, id uint16) error {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		return err
+	}
+	if !h.Response || h.ID != id {
+		return errUnexpectedDNSMessage
+	}
+	if h.RCode != dnsmessage.RCodeSuccess && h.RCode != dnsmessage.RCodeNameError {
+		return fmt.Errorf("response code %v", h.RCode)
+	}
+	return nil
+}
+
+// measureDNS queries resolver for the A records of name once.
+func measureDNS(ctx context.Context, resolver dnsResolver, name string) dnsResult {
+	r := dnsResult{resolver: resolver, at: time.Now()}
+	if err := measureDNSExchange(ctx, name, &r); err != nil {
+		probeLog.Warn("error measuring DNS resolver", "resolver", resolver, "addr", r.addr, "err", err)
+		r.rtts = nil
+	}
+	return r
+}
+
+func measureDNSExchange(ctx context.Context, name string, r *dnsResult) error {
+	ctx, cancel := context.WithTimeout(ctx, dnsProbeTimeout)
+	defer cancel()
+	host, port, _ := net.SplitHostPort(r.resolver.hostPort) // parsed
+	// Resolving a resolver given by name is not part of its latency.
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("no address for %s", host)
+	}
+	r.addr = addrs[0].Unmap()
+	dst := net.JoinHostPort(r.addr.String(), port)
+	query, id, err := dnsQuery(name)
+	if err != nil {
+		return err
+	}
+
+	if r.resolver.transport == dnsTransportQUIC {
+		return measureDNSOverQUIC(ctx, dst, query, r)
+	}
+	var d net.Dialer
+	if r.resolver.transport == dnsTransportUDP {
+		c, err := d.DialContext(ctx, "udp", dst)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		if err := c.SetDeadline(deadlineWithin(ctx, txRxTimeout)); err != nil {
+			return err
+		}
+		start := time.Now()
+		if _, err := c.Write(query); err != nil {
+			return err
+		}
+		b := make([]byte, 1232)
+		for {
+			n, err := c.Read(b)
+			rxAt := time.Now()
+			if err != nil {
+				return tempError{err}
+			}
+			if err := checkDNSResponse(b[:n], id); err != nil {
+				if errors.Is(err, errUnexpectedDNSMessage) {
+					continue
+				}
+				return err
+			}
+			r.rtts = map[dnsPhase]time.Duration{dnsPhaseQuery: rxAt.Sub(start)}
+			return nil
+		}
+	}
+
+	start := time.Now()
+	tcpConn, err := d.DialContext(ctx, "tcp", dst)
+	if err != nil {
+		return tempError{err}
+	}
+	defer tcpConn.Close()
+	c := tls.Client(tcpConn, &tls.Config{ServerName: r.resolver.serverName, RootCAs: dnsRootCAs})
+	if err := c.HandshakeContext(ctx); err != nil {
+		return tempError{err}
+	}
+	session := time.Since(start)
+	if err := c.SetDeadline(deadlineWithin(ctx, txRxTimeout)); err != nil {
+		return err
+	}
+	// Messages over TCP are prefixed with their length, RFC 1035 section
+	// 4.2.2.
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	msg = append(msg, query...)
+	start = time.Now()
+	if _, err := c.Write(msg); err != nil {
+		return tempError{err}
+	}
+	for {
+		var lb [2]byte
+		if _, err := io.ReadFull(c, lb[:]); err != nil {
+			return tempError{err}
+		}
+		b := make([]byte, binary.BigEndian.Uint16(lb[:]))
+		if _, err := io.ReadFull(c, b); err != nil {
+			return tempError{err}
+		}
+		rxAt := time.Now()
+		if err := checkDNSResponse(b, id); err != nil {
+			if errors.Is(err, errUnexpectedDNSMessage) {
+				continue
+			}
+			return err
+		}
+		r.rtts = map[dnsPhase]time.Duration{dnsPhaseSession: session, dnsPhaseQuery: rxAt.Sub(start)}
+		return nil
+	}
+}
+
+// measureDNSOverQUIC measures a DNS-over-QUIC exchange of query with the
+// resolver at dst, recording the QUIC handshake as the session.
+func measureDNSOverQUIC(ctx context.Context, dst string, query []byte, r *dnsResult) error {
+	// The ID of messages over QUIC is 0, RFC 9250 section 4.2.1.
+	binary.BigEndian.PutUint16(query, 0)
+	start := time.Now()
+	conn, err := quic.DialAddr(ctx, dst, &tls.Config{
+		ServerName: r.resolver.serverName,
+		RootCAs:    dnsRootCAs,
+		NextProtos: []string{dnsQUICALPN},
+	}, nil)
+	if err != nil {
+		return tempError{err}
+	}
+	// 0 is DOQ_NO_ERROR, RFC 9250 section 4.3.
+	defer conn.CloseWithError(0, "")
+	session := time.Since(start)
+
+	// Every query is sent on a stream of its own, whose write side the
+	// client closes after it, RFC 9250 section 4.2.
+	start = time.Now()
+	str, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return tempError{err}
+	}
+	if err := str.SetDeadline(deadlineWithin(ctx, txRxTimeout)); err != nil {
+		return err
+	}
+	// Messages are prefixed with their length as over TCP.
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	msg = append(msg, query...)
+	if _, err := str.Write(msg); err != nil {
+		return tempError{err}
+	}
+	if err := str.Close(); err != nil {
+		return tempError{err}
+	}
+	var lb [2]byte
+	if _, err := io.ReadFull(str, lb[:]); err != nil {
+		return tempError{err}
+	}
+	b := make([]byte, binary.BigEndian.Uint16(lb[:]))
+	if _, err := io.ReadFull(str, b); err != nil {
+		return tempError{err}
+	}
+	rxAt := time.Now()
+	if err := checkDNSResponse(b, 0); err != nil {
+		return err
+	}
+	r.rtts = map[dnsPhase]time.Duration{dnsPhaseSession: session, dnsPhaseQuery: rxAt.Sub(start)}
+	return nil
+}
+
+// measureAllDNS measures every resolver in resolvers concurrently.
+func measureAllDNS(ctx context.Context, resolvers []dnsResolver, name string) []dnsResult {
+	results := make([]dnsResult, len(resolvers))
+	var wg sync.WaitGroup
+	for i, resolver := range resolvers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = measureDNS(ctx, resolver, name)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// dnsTracker counts the failures of every resolver and tracks the
+// timeseries written. It is not safe for concurrent use.
+type dnsTracker struct {
+	timeouts map[dnsResolver]uint64
+}
+
+func newDNSTracker() *dnsTracker {
+	return &dnsTracker{timeouts: make(map[dnsResolver]uint64)}
+}
+
+func dnsTimeSeriesLabels(metricName string, resolver dnsResolver, phase dnsPhase, instance string) []prompb.Label {
+	labels := []prompb.Label{
+		{Name: "__name__", Value: metricName},
+		{Name: "job", Value: "stunstamp-rw"},
+		{Name: "instance", Value: instance},
+		{Name: "resolver", Value: resolver.String()},
+		{Name: "transport", Value: string(resolver.transport)},
+	}
+	if phase != "" {
+		labels = append(labels, prompb.Label{Name: "phase", Value: string(phase)})
+	}
+	slices.SortFunc(labels, func(a, b prompb.Label) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return labels
+}
+
+// dnsPhasesOf returns the phases measured of resolver.
+func dnsPhasesOf(resolver dnsResolver) []dnsPhase {
+	if resolver.transport == dnsTransportUDP {
+		return []dnsPhase{dnsPhaseQuery}
+	}
+	return dnsPhases
+}
+
+// update returns timeseries for results, counting failures, and stale
+// markers for the resolvers absent from results.
+func (t *dnsTracker) update(results []dnsResult, instance string) []prompb.TimeSeries {
+	var ts []prompb.TimeSeries
+	current := make(map[dnsResolver]bool)
+	for _, r := range results {
+		current[r.resolver] = true
+		if r.rtts == nil {
+			t.timeouts[r.resolver]++
+		} else if _, ok := t.timeouts[r.resolver]; !ok {
+			t.timeouts[r.resolver] = 0
+		}
+		for _, phase := range dnsPhasesOf(r.resolver) {
+			value := math.NaN()
+			if rtt, ok := r.rtts[phase]; ok {
+				value = float64(rtt)
+			}
+			ts = append(ts, prompb.TimeSeries{
+				Labels:  dnsTimeSeriesLabels(dnsRTTMetricName, r.resolver, phase, instance),
+				Samples: []prompb.Sample{{Timestamp: r.at.UnixMilli(), Value: value}},
+			})
+		}
+		ts = append(ts, prompb.TimeSeries{
+			Labels:  dnsTimeSeriesLabels(dnsTimeoutsMetricName, r.resolver, "", instance),
+			Samples: []prompb.Sample{{Timestamp: r.at.UnixMilli(), Value: float64(t.timeouts[r.resolver])}},
+		})
+	}
+	now := time.Now()
+	for resolver := range t.timeouts {
+		if !current[resolver] {
+			ts = append(ts, dnsStaleMarkers(resolver, instance, now)...)
+			delete(t.timeouts, resolver)
+		}
+	}
+	return ts
+}
+
+// staleMarkers returns stale markers for the series of every resolver
+// queried.
+func (t *dnsTracker) staleMarkers(instance string) []prompb.TimeSeries {
+	now := time.Now()
+	var ts []prompb.TimeSeries
+	for resolver := range t.timeouts {
+		ts = append(ts, dnsStaleMarkers(resolver, instance, now)...)
+	}
+	return ts
+}
+
+func dnsStaleMarkers(resolver dnsResolver, instance string, at time.Time) []prompb.TimeSeries {
+	samples := []prompb.Sample{{Timestamp: at.UnixMilli(), Value: math.Float64frombits(staleNaN)}}
+	ts := []prompb.TimeSeries{{
+		Labels:  dnsTimeSeriesLabels(dnsTimeoutsMetricName, resolver, "", instance),
+		Samples: samples,
+	}}
+	for _, phase := range dnsPhasesOf(resolver) {
+		ts = append(ts, prompb.TimeSeries{
+			Labels:  dnsTimeSeriesLabels(dnsRTTMetricName, resolver, phase, instance),
+			Samples: samples,
+		})
+	}
+	return ts
+}
@@ -0,0 +1,185 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseDNSResolvers(t *testing.T) {
+	got, err := parseDNSResolvers("tls://1.1.1.1,udp://9.9.9.9,tls://[2606:4700::1111]:8853#one.one.one.one,udp://9.9.9.9:53,quic://dns.adguard-dns.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var strs []string
+	for _, r := range got {
+		strs = append(strs, r.String())
+	}
+	if want := "quic://dns.adguard-dns.com:853,tls://1.1.1.1:853,tls://[2606:4700::1111]:8853#one.one.one.one,udp://9.9.9.9:53"; strings.Join(strs, ",") != want {
+		t.Errorf("got %v, want %s", strs, want)
+	}
+	if got[0].serverName != "dns.adguard-dns.com" || got[1].serverName != "1.1.1.1" || got[2].serverName != "one.one.one.one" {
+		t.Errorf("server names %q, %q, %q", got[0].serverName, got[1].serverName, got[2].serverName)
+	}
+	for _, bad := range []string{"1.1.1.1", "https://1.1.1.1/dns-query", "udp://9.9.9.9#dns.quad9.net", "tls://", "quic://"} {
+		if _, err := parseDNSResolvers(bad); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+// dnsTestResponse returns a response to query, answering with rcode.
+func dnsTestResponse(t *testing.T, query []byte, rcode dnsmessage.RCode) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		t.Error(err)
+		return nil
+	}
+	msg.Header.Response, msg.Header.RCode = true, rcode
+	b, err := msg.Pack()
+	if err != nil {
+		t.Error(err)
+	}
+	return b
+}
+
+func TestMeasureDNS(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(dnsTestResponse(t, b[:n], dnsmessage.RCodeNameError), addr)
+		}
+	}()
+
+	// DNS-over-TLS with the certificate of httptest, valid for 127.0.0.1.
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	srv.Close()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", srv.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var lb [2]byte
+				if _, err := io.ReadFull(c, lb[:]); err != nil {
+					return
+				}
+				q := make([]byte, binary.BigEndian.Uint16(lb[:]))
+				if _, err := io.ReadFull(c, q); err != nil {
+					return
+				}
+				resp := dnsTestResponse(t, q, dnsmessage.RCodeServerFailure)
+				if strings.Contains(string(q), "tailscale") {
+					resp = dnsTestResponse(t, q, dnsmessage.RCodeSuccess)
+				}
+				c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+			}()
+		}
+	}()
+
+	// DNS-over-QUIC with the same certificate.
+	quicConf := srv.TLS.Clone()
+	quicConf.NextProtos = []string{dnsQUICALPN}
+	ql, err := quic.ListenAddr("127.0.0.1:0", quicConf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ql.Close()
+	go func() {
+		for {
+			c, err := ql.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				str, err := c.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				// The client closes its side of the stream after the query.
+				b, err := io.ReadAll(str)
+				if err != nil || len(b) < 2 || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+					t.Errorf("invalid DoQ query %x: %v", b, err)
+					return
+				}
+				if id := binary.BigEndian.Uint16(b[2:]); id != 0 {
+					t.Errorf("DoQ query ID %d, want 0", id)
+				}
+				resp := dnsTestResponse(t, b[2:], dnsmessage.RCodeSuccess)
+				str.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+				str.Close()
+				// Closing the connection is up to the client, once it has
+				// read the response.
+				<-c.Context().Done()
+			}()
+		}
+	}()
+
+	dnsRootCAs = x509.NewCertPool()
+	dnsRootCAs.AddCert(srv.Certificate())
+	defer func() { dnsRootCAs = nil }()
+
+	resolvers, err := parseDNSResolvers("udp://" + pc.LocalAddr().String() + ",tls://" + ln.Addr().String() + ",quic://" + ql.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := measureAllDNS(context.Background(), resolvers, "tailscale.com")
+	quicResult, tlsResult, udpResult := results[0], results[1], results[2]
+	if r := udpResult.rtts; len(r) != 1 || r[dnsPhaseQuery] <= 0 {
+		t.Errorf("udp rtts = %v, want a query", r)
+	}
+	if r := tlsResult.rtts; len(r) != 2 || r[dnsPhaseSession] <= 0 || r[dnsPhaseQuery] <= 0 {
+		t.Errorf("tls rtts = %v, want a session and a query", r)
+	}
+	if r := quicResult.rtts; len(r) != 2 || r[dnsPhaseSession] <= 0 || r[dnsPhaseQuery] <= 0 {
+		t.Errorf("quic rtts = %v, want a session and a query", r)
+	}
+	// Resolvers failing to resolve fail.
+	if r := measureDNS(context.Background(), resolvers[1], "example.com"); r.rtts != nil {
+		t.Errorf("SERVFAIL succeeded: %v", r.rtts)
+	}
+
+	tr := newDNSTracker()
+	// Session and query of tls and quic, query of udp, and a timeouts
+	// counter each.
+	if ts := tr.update(results, "test"); len(ts) != 8 {
+		t.Errorf("got %d timeseries, want 8", len(ts))
+	}
+	ts := tr.update(nil, "test")
+	if len(ts) != 8 || math.Float64bits(ts[0].Samples[0].Value) != staleNaN {
+		t.Errorf("expected stale markers for removed resolvers, got %v", ts)
+	}
+	if len(tr.staleMarkers("test")) != 0 {
+		t.Error("removed resolvers still tracked")
+	}
+}
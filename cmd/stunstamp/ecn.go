@@ -0,0 +1,231 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	ecnRepliesMetricName = "stunstamp_derp_ecn_replies_total"
+	ecnPathMetricName    = "stunstamp_derp_ecn_path"
+)
+
+// eventKindECNPath is a change in how the path to and from a target treats
+// the ECT(1) codepoint probes are sent with, see ecnPathState.
+const eventKindECNPath eventKind = "ecn_path"
+
+// ecnCodepoint is the ECN codepoint of a received packet, see RFC 3168 and,
+// for the use of ECT(1) by L4S, RFC 9331. The zero value is unobserved.
+type ecnCodepoint uint8
+
+const (
+	ecnUnobserved ecnCodepoint = iota
+	ecnNotECT
+	ecnECT1
+	ecnECT0
+	ecnCE
+)
+
+// ecnFromTOS returns the ECN codepoint in the lower 2 bits of an IPv4 TOS or
+// IPv6 traffic class octet.
+func ecnFromTOS(tos byte) ecnCodepoint {
+	return ecnNotECT + ecnCodepoint(tos&0b11)
+}
+
+func (e ecnCodepoint) String() string {
+	switch e {
+	case ecnNotECT:
+		return "not_ect"
+	case ecnECT1:
+		return "ect1"
+	case ecnECT0:
+		return "ect0"
+	case ecnCE:
+		return "ce"
+	}
+	return ""
+}
+
+// ecnSent returns the ECN codepoint probes are sent with per --ecn-ect1.
+func ecnSent() ecnCodepoint {
+	if *flagECNECT1 {
+		return ecnECT1
+	}
+	return ecnNotECT
+}
+
+// ecnReflected reports whether replies of protocol p carry the ECN codepoint
+// of the probe they answer as received by the target, as ICMP echo replies
+// from Linux hosts do. STUN servers send replies with a codepoint of their
+// own.
+func ecnReflected(p protocol) bool {
+	return p == protocolICMP
+}
+
+// ecnPathState classifies the path to and from a target by the codepoint
+// received on a reply reflecting a probe sent with ECT(1):
+//
+//   - "preserved": ECT(1) arrived intact, so L4S marking is possible.
+//   - "ce_marked": an AQM on the path marked congestion, as an L4S one would.
+//   - "remarked": ECT(1) was rewritten to ECT(0), defeating L4S.
+//   - "bleached": ECN was cleared, e.g. by a middlebox zeroing the TOS octet.
+//
+// It returns the empty string if the path cannot be classified.
+func ecnPathState(sent, received ecnCodepoint) string {
+	if sent != ecnECT1 {
+		return ""
+	}
+	switch received {
+	case ecnECT1:
+		return "preserved"
+	case ecnCE:
+		return "ce_marked"
+	case ecnECT0:
+		return "remarked"
+	case ecnNotECT:
+		return "bleached"
+	}
+	return ""
+}
+
+// ecnKey identifies the count of replies with a codepoint for a result key.
+type ecnKey struct {
+	key       resultKey
+	codepoint ecnCodepoint
+}
+
+// ecnTracker counts the ECN codepoints received on replies, and tracks the
+// ecnPathState of every result key of a reflecting protocol in order to
+// detect changes. It is not safe for concurrent use.
+type ecnTracker struct {
+	replies map[ecnKey]uint64
+	paths   map[resultKey]string
+}
+
+func newECNTracker() *ecnTracker {
+	return &ecnTracker{
+		replies: make(map[ecnKey]uint64),
+		paths:   make(map[resultKey]string),
+	}
+}
+
+func ecnTimeSeriesLabels(metricName string, k resultKey, name, value, instance string) []prompb.Label {
+	labels := append(resultKeyLabels(metricName, k, instance), prompb.Label{
+		Name:  name,
+		Value: value,
+	})
+	slices.SortFunc(labels, func(a, b prompb.Label) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return labels
+}
+
+// update accounts the codepoints of results, which were probed with sent,
+// recording an event for every change in the ecnPathState of a result key.
+// It returns the reply counts of the result keys in results, and the path
+// states of those changed.
+func (t *ecnTracker) update(results []result, sent ecnCodepoint, instance string) []prompb.TimeSeries {
+	var ts []prompb.TimeSeries
+	written := make(map[resultKey]bool)
+	for _, r := range results {
+		if r.ecn == ecnUnobserved {
+			continue
+		}
+		t.replies[ecnKey{r.key, r.ecn}]++
+		if !written[r.key] {
+			written[r.key] = true
+			for cp := ecnNotECT; cp <= ecnCE; cp++ {
+				n, ok := t.replies[ecnKey{r.key, cp}]
+				if !ok {
+					continue
+				}
+				ts = append(ts, prompb.TimeSeries{
+					Labels:  ecnTimeSeriesLabels(ecnRepliesMetricName, r.key, "codepoint", cp.String(), instance),
+					Samples: []prompb.Sample{{Timestamp: r.at.UnixMilli(), Value: float64(n)}},
+				})
+			}
+		}
+		if !ecnReflected(r.key.protocol) {
+			continue
+		}
+		state := ecnPathState(sent, r.ecn)
+		prev, seen := t.paths[r.key]
+		if state == "" || state == prev {
+			continue
+		}
+		t.paths[r.key] = state
+		if seen {
+			ts = append(ts, prompb.TimeSeries{
+				Labels:  ecnTimeSeriesLabels(ecnPathMetricName, r.key, "state", prev, instance),
+				Samples: []prompb.Sample{{Timestamp: r.at.UnixMilli(), Value: math.Float64frombits(staleNaN)}},
+			})
+		}
+		ts = append(ts, prompb.TimeSeries{
+			Labels:  ecnTimeSeriesLabels(ecnPathMetricName, r.key, "state", state, instance),
+			Samples: []prompb.Sample{{Timestamp: r.at.UnixMilli(), Value: 1}},
+		})
+		if !seen {
+			continue
+		}
+		annotations.annotateAuto(r.at, r.at, r.key.meta.hostname, fmt.Sprintf("%s ECN path changed from %s to %s", r.key.protocol, prev, state))
+		events.record(event{
+			At:         r.at,
+			Kind:       eventKindECNPath,
+			Addr:       r.key.meta.addr,
+			RegionID:   r.key.meta.regionID,
+			RegionCode: r.key.meta.regionCode,
+			Hostname:   r.key.meta.hostname,
+			Protocol:   r.key.protocol,
+			Attrs: map[string]string{
+				"sent":     sent.String(),
+				"received": r.ecn.String(),
+				"previous": prev,
+				"current":  state,
+			},
+		})
+	}
+	return ts
+}
+
+// forget drops all state for keys not present in keep.
+func (t *ecnTracker) forget(keep func(resultKey) bool) {
+	for k := range t.replies {
+		if !keep(k.key) {
+			delete(t.replies, k)
+		}
+	}
+	for k := range t.paths {
+		if !keep(k) {
+			delete(t.paths, k)
+		}
+	}
+}
+
+// staleMarkers returns stale markers for the reply counts and path states
+// of every path classified.
+func (t *ecnTracker) staleMarkers(instance string) []prompb.TimeSeries {
+	now := time.Now()
+	samples := []prompb.Sample{{Timestamp: now.UnixMilli(), Value: math.Float64frombits(staleNaN)}}
+	var ts []prompb.TimeSeries
+	for k := range t.replies {
+		ts = append(ts, prompb.TimeSeries{
+			Labels:  ecnTimeSeriesLabels(ecnRepliesMetricName, k.key, "codepoint", k.codepoint.String(), instance),
+			Samples: samples,
+		})
+	}
+	for k, state := range t.paths {
+		ts = append(ts, prompb.TimeSeries{
+			Labels:  ecnTimeSeriesLabels(ecnPathMetricName, k, "state", state, instance),
+			Samples: samples,
+		})
+	}
+	return ts
+}
@@ -0,0 +1,55 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/sys/unix"
+)
+
+// enableECN enables receiving the TOS octet (IPv4) or traffic class (IPv6)
+// of datagrams on fd, and sets it to ecnSent() on those sent, per --ecn and
+// --ecn-ect1. IPv6 UDP sockets are dual-stack, so the IPv4 options are set on
+// them too.
+func enableECN(fd, domain int) error {
+	if !*flagECN {
+		return nil
+	}
+	tos := 0
+	if ecnSent() == ecnECT1 {
+		tos = 0b01
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVTOS, 1); err != nil && domain == unix.AF_INET {
+		return err
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, tos); err != nil && domain == unix.AF_INET {
+		return err
+	}
+	if domain != unix.AF_INET6 {
+		return nil
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, 1); err != nil {
+		return err
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+}
+
+// parseECNFromCmsgs returns the ECN codepoint of the IP_TOS or IPV6_TCLASS
+// control message in oob, if any.
+func parseECNFromCmsgs(oob []byte) ecnCodepoint {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return ecnUnobserved
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == unix.IPPROTO_IP && msg.Header.Type == unix.IP_TOS && len(msg.Data) >= 1:
+			return ecnFromTOS(msg.Data[0])
+		case msg.Header.Level == unix.IPPROTO_IPV6 && msg.Header.Type == unix.IPV6_TCLASS && len(msg.Data) >= 4:
+			return ecnFromTOS(byte(binary.NativeEndian.Uint32(msg.Data)))
+		}
+	}
+	return ecnUnobserved
+}
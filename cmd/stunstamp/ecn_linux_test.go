@@ -0,0 +1,52 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestEnableECN(t *testing.T) {
+	defer func(ecn, ect1 bool) { *flagECN, *flagECNECT1 = ecn, ect1 }(*flagECN, *flagECNECT1)
+	*flagECN, *flagECNECT1 = true, true
+
+	for _, tt := range []struct {
+		domain int
+		sa     unix.Sockaddr
+	}{
+		{unix.AF_INET, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}},
+		{unix.AF_INET6, &unix.SockaddrInet6{Addr: [16]byte{15: 1}}},
+		// IPv4 over a dual-stack socket, as probed by STUN.
+		{unix.AF_INET6, &unix.SockaddrInet6{Addr: [16]byte{10: 0xff, 11: 0xff, 12: 127, 15: 1}}},
+	} {
+		fd, err := unix.Socket(tt.domain, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Close(fd)
+		if err := enableECN(fd, tt.domain); err != nil {
+			t.Fatal(err)
+		}
+		if err := unix.Bind(fd, tt.sa); err != nil {
+			t.Skipf("bind %v: %v", tt.sa, err)
+		}
+		sa, err := unix.Getsockname(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := unix.Sendto(fd, []byte("ecn"), 0, sa); err != nil {
+			t.Fatal(err)
+		}
+		b, oob := make([]byte, 16), make([]byte, 256)
+		_, oobn, _, _, err := unix.Recvmsg(fd, b, oob, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := parseECNFromCmsgs(oob[:oobn]); got != ecnECT1 {
+			t.Errorf("%v: received %v, want ect1", sa, got)
+		}
+	}
+}
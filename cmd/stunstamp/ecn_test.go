@@ -0,0 +1,80 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"math"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestECNFromTOS(t *testing.T) {
+	for tos, want := range map[byte]ecnCodepoint{0: ecnNotECT, 0b01: ecnECT1, 0b10: ecnECT0, 0b11: ecnCE, 46<<2 | 0b01: ecnECT1} {
+		if got := ecnFromTOS(tos); got != want {
+			t.Errorf("ecnFromTOS(%#x) = %v, want %v", tos, got, want)
+		}
+	}
+}
+
+func TestECNTracker(t *testing.T) {
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	icmpKey := resultKey{meta: meta, protocol: protocolICMP}
+	stunKey := resultKey{meta: meta, protocol: protocolSTUN, dstPort: 3478}
+	countEvents := func() int {
+		n := 0
+		for _, ev := range events.recentEvents() {
+			if ev.Kind == eventKindECNPath && ev.Addr == meta.addr {
+				n++
+			}
+		}
+		return n
+	}
+	before := countEvents()
+	window := func(icmp ecnCodepoint) []result {
+		return []result{
+			{key: icmpKey, at: time.Now(), ecn: icmp},
+			{key: stunKey, at: time.Now(), ecn: ecnNotECT},
+		}
+	}
+
+	e := newECNTracker()
+	for i, tt := range []struct {
+		icmp   ecnCodepoint
+		wantTS int
+	}{
+		{ecnECT1, 3},       // replies of both, and the path preserved
+		{ecnECT1, 2},       // unchanged
+		{ecnUnobserved, 1}, // lost
+		{ecnNotECT, 5},     // bleached, marking preserved stale
+		{ecnCE, 6},
+	} {
+		if got := len(e.update(window(tt.icmp), ecnECT1, "test")); got != tt.wantTS {
+			t.Errorf("update %d: got %d timeseries, want %d", i, got, tt.wantTS)
+		}
+	}
+	if got := countEvents() - before; got != 2 {
+		t.Errorf("got %d ECN path events, want 2", got)
+	}
+	if got := e.replies[ecnKey{icmpKey, ecnECT1}]; got != 2 {
+		t.Errorf("got %d ECT(1) replies, want 2", got)
+	}
+	if got := e.paths[icmpKey]; got != "ce_marked" {
+		t.Errorf("path = %q, want ce_marked", got)
+	}
+
+	// Replies of probes not sent with ECT(1) are counted only.
+	if ts := e.update(window(ecnNotECT), ecnNotECT, "test"); len(ts) != 4 || e.paths[icmpKey] != "ce_marked" {
+		t.Errorf("got %d timeseries and path %q for Not-ECT probes", len(ts), e.paths[icmpKey])
+	}
+
+	ts := e.staleMarkers("test")
+	if len(ts) != 5 || math.Float64bits(ts[0].Samples[0].Value) != staleNaN {
+		t.Errorf("got %d stale markers, want 5", len(ts))
+	}
+	e.forget(func(k resultKey) bool { return k == stunKey })
+	if len(e.replies) != 1 || len(e.paths) != 0 {
+		t.Errorf("state after forget: %v, %v", e.replies, e.paths)
+	}
+}
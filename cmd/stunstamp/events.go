@@ -0,0 +1,165 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// eventKind is the type of a structured event.
+type eventKind string
+
+const (
+	// eventKindICMPError is an ICMP error (e.g. destination unreachable,
+	// time exceeded) received in response to one of our probes.
+	eventKindICMPError eventKind = "icmp_error"
+	// eventKindLog is an error budget relevant log record, see
+	// isErrorBudgetRelevant.
+	eventKindLog eventKind = "log"
+)
+
+// event is a structured, timestamped occurrence worth recording alongside
+// results, e.g. to explain a discontinuity in them.
+type event struct {
+	At   time.Time
+	Kind eventKind
+	// Target fields are populated when the event is attributable to a
+	// probe target.
+	Addr       netip.Addr
+	RegionID   int      `json:",omitempty"`
+	RegionCode string   `json:",omitempty"`
+	Hostname   string   `json:",omitempty"`
+	Protocol   protocol `json:",omitempty"`
+	// Attrs holds kind-specific details.
+	Attrs map[string]string `json:",omitempty"`
+}
+
+const (
+	eventsFilePrefix = "events-"
+	// maxRecentEvents is the number of most recent events held in memory.
+	maxRecentEvents = 1000
+)
+
+// eventRecorder logs, persists, and holds recent events. It is safe for
+// concurrent use.
+type eventRecorder struct {
+	mu      sync.Mutex
+	dir     string // store directory, or empty if not persisting
+	f       *os.File
+	day     string
+	targets map[netip.Addr]nodeMeta
+	recent  []event
+}
+
+// events is the process-wide eventRecorder.
+var events = &eventRecorder{}
+
+// setStoreDir configures the recorder to persist events to dir.
+func (e *eventRecorder) setStoreDir(dir string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dir = dir
+}
+
+// setTargets updates the set of targets used to attribute events by address.
+func (e *eventRecorder) setTargets(targets map[netip.Addr]nodeMeta) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.targets = maps.Clone(targets)
+}
+
+// record logs and persists ev, filling in target fields from ev.Addr when
+// possible.
+func (e *eventRecorder) record(ev event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if ev.At.IsZero() {
+		ev.At = time.Now()
+	}
+	if meta, ok := e.targets[ev.Addr]; ok && ev.Hostname == "" {
+		ev.RegionID = meta.regionID
+		ev.RegionCode = meta.regionCode
+		ev.Hostname = meta.hostname
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		storeLog.Error("error marshaling event", "err", err)
+		return
+	}
+	if ev.Kind != eventKindLog { // already logged
+		slog.Info("event", "event", string(b))
+	}
+	liveStream.publishEvent(ev)
+	e.recent = append(e.recent, ev)
+	if len(e.recent) > maxRecentEvents {
+		e.recent = e.recent[len(e.recent)-maxRecentEvents:]
+	}
+	if len(e.dir) == 0 {
+		return
+	}
+	if err := e.writeLocked(ev.At, append(b, '\n')); err != nil {
+		storeLog.Error("error writing event to store", "err", err)
+	}
+}
+
+// persist persists ev without logging it or holding it as a recent event,
+// for periodic events that would otherwise crowd out the rest.
+func (e *eventRecorder) persist(ev event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.dir) == 0 {
+		return
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		storeLog.Error("error marshaling event", "err", err)
+		return
+	}
+	if err := e.writeLocked(ev.At, append(b, '\n')); err != nil {
+		storeLog.Error("error writing event to store", "err", err)
+	}
+}
+
+func (e *eventRecorder) writeLocked(at time.Time, b []byte) error {
+	day := at.UTC().Format(storeDayLayout)
+	if e.f == nil || e.day != day {
+		if e.f != nil {
+			e.f.Close()
+			e.f = nil
+		}
+		f, err := os.OpenFile(filepath.Join(e.dir, eventsFilePrefix+day+resultsFileSuffix), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		e.f = f
+		e.day = day
+	}
+	_, err := e.f.Write(b)
+	return err
+}
+
+// recentEvents returns a copy of the most recent events, oldest first.
+func (e *eventRecorder) recentEvents() []event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ret := make([]event, len(e.recent))
+	copy(ret, e.recent)
+	return ret
+}
+
+func (e *eventRecorder) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.f != nil {
+		e.f.Close()
+		e.f = nil
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"tailscale.com/util/ctxkey"
+)
+
+// measurementIDLabel is the exemplar label name carrying a result's ID. It
+// follows the trace_id convention closely enough for Grafana's exemplar
+// data links to be pointed at the /measurement/{id} handler.
+const measurementIDLabel = "measurement_id"
+
+// newMeasurementID returns a random identifier for a result.
+func newMeasurementID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// measurementIDKey is the context key holding the ID of the result a probe
+// is measuring, for protocols able to carry it to the server.
+var measurementIDKey = ctxkey.New("stunstamp.measurementID", "")
+
+// measurementIDHeader is the HTTP request header carrying the measurement ID
+// of HTTPS probes, so that server-side logs can be joined with results. It
+// matches derphttp.ProbeMeasurementIDHeader, which derper echoes, and with
+// --log-probe-ids logs.
+const measurementIDHeader = "X-Tailscale-Measurement-Id"
+
+// rttExemplars returns the exemplars to attach to the RTT sample of r, if any.
+func rttExemplars(r result) []prompb.Exemplar {
+	if r.id == "" || r.rtt == nil {
+		return nil
+	}
+	return []prompb.Exemplar{
+		{
+			Labels: []prompb.Label{
+				{Name: measurementIDLabel, Value: r.id},
+			},
+			Value:     float64(*r.rtt),
+			Timestamp: r.at.UnixMilli(),
+		},
+	}
+}
+
+var errMeasurementFound = errors.New("found")
+
+// findMeasurement searches the store for the result with id over the
+// previous lookback, returning false if it is not found.
+func (s *resultsStore) findMeasurement(id string, lookback time.Duration) (storedResult, bool, error) {
+	var found storedResult
+	now := time.Now()
+	err := s.readRange(now.Add(-lookback), now.Add(time.Minute), func(sr storedResult) error {
+		if sr.ID == id {
+			found = sr
+			return errMeasurementFound
+		}
+		return nil
+	})
+	if errors.Is(err, errMeasurementFound) {
+		return found, true, nil
+	}
+	return storedResult{}, false, err
+}
@@ -0,0 +1,57 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestExemplars(t *testing.T) {
+	rtt := 5 * time.Millisecond
+	r := result{
+		key: resultKey{
+			meta:     nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")},
+			protocol: protocolSTUN,
+			dstPort:  3478,
+		},
+		at:  time.Now(),
+		rtt: &rtt,
+		id:  newMeasurementID(),
+	}
+
+	for _, exemplars := range []bool{false, true} {
+		ts := resultsToPromTimeSeries([]result{r}, "test", make(map[resultKey]uint64), exemplars)
+		got := ts[0].Exemplars
+		if !exemplars {
+			if len(got) != 0 {
+				t.Errorf("unexpected exemplars: %v", got)
+			}
+			continue
+		}
+		if len(got) != 1 || got[0].Labels[0].Name != measurementIDLabel || got[0].Labels[0].Value != r.id || got[0].Value != float64(rtt) {
+			t.Errorf("unexpected exemplars: %v", got)
+		}
+	}
+
+	s, err := openResultsStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if err := s.append([]result{r}); err != nil {
+		t.Fatal(err)
+	}
+	sr, ok, err := s.findMeasurement(r.id, time.Hour)
+	if err != nil || !ok {
+		t.Fatalf("findMeasurement() = %v, %v", ok, err)
+	}
+	if sr.ID != r.id || sr.RTTNanos == nil || *sr.RTTNanos != int64(rtt) {
+		t.Errorf("unexpected stored result: %+v", sr)
+	}
+	if _, ok, err := s.findMeasurement("nonexistent", time.Hour); ok || err != nil {
+		t.Errorf("findMeasurement(nonexistent) = %v, %v", ok, err)
+	}
+}
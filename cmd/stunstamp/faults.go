@@ -0,0 +1,251 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// faultInjectionMetricName is 1 while faults are injected, so that alerts
+// and dashboard panels fired by them can be told apart from real incidents.
+const faultInjectionMetricName = "stunstamp_fault_injection"
+
+const (
+	// defaultFaultDuration is how long faults set without an end are
+	// injected for, lest they be forgotten.
+	defaultFaultDuration = 10 * time.Minute
+	// corruptTimestampRange bounds the RTT of probes with corrupted
+	// timestamps in either direction.
+	corruptTimestampRange = time.Second
+)
+
+var errFaultTXDropped = errors.New("tx dropped by fault injection")
+
+// faultConfig is the faults injected into probes, see --fault-injection.
+type faultConfig struct {
+	// DropTXPercent is the percentage of probes whose transmission is
+	// dropped, which then time out.
+	DropTXPercent float64 `json:",omitempty"`
+	// RXDelay is added to the RTT of every probe, as if its response were
+	// delayed.
+	RXDelay time.Duration `json:",omitempty"`
+	// CorruptTimestampsPercent is the percentage of probes whose RTT is
+	// replaced with a random one within ±corruptTimestampRange, as broken
+	// kernel or NIC timestamping would.
+	CorruptTimestampsPercent float64 `json:",omitempty"`
+	// Protocol and Hostname, if set, limit faults to probes of the protocol
+	// and target.
+	Protocol protocol `json:",omitempty"`
+	Hostname string   `json:",omitempty"`
+	// Until is when the faults are lifted. It defaults to
+	// defaultFaultDuration from when they are set.
+	Until time.Time
+}
+
+func (c faultConfig) validate() error {
+	if c.DropTXPercent < 0 || c.DropTXPercent > 100 {
+		return errors.New("DropTXPercent must be between 0 and 100")
+	}
+	if c.CorruptTimestampsPercent < 0 || c.CorruptTimestampsPercent > 100 {
+		return errors.New("CorruptTimestampsPercent must be between 0 and 100")
+	}
+	if c.RXDelay < 0 {
+		return errors.New("RXDelay must be >= 0")
+	}
+	if c.Protocol != "" && !slices.Contains(allProtocols, c.Protocol) {
+		return fmt.Errorf("unknown Protocol %q", c.Protocol)
+	}
+	return nil
+}
+
+// applies reports whether the faults of c are injected into probes of p to
+// hostname.
+func (c faultConfig) applies(p protocol, hostname string) bool {
+	return (c.Protocol == "" || c.Protocol == p) && (c.Hostname == "" || c.Hostname == hostname)
+}
+
+// String describes c for logs and annotations.
+func (c faultConfig) String() string {
+	var parts []string
+	if c.DropTXPercent > 0 {
+		parts = append(parts, fmt.Sprintf("drop %g%% of tx", c.DropTXPercent))
+	}
+	if c.RXDelay > 0 {
+		parts = append(parts, fmt.Sprintf("delay rx by %v", c.RXDelay))
+	}
+	if c.CorruptTimestampsPercent > 0 {
+		parts = append(parts, fmt.Sprintf("corrupt %g%% of timestamps", c.CorruptTimestampsPercent))
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "no faults")
+	}
+	s := strings.Join(parts, ", ")
+	if c.Protocol != "" {
+		s += " of " + string(c.Protocol)
+	}
+	if c.Hostname != "" {
+		s += " to " + c.Hostname
+	}
+	return s
+}
+
+// faultInjector injects faults into probes, so that users can verify their
+// alerting and dashboards fire before a real incident. Faults are set via
+// the API with --fault-injection. It is safe for concurrent use.
+type faultInjector struct {
+	mu  sync.Mutex
+	cfg *faultConfig // nil if no faults are injected
+}
+
+var faults = &faultInjector{}
+
+// set injects the faults of cfg from now on, replacing any injected before,
+// and returns cfg with its defaults applied.
+func (f *faultInjector) set(cfg faultConfig, now time.Time) (faultConfig, error) {
+	if err := cfg.validate(); err != nil {
+		return faultConfig{}, err
+	}
+	if cfg.Until.IsZero() {
+		cfg.Until = now.Add(defaultFaultDuration)
+	}
+	if !cfg.Until.After(now) {
+		return faultConfig{}, errors.New("Until is not in the future")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cfg = &cfg
+	return cfg, nil
+}
+
+// clear lifts any faults injected.
+func (f *faultInjector) clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cfg = nil
+}
+
+// active returns the faults injected at now, if any.
+func (f *faultInjector) active(now time.Time) (faultConfig, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cfg == nil {
+		return faultConfig{}, false
+	}
+	if !now.Before(f.cfg.Until) {
+		probeLog.Info("fault injection ended", "faults", f.cfg.String())
+		f.cfg = nil
+		return faultConfig{}, false
+	}
+	return *f.cfg, true
+}
+
+// measure measures the RTT to dst over conn with fn, a measureFn of p,
+// injecting the faults active, if any.
+func (f *faultInjector) measure(ctx context.Context, p protocol, fn measureFn, conn io.ReadWriteCloser, hostname string, dst netip.AddrPort) (measurement, error) {
+	cfg, ok := f.active(time.Now())
+	if !ok || !cfg.applies(p, hostname) {
+		return fn(ctx, conn, hostname, dst)
+	}
+	if rand.Float64()*100 < cfg.DropTXPercent {
+		// Nothing was sent, so nothing is received before the deadline.
+		t := time.NewTimer(time.Until(deadlineWithin(ctx, txRxTimeout)))
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+		return measurement{}, fmt.Errorf("%w: %w", errFaultTXDropped, os.ErrDeadlineExceeded)
+	}
+	m, err := fn(ctx, conn, hostname, dst)
+	if err != nil {
+		return m, err
+	}
+	m.rtt += cfg.RXDelay
+	if m.userspaceRTT != 0 {
+		m.userspaceRTT += cfg.RXDelay
+	}
+	if rand.Float64()*100 < cfg.CorruptTimestampsPercent {
+		m.rtt = rand.N(2*corruptTimestampRange) - corruptTimestampRange
+	}
+	return m, nil
+}
+
+// toPromTimeSeries returns the faultInjectionMetricName timeseries at at.
+func (f *faultInjector) toPromTimeSeries(instance string, at time.Time) prompb.TimeSeries {
+	var v float64
+	if _, ok := f.active(at); ok {
+		v = 1
+	}
+	return instanceTimeSeries(faultInjectionMetricName, instance, at, v)
+}
+
+// checkFaultInjection fails the request if --fault-injection is unset,
+// returning whether it did.
+func checkFaultInjection(w http.ResponseWriter) bool {
+	if !*flagFaultInjection {
+		http.Error(w, "fault injection is disabled, see --fault-injection", http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// serveGetFaults serves the faults injected as JSON, or null if none are.
+func (s *httpServer) serveGetFaults(w http.ResponseWriter, r *http.Request) {
+	if checkFaultInjection(w) {
+		return
+	}
+	var ret *faultConfig
+	if cfg, ok := faults.active(time.Now()); ok {
+		ret = &cfg
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
+
+// servePutFaults injects the faults of the faultConfig in the request body,
+// replacing any injected before, and annotates the time they are injected
+// for.
+func (s *httpServer) servePutFaults(w http.ResponseWriter, r *http.Request) {
+	if checkFaultInjection(w) {
+		return
+	}
+	var cfg faultConfig
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	cfg, err := faults.set(cfg, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	apiLog.Warn("fault injection started", "faults", cfg.String(), "until", cfg.Until, "remote_addr", r.RemoteAddr)
+	annotations.annotateAuto(now, cfg.Until, cfg.Hostname, "fault injection: "+cfg.String())
+	s.serveGetFaults(w, r)
+}
+
+// serveDeleteFaults lifts any faults injected.
+func (s *httpServer) serveDeleteFaults(w http.ResponseWriter, r *http.Request) {
+	if checkFaultInjection(w) {
+		return
+	}
+	faults.clear()
+	apiLog.Info("fault injection stopped", "remote_addr", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
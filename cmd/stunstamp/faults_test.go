@@ -0,0 +1,128 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFaultInjector(t *testing.T) {
+	dst := netip.MustParseAddrPort("192.0.2.1:3478")
+	fn := func(ctx context.Context, conn io.ReadWriteCloser, hostname string, dst netip.AddrPort) (measurement, error) {
+		return measurement{rtt: 10 * time.Millisecond}, nil
+	}
+	measure := func(f *faultInjector, ctx context.Context, p protocol, hostname string) (measurement, error) {
+		return f.measure(ctx, p, fn, nil, hostname, dst)
+	}
+
+	f := &faultInjector{}
+	if m, err := measure(f, context.Background(), protocolSTUN, "derp1a"); err != nil || m.rtt != 10*time.Millisecond {
+		t.Fatalf("without faults = %v, %v", m.rtt, err)
+	}
+
+	now := time.Now()
+	if _, err := f.set(faultConfig{RXDelay: 5 * time.Millisecond, Hostname: "derp1a"}, now); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := measure(f, context.Background(), protocolSTUN, "derp1a"); m.rtt != 15*time.Millisecond {
+		t.Errorf("delayed rtt = %v, want 15ms", m.rtt)
+	}
+	if m, _ := measure(f, context.Background(), protocolSTUN, "derp2a"); m.rtt != 10*time.Millisecond {
+		t.Errorf("rtt of another target = %v, want 10ms", m.rtt)
+	}
+
+	if _, err := f.set(faultConfig{DropTXPercent: 100, Protocol: protocolSTUN}, now); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := measure(f, ctx, protocolSTUN, "derp1a"); !errors.Is(err, errFaultTXDropped) || !isTemporaryOrTimeoutErr(err) {
+		t.Errorf("dropped tx err = %v, want a timeout wrapping %v", err, errFaultTXDropped)
+	}
+	if _, err := measure(f, context.Background(), protocolICMP, "derp1a"); err != nil {
+		t.Errorf("ICMP err = %v, want STUN alone to be dropped", err)
+	}
+
+	if _, err := f.set(faultConfig{CorruptTimestampsPercent: 100}, now); err != nil {
+		t.Fatal(err)
+	}
+	for range 10 {
+		m, _ := measure(f, context.Background(), protocolSTUN, "derp1a")
+		if m.rtt < -corruptTimestampRange || m.rtt >= corruptTimestampRange {
+			t.Fatalf("corrupted rtt = %v, want within ±%v", m.rtt, corruptTimestampRange)
+		}
+	}
+
+	if cfg, ok := f.active(now.Add(defaultFaultDuration)); ok {
+		t.Errorf("faults %v still active after defaultFaultDuration", cfg)
+	}
+	for _, cfg := range []faultConfig{
+		{DropTXPercent: 101},
+		{CorruptTimestampsPercent: -1},
+		{RXDelay: -time.Second},
+		{Protocol: "quic"},
+		{Until: now.Add(-time.Second)},
+	} {
+		if _, err := f.set(cfg, now); err == nil {
+			t.Errorf("set(%+v) unexpectedly succeeded", cfg)
+		}
+	}
+}
+
+func TestFaultsAPI(t *testing.T) {
+	srv := httptest.NewServer((&httpServer{baselines: newBaselineTracker()}).mux())
+	defer srv.Close()
+	defer faults.clear()
+	do := func(method, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+"/api/faults", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if code, _ := do("PUT", `{"DropTXPercent": 50}`); code != http.StatusForbidden {
+		t.Errorf("PUT without --fault-injection = %d, want %d", code, http.StatusForbidden)
+	}
+	old := *flagFaultInjection
+	*flagFaultInjection = true
+	defer func() { *flagFaultInjection = old }()
+
+	code, body := do("PUT", `{"DropTXPercent": 50, "Protocol": "stun"}`)
+	if code != http.StatusOK {
+		t.Fatalf("PUT = %d: %s", code, body)
+	}
+	var got faultConfig
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.DropTXPercent != 50 || got.Protocol != protocolSTUN || got.Until.IsZero() {
+		t.Errorf("PUT = %+v", got)
+	}
+	if code, _ := do("PUT", `{"DropTXPercent": 500}`); code != http.StatusBadRequest {
+		t.Errorf("PUT of invalid faults = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code, _ := do("DELETE", ""); code != http.StatusNoContent {
+		t.Errorf("DELETE = %d, want %d", code, http.StatusNoContent)
+	}
+	if _, body := do("GET", ""); strings.TrimSpace(body) != "null" {
+		t.Errorf("GET after DELETE = %s, want null", body)
+	}
+}
@@ -0,0 +1,374 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"tailscale.com/net/stun"
+)
+
+const (
+	responseTTLMetricName        = "stunstamp_derp_path_response_ttl"
+	initialTTLMetricName         = "stunstamp_derp_path_initial_ttl"
+	tcpMSSMetricName             = "stunstamp_derp_path_tcp_mss"
+	fingerprintChangesMetricName = "stunstamp_derp_path_fingerprint_changes_total"
+)
+
+// eventKindPathFingerprintChange is a change in the fingerprint of the
+// device returning responses from a target, e.g. due to a CGNAT pool
+// re-homing us onto another gateway.
+const eventKindPathFingerprintChange eventKind = "path_fingerprint_change"
+
+// IPv4 ID behaviors of the device returning responses, see ipIDClass.
+const (
+	ipIDZero        = "zero"
+	ipIDIncremental = "incremental"
+	ipIDRandom      = "random"
+)
+
+// ipIDIncrementalMax is the largest difference between the IPv4 IDs of
+// back-to-back responses considered incremental. Global counters of busy
+// devices advance between responses.
+const ipIDIncrementalMax = 1024
+
+// initialTTLClass returns the initial TTL (hop limit) a response received
+// with ttl was most likely sent with, one of the common defaults of 32, 64,
+// 128, and 255, or 0 if ttl is invalid.
+func initialTTLClass(ttl int) int {
+	for _, class := range []int{32, 64, 128, 255} {
+		if ttl > 0 && ttl <= class {
+			return class
+		}
+	}
+	return 0
+}
+
+// ipIDClass classifies the IPv4 IDs of back-to-back responses.
+func ipIDClass(a, b uint16) string {
+	switch d := b - a; {
+	case a == 0 && b == 0:
+		return ipIDZero
+	case d > 0 && d <= ipIDIncrementalMax:
+		return ipIDIncremental
+	}
+	return ipIDRandom
+}
+
+// pathFingerprint describes the device returning responses from a target.
+// Zero values are unknown.
+type pathFingerprint struct {
+	meta     nodeMeta
+	at       time.Time
+	stunPort int
+	ttl      int // of STUN responses
+	tcpPort  int
+	mss      int // of TCP connections
+	ipID     string
+}
+
+func (f pathFingerprint) initialTTL() int {
+	return initialTTLClass(f.ttl)
+}
+
+// changesFrom returns descriptions of the attributes of f that differ from
+// prev, ignoring attributes unknown in either. Response TTLs within the same
+// initial TTL class are hop count changes, see hopTracker.
+func (f pathFingerprint) changesFrom(prev pathFingerprint) []string {
+	var changes []string
+	if a, b := prev.initialTTL(), f.initialTTL(); a != 0 && b != 0 && a != b {
+		changes = append(changes, fmt.Sprintf("initial TTL %d -> %d", a, b))
+	}
+	if prev.mss != 0 && f.mss != 0 && prev.tcpPort == f.tcpPort && prev.mss != f.mss {
+		changes = append(changes, fmt.Sprintf("TCP MSS %d -> %d", prev.mss, f.mss))
+	}
+	if prev.ipID != "" && f.ipID != "" && prev.ipID != f.ipID {
+		changes = append(changes, fmt.Sprintf("IP ID %s -> %s", prev.ipID, f.ipID))
+	}
+	return changes
+}
+
+// measureResponseTTL sends a STUN request to dst, returning the TTL (hop
+// limit) of the response.
+func measureResponseTTL(ctx context.Context, dst netip.AddrPort) (int, error) {
+	network := "udp4"
+	if dst.Addr().Is6() {
+		network = "udp6"
+	}
+	c, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	if err := c.SetDeadline(deadlineWithin(ctx, txRxTimeout)); err != nil {
+		return 0, err
+	}
+	var read func([]byte) (int, int, error)
+	if dst.Addr().Is4() {
+		pc := ipv4.NewPacketConn(c)
+		if err := pc.SetControlMessage(ipv4.FlagTTL, true); err != nil {
+			return 0, err
+		}
+		read = func(b []byte) (int, int, error) {
+			n, cm, _, err := pc.ReadFrom(b)
+			if cm == nil {
+				return n, 0, err
+			}
+			return n, cm.TTL, err
+		}
+	} else {
+		pc := ipv6.NewPacketConn(c)
+		if err := pc.SetControlMessage(ipv6.FlagHopLimit, true); err != nil {
+			return 0, err
+		}
+		read = func(b []byte) (int, int, error) {
+			n, cm, _, err := pc.ReadFrom(b)
+			if cm == nil {
+				return n, 0, err
+			}
+			return n, cm.HopLimit, err
+		}
+	}
+	txID := stun.NewTxID()
+	if _, err := c.WriteToUDPAddrPort(stun.Request(txID), dst); err != nil {
+		return 0, err
+	}
+	b := make([]byte, 1500)
+	for {
+		n, ttl, err := read(b)
+		if err != nil {
+			return 0, err
+		}
+		if got, _, err := stun.ParseResponse(b[:n]); err != nil || got != txID {
+			continue
+		}
+		if ttl == 0 {
+			return 0, errors.New("response without TTL")
+		}
+		return ttl, nil
+	}
+}
+
+// measureTCPMSS connects to dst, returning the MSS of the connection, which
+// reflects the MSS advertised by, or clamped on the path to, dst.
+func measureTCPMSS(ctx context.Context, dst netip.AddrPort) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, txRxTimeout)
+	defer cancel()
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", dst.String())
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	return tcpMSS(c.(*net.TCPConn))
+}
+
+// measurePathFingerprint measures the fingerprint of the path to meta, via
+// STUN to stunPort and TCP to tcpPort, either of which may be zero to skip
+// it. IPv4 IDs are invisible to sockets, and are only measured via
+// activeRawProber, if set.
+func measurePathFingerprint(ctx context.Context, meta nodeMeta, stunPort, tcpPort int) pathFingerprint {
+	f := pathFingerprint{meta: meta, at: time.Now()}
+	if stunPort > 0 {
+		dst := netip.AddrPortFrom(meta.addr, uint16(stunPort))
+		ttl, err := measureResponseTTL(ctx, dst)
+		if err != nil {
+			probeLog.Debug("error measuring response TTL", "hostname", meta.hostname, "dst", dst, "err", err)
+		} else {
+			f.stunPort, f.ttl = stunPort, ttl
+		}
+		if activeRawProber != nil && activeRawProber.supports(protocolSTUN, meta.addr) {
+			ids, err := activeRawProber.measureIPIDs(ctx, dst)
+			if err != nil {
+				probeLog.Debug("error measuring IP IDs", "hostname", meta.hostname, "dst", dst, "err", err)
+			} else {
+				f.ipID = ipIDClass(ids[0], ids[1])
+			}
+		}
+	}
+	if tcpPort > 0 {
+		dst := netip.AddrPortFrom(meta.addr, uint16(tcpPort))
+		mss, err := measureTCPMSS(ctx, dst)
+		if err != nil {
+			probeLog.Debug("error measuring TCP MSS", "hostname", meta.hostname, "dst", dst, "err", err)
+		} else {
+			f.tcpPort, f.mss = tcpPort, mss
+		}
+	}
+	return f
+}
+
+// measureAllPathFingerprints measures the path fingerprint of every target
+// concurrently, via the first of its STUN and TCP ports.
+func measureAllPathFingerprints(ctx context.Context, targets map[netip.Addr]nodeMeta, stunPortsFor, tcpPortsFor func(nodeMeta) []int) []pathFingerprint {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make([]pathFingerprint, 0, len(targets))
+	)
+	for _, meta := range targets {
+		var stunPort, tcpPort int
+		if ports := stunPortsFor(meta); len(ports) > 0 {
+			stunPort = ports[0]
+		}
+		if ports := tcpPortsFor(meta); len(ports) > 0 {
+			tcpPort = ports[0]
+		}
+		if stunPort == 0 && tcpPort == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f := measurePathFingerprint(ctx, meta, stunPort, tcpPort)
+			mu.Lock()
+			defer mu.Unlock()
+			results = append(results, f)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// fingerprintTracker tracks the last known path fingerprint of targets in
+// order to detect changes. It is not safe for concurrent use.
+type fingerprintTracker struct {
+	last    map[nodeMeta]pathFingerprint // merged from successful measurements
+	written map[nodeMeta]pathFingerprint // ports of the timeseries written
+	changes map[nodeMeta]int
+}
+
+func newFingerprintTracker() *fingerprintTracker {
+	return &fingerprintTracker{
+		last:    make(map[nodeMeta]pathFingerprint),
+		written: make(map[nodeMeta]pathFingerprint),
+		changes: make(map[nodeMeta]int),
+	}
+}
+
+// fingerprintTimeSeries returns the timeseries of f, with values from value,
+// which is called with the metric name.
+func fingerprintTimeSeries(f pathFingerprint, instance string, at time.Time, value func(metricName string) float64) []prompb.TimeSeries {
+	sample := func(metricName string, proto protocol, port int) prompb.TimeSeries {
+		return prompb.TimeSeries{
+			Labels:  timeSeriesLabels(metricName, f.meta, instance, timestampSourceUserspace, unstableConn, proto, port),
+			Samples: []prompb.Sample{{Timestamp: at.UnixMilli(), Value: value(metricName)}},
+		}
+	}
+	ts := []prompb.TimeSeries{sample(fingerprintChangesMetricName, "", 0)}
+	if f.stunPort > 0 {
+		ts = append(ts,
+			sample(responseTTLMetricName, protocolSTUN, f.stunPort),
+			sample(initialTTLMetricName, protocolSTUN, f.stunPort))
+	}
+	if f.tcpPort > 0 {
+		ts = append(ts, sample(tcpMSSMetricName, protocolTCP, f.tcpPort))
+	}
+	return ts
+}
+
+// update records results, counting and recording an event for every target
+// whose fingerprint changed. It returns timeseries for results, and stale
+// markers for targets absent from results.
+func (t *fingerprintTracker) update(results []pathFingerprint, instance string) []prompb.TimeSeries {
+	var ts []prompb.TimeSeries
+	current := make(map[nodeMeta]bool)
+	for _, f := range results {
+		current[f.meta] = true
+		prev, ok := t.last[f.meta]
+		if ok {
+			if changes := f.changesFrom(prev); len(changes) > 0 {
+				t.changes[f.meta]++
+				text := "path fingerprint changed: " + strings.Join(changes, ", ")
+				annotations.annotateAuto(f.at, f.at, f.meta.hostname, text)
+				events.record(event{
+					At:   f.at,
+					Kind: eventKindPathFingerprintChange,
+					Addr: f.meta.addr,
+					Attrs: map[string]string{
+						"changes": strings.Join(changes, ", "),
+					},
+				})
+			}
+		}
+		// Remember the last known value of every attribute.
+		merged := f
+		if merged.ttl == 0 {
+			merged.stunPort, merged.ttl = prev.stunPort, prev.ttl
+		}
+		if merged.mss == 0 {
+			merged.tcpPort, merged.mss = prev.tcpPort, prev.mss
+		}
+		if merged.ipID == "" {
+			merged.ipID = prev.ipID
+		}
+		t.last[f.meta] = merged
+
+		// Write every port measured, with NaN for failures.
+		written := t.written[f.meta]
+		written.meta = f.meta
+		written.stunPort = cmp.Or(f.stunPort, written.stunPort)
+		written.tcpPort = cmp.Or(f.tcpPort, written.tcpPort)
+		t.written[f.meta] = written
+		ts = append(ts, fingerprintTimeSeries(written, instance, f.at, func(name string) float64 {
+			switch name {
+			case responseTTLMetricName:
+				if f.ttl > 0 {
+					return float64(f.ttl)
+				}
+			case initialTTLMetricName:
+				if f.ttl > 0 {
+					return float64(f.initialTTL())
+				}
+			case tcpMSSMetricName:
+				if f.mss > 0 {
+					return float64(f.mss)
+				}
+			case fingerprintChangesMetricName:
+				return float64(t.changes[f.meta])
+			}
+			return math.NaN()
+		})...)
+	}
+	now := time.Now()
+	for meta, written := range t.written {
+		if current[meta] {
+			continue
+		}
+		ts = append(ts, fingerprintStaleMarkers(written, instance, now)...)
+		delete(t.written, meta)
+		delete(t.last, meta)
+		delete(t.changes, meta)
+	}
+	return ts
+}
+
+// staleMarkers returns stale markers for the last fingerprint written of
+// every path.
+func (t *fingerprintTracker) staleMarkers(instance string) []prompb.TimeSeries {
+	now := time.Now()
+	var ts []prompb.TimeSeries
+	for _, written := range t.written {
+		ts = append(ts, fingerprintStaleMarkers(written, instance, now)...)
+	}
+	return ts
+}
+
+func fingerprintStaleMarkers(f pathFingerprint, instance string, at time.Time) []prompb.TimeSeries {
+	return fingerprintTimeSeries(f, instance, at, func(string) float64 {
+		return math.Float64frombits(staleNaN)
+	})
+}
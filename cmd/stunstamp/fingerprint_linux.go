@@ -0,0 +1,52 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpMSS returns the maximum segment size of the connected c.
+func tcpMSS(c *net.TCPConn) (int, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		mss     int
+		sockErr error
+	)
+	err = rc.Control(func(fd uintptr) {
+		mss, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_MAXSEG)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return mss, sockErr
+}
+
+// measureIPIDs sends two STUN requests to dst back-to-back, returning the
+// IPv4 IDs of the responses.
+func (r *rawProber) measureIPIDs(ctx context.Context, dst netip.AddrPort) ([2]uint16, error) {
+	var ids [2]uint16
+	for i := range ids {
+		pkt, match := r.stunRequest(dst)
+		_, err := r.measure(ctx, pkt, func(b []byte) bool {
+			if !match(b) {
+				return false
+			}
+			ids[i] = binary.BigEndian.Uint16(b[4:])
+			return true
+		})
+		if err != nil {
+			return ids, err
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,129 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+
+	"tailscale.com/net/stun/stuntest"
+)
+
+func TestInitialTTLClass(t *testing.T) {
+	for ttl, want := range map[int]int{0: 0, 1: 32, 32: 32, 33: 64, 57: 64, 64: 64, 120: 128, 200: 255, 255: 255, 256: 0} {
+		if got := initialTTLClass(ttl); got != want {
+			t.Errorf("initialTTLClass(%d) = %d, want %d", ttl, got, want)
+		}
+	}
+}
+
+func TestIPIDClass(t *testing.T) {
+	tests := []struct {
+		a, b uint16
+		want string
+	}{
+		{0, 0, ipIDZero},
+		{100, 101, ipIDIncremental},
+		{65535, 3, ipIDIncremental},
+		{100, 100, ipIDRandom},
+		{100, 40000, ipIDRandom},
+		{40000, 100, ipIDRandom},
+	}
+	for _, tt := range tests {
+		if got := ipIDClass(tt.a, tt.b); got != tt.want {
+			t.Errorf("ipIDClass(%d, %d) = %s, want %s", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMeasurePathFingerprint(t *testing.T) {
+	stunAddr, cleanup := stuntest.Serve(t)
+	defer cleanup()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	meta := nodeMeta{hostname: "local", addr: netip.MustParseAddr("127.0.0.1")}
+	f := measurePathFingerprint(context.Background(), meta, stunAddr.Port, ln.Addr().(*net.TCPAddr).Port)
+	if f.ttl == 0 || f.initialTTL() == 0 {
+		t.Errorf("got TTL %d, want one", f.ttl)
+	}
+	if runtime.GOOS == "linux" && f.mss == 0 {
+		t.Error("got no MSS")
+	}
+}
+
+func TestFingerprintTracker(t *testing.T) {
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	ft := newFingerprintTracker()
+	countChanges := func() int {
+		n := 0
+		for _, ev := range events.recentEvents() {
+			if ev.Kind == eventKindPathFingerprintChange && ev.Addr == meta.addr {
+				n++
+			}
+		}
+		return n
+	}
+	before := countChanges()
+
+	fp := func(ttl, mss int, ipID string) pathFingerprint {
+		return pathFingerprint{meta: meta, at: time.Now(), stunPort: 3478, ttl: ttl, tcpPort: 443, mss: mss, ipID: ipID}
+	}
+	for i, f := range []pathFingerprint{
+		fp(57, 1380, ipIDRandom),
+		fp(55, 1380, ipIDRandom), // hop count change
+		fp(0, 0, ""),             // failures
+		fp(120, 1380, ipIDRandom),
+		fp(120, 1360, ipIDIncremental),
+	} {
+		ts := ft.update([]pathFingerprint{f}, "test")
+		if len(ts) != 4 {
+			t.Fatalf("update %d: got %d timeseries, want 4", i, len(ts))
+		}
+		for _, s := range ts {
+			if name := s.Labels[0].Value; name == responseTTLMetricName {
+				if got := s.Samples[0].Value; f.ttl == 0 && !math.IsNaN(got) || f.ttl > 0 && got != float64(f.ttl) {
+					t.Errorf("update %d: got TTL %v, want %d", i, got, f.ttl)
+				}
+			}
+		}
+	}
+	// The initial TTL class changed from 64 to 128, then the MSS and IP ID
+	// changed together.
+	if got := countChanges() - before; got != 2 {
+		t.Errorf("got %d path fingerprint change events, want 2", got)
+	}
+	if got := ft.changes[meta]; got != 2 {
+		t.Errorf("got %d changes, want 2", got)
+	}
+
+	ts := ft.update(nil, "test")
+	if len(ts) != 4 {
+		t.Fatalf("got %d stale markers for vanished target, want 4", len(ts))
+	}
+	for _, s := range ts {
+		if math.Float64bits(s.Samples[0].Value) != staleNaN {
+			t.Errorf("got value %v, want stale marker", s.Samples[0].Value)
+		}
+	}
+	if len(ft.staleMarkers("test")) != 0 {
+		t.Error("vanished target still tracked")
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/tcnksm/go-httpstat"
+)
+
+// funnelPhase is a step of an HTTPS request to a Funnel endpoint that we
+// measure independently.
+type funnelPhase string
+
+const (
+	funnelPhaseDNS     funnelPhase = "dns"
+	funnelPhaseConnect funnelPhase = "connect"
+	funnelPhaseTLS     funnelPhase = "tls"
+	// funnelPhaseTTFB is the time from writing the request until the first
+	// byte of the response, which includes the Funnel ingress relaying the
+	// request to the node serving it over the tailnet, and back.
+	funnelPhaseTTFB funnelPhase = "ttfb"
+	// funnelPhaseTotal is the time from starting the request until the first
+	// byte of the response, i.e. the sum of all other phases.
+	funnelPhaseTotal funnelPhase = "total"
+)
+
+var funnelPhases = []funnelPhase{funnelPhaseDNS, funnelPhaseConnect, funnelPhaseTLS, funnelPhaseTTFB, funnelPhaseTotal}
+
+const (
+	funnelRTTMetricName      = "stunstamp_funnel_rtt_ns"
+	funnelTimeoutsMetricName = "stunstamp_funnel_timeouts_total"
+
+	// funnelProbeTimeout bounds a single Funnel probe.
+	funnelProbeTimeout = time.Second * 10
+)
+
+// funnelPorts are the ports Tailscale Funnel serves on.
+var funnelPorts = []int{443, 8443, 10000}
+
+// funnelConfig describes a Funnel-published endpoint to probe over HTTPS
+// from outside the tailnet.
+type funnelConfig struct {
+	// URL is the Funnel URL to GET, e.g.
+	// https://service.tailnet-name.ts.net/healthz.
+	URL string
+	// SNI overrides the TLS server name, which defaults to the hostname of
+	// URL.
+	SNI string `json:",omitempty"`
+	// Addr is the address of the Funnel ingress to connect to instead of
+	// resolving the hostname of URL, e.g. to monitor a particular ingress.
+	Addr string `json:",omitempty"`
+}
+
+func (f *funnelConfig) validate() error {
+	u, err := url.Parse(f.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.Hostname() == "" {
+		return fmt.Errorf("URL %q is not an https URL", f.URL)
+	}
+	if port := u.Port(); port != "" {
+		n, _ := strconv.Atoi(port)
+		if !slices.Contains(funnelPorts, n) {
+			return fmt.Errorf("URL %q has port %s, Funnel serves on %v", f.URL, port, funnelPorts)
+		}
+	}
+	if f.Addr != "" {
+		if _, err := netip.ParseAddr(f.Addr); err != nil {
+			return fmt.Errorf("invalid Addr: %w", err)
+		}
+	}
+	return nil
+}
+
+// funnelKey identifies the timeseries of a Funnel endpoint.
+type funnelKey struct {
+	host string // with port
+	path string
+	addr string // of the ingress, if configured
+}
+
+func funnelKeyOf(f funnelConfig) funnelKey {
+	u, _ := url.Parse(f.URL) // validated
+	host := u.Hostname() + ":" + cmp.Or(u.Port(), "443")
+	return funnelKey{host: host, path: cmp.Or(u.EscapedPath(), "/"), addr: f.Addr}
+}
+
+// funnelResult is the measurement of a Funnel endpoint. Phases missing from
+// rtts were skipped, e.g. DNS if an ingress address is configured. A nil rtts
+// signifies failure.
+type funnelResult struct {
+	key  funnelKey
+	at   time.Time
+	rtts map[funnelPhase]time.Duration
+}
+
+// measureFunnel GETs the Funnel endpoint f on a fresh connection, as a client
+// on the internet would, and measures every funnelPhase. Responses with a
+// 5xx status code, e.g. from the ingress when the node serving f is offline,
+// are failures.
+func measureFunnel(ctx context.Context, f funnelConfig) funnelResult {
+	r := funnelResult{key: funnelKeyOf(f), at: time.Now()}
+	if err := measureFunnelPhases(ctx, f, &r); err != nil {
+		probeLog.Warn("error measuring funnel", "url", f.URL, "addr", f.Addr, "err", err)
+		r.rtts = nil
+	}
+	return r
+}
+
+func measureFunnelPhases(ctx context.Context, f funnelConfig, r *funnelResult) error {
+	var stat httpstat.Result
+	ctx, cancel := context.WithTimeout(httpstat.WithHTTPStat(ctx, &stat), funnelProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", f.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "stunstamp")
+	tr := &http.Transport{
+		DisableKeepAlives: true,
+		TLSClientConfig:   &tls.Config{ServerName: cmp.Or(f.SNI, req.URL.Hostname())},
+	}
+	defer tr.CloseIdleConnections()
+	if f.Addr != "" {
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, net.JoinHostPort(f.Addr, port))
+		}
+	}
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return tempError{err}
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 8<<10))
+	stat.End(time.Now())
+	if resp.StatusCode/100 == 5 {
+		return tempError{fmt.Errorf("unexpected status code: %d", resp.StatusCode)}
+	}
+	r.rtts = map[funnelPhase]time.Duration{
+		funnelPhaseConnect: stat.TCPConnection,
+		funnelPhaseTLS:     stat.TLSHandshake,
+		funnelPhaseTTFB:    stat.ServerProcessing,
+		funnelPhaseTotal:   stat.StartTransfer,
+	}
+	if f.Addr == "" {
+		r.rtts[funnelPhaseDNS] = stat.DNSLookup
+	}
+	return nil
+}
+
+// measureAllFunnels measures every Funnel endpoint in funnels concurrently.
+func measureAllFunnels(ctx context.Context, funnels []funnelConfig) []funnelResult {
+	results := make([]funnelResult, len(funnels))
+	var wg sync.WaitGroup
+	for i, f := range funnels {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = measureFunnel(ctx, f)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// funnelTracker counts the failures of every Funnel endpoint and tracks the
+// timeseries written. It is not safe for concurrent use.
+type funnelTracker struct {
+	timeouts map[funnelKey]uint64
+}
+
+func newFunnelTracker() *funnelTracker {
+	return &funnelTracker{timeouts: make(map[funnelKey]uint64)}
+}
+
+func funnelTimeSeriesLabels(metricName string, k funnelKey, phase funnelPhase, instance string) []prompb.Label {
+	labels := []prompb.Label{
+		{Name: "__name__", Value: metricName},
+		{Name: "job", Value: "stunstamp-rw"},
+		{Name: "instance", Value: instance},
+		{Name: "funnel_host", Value: k.host},
+		{Name: "path", Value: k.path},
+	}
+	if k.addr != "" {
+		labels = append(labels, prompb.Label{Name: "addr", Value: k.addr})
+	}
+	if phase != "" {
+		labels = append(labels, prompb.Label{Name: "phase", Value: string(phase)})
+	}
+	slices.SortFunc(labels, func(a, b prompb.Label) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return labels
+}
+
+// update returns timeseries for results, counting failures, and stale
+// markers for the endpoints absent from results, e.g. removed from the
+// config.
+func (t *funnelTracker) update(results []funnelResult, instance string) []prompb.TimeSeries {
+	var ts []prompb.TimeSeries
+	current := make(map[funnelKey]bool)
+	for _, r := range results {
+		current[r.key] = true
+		if r.rtts == nil {
+			t.timeouts[r.key]++
+		} else if _, ok := t.timeouts[r.key]; !ok {
+			t.timeouts[r.key] = 0
+		}
+		for _, phase := range funnelPhases {
+			value := math.NaN()
+			if rtt, ok := r.rtts[phase]; ok {
+				value = float64(rtt)
+			} else if r.rtts != nil || (phase == funnelPhaseDNS && r.key.addr != "") {
+				// Skipped.
+				continue
+			}
+			ts = append(ts, prompb.TimeSeries{
+				Labels:  funnelTimeSeriesLabels(funnelRTTMetricName, r.key, phase, instance),
+				Samples: []prompb.Sample{{Timestamp: r.at.UnixMilli(), Value: value}},
+			})
+		}
+		ts = append(ts, prompb.TimeSeries{
+			Labels:  funnelTimeSeriesLabels(funnelTimeoutsMetricName, r.key, "", instance),
+			Samples: []prompb.Sample{{Timestamp: r.at.UnixMilli(), Value: float64(t.timeouts[r.key])}},
+		})
+	}
+	now := time.Now()
+	for k := range t.timeouts {
+		if !current[k] {
+			ts = append(ts, funnelStaleMarkers(k, instance, now)...)
+			delete(t.timeouts, k)
+		}
+	}
+	return ts
+}
+
+// staleMarkers returns stale markers for the series of every funnel probed.
+func (t *funnelTracker) staleMarkers(instance string) []prompb.TimeSeries {
+	now := time.Now()
+	var ts []prompb.TimeSeries
+	for k := range t.timeouts {
+		ts = append(ts, funnelStaleMarkers(k, instance, now)...)
+	}
+	return ts
+}
+
+func funnelStaleMarkers(k funnelKey, instance string, at time.Time) []prompb.TimeSeries {
+	samples := []prompb.Sample{{Timestamp: at.UnixMilli(), Value: math.Float64frombits(staleNaN)}}
+	ts := []prompb.TimeSeries{{
+		Labels:  funnelTimeSeriesLabels(funnelTimeoutsMetricName, k, "", instance),
+		Samples: samples,
+	}}
+	for _, phase := range funnelPhases {
+		ts = append(ts, prompb.TimeSeries{
+			Labels:  funnelTimeSeriesLabels(funnelRTTMetricName, k, phase, instance),
+			Samples: samples,
+		})
+	}
+	return ts
+}
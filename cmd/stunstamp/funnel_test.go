@@ -0,0 +1,78 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFunnelConfigValidate(t *testing.T) {
+	for _, f := range []funnelConfig{
+		{URL: "https://svc.tailnet.ts.net/healthz"},
+		{URL: "https://svc.tailnet.ts.net:8443/", SNI: "other.tailnet.ts.net", Addr: "192.0.2.1"},
+	} {
+		if err := f.validate(); err != nil {
+			t.Errorf("validate(%+v) = %v", f, err)
+		}
+	}
+	for _, f := range []funnelConfig{
+		{URL: "http://svc.tailnet.ts.net/"},
+		{URL: "https:///path"},
+		{URL: "https://svc.tailnet.ts.net:8080/"},
+		{URL: "https://svc.tailnet.ts.net/", Addr: "ingress.example.com"},
+	} {
+		if err := f.validate(); err == nil {
+			t.Errorf("validate(%+v) succeeded", f)
+		}
+	}
+	if _, err := parseConfig([]byte(`{"Funnels": [{"URL": "https://svc.tailnet.ts.net:1/"}]}`)); err == nil {
+		t.Error("config with invalid funnel parsed")
+	}
+}
+
+func TestFunnelTracker(t *testing.T) {
+	direct := funnelKeyOf(funnelConfig{URL: "https://svc.tailnet.ts.net"})
+	if direct.host != "svc.tailnet.ts.net:443" || direct.path != "/" {
+		t.Errorf("funnelKeyOf() = %+v", direct)
+	}
+	viaIngress := funnelKeyOf(funnelConfig{URL: "https://svc.tailnet.ts.net", Addr: "192.0.2.1"})
+	now := time.Now()
+	rtts := map[funnelPhase]time.Duration{
+		funnelPhaseConnect: time.Millisecond,
+		funnelPhaseTLS:     time.Millisecond,
+		funnelPhaseTTFB:    time.Millisecond,
+		funnelPhaseTotal:   3 * time.Millisecond,
+	}
+
+	tr := newFunnelTracker()
+	// The ingress result skips DNS, and the failed direct one writes NaN for
+	// every phase.
+	ts := tr.update([]funnelResult{
+		{key: direct, at: now},
+		{key: viaIngress, at: now, rtts: rtts},
+	}, "test")
+	if want := len(funnelPhases) + 1 + len(rtts) + 1; len(ts) != want {
+		t.Errorf("update() = %d timeseries, want %d", len(ts), want)
+	}
+	if tr.timeouts[direct] != 1 || tr.timeouts[viaIngress] != 0 {
+		t.Errorf("timeouts = %v", tr.timeouts)
+	}
+
+	// Removed endpoints are marked stale.
+	ts = tr.update([]funnelResult{{key: viaIngress, at: now, rtts: rtts}}, "test")
+	var stale int
+	for _, s := range ts {
+		if math.Float64bits(s.Samples[0].Value) == staleNaN {
+			stale++
+		}
+	}
+	if want := len(funnelPhases) + 1; stale != want {
+		t.Errorf("update() wrote %d stale markers, want %d", stale, want)
+	}
+	if _, ok := tr.timeouts[direct]; ok {
+		t.Error("removed endpoint still tracked")
+	}
+}
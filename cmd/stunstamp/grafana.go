@@ -0,0 +1,348 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The handlers in this file implement the API of the Grafana JSON
+// datasources, simple-json and its successors, so that Grafana is able to
+// chart stored results directly. They are served under grafanaPathPrefix,
+// which is the URL to configure the datasource with.
+//
+// A target is a set of label filters in URL query form, e.g.
+// "hostname=derp1a.tailscale.com&protocol=stun", matching the results of
+// every series with those labels; see grafanaLabels for the labels. Each
+// matching series is charted as its RTT in milliseconds.
+const grafanaPathPrefix = "/grafana"
+
+// grafanaLabelNames are the labels of a series targets filter by, in the
+// order they are rendered.
+var grafanaLabelNames = []string{
+	"region_code",
+	"hostname",
+	"address_family",
+	"protocol",
+	"dst_port",
+	"timestamp_source",
+	"stable_conn",
+	"proxy",
+	"xlat",
+}
+
+// grafanaLabels returns the labels of the series sr belongs to.
+func grafanaLabels(sr storedResult) url.Values {
+	family := "ipv4"
+	if sr.Addr.Is6() {
+		family = "ipv6"
+	}
+	v := url.Values{
+		"region_code":      {sr.RegionCode},
+		"hostname":         {sr.Hostname},
+		"address_family":   {family},
+		"protocol":         {string(sr.Protocol)},
+		"dst_port":         {strconv.Itoa(sr.DstPort)},
+		"timestamp_source": {sr.TimestampSource},
+		"stable_conn":      {strconv.FormatBool(sr.StableConn)},
+	}
+	if sr.Proxy != "" {
+		v.Set("proxy", sr.Proxy)
+	}
+	if sr.Xlat != "" {
+		v.Set("xlat", sr.Xlat)
+	}
+	return v
+}
+
+// grafanaMatches reports whether labels satisfy every filter in target.
+func grafanaMatches(labels, target url.Values) bool {
+	for k, vs := range target {
+		if !slices.Contains(vs, labels.Get(k)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *httpServer) registerGrafana(mux *http.ServeMux) {
+	mux.HandleFunc("GET "+grafanaPathPrefix+"/{$}", s.serveHealthz)
+	mux.HandleFunc("POST "+grafanaPathPrefix+"/search", s.serveGrafanaSearch)
+	mux.HandleFunc("POST "+grafanaPathPrefix+"/variable", s.serveGrafanaVariable)
+	mux.HandleFunc("POST "+grafanaPathPrefix+"/query", s.serveGrafanaQuery)
+	mux.HandleFunc("POST "+grafanaPathPrefix+"/annotations", s.serveGrafanaAnnotations)
+}
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// orDefault returns r, defaulting to the last hour if unset.
+func (r grafanaRange) orDefault() (from, to time.Time) {
+	if r.From.IsZero() || r.To.IsZero() {
+		now := time.Now()
+		return now.Add(-defaultResultsQueryRange), now
+	}
+	return r.From, r.To
+}
+
+// grafanaSeriesRange is how far back series are discovered by search and
+// variable requests.
+const grafanaSeriesRange = time.Hour
+
+// distinctLabelValues returns the sorted distinct values of label among the
+// series with results in the last hour that satisfy filter, or the targets
+// of those series if label is empty.
+func (s *httpServer) distinctLabelValues(label string, filter url.Values) ([]string, error) {
+	seen := make(map[string]bool)
+	now := time.Now()
+	err := s.store.readRange(now.Add(-grafanaSeriesRange), now, func(sr storedResult) error {
+		labels := grafanaLabels(sr)
+		if !grafanaMatches(labels, filter) {
+			return nil
+		}
+		if label == "" {
+			seen[labels.Encode()] = true
+		} else if v := labels.Get(label); v != "" {
+			seen[v] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0, len(seen))
+	for v := range seen {
+		ret = append(ret, v)
+	}
+	slices.Sort(ret)
+	return ret, nil
+}
+
+// parseGrafanaQuery splits q, e.g. "hostname" or
+// "hostname?region_code=nyc", into a label name and a filter. A q that is
+// not a label name is a filter alone.
+func parseGrafanaQuery(q string) (label string, filter url.Values, err error) {
+	name, rawFilter, _ := strings.Cut(q, "?")
+	if !slices.Contains(grafanaLabelNames, name) {
+		name, rawFilter = "", q
+	}
+	filter, err = url.ParseQuery(rawFilter)
+	return name, filter, err
+}
+
+// serveGrafanaSearch serves the metric names of the simple-json datasource:
+// the targets of the series with recent results, or the values of a label if
+// the request target names one, e.g. for template variables.
+func (s *httpServer) serveGrafanaSearch(w http.ResponseWriter, r *http.Request) {
+	if s.store == nil {
+		http.Error(w, "results are not being persisted", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Target string `json:"target"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	label, filter, err := parseGrafanaQuery(req.Target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	values, err := s.distinctLabelValues(label, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(values)
+}
+
+// serveGrafanaVariable serves the values of a template variable, as a label
+// query in the form accepted by serveGrafanaSearch.
+func (s *httpServer) serveGrafanaVariable(w http.ResponseWriter, r *http.Request) {
+	if s.store == nil {
+		http.Error(w, "results are not being persisted", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Payload struct {
+			Target string `json:"target"`
+		} `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	label, filter, err := parseGrafanaQuery(req.Payload.Target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	values, err := s.distinctLabelValues(label, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type variableValue struct {
+		Text  string `json:"__text"`
+		Value string `json:"__value"`
+	}
+	ret := make([]variableValue, 0, len(values))
+	for _, v := range values {
+		ret = append(ret, variableValue{v, v})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
+
+// grafanaSeries is a series in a query response, with datapoints of
+// [value, Unix milliseconds].
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// serveGrafanaQuery serves the series matching every target in the request
+// as RTTs in milliseconds. Results are downsampled to the median of every
+// intervalMs, if set. Failed probes are omitted, as they are charted by the
+// timeouts metric.
+func (s *httpServer) serveGrafanaQuery(w http.ResponseWriter, r *http.Request) {
+	if s.store == nil {
+		http.Error(w, "results are not being persisted", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Range      grafanaRange `json:"range"`
+		IntervalMs int64        `json:"intervalMs"`
+		Targets    []struct {
+			Target string `json:"target"`
+			Hide   bool   `json:"hide"`
+		} `json:"targets"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var targets []url.Values
+	for _, t := range req.Targets {
+		if t.Hide {
+			continue
+		}
+		filter, err := url.ParseQuery(t.Target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		targets = append(targets, filter)
+	}
+	interval := time.Duration(req.IntervalMs) * time.Millisecond
+
+	// rtts holds RTTs by series and bucket start, in Unix milliseconds.
+	rtts := make(map[string]map[int64][]time.Duration)
+	from, to := req.Range.orDefault()
+	n := 0
+	err := s.store.readRange(from, to, func(sr storedResult) error {
+		if sr.RTTNanos == nil {
+			return nil
+		}
+		labels := grafanaLabels(sr)
+		if !slices.ContainsFunc(targets, func(t url.Values) bool { return grafanaMatches(labels, t) }) {
+			return nil
+		}
+		if n == maxResultsQueryLimit {
+			return errResultsLimit
+		}
+		n++
+		at := sr.At
+		if interval > 0 {
+			at = at.Truncate(interval)
+		}
+		series := labels.Encode()
+		if rtts[series] == nil {
+			rtts[series] = make(map[int64][]time.Duration)
+		}
+		rtts[series][at.UnixMilli()] = append(rtts[series][at.UnixMilli()], time.Duration(*sr.RTTNanos))
+		return nil
+	})
+	if err != nil && !errors.Is(err, errResultsLimit) {
+		apiLog.Error("error serving grafana query", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ret := make([]grafanaSeries, 0, len(rtts))
+	for series, buckets := range rtts {
+		gs := grafanaSeries{Target: series}
+		for at, d := range buckets {
+			gs.Datapoints = append(gs.Datapoints, [2]float64{float64(medianOf(d)) / float64(time.Millisecond), float64(at)})
+		}
+		slices.SortFunc(gs.Datapoints, func(a, b [2]float64) int {
+			return cmp.Compare(a[1], b[1])
+		})
+		ret = append(ret, gs)
+	}
+	slices.SortFunc(ret, func(a, b grafanaSeries) int {
+		return strings.Compare(a.Target, b.Target)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
+
+// serveGrafanaAnnotations serves the annotations overlapping the requested
+// range. The annotation query, if any, filters them by hostname.
+func (s *httpServer) serveGrafanaAnnotations(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Range      grafanaRange `json:"range"`
+		Annotation struct {
+			Name  string `json:"name"`
+			Query string `json:"query"`
+		} `json:"annotation"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	type grafanaAnnotation struct {
+		Annotation any      `json:"annotation"`
+		Time       int64    `json:"time"`
+		TimeEnd    int64    `json:"timeEnd"`
+		IsRegion   bool     `json:"isRegion"`
+		Title      string   `json:"title"`
+		Text       string   `json:"text"`
+		Tags       []string `json:"tags"`
+	}
+	from, to := req.Range.orDefault()
+	ret := []grafanaAnnotation{}
+	for _, a := range annotations.overlapping(from, to) {
+		if req.Annotation.Query != "" && a.Hostname != req.Annotation.Query {
+			continue
+		}
+		tags := []string{string(a.Source)}
+		if a.Hostname != "" {
+			tags = append(tags, a.Hostname)
+		}
+		ret = append(ret, grafanaAnnotation{
+			Annotation: req.Annotation,
+			Time:       a.From.UnixMilli(),
+			TimeEnd:    a.To.UnixMilli(),
+			IsRegion:   a.To.After(a.From),
+			Title:      a.Text,
+			Text:       a.Text,
+			Tags:       tags,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
@@ -0,0 +1,87 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrafanaAPI(t *testing.T) {
+	s, err := openResultsStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	now := time.Now().Truncate(time.Minute)
+	var results []result
+	for i, hostname := range []string{"1a", "1b", "1a", "1a"} {
+		rtt := time.Duration(i+1) * time.Millisecond
+		results = append(results, result{
+			key: resultKey{
+				meta:            nodeMeta{regionID: 1, regionCode: "nyc", hostname: hostname, addr: netip.MustParseAddr("192.0.2.1")},
+				protocol:        protocolSTUN,
+				dstPort:         3478,
+				timestampSource: timestampSourceKernel,
+			},
+			at:  now.Add(-time.Minute + time.Duration(i)*time.Second),
+			rtt: &rtt,
+		})
+	}
+	if err := s.append(results); err != nil {
+		t.Fatal(err)
+	}
+	mux := (&httpServer{store: s}).mux()
+	post := func(path, body string, v any) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("POST", grafanaPathPrefix+path, strings.NewReader(body)))
+		if rec.Code != 200 {
+			t.Fatalf("%s: status %d: %s", path, rec.Code, rec.Body)
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", grafanaPathPrefix+"/", nil))
+	if rec.Code != 200 {
+		t.Errorf("test connection: status %d", rec.Code)
+	}
+
+	var hostnames []string
+	post("/search", `{"target": "hostname"}`, &hostnames)
+	if want := []string{"1a", "1b"}; !reflect.DeepEqual(hostnames, want) {
+		t.Errorf("search hostname = %v, want %v", hostnames, want)
+	}
+	var targets []string
+	post("/search", `{"target": "hostname=1b"}`, &targets)
+	if len(targets) != 1 || !strings.Contains(targets[0], "hostname=1b") {
+		t.Errorf("search targets = %v", targets)
+	}
+	var vars []map[string]string
+	post("/variable", `{"payload": {"target": "region_code"}}`, &vars)
+	if len(vars) != 1 || vars[0]["__value"] != "nyc" {
+		t.Errorf("variable values = %v", vars)
+	}
+
+	var series []grafanaSeries
+	query := fmt.Sprintf(`{"range": {"from": %q, "to": %q}, "intervalMs": 60000, "targets": [{"target": "hostname=1a&timestamp_source=kernel"}]}`,
+		now.Add(-time.Hour).Format(time.RFC3339), now.Add(time.Minute).Format(time.RFC3339))
+	post("/query", query, &series)
+	if len(series) != 1 {
+		t.Fatalf("got %d series, want 1", len(series))
+	}
+	// The median of 1ms, 3ms, and 4ms in a single bucket.
+	if want := [][2]float64{{3, float64(now.Add(-time.Minute).UnixMilli())}}; !reflect.DeepEqual(series[0].Datapoints, want) {
+		t.Errorf("datapoints = %v, want %v", series[0].Datapoints, want)
+	}
+}
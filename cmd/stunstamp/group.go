@@ -0,0 +1,194 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	groupBestRTTMetricName   = "stunstamp_group_best_rtt_ns"
+	groupReachableMetricName = "stunstamp_group_reachable_ratio"
+)
+
+// groupKey contains the stable dimensions for a group-level timeseries. It
+// mirrors resultKey with nodeMeta replaced by the group name and address
+// family, so that composite metrics never mix e.g. kernel and userspace
+// timestamps.
+type groupKey struct {
+	group           string
+	addressFamily   string
+	timestampSource timestampSource
+	connStability   connStability
+	protocol        protocol
+	dstPort         int
+}
+
+type groupAggregate struct {
+	total     int
+	reachable int
+	best      *time.Duration
+}
+
+func addressFamilyOf(meta nodeMeta) string {
+	if meta.addr.Is6() {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// aggregateGroups computes per-group aggregates for results. A result
+// contributes to every group its node is a member of.
+func aggregateGroups(groups []groupConfig, results []result) map[groupKey]*groupAggregate {
+	aggs := make(map[groupKey]*groupAggregate)
+	for _, r := range results {
+		if len(r.key.proxy) > 0 {
+			// Groups describe direct reachability.
+			continue
+		}
+		for i := range groups {
+			g := &groups[i]
+			if !g.matches(r.key.meta) {
+				continue
+			}
+			k := groupKey{
+				group:           g.Name,
+				addressFamily:   addressFamilyOf(r.key.meta),
+				timestampSource: r.key.timestampSource,
+				connStability:   r.key.connStability,
+				protocol:        r.key.protocol,
+				dstPort:         r.key.dstPort,
+			}
+			agg, ok := aggs[k]
+			if !ok {
+				agg = &groupAggregate{}
+				aggs[k] = agg
+			}
+			agg.total++
+			if r.rtt != nil {
+				agg.reachable++
+				if agg.best == nil || *r.rtt < *agg.best {
+					rtt := *r.rtt
+					agg.best = &rtt
+				}
+			}
+		}
+	}
+	return aggs
+}
+
+func groupTimeSeriesLabels(metricName string, k groupKey, instance string) []prompb.Label {
+	labels := []prompb.Label{
+		{Name: "__name__", Value: metricName},
+		{Name: "job", Value: "stunstamp-rw"},
+		{Name: "instance", Value: instance},
+		{Name: "group", Value: k.group},
+		{Name: "address_family", Value: k.addressFamily},
+		{Name: "protocol", Value: string(k.protocol)},
+		{Name: "dst_port", Value: strconv.Itoa(k.dstPort)},
+		{Name: "timestamp_source", Value: k.timestampSource.String()},
+		{Name: "stable_conn", Value: fmt.Sprintf("%v", k.connStability)},
+	}
+	slices.SortFunc(labels, func(a, b prompb.Label) int {
+		// prometheus remote-write spec requires lexicographically sorted label names
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return labels
+}
+
+// groupsToPromTimeSeries returns group-level composite timeseries for the
+// provided results. The groupKeys present in results are added to seen, for
+// staleGroupKeys.
+func groupsToPromTimeSeries(groups []groupConfig, results []result, instance string, at time.Time, seen map[groupKey]bool) []prompb.TimeSeries {
+	aggs := aggregateGroups(groups, results)
+	all := make([]prompb.TimeSeries, 0, len(aggs)*2)
+	for k, agg := range aggs {
+		best := math.NaN()
+		if agg.best != nil {
+			best = float64(*agg.best)
+		}
+		all = append(all, prompb.TimeSeries{
+			Labels:  groupTimeSeriesLabels(groupBestRTTMetricName, k, instance),
+			Samples: []prompb.Sample{{Timestamp: at.UnixMilli(), Value: best}},
+		})
+		all = append(all, prompb.TimeSeries{
+			Labels:  groupTimeSeriesLabels(groupReachableMetricName, k, instance),
+			Samples: []prompb.Sample{{Timestamp: at.UnixMilli(), Value: float64(agg.reachable) / float64(agg.total)}},
+		})
+	}
+	for k := range aggs {
+		seen[k] = true
+	}
+	return all
+}
+
+// staleGroupKeys returns stale markers for the groupKeys in seen that no
+// target in targets contributes to any longer, i.e. whose group was removed,
+// or whose members were removed or no longer probe its protocol and
+// destination port per portsOf, and removes them from seen. Keys merely
+// absent from a window's results, e.g. as their protocol was not due, are
+// kept.
+func staleGroupKeys(seen map[groupKey]bool, groups []groupConfig, targets map[netip.Addr]nodeMeta, portsOf func(nodeMeta) map[protocol][]int, instance string, at time.Time) []prompb.TimeSeries {
+	if len(seen) == 0 {
+		return nil
+	}
+	// live holds the groupKeys with a member, ignoring timestamp source and
+	// conn stability.
+	live := make(map[groupKey]bool)
+	for _, m := range targets {
+		ports := portsOf(m)
+		for i := range groups {
+			if !groups[i].matches(m) {
+				continue
+			}
+			for p, pp := range ports {
+				for _, port := range pp {
+					live[groupKey{
+						group:         groups[i].Name,
+						addressFamily: addressFamilyOf(m),
+						protocol:      p,
+						dstPort:       port,
+					}] = true
+				}
+			}
+		}
+	}
+	var all []prompb.TimeSeries
+	for k := range seen {
+		lk := k
+		lk.timestampSource, lk.connStability = 0, false
+		if !live[lk] {
+			all = append(all, groupStaleMarkers(k, instance, at)...)
+			delete(seen, k)
+		}
+	}
+	return all
+}
+
+func groupStaleMarkers(k groupKey, instance string, at time.Time) []prompb.TimeSeries {
+	samples := []prompb.Sample{
+		{
+			Timestamp: at.UnixMilli(),
+			Value:     math.Float64frombits(staleNaN),
+		},
+	}
+	return []prompb.TimeSeries{
+		{
+			Labels:  groupTimeSeriesLabels(groupBestRTTMetricName, k, instance),
+			Samples: samples,
+		},
+		{
+			Labels:  groupTimeSeriesLabels(groupReachableMetricName, k, instance),
+			Samples: samples,
+		},
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestParseConfigGroups(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			raw: `{
+				// trailing commas and comments are allowed
+				"Groups": [
+					{"Name": "EU DERP", "RegionCodes": ["fra", "ams"]},
+				],
+			}`,
+		},
+		{
+			name:    "no selectors",
+			raw:     `{"Groups": [{"Name": "empty"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "duplicate",
+			raw:     `{"Groups": [{"Name": "a", "RegionIDs": [1]}, {"Name": "a", "RegionIDs": [2]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			raw:     `{"Gruops": []}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig([]byte(tt.raw))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseConfig() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAggregateGroups(t *testing.T) {
+	fra := nodeMeta{regionID: 4, regionCode: "fra", hostname: "derp4a", addr: netip.MustParseAddr("192.0.2.1")}
+	ams := nodeMeta{regionID: 5, regionCode: "ams", hostname: "derp5a", addr: netip.MustParseAddr("192.0.2.2")}
+	nyc := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "derp1a", addr: netip.MustParseAddr("192.0.2.3")}
+	groups := []groupConfig{{Name: "EU DERP", targetSelector: targetSelector{RegionCodes: []string{"fra", "ams"}}}}
+
+	rtt := func(d time.Duration) *time.Duration { return &d }
+	mk := func(meta nodeMeta, d *time.Duration) result {
+		return result{
+			key: resultKey{meta: meta, protocol: protocolSTUN, dstPort: 3478},
+			rtt: d,
+		}
+	}
+	results := []result{
+		mk(fra, rtt(30*time.Millisecond)),
+		mk(ams, nil),
+		mk(nyc, rtt(5*time.Millisecond)),
+	}
+	aggs := aggregateGroups(groups, results)
+	if len(aggs) != 1 {
+		t.Fatalf("got %d aggregates, want 1", len(aggs))
+	}
+	for k, agg := range aggs {
+		if k.group != "EU DERP" || k.addressFamily != "ipv4" {
+			t.Errorf("unexpected key: %+v", k)
+		}
+		if agg.total != 2 || agg.reachable != 1 {
+			t.Errorf("total/reachable = %d/%d, want 2/1", agg.total, agg.reachable)
+		}
+		if agg.best == nil || *agg.best != 30*time.Millisecond {
+			t.Errorf("best = %v, want 30ms", agg.best)
+		}
+	}
+
+	seen := make(map[groupKey]bool)
+	ts := groupsToPromTimeSeries(groups, results, "i", time.Now(), seen)
+	if len(ts) != 2 || len(seen) != 1 {
+		t.Fatalf("got %d timeseries and %d seen, want 2 and 1", len(ts), len(seen))
+	}
+	// A window without members, e.g. as their protocol was not due, keeps
+	// the previous keys.
+	ts = groupsToPromTimeSeries(groups, results[2:], "i", time.Now(), seen)
+	if len(ts) != 0 || len(seen) != 1 {
+		t.Fatalf("got %d timeseries and %d seen, want 0 and 1", len(ts), len(seen))
+	}
+	stunPorts := func(nodeMeta) map[protocol][]int { return map[protocol][]int{protocolSTUN: {3478}} }
+	targets := map[netip.Addr]nodeMeta{fra.addr: fra, nyc.addr: nyc}
+	if ts := staleGroupKeys(seen, groups, targets, stunPorts, "i", time.Now()); len(ts) != 0 || len(seen) != 1 {
+		t.Fatalf("staleGroupKeys() with a member left = %d timeseries and %d seen, want 0 and 1", len(ts), len(seen))
+	}
+	// Removing the port of the remaining member marks the keys stale.
+	httpsPorts := func(nodeMeta) map[protocol][]int { return map[protocol][]int{protocolHTTPS: {443}} }
+	if ts := staleGroupKeys(seen, groups, targets, httpsPorts, "i", time.Now()); len(ts) != 2 || len(seen) != 0 {
+		t.Fatalf("staleGroupKeys() with the port removed = %d timeseries and %d seen, want 2 stale markers and 0", len(ts), len(seen))
+	}
+}
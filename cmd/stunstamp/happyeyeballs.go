@@ -0,0 +1,264 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	happyEyeballsIPv6WonMetricName  = "stunstamp_derp_happy_eyeballs_ipv6_won"
+	happyEyeballsIPv6LeadMetricName = "stunstamp_derp_happy_eyeballs_ipv6_lead_s"
+	happyEyeballsFlipsMetricName    = "stunstamp_derp_happy_eyeballs_flips_total"
+	// happyEyeballsAttemptDelay is the delay before the IPv4 connection
+	// attempt is started if IPv6 has not connected, the Connection Attempt
+	// Delay recommended by RFC 8305.
+	happyEyeballsAttemptDelay = 250 * time.Millisecond
+)
+
+// eventKindHappyEyeballsFlip is a change in the address family that wins the
+// Happy Eyeballs race to a dual-stack target.
+const eventKindHappyEyeballsFlip eventKind = "happy_eyeballs_flip"
+
+// happyEyeballsResult is the outcome of a Happy Eyeballs race to a
+// dual-stack target.
+type happyEyeballsResult struct {
+	meta     nodeMeta // of the target, without an address
+	port     int
+	at       time.Time
+	rtt4     *time.Duration // TCP connect time, nil on failure
+	rtt6     *time.Duration
+	winner   string        // "ipv4" or "ipv6", or empty if both failed
+	ipv6Lead time.Duration // by which IPv6 won, negative if it lost; zero unless both connected
+}
+
+// happyEyeballsWinner returns the outcome of a Happy Eyeballs race (RFC
+// 8305) between connections that take rtt4 and rtt6, nil on failure: IPv6 is
+// attempted first, and IPv4 after happyEyeballsAttemptDelay, or as soon as
+// IPv6 fails. The first connection to complete wins.
+func happyEyeballsWinner(rtt4, rtt6 *time.Duration) (winner string, ipv6Lead time.Duration) {
+	switch {
+	case rtt4 == nil && rtt6 == nil:
+		return "", 0
+	case rtt6 == nil:
+		return "ipv4", 0
+	case rtt4 == nil:
+		return "ipv6", 0
+	}
+	done4 := happyEyeballsAttemptDelay + *rtt4
+	ipv6Lead = done4 - *rtt6
+	if ipv6Lead >= 0 {
+		return "ipv6", ipv6Lead
+	}
+	return "ipv4", ipv6Lead
+}
+
+// measureHappyEyeballs connects to the target over TCP at v4 and v6 at once,
+// timing each, and determines the winner of a Happy Eyeballs race from the
+// connect times, see happyEyeballsWinner. Timing both rather than racing them
+// reveals by how much a family won, and whether the other one connects at
+// all.
+func measureHappyEyeballs(ctx context.Context, meta nodeMeta, v4, v6 netip.AddrPort) happyEyeballsResult {
+	ctx, cancel := context.WithTimeout(ctx, txRxTimeout)
+	defer cancel()
+	connect := func(dst netip.AddrPort) *time.Duration {
+		var d net.Dialer
+		start := time.Now()
+		c, err := d.DialContext(ctx, "tcp", dst.String())
+		if err != nil {
+			probeLog.Debug("error connecting for happy eyeballs", "hostname", meta.hostname, "dst", dst, "err", err)
+			return nil
+		}
+		rtt := time.Since(start)
+		c.Close()
+		return &rtt
+	}
+	r := happyEyeballsResult{meta: meta, port: int(v4.Port()), at: time.Now()}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.rtt4 = connect(v4)
+	}()
+	r.rtt6 = connect(v6)
+	wg.Wait()
+	r.winner, r.ipv6Lead = happyEyeballsWinner(r.rtt4, r.rtt6)
+	return r
+}
+
+// measureAllHappyEyeballs races the families of every dual-stack target, one
+// with both an IPv4 and IPv6 address in targets, on each of its HTTPS ports
+// concurrently.
+func measureAllHappyEyeballs(ctx context.Context, targets map[netip.Addr]nodeMeta, portsFor func(nodeMeta) []int) []happyEyeballsResult {
+	type dualStack struct {
+		v4, v6 nodeMeta
+	}
+	byHost := make(map[nodeMeta]*dualStack)
+	for addr, meta := range targets {
+		k := meta
+		k.addr = netip.Addr{}
+		ds, ok := byHost[k]
+		if !ok {
+			ds = &dualStack{}
+			byHost[k] = ds
+		}
+		if addr.Is4() {
+			ds.v4 = meta
+		} else {
+			ds.v6 = meta
+		}
+	}
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results []happyEyeballsResult
+	)
+	for k, ds := range byHost {
+		if !ds.v4.addr.IsValid() || !ds.v6.addr.IsValid() {
+			continue
+		}
+		for _, port := range portsFor(ds.v4) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r := measureHappyEyeballs(ctx, k, netip.AddrPortFrom(ds.v4.addr, uint16(port)), netip.AddrPortFrom(ds.v6.addr, uint16(port)))
+				mu.Lock()
+				defer mu.Unlock()
+				results = append(results, r)
+			}()
+		}
+	}
+	wg.Wait()
+	return results
+}
+
+// happyEyeballsKey identifies the timeseries of a dual-stack target.
+type happyEyeballsKey struct {
+	meta nodeMeta // without an address
+	port int
+}
+
+// happyEyeballsTracker tracks the family that won the race to every
+// dual-stack target in order to count flips, and the timeseries written. It
+// is not safe for concurrent use.
+type happyEyeballsTracker struct {
+	winner map[happyEyeballsKey]string
+	flips  map[happyEyeballsKey]int
+}
+
+func newHappyEyeballsTracker() *happyEyeballsTracker {
+	return &happyEyeballsTracker{
+		winner: make(map[happyEyeballsKey]string),
+		flips:  make(map[happyEyeballsKey]int),
+	}
+}
+
+func happyEyeballsTimeSeries(metricName string, k happyEyeballsKey, instance string, at time.Time, value float64) prompb.TimeSeries {
+	labels := []prompb.Label{
+		{Name: "__name__", Value: metricName},
+		{Name: "instance", Value: instance},
+		{Name: "job", Value: "stunstamp-rw"},
+		{Name: "region_id", Value: strconv.Itoa(k.meta.regionID)},
+		{Name: "region_code", Value: k.meta.regionCode},
+		{Name: "hostname", Value: k.meta.hostname},
+		{Name: "protocol", Value: string(protocolTCP)},
+		{Name: "dst_port", Value: strconv.Itoa(k.port)},
+	}
+	slices.SortFunc(labels, func(a, b prompb.Label) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return prompb.TimeSeries{
+		Labels:  labels,
+		Samples: []prompb.Sample{{Timestamp: at.UnixMilli(), Value: value}},
+	}
+}
+
+// update records results, counting and recording an event for every target
+// the winning family of which changed. It returns timeseries for results,
+// and stale markers for the targets absent from results.
+func (t *happyEyeballsTracker) update(results []happyEyeballsResult, instance string) []prompb.TimeSeries {
+	var ts []prompb.TimeSeries
+	current := make(map[happyEyeballsKey]bool)
+	for _, r := range results {
+		k := happyEyeballsKey{r.meta, r.port}
+		current[k] = true
+		if _, ok := t.flips[k]; !ok {
+			t.flips[k] = 0
+		}
+		if r.winner == "" {
+			ts = append(ts, happyEyeballsTimeSeries(happyEyeballsFlipsMetricName, k, instance, r.at, float64(t.flips[k])))
+			continue
+		}
+		if prev := t.winner[k]; prev != "" && prev != r.winner {
+			t.flips[k]++
+			text := fmt.Sprintf("Happy Eyeballs to port %d now won by %s, was %s", r.port, r.winner, prev)
+			annotations.annotateAuto(r.at, r.at, r.meta.hostname, text)
+			events.record(event{
+				At:         r.at,
+				Kind:       eventKindHappyEyeballsFlip,
+				RegionID:   r.meta.regionID,
+				RegionCode: r.meta.regionCode,
+				Hostname:   r.meta.hostname,
+				Protocol:   protocolTCP,
+				Attrs: map[string]string{
+					"port":      fmt.Sprint(r.port),
+					"winner":    r.winner,
+					"ipv6_lead": r.ipv6Lead.String(),
+				},
+			})
+		}
+		t.winner[k] = r.winner
+		won := 0.0
+		if r.winner == "ipv6" {
+			won = 1
+		}
+		ts = append(ts,
+			happyEyeballsTimeSeries(happyEyeballsIPv6WonMetricName, k, instance, r.at, won),
+			happyEyeballsTimeSeries(happyEyeballsFlipsMetricName, k, instance, r.at, float64(t.flips[k])),
+		)
+		if r.rtt4 != nil && r.rtt6 != nil {
+			ts = append(ts, happyEyeballsTimeSeries(happyEyeballsIPv6LeadMetricName, k, instance, r.at, r.ipv6Lead.Seconds()))
+		}
+	}
+	now := time.Now()
+	for k := range t.flips {
+		if current[k] {
+			continue
+		}
+		ts = append(ts, happyEyeballsStaleMarkers(k, instance, now)...)
+		delete(t.flips, k)
+		delete(t.winner, k)
+	}
+	return ts
+}
+
+// staleMarkers returns stale markers for the race outcomes of every
+// dual-stack target raced.
+func (t *happyEyeballsTracker) staleMarkers(instance string) []prompb.TimeSeries {
+	now := time.Now()
+	var ts []prompb.TimeSeries
+	for k := range t.flips {
+		ts = append(ts, happyEyeballsStaleMarkers(k, instance, now)...)
+	}
+	return ts
+}
+
+func happyEyeballsStaleMarkers(k happyEyeballsKey, instance string, at time.Time) []prompb.TimeSeries {
+	var ts []prompb.TimeSeries
+	for _, name := range []string{happyEyeballsIPv6WonMetricName, happyEyeballsIPv6LeadMetricName, happyEyeballsFlipsMetricName} {
+		ts = append(ts, happyEyeballsTimeSeries(name, k, instance, at, math.Float64frombits(staleNaN)))
+	}
+	return ts
+}
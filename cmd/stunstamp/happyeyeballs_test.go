@@ -0,0 +1,90 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestHappyEyeballsWinner(t *testing.T) {
+	d := func(ms int) *time.Duration {
+		v := time.Duration(ms) * time.Millisecond
+		return &v
+	}
+	tests := []struct {
+		name       string
+		rtt4, rtt6 *time.Duration
+		winner     string
+		lead       time.Duration
+	}{
+		{name: "both failed"},
+		{name: "v6 failed", rtt4: d(10), winner: "ipv4"},
+		{name: "v4 failed", rtt6: d(10), winner: "ipv6"},
+		{name: "v6 faster", rtt4: d(20), rtt6: d(10), winner: "ipv6", lead: 260 * time.Millisecond},
+		{name: "v6 slower within delay", rtt4: d(10), rtt6: d(200), winner: "ipv6", lead: 60 * time.Millisecond},
+		{name: "v6 slower beyond delay", rtt4: d(10), rtt6: d(300), winner: "ipv4", lead: -40 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			winner, lead := happyEyeballsWinner(tt.rtt4, tt.rtt6)
+			if winner != tt.winner || lead != tt.lead {
+				t.Errorf("happyEyeballsWinner() = %q, %v; want %q, %v", winner, lead, tt.winner, tt.lead)
+			}
+		})
+	}
+}
+
+func TestMeasureHappyEyeballs(t *testing.T) {
+	ln4, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln4.Close()
+	ln6, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	ln6.Close() // refuse IPv6 connections
+
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "derp1a"}
+	port := uint16(ln4.Addr().(*net.TCPAddr).Port)
+	r := measureHappyEyeballs(context.Background(), meta,
+		netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port),
+		netip.AddrPortFrom(netip.IPv6Loopback(), port))
+	if r.rtt4 == nil || r.rtt6 != nil || r.winner != "ipv4" {
+		t.Errorf("measureHappyEyeballs() = rtt4 %v, rtt6 %v, winner %q; want IPv4 only", r.rtt4, r.rtt6, r.winner)
+	}
+}
+
+func TestHappyEyeballsTracker(t *testing.T) {
+	tr := newHappyEyeballsTracker()
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "derp1a"}
+	rtt := time.Millisecond
+	res := func(winner string) happyEyeballsResult {
+		return happyEyeballsResult{meta: meta, port: 443, at: time.Now(), rtt4: &rtt, rtt6: &rtt, winner: winner}
+	}
+	k := happyEyeballsKey{meta, 443}
+	tr.update([]happyEyeballsResult{res("ipv6")}, "test")
+	tr.update([]happyEyeballsResult{res("ipv6")}, "test")
+	if tr.flips[k] != 0 {
+		t.Errorf("flips = %d, want 0", tr.flips[k])
+	}
+	tr.update([]happyEyeballsResult{res("ipv4")}, "test")
+	// Races both families lose do not count.
+	tr.update([]happyEyeballsResult{res("")}, "test")
+	tr.update([]happyEyeballsResult{res("ipv6")}, "test")
+	if tr.flips[k] != 2 {
+		t.Errorf("flips = %d, want 2", tr.flips[k])
+	}
+	if ts := tr.update(nil, "test"); len(ts) != 3 {
+		t.Errorf("update() of vanished target = %d stale markers, want 3", len(ts))
+	}
+	if len(tr.flips) != 0 || len(tr.winner) != 0 {
+		t.Error("vanished target not forgotten")
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// eventKindHealth is a periodic snapshot of stunstamp's own health, see
+// selfHealth.
+const eventKindHealth eventKind = "health"
+
+const (
+	schedulerLagMetricName   = "stunstamp_scheduler_lag_ns"
+	windowDurationMetricName = "stunstamp_window_duration_ns"
+	storeLatencyMetricName   = "stunstamp_store_write_latency_ns"
+	goroutinesMetricName     = "stunstamp_goroutines"
+	rxWakeupsMetricName      = "stunstamp_rx_wakeups_total"
+	rxRecvmsgsMetricName     = "stunstamp_rx_recvmsgs_total"
+	rxErrQueueMetricName     = "stunstamp_rx_errqueue_reads_total"
+	rxSyscallsMetricName     = "stunstamp_rx_syscalls_total"
+	rxSyscallsPerMsgName     = "stunstamp_rx_syscalls_per_message"
+)
+
+// rxStats are counters of the demultiplexed receive path.
+type rxStats struct {
+	wakeups       uint64 // epoll wakeups, or datagrams read by readLoops without epoll
+	recvmsgs      uint64 // messages read, including MSG_ERRQUEUE
+	errQueueReads uint64 // MSG_ERRQUEUE messages read
+	syscalls      uint64 // receive syscalls, including those reading nothing
+}
+
+// syscallsPerMessage returns the receive syscalls per message read since
+// prev, or false if none were read.
+func (s rxStats) syscallsPerMessage(prev rxStats) (float64, bool) {
+	if s.recvmsgs <= prev.recvmsgs {
+		return 0, false
+	}
+	return float64(s.syscalls-prev.syscalls) / float64(s.recvmsgs-prev.recvmsgs), true
+}
+
+// selfHealth is a snapshot of stunstamp's own health at the end of a probe
+// window. It is exported as metrics, and persisted to the store so that gaps
+// or anomalies in results can be explained after the fact, e.g. by a stalled
+// scheduler or a slow disk.
+type selfHealth struct {
+	// schedulerLag is the time between the scheduled start of the window
+	// and the start of probing.
+	schedulerLag time.Duration
+	// windowDuration is the time from the start of probing to the end of
+	// processing results.
+	windowDuration time.Duration
+	results        int
+	goroutines     int
+	// droppedBatches is the number of batches dropped across outputs.
+	droppedBatches uint64
+	// storeLatency is the duration of the last successful store write, or
+	// zero if there is no store.
+	storeLatency time.Duration
+	rx           rxStats
+	rxOK         bool // whether rx is supported on this platform
+	// rxSyscallsPerMsg is the receive syscalls per message read in the
+	// window, valid if rxSyscallsPerMsgOK.
+	rxSyscallsPerMsg   float64
+	rxSyscallsPerMsgOK bool
+}
+
+// newSelfHealth returns a selfHealth for a window scheduled to start at
+// scheduled, which started probing at started and finished at now. prevRX
+// are the receive path counters at the end of the previous window.
+func newSelfHealth(scheduled, started, now time.Time, results int, outs outputs, store *storeBackend, prevRX rxStats) selfHealth {
+	h := selfHealth{
+		schedulerLag:   started.Sub(scheduled),
+		windowDuration: now.Sub(started),
+		results:        results,
+		goroutines:     runtime.NumGoroutine(),
+		droppedBatches: outs.dropped(),
+	}
+	if store != nil {
+		h.storeLatency = time.Duration(store.lastLatency.Load())
+	}
+	h.rx, h.rxOK = getRXStats()
+	if h.rxOK {
+		h.rxSyscallsPerMsg, h.rxSyscallsPerMsgOK = h.rx.syscallsPerMessage(prevRX)
+	}
+	return h
+}
+
+func (h selfHealth) toPromTimeSeries(instance string, at time.Time) []prompb.TimeSeries {
+	ts := []prompb.TimeSeries{
+		instanceTimeSeries(schedulerLagMetricName, instance, at, float64(h.schedulerLag)),
+		instanceTimeSeries(windowDurationMetricName, instance, at, float64(h.windowDuration)),
+		instanceTimeSeries(goroutinesMetricName, instance, at, float64(h.goroutines)),
+	}
+	if h.storeLatency > 0 {
+		ts = append(ts, instanceTimeSeries(storeLatencyMetricName, instance, at, float64(h.storeLatency)))
+	}
+	if h.rxOK {
+		ts = append(ts,
+			instanceTimeSeries(rxWakeupsMetricName, instance, at, float64(h.rx.wakeups)),
+			instanceTimeSeries(rxRecvmsgsMetricName, instance, at, float64(h.rx.recvmsgs)),
+			instanceTimeSeries(rxErrQueueMetricName, instance, at, float64(h.rx.errQueueReads)),
+			instanceTimeSeries(rxSyscallsMetricName, instance, at, float64(h.rx.syscalls)),
+		)
+	}
+	if h.rxSyscallsPerMsgOK {
+		ts = append(ts, instanceTimeSeries(rxSyscallsPerMsgName, instance, at, h.rxSyscallsPerMsg))
+	}
+	return ts
+}
+
+func (h selfHealth) toEvent(at time.Time) event {
+	ev := event{
+		At:   at,
+		Kind: eventKindHealth,
+		Attrs: map[string]string{
+			"scheduler_lag":   h.schedulerLag.String(),
+			"window_duration": h.windowDuration.String(),
+			"results":         strconv.Itoa(h.results),
+			"goroutines":      strconv.Itoa(h.goroutines),
+			"dropped_batches": strconv.FormatUint(h.droppedBatches, 10),
+		},
+	}
+	if h.storeLatency > 0 {
+		ev.Attrs["store_write_latency"] = h.storeLatency.String()
+	}
+	if h.rxOK {
+		ev.Attrs["rx_wakeups"] = strconv.FormatUint(h.rx.wakeups, 10)
+		ev.Attrs["rx_recvmsgs"] = strconv.FormatUint(h.rx.recvmsgs, 10)
+		ev.Attrs["rx_errqueue_reads"] = strconv.FormatUint(h.rx.errQueueReads, 10)
+		ev.Attrs["rx_syscalls"] = strconv.FormatUint(h.rx.syscalls, 10)
+	}
+	if h.rxSyscallsPerMsgOK {
+		ev.Attrs["rx_syscalls_per_message"] = strconv.FormatFloat(h.rxSyscallsPerMsg, 'f', 3, 64)
+	}
+	return ev
+}
+
+// readiness tracks whether stunstamp is producing results, for readiness
+// probes, e.g. by Kubernetes.
+type readiness struct {
+	interval time.Duration
+	// lastWindow is the time the last probe window completed in Unix
+	// nanoseconds, or zero if none has.
+	lastWindow atomic.Int64
+}
+
+// windowDone records the completion of a probe window at at.
+func (r *readiness) windowDone(at time.Time) {
+	r.lastWindow.Store(at.UnixNano())
+}
+
+// check returns an error describing why stunstamp is not ready at now: no
+// probe window has completed yet, e.g. while fetching the DERP map on
+// startup, or the last one completed more than two intervals ago.
+func (r *readiness) check(now time.Time) error {
+	last := r.lastWindow.Load()
+	if last == 0 {
+		return errors.New("no probe window has completed yet")
+	}
+	if since := now.Sub(time.Unix(0, last)); since > 2*r.interval {
+		return fmt.Errorf("last probe window completed %v ago", since.Round(time.Second))
+	}
+	return nil
+}
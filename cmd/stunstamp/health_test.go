@@ -0,0 +1,89 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSelfHealthPersisted(t *testing.T) {
+	dir := t.TempDir()
+	e := &eventRecorder{}
+	e.setStoreDir(dir)
+	defer e.close()
+
+	scheduled := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	started := scheduled.Add(3 * time.Second)
+	now := started.Add(10 * time.Second)
+	sb := &storeBackend{}
+	sb.lastLatency.Store(int64(5 * time.Millisecond))
+	h := newSelfHealth(scheduled, started, now, 42, nil, sb, rxStats{})
+	if h.schedulerLag != 3*time.Second || h.windowDuration != 10*time.Second || h.goroutines < 1 {
+		t.Errorf("unexpected selfHealth: %+v", h)
+	}
+	if got := len(h.toPromTimeSeries("i", now)); got < 4 {
+		t.Errorf("got %d time series, want >= 4", got)
+	}
+
+	e.persist(h.toEvent(now))
+	if got := len(e.recentEvents()); got != 0 {
+		t.Errorf("got %d recent events, want health events to be persisted only", got)
+	}
+	f, err := os.Open(filepath.Join(dir, eventsFilePrefix+now.Format(storeDayLayout)+resultsFileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Fatal("no health event persisted")
+	}
+	var ev event
+	if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Kind != eventKindHealth || ev.Attrs["scheduler_lag"] != "3s" || ev.Attrs["results"] != "42" || ev.Attrs["store_write_latency"] != "5ms" {
+		t.Errorf("unexpected health event: %+v", ev)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	ready := &readiness{interval: time.Minute}
+	mux := (&httpServer{baselines: newBaselineTracker(), ready: ready}).mux()
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+	if got := get("/healthz"); got != 200 {
+		t.Errorf("/healthz status = %d, want 200", got)
+	}
+	if got := get("/readyz"); got != 503 {
+		t.Errorf("/readyz status before first window = %d, want 503", got)
+	}
+	ready.windowDone(time.Now())
+	if got := get("/readyz"); got != 200 {
+		t.Errorf("/readyz status after window = %d, want 200", got)
+	}
+	ready.windowDone(time.Now().Add(-3 * time.Minute))
+	if got := get("/readyz"); got != 503 {
+		t.Errorf("/readyz status after stalled windows = %d, want 503", got)
+	}
+}
+
+func TestRXStatsSyscallsPerMessage(t *testing.T) {
+	prev := rxStats{recvmsgs: 10, syscalls: 20}
+	if got, ok := (rxStats{recvmsgs: 30, syscalls: 25}).syscallsPerMessage(prev); !ok || got != 0.25 {
+		t.Errorf("syscallsPerMessage = %v, %v, want 0.25", got, ok)
+	}
+	if _, ok := (rxStats{recvmsgs: 10, syscalls: 21}).syscallsPerMessage(prev); ok {
+		t.Error("syscallsPerMessage without messages read is valid")
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	hopCountMetricName = "stunstamp_derp_hop_count"
+	// maxHopTTL is the highest TTL (hop limit) sent when measuring hop
+	// count.
+	maxHopTTL = 32
+)
+
+// eventKindHopCountChange is a change in the hop count to a target, e.g.
+// due to a CGNAT re-homing the path.
+const eventKindHopCountChange eventKind = "hop_count_change"
+
+type hopResult struct {
+	meta nodeMeta
+	at   time.Time
+	hops int // zero signifies failure
+}
+
+// measureHopCounts measures the hop count to every target concurrently.
+func measureHopCounts(ctx context.Context, targets map[netip.Addr]nodeMeta) []hopResult {
+	at := time.Now()
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make([]hopResult, 0, len(targets))
+	)
+	for _, meta := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hops, err := measureHopCount(ctx, meta.addr)
+			if err != nil {
+				probeLog.Debug("error measuring hop count", "hostname", meta.hostname, "addr", meta.addr, "err", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			results = append(results, hopResult{meta: meta, at: at, hops: hops})
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// hopTracker tracks the last known hop count of targets in order to
+// detect changes. It is not safe for concurrent use.
+type hopTracker struct {
+	last map[netip.Addr]hopResult // last successful result
+	seen map[nodeMeta]bool        // targets we have written timeseries for
+}
+
+func newHopTracker() *hopTracker {
+	return &hopTracker{
+		last: make(map[netip.Addr]hopResult),
+		seen: make(map[nodeMeta]bool),
+	}
+}
+
+func hopCountTimeSeriesLabels(meta nodeMeta, instance string) []prompb.Label {
+	return timeSeriesLabels(hopCountMetricName, meta, instance, timestampSourceUserspace, unstableConn, protocolICMP, 0)
+}
+
+// update records results, recording an event for every target whose hop
+// count changed. It returns timeseries for results, and stale markers for
+// targets absent from results.
+func (h *hopTracker) update(results []hopResult, instance string) []prompb.TimeSeries {
+	ts := make([]prompb.TimeSeries, 0, len(results))
+	current := make(map[nodeMeta]bool)
+	for _, r := range results {
+		current[r.meta] = true
+		h.seen[r.meta] = true
+		value := math.NaN()
+		if r.hops > 0 {
+			value = float64(r.hops)
+			if prev, ok := h.last[r.meta.addr]; ok && prev.meta == r.meta && prev.hops != r.hops {
+				annotations.annotateAuto(r.at, r.at, r.meta.hostname, fmt.Sprintf("hop count changed from %d to %d", prev.hops, r.hops))
+				events.record(event{
+					At:       r.at,
+					Kind:     eventKindHopCountChange,
+					Addr:     r.meta.addr,
+					Protocol: protocolICMP,
+					Attrs: map[string]string{
+						"previous": strconv.Itoa(prev.hops),
+						"current":  strconv.Itoa(r.hops),
+					},
+				})
+			}
+			h.last[r.meta.addr] = r
+		}
+		ts = append(ts, prompb.TimeSeries{
+			Labels: hopCountTimeSeriesLabels(r.meta, instance),
+			Samples: []prompb.Sample{
+				{
+					Timestamp: r.at.UnixMilli(),
+					Value:     value,
+				},
+			},
+		})
+	}
+	now := time.Now()
+	for meta := range h.seen {
+		if current[meta] {
+			continue
+		}
+		ts = append(ts, hopCountStaleMarker(meta, instance, now))
+		delete(h.seen, meta)
+		if h.last[meta.addr].meta == meta {
+			delete(h.last, meta.addr)
+		}
+	}
+	return ts
+}
+
+// staleMarkers returns stale markers for all targets we have written
+// timeseries for.
+func (h *hopTracker) staleMarkers(instance string) []prompb.TimeSeries {
+	now := time.Now()
+	ts := make([]prompb.TimeSeries, 0, len(h.seen))
+	for meta := range h.seen {
+		ts = append(ts, hopCountStaleMarker(meta, instance, now))
+	}
+	return ts
+}
+
+func hopCountStaleMarker(meta nodeMeta, instance string, at time.Time) prompb.TimeSeries {
+	return prompb.TimeSeries{
+		Labels: hopCountTimeSeriesLabels(meta, instance),
+		Samples: []prompb.Sample{
+			{
+				Timestamp: at.UnixMilli(),
+				Value:     math.Float64frombits(staleNaN),
+			},
+		},
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/netip"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// hopProbeData fingerprints hop count probes.
+var hopProbeData = []byte("stunstamp-hops")
+
+// measureHopCount sends ICMP echo requests to dst with TTLs (hop limits)
+// from 1 through maxHopTTL, and returns the lowest TTL for which an echo
+// reply was received.
+func measureHopCount(ctx context.Context, dst netip.Addr) (int, error) {
+	conn, err := getICMPConn(dst, timestampSourceUserspace, 0)
+	if err != nil {
+		return 0, err
+	}
+	pconn := conn.(*polledConn)
+	defer pconn.Close()
+	// Probes with a TTL below the hop count solicit time exceeded errors
+	// by design.
+	pconn.quietICMPErrors = true
+
+	var (
+		to        unix.Sockaddr
+		reqType   icmp.Type = ipv4.ICMPTypeEcho
+		replyType icmp.Type = ipv4.ICMPTypeEchoReply
+		level               = unix.IPPROTO_IP
+		opt                 = unix.IP_TTL
+	)
+	if dst.Is4() {
+		to = &unix.SockaddrInet4{Addr: dst.As4()}
+	} else {
+		to = &unix.SockaddrInet6{Addr: dst.As16()}
+		reqType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS
+	}
+	proto := reqType.Protocol()
+
+	seqBase := int(rand.Int32N(math.MaxUint16 - maxHopTTL))
+	waiters := make([]*rxWaiter, maxHopTTL)
+	for i := range waiters {
+		seq := seqBase + i
+		waiters[i] = pconn.poller.register(pconn, false, func(b []byte) bool {
+			msg, err := icmp.ParseMessage(proto, b)
+			if err != nil || msg.Type != replyType {
+				return false
+			}
+			body, ok := msg.Body.(*icmp.Echo)
+			return ok && body.Seq == seq && bytes.Equal(body.Data, hopProbeData)
+		})
+		defer pconn.poller.unregister(waiters[i])
+	}
+
+	for i := range maxHopTTL {
+		if err := unix.SetsockoptInt(pconn.fd, level, opt, i+1); err != nil {
+			return 0, fmt.Errorf("error setting TTL: %w", err)
+		}
+		b, err := (&icmp.Message{
+			Type: reqType,
+			Body: &icmp.Echo{Seq: seqBase + i, Data: hopProbeData},
+		}).Marshal(nil)
+		if err != nil {
+			return 0, err
+		}
+		if err := pconn.sendto(b, to); err != nil {
+			return 0, fmt.Errorf("sendto error: %v", err)
+		}
+	}
+
+	// Probes with a TTL below the hop count are never answered with an
+	// echo reply, so we always wait out the timeout.
+	timer := time.NewTimer(time.Until(deadlineWithin(ctx, txRxTimeout)))
+	defer timer.Stop()
+	<-timer.C
+	for i, w := range waiters {
+		select {
+		case <-w.ch:
+			return i + 1, nil
+		default:
+		}
+	}
+	return 0, errors.New("no echo replies")
+}
@@ -0,0 +1,48 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"math"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestHopTracker(t *testing.T) {
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	h := newHopTracker()
+	countChanges := func() int {
+		n := 0
+		for _, ev := range events.recentEvents() {
+			if ev.Kind == eventKindHopCountChange && ev.Addr == meta.addr {
+				n++
+			}
+		}
+		return n
+	}
+	before := countChanges()
+
+	for i, hops := range []int{10, 0, 10, 12} {
+		ts := h.update([]hopResult{{meta: meta, at: time.Now(), hops: hops}}, "test")
+		if len(ts) != 1 {
+			t.Fatalf("update %d: got %d timeseries, want 1", i, len(ts))
+		}
+		if got := ts[0].Samples[0].Value; hops == 0 && !math.IsNaN(got) || hops > 0 && got != float64(hops) {
+			t.Errorf("update %d: got value %v for hops %d", i, got, hops)
+		}
+	}
+	// Only the change from 10 to 12 counts; a failure is not a change.
+	if got := countChanges() - before; got != 1 {
+		t.Errorf("got %d hop count change events, want 1", got)
+	}
+
+	ts := h.update(nil, "test")
+	if len(ts) != 1 || math.Float64bits(ts[0].Samples[0].Value) != staleNaN {
+		t.Errorf("expected a single stale marker for vanished target, got %v", ts)
+	}
+	if len(h.staleMarkers("test")) != 0 {
+		t.Error("vanished target still tracked")
+	}
+}
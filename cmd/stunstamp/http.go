@@ -0,0 +1,506 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"tailscale.com/tsweb"
+)
+
+// httpServer is stunstamp's embedded HTTP server, serving a minimal web UI
+// and the tsweb debug handlers.
+type httpServer struct {
+	instance    string
+	baselines   *baselineTracker
+	store       *resultsStore       // nil if not persisting
+	ready       *readiness          // nil if not probing
+	caps        []capability        // nil if not probing
+	privs       []privilege         // nil if not probing
+	calib       *calibrator         // nil if not probing
+	mesh        *probeMesh          // nil if not meshing
+	relay       *relayPathTracker   // nil if not measuring relay penalties
+	consistency *consistencyTracker // nil if not probing
+	portBlocks  *portBlockTracker   // nil if not probing
+	ab          *abTracker          // nil if not probing
+	intervals   *intervalScheduler  // nil if not probing
+	targets     *targetTracker      // nil if not probing
+	stream      *streamHub          // nil if not probing
+	home        *homeRecommender    // nil if not probing
+	leader      *leaderElector      // nil if not electing a leader
+}
+
+func (s *httpServer) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/{$}", s.serveIndex)
+	mux.HandleFunc("GET /healthz", s.serveHealthz)
+	mux.HandleFunc("GET /readyz", s.serveReadyz)
+	mux.HandleFunc("GET /measurement/{id}", s.serveMeasurement)
+	mux.HandleFunc("GET /api/results", s.serveResults)
+	mux.HandleFunc("GET /api/percentiles", s.servePercentiles)
+	mux.HandleFunc("GET /api/stream", s.serveStream)
+	mux.HandleFunc("GET /api/capabilities", s.serveCapabilities)
+	mux.HandleFunc("GET /api/privileges", s.servePrivileges)
+	mux.HandleFunc("GET /api/calibration", s.serveCalibration)
+	mux.HandleFunc("GET /api/mesh", s.serveMesh)
+	mux.HandleFunc("GET /api/mesh/matrix", s.serveMeshMatrix)
+	mux.HandleFunc("GET /api/peers/paths", s.servePeerPaths)
+	mux.HandleFunc("GET /api/consistency", s.serveConsistency)
+	mux.HandleFunc("GET /api/nat/port-blocks", s.servePortBlocks)
+	mux.HandleFunc("GET /api/ab", s.serveAB)
+	mux.HandleFunc("GET /api/tls-certs", s.serveTLSCerts)
+	mux.HandleFunc("GET /api/clock", s.serveClock)
+	mux.HandleFunc("GET /api/intervals", s.serveIntervals)
+	mux.HandleFunc("GET /api/targets", s.serveTargets)
+	mux.HandleFunc("GET /api/derp-home", s.serveDERPHome)
+	mux.HandleFunc("GET /api/annotations", s.serveGetAnnotations)
+	mux.HandleFunc("POST /api/annotations", s.servePostAnnotation)
+	mux.HandleFunc("DELETE /api/annotations/{id}", s.serveDeleteAnnotation)
+	mux.HandleFunc("GET /api/log-levels", s.serveGetLogLevels)
+	mux.HandleFunc("PUT /api/log-levels", s.servePutLogLevels)
+	mux.HandleFunc("GET /api/leader", s.serveLeader)
+	mux.HandleFunc("GET /api/faults", s.serveGetFaults)
+	mux.HandleFunc("PUT /api/faults", s.servePutFaults)
+	mux.HandleFunc("DELETE /api/faults", s.serveDeleteFaults)
+	s.registerGrafana(mux)
+	tsweb.Debugger(mux)
+	return mux
+}
+
+// serveHealthz serves a liveness probe, succeeding as long as the process is
+// able to serve HTTP.
+func (s *httpServer) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// serveReadyz serves a readiness probe, succeeding once probe windows are
+// completing on schedule, see readiness. Read-only servers are always ready.
+func (s *httpServer) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.ready != nil {
+		if err := s.ready.check(time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("ok\n"))
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><title>stunstamp: {{.Instance}}</title></head>
+<body>
+<h1>stunstamp: {{.Instance}}</h1>
+<h2>Current vs. baseline</h2>
+<p>Baselines are the median of hourly median RTTs for the same local hour-of-day over the previous {{.BaselineDays}} days.</p>
+{{if .Baselines}}
+<table border="1" cellpadding="4">
+<tr><th>Region</th><th>Hostname</th><th>Address</th><th>Protocol</th><th>Port</th><th>Timestamps</th><th>Stable conn</th><th>Current</th><th>Baseline</th><th>Days</th><th>Deviation</th></tr>
+{{range .Baselines}}
+<tr><td>{{.Region}}</td><td>{{.Hostname}}</td><td>{{.Addr}}</td><td>{{.Protocol}}</td><td>{{.DstPort}}</td><td>{{.TimestampSource}}</td><td>{{.StableConn}}</td><td>{{.Current}}</td><td>{{.Baseline}}</td><td>{{.Days}}</td><td>{{.Deviation}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>Not enough history for baselines yet.</p>
+{{end}}
+<h2>Annotations</h2>
+{{if .Annotations}}
+<table border="1" cellpadding="4">
+<tr><th>From</th><th>To</th><th>Source</th><th>Hostname</th><th>Text</th></tr>
+{{range .Annotations}}
+<tr><td>{{.From.Format "2006-01-02 15:04:05Z07:00"}}</td><td>{{.To.Format "2006-01-02 15:04:05Z07:00"}}</td><td>{{.Source}}</td><td>{{.Hostname}}</td><td>{{.Text}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No annotations in the last 24 hours.</p>
+{{end}}
+<h2>Recent events</h2>
+{{if .Events}}
+<table border="1" cellpadding="4">
+<tr><th>Time</th><th>Kind</th><th>Address</th><th>Hostname</th><th>Protocol</th><th>Details</th></tr>
+{{range .Events}}
+<tr><td>{{.At.Format "2006-01-02 15:04:05Z07:00"}}</td><td>{{.Kind}}</td><td>{{.Addr}}</td><td>{{.Hostname}}</td><td>{{.Protocol}}</td><td>{{range $k, $v := .Attrs}}{{$k}}={{$v}} {{end}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No events.</p>
+{{end}}
+</body>
+</html>
+`))
+
+type indexBaselineRow struct {
+	Region          string
+	Hostname        string
+	Addr            string
+	Protocol        protocol
+	DstPort         int
+	TimestampSource string
+	StableConn      bool
+	Current         time.Duration
+	Baseline        time.Duration
+	Days            int
+	Deviation       string
+}
+
+func (s *httpServer) serveIndex(w http.ResponseWriter, r *http.Request) {
+	tsweb.AddBrowserHeaders(w)
+	data := struct {
+		Instance     string
+		BaselineDays int
+		Baselines    []indexBaselineRow
+		Annotations  []annotation
+		Events       []event
+	}{
+		Instance:     s.instance,
+		BaselineDays: baselineDays,
+	}
+	now := time.Now()
+	data.Annotations = annotations.overlapping(now.Add(-defaultAnnotationsQueryRange), now)
+	recent := events.recentEvents()
+	// newest first
+	for i := len(recent) - 1; i >= 0 && len(data.Events) < 50; i-- {
+		data.Events = append(data.Events, recent[i])
+	}
+	for _, st := range s.baselines.statuses() {
+		k := st.key
+		data.Baselines = append(data.Baselines, indexBaselineRow{
+			Region:          fmt.Sprintf("%d (%s)", k.meta.regionID, k.meta.regionCode),
+			Hostname:        k.meta.hostname,
+			Addr:            k.meta.addr.String(),
+			Protocol:        k.protocol,
+			DstPort:         k.dstPort,
+			TimestampSource: k.timestampSource.String(),
+			StableConn:      bool(k.connStability),
+			Current:         st.current.Round(time.Microsecond),
+			Baseline:        st.baseline.Round(time.Microsecond),
+			Days:            st.days,
+			Deviation:       fmt.Sprintf("%+.1f%%", st.deviationPercent()),
+		})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := indexTemplate.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveMeasurement serves the stored result with the ID in the request path
+// as JSON. It is the target of exemplar links.
+func (s *httpServer) serveMeasurement(w http.ResponseWriter, r *http.Request) {
+	if s.store == nil {
+		http.Error(w, "results are not being persisted", http.StatusNotFound)
+		return
+	}
+	sr, ok, err := s.store.findMeasurement(r.PathValue("id"), (baselineDays+1)*24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sr)
+}
+
+// serveGetLogLevels serves the current level of every logging subsystem as a
+// JSON object.
+func (s *httpServer) serveGetLogLevels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentLogLevels())
+}
+
+// servePutLogLevels sets the levels of the logging subsystems in the JSON
+// object request body, e.g. {"probe": "DEBUG"}, and responds like
+// serveGetLogLevels.
+func (s *httpServer) servePutLogLevels(w http.ResponseWriter, r *http.Request) {
+	var levels map[subsystem]slog.Level
+	if err := json.NewDecoder(r.Body).Decode(&levels); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := setLogLevels(levels); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	apiLog.Info("log levels changed", "levels", levels, "remote_addr", r.RemoteAddr)
+	s.serveGetLogLevels(w, r)
+}
+
+// serveCapabilities serves the capabilities detected on startup as a JSON
+// array, see detectCapabilities. Unavailable capabilities hold the reason.
+func (s *httpServer) serveCapabilities(w http.ResponseWriter, r *http.Request) {
+	caps := s.caps
+	if caps == nil {
+		caps = []capability{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(caps)
+}
+
+// serveCalibration serves the latest calibration of the latency floor of this
+// host as JSON, see calibrate.
+func (s *httpServer) serveCalibration(w http.ResponseWriter, r *http.Request) {
+	if s.calib == nil {
+		http.Error(w, "not probing", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.calib.calibration())
+}
+
+// servePrivileges serves the privileges detected on startup as a JSON array,
+// see detectPrivileges. Privileges not held hold their remediation.
+func (s *httpServer) servePrivileges(w http.ResponseWriter, r *http.Request) {
+	privs := s.privs
+	if privs == nil {
+		privs = []privilege{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(privs)
+}
+
+// serveMesh serves the probe mesh as seen by this probe as JSON, including
+// the RTTs of the pairs it probes, see probeMesh.
+func (s *httpServer) serveMesh(w http.ResponseWriter, r *http.Request) {
+	if s.mesh == nil {
+		http.Error(w, "not meshing", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.mesh.status())
+}
+
+// serveMeshMatrix serves the latency matrix of the probe mesh as JSON,
+// aggregated from every member.
+func (s *httpServer) serveMeshMatrix(w http.ResponseWriter, r *http.Request) {
+	if s.mesh == nil {
+		http.Error(w, "not meshing", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.mesh.matrix(ctx, meshHTTPClient))
+}
+
+// servePeerPaths serves the latest direct and DERP-relayed RTTs of every peer
+// as JSON, ordered by relay penalty, see relayPathTracker.
+func (s *httpServer) servePeerPaths(w http.ResponseWriter, r *http.Request) {
+	if s.relay == nil {
+		http.Error(w, "not measuring relay penalties", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.relay.status())
+}
+
+// serveConsistency serves the classification of every target by the
+// consistency of the RTTs of its protocols as JSON, targets with protocol
+// shaping first, see consistencyTracker.
+func (s *httpServer) serveConsistency(w http.ResponseWriter, r *http.Request) {
+	if s.consistency == nil {
+		http.Error(w, "not probing", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.consistency.statuses())
+}
+
+// servePortBlocks serves the port allocation scheme of the NAT on the path
+// to targets as JSON, see portBlockTracker.
+func (s *httpServer) servePortBlocks(w http.ResponseWriter, r *http.Request) {
+	if s.portBlocks == nil {
+		http.Error(w, "not probing", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.portBlocks.inference())
+}
+
+// serveAB serves the statistics of the comparison of the probe profiles of
+// the AB config in the last full window as JSON, see abTracker.
+func (s *httpServer) serveAB(w http.ResponseWriter, r *http.Request) {
+	if s.ab == nil {
+		http.Error(w, "not probing", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.ab.stats())
+}
+
+// serveTLSCerts serves the leaf certificate last presented by every TLS
+// endpoint of targets as JSON, see tlsCertTracker.
+func (s *httpServer) serveTLSCerts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tlsCerts.observations())
+}
+
+// serveIntervals serves the probe interval of every protocol of every target
+// as JSON, see intervalConfig.
+func (s *httpServer) serveIntervals(w http.ResponseWriter, r *http.Request) {
+	if s.intervals == nil {
+		http.Error(w, "not probing", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.intervals.statuses())
+}
+
+// serveClock serves the quality of this host's clock as measured against NTP
+// servers as JSON, see clockQuality.
+func (s *httpServer) serveClock(w http.ResponseWriter, r *http.Request) {
+	q := activeClockQuality.Load()
+	if q == nil {
+		http.Error(w, "not measuring NTP servers", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(q)
+}
+
+const (
+	defaultResultsQueryRange     = time.Hour
+	defaultAnnotationsQueryRange = 24 * time.Hour
+	maxResultsQueryLimit         = 100000
+)
+
+// parseTimeRange returns the RFC 3339 time range in the from and to query
+// parameters of q. to defaults to now, and from to defaultRange before to.
+func parseTimeRange(q url.Values, defaultRange time.Duration) (from, to time.Time, err error) {
+	to = time.Now()
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	from = to.Add(-defaultRange)
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	return from, to, nil
+}
+
+// serveResults serves stored results as newline-delimited JSON, oldest
+// first. Query parameters:
+//
+//   - from, to: RFC 3339 time range, defaulting to the last hour
+//   - hostname, region_code, protocol: optional exact match filters
+//   - limit: maximum number of results, defaulting to and capped at 100000
+func (s *httpServer) serveResults(w http.ResponseWriter, r *http.Request) {
+	if s.store == nil {
+		http.Error(w, "results are not being persisted", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	from, to, err := parseTimeRange(q, defaultResultsQueryRange)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := maxResultsQueryLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxResultsQueryLimit)
+	}
+	hostname, regionCode, proto := q.Get("hostname"), q.Get("region_code"), protocol(q.Get("protocol"))
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	n := 0
+	err = s.store.readRange(from, to, func(sr storedResult) error {
+		if hostname != "" && sr.Hostname != hostname ||
+			regionCode != "" && sr.RegionCode != regionCode ||
+			proto != "" && sr.Protocol != proto {
+			return nil
+		}
+		if n == limit {
+			return errResultsLimit
+		}
+		n++
+		return enc.Encode(sr)
+	})
+	if err != nil && !errors.Is(err, errResultsLimit) {
+		apiLog.Error("error serving results", "err", err)
+	}
+}
+
+var errResultsLimit = errors.New("limit reached")
+
+// serveGetAnnotations serves the annotations overlapping the time range in
+// the from and to query parameters, defaulting to the last 24 hours, as a
+// JSON array ordered by From.
+func (s *httpServer) serveGetAnnotations(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseTimeRange(r.URL.Query(), defaultAnnotationsQueryRange)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	anns := annotations.overlapping(from, to)
+	if anns == nil {
+		anns = []annotation{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(anns)
+}
+
+// servePostAnnotation adds the manual annotation in the JSON request body,
+// e.g. {"From": "2024-07-01T02:00:00Z", "To": "2024-07-01T04:00:00Z",
+// "Text": "ISP maintenance"}, and responds with it including its ID.
+func (s *httpServer) servePostAnnotation(w http.ResponseWriter, r *http.Request) {
+	var a annotation
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.Source = annotationSourceManual
+	a, err := annotations.add(a)
+	if err != nil {
+		http.Error(w, err.Error(), annotationErrStatus(err))
+		return
+	}
+	apiLog.Info("annotation added", "id", a.ID, "text", a.Text, "remote_addr", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// serveDeleteAnnotation deletes the annotation with the ID in the request
+// path.
+func (s *httpServer) serveDeleteAnnotation(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := annotations.remove(id); err != nil {
+		http.Error(w, err.Error(), annotationErrStatus(err))
+		return
+	}
+	apiLog.Info("annotation deleted", "id", id, "remote_addr", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func annotationErrStatus(err error) int {
+	switch {
+	case errors.Is(err, errAnnotationNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errAnnotationsReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, errInvalidAnnotation):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
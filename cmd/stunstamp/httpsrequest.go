@@ -0,0 +1,118 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+	"tailscale.com/util/ctxkey"
+)
+
+// The request of the https protocol unless customized by an
+// httpsRequestConfig: DERP's latency check.
+const (
+	defaultHTTPSMethod = "GET"
+	defaultHTTPSPath   = "/derp/latency-check"
+)
+
+// httpsRequestConfig customizes the request of the https protocol to the
+// selected targets, e.g. to measure the latency of an internal service
+// reached through the CGNAT rather than that of a DERP.
+type httpsRequestConfig struct {
+	targetSelector
+	// Method is the method of the request, GET if empty.
+	Method string `json:",omitempty"`
+	// Path is the path of the request, including any query, or
+	// /derp/latency-check if empty.
+	Path string `json:",omitempty"`
+	// Headers are set on the request, a Host header overriding the
+	// target's address as the request's host.
+	Headers map[string]string `json:",omitempty"`
+	// ExpectStatus are the status codes of successful responses, any 2xx
+	// if empty. Other responses fail the probe.
+	ExpectStatus []int `json:",omitempty"`
+}
+
+func (c *httpsRequestConfig) validate() error {
+	if c.empty() {
+		return errors.New("no selectors")
+	}
+	if c.Method != "" && !httpguts.ValidHeaderFieldName(c.Method) {
+		return fmt.Errorf("invalid method %q", c.Method)
+	}
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("path %q does not start with /", c.Path)
+	}
+	for k, v := range c.Headers {
+		if !httpguts.ValidHeaderFieldName(k) {
+			return fmt.Errorf("invalid header name %q", k)
+		}
+		if !httpguts.ValidHeaderFieldValue(v) {
+			return fmt.Errorf("invalid value of header %q", k)
+		}
+	}
+	for _, code := range c.ExpectStatus {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid expected status %d", code)
+		}
+	}
+	return nil
+}
+
+// httpsRequestFor returns the first of reqs selecting meta, or nil if none
+// does.
+func httpsRequestFor(reqs []httpsRequestConfig, meta nodeMeta) *httpsRequestConfig {
+	for i := range reqs {
+		if reqs[i].matches(meta) {
+			return &reqs[i]
+		}
+	}
+	return nil
+}
+
+// httpsRequestKey is the context key holding the httpsRequestConfig of the
+// target of an https probe, if customized.
+var httpsRequestKey = ctxkey.New("stunstamp.httpsRequest", (*httpsRequestConfig)(nil))
+
+// newHTTPSRequest returns the request of an https probe of dst, as customized
+// by the httpsRequestKey of ctx, if any.
+func newHTTPSRequest(ctx context.Context, dst netip.AddrPort) (*http.Request, error) {
+	c := httpsRequestKey.Value(ctx)
+	method, path := defaultHTTPSMethod, defaultHTTPSPath
+	if c != nil {
+		method = cmp.Or(c.Method, method)
+		path = cmp.Or(c.Path, path)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "https://"+dst.String()+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		for k, v := range c.Headers {
+			if http.CanonicalHeaderKey(k) == "Host" {
+				req.Host = v
+				continue
+			}
+			req.Header.Set(k, v)
+		}
+	}
+	return req, nil
+}
+
+// expectsStatus reports whether code is the status of a successful response
+// to the request of c, which may be nil.
+func (c *httpsRequestConfig) expectsStatus(code int) bool {
+	if c == nil || len(c.ExpectStatus) == 0 {
+		return code/100 == 2
+	}
+	return slices.Contains(c.ExpectStatus, code)
+}
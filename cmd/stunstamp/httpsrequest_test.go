@@ -0,0 +1,64 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+)
+
+func TestNewHTTPSRequest(t *testing.T) {
+	dst := netip.MustParseAddrPort("192.0.2.1:443")
+	req, err := newHTTPSRequest(context.Background(), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "GET" || req.URL.String() != "https://192.0.2.1:443/derp/latency-check" {
+		t.Errorf("default request = %s %s", req.Method, req.URL)
+	}
+	var c *httpsRequestConfig
+	if !c.expectsStatus(204) || c.expectsStatus(301) {
+		t.Error("default request does not expect 2xx alone")
+	}
+
+	cfg, err := parseConfig([]byte(`{
+		"HTTPSRequests": [
+			{"Hostnames": ["svc"], "Method": "HEAD", "Path": "/healthz?full=1", "Headers": {"host": "svc.internal", "Authorization": "Bearer x"}, "ExpectStatus": [200, 401]},
+			{"RegionCodes": ["nyc"], "Path": "/ignored"},
+		],
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = httpsRequestFor(cfg.HTTPSRequests, nodeMeta{regionCode: "nyc", hostname: "svc"})
+	if c == nil || c.Method != "HEAD" {
+		t.Fatalf("httpsRequestFor = %+v, want the first match", c)
+	}
+	if got := httpsRequestFor(cfg.HTTPSRequests, nodeMeta{regionCode: "sfo", hostname: "derp1a"}); got != nil {
+		t.Errorf("httpsRequestFor unselected target = %+v", got)
+	}
+	req, err = newHTTPSRequest(httpsRequestKey.WithValue(context.Background(), c), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "HEAD" || req.URL.String() != "https://192.0.2.1:443/healthz?full=1" || req.Host != "svc.internal" || req.Header.Get("Authorization") != "Bearer x" {
+		t.Errorf("custom request = %s %s, host %q, headers %v", req.Method, req.URL, req.Host, req.Header)
+	}
+	if !c.expectsStatus(401) || c.expectsStatus(204) {
+		t.Error("custom request does not expect 200 and 401 alone")
+	}
+
+	for _, bad := range []string{
+		`{"HTTPSRequests": [{"Path": "/x"}]}`,
+		`{"HTTPSRequests": [{"Hostnames": ["a"], "Method": "GE T"}]}`,
+		`{"HTTPSRequests": [{"Hostnames": ["a"], "Path": "x"}]}`,
+		`{"HTTPSRequests": [{"Hostnames": ["a"], "Headers": {"Bad Name": "x"}}]}`,
+		`{"HTTPSRequests": [{"Hostnames": ["a"], "ExpectStatus": [99]}]}`,
+	} {
+		if _, err := parseConfig([]byte(bad)); err == nil {
+			t.Errorf("parseConfig(%s) unexpectedly succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"unsafe"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+	"tailscale.com/net/stun"
+)
+
+// enableRecvErr enables IP_RECVERR (and IPV6_RECVERR for AF_INET6 sockets) on
+// fd so that ICMP errors triggered by our probes are queued to MSG_ERRQUEUE
+// where the rxPoller can harvest them. It is a no-op for AF_PACKET sockets,
+// which queue tx timestamps without it.
+func enableRecvErr(fd int, domain int) error {
+	if domain == unix.AF_PACKET {
+		return nil
+	}
+	if domain == unix.AF_INET6 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_RECVERR, 1); err != nil {
+			return err
+		}
+	}
+	// IP_RECVERR is also honored by AF_INET6 sockets for traffic to IPv4
+	// (mapped) destinations.
+	return unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_RECVERR, 1)
+}
+
+// icmpError is an ICMP error harvested from MSG_ERRQUEUE.
+type icmpError struct {
+	// dst is the destination of the packet that triggered the error.
+	dst netip.Addr
+	// offender is the address of the node that sent the ICMP error.
+	offender netip.Addr
+	is6      bool
+	typ      uint8
+	code     uint8
+	// payload is the (possibly truncated) payload of the packet that
+	// triggered the error, starting at the transport payload for UDP and at
+	// the ICMP header for ICMP.
+	payload []byte
+}
+
+// parseICMPError returns the ICMP error described by the MSG_ERRQUEUE control
+// messages in oob, if any. from is the name returned by recvmsg, which for
+// MSG_ERRQUEUE is the original destination.
+func parseICMPError(oob []byte, from unix.Sockaddr, payload []byte) (icmpError, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return icmpError{}, false
+	}
+	const eeLen = int(unsafe.Sizeof(unix.SockExtendedErr{}))
+	for _, msg := range msgs {
+		isRecvErr := (msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_RECVERR) ||
+			(msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_RECVERR)
+		if !isRecvErr || len(msg.Data) < eeLen {
+			continue
+		}
+		ee := (*unix.SockExtendedErr)(unsafe.Pointer(&msg.Data[0]))
+		if ee.Origin != unix.SO_EE_ORIGIN_ICMP && ee.Origin != unix.SO_EE_ORIGIN_ICMP6 {
+			// e.g. SO_EE_ORIGIN_TIMESTAMPING for tx timestamps
+			continue
+		}
+		ie := icmpError{
+			dst:      addrFromSockaddr(from),
+			offender: parseOffender(msg.Data[eeLen:]),
+			is6:      ee.Origin == unix.SO_EE_ORIGIN_ICMP6,
+			typ:      ee.Type,
+			code:     ee.Code,
+			payload:  payload,
+		}
+		return ie, true
+	}
+	return icmpError{}, false
+}
+
+func addrFromSockaddr(sa unix.Sockaddr) netip.Addr {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return netip.AddrFrom4(sa.Addr)
+	case *unix.SockaddrInet6:
+		return netip.AddrFrom16(sa.Addr).Unmap()
+	}
+	return netip.Addr{}
+}
+
+// parseOffender parses the SO_EE_OFFENDER sockaddr that follows struct
+// sock_extended_err.
+func parseOffender(b []byte) netip.Addr {
+	if len(b) < 2 {
+		return netip.Addr{}
+	}
+	switch binary.NativeEndian.Uint16(b[:2]) {
+	case unix.AF_INET:
+		// struct sockaddr_in: family(2) port(2) addr(4)
+		if len(b) >= 8 {
+			return netip.AddrFrom4([4]byte(b[4:8]))
+		}
+	case unix.AF_INET6:
+		// struct sockaddr_in6: family(2) port(2) flowinfo(4) addr(16)
+		if len(b) >= 24 {
+			return netip.AddrFrom16([16]byte(b[8:24])).Unmap()
+		}
+	}
+	return netip.Addr{}
+}
+
+// kindName returns a short name for the ICMP error type.
+func (ie icmpError) kindName() string {
+	if ie.is6 {
+		switch ipv6.ICMPType(ie.typ) {
+		case ipv6.ICMPTypeDestinationUnreachable:
+			return "destination_unreachable"
+		case ipv6.ICMPTypePacketTooBig:
+			return "packet_too_big"
+		case ipv6.ICMPTypeTimeExceeded:
+			return "time_exceeded"
+		case ipv6.ICMPTypeParameterProblem:
+			return "parameter_problem"
+		}
+	} else {
+		switch ipv4.ICMPType(ie.typ) {
+		case ipv4.ICMPTypeDestinationUnreachable:
+			return "destination_unreachable"
+		case ipv4.ICMPTypeTimeExceeded:
+			return "time_exceeded"
+		case ipv4.ICMPTypeParameterProblem:
+			return "parameter_problem"
+		}
+	}
+	return "other"
+}
+
+// toEvent returns ie as an event, attributing it to the probe described by
+// the triggering packet's payload where possible.
+func (ie icmpError) toEvent(p protocol) event {
+	attrs := map[string]string{
+		"kind": ie.kindName(),
+		"type": strconv.Itoa(int(ie.typ)),
+		"code": strconv.Itoa(int(ie.code)),
+	}
+	if ie.offender.IsValid() {
+		attrs["offender"] = ie.offender.String()
+	}
+	switch p {
+	case protocolSTUN:
+		if len(ie.payload) >= 20 && stun.Is(ie.payload) {
+			attrs["stun_txid"] = hex.EncodeToString(ie.payload[8:20])
+		}
+	case protocolICMP:
+		proto := 1 // ICMPv4
+		if ie.is6 {
+			proto = 58 // ICMPv6
+		}
+		if m, err := icmp.ParseMessage(proto, ie.payload); err == nil {
+			if echo, ok := m.Body.(*icmp.Echo); ok {
+				attrs["icmp_seq"] = fmt.Sprint(echo.Seq)
+			}
+		}
+	}
+	return event{
+		Kind:     eventKindICMPError,
+		Addr:     ie.dst,
+		Protocol: p,
+		Attrs:    attrs,
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// minProtocolInterval is the minimum interval of intervalConfig. It is below
+// minInterval, as individual protocols, e.g. STUN, are cheap enough to probe
+// every second.
+const minProtocolInterval = time.Second
+
+// intervalConfig holds the probe intervals by protocol of the selected
+// targets, or of all targets if no selectors are set. For every protocol of a
+// target, the first entry matching the target and holding the protocol
+// applies; protocols without one are probed every --interval. Intervals are
+// rounded to multiples of the shortest interval, or of --interval if they
+// are at least --interval, see intervalScheduler.
+type intervalConfig struct {
+	targetSelector
+	// Intervals holds intervals in time.ParseDuration format, e.g.
+	// {"stun": "1s", "https": "30s"}.
+	Intervals map[protocol]string
+}
+
+func (c *intervalConfig) validate() error {
+	for p, s := range c.Intervals {
+		if !slices.Contains(allProtocols, p) {
+			return fmt.Errorf("unknown protocol %q", p)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("protocol %q: %w", p, err)
+		}
+		if d < minProtocolInterval || d > maxBufferDuration {
+			return fmt.Errorf("protocol %q: interval must be >= %s and <= %s", p, minProtocolInterval, maxBufferDuration)
+		}
+	}
+	return nil
+}
+
+// matches reports whether meta is selected by c.
+func (c *intervalConfig) matches(meta nodeMeta) bool {
+	return c.empty() || c.targetSelector.matches(meta)
+}
+
+// intervalFor returns the interval to probe meta with p at, given the
+// default from flags.
+func (c *config) intervalFor(meta nodeMeta, p protocol, def time.Duration) time.Duration {
+	for _, ic := range c.Intervals {
+		if s, ok := ic.Intervals[p]; ok && ic.matches(meta) {
+			d, _ := time.ParseDuration(s) // validated
+			return d
+		}
+	}
+	return def
+}
+
+// tick returns the interval probe windows start at, the shortest of def and
+// all configured intervals.
+func (c *config) tick(def time.Duration) time.Duration {
+	ret := def
+	for _, ic := range c.Intervals {
+		for _, s := range ic.Intervals {
+			d, _ := time.ParseDuration(s) // validated
+			ret = min(ret, d)
+		}
+	}
+	return ret
+}
+
+type intervalKey struct {
+	addr     netip.Addr
+	protocol protocol
+}
+
+// intervalScheduler decides which protocols of every target are due in a
+// probe window, when windows start every tick, the shortest of all
+// intervals. It is safe for concurrent use.
+//
+// Protocols with an interval of at least --interval are only probed in full
+// windows, those in which --interval has elapsed, so that they share the
+// deadline of the window-level measurements, e.g. hop counts, which run in
+// full windows only.
+type intervalScheduler struct {
+	mu        sync.Mutex
+	last      map[intervalKey]time.Time // start of the window last probed in
+	intervals map[intervalKey]time.Duration
+	metas     map[netip.Addr]nodeMeta
+	lastFull  time.Time
+}
+
+func newIntervalScheduler() *intervalScheduler {
+	return &intervalScheduler{
+		last:      make(map[intervalKey]time.Time),
+		intervals: make(map[intervalKey]time.Duration),
+		metas:     make(map[netip.Addr]nodeMeta),
+	}
+}
+
+// intervalElapsed reports whether interval has elapsed between last and at, within
+// half a tick, as windows start at multiples of tick.
+func intervalElapsed(last, at time.Time, interval, tick time.Duration) bool {
+	return last.IsZero() || at.Sub(last) >= interval-tick/2
+}
+
+// full reports whether the window starting at is full, marking it so.
+func (s *intervalScheduler) full(at time.Time, def, tick time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !intervalElapsed(s.lastFull, at, def, tick) {
+		return false
+	}
+	s.lastFull = at
+	return true
+}
+
+// due returns the protocols of every target in targets that are due in the
+// window starting at, marking them probed. protocols returns the protocols of
+// a target. full is whether the window is full, see full.
+func (s *intervalScheduler) due(targets map[netip.Addr]nodeMeta, protocols func(nodeMeta) []protocol, c *config, def, tick time.Duration, full bool, at time.Time) map[intervalKey]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make(map[intervalKey]bool)
+	for addr, meta := range targets {
+		s.metas[addr] = meta
+		for _, p := range protocols(meta) {
+			k := intervalKey{addr, p}
+			interval := c.intervalFor(meta, p, def)
+			s.intervals[k] = interval
+			if interval >= def && !full || !intervalElapsed(s.last[k], at, interval, tick) {
+				continue
+			}
+			s.last[k] = at
+			ret[k] = true
+		}
+	}
+	return ret
+}
+
+// forget drops the adaptive intervals and last probe times of targets for
+// which keep returns false.
+func (s *intervalScheduler) forget(keep func(resultKey) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, meta := range s.metas {
+		if keep(resultKey{meta: meta}) {
+			continue
+		}
+		delete(s.metas, addr)
+		for k := range s.last {
+			if k.addr == addr {
+				delete(s.last, k)
+				delete(s.intervals, k)
+			}
+		}
+	}
+}
+
+// intervalState is the persisted state of a protocol of a target, see
+// probeState.
+type intervalState struct {
+	nodeMetaState
+	Protocol   protocol
+	LastProbed time.Time
+}
+
+// state returns the start of the last full window and the state of every
+// protocol of every target probed, sorted for stable output.
+func (s *intervalScheduler) state() (lastFull time.Time, ret []intervalState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret = make([]intervalState, 0, len(s.last))
+	for k, last := range s.last {
+		ret = append(ret, intervalState{
+			nodeMetaState: nodeMetaStateOf(s.metas[k.addr]),
+			Protocol:      k.protocol,
+			LastProbed:    last,
+		})
+	}
+	slices.SortFunc(ret, func(a, b intervalState) int {
+		return cmp.Or(a.Addr.Compare(b.Addr), cmp.Compare(a.Protocol, b.Protocol))
+	})
+	return s.lastFull, ret
+}
+
+// restore restores the state returned by state before a restart. Intervals
+// are recomputed as targets are next due.
+func (s *intervalScheduler) restore(lastFull time.Time, st []intervalState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastFull = lastFull
+	for _, is := range st {
+		s.metas[is.Addr] = is.meta()
+		s.last[intervalKey{is.Addr, is.Protocol}] = is.LastProbed
+	}
+}
+
+// intervalStatus is the interval of a protocol of a target, as served by the
+// API.
+type intervalStatus struct {
+	Hostname   string
+	Addr       string
+	Protocol   protocol
+	Interval   time.Duration
+	LastProbed time.Time
+}
+
+// statuses returns the interval of every protocol of every target probed.
+func (s *intervalScheduler) statuses() []intervalStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]intervalStatus, 0, len(s.last))
+	for k, last := range s.last {
+		meta := s.metas[k.addr]
+		ret = append(ret, intervalStatus{
+			Hostname:   meta.hostname,
+			Addr:       k.addr.String(),
+			Protocol:   k.protocol,
+			Interval:   s.intervals[k],
+			LastProbed: last,
+		})
+	}
+	slices.SortFunc(ret, func(a, b intervalStatus) int {
+		return cmp.Or(
+			cmp.Compare(a.Hostname, b.Hostname),
+			cmp.Compare(a.Addr, b.Addr),
+			cmp.Compare(a.Protocol, b.Protocol),
+		)
+	})
+	return ret
+}
@@ -0,0 +1,166 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIntervalConfig(t *testing.T) {
+	for _, tt := range []struct {
+		raw     string
+		wantErr string
+	}{
+		{raw: `{"Intervals": [{"Intervals": {"stun": "1s", "https": "30s"}}]}`},
+		{raw: `{"Intervals": [{"Hostnames": ["a"], "Intervals": {"icmp": "5s"}}]}`},
+		{raw: `{"Intervals": [{"Intervals": {"stun": "500ms"}}]}`, wantErr: "interval must be"},
+		{raw: `{"Intervals": [{"Intervals": {"stun": "2h"}}]}`, wantErr: "interval must be"},
+		{raw: `{"Intervals": [{"Intervals": {"stun": "often"}}]}`, wantErr: "invalid duration"},
+		{raw: `{"Intervals": [{"Intervals": {"quic": "1s"}}]}`, wantErr: "unknown protocol"},
+	} {
+		_, err := parseConfig([]byte(tt.raw))
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("parseConfig(%s) = %v", tt.raw, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("parseConfig(%s) = %v, want error containing %q", tt.raw, err, tt.wantErr)
+		}
+	}
+
+	c, err := parseConfig([]byte(`{"Intervals": [
+		{"Hostnames": ["a"], "Intervals": {"stun": "1s"}},
+		{"Intervals": {"stun": "5s", "https": "30s"}},
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := nodeMeta{hostname: "a"}, nodeMeta{hostname: "b"}
+	for _, tt := range []struct {
+		meta nodeMeta
+		p    protocol
+		want time.Duration
+	}{
+		{a, protocolSTUN, time.Second},
+		{a, protocolHTTPS, 30 * time.Second},
+		{b, protocolSTUN, 5 * time.Second},
+		{b, protocolICMP, time.Minute},
+	} {
+		if got := c.intervalFor(tt.meta, tt.p, time.Minute); got != tt.want {
+			t.Errorf("intervalFor(%s, %s) = %v, want %v", tt.meta.hostname, tt.p, got, tt.want)
+		}
+	}
+	if got := c.tick(time.Minute); got != time.Second {
+		t.Errorf("tick = %v, want 1s", got)
+	}
+	if got := (&config{}).tick(time.Minute); got != time.Minute {
+		t.Errorf("tick without intervals = %v, want 1m", got)
+	}
+}
+
+func TestIntervalScheduler(t *testing.T) {
+	c, err := parseConfig([]byte(`{"Intervals": [{"Intervals": {"stun": "1s", "icmp": "5s", "https": "2m"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := nodeMeta{hostname: "a", addr: netip.MustParseAddr("192.0.2.1")}
+	targets := map[netip.Addr]nodeMeta{meta.addr: meta}
+	protocols := func(nodeMeta) []protocol {
+		return []protocol{protocolSTUN, protocolICMP, protocolHTTPS, protocolTCP}
+	}
+	const def, tick = time.Minute, time.Second
+	s := newIntervalScheduler()
+	counts := make(map[protocol]int)
+	fulls := 0
+	start := time.Unix(1700000000, 0)
+	for i := range 300 {
+		// Windows start a few milliseconds late, as with time.Ticker.
+		at := start.Add(time.Duration(i)*tick + time.Duration(i%3)*time.Millisecond)
+		full := s.full(at, def, tick)
+		if full {
+			fulls++
+		}
+		for k := range s.due(targets, protocols, c, def, tick, full, at) {
+			counts[k.protocol]++
+		}
+	}
+	want := map[protocol]int{
+		protocolSTUN:  300,
+		protocolICMP:  60,
+		protocolTCP:   5, // every --interval
+		protocolHTTPS: 3, // every other full window
+	}
+	for p, n := range want {
+		if counts[p] != n {
+			t.Errorf("%s probed in %d windows, want %d", p, counts[p], n)
+		}
+	}
+	if fulls != 5 {
+		t.Errorf("%d full windows, want 5", fulls)
+	}
+
+	if got := s.statuses(); len(got) != 4 || got[0].Protocol != protocolHTTPS || got[0].Interval != 2*time.Minute {
+		t.Errorf("statuses() = %+v", got)
+	}
+	s.forget(func(resultKey) bool { return false })
+	if got := s.statuses(); len(got) != 0 {
+		t.Errorf("statuses() after forget = %+v", got)
+	}
+}
+
+// probeNothingDue calls probeNodes for targets with the due set due, of
+// none of targets' protocols, failing t unless it returns nothing at once.
+func probeNothingDue(t *testing.T, targets map[netip.Addr]nodeMeta, due map[intervalKey]bool) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		results, err := probeNodes(context.Background(), targets, make(map[stableConnKey][2]*connAndMeasureFn), map[protocol][]int{protocolSTUN: {3478}}, nil, func(addr netip.Addr, p protocol) bool {
+			return due[intervalKey{addr, p}]
+		}, nil, nil)
+		if results != nil || err != nil {
+			t.Errorf("probeNodes() = %v, %v; want nil, nil", results, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("probeNodes() with nothing due did not return")
+	}
+}
+
+func TestProbeNodesNothingDue(t *testing.T) {
+	meta := nodeMeta{hostname: "a", addr: netip.MustParseAddr("192.0.2.1")}
+	probeNothingDue(t, map[netip.Addr]nodeMeta{meta.addr: meta}, nil)
+}
+
+func TestTimeoutsKeptAcrossWindowsNotDue(t *testing.T) {
+	meta := nodeMeta{hostname: "a", addr: netip.MustParseAddr("192.0.2.1")}
+	targets := map[netip.Addr]nodeMeta{meta.addr: meta}
+	ports := map[protocol][]int{protocolSTUN: {3478}, protocolHTTPS: {443}}
+	portsOf := func(nodeMeta) map[protocol][]int { return ports }
+	https := resultKey{meta: meta, protocol: protocolHTTPS, dstPort: 443}
+	stun := resultKey{meta: meta, protocol: protocolSTUN, dstPort: 3478}
+	timeouts := make(map[resultKey]uint64)
+	resultsToPromTimeSeries([]result{{key: https}}, "i", timeouts, false)
+	// https is not due in the next window.
+	forgetTimeouts(timeouts, targets, portsOf)
+	resultsToPromTimeSeries([]result{{key: stun}}, "i", timeouts, false)
+	if timeouts[https] != 1 || timeouts[stun] != 1 {
+		t.Fatalf("timeouts = %v, want both counted once", timeouts)
+	}
+
+	delete(ports, protocolHTTPS)
+	forgetTimeouts(timeouts, targets, portsOf)
+	if _, ok := timeouts[https]; ok || timeouts[stun] != 1 {
+		t.Errorf("timeouts after removing https = %v, want stun only", timeouts)
+	}
+	forgetTimeouts(timeouts, nil, portsOf)
+	if len(timeouts) != 0 {
+		t.Errorf("timeouts after removing the target = %v, want none", timeouts)
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"tailscale.com/net/stun"
+	"tailscale.com/tstime"
+)
+
+const (
+	keepaliveRTTMetricName            = "stunstamp_keepalive_rtt_ns"
+	keepaliveTimeoutsMetricName       = "stunstamp_keepalive_timeouts_total"
+	keepaliveMappingChangesMetricName = "stunstamp_keepalive_mapping_changes_total"
+	keepaliveMappingAgeMetricName     = "stunstamp_keepalive_mapping_age_seconds"
+	// keepaliveMinInterval and keepaliveMaxInterval bound the random
+	// interval between keepalives, as tailscaled's magicsock picks it to be
+	// just under 30s, a common UDP NAT timeout.
+	keepaliveMinInterval = 20 * time.Second
+	keepaliveMaxInterval = 26 * time.Second
+	// defaultKeepalivePort is tailscaled's default --port.
+	defaultKeepalivePort = 41641
+)
+
+// eventKindKeepaliveMappingChange is a change of the address a NAT maps the
+// socket of keepaliveEmulator to, as tailscaled would observe it.
+const eventKindKeepaliveMappingChange eventKind = "keepalive_mapping_change"
+
+// keepaliveResult is the outcome of a keepalive to a target.
+type keepaliveResult struct {
+	meta   nodeMeta
+	port   int
+	at     time.Time
+	rtt    *time.Duration // nil on timeout
+	mapped netip.AddrPort // invalid on timeout
+}
+
+// keepaliveEmulator mimics the STUN keepalives of tailscaled's magicsock on
+// an active session, so that the stability of NAT mappings is measured as
+// tailscaled experiences it rather than as stable conns do: a single UDP
+// socket per address family, bound to the same port for the lifetime of the
+// process, from which all STUN targets are probed together every 20 to 26
+// seconds, independently of probe windows. Like magicsock, it falls back to
+// an ephemeral port if the port is taken, e.g. by a co-resident tailscaled.
+// It is safe for concurrent use.
+type keepaliveEmulator struct {
+	conns map[bool]*net.UDPConn // by whether IPv6
+	// hasTargets is closed once targets are first set.
+	hasTargets     chan struct{}
+	hasTargetsOnce sync.Once
+
+	mu      sync.Mutex
+	targets []keepaliveTarget
+	pending map[stun.TxID]keepalivePending
+	results []keepaliveResult
+}
+
+// keepalivePending is a keepalive awaiting its response.
+type keepalivePending struct {
+	result keepaliveResult
+	txAt   time.Time
+}
+
+type keepaliveTarget struct {
+	meta nodeMeta
+	port int
+}
+
+// newKeepaliveEmulator binds the sockets of a keepaliveEmulator to port, or
+// to an ephemeral port if port is taken, for IPv4 and, if ipv6, for IPv6.
+func newKeepaliveEmulator(port int, ipv6 bool) (*keepaliveEmulator, error) {
+	k := &keepaliveEmulator{
+		conns:      make(map[bool]*net.UDPConn),
+		hasTargets: make(chan struct{}),
+		pending:    make(map[stun.TxID]keepalivePending),
+	}
+	networks := map[bool]string{false: "udp4"}
+	if ipv6 {
+		networks[true] = "udp6"
+	}
+	for is6, network := range networks {
+		c, err := net.ListenUDP(network, &net.UDPAddr{Port: port})
+		if err != nil && port != 0 {
+			probeLog.Warn("keepalive emulation port taken, falling back to an ephemeral port as tailscaled does", "network", network, "port", port, "err", err)
+			c, err = net.ListenUDP(network, nil)
+		}
+		if err != nil {
+			k.close()
+			return nil, err
+		}
+		k.conns[is6] = c
+	}
+	return k, nil
+}
+
+// setTargets sets the targets of subsequent keepalives.
+func (k *keepaliveEmulator) setTargets(targets map[netip.Addr]nodeMeta, portsFor func(nodeMeta) []int) {
+	var ts []keepaliveTarget
+	for _, meta := range targets {
+		if k.conns[meta.addr.Is6()] == nil {
+			continue
+		}
+		for _, port := range portsFor(meta) {
+			ts = append(ts, keepaliveTarget{meta, port})
+		}
+	}
+	k.mu.Lock()
+	k.targets = ts
+	k.mu.Unlock()
+	k.hasTargetsOnce.Do(func() { close(k.hasTargets) })
+}
+
+// run sends keepalives until ctx is done, the first as soon as targets are
+// set, as tailscaled does on startup.
+func (k *keepaliveEmulator) run(ctx context.Context) {
+	for _, c := range k.conns {
+		go k.read(c)
+	}
+	select {
+	case <-ctx.Done():
+		return
+	case <-k.hasTargets:
+	}
+	for {
+		k.keepalive()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(tstime.RandomDurationBetween(keepaliveMinInterval, keepaliveMaxInterval)):
+		}
+	}
+}
+
+// keepalive sends a STUN request to every target, and accounts those not
+// answered within txRxTimeout as timeouts.
+func (k *keepaliveEmulator) keepalive() {
+	k.mu.Lock()
+	targets := k.targets
+	k.mu.Unlock()
+	at := time.Now()
+	var txIDs []stun.TxID
+	for _, t := range targets {
+		txID := stun.NewTxID()
+		txIDs = append(txIDs, txID)
+		k.mu.Lock()
+		k.pending[txID] = keepalivePending{
+			result: keepaliveResult{meta: t.meta, port: t.port, at: at},
+			txAt:   time.Now(),
+		}
+		k.mu.Unlock()
+		dst := netip.AddrPortFrom(t.meta.addr, uint16(t.port))
+		if _, err := k.conns[t.meta.addr.Is6()].WriteToUDPAddrPort(stun.Request(txID), dst); err != nil {
+			probeLog.Debug("error sending keepalive", "hostname", t.meta.hostname, "addr", dst, "err", err)
+		}
+	}
+	time.AfterFunc(txRxTimeout, func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		for _, txID := range txIDs {
+			if p, ok := k.pending[txID]; ok {
+				k.results = append(k.results, p.result)
+				delete(k.pending, txID)
+			}
+		}
+	})
+}
+
+// read accounts the responses received on c until it is closed.
+func (k *keepaliveEmulator) read(c *net.UDPConn) {
+	b := make([]byte, 1500)
+	for {
+		n, err := c.Read(b)
+		rxAt := time.Now()
+		if err != nil {
+			return
+		}
+		txID, mapped, err := stun.ParseResponse(b[:n])
+		if err != nil {
+			continue
+		}
+		k.mu.Lock()
+		if p, ok := k.pending[txID]; ok {
+			rtt := rxAt.Sub(p.txAt)
+			p.result.rtt = &rtt
+			p.result.mapped = mapped
+			k.results = append(k.results, p.result)
+			delete(k.pending, txID)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// drain returns and forgets the results of keepalives completed since the
+// last call.
+func (k *keepaliveEmulator) drain() []keepaliveResult {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	ret := k.results
+	k.results = nil
+	return ret
+}
+
+func (k *keepaliveEmulator) close() {
+	for _, c := range k.conns {
+		c.Close()
+	}
+}
+
+// keepaliveKey identifies the timeseries of keepalives to a target.
+type keepaliveKey struct {
+	meta nodeMeta
+	port int
+}
+
+// keepaliveMapping is the address keepalives to a target were last mapped
+// to, and since when.
+type keepaliveMapping struct {
+	addr  netip.AddrPort
+	since time.Time
+}
+
+// keepaliveTracker tracks the mappings of keepalives to every target in
+// order to detect changes, and the counters written. It is not safe for
+// concurrent use.
+type keepaliveTracker struct {
+	mappings map[keepaliveKey]keepaliveMapping
+	changes  map[keepaliveKey]uint64
+	timeouts map[keepaliveKey]uint64
+}
+
+func newKeepaliveTracker() *keepaliveTracker {
+	return &keepaliveTracker{
+		mappings: make(map[keepaliveKey]keepaliveMapping),
+		changes:  make(map[keepaliveKey]uint64),
+		timeouts: make(map[keepaliveKey]uint64),
+	}
+}
+
+func keepaliveTimeSeries(name string, k keepaliveKey, instance string, at time.Time, value float64) prompb.TimeSeries {
+	return prompb.TimeSeries{
+		Labels:  timeSeriesLabels(name, k.meta, instance, timestampSourceUserspace, stableConn, protocolSTUN, k.port),
+		Samples: []prompb.Sample{{Timestamp: at.UnixMilli(), Value: value}},
+	}
+}
+
+// update accounts results, recording an event for every change of a mapping
+// shared by the targets whose keepalives it mapped, and returns timeseries
+// for them.
+func (t *keepaliveTracker) update(results []keepaliveResult, instance string) []prompb.TimeSeries {
+	type change struct{ previous, current netip.AddrPort }
+	changed := make(map[change][]string)
+	var changedAt time.Time
+	var ts []prompb.TimeSeries
+	for _, r := range results {
+		k := keepaliveKey{r.meta, r.port}
+		rtt := math.NaN()
+		if r.rtt == nil {
+			t.timeouts[k]++
+		} else {
+			rtt = float64(*r.rtt)
+			if _, ok := t.timeouts[k]; !ok {
+				t.timeouts[k] = 0
+			}
+			switch m, ok := t.mappings[k]; {
+			case !ok:
+				t.mappings[k] = keepaliveMapping{addr: r.mapped, since: r.at}
+			case m.addr != r.mapped:
+				t.changes[k]++
+				c := change{m.addr, r.mapped}
+				changed[c] = append(changed[c], r.meta.hostname)
+				changedAt = r.at
+				t.mappings[k] = keepaliveMapping{addr: r.mapped, since: r.at}
+			}
+		}
+		ts = append(ts,
+			keepaliveTimeSeries(keepaliveRTTMetricName, k, instance, r.at, rtt),
+			keepaliveTimeSeries(keepaliveTimeoutsMetricName, k, instance, r.at, float64(t.timeouts[k])),
+		)
+		if m, ok := t.mappings[k]; ok {
+			ts = append(ts,
+				keepaliveTimeSeries(keepaliveMappingChangesMetricName, k, instance, r.at, float64(t.changes[k])),
+				keepaliveTimeSeries(keepaliveMappingAgeMetricName, k, instance, r.at, r.at.Sub(m.since).Seconds()),
+			)
+		}
+	}
+	for c, hostnames := range changed {
+		slices.Sort(hostnames)
+		hostnames = slices.Compact(hostnames)
+		annotations.annotateAuto(changedAt, changedAt, "", fmt.Sprintf("keepalive mapping changed from %s to %s", c.previous, c.current))
+		events.record(event{
+			At:       changedAt,
+			Kind:     eventKindKeepaliveMappingChange,
+			Protocol: protocolSTUN,
+			Attrs: map[string]string{
+				"previous":  c.previous.String(),
+				"current":   c.current.String(),
+				"targets":   strconv.Itoa(len(hostnames)),
+				"hostnames": strings.Join(hostnames, ","),
+			},
+		})
+	}
+	return ts
+}
+
+// forget drops the counters and NAT mappings of targets for which keep
+// returns false.
+func (t *keepaliveTracker) forget(keep func(resultKey) bool) {
+	for k := range t.timeouts {
+		if !keep(resultKey{meta: k.meta}) {
+			delete(t.timeouts, k)
+			delete(t.changes, k)
+			delete(t.mappings, k)
+		}
+	}
+}
+
+// staleMarkers returns stale markers for the RTT and NAT mapping series of
+// every target keepalives were emulated to.
+func (t *keepaliveTracker) staleMarkers(instance string) []prompb.TimeSeries {
+	now := time.Now()
+	stale := math.Float64frombits(staleNaN)
+	var ts []prompb.TimeSeries
+	for k := range t.timeouts {
+		for _, name := range []string{keepaliveRTTMetricName, keepaliveTimeoutsMetricName, keepaliveMappingChangesMetricName, keepaliveMappingAgeMetricName} {
+			ts = append(ts, keepaliveTimeSeries(name, k, instance, now, stale))
+		}
+	}
+	return ts
+}
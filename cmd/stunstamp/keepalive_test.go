@@ -0,0 +1,127 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"math"
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/net/stun/stuntest"
+)
+
+func TestKeepaliveEmulator(t *testing.T) {
+	stunAddr, cleanup := stuntest.Serve(t)
+	defer cleanup()
+	k, err := newKeepaliveEmulator(0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.close()
+	for _, c := range k.conns {
+		go k.read(c)
+	}
+	targets := map[netip.Addr]nodeMeta{
+		netip.MustParseAddr("127.0.0.1"): {hostname: "local", addr: netip.MustParseAddr("127.0.0.1")},
+		netip.MustParseAddr("::1"):       {hostname: "local6", addr: netip.MustParseAddr("::1")},
+	}
+	k.setTargets(targets, func(nodeMeta) []int { return []int{stunAddr.Port} })
+	if len(k.targets) != 1 {
+		t.Fatalf("got %d targets, want 1 as IPv6 is disabled", len(k.targets))
+	}
+
+	var mapped []netip.AddrPort
+	for range 2 {
+		k.keepalive()
+		var results []keepaliveResult
+		for deadline := time.Now().Add(txRxTimeout); len(results) == 0 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+			results = k.drain()
+		}
+		if len(results) != 1 {
+			t.Fatalf("got %d results, want 1", len(results))
+		}
+		if results[0].rtt == nil {
+			t.Fatal("got timeout")
+		}
+		mapped = append(mapped, results[0].mapped)
+	}
+	if mapped[0] != mapped[1] || mapped[0].Addr() != netip.MustParseAddr("127.0.0.1") {
+		t.Errorf("got mapped addresses %v, want one stable 127.0.0.1 address", mapped)
+	}
+}
+
+func TestKeepaliveTracker(t *testing.T) {
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	other := nodeMeta{regionID: 2, regionCode: "sfo", hostname: "2a", addr: netip.MustParseAddr("192.0.2.2")}
+	countChanges := func(current netip.AddrPort) int {
+		n := 0
+		for _, ev := range events.recentEvents() {
+			if ev.Kind == eventKindKeepaliveMappingChange && ev.Attrs["current"] == current.String() {
+				n++
+			}
+		}
+		return n
+	}
+	rtt := 10 * time.Millisecond
+	mappedA := netip.MustParseAddrPort("100.64.0.1:41641")
+	mappedB := netip.MustParseAddrPort("100.64.0.2:1024")
+	start := time.Now()
+	results := func(at time.Time, mapped netip.AddrPort) []keepaliveResult {
+		return []keepaliveResult{
+			{meta: meta, port: 3478, at: at, rtt: &rtt, mapped: mapped},
+			{meta: other, port: 3478, at: at, rtt: &rtt, mapped: mapped},
+		}
+	}
+	changesBefore := countChanges(mappedB)
+	kt := newKeepaliveTracker()
+	ts := kt.update(results(start, mappedA), "i")
+	if len(ts) != 8 {
+		t.Fatalf("got %d timeseries, want 8", len(ts))
+	}
+	vs := sloValues(ts[:4])
+	if got := vs[keepaliveRTTMetricName]; got != float64(rtt) {
+		t.Errorf("got RTT %v, want %v", got, float64(rtt))
+	}
+	if got := vs[keepaliveMappingChangesMetricName]; got != 0 {
+		t.Errorf("got %v mapping changes, want 0", got)
+	}
+
+	vs = sloValues(kt.update(results(start.Add(25*time.Second), mappedA), "i")[:4])
+	if got := vs[keepaliveMappingAgeMetricName]; got != 25 {
+		t.Errorf("got mapping age %v, want 25", got)
+	}
+	if n := countChanges(mappedB) - changesBefore; n != 0 {
+		t.Errorf("got %d change events to %v, want 0", n, mappedB)
+	}
+
+	vs = sloValues(kt.update(results(start.Add(50*time.Second), mappedB), "i")[:4])
+	if got := vs[keepaliveMappingChangesMetricName]; got != 1 {
+		t.Errorf("got %v mapping changes, want 1", got)
+	}
+	if got := vs[keepaliveMappingAgeMetricName]; got != 0 {
+		t.Errorf("got mapping age %v after change, want 0", got)
+	}
+	if n := countChanges(mappedB) - changesBefore; n != 1 {
+		t.Errorf("got %d change events to %v, want 1 shared by both targets", n, mappedB)
+	}
+
+	ts = kt.update([]keepaliveResult{{meta: meta, port: 3478, at: start.Add(75 * time.Second)}}, "i")
+	if len(ts) != 4 {
+		t.Fatalf("got %d timeseries on timeout, want 4", len(ts))
+	}
+	vs = sloValues(ts)
+	if got := vs[keepaliveRTTMetricName]; !math.IsNaN(got) {
+		t.Errorf("got RTT %v on timeout, want NaN", got)
+	}
+	if got := vs[keepaliveTimeoutsMetricName]; got != 1 {
+		t.Errorf("got %v timeouts, want 1", got)
+	}
+
+	kt.forget(func(k resultKey) bool { return k.meta == meta })
+	if got := len(kt.staleMarkers("i")); got != 4 {
+		t.Errorf("got %d stale markers after forget, want 4", got)
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"tailscale.com/net/stun"
+)
+
+const (
+	largeUDPLossMetricName = "stunstamp_derp_udp_size_loss_ratio"
+	// largeUDPSize is the UDP payload size of large probes, in the range of
+	// the QUIC and WireGuard packets a path must deliver.
+	largeUDPSize = 1350
+	// largeUDPRounds is the number of probes sent of every size per target
+	// and window.
+	largeUDPRounds = 3
+)
+
+// eventKindLargeUDPBlackhole is a change in whether large UDP packets to a
+// target are dropped while small ones are not, e.g. a CGNAT discarding
+// fragments or packets exceeding its MTU, which breaks QUIC and WireGuard but
+// not STUN.
+const eventKindLargeUDPBlackhole eventKind = "large_udp_blackhole"
+
+const (
+	udpSizeSmall = "small"
+	udpSizeLarge = "large"
+)
+
+// stunAttrPadding is the PADDING STUN attribute (RFC 5780), which STUN
+// servers ignore.
+const stunAttrPadding = 0x0026
+
+// paddedSTUNRequest returns a STUN binding request with transaction ID txID,
+// padded to size bytes with a PADDING attribute. The request is otherwise
+// identical to stun.Request, so that DERP servers answer it.
+func paddedSTUNRequest(txID stun.TxID, size int) []byte {
+	req := stun.Request(txID)
+	const headerLen, fingerprintLen = 20, 8
+	attrs := req[headerLen : len(req)-fingerprintLen] // SOFTWARE
+	padLen := max(size-len(req)-4, 0) &^ 3
+	b := make([]byte, 0, len(req)+4+padLen)
+	b = append(b, req[:headerLen]...)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(req)-headerLen+4+padLen))
+	b = binary.BigEndian.AppendUint16(b, stunAttrPadding)
+	b = binary.BigEndian.AppendUint16(b, uint16(padLen))
+	b = append(b, make([]byte, padLen)...)
+	b = append(b, attrs...)
+	// The FINGERPRINT attribute covers everything preceding it, RFC 5389
+	// Section 15.5.
+	fp := crc32.ChecksumIEEE(b) ^ 0x5354554e
+	b = append(b, req[len(req)-fingerprintLen:len(req)-4]...)
+	return binary.BigEndian.AppendUint32(b, fp)
+}
+
+// largeUDPResult is the outcome of the probes of a size to a target in a
+// window.
+type largeUDPResult struct {
+	meta     nodeMeta
+	port     int
+	size     string
+	at       time.Time
+	sent     int
+	received int
+}
+
+func (r largeUDPResult) lossRatio() float64 {
+	if r.sent == 0 {
+		return math.NaN()
+	}
+	return float64(r.sent-r.received) / float64(r.sent)
+}
+
+// measureLargeUDP sends largeUDPRounds small and large STUN requests, in
+// alternation, to dst over a single socket, and returns the outcome by size.
+// Large IPv4 probes are sent with the don't fragment bit set where supported,
+// as QUIC does, so that they are dropped rather than fragmented by links with
+// a smaller MTU.
+func measureLargeUDP(ctx context.Context, meta nodeMeta, dst netip.AddrPort) ([]largeUDPResult, error) {
+	network := "udp4"
+	if dst.Addr().Is6() {
+		network = "udp6"
+	}
+	c, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if dst.Addr().Is4() {
+		if err := setDontFragment(c, true); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			return nil, err
+		}
+	}
+	deadline := deadlineWithin(ctx, txRxTimeout+largeUDPRounds*2*markingSpacing)
+	if err := c.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	sizes := []string{udpSizeSmall, udpSizeLarge}
+	var (
+		mu       sync.Mutex
+		probes   = make(map[stun.TxID]int) // index into sizes
+		received = make([]int, len(sizes))
+		done     = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		b := make([]byte, 1500)
+		for {
+			n, err := c.Read(b)
+			if err != nil {
+				return
+			}
+			txID, _, err := stun.ParseResponse(b[:n])
+			if err != nil {
+				continue
+			}
+			mu.Lock()
+			if i, ok := probes[txID]; ok {
+				received[i]++
+				delete(probes, txID)
+			}
+			mu.Unlock()
+		}
+	}()
+
+	at := time.Now()
+	sent := make([]int, len(sizes))
+	for range largeUDPRounds {
+		for i, size := range sizes {
+			txID := stun.NewTxID()
+			req := stun.Request(txID)
+			if size == udpSizeLarge {
+				req = paddedSTUNRequest(txID, largeUDPSize)
+			}
+			mu.Lock()
+			probes[txID] = i
+			mu.Unlock()
+			if _, err := c.WriteToUDPAddrPort(req, dst); err != nil {
+				// EMSGSIZE if the local MTU is too small is a loss as
+				// much as a drop in transit.
+				probeLog.Debug("error sending UDP size probe", "hostname", meta.hostname, "size", size, "err", err)
+			}
+			sent[i]++
+			time.Sleep(markingSpacing)
+		}
+	}
+	for {
+		mu.Lock()
+		outstanding := len(probes)
+		mu.Unlock()
+		if outstanding == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(markingSpacing)
+	}
+	c.Close()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	ret := make([]largeUDPResult, len(sizes))
+	for i, size := range sizes {
+		ret[i] = largeUDPResult{meta: meta, port: int(dst.Port()), size: size, at: at, sent: sent[i], received: received[i]}
+	}
+	return ret, nil
+}
+
+// measureAllLargeUDP measures large UDP delivery to every target on each of
+// its STUN ports concurrently.
+func measureAllLargeUDP(ctx context.Context, targets map[netip.Addr]nodeMeta, portsFor func(nodeMeta) []int) []largeUDPResult {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results []largeUDPResult
+	)
+	for _, meta := range targets {
+		for _, port := range portsFor(meta) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rs, err := measureLargeUDP(ctx, meta, netip.AddrPortFrom(meta.addr, uint16(port)))
+				if err != nil {
+					probeLog.Debug("error measuring large UDP delivery", "hostname", meta.hostname, "addr", meta.addr, "port", port, "err", err)
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				results = append(results, rs...)
+			}()
+		}
+	}
+	wg.Wait()
+	return results
+}
+
+// largeUDPKey identifies the timeseries of a probe size to a target.
+type largeUDPKey struct {
+	meta nodeMeta
+	port int
+	size string
+}
+
+// largeUDPTracker tracks the targets large UDP packets are blackholed to in
+// order to detect changes, and the timeseries written. It is not safe for
+// concurrent use.
+type largeUDPTracker struct {
+	blackholed map[stableConnKey]bool
+	seen       map[largeUDPKey]bool
+}
+
+func newLargeUDPTracker() *largeUDPTracker {
+	return &largeUDPTracker{
+		blackholed: make(map[stableConnKey]bool),
+		seen:       make(map[largeUDPKey]bool),
+	}
+}
+
+func largeUDPTimeSeriesLabels(k largeUDPKey, instance string) []prompb.Label {
+	labels := timeSeriesLabels(largeUDPLossMetricName, k.meta, instance, timestampSourceUserspace, unstableConn, protocolSTUN, k.port)
+	labels = append(labels, prompb.Label{
+		Name:  "size",
+		Value: k.size,
+	})
+	slices.SortFunc(labels, func(a, b prompb.Label) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return labels
+}
+
+// update records results, recording an event for every target large UDP
+// packets started or stopped being blackholed to while small ones were
+// answered. It returns timeseries for results, and stale markers for those
+// absent from results.
+func (t *largeUDPTracker) update(results []largeUDPResult, instance string) []prompb.TimeSeries {
+	small := make(map[stableConnKey]largeUDPResult)
+	for _, r := range results {
+		if r.size == udpSizeSmall {
+			small[stableConnKey{r.meta.addr, protocolSTUN, r.port}] = r
+		}
+	}
+	var ts []prompb.TimeSeries
+	current := make(map[largeUDPKey]bool)
+	for _, r := range results {
+		k := largeUDPKey{r.meta, r.port, r.size}
+		current[k] = true
+		t.seen[k] = true
+		ts = append(ts, prompb.TimeSeries{
+			Labels:  largeUDPTimeSeriesLabels(k, instance),
+			Samples: []prompb.Sample{{Timestamp: r.at.UnixMilli(), Value: r.lossRatio()}},
+		})
+		ck := stableConnKey{r.meta.addr, protocolSTUN, r.port}
+		// Loss is only attributable to size if small probes got through.
+		if r.size != udpSizeLarge || small[ck].received == 0 {
+			continue
+		}
+		blackholed := r.received == 0
+		if blackholed == t.blackholed[ck] {
+			continue
+		}
+		t.blackholed[ck] = blackholed
+		text := fmt.Sprintf("%d-byte UDP packets to port %d blackholed while small ones are answered", largeUDPSize, r.port)
+		if !blackholed {
+			text = fmt.Sprintf("%d-byte UDP packets to port %d no longer blackholed", largeUDPSize, r.port)
+		}
+		annotations.annotateAuto(r.at, r.at, r.meta.hostname, text)
+		events.record(event{
+			At:       r.at,
+			Kind:     eventKindLargeUDPBlackhole,
+			Addr:     r.meta.addr,
+			Protocol: protocolSTUN,
+			Attrs: map[string]string{
+				"port":       fmt.Sprint(r.port),
+				"size":       fmt.Sprint(largeUDPSize),
+				"blackholed": fmt.Sprint(blackholed),
+			},
+		})
+	}
+	now := time.Now()
+	for k := range t.seen {
+		if current[k] {
+			continue
+		}
+		ts = append(ts, largeUDPStaleMarker(k, instance, now))
+		delete(t.seen, k)
+		delete(t.blackholed, stableConnKey{k.meta.addr, protocolSTUN, k.port})
+	}
+	return ts
+}
+
+// staleMarkers returns stale markers for the loss of every target and
+// packet size probed.
+func (t *largeUDPTracker) staleMarkers(instance string) []prompb.TimeSeries {
+	now := time.Now()
+	var ts []prompb.TimeSeries
+	for k := range t.seen {
+		ts = append(ts, largeUDPStaleMarker(k, instance, now))
+	}
+	return ts
+}
+
+func largeUDPStaleMarker(k largeUDPKey, instance string, at time.Time) prompb.TimeSeries {
+	return prompb.TimeSeries{
+		Labels:  largeUDPTimeSeriesLabels(k, instance),
+		Samples: []prompb.Sample{{Timestamp: at.UnixMilli(), Value: math.Float64frombits(staleNaN)}},
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"math"
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/net/stun"
+	"tailscale.com/net/stun/stuntest"
+)
+
+func TestPaddedSTUNRequest(t *testing.T) {
+	txID := stun.NewTxID()
+	req := paddedSTUNRequest(txID, largeUDPSize)
+	if len(req) > largeUDPSize || len(req) < largeUDPSize-3 {
+		t.Errorf("got %d-byte request, want about %d bytes", len(req), largeUDPSize)
+	}
+	got, err := stun.ParseBindingRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != txID {
+		t.Errorf("got txID %x, want %x", got, txID)
+	}
+}
+
+func TestMeasureLargeUDP(t *testing.T) {
+	stunAddr, cleanup := stuntest.Serve(t)
+	defer cleanup()
+	meta := nodeMeta{hostname: "local", addr: netip.MustParseAddr("127.0.0.1")}
+	results, err := measureLargeUDP(context.Background(), meta, netip.AddrPortFrom(meta.addr, uint16(stunAddr.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for _, r := range results {
+		if r.sent != largeUDPRounds || r.received != largeUDPRounds {
+			t.Errorf("size %s: sent %d, received %d", r.size, r.sent, r.received)
+		}
+	}
+}
+
+func TestLargeUDPTracker(t *testing.T) {
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	l := newLargeUDPTracker()
+	countBlackholes := func() int {
+		n := 0
+		for _, ev := range events.recentEvents() {
+			if ev.Kind == eventKindLargeUDPBlackhole && ev.Addr == meta.addr {
+				n++
+			}
+		}
+		return n
+	}
+	before := countBlackholes()
+	window := func(small, large int) []largeUDPResult {
+		return []largeUDPResult{
+			{meta: meta, port: 3478, size: udpSizeSmall, at: time.Now(), sent: 3, received: small},
+			{meta: meta, port: 3478, size: udpSizeLarge, at: time.Now(), sent: 3, received: large},
+		}
+	}
+	for i, w := range [][]largeUDPResult{
+		window(3, 3),
+		window(3, 0), // blackholed
+		window(0, 0), // everything dropped, not attributable to size
+		window(3, 0),
+		window(3, 1), // no longer blackholed
+	} {
+		ts := l.update(w, "test")
+		if len(ts) != 2 {
+			t.Fatalf("update %d: got %d timeseries, want 2", i, len(ts))
+		}
+	}
+	if got := countBlackholes() - before; got != 2 {
+		t.Errorf("got %d blackhole events, want 2", got)
+	}
+
+	ts := l.update(nil, "test")
+	if len(ts) != 2 || math.Float64bits(ts[0].Samples[0].Value) != staleNaN {
+		t.Errorf("expected stale markers for vanished target, got %v", ts)
+	}
+	if len(l.staleMarkers("test")) != 0 {
+		t.Error("vanished target still tracked")
+	}
+}
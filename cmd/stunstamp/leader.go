@@ -0,0 +1,370 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"tailscale.com/kube/kubeapi"
+	"tailscale.com/kube/kubeclient"
+)
+
+// leaderMetricName is 1 while an instance with --leader-election is the
+// leader, probing, and 0 while it is the standby.
+const leaderMetricName = "stunstamp_leader"
+
+// leaseSettle is how long an instance acquiring a file lease waits before
+// reading it back, so that of two instances acquiring it concurrently, both
+// observe the same winner.
+const leaseSettle = 250 * time.Millisecond
+
+// leaseRecord is the record of the holder of the lease of a redundant pair of
+// stunstamp instances.
+type leaseRecord struct {
+	Holder    string // identity of the instance, or empty if released
+	RenewedAt time.Time
+	Duration  time.Duration
+}
+
+// expired reports whether the lease is free to be acquired at now.
+func (r leaseRecord) expired(now time.Time) bool {
+	return r.Holder == "" || !now.Before(r.RenewedAt.Add(r.Duration))
+}
+
+// leaseBackend stores the leaseRecord of a redundant pair.
+type leaseBackend interface {
+	// tryAcquire stores rec if the lease is held by rec.Holder or has
+	// expired at now, returning the record in effect afterwards.
+	tryAcquire(ctx context.Context, rec leaseRecord, now time.Time) (leaseRecord, error)
+	// release frees the lease if it is held by holder.
+	release(ctx context.Context, holder string) error
+}
+
+// parseLeaseBackend parses the --leader-election flag value s, one of
+// file:PATH, a file on storage shared by the pair, or kube:NAME, a Secret in
+// the namespace of the pod.
+func parseLeaseBackend(s string) (leaseBackend, error) {
+	kind, arg, ok := strings.Cut(s, ":")
+	if !ok || arg == "" {
+		return nil, fmt.Errorf("%q is not file:PATH or kube:NAME", s)
+	}
+	switch kind {
+	case "file":
+		return &fileLease{path: arg}, nil
+	case "kube":
+		c, err := kubeclient.New()
+		if err != nil {
+			return nil, fmt.Errorf("error creating kube client: %w", err)
+		}
+		return &kubeLease{client: c, name: arg}, nil
+	}
+	return nil, fmt.Errorf("unknown lease backend %q, want file or kube", kind)
+}
+
+// leaderElector elects one of a redundant pair of stunstamp instances at a
+// site to probe, avoiding double load on targets, while the other stands by
+// to take over within a lease duration should the leader fail to renew its
+// lease, avoiding gaps. It is safe for concurrent use.
+type leaderElector struct {
+	backend  leaseBackend
+	identity string
+	lease    time.Duration
+
+	mu      sync.Mutex
+	leader  bool
+	expires time.Time // of our lease, if leader
+	holder  string    // of the last record observed
+	lastErr error
+}
+
+func newLeaderElector(backend leaseBackend, identity string, lease time.Duration) *leaderElector {
+	return &leaderElector{backend: backend, identity: identity, lease: lease}
+}
+
+// leaderIdentity returns the identity of this instance in leader election.
+func leaderIdentity() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}
+
+// run renews or tries to acquire the lease every third of its duration until
+// ctx is done, releasing it then if held, so that the standby takes over at
+// once on a clean shutdown.
+func (e *leaderElector) run(ctx context.Context) {
+	ticker := time.NewTicker(e.lease / 3)
+	defer ticker.Stop()
+	for {
+		e.tick(ctx, time.Now())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if e.isLeader() {
+				releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := e.backend.release(releaseCtx, e.identity); err != nil {
+					probeLog.Error("error releasing leader lease", "err", err)
+				}
+				cancel()
+			}
+			return
+		}
+	}
+}
+
+// tick renews or tries to acquire the lease at now.
+func (e *leaderElector) tick(ctx context.Context, now time.Time) {
+	rec, err := e.backend.tryAcquire(ctx, leaseRecord{Holder: e.identity, RenewedAt: now, Duration: e.lease}, now)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastErr = err
+	if err != nil {
+		// Leadership lapses when the lease expires unrenewed, see
+		// isLeader, as the standby may take over then.
+		probeLog.Warn("error renewing leader lease", "err", err)
+		return
+	}
+	was := e.leader
+	e.leader = rec.Holder == e.identity
+	e.holder = rec.Holder
+	if e.leader {
+		e.expires = rec.RenewedAt.Add(rec.Duration)
+	}
+	switch {
+	case e.leader && !was:
+		probeLog.Info("became leader, probing", "identity", e.identity)
+	case !e.leader && was:
+		probeLog.Warn("lost leadership, standing by", "leader", rec.Holder)
+	}
+}
+
+// isLeader reports whether this instance holds an unexpired lease.
+func (e *leaderElector) isLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leader && !time.Now().Before(e.expires) {
+		probeLog.Warn("leader lease expired unrenewed, standing by", "err", e.lastErr)
+		e.leader = false
+	}
+	return e.leader
+}
+
+// leaderStatus is the leader election status of an instance, as served by
+// the API.
+type leaderStatus struct {
+	Identity  string
+	Leader    bool
+	Holder    string `json:",omitempty"` // of the lease when last observed
+	LastError string `json:",omitempty"`
+}
+
+func (e *leaderElector) status() leaderStatus {
+	leader := e.isLeader()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	st := leaderStatus{Identity: e.identity, Leader: leader, Holder: e.holder}
+	if e.lastErr != nil {
+		st.LastError = e.lastErr.Error()
+	}
+	return st
+}
+
+// toPromTimeSeries returns the leaderMetricName timeseries at at.
+func (e *leaderElector) toPromTimeSeries(instance string, at time.Time) prompb.TimeSeries {
+	var v float64
+	if e.isLeader() {
+		v = 1
+	}
+	return instanceTimeSeries(leaderMetricName, instance, at, v)
+}
+
+// serveLeader serves the leader election status of this instance as JSON,
+// see leaderStatus.
+func (s *httpServer) serveLeader(w http.ResponseWriter, r *http.Request) {
+	if s.leader == nil {
+		http.Error(w, "leader election is disabled, see --leader-election", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.leader.status())
+}
+
+// fileLease is a leaseBackend storing the lease as JSON in a file on storage
+// shared by the pair, e.g. an NFS volume. Writes replace the file atomically,
+// and the last of concurrent writes wins, see leaseSettle.
+type fileLease struct {
+	path string
+}
+
+func (l *fileLease) read() (leaseRecord, error) {
+	var rec leaseRecord
+	b, err := os.ReadFile(l.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return rec, nil
+	}
+	if err != nil {
+		return rec, err
+	}
+	if err := json.Unmarshal(b, &rec); err != nil {
+		// A torn or foreign file is treated as a released lease.
+		probeLog.Warn("ignoring invalid leader lease file", "path", l.path, "err", err)
+		return leaseRecord{}, nil
+	}
+	return rec, nil
+}
+
+// write replaces the lease file with rec. Unlike writeFileAtomic, it writes
+// via a uniquely named temporary file, as the other instance of the pair may
+// be writing concurrently.
+func (l *fileLease) write(rec leaseRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(l.path), "."+filepath.Base(l.path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), l.path)
+}
+
+func (l *fileLease) tryAcquire(ctx context.Context, rec leaseRecord, now time.Time) (leaseRecord, error) {
+	cur, err := l.read()
+	if err != nil {
+		return leaseRecord{}, err
+	}
+	if cur.Holder != rec.Holder && !cur.expired(now) {
+		return cur, nil
+	}
+	if err := l.write(rec); err != nil {
+		return leaseRecord{}, err
+	}
+	if cur.Holder == rec.Holder {
+		return rec, nil
+	}
+	t := time.NewTimer(leaseSettle)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		return leaseRecord{}, ctx.Err()
+	}
+	return l.read()
+}
+
+func (l *fileLease) release(ctx context.Context, holder string) error {
+	cur, err := l.read()
+	if err != nil || cur.Holder != holder {
+		return err
+	}
+	return l.write(leaseRecord{})
+}
+
+// kubeLeaseKey is the key of the Secret data holding a kubeLease.
+const kubeLeaseKey = "lease"
+
+// kubeLease is a leaseBackend storing the lease in a Secret, updated with
+// optimistic concurrency on its resource version, as kubeclient does not
+// support coordination.k8s.io Leases. The pod's service account needs get,
+// create, and update on it.
+type kubeLease struct {
+	client kubeclient.Client
+	name   string
+}
+
+func isKubeConflict(err error) bool {
+	var st *kubeapi.Status
+	return errors.As(err, &st) && st.Code == http.StatusConflict
+}
+
+// get returns the Secret and the lease it holds, or a nil Secret if it does
+// not exist.
+func (l *kubeLease) get(ctx context.Context) (*kubeapi.Secret, leaseRecord, error) {
+	var rec leaseRecord
+	s, err := l.client.GetSecret(ctx, l.name)
+	if kubeclient.IsNotFoundErr(err) {
+		return nil, rec, nil
+	}
+	if err != nil {
+		return nil, rec, err
+	}
+	if b := s.Data[kubeLeaseKey]; len(b) > 0 {
+		if err := json.Unmarshal(b, &rec); err != nil {
+			probeLog.Warn("ignoring invalid leader lease", "secret", l.name, "err", err)
+			rec = leaseRecord{}
+		}
+	}
+	return s, rec, nil
+}
+
+// put stores rec in s, creating it if nil. It fails with a conflict if the
+// Secret changed since s was read.
+func (l *kubeLease) put(ctx context.Context, s *kubeapi.Secret, rec leaseRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return l.client.CreateSecret(ctx, &kubeapi.Secret{
+			ObjectMeta: kubeapi.ObjectMeta{Name: l.name},
+			Data:       map[string][]byte{kubeLeaseKey: b},
+		})
+	}
+	if s.Data == nil {
+		s.Data = make(map[string][]byte)
+	}
+	s.Data[kubeLeaseKey] = b
+	return l.client.UpdateSecret(ctx, s)
+}
+
+func (l *kubeLease) tryAcquire(ctx context.Context, rec leaseRecord, now time.Time) (leaseRecord, error) {
+	s, cur, err := l.get(ctx)
+	if err != nil {
+		return leaseRecord{}, err
+	}
+	if cur.Holder != rec.Holder && !cur.expired(now) {
+		return cur, nil
+	}
+	if err := l.put(ctx, s, rec); err != nil {
+		if !isKubeConflict(err) {
+			return leaseRecord{}, err
+		}
+		// The other instance got there first.
+		_, cur, err := l.get(ctx)
+		return cur, err
+	}
+	return rec, nil
+}
+
+func (l *kubeLease) release(ctx context.Context, holder string) error {
+	s, cur, err := l.get(ctx)
+	if err != nil || s == nil || cur.Holder != holder {
+		return err
+	}
+	err = l.put(ctx, s, leaseRecord{})
+	if isKubeConflict(err) {
+		return nil
+	}
+	return err
+}
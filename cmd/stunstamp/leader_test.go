@@ -0,0 +1,151 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/kube/kubeapi"
+	"tailscale.com/kube/kubeclient"
+)
+
+// testElection checks that of a pair electing a leader via backend a and b,
+// one leads at a time and the other takes over on release and on expiry.
+func testElection(t *testing.T, a, b leaseBackend) {
+	ctx := context.Background()
+	lease := 10 * time.Second
+	ea := newLeaderElector(a, "a", lease)
+	eb := newLeaderElector(b, "b", lease)
+
+	now := time.Now()
+	ea.tick(ctx, now)
+	eb.tick(ctx, now)
+	if !ea.isLeader() || eb.isLeader() {
+		t.Fatalf("leaders = %v, %v, want a alone", ea.isLeader(), eb.isLeader())
+	}
+	if st := eb.status(); st.Holder != "a" {
+		t.Errorf("standby status = %+v, want holder a", st)
+	}
+
+	// Renewals keep a in the lead.
+	now = now.Add(lease / 3)
+	ea.tick(ctx, now)
+	eb.tick(ctx, now)
+	if !ea.isLeader() || eb.isLeader() {
+		t.Fatalf("after renewal, leaders = %v, %v, want a alone", ea.isLeader(), eb.isLeader())
+	}
+
+	// b takes over at once on a's release.
+	if err := a.release(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	eb.tick(ctx, now)
+	ea.tick(ctx, now)
+	if ea.isLeader() || !eb.isLeader() {
+		t.Fatalf("after release, leaders = %v, %v, want b alone", ea.isLeader(), eb.isLeader())
+	}
+
+	// a takes over once b's lease expires unrenewed.
+	ea.tick(ctx, now.Add(lease/2))
+	if ea.isLeader() {
+		t.Fatal("a took over an unexpired lease")
+	}
+	ea.tick(ctx, now.Add(lease))
+	if !ea.isLeader() {
+		t.Fatal("a did not take over an expired lease")
+	}
+	eb.tick(ctx, now.Add(lease))
+	if eb.isLeader() {
+		t.Fatal("b still leads after a took over")
+	}
+}
+
+func TestFileLeaderElection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease")
+	testElection(t, &fileLease{path: path}, &fileLease{path: path})
+}
+
+// fakeSecrets is a kubeclient.Client holding secrets in memory, rejecting
+// updates of stale resource versions as the API server does.
+type fakeSecrets struct {
+	kubeclient.FakeClient
+	mu      sync.Mutex
+	secrets map[string]kubeapi.Secret
+}
+
+func (f *fakeSecrets) GetSecret(ctx context.Context, name string) (*kubeapi.Secret, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.secrets[name]
+	if !ok {
+		return nil, &kubeapi.Status{Code: http.StatusNotFound}
+	}
+	s.Data = maps.Clone(s.Data)
+	return &s, nil
+}
+
+func (f *fakeSecrets) CreateSecret(ctx context.Context, s *kubeapi.Secret) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.secrets[s.Name]; ok {
+		return &kubeapi.Status{Code: http.StatusConflict}
+	}
+	s.ResourceVersion = "1"
+	f.secrets[s.Name] = *s
+	return nil
+}
+
+func (f *fakeSecrets) UpdateSecret(ctx context.Context, s *kubeapi.Secret) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cur, ok := f.secrets[s.Name]
+	if !ok {
+		return &kubeapi.Status{Code: http.StatusNotFound}
+	}
+	if cur.ResourceVersion != s.ResourceVersion {
+		return &kubeapi.Status{Code: http.StatusConflict}
+	}
+	v, _ := strconv.Atoi(cur.ResourceVersion)
+	s.ResourceVersion = strconv.Itoa(v + 1)
+	f.secrets[s.Name] = *s
+	return nil
+}
+
+func TestKubeLeaderElection(t *testing.T) {
+	c := &fakeSecrets{secrets: make(map[string]kubeapi.Secret)}
+	testElection(t, &kubeLease{client: c, name: "stunstamp-leader"}, &kubeLease{client: c, name: "stunstamp-leader"})
+
+	// Of concurrent updates of the same version, one wins.
+	l := &kubeLease{client: c, name: "stunstamp-leader"}
+	s, _, err := l.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := *s
+	stale.Data = maps.Clone(s.Data)
+	if err := l.put(context.Background(), s, leaseRecord{Holder: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.put(context.Background(), &stale, leaseRecord{Holder: "d"}); !isKubeConflict(err) {
+		t.Errorf("stale update err = %v, want conflict", err)
+	}
+}
+
+func TestParseLeaseBackend(t *testing.T) {
+	if b, err := parseLeaseBackend("file:/var/run/stunstamp/lease"); err != nil || b.(*fileLease).path != "/var/run/stunstamp/lease" {
+		t.Errorf("parseLeaseBackend(file) = %v, %v", b, err)
+	}
+	for _, s := range []string{"file", "file:", "etcd:/x"} {
+		if _, err := parseLeaseBackend(s); err == nil {
+			t.Errorf("parseLeaseBackend(%q) unexpectedly succeeded", s)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"tailscale.com/net/netmon"
+)
+
+// eventKindLinkChange is a change of the default route or of an interface
+// going up or down, on which all targets are probed out of cycle, see
+// --probe-on-link-change.
+const eventKindLinkChange eventKind = "link_change"
+
+// linkChange is a change of the links of this host.
+type linkChange struct {
+	at time.Time
+	// changes describe the change, e.g. "default route moved from eth0 to
+	// wwan0".
+	changes []string
+}
+
+// linkChangesOf returns descriptions of the changes from old to new of the
+// default route interface and of non-loopback interfaces going up or down,
+// as e.g. a failover from a fixed line to a cellular backup makes them. It
+// returns nil if old is unknown.
+func linkChangesOf(old, new *netmon.State) []string {
+	if old == nil || new == nil {
+		return nil
+	}
+	var ret []string
+	if old.DefaultRouteInterface != new.DefaultRouteInterface {
+		switch {
+		case old.DefaultRouteInterface == "":
+			ret = append(ret, fmt.Sprintf("default route added via %s", new.DefaultRouteInterface))
+		case new.DefaultRouteInterface == "":
+			ret = append(ret, fmt.Sprintf("default route via %s removed", old.DefaultRouteInterface))
+		default:
+			ret = append(ret, fmt.Sprintf("default route moved from %s to %s", old.DefaultRouteInterface, new.DefaultRouteInterface))
+		}
+	}
+	isUp := func(s *netmon.State, name string) bool {
+		i, ok := s.Interface[name]
+		return ok && i.Interface != nil && !i.IsLoopback() && i.IsUp()
+	}
+	var names []string
+	for name := range old.Interface {
+		names = append(names, name)
+	}
+	for name := range new.Interface {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range slices.Compact(names) {
+		was, is := isUp(old, name), isUp(new, name)
+		switch {
+		case !was && is:
+			ret = append(ret, fmt.Sprintf("interface %s up", name))
+		case was && !is:
+			ret = append(ret, fmt.Sprintf("interface %s down", name))
+		}
+	}
+	return ret
+}
+
+// watchLinkChanges watches for link changes and sends them on the returned
+// channel. Changes not yet received are coalesced. mon must be started by the
+// caller.
+func watchLinkChanges(mon *netmon.Monitor) <-chan linkChange {
+	ch := make(chan linkChange, 1)
+	mon.RegisterChangeCallback(func(d *netmon.ChangeDelta) {
+		changes := linkChangesOf(d.Old, d.New)
+		if len(changes) == 0 {
+			return
+		}
+		c := linkChange{at: time.Now(), changes: changes}
+		for {
+			select {
+			case ch <- c:
+				return
+			case pending := <-ch:
+				c.changes = append(pending.changes, c.changes...)
+			}
+		}
+	})
+	return ch
+}
+
+func (c linkChange) String() string {
+	return strings.Join(c.changes, "; ")
+}
+
+func (c linkChange) event() event {
+	return event{
+		At:    c.at,
+		Kind:  eventKindLinkChange,
+		Attrs: map[string]string{"changes": c.String()},
+	}
+}
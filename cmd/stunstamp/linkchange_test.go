@@ -0,0 +1,51 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"tailscale.com/net/netmon"
+)
+
+func TestLinkChangesOf(t *testing.T) {
+	state := func(defaultRoute string, up ...string) *netmon.State {
+		s := &netmon.State{
+			DefaultRouteInterface: defaultRoute,
+			Interface: map[string]netmon.Interface{
+				"lo":    {Interface: &net.Interface{Name: "lo", Flags: net.FlagUp | net.FlagLoopback}},
+				"eth0":  {Interface: &net.Interface{Name: "eth0"}},
+				"wwan0": {Interface: &net.Interface{Name: "wwan0"}},
+			},
+		}
+		for _, name := range up {
+			s.Interface[name].Interface.Flags |= net.FlagUp
+		}
+		return s
+	}
+
+	for _, tt := range []struct {
+		name     string
+		old, new *netmon.State
+		want     []string
+	}{
+		{"unknown", nil, state("eth0", "eth0"), nil},
+		{"unchanged", state("eth0", "eth0"), state("eth0", "eth0"), nil},
+		{"failover", state("eth0", "eth0"), state("wwan0", "wwan0"), []string{"default route moved from eth0 to wwan0", "interface eth0 down", "interface wwan0 up"}},
+		{"backup up", state("eth0", "eth0"), state("eth0", "eth0", "wwan0"), []string{"interface wwan0 up"}},
+		{"route lost", state("eth0", "eth0"), state("", "eth0"), []string{"default route via eth0 removed"}},
+		{"route added", state("", "eth0"), state("eth0", "eth0"), []string{"default route added via eth0"}},
+	} {
+		if got := linkChangesOf(tt.old, tt.new); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: linkChangesOf = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	c := linkChange{changes: []string{"interface eth0 down", "interface wwan0 up"}}
+	if ev := c.event(); ev.Kind != eventKindLinkChange || ev.Attrs["changes"] != "interface eth0 down; interface wwan0 up" {
+		t.Errorf("event = %+v", ev)
+	}
+}
@@ -0,0 +1,432 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"tailscale.com/net/stun"
+)
+
+const (
+	loadedDefaultRate = 20
+	loadedMaxRate     = 100
+	// loadedTrimmed is the fraction of fastest RTTs the RPM score is the
+	// trimmed mean of, after the IETF draft "Responsiveness under Working
+	// Conditions".
+	loadedTrimmed = 0.9
+)
+
+// loadPhase is the phase of the load generated by a speedtest a sample of
+// loaded latency was probed in.
+type loadPhase string
+
+const (
+	// loadPhaseIdle precedes the load, providing the unloaded baseline.
+	loadPhaseIdle loadPhase = "idle"
+	// loadPhaseRamp is the start of a throughput test, while TCP ramps up
+	// and queues on the bottleneck fill.
+	loadPhaseRamp   loadPhase = "ramp"
+	loadPhaseSteady loadPhase = "steady"
+	// loadPhasePost follows a throughput test, while queues drain.
+	loadPhasePost loadPhase = "post"
+)
+
+var loadPhases = []loadPhase{loadPhaseIdle, loadPhaseRamp, loadPhaseSteady, loadPhasePost}
+
+// loadInterval is a throughput test of a speedtest.
+type loadInterval struct {
+	test       string // e.g. download, if known
+	start, end time.Time
+}
+
+// loadTimeline is the throughput tests of a speedtest, in order.
+type loadTimeline struct {
+	intervals []loadInterval
+	ramp      time.Duration
+}
+
+// phaseAt returns the phase of the load at t.
+func (l *loadTimeline) phaseAt(t time.Time) (loadPhase, string) {
+	if len(l.intervals) == 0 || t.Before(l.intervals[0].start) {
+		return loadPhaseIdle, ""
+	}
+	for _, iv := range l.intervals {
+		if t.Before(iv.start) || !t.Before(iv.end) {
+			continue
+		}
+		if t.Before(iv.start.Add(l.ramp)) {
+			return loadPhaseRamp, iv.test
+		}
+		return loadPhaseSteady, iv.test
+	}
+	return loadPhasePost, ""
+}
+
+// ndt7Event is an event streamed by ndt7-client -format=json.
+type ndt7Event struct {
+	Key   string
+	Value struct {
+		Test string
+	}
+}
+
+// parseSpeedtestOutput copies the output of a speedtest from r to w,
+// returning the throughput tests in it, as delimited by ndt7-client's JSON
+// starting and complete events, with now returning the time of a line.
+// Other speedtests, e.g. librespeed-cli, report nothing before exiting, and
+// yield no intervals.
+func parseSpeedtestOutput(r io.Reader, w io.Writer, now func() time.Time) []loadInterval {
+	var ivs []loadInterval
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Bytes()
+		at := now()
+		fmt.Fprintf(w, "%s\n", line)
+		var ev ndt7Event
+		if json.Unmarshal(line, &ev) != nil || ev.Value.Test == "" {
+			continue
+		}
+		switch ev.Key {
+		case "starting":
+			ivs = append(ivs, loadInterval{test: ev.Value.Test, start: at})
+		case "complete":
+			if n := len(ivs); n > 0 && ivs[n-1].test == ev.Value.Test && ivs[n-1].end.IsZero() {
+				ivs[n-1].end = at
+			}
+		}
+	}
+	return ivs
+}
+
+// loadedSample is a STUN probe sent during a speedtest.
+type loadedSample struct {
+	at  time.Time
+	rtt *time.Duration // nil if lost
+}
+
+// loadedTarget is the STUN server of a target probed during a speedtest.
+type loadedTarget struct {
+	meta nodeMeta
+	dst  netip.AddrPort
+}
+
+// probeLoaded sends STUN probes to dst every interval until ctx is done,
+// returning them once answered or timed out.
+func probeLoaded(ctx context.Context, dst netip.AddrPort, interval time.Duration) ([]loadedSample, error) {
+	network := "udp4"
+	if dst.Addr().Is6() {
+		network = "udp6"
+	}
+	c, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	var (
+		mu      sync.Mutex
+		samples []loadedSample
+		pending = make(map[stun.TxID]int) // index into samples
+		done    = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		b := make([]byte, 1500)
+		for {
+			n, err := c.Read(b)
+			rxAt := time.Now()
+			if err != nil {
+				return
+			}
+			txID, _, err := stun.ParseResponse(b[:n])
+			if err != nil {
+				continue
+			}
+			mu.Lock()
+			if i, ok := pending[txID]; ok {
+				rtt := rxAt.Sub(samples[i].at)
+				samples[i].rtt = &rtt
+				delete(pending, txID)
+			}
+			mu.Unlock()
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ctx.Err() == nil {
+		txID := stun.NewTxID()
+		mu.Lock()
+		pending[txID] = len(samples)
+		samples = append(samples, loadedSample{at: time.Now()})
+		mu.Unlock()
+		if _, err := c.WriteToUDPAddrPort(stun.Request(txID), dst); err != nil {
+			probeLog.Debug("error sending loaded latency probe", "dst", dst, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+	// Probes sent last get as long to be answered as any.
+	for deadline := time.Now().Add(txRxTimeout); time.Now().Before(deadline); {
+		mu.Lock()
+		outstanding := len(pending)
+		mu.Unlock()
+		if outstanding == 0 {
+			break
+		}
+		time.Sleep(interval)
+	}
+	c.Close()
+	<-done
+	mu.Lock()
+	defer mu.Unlock()
+	return samples, nil
+}
+
+// loadedPhaseStats summarize the samples of a target in a phase.
+type loadedPhaseStats struct {
+	Phase   loadPhase
+	Samples int
+	Lost    int
+	P50     time.Duration
+	P90     time.Duration
+	P99     time.Duration
+	// RPM is the responsiveness in round trips per minute: a minute over
+	// the trimmed mean of the fastest 90% of RTTs.
+	RPM float64
+}
+
+// loadedSampleJSON is a sample of a loadedTargetStats.
+type loadedSampleJSON struct {
+	// Offset is the time of the sample since probing started, --idle
+	// before the speedtest.
+	Offset time.Duration
+	Phase  loadPhase
+	Test   string         `json:",omitempty"`
+	RTT    *time.Duration `json:",omitempty"`
+}
+
+// loadedTargetStats are the loaded latency statistics of a target.
+type loadedTargetStats struct {
+	Hostname string
+	Addr     netip.AddrPort
+	Phases   []loadedPhaseStats
+	Samples  []loadedSampleJSON
+}
+
+// loadedStats summarizes samples by the phases of tl, with offsets from
+// start.
+func loadedStats(t loadedTarget, samples []loadedSample, tl *loadTimeline, start time.Time) loadedTargetStats {
+	st := loadedTargetStats{Hostname: t.meta.hostname, Addr: t.dst}
+	byPhase := make(map[loadPhase][]time.Duration)
+	lost := make(map[loadPhase]int)
+	for _, s := range samples {
+		phase, test := tl.phaseAt(s.at)
+		st.Samples = append(st.Samples, loadedSampleJSON{Offset: s.at.Sub(start), Phase: phase, Test: test, RTT: s.rtt})
+		if s.rtt == nil {
+			lost[phase]++
+			continue
+		}
+		byPhase[phase] = append(byPhase[phase], *s.rtt)
+	}
+	for _, phase := range loadPhases {
+		rtts := byPhase[phase]
+		ps := loadedPhaseStats{Phase: phase, Samples: len(rtts) + lost[phase], Lost: lost[phase]}
+		if ps.Samples == 0 {
+			continue
+		}
+		if len(rtts) > 0 {
+			slices.Sort(rtts)
+			at := func(q float64) time.Duration {
+				return rtts[int(float64(len(rtts)-1)*q)]
+			}
+			ps.P50, ps.P90, ps.P99 = at(0.5), at(0.9), at(0.99)
+			var sum time.Duration
+			fastest := rtts[:max(1, int(float64(len(rtts))*loadedTrimmed))]
+			for _, rtt := range fastest {
+				sum += rtt
+			}
+			if mean := sum / time.Duration(len(fastest)); mean > 0 {
+				ps.RPM = float64(time.Minute) / float64(mean)
+			}
+		}
+		st.Phases = append(st.Phases, ps)
+	}
+	return st
+}
+
+// measureLoadedLatency probes targets every interval while running the
+// speedtest command, idle before and after it, returning the statistics of
+// every target. The output of command is copied to w.
+func measureLoadedLatency(ctx context.Context, targets []loadedTarget, command []string, interval, idle, ramp time.Duration, w io.Writer) ([]loadedTargetStats, error) {
+	probeCtx, stopProbing := context.WithCancel(ctx)
+	defer stopProbing()
+	var wg sync.WaitGroup
+	samples := make([][]loadedSample, len(targets))
+	errs := make([]error, len(targets))
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			samples[i], errs[i] = probeLoaded(probeCtx, t.dst, interval)
+		}()
+	}
+	start := time.Now()
+
+	sleep := func(d time.Duration) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+			return nil
+		}
+	}
+	var cmdErr error
+	tl := &loadTimeline{ramp: ramp}
+	if cmdErr = sleep(idle); cmdErr == nil {
+		cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+		cmd.Stderr = os.Stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			stopProbing()
+			wg.Wait()
+			return nil, err
+		}
+		cmdStart := time.Now()
+		if err := cmd.Start(); err != nil {
+			stopProbing()
+			wg.Wait()
+			return nil, err
+		}
+		tl.intervals = parseSpeedtestOutput(stdout, w, time.Now)
+		cmdErr = cmd.Wait()
+		cmdEnd := time.Now()
+		if len(tl.intervals) == 0 {
+			tl.intervals = []loadInterval{{start: cmdStart, end: cmdEnd}}
+		}
+		for i := range tl.intervals {
+			if tl.intervals[i].end.IsZero() {
+				tl.intervals[i].end = cmdEnd
+			}
+		}
+		if cmdErr == nil {
+			cmdErr = sleep(idle)
+		}
+	}
+	stopProbing()
+	wg.Wait()
+	if cmdErr != nil {
+		return nil, fmt.Errorf("speedtest: %w", cmdErr)
+	}
+	var ret []loadedTargetStats
+	for i, t := range targets {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("%s: %w", t.meta.hostname, errs[i])
+		}
+		ret = append(ret, loadedStats(t, samples[i], tl, start))
+	}
+	return ret, nil
+}
+
+// runLoadedLatency implements the loaded-latency subcommand, running a
+// speedtest, e.g. ndt7-client or librespeed-cli, while probing the STUN
+// servers of the selected targets of --derp-map at --rate, and writing the
+// latency of every phase of the load to w: percentiles of RTT and the RPM
+// score, as in the IETF draft "Responsiveness under Working Conditions".
+// The throughput tests of ndt7-client -format=json are phased separately;
+// those of other speedtests span the command.
+func runLoadedLatency(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("loaded-latency", flag.ContinueOnError)
+	hostnames := fs.String("hostnames", "", "comma-separated hostnames of the targets of --derp-map to probe")
+	rate := fs.Int("rate", loadedDefaultRate, "probes per second per target")
+	idle := fs.Duration("idle", 3*time.Second, "duration to probe for before and after the speedtest, providing the idle baseline and the post phase")
+	ramp := fs.Duration("ramp", 2*time.Second, "duration of the ramp phase at the start of every throughput test")
+	jsonOut := fs.Bool("json", false, "write the statistics and every sample as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *hostnames == "" || fs.NArg() < 1 {
+		return errors.New("usage: stunstamp loaded-latency --hostnames=HOST[,HOST...] [--rate=N] [--json] -- SPEEDTEST [ARGS...]")
+	}
+	if *rate < 1 || *rate > loadedMaxRate {
+		return fmt.Errorf("rate must be >= 1 and <= %d", loadedMaxRate)
+	}
+	if *idle < 0 || *ramp < 0 {
+		return errors.New("idle and ramp must not be negative")
+	}
+	ctx := context.Background()
+	dm, err := getDERPMap(ctx, *flagDERPMap)
+	if err != nil {
+		return err
+	}
+	metas := make(map[netip.Addr]nodeMeta)
+	if _, err := nodeMetaFromDERPMap(dm, metas, *flagIPv6); err != nil {
+		return err
+	}
+	stunPorts := derpSTUNPorts(dm)
+	var targets []loadedTarget
+	for _, h := range strings.Split(*hostnames, ",") {
+		h = strings.TrimSpace(h)
+		n := len(targets)
+		for addr, meta := range metas {
+			if meta.hostname != h {
+				continue
+			}
+			if stunPorts[h] == 0 {
+				return fmt.Errorf("%s does not serve STUN", h)
+			}
+			targets = append(targets, loadedTarget{meta: meta, dst: netip.AddrPortFrom(addr, uint16(stunPorts[h]))})
+		}
+		if len(targets) == n {
+			return fmt.Errorf("no target with hostname %q in the DERP map", h)
+		}
+	}
+	slices.SortFunc(targets, func(a, b loadedTarget) int {
+		return cmp.Or(cmp.Compare(a.meta.hostname, b.meta.hostname), a.dst.Compare(b.dst))
+	})
+
+	// The speedtest's output goes to stderr, keeping stdout for statistics.
+	stats, err := measureLoadedLatency(ctx, targets, fs.Args(), time.Second/time.Duration(*rate), *idle, *ramp, os.Stderr)
+	if err != nil {
+		return err
+	}
+	return writeLoadedStats(w, stats, *jsonOut)
+}
+
+// writeLoadedStats writes stats to w as a table, or as JSON, including every
+// sample.
+func writeLoadedStats(w io.Writer, stats []loadedTargetStats, jsonOut bool) error {
+	if jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(stats)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOSTNAME\tADDR\tPHASE\tSAMPLES\tLOST\tP50\tP90\tP99\tRPM")
+	for _, st := range stats {
+		for _, ps := range st.Phases {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%v\t%v\t%v\t%.0f\n", st.Hostname, st.Addr, ps.Phase, ps.Samples, ps.Lost,
+				ps.P50.Round(time.Microsecond), ps.P90.Round(time.Microsecond), ps.P99.Round(time.Microsecond), ps.RPM)
+		}
+	}
+	return tw.Flush()
+}
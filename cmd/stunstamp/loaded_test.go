@@ -0,0 +1,142 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/net/stun/stuntest"
+)
+
+func TestParseSpeedtestOutput(t *testing.T) {
+	const out = `{"Key":"starting","Value":{"Test":"download"}}
+{"Key":"measurement","Value":{"AppInfo":{"NumBytes":1000},"Test":"download"}}
+{"Key":"complete","Value":{"Test":"download"}}
+not json
+{"Key":"starting","Value":{"Test":"upload"}}
+`
+	base := time.Unix(1700000000, 0)
+	var line int
+	now := func() time.Time {
+		line++
+		return base.Add(time.Duration(line) * time.Second)
+	}
+	var echoed bytes.Buffer
+	ivs := parseSpeedtestOutput(strings.NewReader(out), &echoed, now)
+	if echoed.String() != out {
+		t.Errorf("echoed %q, want the output", echoed.String())
+	}
+	if len(ivs) != 2 || ivs[0].test != "download" || !ivs[0].start.Equal(base.Add(time.Second)) || !ivs[0].end.Equal(base.Add(3*time.Second)) {
+		t.Fatalf("intervals = %+v", ivs)
+	}
+	// Upload never completed; the caller ends it when the command exits.
+	if ivs[1].test != "upload" || !ivs[1].end.IsZero() {
+		t.Errorf("upload = %+v", ivs[1])
+	}
+}
+
+func TestLoadTimelinePhases(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	at := func(s float64) time.Time { return base.Add(time.Duration(s * float64(time.Second))) }
+	tl := &loadTimeline{ramp: 2 * time.Second, intervals: []loadInterval{
+		{test: "download", start: at(10), end: at(20)},
+		{test: "upload", start: at(21), end: at(31)},
+	}}
+	for _, tt := range []struct {
+		s     float64
+		phase loadPhase
+		test  string
+	}{
+		{0, loadPhaseIdle, ""},
+		{10, loadPhaseRamp, "download"},
+		{11.9, loadPhaseRamp, "download"},
+		{12, loadPhaseSteady, "download"},
+		{20.5, loadPhasePost, ""},
+		{22, loadPhaseRamp, "upload"},
+		{30, loadPhaseSteady, "upload"},
+		{31, loadPhasePost, ""},
+	} {
+		if phase, test := tl.phaseAt(at(tt.s)); phase != tt.phase || test != tt.test {
+			t.Errorf("phaseAt(%vs) = %s, %q, want %s, %q", tt.s, phase, test, tt.phase, tt.test)
+		}
+	}
+}
+
+func TestLoadedStats(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	tl := &loadTimeline{intervals: []loadInterval{{start: base.Add(10 * time.Second), end: base.Add(20 * time.Second)}}}
+	ms := func(v int) *time.Duration {
+		d := time.Duration(v) * time.Millisecond
+		return &d
+	}
+	var samples []loadedSample
+	for i := range 10 {
+		samples = append(samples, loadedSample{at: base.Add(time.Duration(i) * time.Second), rtt: ms(10)})
+	}
+	for i := range 10 {
+		rtt := ms(100)
+		if i == 9 {
+			rtt = ms(1000) // trimmed
+		}
+		samples = append(samples, loadedSample{at: base.Add(time.Duration(10+i) * time.Second), rtt: rtt})
+	}
+	samples = append(samples, loadedSample{at: base.Add(25 * time.Second)})
+
+	st := loadedStats(loadedTarget{meta: nodeMeta{hostname: "1a"}}, samples, tl, base)
+	if len(st.Phases) != 3 || len(st.Samples) != len(samples) {
+		t.Fatalf("stats = %+v, want idle, steady, and post", st.Phases)
+	}
+	idle, steady, post := st.Phases[0], st.Phases[1], st.Phases[2]
+	if idle.Phase != loadPhaseIdle || idle.Samples != 10 || idle.P50 != 10*time.Millisecond || idle.RPM != 6000 {
+		t.Errorf("idle = %+v, want 6000 RPM", idle)
+	}
+	if steady.Phase != loadPhaseSteady || steady.P50 != 100*time.Millisecond || steady.P99 != 100*time.Millisecond || steady.RPM != 600 {
+		t.Errorf("steady = %+v, want 600 RPM", steady)
+	}
+	if post.Phase != loadPhasePost || post.Samples != 1 || post.Lost != 1 || post.RPM != 0 {
+		t.Errorf("post = %+v, want a loss", post)
+	}
+}
+
+func TestMeasureLoadedLatency(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	stunAddr, cleanup := stuntest.Serve(t)
+	defer cleanup()
+	meta := nodeMeta{hostname: "local", addr: netip.MustParseAddr("127.0.0.1")}
+	targets := []loadedTarget{{meta: meta, dst: netip.AddrPortFrom(meta.addr, uint16(stunAddr.Port))}}
+	cmd := []string{"sh", "-c", `echo '{"Key":"starting","Value":{"Test":"download"}}'; sleep 0.3; echo '{"Key":"complete","Value":{"Test":"download"}}'`}
+	var out bytes.Buffer
+	stats, err := measureLoadedLatency(context.Background(), targets, cmd, 20*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"complete"`) {
+		t.Errorf("speedtest output not copied: %q", out.String())
+	}
+	if len(stats) != 1 {
+		t.Fatalf("got stats of %d targets, want 1", len(stats))
+	}
+	phases := make(map[loadPhase]loadedPhaseStats)
+	for _, ps := range stats[0].Phases {
+		phases[ps.Phase] = ps
+	}
+	for _, phase := range loadPhases {
+		if ps, ok := phases[phase]; !ok || ps.Samples == 0 || ps.Lost == ps.Samples || ps.RPM <= 0 {
+			t.Errorf("phase %s = %+v, want answered samples", phase, ps)
+		}
+	}
+
+	cmd = []string{"sh", "-c", "exit 3"}
+	if _, err := measureLoadedLatency(context.Background(), targets, cmd, 20*time.Millisecond, 0, 0, &out); err == nil {
+		t.Error("failing speedtest succeeded")
+	}
+}
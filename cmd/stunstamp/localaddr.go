@@ -0,0 +1,134 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/net/netmon"
+)
+
+// eventKindRebind is the re-establishment of stable conns on a change of the
+// local addresses, see watchLocalAddrs.
+const eventKindRebind eventKind = "rebind"
+
+// localAddrChange is a change of the addresses probes may be sent from.
+type localAddrChange struct {
+	at      time.Time
+	added   []netip.Addr
+	removed []netip.Addr
+}
+
+// localAddrsOf returns the sorted addresses of s probes may be sent from,
+// i.e. its global unicast addresses, which include private and CGNAT ones.
+func localAddrsOf(s *netmon.State) []netip.Addr {
+	if s == nil {
+		return nil
+	}
+	var ret []netip.Addr
+	for _, pfxs := range s.InterfaceIPs {
+		for _, pfx := range pfxs {
+			if a := pfx.Addr(); a.IsGlobalUnicast() {
+				ret = append(ret, a)
+			}
+		}
+	}
+	slices.SortFunc(ret, netip.Addr.Compare)
+	return slices.Compact(ret)
+}
+
+// diffLocalAddrs returns the addresses probes may be sent from in new but not
+// in old, and those in old but not in new.
+func diffLocalAddrs(old, new *netmon.State) (added, removed []netip.Addr) {
+	oldAddrs, newAddrs := localAddrsOf(old), localAddrsOf(new)
+	for _, a := range newAddrs {
+		if _, ok := slices.BinarySearchFunc(oldAddrs, a, netip.Addr.Compare); !ok {
+			added = append(added, a)
+		}
+	}
+	for _, a := range oldAddrs {
+		if _, ok := slices.BinarySearchFunc(newAddrs, a, netip.Addr.Compare); !ok {
+			removed = append(removed, a)
+		}
+	}
+	return added, removed
+}
+
+// watchLocalAddrs watches for changes of the addresses probes may be sent
+// from that remove an address, e.g. a DHCP renewal moving this host to an
+// address of a new CGNAT pool, and sends them on the returned channel.
+// Connections established from a removed address blackhole until they time
+// out, whereas additions alone leave them intact. Changes not yet received
+// are coalesced. mon must be started by the caller.
+func watchLocalAddrs(mon *netmon.Monitor) <-chan localAddrChange {
+	ch := make(chan localAddrChange, 1)
+	mon.RegisterChangeCallback(func(d *netmon.ChangeDelta) {
+		added, removed := diffLocalAddrs(d.Old, d.New)
+		if len(removed) == 0 {
+			return
+		}
+		c := localAddrChange{at: time.Now(), added: added, removed: removed}
+		for {
+			select {
+			case ch <- c:
+				return
+			case pending := <-ch:
+				c = coalesceLocalAddrChanges(pending, c)
+			}
+		}
+	})
+	return ch
+}
+
+// coalesceLocalAddrChanges returns the change of a followed by b.
+func coalesceLocalAddrChanges(a, b localAddrChange) localAddrChange {
+	ret := localAddrChange{at: b.at}
+	for _, addr := range a.added {
+		if !slices.Contains(b.removed, addr) {
+			ret.added = append(ret.added, addr)
+		}
+	}
+	for _, addr := range b.added {
+		if !slices.Contains(a.removed, addr) {
+			ret.added = append(ret.added, addr)
+		}
+	}
+	for _, addr := range a.removed {
+		if !slices.Contains(b.added, addr) {
+			ret.removed = append(ret.removed, addr)
+		}
+	}
+	for _, addr := range b.removed {
+		if !slices.Contains(a.added, addr) {
+			ret.removed = append(ret.removed, addr)
+		}
+	}
+	return ret
+}
+
+func joinAddrs(addrs []netip.Addr) string {
+	s := make([]string, len(addrs))
+	for i, a := range addrs {
+		s[i] = a.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// rebindEvent returns an event for the re-establishment of the given number
+// of stable conns on change c.
+func rebindEvent(c localAddrChange, conns int) event {
+	return event{
+		At:   c.at,
+		Kind: eventKindRebind,
+		Attrs: map[string]string{
+			"added":        joinAddrs(c.added),
+			"removed":      joinAddrs(c.removed),
+			"stable_conns": strconv.Itoa(conns),
+		},
+	}
+}
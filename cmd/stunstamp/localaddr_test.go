@@ -0,0 +1,63 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/net/netmon"
+)
+
+func TestDiffLocalAddrs(t *testing.T) {
+	state := func(pfxs ...string) *netmon.State {
+		s := &netmon.State{InterfaceIPs: map[string][]netip.Prefix{}}
+		for _, p := range pfxs {
+			s.InterfaceIPs["eth0"] = append(s.InterfaceIPs["eth0"], netip.MustParsePrefix(p))
+		}
+		s.InterfaceIPs["lo"] = []netip.Prefix{netip.MustParsePrefix("127.0.0.1/8")}
+		return s
+	}
+	addrs := func(s ...string) []netip.Addr {
+		var ret []netip.Addr
+		for _, a := range s {
+			ret = append(ret, netip.MustParseAddr(a))
+		}
+		return ret
+	}
+
+	old := state("100.64.1.2/10", "fe80::1/64", "2001:db8::1/64")
+	// A DHCP renewal moving this host to a new CGNAT pool.
+	added, removed := diffLocalAddrs(old, state("100.72.3.4/10", "fe80::1/64", "2001:db8::1/64"))
+	if !slices.Equal(added, addrs("100.72.3.4")) || !slices.Equal(removed, addrs("100.64.1.2")) {
+		t.Errorf("diffLocalAddrs = %v, %v", added, removed)
+	}
+	// Link-local addresses are ignored.
+	if added, removed := diffLocalAddrs(old, state("100.64.1.2/10", "2001:db8::1/64")); len(added) != 0 || len(removed) != 0 {
+		t.Errorf("diffLocalAddrs without link-local = %v, %v", added, removed)
+	}
+	if added, _ := diffLocalAddrs(nil, old); !slices.Equal(added, addrs("100.64.1.2", "2001:db8::1")) {
+		t.Errorf("diffLocalAddrs from unknown state added %v", added)
+	}
+
+	at := time.Unix(1700000000, 0)
+	// A renewal followed by a flap back to the original address.
+	c := coalesceLocalAddrChanges(
+		localAddrChange{at: at, added: addrs("100.72.3.4"), removed: addrs("100.64.1.2")},
+		localAddrChange{at: at.Add(time.Second), added: addrs("100.64.1.2"), removed: addrs("100.72.3.4")},
+	)
+	if len(c.added) != 0 || len(c.removed) != 0 || !c.at.Equal(at.Add(time.Second)) {
+		t.Errorf("coalesced flap = %+v, want no change", c)
+	}
+	c = coalesceLocalAddrChanges(
+		localAddrChange{at: at, added: addrs("100.72.3.4"), removed: addrs("100.64.1.2")},
+		localAddrChange{at: at, added: addrs("2001:db8::2"), removed: addrs("2001:db8::1")},
+	)
+	ev := rebindEvent(c, 3)
+	if ev.Kind != eventKindRebind || ev.Attrs["added"] != "100.72.3.4,2001:db8::2" || ev.Attrs["removed"] != "100.64.1.2,2001:db8::1" || ev.Attrs["stable_conns"] != "3" {
+		t.Errorf("rebind event = %+v", ev)
+	}
+}
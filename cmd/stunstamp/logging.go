@@ -0,0 +1,183 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"tailscale.com/types/logger"
+)
+
+// subsystem is a logging subsystem with an independently adjustable level.
+type subsystem string
+
+const (
+	subsystemProbe  subsystem = "probe"
+	subsystemStore  subsystem = "store"
+	subsystemExport subsystem = "export"
+	subsystemAPI    subsystem = "api"
+)
+
+var allSubsystems = []subsystem{subsystemProbe, subsystemStore, subsystemExport, subsystemAPI}
+
+// logLevels holds the current level of each subsystem. The map itself is
+// never modified after init, only the levels it holds.
+var logLevels = func() map[subsystem]*slog.LevelVar {
+	m := make(map[subsystem]*slog.LevelVar)
+	for _, s := range allSubsystems {
+		m[s] = new(slog.LevelVar)
+	}
+	return m
+}()
+
+var baseLogHandler slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+	Level: slog.LevelDebug, // filtered by subsystemHandler
+})
+
+var (
+	probeLog  = newSubsystemLogger(subsystemProbe)
+	storeLog  = newSubsystemLogger(subsystemStore)
+	exportLog = newSubsystemLogger(subsystemExport)
+	apiLog    = newSubsystemLogger(subsystemAPI)
+)
+
+func newSubsystemLogger(s subsystem) *slog.Logger {
+	return slog.New(&subsystemHandler{
+		sub:   s,
+		level: logLevels[s],
+		h:     baseLogHandler.WithAttrs([]slog.Attr{slog.String("subsystem", string(s))}),
+	})
+}
+
+// logfOf returns a logger.Logf that logs to l at info level, for APIs that
+// require one.
+func logfOf(l *slog.Logger) logger.Logf {
+	return func(format string, args ...any) {
+		l.Info(fmt.Sprintf(format, args...))
+	}
+}
+
+// subsystemHandler is a slog.Handler that filters records by the level of
+// its subsystem, and records error budget relevant records as events.
+type subsystemHandler struct {
+	sub   subsystem
+	level *slog.LevelVar
+	h     slog.Handler
+	attrs []slog.Attr // from WithAttrs, for events
+}
+
+func (s *subsystemHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= s.level.Level()
+}
+
+func (s *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	err := s.h.Handle(ctx, r)
+	if isErrorBudgetRelevant(s.sub, r.Level) {
+		events.record(s.eventFromRecord(r))
+	}
+	return err
+}
+
+func (s *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &subsystemHandler{
+		sub:   s.sub,
+		level: s.level,
+		h:     s.h.WithAttrs(attrs),
+		attrs: append(slices.Clip(s.attrs), attrs...),
+	}
+}
+
+func (s *subsystemHandler) WithGroup(name string) slog.Handler {
+	return &subsystemHandler{
+		sub:   s.sub,
+		level: s.level,
+		h:     s.h.WithGroup(name),
+		attrs: s.attrs,
+	}
+}
+
+// isErrorBudgetRelevant reports whether records of level logged by sub
+// describe a failure to measure or to deliver measurements, i.e. something
+// that consumes error budget and is worth keeping alongside results.
+func isErrorBudgetRelevant(sub subsystem, level slog.Level) bool {
+	return level >= slog.LevelWarn && (sub == subsystemProbe || sub == subsystemExport)
+}
+
+// eventFromRecord returns an eventKindLog event for r. An "addr" attribute
+// holding an IP address attributes the event to a target.
+func (s *subsystemHandler) eventFromRecord(r slog.Record) event {
+	ev := event{
+		At:   r.Time,
+		Kind: eventKindLog,
+		Attrs: map[string]string{
+			"subsystem": string(s.sub),
+			"level":     r.Level.String(),
+			"msg":       r.Message,
+		},
+	}
+	addAttr := func(a slog.Attr) bool {
+		if a.Key == "addr" {
+			if addr, err := netip.ParseAddr(a.Value.String()); err == nil {
+				ev.Addr = addr
+			}
+		}
+		ev.Attrs[a.Key] = a.Value.String()
+		return true
+	}
+	for _, a := range s.attrs {
+		addAttr(a)
+	}
+	r.Attrs(addAttr)
+	return ev
+}
+
+// parseLogLevels parses a comma-separated list of subsystem=level pairs, e.g.
+// "probe=debug,export=warn".
+func parseLogLevels(s string) (map[subsystem]slog.Level, error) {
+	ret := make(map[subsystem]slog.Level)
+	if len(s) == 0 {
+		return ret, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid subsystem=level pair: %q", kv)
+		}
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(v)); err != nil {
+			return nil, err
+		}
+		ret[subsystem(k)] = l
+	}
+	return ret, nil
+}
+
+// setLogLevels applies levels, returning an error without applying any of
+// them if a subsystem is unknown.
+func setLogLevels(levels map[subsystem]slog.Level) error {
+	for s := range levels {
+		if _, ok := logLevels[s]; !ok {
+			return fmt.Errorf("unknown subsystem %q, want one of %v", s, allSubsystems)
+		}
+	}
+	for s, l := range levels {
+		logLevels[s].Set(l)
+	}
+	return nil
+}
+
+// currentLogLevels returns the current level of every subsystem.
+func currentLogLevels() map[subsystem]slog.Level {
+	ret := make(map[subsystem]slog.Level)
+	for s, l := range logLevels {
+		ret[s] = l.Level()
+	}
+	return ret
+}
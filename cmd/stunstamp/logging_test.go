@@ -0,0 +1,79 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevels(t *testing.T) {
+	got, err := parseLogLevels("probe=debug,export=WARN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[subsystemProbe] != slog.LevelDebug || got[subsystemExport] != slog.LevelWarn {
+		t.Errorf("unexpected levels: %v", got)
+	}
+	for _, bad := range []string{"probe", "probe=loud"} {
+		if _, err := parseLogLevels(bad); err == nil {
+			t.Errorf("parseLogLevels(%q) unexpectedly succeeded", bad)
+		}
+	}
+	if err := setLogLevels(map[subsystem]slog.Level{"bogus": slog.LevelDebug}); err == nil {
+		t.Error("setLogLevels() with unknown subsystem unexpectedly succeeded")
+	}
+}
+
+func TestLogRecordEvents(t *testing.T) {
+	before := len(events.recentEvents())
+	addr := netip.MustParseAddr("192.0.2.1")
+	probeLog.Warn("temp error measuring RTT", "addr", addr, "err", errors.New("timeout"))
+	probeLog.Info("not budget relevant")
+	storeLog.Error("not budget relevant")
+	got := events.recentEvents()[before:]
+	if len(got) != 1 {
+		t.Fatalf("got %d events, want 1: %+v", len(got), got)
+	}
+	ev := got[0]
+	if ev.Kind != eventKindLog || ev.Addr != addr || ev.Attrs["subsystem"] != "probe" || ev.Attrs["err"] != "timeout" {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+}
+
+func TestLogLevelsAPI(t *testing.T) {
+	defer setLogLevels(currentLogLevels())
+	mux := (&httpServer{}).mux()
+
+	req := httptest.NewRequest("PUT", "/api/log-levels", strings.NewReader(`{"store": "DEBUG"}`))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT: got status %d: %s", rec.Code, rec.Body)
+	}
+	var got map[subsystem]slog.Level
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got[subsystemStore] != slog.LevelDebug || len(got) != len(allSubsystems) {
+		t.Errorf("unexpected levels: %v", got)
+	}
+	if !storeLog.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("store subsystem debug level not enabled")
+	}
+
+	req = httptest.NewRequest("PUT", "/api/log-levels", strings.NewReader(`{"bogus": "DEBUG"}`))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("PUT unknown subsystem: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"tailscale.com/net/stun"
+)
+
+const (
+	markingRTTMetricName  = "stunstamp_derp_marking_rtt_s"
+	markingLossMetricName = "stunstamp_derp_marking_loss_ratio"
+	// markingRounds is the number of probes sent with every marking per
+	// target and window.
+	markingRounds = 3
+	// markingSpacing separates consecutive marking probes, so that they are
+	// not mistaken for a burst and policed as such.
+	markingSpacing = 5 * time.Millisecond
+)
+
+// eventKindMarkingDrop is a change in whether STUN probes to a target with a
+// marking are dropped while unmarked probes are not, e.g. a CGNAT dropping
+// ECT(1).
+const eventKindMarkingDrop eventKind = "marking_drop"
+
+// marking is a combination of IP header markings STUN probes are sent with
+// in order to reveal middleboxes treating them differently, by loss or RTT.
+// Markings cleared in transit are not observable, as STUN servers do not
+// report the markings they receive.
+type marking struct {
+	name string
+	// tos is the IPv4 TOS or IPv6 traffic class octet: the DSCP in the
+	// upper 6 bits, and the ECN codepoint in the lower 2 bits.
+	tos int
+	// df is whether the don't fragment bit is set; IPv6 never fragments in
+	// transit.
+	df bool
+}
+
+// markings are the markings probed, the first of which is the reference
+// others are compared against.
+var markings = []marking{
+	{name: "none"},
+	{name: "ect0", tos: 0b10},
+	{name: "ect1", tos: 0b01},
+	{name: "ce", tos: 0b11},
+	{name: "df", df: true},
+	{name: "dscp_ef", tos: 46 << 2},
+	{name: "dscp_af41", tos: 34 << 2},
+	{name: "dscp_le", tos: 1 << 2},
+}
+
+// markingResult is the outcome of the probes with a marking to a target in a
+// window.
+type markingResult struct {
+	meta     nodeMeta
+	port     int
+	marking  string
+	at       time.Time
+	sent     int
+	received int
+	rtt      time.Duration // median of received, or zero
+}
+
+func (r markingResult) lossRatio() float64 {
+	if r.sent == 0 {
+		return math.NaN()
+	}
+	return float64(r.sent-r.received) / float64(r.sent)
+}
+
+// setMarking sets the marking of packets subsequently sent via c to dst.
+func setMarking(c *net.UDPConn, dst netip.Addr, m marking) error {
+	if dst.Is4() {
+		if err := ipv4.NewConn(c).SetTOS(m.tos); err != nil {
+			return fmt.Errorf("error setting TOS: %w", err)
+		}
+		return setDontFragment(c, m.df)
+	}
+	if err := ipv6.NewConn(c).SetTrafficClass(m.tos); err != nil {
+		return fmt.Errorf("error setting traffic class: %w", err)
+	}
+	return nil
+}
+
+// measureMarkings sends markingRounds STUN requests to dst with every
+// marking over a single socket, so that all probes share a 5-tuple, and
+// returns the outcome by marking. Markings the platform is unable to set are
+// omitted.
+func measureMarkings(ctx context.Context, meta nodeMeta, dst netip.AddrPort) ([]markingResult, error) {
+	network := "udp4"
+	if dst.Addr().Is6() {
+		network = "udp6"
+	}
+	c, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	deadline := deadlineWithin(ctx, txRxTimeout+time.Duration(len(markings)*markingRounds)*markingSpacing)
+	if err := c.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	type probe struct {
+		marking int
+		txAt    time.Time
+	}
+	var (
+		mu     sync.Mutex
+		probes = make(map[stun.TxID]probe)
+		rtts   = make([][]time.Duration, len(markings))
+		done   = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		b := make([]byte, 1500)
+		for {
+			n, err := c.Read(b)
+			rxAt := time.Now()
+			if err != nil {
+				return
+			}
+			txID, _, err := stun.ParseResponse(b[:n])
+			if err != nil {
+				continue
+			}
+			mu.Lock()
+			if p, ok := probes[txID]; ok {
+				rtts[p.marking] = append(rtts[p.marking], rxAt.Sub(p.txAt))
+				delete(probes, txID)
+			}
+			mu.Unlock()
+		}
+	}()
+
+	at := time.Now()
+	sent := make([]int, len(markings))
+	unsupported := make([]bool, len(markings))
+	for range markingRounds {
+		for i, m := range markings {
+			if unsupported[i] {
+				continue
+			}
+			if err := setMarking(c, dst.Addr(), m); err != nil {
+				if errors.Is(err, errors.ErrUnsupported) {
+					unsupported[i] = true
+					continue
+				}
+				c.Close()
+				<-done
+				return nil, err
+			}
+			txID := stun.NewTxID()
+			mu.Lock()
+			probes[txID] = probe{marking: i, txAt: time.Now()}
+			mu.Unlock()
+			if _, err := c.WriteToUDPAddrPort(stun.Request(txID), dst); err != nil {
+				probeLog.Debug("error sending marking probe", "hostname", meta.hostname, "marking", m.name, "err", err)
+			}
+			sent[i]++
+			time.Sleep(markingSpacing)
+		}
+	}
+	// Wait for all responses or the deadline.
+	for {
+		mu.Lock()
+		outstanding := len(probes)
+		mu.Unlock()
+		if outstanding == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(markingSpacing)
+	}
+	c.Close()
+	<-done
+
+	var ret []markingResult
+	for i, m := range markings {
+		if unsupported[i] {
+			continue
+		}
+		r := markingResult{meta: meta, port: int(dst.Port()), marking: m.name, at: at, sent: sent[i], received: len(rtts[i])}
+		if r.received > 0 {
+			r.rtt = medianOf(rtts[i])
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+// measureAllMarkings measures markings to every target on each of its STUN
+// ports concurrently.
+func measureAllMarkings(ctx context.Context, targets map[netip.Addr]nodeMeta, portsFor func(nodeMeta) []int) []markingResult {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results []markingResult
+	)
+	for _, meta := range targets {
+		for _, port := range portsFor(meta) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rs, err := measureMarkings(ctx, meta, netip.AddrPortFrom(meta.addr, uint16(port)))
+				if err != nil {
+					probeLog.Debug("error measuring markings", "hostname", meta.hostname, "addr", meta.addr, "port", port, "err", err)
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				results = append(results, rs...)
+			}()
+		}
+	}
+	wg.Wait()
+	return results
+}
+
+// markingKey identifies the timeseries of a marking to a target.
+type markingKey struct {
+	meta    nodeMeta
+	port    int
+	marking string
+}
+
+// markingTracker tracks the markings dropped to every target in order to
+// detect changes, and the timeseries written. It is not safe for concurrent
+// use.
+type markingTracker struct {
+	dropped map[markingKey]bool
+	seen    map[markingKey]bool
+}
+
+func newMarkingTracker() *markingTracker {
+	return &markingTracker{
+		dropped: make(map[markingKey]bool),
+		seen:    make(map[markingKey]bool),
+	}
+}
+
+func markingTimeSeriesLabels(metricName string, k markingKey, instance string) []prompb.Label {
+	labels := timeSeriesLabels(metricName, k.meta, instance, timestampSourceUserspace, unstableConn, protocolSTUN, k.port)
+	labels = append(labels, prompb.Label{
+		Name:  "marking",
+		Value: k.marking,
+	})
+	slices.SortFunc(labels, func(a, b prompb.Label) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return labels
+}
+
+// update records results, recording an event for every marking that
+// started or stopped being dropped to a target while unmarked probes were
+// answered. It returns timeseries for results, and stale markers for those
+// absent from results.
+func (t *markingTracker) update(results []markingResult, instance string) []prompb.TimeSeries {
+	// Loss is only attributable to a marking if unmarked probes got through.
+	reference := make(map[stableConnKey]bool)
+	for _, r := range results {
+		if r.marking == markings[0].name && r.received > 0 {
+			reference[stableConnKey{r.meta.addr, protocolSTUN, r.port}] = true
+		}
+	}
+	var ts []prompb.TimeSeries
+	current := make(map[markingKey]bool)
+	for _, r := range results {
+		k := markingKey{r.meta, r.port, r.marking}
+		current[k] = true
+		t.seen[k] = true
+		rtt := math.NaN()
+		if r.received > 0 {
+			rtt = r.rtt.Seconds()
+		}
+		for name, value := range map[string]float64{markingRTTMetricName: rtt, markingLossMetricName: r.lossRatio()} {
+			ts = append(ts, prompb.TimeSeries{
+				Labels:  markingTimeSeriesLabels(name, k, instance),
+				Samples: []prompb.Sample{{Timestamp: r.at.UnixMilli(), Value: value}},
+			})
+		}
+		if !reference[stableConnKey{r.meta.addr, protocolSTUN, r.port}] {
+			continue
+		}
+		dropped := r.received == 0
+		if dropped == t.dropped[k] {
+			continue
+		}
+		t.dropped[k] = dropped
+		text := fmt.Sprintf("STUN probes marked %s to port %d dropped while unmarked probes are answered", r.marking, r.port)
+		if !dropped {
+			text = fmt.Sprintf("STUN probes marked %s to port %d no longer dropped", r.marking, r.port)
+		}
+		annotations.annotateAuto(r.at, r.at, r.meta.hostname, text)
+		events.record(event{
+			At:       r.at,
+			Kind:     eventKindMarkingDrop,
+			Addr:     r.meta.addr,
+			Protocol: protocolSTUN,
+			Attrs: map[string]string{
+				"port":    fmt.Sprint(r.port),
+				"marking": r.marking,
+				"dropped": fmt.Sprint(dropped),
+			},
+		})
+	}
+	now := time.Now()
+	for k := range t.seen {
+		if current[k] {
+			continue
+		}
+		ts = append(ts, markingStaleMarkers(k, instance, now)...)
+		delete(t.seen, k)
+		delete(t.dropped, k)
+	}
+	return ts
+}
+
+// staleMarkers returns stale markers for the RTT and loss of every target
+// and marking probed.
+func (t *markingTracker) staleMarkers(instance string) []prompb.TimeSeries {
+	now := time.Now()
+	var ts []prompb.TimeSeries
+	for k := range t.seen {
+		ts = append(ts, markingStaleMarkers(k, instance, now)...)
+	}
+	return ts
+}
+
+func markingStaleMarkers(k markingKey, instance string, at time.Time) []prompb.TimeSeries {
+	var ts []prompb.TimeSeries
+	for _, name := range []string{markingRTTMetricName, markingLossMetricName} {
+		ts = append(ts, prompb.TimeSeries{
+			Labels:  markingTimeSeriesLabels(name, k, instance),
+			Samples: []prompb.Sample{{Timestamp: at.UnixMilli(), Value: math.Float64frombits(staleNaN)}},
+		})
+	}
+	return ts
+}
@@ -0,0 +1,47 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDontFragment sets or clears the don't fragment bit of IPv4 packets
+// subsequently sent via c.
+func setDontFragment(c *net.UDPConn, df bool) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	mode := unix.IP_PMTUDISC_DONT
+	if df {
+		mode = unix.IP_PMTUDISC_DO
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, mode)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// setSocketMark sets the fwmark (SO_MARK) of packets subsequently sent via c.
+func setSocketMark(c *net.UDPConn, mark int) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,79 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"math"
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/net/stun/stuntest"
+)
+
+func TestMeasureMarkings(t *testing.T) {
+	stunAddr, cleanup := stuntest.Serve(t)
+	defer cleanup()
+	meta := nodeMeta{hostname: "local", addr: netip.MustParseAddr("127.0.0.1")}
+	results, err := measureMarkings(context.Background(), meta, netip.AddrPortFrom(meta.addr, uint16(stunAddr.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 || results[0].marking != markings[0].name {
+		t.Fatalf("got results %+v, want the reference marking first", results)
+	}
+	for _, r := range results {
+		if r.sent != markingRounds || r.received != markingRounds || r.rtt <= 0 {
+			t.Errorf("marking %s: sent %d, received %d, rtt %v", r.marking, r.sent, r.received, r.rtt)
+		}
+	}
+}
+
+func TestMarkingTracker(t *testing.T) {
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	m := newMarkingTracker()
+	countDrops := func() int {
+		n := 0
+		for _, ev := range events.recentEvents() {
+			if ev.Kind == eventKindMarkingDrop && ev.Addr == meta.addr {
+				n++
+			}
+		}
+		return n
+	}
+	before := countDrops()
+	window := func(reference, ect1 int) []markingResult {
+		return []markingResult{
+			{meta: meta, port: 3478, marking: "none", at: time.Now(), sent: 3, received: reference, rtt: time.Millisecond},
+			{meta: meta, port: 3478, marking: "ect1", at: time.Now(), sent: 3, received: ect1, rtt: time.Millisecond},
+		}
+	}
+	for i, w := range [][]markingResult{
+		window(3, 3),
+		window(3, 0), // ECT(1) dropped
+		window(0, 0), // everything dropped, not attributable to marking
+		window(3, 0),
+		window(3, 2), // no longer dropped
+	} {
+		ts := m.update(w, "test")
+		if len(ts) != 4 {
+			t.Fatalf("update %d: got %d timeseries, want 4", i, len(ts))
+		}
+	}
+	if got := countDrops() - before; got != 2 {
+		t.Errorf("got %d marking drop events, want 2", got)
+	}
+	if r := window(3, 0)[1]; r.lossRatio() != 1 {
+		t.Errorf("loss ratio = %v, want 1", r.lossRatio())
+	}
+
+	ts := m.update(nil, "test")
+	if len(ts) != 4 || math.Float64bits(ts[0].Samples[0].Value) != staleNaN {
+		t.Errorf("expected stale markers for vanished target, got %v", ts)
+	}
+	if len(m.staleMarkers("test")) != 0 {
+		t.Error("vanished target still tracked")
+	}
+}
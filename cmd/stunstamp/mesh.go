@@ -0,0 +1,393 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+const meshRTTMetricName = "stunstamp_mesh_rtt_ns"
+
+// meshPair is an unordered pair of mesh members, a < b, and the member that
+// probes it.
+type meshPair struct {
+	a, b, prober tailcfg.StableNodeID
+}
+
+// meshRingKey returns the position of id on the ring partial meshes are built
+// from, which spreads members independently of their IDs.
+func meshRingKey(id tailcfg.StableNodeID) [sha256.Size]byte {
+	return sha256.Sum256([]byte(id))
+}
+
+// meshPairs returns the pairs of members to probe: every pair if degree is
+// zero, or else the pairs of every member with the degree members following
+// it on a ring, so that every member is in at least degree pairs. Every pair
+// is probed by one of its members only, chosen by a hash of the pair so that
+// probing is spread evenly. Every member computes the same pairs from the
+// same members, so no coordination beyond discovery is needed.
+func meshPairs(members []tailcfg.StableNodeID, degree int) []meshPair {
+	ring := slices.Clone(members)
+	slices.SortFunc(ring, func(a, b tailcfg.StableNodeID) int {
+		ka, kb := meshRingKey(a), meshRingKey(b)
+		return cmp.Or(slices.Compare(ka[:], kb[:]), cmp.Compare(a, b))
+	})
+	ring = slices.Compact(ring)
+	n := len(ring)
+	if degree <= 0 || degree > n-1 {
+		degree = n - 1
+	}
+	seen := make(map[[2]tailcfg.StableNodeID]bool)
+	var ret []meshPair
+	for i, a := range ring {
+		for j := 1; j <= degree; j++ {
+			b := ring[(i+j)%n]
+			lo, hi := min(a, b), max(a, b)
+			k := [2]tailcfg.StableNodeID{lo, hi}
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			p := meshPair{a: lo, b: hi, prober: lo}
+			if h := sha256.Sum256([]byte(lo + "|" + hi)); h[0]&1 == 1 {
+				p.prober = hi
+			}
+			ret = append(ret, p)
+		}
+	}
+	slices.SortFunc(ret, func(x, y meshPair) int {
+		return cmp.Or(cmp.Compare(x.a, y.a), cmp.Compare(x.b, y.b))
+	})
+	return ret
+}
+
+// meshMember is a probe in the mesh.
+type meshMember struct {
+	ID       tailcfg.StableNodeID
+	Hostname string
+	Relay    string // home DERP region code
+	Addrs    []netip.Addr
+}
+
+// meshRTT is the RTT between two mesh members, as measured by Src.
+type meshRTT struct {
+	Src, Dst string // hostnames
+	Protocol protocol
+	RTTNanos int64
+	At       time.Time
+}
+
+// meshStatus is the state of the mesh as seen by a member, served at
+// /api/mesh.
+type meshStatus struct {
+	Self    string
+	Members []string
+	// RTTs are the latest RTTs of the pairs probed by Self.
+	RTTs []meshRTT
+}
+
+// meshMatrix is the latency matrix of the mesh, aggregated from the status
+// of every member.
+type meshMatrix struct {
+	Members []string
+	RTTs    []meshRTT
+	// Errors holds the errors fetching the status of members, by hostname.
+	Errors map[string]string `json:",omitempty"`
+}
+
+// probeMesh discovers the other probes in the tailnet, those tagged with tag
+// like this one, and builds a probe mesh of them, see meshPairs. The mesh
+// members this probe is assigned are probed inside the tunnel with
+// tailnetPorts, and their RTTs form its rows of the mesh latency matrix. It
+// is safe for concurrent use.
+type probeMesh struct {
+	tag          string
+	degree       int
+	ipv6         bool
+	tailnetPorts map[protocol][]int
+	httpPort     string // of the HTTP servers of members, "" if not serving
+
+	mu          sync.Mutex
+	self        meshMember
+	members     []meshMember
+	metaByAddr  map[netip.Addr]nodeMeta
+	portsByAddr map[netip.Addr]map[protocol][]int
+	rtts        map[meshRTTKey]meshRTT
+}
+
+// meshRTTKey identifies a timeseries of the mesh latency matrix.
+type meshRTTKey struct {
+	dst      string
+	protocol protocol
+}
+
+func newProbeMesh(tag string, degree int, ipv6 bool, tailnetPorts map[protocol][]int, httpPort string) *probeMesh {
+	return &probeMesh{
+		tag:          tag,
+		degree:       degree,
+		ipv6:         ipv6,
+		tailnetPorts: tailnetPorts,
+		httpPort:     httpPort,
+		metaByAddr:   make(map[netip.Addr]nodeMeta),
+		portsByAddr:  make(map[netip.Addr]map[protocol][]int),
+		rtts:         make(map[meshRTTKey]meshRTT),
+	}
+}
+
+func hasTag(ps *ipnstate.PeerStatus, tag string) bool {
+	return ps.Tags != nil && slices.Contains(ps.Tags.AsSlice(), tag)
+}
+
+func meshMemberOf(ps *ipnstate.PeerStatus) meshMember {
+	return meshMember{ID: ps.ID, Hostname: ps.HostName, Relay: ps.Relay, Addrs: ps.TailscaleIPs}
+}
+
+// update rebuilds the mesh from the online peers in st. It returns stale
+// markers for targets no longer assigned to this probe, and whether its
+// targets changed.
+func (m *probeMesh) update(st *ipnstate.Status, instance string) (staleMarkers []prompb.TimeSeries, changed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var self meshMember
+	var members []meshMember
+	if st.Self != nil && hasTag(st.Self, m.tag) {
+		self = meshMemberOf(st.Self)
+		members = append(members, self)
+		for _, ps := range st.Peer {
+			if ps.Online && hasTag(ps, m.tag) {
+				members = append(members, meshMemberOf(ps))
+			}
+		}
+	}
+	slices.SortFunc(members, func(a, b meshMember) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	byID := make(map[tailcfg.StableNodeID]meshMember)
+	ids := make([]tailcfg.StableNodeID, 0, len(members))
+	for _, mm := range members {
+		byID[mm.ID] = mm
+		ids = append(ids, mm.ID)
+	}
+
+	metaByAddr := make(map[netip.Addr]nodeMeta)
+	portsByAddr := make(map[netip.Addr]map[protocol][]int)
+	for _, p := range meshPairs(ids, m.degree) {
+		if p.prober != self.ID {
+			continue
+		}
+		peer := byID[p.a]
+		if p.a == self.ID {
+			peer = byID[p.b]
+		}
+		for _, addr := range peer.Addrs {
+			if addr.Is6() && !m.ipv6 {
+				continue
+			}
+			metaByAddr[addr] = nodeMeta{regionCode: peer.Relay, hostname: peer.Hostname, addr: addr}
+			portsByAddr[addr] = m.tailnetPorts
+		}
+	}
+
+	for addr, meta := range m.metaByAddr {
+		if metaByAddr[addr] == meta {
+			continue
+		}
+		changed = true
+		staleMarkers = append(staleMarkers, staleMarkersFromNodeMeta([]nodeMeta{meta}, instance, m.portsByAddr[addr])...)
+	}
+	if len(metaByAddr) != len(m.metaByAddr) {
+		changed = true
+	}
+	m.self = self
+	m.members = members
+	m.metaByAddr = metaByAddr
+	m.portsByAddr = portsByAddr
+	return staleMarkers, changed
+}
+
+// isTarget reports whether meta is a target assigned to this probe.
+func (m *probeMesh) isTarget(meta nodeMeta) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.metaByAddr[meta.addr] == meta
+}
+
+// merge returns the union of targets and the mesh targets, along with the
+// per-address ports of the mesh targets. Addresses present in targets are
+// probed as such.
+func (m *probeMesh) merge(targets map[netip.Addr]nodeMeta) (map[netip.Addr]nodeMeta, map[netip.Addr]map[protocol][]int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := maps.Clone(targets)
+	portsByAddr := make(map[netip.Addr]map[protocol][]int)
+	for addr, meta := range m.metaByAddr {
+		if _, ok := ret[addr]; ok {
+			continue
+		}
+		ret[addr] = meta
+		portsByAddr[addr] = m.portsByAddr[addr]
+	}
+	return ret, portsByAddr
+}
+
+func meshRTTTimeSeries(src string, k meshRTTKey, instance string, at time.Time, value float64) prompb.TimeSeries {
+	labels := []prompb.Label{
+		{Name: "__name__", Value: meshRTTMetricName},
+		{Name: "instance", Value: instance},
+		{Name: "job", Value: "stunstamp-rw"},
+		{Name: "src_hostname", Value: src},
+		{Name: "dst_hostname", Value: k.dst},
+		{Name: "protocol", Value: string(k.protocol)},
+	}
+	slices.SortFunc(labels, func(a, b prompb.Label) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return prompb.TimeSeries{
+		Labels:  labels,
+		Samples: []prompb.Sample{{Timestamp: at.UnixMilli(), Value: value}},
+	}
+}
+
+// updateRTTs records the median RTT of the results for every mesh target and
+// protocol as its entry in the mesh latency matrix. It returns timeseries for
+// the entries, and stale markers for those absent from results.
+func (m *probeMesh) updateRTTs(results []result, instance string) []prompb.TimeSeries {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rtts := make(map[meshRTTKey][]time.Duration)
+	at := make(map[meshRTTKey]time.Time)
+	for _, r := range results {
+		if r.rtt == nil || m.metaByAddr[r.key.meta.addr] != r.key.meta {
+			continue
+		}
+		k := meshRTTKey{r.key.meta.hostname, r.key.protocol}
+		rtts[k] = append(rtts[k], *r.rtt)
+		at[k] = r.at
+	}
+	var ts []prompb.TimeSeries
+	for k, d := range rtts {
+		rtt := medianOf(d)
+		m.rtts[k] = meshRTT{Src: m.self.Hostname, Dst: k.dst, Protocol: k.protocol, RTTNanos: rtt.Nanoseconds(), At: at[k]}
+		ts = append(ts, meshRTTTimeSeries(m.self.Hostname, k, instance, at[k], float64(rtt.Nanoseconds())))
+	}
+	now := time.Now()
+	for k, r := range m.rtts {
+		if _, ok := rtts[k]; ok {
+			continue
+		}
+		ts = append(ts, meshRTTTimeSeries(r.Src, k, instance, now, math.Float64frombits(staleNaN)))
+		delete(m.rtts, k)
+	}
+	return ts
+}
+
+// staleMarkers returns stale markers for all targets and timeseries of the
+// mesh latency matrix.
+func (m *probeMesh) staleMarkers(instance string) []prompb.TimeSeries {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ts []prompb.TimeSeries
+	for addr, meta := range m.metaByAddr {
+		ts = append(ts, staleMarkersFromNodeMeta([]nodeMeta{meta}, instance, m.portsByAddr[addr])...)
+	}
+	now := time.Now()
+	for k, r := range m.rtts {
+		ts = append(ts, meshRTTTimeSeries(r.Src, k, instance, now, math.Float64frombits(staleNaN)))
+	}
+	return ts
+}
+
+// status returns the mesh as seen by this probe.
+func (m *probeMesh) status() meshStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := meshStatus{Self: m.self.Hostname, Members: []string{}, RTTs: []meshRTT{}}
+	for _, mm := range m.members {
+		st.Members = append(st.Members, mm.Hostname)
+	}
+	for _, r := range m.rtts {
+		st.RTTs = append(st.RTTs, r)
+	}
+	sortMeshRTTs(st.RTTs)
+	return st
+}
+
+func sortMeshRTTs(rtts []meshRTT) {
+	slices.SortFunc(rtts, func(a, b meshRTT) int {
+		return cmp.Or(cmp.Compare(a.Src, b.Src), cmp.Compare(a.Dst, b.Dst), cmp.Compare(a.Protocol, b.Protocol))
+	})
+}
+
+// matrix aggregates the mesh latency matrix from the status of every member,
+// fetched from their HTTP servers over the tailnet, which are assumed to
+// listen on the same port as this one's.
+func (m *probeMesh) matrix(ctx context.Context, c *http.Client) meshMatrix {
+	local := m.status()
+	m.mu.Lock()
+	self, members, port := m.self, slices.Clone(m.members), m.httpPort
+	m.mu.Unlock()
+
+	ret := meshMatrix{Members: local.Members, RTTs: local.RTTs, Errors: make(map[string]string)}
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for _, mm := range members {
+		if mm.ID == self.ID || len(mm.Addrs) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := fetchMeshStatus(ctx, c, net.JoinHostPort(mm.Addrs[0].String(), port))
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				ret.Errors[mm.Hostname] = err.Error()
+				return
+			}
+			ret.RTTs = append(ret.RTTs, st.RTTs...)
+		}()
+	}
+	wg.Wait()
+	sortMeshRTTs(ret.RTTs)
+	return ret
+}
+
+func fetchMeshStatus(ctx context.Context, c *http.Client, hostPort string) (meshStatus, error) {
+	var st meshStatus
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+hostPort+"/api/mesh", nil)
+	if err != nil {
+		return st, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return st, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return st, fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	return st, err
+}
+
+// meshHTTPClient fetches the status of mesh members.
+var meshHTTPClient = &http.Client{Timeout: 5 * time.Second}
@@ -0,0 +1,161 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/views"
+)
+
+func TestMeshPairs(t *testing.T) {
+	var members []tailcfg.StableNodeID
+	for i := range 7 {
+		members = append(members, tailcfg.StableNodeID(fmt.Sprintf("n%d", i)))
+	}
+	tests := []struct {
+		degree    int
+		wantPairs int
+	}{
+		{degree: 0, wantPairs: 21},
+		{degree: 6, wantPairs: 21},
+		{degree: 10, wantPairs: 21},
+		{degree: 1, wantPairs: 7},
+		{degree: 2, wantPairs: 14},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.degree), func(t *testing.T) {
+			pairs := meshPairs(members, tt.degree)
+			if len(pairs) != tt.wantPairs {
+				t.Fatalf("got %d pairs, want %d", len(pairs), tt.wantPairs)
+			}
+			seen := make(map[[2]tailcfg.StableNodeID]bool)
+			inPairs := make(map[tailcfg.StableNodeID]int)
+			for _, p := range pairs {
+				if p.a >= p.b {
+					t.Errorf("pair %v not ordered", p)
+				}
+				if p.prober != p.a && p.prober != p.b {
+					t.Errorf("pair %v probed by a non-member", p)
+				}
+				if seen[[2]tailcfg.StableNodeID{p.a, p.b}] {
+					t.Errorf("duplicate pair %v", p)
+				}
+				seen[[2]tailcfg.StableNodeID{p.a, p.b}] = true
+				inPairs[p.a]++
+				inPairs[p.b]++
+			}
+			for _, m := range members {
+				if inPairs[m] < min(max(tt.degree, 1), len(members)-1) {
+					t.Errorf("member %s in %d pairs, want >= %d", m, inPairs[m], tt.degree)
+				}
+			}
+		})
+	}
+
+	// Members compute the same pairs regardless of the order of discovery.
+	reversed := []tailcfg.StableNodeID{"n6", "n5", "n4", "n3", "n2", "n1", "n0", "n0"}
+	a, b := meshPairs(members, 2), meshPairs(reversed, 2)
+	if fmt.Sprint(a) != fmt.Sprint(b) {
+		t.Errorf("pairs depend on member order: %v != %v", a, b)
+	}
+}
+
+func TestProbeMeshAssignment(t *testing.T) {
+	const tag = "tag:stunstamp"
+	tags := views.SliceOf([]string{tag})
+	var nodes []*ipnstate.PeerStatus
+	for i := range 4 {
+		nodes = append(nodes, &ipnstate.PeerStatus{
+			ID:           tailcfg.StableNodeID(fmt.Sprintf("n%d", i)),
+			HostName:     fmt.Sprintf("host%d", i),
+			Online:       true,
+			Tags:         &tags,
+			TailscaleIPs: []netip.Addr{netip.AddrFrom4([4]byte{100, 64, 0, byte(i + 1)})},
+		})
+	}
+	untagged := &ipnstate.PeerStatus{
+		ID:           "untagged",
+		HostName:     "untagged",
+		Online:       true,
+		TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.100")},
+	}
+	statusOf := func(self int) *ipnstate.Status {
+		st := &ipnstate.Status{Self: nodes[self], Peer: make(map[key.NodePublic]*ipnstate.PeerStatus)}
+		for i, n := range nodes {
+			if i != self {
+				st.Peer[key.NewNode().Public()] = n
+			}
+		}
+		st.Peer[key.NewNode().Public()] = untagged
+		return st
+	}
+
+	// Every pair is probed by exactly one of its members.
+	probed := make(map[[2]string]int)
+	for i := range nodes {
+		m := newProbeMesh(tag, 0, false, map[protocol][]int{protocolICMP: {0}}, "")
+		if _, changed := m.update(statusOf(i), "test"); !changed && len(m.metaByAddr) > 0 {
+			t.Errorf("first update() of %d unchanged", i)
+		}
+		if got := len(m.status().Members); got != len(nodes) {
+			t.Errorf("members seen by %d = %d, want %d", i, got, len(nodes))
+		}
+		for _, meta := range m.metaByAddr {
+			if meta.hostname == "untagged" {
+				t.Errorf("untagged peer assigned to %d", i)
+			}
+			pair := [2]string{min(meta.hostname, nodes[i].HostName), max(meta.hostname, nodes[i].HostName)}
+			probed[pair]++
+		}
+	}
+	if len(probed) != 6 {
+		t.Errorf("%d pairs probed, want 6", len(probed))
+	}
+	for pair, n := range probed {
+		if n != 1 {
+			t.Errorf("pair %v probed %d times", pair, n)
+		}
+	}
+
+	// RTTs of assigned targets form the matrix, and vanish with their
+	// targets.
+	m := newProbeMesh(tag, 0, false, map[protocol][]int{protocolICMP: {0}}, "")
+	for i := range nodes {
+		m.update(statusOf(i), "test")
+		if len(m.metaByAddr) > 0 {
+			break
+		}
+	}
+	var results []result
+	for _, meta := range m.metaByAddr {
+		rtt := time.Millisecond
+		results = append(results, result{key: resultKey{meta: meta, protocol: protocolICMP}, at: time.Now(), rtt: &rtt})
+	}
+	if ts := m.updateRTTs(results, "test"); len(ts) != len(results) {
+		t.Errorf("updateRTTs() = %d timeseries, want %d", len(ts), len(results))
+	}
+	if got := len(m.status().RTTs); got != len(results) {
+		t.Errorf("status RTTs = %d, want %d", got, len(results))
+	}
+	if ts := m.updateRTTs(nil, "test"); len(ts) != len(results) {
+		t.Errorf("updateRTTs() without results = %d stale markers, want %d", len(ts), len(results))
+	}
+	if got := len(m.status().RTTs); got != 0 {
+		t.Errorf("status RTTs after going stale = %d, want 0", got)
+	}
+
+	// Untagged probes are not in the mesh.
+	st := statusOf(0)
+	st.Self = untagged
+	if _, changed := m.update(st, "test"); !changed || len(m.metaByAddr) != 0 {
+		t.Errorf("untagged update() = %d targets, changed %v; want 0, true", len(m.metaByAddr), changed)
+	}
+}
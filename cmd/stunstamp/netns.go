@@ -0,0 +1,277 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"tailscale.com/logtail/backoff"
+)
+
+const (
+	// netnsEnv holds the network namespace a child of runNetnsSupervisor
+	// probes from.
+	netnsEnv = "STUNSTAMP_NETNS"
+	// netnsPipeFD is the file descriptor of the pipe on which children of
+	// runNetnsSupervisor send it their results and events.
+	netnsPipeFD = 3
+	// netnsMaxMessageSize is the maximum size of a message on the pipe.
+	netnsMaxMessageSize = 64 << 20
+	// netnsStopTimeout is how long children are given to exit on SIGTERM.
+	netnsStopTimeout = 10 * time.Second
+)
+
+// netnsSupervisorFlags are the flags that runNetnsSupervisor handles itself
+// rather than pass on to its children.
+var netnsSupervisorFlags = []string{"netns", "store-dir", "store-layout", "archive-after", "results-cache", "http-addr"}
+
+// parseNetnsFlag returns the names of the network namespaces in f.
+func parseNetnsFlag(f string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(f, ",") {
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid network namespace name %q", name)
+		}
+		if slices.Contains(names, name) {
+			return nil, fmt.Errorf("duplicate network namespace %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// netnsChildArgs returns the arguments of the children of
+// runNetnsSupervisor: the flags set on fs, less netnsSupervisorFlags.
+func netnsChildArgs(fs *flag.FlagSet) []string {
+	var args []string
+	fs.Visit(func(f *flag.Flag) {
+		if !slices.Contains(netnsSupervisorFlags, f.Name) {
+			args = append(args, fmt.Sprintf("--%s=%s", f.Name, f.Value))
+		}
+	})
+	return args
+}
+
+// netnsPipe is the child's end of the pipe to runNetnsSupervisor. Messages
+// are lines of a type, "results" or "event", a space, and JSON. It is safe
+// for concurrent use.
+type netnsPipe struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (p *netnsPipe) send(typ string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := fmt.Fprintf(p.w, "%s %s\n", typ, data)
+	return err
+}
+
+// write sends the results of b to the supervisor.
+func (p *netnsPipe) write(_ context.Context, b outputBatch) error {
+	if len(b.results) == 0 {
+		return nil
+	}
+	srs := make([]storedResult, len(b.results))
+	for i, r := range b.results {
+		srs[i] = storedResultFromResult(r)
+	}
+	data, err := json.Marshal(srs)
+	if err != nil {
+		return err
+	}
+	return p.send("results", data)
+}
+
+func (*netnsPipe) name() string { return "netns-supervisor" }
+
+// forwardEvents sends the events published to hub to the supervisor until
+// the pipe breaks.
+func (p *netnsPipe) forwardEvents(hub *streamHub) {
+	sub := hub.subscribe(streamFilter{events: true})
+	defer hub.unsubscribe(sub)
+	for m := range sub.ch {
+		if err := p.send("event", m.data); err != nil {
+			return
+		}
+	}
+}
+
+// netnsSupervisor aggregates the results and events of its children.
+type netnsSupervisor struct {
+	outs      outputs
+	baselines *baselineTracker
+}
+
+// receive reads the messages of the child probing from netns on r until EOF.
+func (s *netnsSupervisor) receive(netns string, r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, netnsMaxMessageSize)
+	for sc.Scan() {
+		typ, data, _ := bytes.Cut(sc.Bytes(), []byte(" "))
+		switch string(typ) {
+		case "results":
+			var srs []storedResult
+			if err := json.Unmarshal(data, &srs); err != nil {
+				return fmt.Errorf("invalid results: %w", err)
+			}
+			results := make([]result, len(srs))
+			for i, sr := range srs {
+				results[i] = sr.toResult()
+				results[i].key.netns = netns
+			}
+			s.baselines.add(results)
+			s.outs.enqueue(outputBatch{results: results})
+		case "event":
+			var ev event
+			if err := json.Unmarshal(data, &ev); err != nil {
+				return fmt.Errorf("invalid event: %w", err)
+			}
+			if ev.Attrs == nil {
+				ev.Attrs = make(map[string]string)
+			}
+			ev.Attrs["netns"] = netns
+			events.record(ev)
+		default:
+			return fmt.Errorf("invalid message type %q", typ)
+		}
+	}
+	return sc.Err()
+}
+
+// runChild runs a child probing from netns with args until it exits or ctx
+// is done.
+func (s *netnsSupervisor) runChild(ctx context.Context, exe string, args []string, netns string) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.Env = append(os.Environ(), netnsEnv+"="+netns)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{w} // netnsPipeFD
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = netnsStopTimeout
+	err = startInNetns(cmd, netns)
+	w.Close()
+	if err != nil {
+		return err
+	}
+	if err := s.receive(netns, r); err != nil {
+		probeLog.Error("error receiving from netns child, restarting it", "netns", netns, "err", err)
+		cmd.Cancel()
+	}
+	return cmd.Wait()
+}
+
+// supervise runs a child probing from netns until ctx is done, restarting it
+// with backoff whenever it exits.
+func (s *netnsSupervisor) supervise(ctx context.Context, exe string, args []string, netns string) {
+	bo := backoff.NewBackoff("netns-"+netns, logfOf(probeLog), 30*time.Second)
+	for {
+		err := s.runChild(ctx, exe, args, netns)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("exited")
+		}
+		probeLog.Error("netns child exited", "netns", netns, "err", err)
+		bo.BackOff(ctx, err)
+	}
+}
+
+// runNetnsSupervisor probes from each of the named network namespaces by
+// running a child stunstamp process in each, started from a thread that has
+// entered the namespace so that every socket of the child is created in it,
+// as `ip netns exec` does. Go processes are multi-threaded from the start,
+// so they cannot move themselves into a namespace wholesale.
+//
+// Children are passed all flags except netnsSupervisorFlags: they write to
+// remote write and webhooks themselves, labeled with their namespace, and
+// send their results and events to the supervisor, which aggregates them
+// into the store in storeDir and the web UI on httpAddr with their namespace
+// as a dimension. It returns when interrupted.
+func runNetnsSupervisor(names []string, storeDir string, layout storeLayout, httpAddr, instance string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	s := &netnsSupervisor{baselines: newBaselineTracker()}
+	outputDepth := len(names) * int(maxBufferDuration/minInterval)
+	var store *resultsStore
+	if len(storeDir) > 0 {
+		store, err = openResultsStoreLayout(storeDir, layout)
+		if err != nil {
+			return fmt.Errorf("error opening store: %w", err)
+		}
+		defer store.close()
+		events.setStoreDir(storeDir)
+		defer events.close()
+		if err := annotations.open(storeDir, false); err != nil {
+			return fmt.Errorf("error loading annotations: %w", err)
+		}
+		now := time.Now()
+		err = store.readRange(now.AddDate(0, 0, -baselineDays-1), now, func(sr storedResult) error {
+			s.baselines.add([]result{sr.toResult()})
+			return nil
+		})
+		if err != nil {
+			storeLog.Error("error loading baselines from store", "err", err)
+		}
+		s.outs = append(s.outs, newOutputQueue(&storeBackend{s: store}, outputDepth))
+	}
+	if len(httpAddr) > 0 {
+		s.outs = append(s.outs, newOutputQueue(streamBackend{liveStream}, outputDepth))
+		hs := &httpServer{
+			instance:  instance,
+			baselines: s.baselines,
+			store:     store,
+			stream:    liveStream,
+		}
+		go func() {
+			log.Fatal(http.ListenAndServe(httpAddr, hs.mux()))
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	args := netnsChildArgs(flag.CommandLine)
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.supervise(ctx, exe, args, name)
+		}()
+	}
+	slog.Info("stunstamp started supervising network namespaces", "netns", strings.Join(names, ","))
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+	cancel()
+	wg.Wait()
+	s.outs.close(netnsStopTimeout)
+	return nil
+}
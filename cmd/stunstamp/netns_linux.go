@@ -0,0 +1,40 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// netnsDir is where `ip netns add` creates named network namespaces.
+const netnsDir = "/var/run/netns"
+
+// startInNetns starts cmd in the named network namespace, by starting it from
+// a thread that has entered the namespace.
+func startInNetns(cmd *exec.Cmd, name string) error {
+	f, err := os.Open(filepath.Join(netnsDir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	errc := make(chan error, 1)
+	go func() {
+		// The thread is left in the namespace rather than unlocked, so that
+		// the runtime terminates it when this goroutine exits instead of
+		// scheduling other goroutines on it.
+		runtime.LockOSThread()
+		if err := unix.Setns(int(f.Fd()), unix.CLONE_NEWNET); err != nil {
+			errc <- fmt.Errorf("error entering network namespace %s: %w", name, err)
+			return
+		}
+		errc <- cmd.Start()
+	}()
+	return <-errc
+}
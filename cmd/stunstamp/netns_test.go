@@ -0,0 +1,82 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseNetnsFlag(t *testing.T) {
+	if got, err := parseNetnsFlag("uplink-a,uplink-b"); err != nil || !slices.Equal(got, []string{"uplink-a", "uplink-b"}) {
+		t.Errorf("got %v, %v", got, err)
+	}
+	for _, f := range []string{"a,", "a,a", "../a", ".."} {
+		if _, err := parseNetnsFlag(f); err == nil {
+			t.Errorf("parseNetnsFlag(%q) succeeded, want error", f)
+		}
+	}
+}
+
+func TestNetnsChildArgs(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("netns", "", "")
+	fs.String("store-dir", "", "")
+	fs.String("http-addr", "", "")
+	fs.String("stun-dst-ports", "", "")
+	fs.Bool("icmp", false, "")
+	fs.Duration("interval", time.Minute, "")
+	if err := fs.Parse([]string{"--netns=a,b", "--store-dir=/tmp", "--http-addr=:8080", "--stun-dst-ports=3478", "--icmp"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"--icmp=true", "--stun-dst-ports=3478"}
+	if got := netnsChildArgs(fs); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestNetnsPipe(t *testing.T) {
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	rtt := 10 * time.Millisecond
+	var buf bytes.Buffer
+	p := &netnsPipe{w: &buf}
+	sent := []result{{key: resultKey{meta: meta, protocol: protocolSTUN, dstPort: 3478}, at: time.Now(), rtt: &rtt}}
+	if err := p.write(context.Background(), outputBatch{results: sent}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.send("event", []byte(`{"Kind":"rebind","Attrs":{"removed":"100.64.0.1"}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	fb := &fakeBackend{unblock: make(chan struct{})}
+	close(fb.unblock)
+	s := &netnsSupervisor{outs: outputs{newOutputQueue(fb, 1)}, baselines: newBaselineTracker()}
+	if err := s.receive("uplink-a", &buf); err != nil {
+		t.Fatal(err)
+	}
+	s.outs.close(time.Second)
+	if fb.numWritten() != 1 {
+		t.Fatalf("got %d batches, want 1", fb.numWritten())
+	}
+	got := fb.written[0].results
+	if len(got) != 1 || got[0].key.netns != "uplink-a" || got[0].key.meta != meta || *got[0].rtt != rtt {
+		t.Errorf("got results %+v, want %+v from uplink-a", got, sent)
+	}
+	if sr := storedResultFromResult(got[0]); sr.Netns != "uplink-a" {
+		t.Errorf("got stored netns %q, want uplink-a", sr.Netns)
+	}
+	recent := events.recentEvents()
+	if ev := recent[len(recent)-1]; ev.Kind != eventKindRebind || ev.Attrs["netns"] != "uplink-a" || ev.Attrs["removed"] != "100.64.0.1" {
+		t.Errorf("got event %+v, want rebind from uplink-a", ev)
+	}
+
+	if err := s.receive("uplink-a", bytes.NewBufferString("bogus {}\n")); err == nil {
+		t.Error("got no error receiving invalid message type")
+	}
+}
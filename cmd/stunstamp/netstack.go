@@ -0,0 +1,331 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+	"tailscale.com/net/stun"
+)
+
+// netstackProxyName is the value of the proxy label for results of probes
+// via the netstackProber.
+const netstackProxyName = "netstack"
+
+var (
+	netstackClientIPv4 = netip.MustParseAddr("100.64.0.1")
+	netstackClientIPv6 = netip.MustParseAddr("fd7a:115c:a1e0::1")
+)
+
+// netstackProber probes targets through gVisor's netstack, as used by
+// tailscaled's userspace networking, rather than solely through the host's
+// network stack, in order to quantify the latency overhead of userspace
+// networking on constrained devices.
+//
+// Probes are sent from a client netstack, standing in for tailscaled dialing
+// out with netstack, to a forwarding netstack, standing in for tailscaled
+// forwarding flows it terminates to the host's network stack, like it does as
+// a subnet router or exit node in userspace networking mode. The two are
+// linked by channel endpoints rather than WireGuard, so that the overhead
+// measured is that of netstack alone. Results of netstack probes carry
+// netstackProxyName in resultKey.proxy, and are comparable to those of
+// unstable direct probes with userspace timestamps.
+type netstackProber struct {
+	client *stack.Stack
+	fwd    *stack.Stack
+}
+
+// activeNetstack is the netstackProber enabled via --netstack, or nil. It is
+// set once at startup.
+var activeNetstack *netstackProber
+
+const (
+	netstackNICID = 1
+	netstackMTU   = 1280
+	// netstackUDPIdleTimeout is how long forwarded UDP flows are kept without
+	// traffic.
+	netstackUDPIdleTimeout = 2 * txRxTimeout
+)
+
+func newNetstackStack() *stack.Stack {
+	return stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+}
+
+// setDefaultRoutes routes all IPv4 and IPv6 traffic of s via its sole NIC.
+func setDefaultRoutes(s *stack.Stack) error {
+	var routes []tcpip.Route
+	for _, n := range []int{4, 16} {
+		subnet, err := tcpip.NewSubnet(tcpip.AddrFromSlice(make([]byte, n)), tcpip.MaskFromBytes(make([]byte, n)))
+		if err != nil {
+			return err
+		}
+		routes = append(routes, tcpip.Route{Destination: subnet, NIC: netstackNICID})
+	}
+	s.SetRouteTable(routes)
+	return nil
+}
+
+func newNetstackProber() (*netstackProber, error) {
+	n := &netstackProber{
+		client: newNetstackStack(),
+		fwd:    newNetstackStack(),
+	}
+	clientEP := channel.New(512, netstackMTU, "")
+	fwdEP := channel.New(512, netstackMTU, "")
+	if err := n.client.CreateNIC(netstackNICID, clientEP); err != nil {
+		return nil, fmt.Errorf("error creating client NIC: %v", err)
+	}
+	if err := n.fwd.CreateNIC(netstackNICID, fwdEP); err != nil {
+		return nil, fmt.Errorf("error creating forwarder NIC: %v", err)
+	}
+	for _, addr := range []netip.Addr{netstackClientIPv4, netstackClientIPv6} {
+		proto := ipv4.ProtocolNumber
+		if addr.Is6() {
+			proto = ipv6.ProtocolNumber
+		}
+		err := n.client.AddProtocolAddress(netstackNICID, tcpip.ProtocolAddress{
+			Protocol:          proto,
+			AddressWithPrefix: tcpip.AddrFromSlice(addr.AsSlice()).WithPrefix(),
+		}, stack.AddressProperties{})
+		if err != nil {
+			return nil, fmt.Errorf("error adding client address %v: %v", addr, err)
+		}
+	}
+	// The forwarder accepts, and responds as, any destination.
+	n.fwd.SetPromiscuousMode(netstackNICID, true)
+	n.fwd.SetSpoofing(netstackNICID, true)
+	for _, s := range []*stack.Stack{n.client, n.fwd} {
+		if err := setDefaultRoutes(s); err != nil {
+			return nil, err
+		}
+	}
+	tcpFwd := tcp.NewForwarder(n.fwd, 0, 64, n.forwardTCP)
+	n.fwd.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpFwd.HandlePacket)
+	udpFwd := udp.NewForwarder(n.fwd, n.forwardUDP)
+	n.fwd.SetTransportProtocolHandler(udp.ProtocolNumber, udpFwd.HandlePacket)
+
+	go pumpPackets(clientEP, fwdEP)
+	go pumpPackets(fwdEP, clientEP)
+	return n, nil
+}
+
+// pumpPackets delivers the packets sent via from as received by to. It never
+// returns.
+func pumpPackets(from, to *channel.Endpoint) {
+	for {
+		pkt := from.ReadContext(context.Background())
+		if pkt == nil {
+			continue
+		}
+		b := pkt.ToView().AsSlice()
+		proto := header.IPv4ProtocolNumber
+		if len(b) > 0 && b[0]>>4 == 6 {
+			proto = header.IPv6ProtocolNumber
+		}
+		in := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Payload: buffer.MakeWithData(b),
+		})
+		pkt.DecRef()
+		to.InjectInbound(proto, in)
+		in.DecRef()
+	}
+}
+
+func addrPortOfNetstack(addr tcpip.Address, port uint16) netip.AddrPort {
+	ip, _ := netip.AddrFromSlice(addr.AsSlice())
+	return netip.AddrPortFrom(ip, port)
+}
+
+func netstackFullAddr(dst netip.AddrPort) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
+	proto := ipv4.ProtocolNumber
+	if dst.Addr().Is6() {
+		proto = ipv6.ProtocolNumber
+	}
+	return tcpip.FullAddress{
+		NIC:  netstackNICID,
+		Addr: tcpip.AddrFromSlice(dst.Addr().AsSlice()),
+		Port: dst.Port(),
+	}, proto
+}
+
+// forwardTCP forwards a TCP connection to the host's network stack. Like
+// tailscaled, it dials the destination before completing the handshake, so
+// that connect RTTs through netstack span those of the host.
+func (n *netstackProber) forwardTCP(r *tcp.ForwarderRequest) {
+	dst := addrPortOfNetstack(r.ID().LocalAddress, r.ID().LocalPort)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var d net.Dialer
+	hostConn, err := d.DialContext(ctx, "tcp", dst.String())
+	if err != nil {
+		r.Complete(true) // sends a RST
+		return
+	}
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		hostConn.Close()
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+	go splice(gonet.NewTCPConn(&wq, ep), hostConn)
+}
+
+// forwardUDP forwards a UDP flow to the host's network stack.
+func (n *netstackProber) forwardUDP(r *udp.ForwarderRequest) {
+	dst := addrPortOfNetstack(r.ID().LocalAddress, r.ID().LocalPort)
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		return
+	}
+	nsConn := gonet.NewUDPConn(&wq, ep)
+	hostConn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(dst))
+	if err != nil {
+		nsConn.Close()
+		return
+	}
+	go splice(nsConn, hostConn)
+}
+
+// splice copies between a and b in both directions until either fails, e.g.
+// is closed or, for UDP, idle for netstackUDPIdleTimeout, closing both.
+func splice(a, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			a.Close()
+			b.Close()
+		})
+	}
+	_, isUDP := b.(*net.UDPConn)
+	cp := func(dst, src net.Conn) {
+		defer closeBoth()
+		if !isUDP {
+			io.Copy(dst, src)
+			return
+		}
+		buf := make([]byte, 1<<16)
+		for {
+			src.SetReadDeadline(time.Now().Add(netstackUDPIdleTimeout))
+			n, err := src.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}
+	go cp(a, b)
+	cp(b, a)
+}
+
+// name returns the value of the proxy label for results of probes via n.
+func (n *netstackProber) name() string {
+	return netstackProxyName
+}
+
+// supports reports whether targets may be probed with p via n.
+func (n *netstackProber) supports(p protocol) bool {
+	switch p {
+	case protocolSTUN, protocolTCP, protocolHTTPS:
+		return true
+	}
+	return false
+}
+
+// connAndMeasureFn returns a connAndMeasureFn measuring p via n. Like proxied
+// probes, netstack probes dial on demand.
+func (n *netstackProber) connAndMeasureFn(p protocol) *connAndMeasureFn {
+	cf := &connAndMeasureFn{conn: proxiedConn{}}
+	switch p {
+	case protocolTCP:
+		cf.fn = n.measureTCPRTT
+	case protocolHTTPS:
+		cf.fn = n.measureHTTPSRTT
+	case protocolSTUN:
+		cf.fn = n.measureSTUNRTT
+	}
+	return cf
+}
+
+func (n *netstackProber) dialTCP(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
+	addr, proto := netstackFullAddr(dst)
+	return gonet.DialContextTCP(ctx, n.client, addr, proto)
+}
+
+// measureTCPRTT returns the time taken to establish a TCP connection to dst
+// through netstack.
+func (n *netstackProber) measureTCPRTT(ctx context.Context, _ io.ReadWriteCloser, _ string, dst netip.AddrPort) (measurement, error) {
+	ctx, cancel := context.WithTimeout(ctx, txRxTimeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := n.dialTCP(ctx, dst)
+	if err != nil {
+		return measurement{}, tempError{err}
+	}
+	rtt := time.Since(start)
+	conn.Close()
+	return measurement{rtt: rtt}, nil
+}
+
+// measureHTTPSRTT is measureHTTPSRTT through netstack.
+func (n *netstackProber) measureHTTPSRTT(ctx context.Context, _ io.ReadWriteCloser, hostname string, dst netip.AddrPort) (measurement, error) {
+	return measureHTTPS(ctx, hostname, dst, func(ctx context.Context) (net.Conn, error) {
+		return n.dialTCP(ctx, dst)
+	})
+}
+
+// measureSTUNRTT measures STUN RTT to dst through netstack.
+func (n *netstackProber) measureSTUNRTT(ctx context.Context, _ io.ReadWriteCloser, _ string, dst netip.AddrPort) (measurement, error) {
+	addr, proto := netstackFullAddr(dst)
+	conn, err := gonet.DialUDP(n.client, nil, &addr, proto)
+	if err != nil {
+		return measurement{}, tempError{err}
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(deadlineWithin(ctx, txRxTimeout)); err != nil {
+		return measurement{}, fmt.Errorf("error setting deadline: %w", err)
+	}
+	txID := stun.NewTxID()
+	txAt := time.Now()
+	if _, err := conn.Write(stun.Request(txID)); err != nil {
+		return measurement{}, fmt.Errorf("error writing to netstack udp conn: %w", err)
+	}
+	b := make([]byte, 1460)
+	for {
+		n, err := conn.Read(b)
+		rxAt := time.Now()
+		if err != nil {
+			return measurement{}, fmt.Errorf("error reading from netstack udp conn: %w", err)
+		}
+		gotTxID, _, err := stun.ParseResponse(b[:n])
+		if err != nil || gotTxID != txID {
+			continue
+		}
+		return measurement{rtt: rxAt.Sub(txAt), instance: stunResponseInstance(b[:n]), stunResponse: sampledSTUNResponse(ctx, b[:n])}, nil
+	}
+}
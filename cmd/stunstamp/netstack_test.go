@@ -0,0 +1,83 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"tailscale.com/net/stun/stuntest"
+)
+
+// nonLoopbackIPv4 returns an IPv4 address of this host other than a loopback
+// address, which netstack refuses to route to.
+func nonLoopbackIPv4(t *testing.T) netip.Addr {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range addrs {
+		if p, err := netip.ParsePrefix(a.String()); err == nil && p.Addr().Is4() && !p.Addr().IsLoopback() {
+			return p.Addr()
+		}
+	}
+	t.Skip("no non-loopback IPv4 address")
+	return netip.Addr{}
+}
+
+func TestNetstackProber(t *testing.T) {
+	local := nonLoopbackIPv4(t)
+	n, err := newNetstackProber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.supports(protocolICMP) || !n.supports(protocolSTUN) || n.name() != netstackProxyName {
+		t.Errorf("unexpected netstack prober: %v %v", n.name(), n.supports(protocolICMP))
+	}
+	ctx := context.Background()
+
+	ln, err := net.Listen("tcp", netip.AddrPortFrom(local, 0).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	m, err := n.connAndMeasureFn(protocolTCP).fn(ctx, nil, "", netip.MustParseAddrPort(ln.Addr().String()))
+	if err != nil {
+		t.Fatalf("TCP via netstack: %v", err)
+	}
+	if m.rtt <= 0 {
+		t.Errorf("TCP via netstack: got rtt %v", m.rtt)
+	}
+
+	// Nothing listens on the closed port, which the forwarder must reflect.
+	closed, err := net.Listen("tcp", netip.AddrPortFrom(local, 0).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	if _, err := n.measureTCPRTT(ctx, nil, "", netip.MustParseAddrPort(closed.Addr().String())); err == nil {
+		t.Error("TCP via netstack to closed port unexpectedly succeeded")
+	}
+
+	stunAddr, cleanup := stuntest.Serve(t)
+	defer cleanup()
+	m, err = n.measureSTUNRTT(ctx, nil, "", netip.AddrPortFrom(local, uint16(stunAddr.Port)))
+	if err != nil {
+		t.Fatalf("STUN via netstack: %v", err)
+	}
+	if m.rtt <= 0 {
+		t.Errorf("STUN via netstack: got rtt %v", m.rtt)
+	}
+}
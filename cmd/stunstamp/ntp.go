@@ -0,0 +1,372 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// This file implements a client-mode NTP (RFC 5905) probe of configured
+// servers, recording the delay and offset of every server, and deriving the
+// quality of this host's clock from them for the Error Estimate of TWAMP
+// timestamps. PTP is not probed, as PTP masters are rarely reachable beyond
+// the local segment.
+
+// errUnexpectedNTPPacket is returned for packets that are not a response to
+// our request, e.g. late responses to a previous one.
+var errUnexpectedNTPPacket = errors.New("unexpected packet")
+
+const (
+	ntpDelayMetricName    = "stunstamp_ntp_delay_ns"
+	ntpOffsetMetricName   = "stunstamp_ntp_offset_ns"
+	ntpStratumMetricName  = "stunstamp_ntp_stratum"
+	ntpTimeoutsMetricName = "stunstamp_ntp_timeouts_total"
+	clockErrorMetricName  = "stunstamp_clock_error_bound_ns"
+	ntpDefaultPort        = "123"
+	ntpPacketLen          = 48
+	ntpVersion            = 4
+	ntpModeClient         = 3
+	ntpModeServer         = 4
+	ntpLeapUnsynchronized = 3
+	ntpMaxStratum         = 15
+	// ntpClockQualityValidFor is the minimum age at which clock quality is
+	// no longer used; it is valid for at least two intervals.
+	ntpClockQualityValidFor = 5 * time.Minute
+)
+
+// parseNTPServers parses a comma-separated list of NTP servers in the form
+// host[:port].
+func parseNTPServers(s string) ([]string, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	var ret []string
+	for _, server := range strings.Split(s, ",") {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, ntpDefaultPort)
+		}
+		host, _, err := net.SplitHostPort(server)
+		if err != nil || host == "" {
+			return nil, fmt.Errorf("invalid NTP server %q", server)
+		}
+		ret = append(ret, server)
+	}
+	slices.Sort(ret)
+	return slices.Compact(ret), nil
+}
+
+// ntpResult is the measurement of an NTP server. delay and offset are nil on
+// failure.
+type ntpResult struct {
+	server  string // as configured
+	addr    netip.Addr
+	at      time.Time
+	stratum int
+	// delay is the round-trip delay, excluding the time the server held
+	// the request.
+	delay *time.Duration
+	// offset is the offset of the server's clock from ours.
+	offset *time.Duration
+}
+
+// ntpRequest returns a client-mode request. Its transmit timestamp is a
+// random cookie rather than our clock, as recommended by RFC 9109, which the
+// server echoes as the origin timestamp of its response.
+func ntpRequest() (req []byte, cookie uint64) {
+	req = make([]byte, ntpPacketLen)
+	req[0] = ntpVersion<<3 | ntpModeClient
+	rand.Read(req[40:])
+	return req, binary.BigEndian.Uint64(req[40:])
+}
+
+// parseNTPResponse validates a response to the request with cookie, returning
+// its stratum, receive timestamp, and transmit timestamp.
+func parseNTPResponse(b []byte, cookie uint64) (stratum int, rx, tx time.Time, err error) {
+	if len(b) < ntpPacketLen {
+		return 0, rx, tx, errors.New("short packet")
+	}
+	if b[0]&0x7 != ntpModeServer || binary.BigEndian.Uint64(b[24:]) != cookie {
+		return 0, rx, tx, errUnexpectedNTPPacket
+	}
+	stratum = int(b[1])
+	if stratum == 0 {
+		return 0, rx, tx, fmt.Errorf("kiss-o'-death %q", strings.TrimRight(string(b[12:16]), "\x00"))
+	}
+	if b[0]>>6 == ntpLeapUnsynchronized || stratum > ntpMaxStratum {
+		return 0, rx, tx, errors.New("server unsynchronized")
+	}
+	return stratum, fromNTPTimestamp(binary.BigEndian.Uint64(b[32:])), fromNTPTimestamp(binary.BigEndian.Uint64(b[40:])), nil
+}
+
+// measureNTP queries server once.
+func measureNTP(ctx context.Context, server string) ntpResult {
+	r := ntpResult{server: server, at: time.Now()}
+	if err := measureNTPExchange(ctx, &r); err != nil {
+		probeLog.Warn("error measuring NTP server", "server", server, "addr", r.addr, "err", err)
+		r.delay, r.offset = nil, nil
+	}
+	return r
+}
+
+func measureNTPExchange(ctx context.Context, r *ntpResult) error {
+	ctx, cancel := context.WithTimeout(ctx, txRxTimeout)
+	defer cancel()
+	host, port, _ := net.SplitHostPort(r.server) // parsed
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", net.JoinHostPort(host, port))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ap, err := netip.ParseAddrPort(c.RemoteAddr().String()); err == nil {
+		r.addr = ap.Addr().Unmap()
+	}
+	if err := c.SetDeadline(deadlineWithin(ctx, txRxTimeout)); err != nil {
+		return err
+	}
+	req, cookie := ntpRequest()
+	t1 := time.Now()
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+	b := make([]byte, 512)
+	for {
+		n, err := c.Read(b)
+		t4 := time.Now()
+		if err != nil {
+			return tempError{err}
+		}
+		stratum, t2, t3, err := parseNTPResponse(b[:n], cookie)
+		if err != nil {
+			if errors.Is(err, errUnexpectedNTPPacket) {
+				continue
+			}
+			return err
+		}
+		// RFC 5905 section 8.
+		delay := t4.Sub(t1) - t3.Sub(t2)
+		offset := (t2.Sub(t1) + t3.Sub(t4)) / 2
+		r.stratum, r.delay, r.offset = stratum, &delay, &offset
+		return nil
+	}
+}
+
+// measureAllNTP measures every server in servers concurrently.
+func measureAllNTP(ctx context.Context, servers []string) []ntpResult {
+	results := make([]ntpResult, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = measureNTP(ctx, server)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// clockQuality is the quality of this host's clock as measured against NTP
+// servers.
+type clockQuality struct {
+	At     time.Time
+	Server string
+	// Offset is the offset of the server's clock from ours, and Delay the
+	// round-trip delay, of the measurement with the lowest delay.
+	Offset time.Duration
+	Delay  time.Duration
+	// ErrorBound bounds the error of our clock: the magnitude of the offset
+	// plus half the delay, as the path may be asymmetric.
+	ErrorBound time.Duration
+}
+
+// activeClockQuality is the latest clockQuality, or nil if NTP servers have
+// not been measured.
+var activeClockQuality atomic.Pointer[clockQuality]
+
+// clockQualityOf returns the clock quality from the successful measurement
+// with the lowest delay in results, which is the least affected by queueing.
+func clockQualityOf(results []ntpResult) (clockQuality, bool) {
+	var best *ntpResult
+	for i, r := range results {
+		if r.delay != nil && (best == nil || *r.delay < *best.delay) {
+			best = &results[i]
+		}
+	}
+	if best == nil {
+		return clockQuality{}, false
+	}
+	return clockQuality{
+		At:         best.at,
+		Server:     best.server,
+		Offset:     *best.offset,
+		Delay:      *best.delay,
+		ErrorBound: best.offset.Abs() + *best.delay/2,
+	}, true
+}
+
+// twampErrorEstimateAt returns the Error Estimate (RFC 4656 section 4.1.2)
+// of our timestamps at now: synchronized, with the error bound of
+// activeClockQuality, if it is recent, otherwise twampErrorEstimate.
+func twampErrorEstimateAt(now time.Time) uint16 {
+	q := activeClockQuality.Load()
+	if q == nil || now.Sub(q.At) > max(ntpClockQualityValidFor, 2**flagInterval) {
+		return twampErrorEstimate
+	}
+	return errorEstimateOf(q.ErrorBound)
+}
+
+// errorEstimateOf encodes d as a synchronized Error Estimate, i.e.
+// Multiplier*2^(Scale-32) seconds, rounded up.
+func errorEstimateOf(d time.Duration) uint16 {
+	// In units of 2^-32 seconds.
+	hi, lo := bits.Mul64(uint64(max(d, 1)), 1<<32)
+	units, rem := bits.Div64(hi, lo, uint64(time.Second))
+	if rem > 0 {
+		units++
+	}
+	scale := 0
+	for units > math.MaxUint8 && scale < 63 {
+		units = (units + 1) >> 1
+		scale++
+	}
+	return 1<<15 | uint16(scale)<<8 | uint16(min(units, math.MaxUint8))
+}
+
+// ntpTracker counts the failures of every NTP server, tracks the timeseries
+// written, and maintains activeClockQuality. It is not safe for concurrent
+// use.
+type ntpTracker struct {
+	timeouts map[string]uint64
+	addrs    map[string]netip.Addr // last of every server
+	clock    bool                  // whether the clock error bound was written
+}
+
+func newNTPTracker() *ntpTracker {
+	return &ntpTracker{
+		timeouts: make(map[string]uint64),
+		addrs:    make(map[string]netip.Addr),
+	}
+}
+
+func ntpTimeSeries(metricName, server string, addr netip.Addr, instance string, at time.Time, value float64) prompb.TimeSeries {
+	labels := []prompb.Label{
+		{Name: "__name__", Value: metricName},
+		{Name: "job", Value: "stunstamp-rw"},
+		{Name: "instance", Value: instance},
+		{Name: "server", Value: server},
+	}
+	if addr.IsValid() {
+		labels = append(labels, prompb.Label{Name: "addr", Value: addr.String()})
+	}
+	slices.SortFunc(labels, func(a, b prompb.Label) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return prompb.TimeSeries{
+		Labels:  labels,
+		Samples: []prompb.Sample{{Timestamp: at.UnixMilli(), Value: value}},
+	}
+}
+
+// update returns timeseries for results, counting failures, and stale markers
+// for servers absent from results or resolving to another address.
+func (t *ntpTracker) update(results []ntpResult, instance string) []prompb.TimeSeries {
+	var ts []prompb.TimeSeries
+	current := make(map[string]bool)
+	for _, r := range results {
+		current[r.server] = true
+		if r.delay == nil {
+			t.timeouts[r.server]++
+		} else if _, ok := t.timeouts[r.server]; !ok {
+			t.timeouts[r.server] = 0
+		}
+		addr := r.addr
+		if prev, ok := t.addrs[r.server]; ok && prev != addr {
+			if addr.IsValid() {
+				ts = append(ts, ntpStaleMarkers(r.server, prev, instance, r.at)...)
+			} else {
+				// Keep the series continuous across resolution failures.
+				addr = prev
+			}
+		}
+		if addr.IsValid() {
+			t.addrs[r.server] = addr
+		}
+		value := func(d *time.Duration) float64 {
+			if d == nil {
+				return math.NaN()
+			}
+			return float64(*d)
+		}
+		stratum := math.NaN()
+		if r.delay != nil {
+			stratum = float64(r.stratum)
+		}
+		ts = append(ts,
+			ntpTimeSeries(ntpDelayMetricName, r.server, addr, instance, r.at, value(r.delay)),
+			ntpTimeSeries(ntpOffsetMetricName, r.server, addr, instance, r.at, value(r.offset)),
+			ntpTimeSeries(ntpStratumMetricName, r.server, addr, instance, r.at, stratum),
+			ntpTimeSeries(ntpTimeoutsMetricName, r.server, netip.Addr{}, instance, r.at, float64(t.timeouts[r.server])),
+		)
+	}
+	now := time.Now()
+	for server := range t.timeouts {
+		if !current[server] {
+			ts = append(ts, ntpStaleMarkers(server, t.addrs[server], instance, now)...)
+			delete(t.timeouts, server)
+			delete(t.addrs, server)
+		}
+	}
+	if q, ok := clockQualityOf(results); ok {
+		activeClockQuality.Store(&q)
+		ts = append(ts, instanceTimeSeries(clockErrorMetricName, instance, q.At, float64(q.ErrorBound)))
+		t.clock = true
+	}
+	return ts
+}
+
+// staleMarkers returns stale markers for the series of every NTP server
+// queried, and for the clock error estimated from them.
+func (t *ntpTracker) staleMarkers(instance string) []prompb.TimeSeries {
+	now := time.Now()
+	var ts []prompb.TimeSeries
+	for server := range t.timeouts {
+		ts = append(ts, ntpStaleMarkers(server, t.addrs[server], instance, now)...)
+	}
+	if t.clock {
+		ts = append(ts, instanceTimeSeries(clockErrorMetricName, instance, now, math.Float64frombits(staleNaN)))
+	}
+	return ts
+}
+
+func ntpStaleMarkers(server string, addr netip.Addr, instance string, at time.Time) []prompb.TimeSeries {
+	stale := math.Float64frombits(staleNaN)
+	ts := []prompb.TimeSeries{
+		ntpTimeSeries(ntpTimeoutsMetricName, server, netip.Addr{}, instance, at, stale),
+	}
+	if addr.IsValid() {
+		ts = append(ts,
+			ntpTimeSeries(ntpDelayMetricName, server, addr, instance, at, stale),
+			ntpTimeSeries(ntpOffsetMetricName, server, addr, instance, at, stale),
+			ntpTimeSeries(ntpStratumMetricName, server, addr, instance, at, stale),
+		)
+	}
+	return ts
+}
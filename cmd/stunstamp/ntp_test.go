@@ -0,0 +1,157 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// serveNTP runs a fake NTP server on loopback whose clock is ahead of ours by
+// offset, answering with stratum, and returns its address.
+func serveNTP(t *testing.T, offset time.Duration, stratum byte) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			rxAt := time.Now().Add(offset)
+			if n < ntpPacketLen {
+				continue
+			}
+			resp := make([]byte, ntpPacketLen)
+			resp[0] = ntpVersion<<3 | ntpModeServer
+			resp[1] = stratum
+			copy(resp[12:16], "RATE")
+			copy(resp[24:32], b[40:48])
+			binary.BigEndian.PutUint64(resp[32:], toNTPTimestamp(rxAt))
+			binary.BigEndian.PutUint64(resp[40:], toNTPTimestamp(time.Now().Add(offset)))
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func labelValue(labels []prompb.Label, name string) string {
+	for _, l := range labels {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+func TestParseNTPServers(t *testing.T) {
+	got, err := parseNTPServers("time.example.com,10.0.0.1:1123,[::1]:123,time.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.1:1123", "[::1]:123", "time.example.com:123"}
+	if !slices.Equal(got, want) {
+		t.Errorf("parseNTPServers = %v, want %v", got, want)
+	}
+	if _, err := parseNTPServers(":123"); err == nil {
+		t.Error("parseNTPServers of server without host unexpectedly succeeded")
+	}
+}
+
+func TestMeasureNTP(t *testing.T) {
+	const offset = 3 * time.Second
+	good := serveNTP(t, offset, 2)
+	kod := serveNTP(t, 0, 0)
+	results := measureAllNTP(context.Background(), []string{good, kod})
+
+	r := results[0]
+	if r.delay == nil {
+		t.Fatalf("measuring %s failed", good)
+	}
+	if *r.delay < 0 || *r.delay > time.Second {
+		t.Errorf("delay = %v", *r.delay)
+	}
+	if d := (*r.offset - offset).Abs(); d > 100*time.Millisecond {
+		t.Errorf("offset = %v, want ~%v", *r.offset, offset)
+	}
+	if r.stratum != 2 || r.addr.String() != "127.0.0.1" {
+		t.Errorf("stratum, addr = %d, %v", r.stratum, r.addr)
+	}
+	if results[1].delay != nil {
+		t.Errorf("kiss-o'-death response unexpectedly succeeded")
+	}
+
+	tracker := newNTPTracker()
+	activeClockQuality.Store(nil)
+	defer activeClockQuality.Store(nil)
+	ts := tracker.update(results, "i")
+	q := activeClockQuality.Load()
+	if q == nil || q.Server != good {
+		t.Fatalf("activeClockQuality = %+v", q)
+	}
+	if tracker.timeouts[kod] != 1 {
+		t.Errorf("timeouts of %s = %d, want 1", kod, tracker.timeouts[kod])
+	}
+	var clock bool
+	for _, s := range ts {
+		if labelValue(s.Labels, "__name__") == clockErrorMetricName {
+			clock = true
+			if v := s.Samples[0].Value; v < float64(offset) {
+				t.Errorf("clock error bound %v < offset %v", time.Duration(v), offset)
+			}
+		}
+	}
+	if !clock {
+		t.Error("no clock error bound timeseries")
+	}
+
+	// Removing a server marks its timeseries stale.
+	ts = tracker.update(results[:1], "i")
+	var stale int
+	for _, s := range ts {
+		if labelValue(s.Labels, "server") == kod && math.Float64bits(s.Samples[0].Value) == staleNaN {
+			stale++
+		}
+	}
+	if stale != 4 {
+		t.Errorf("stale markers for removed server = %d, want 4", stale)
+	}
+}
+
+func TestTWAMPErrorEstimate(t *testing.T) {
+	activeClockQuality.Store(nil)
+	defer activeClockQuality.Store(nil)
+	now := time.Now()
+	if got := twampErrorEstimateAt(now); got != twampErrorEstimate {
+		t.Errorf("error estimate without clock quality = %#x, want %#x", got, twampErrorEstimate)
+	}
+	activeClockQuality.Store(&clockQuality{At: now, ErrorBound: 5 * time.Millisecond})
+	got := twampErrorEstimateAt(now)
+	if got>>15 != 1 {
+		t.Errorf("error estimate %#x not synchronized", got)
+	}
+	scale, mult := int(got>>8&0x3f), float64(got&0xff)
+	if mult == 0 {
+		t.Errorf("error estimate %#x has zero multiplier", got)
+	}
+	// Multiplier*2^(Scale-32) seconds, rounded up to within a factor of 2.
+	if est := time.Duration(mult * math.Ldexp(1, scale-32) * float64(time.Second)); est < 5*time.Millisecond || est > 10*time.Millisecond {
+		t.Errorf("error estimate %#x = %v, want ~5ms", got, est)
+	}
+	if got := twampErrorEstimateAt(now.Add(time.Hour)); got != twampErrorEstimate {
+		t.Errorf("error estimate with stale clock quality = %#x, want %#x", got, twampErrorEstimate)
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// otlpFlagNoRecordedValue is the DataPointFlags of OTLP data points without a
+// value, which stale markers and failed probes are exported as.
+const otlpFlagNoRecordedValue = 1
+
+// otlpAggregationTemporalityCumulative is OTLP's
+// AGGREGATION_TEMPORALITY_CUMULATIVE, that of stunstamp's counters.
+const otlpAggregationTemporalityCumulative = 2
+
+// otlpBackend exports time series as OTLP metrics over HTTP, in the JSON
+// encoding of OTLP/HTTP, for collectors that do not accept Prometheus remote
+// write. Series named *_total are exported as monotonic cumulative sums, and
+// all others as gauges. The exemplars of RTT samples are exported with the
+// measurement ID as their span ID, and as a measurement_id attribute.
+type otlpBackend struct {
+	c   *http.Client
+	url string
+	// labels are added to every timeseries written, see remoteWriteClient.
+	labels []prompb.Label
+	// privacy anonymizes the addresses in labels written, if non-nil.
+	privacy *ipPrivacy
+}
+
+func newOTLPBackend(url string) *otlpBackend {
+	return &otlpBackend{
+		c: &http.Client{
+			Timeout: time.Second * 30,
+		},
+		url: url,
+	}
+}
+
+func (*otlpBackend) name() string { return "otlp" }
+
+// The following types are the subset of the OTLP/HTTP JSON encoding of
+// ExportMetricsServiceRequest written by otlpBackend, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding. 64-bit
+// integers are encoded as strings, and span IDs in hex.
+type (
+	otlpMetricsRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpMetric struct {
+		Name  string     `json:"name"`
+		Gauge *otlpGauge `json:"gauge,omitempty"`
+		Sum   *otlpSum   `json:"sum,omitempty"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpDataPoint `json:"dataPoints"`
+	}
+	otlpSum struct {
+		DataPoints             []otlpDataPoint `json:"dataPoints"`
+		AggregationTemporality int             `json:"aggregationTemporality"`
+		IsMonotonic            bool            `json:"isMonotonic"`
+	}
+	otlpDataPoint struct {
+		Attributes   []otlpKeyValue `json:"attributes"`
+		TimeUnixNano string         `json:"timeUnixNano"`
+		AsDouble     *float64       `json:"asDouble,omitempty"`
+		Exemplars    []otlpExemplar `json:"exemplars,omitempty"`
+		Flags        uint32         `json:"flags,omitempty"`
+	}
+	otlpExemplar struct {
+		FilteredAttributes []otlpKeyValue `json:"filteredAttributes,omitempty"`
+		TimeUnixNano       string         `json:"timeUnixNano"`
+		AsDouble           float64        `json:"asDouble"`
+		SpanID             string         `json:"spanId,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue string `json:"stringValue"`
+	}
+)
+
+// otlpTime returns the OTLP encoding of the Prometheus timestamp ms.
+func otlpTime(ms int64) string {
+	return strconv.FormatInt(ms*int64(time.Millisecond), 10)
+}
+
+// otlpMetricsRequestOf converts ts to an OTLP metrics request. The __name__
+// label of a series is its metric name, and its other labels are the
+// attributes of its data points.
+func otlpMetricsRequestOf(ts []prompb.TimeSeries) otlpMetricsRequest {
+	var metrics []otlpMetric
+	byName := make(map[string]int) // index in metrics
+	for _, t := range ts {
+		var name string
+		var attrs []otlpKeyValue
+		for _, l := range t.Labels {
+			if l.Name == "__name__" {
+				name = l.Value
+				continue
+			}
+			attrs = append(attrs, otlpKeyValue{Key: l.Name, Value: otlpAnyValue{StringValue: l.Value}})
+		}
+		i, ok := byName[name]
+		if !ok {
+			i = len(metrics)
+			byName[name] = i
+			m := otlpMetric{Name: name}
+			if strings.HasSuffix(name, "_total") {
+				m.Sum = &otlpSum{AggregationTemporality: otlpAggregationTemporalityCumulative, IsMonotonic: true}
+			} else {
+				m.Gauge = &otlpGauge{}
+			}
+			metrics = append(metrics, m)
+		}
+		for _, s := range t.Samples {
+			dp := otlpDataPoint{
+				Attributes:   attrs,
+				TimeUnixNano: otlpTime(s.Timestamp),
+			}
+			// JSON cannot encode NaN, which are either stale markers or
+			// the RTTs of failed probes.
+			if math.IsNaN(s.Value) {
+				dp.Flags = otlpFlagNoRecordedValue
+			} else {
+				dp.AsDouble = &s.Value
+			}
+			for _, e := range t.Exemplars {
+				if e.Timestamp != s.Timestamp {
+					continue
+				}
+				oe := otlpExemplar{
+					TimeUnixNano: otlpTime(e.Timestamp),
+					AsDouble:     e.Value,
+				}
+				for _, l := range e.Labels {
+					oe.FilteredAttributes = append(oe.FilteredAttributes, otlpKeyValue{Key: l.Name, Value: otlpAnyValue{StringValue: l.Value}})
+					if l.Name == measurementIDLabel {
+						// Measurement IDs are 8 random bytes, as span
+						// IDs are, so that exemplars link to them by
+						// span ID as well.
+						oe.SpanID = l.Value
+					}
+				}
+				dp.Exemplars = append(dp.Exemplars, oe)
+			}
+			if m := &metrics[i]; m.Sum != nil {
+				m.Sum.DataPoints = append(m.Sum.DataPoints, dp)
+			} else {
+				m.Gauge.DataPoints = append(m.Gauge.DataPoints, dp)
+			}
+		}
+	}
+	return otlpMetricsRequest{
+		ResourceMetrics: []otlpResourceMetrics{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{{Key: "service.name", Value: otlpAnyValue{StringValue: "stunstamp"}}},
+			},
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope:   otlpScope{Name: "tailscale.com/cmd/stunstamp"},
+				Metrics: metrics,
+			}},
+		}},
+	}
+}
+
+func (o *otlpBackend) write(ctx context.Context, b outputBatch) error {
+	if len(b.ts) == 0 {
+		return nil
+	}
+	ts := b.ts
+	if len(o.labels) > 0 {
+		labeled := make([]prompb.TimeSeries, len(ts))
+		for i, t := range ts {
+			t.Labels = append(slices.Clip(t.Labels), o.labels...)
+			labeled[i] = t
+		}
+		ts = labeled
+	}
+	if o.privacy != nil {
+		ts = o.privacy.timeSeries(ts)
+	}
+	body, err := json.Marshal(otlpMetricsRequestOf(ts))
+	if err != nil {
+		return fmt.Errorf("unable to marshal OTLP request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", o.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create OTLP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "stunstamp")
+	resp, err := o.c.Do(req)
+	if err != nil {
+		return recoverableErr{fmt.Errorf("error performing OTLP request: %w", err)}
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	// Per the OTLP/HTTP spec, 429, 502, 503, and 504 are retryable.
+	err = fmt.Errorf("OTLP collector %s returned HTTP status %d", o.url, resp.StatusCode)
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return recoverableErr{err}
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestOTLPBackend(t *testing.T) {
+	rtt := 5 * time.Millisecond
+	ok := result{
+		key: resultKey{
+			meta:     nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")},
+			protocol: protocolSTUN,
+			dstPort:  3478,
+		},
+		at:  time.UnixMilli(1700000000000),
+		rtt: &rtt,
+		id:  newMeasurementID(),
+	}
+	failed := ok
+	failed.key.meta.hostname = "1b"
+	failed.key.meta.addr = netip.MustParseAddr("192.0.2.2")
+	failed.rtt = nil
+	failed.id = newMeasurementID()
+	ts := resultsToPromTimeSeries([]result{ok, failed}, "test", make(map[resultKey]uint64), true)
+
+	var got otlpMetricsRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Errorf("invalid request %s: %v", b, err)
+		}
+	}))
+	defer srv.Close()
+	o := newOTLPBackend(srv.URL)
+	o.labels = []prompb.Label{{Name: "netns", Value: "uplink-a"}}
+	if err := o.write(context.Background(), outputBatch{ts: ts}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.ResourceMetrics) != 1 || len(got.ResourceMetrics[0].ScopeMetrics) != 1 {
+		t.Fatalf("unexpected request: %+v", got)
+	}
+	metrics := make(map[string]otlpMetric)
+	for _, m := range got.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+	attr := func(dp otlpDataPoint, key string) string {
+		for _, kv := range dp.Attributes {
+			if kv.Key == key {
+				return kv.Value.StringValue
+			}
+		}
+		return ""
+	}
+
+	rttMetric := metrics[rttMetricName]
+	if rttMetric.Gauge == nil || len(rttMetric.Gauge.DataPoints) != 2 {
+		t.Fatalf("unexpected %s: %+v", rttMetricName, rttMetric)
+	}
+	for _, dp := range rttMetric.Gauge.DataPoints {
+		if attr(dp, "netns") != "uplink-a" || attr(dp, "instance") != "test" {
+			t.Errorf("unexpected attributes: %+v", dp.Attributes)
+		}
+		if dp.TimeUnixNano != strconv.FormatInt(ok.at.UnixNano(), 10) {
+			t.Errorf("TimeUnixNano = %s", dp.TimeUnixNano)
+		}
+		switch attr(dp, "hostname") {
+		case "1a":
+			if dp.AsDouble == nil || *dp.AsDouble != float64(rtt) || dp.Flags != 0 {
+				t.Errorf("unexpected data point: %+v", dp)
+			}
+			if len(dp.Exemplars) != 1 {
+				t.Fatalf("exemplars = %+v", dp.Exemplars)
+			}
+			if e := dp.Exemplars[0]; e.SpanID != ok.id || e.AsDouble != float64(rtt) || len(e.FilteredAttributes) != 1 || e.FilteredAttributes[0].Key != measurementIDLabel {
+				t.Errorf("unexpected exemplar: %+v", e)
+			}
+		case "1b":
+			// Failed probes have neither a value nor an exemplar.
+			if dp.AsDouble != nil || dp.Flags != otlpFlagNoRecordedValue || len(dp.Exemplars) != 0 {
+				t.Errorf("unexpected data point of failed probe: %+v", dp)
+			}
+		default:
+			t.Errorf("unexpected data point: %+v", dp)
+		}
+	}
+
+	timeoutsMetric := metrics[timeoutsMetricName]
+	if timeoutsMetric.Sum == nil || !timeoutsMetric.Sum.IsMonotonic || timeoutsMetric.Sum.AggregationTemporality != otlpAggregationTemporalityCumulative || len(timeoutsMetric.Sum.DataPoints) != 2 {
+		t.Errorf("unexpected %s: %+v", timeoutsMetricName, timeoutsMetric)
+	}
+}
+
+func TestOTLPBackendStatus(t *testing.T) {
+	for _, tt := range []struct {
+		status      int
+		wantErr     bool
+		recoverable bool
+	}{
+		{http.StatusOK, false, false},
+		{http.StatusBadRequest, true, false},
+		{http.StatusTooManyRequests, true, true},
+		{http.StatusServiceUnavailable, true, true},
+		{http.StatusInternalServerError, true, false},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+		err := newOTLPBackend(srv.URL).write(context.Background(), outputBatch{ts: []prompb.TimeSeries{
+			instanceTimeSeries(outputDroppedMetricName, "test", time.Now(), 1),
+		}})
+		srv.Close()
+		var re recoverableErr
+		if (err != nil) != tt.wantErr || errors.As(err, &re) != tt.recoverable {
+			t.Errorf("status %d: err = %v, recoverable = %v", tt.status, err, errors.As(err, &re))
+		}
+	}
+}
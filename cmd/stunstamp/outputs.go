@@ -0,0 +1,284 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"tailscale.com/logtail/backoff"
+)
+
+// outputBatch is the output of a probe window, or a batch of stale markers.
+type outputBatch struct {
+	results []result
+	ts      []prompb.TimeSeries
+}
+
+// outputBackend is a destination for outputBatches, e.g. Prometheus remote
+// write, the results store, or a webhook.
+type outputBackend interface {
+	// name identifies the backend in logs and metrics.
+	name() string
+	// write writes b, returning a recoverableErr if it should be retried.
+	write(ctx context.Context, b outputBatch) error
+}
+
+// outputQueue buffers and writes batches to a single outputBackend from its
+// own goroutine, retrying recoverable errors with backoff. Backends thereby
+// fail independently: an unavailable Prometheus endpoint does not delay
+// writes to the store, and vice versa. When the buffer is full the oldest
+// batch is dropped.
+type outputQueue struct {
+	backend outputBackend
+	ch      chan outputBatch
+	done    chan struct{}
+	dropped atomic.Uint64
+}
+
+// newOutputQueue returns an outputQueue for backend buffering up to depth
+// batches, and starts its goroutine.
+func newOutputQueue(backend outputBackend, depth int) *outputQueue {
+	q := &outputQueue{
+		backend: backend,
+		ch:      make(chan outputBatch, depth),
+		done:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// enqueue buffers b for writing without blocking.
+func (q *outputQueue) enqueue(b outputBatch) {
+	for {
+		select {
+		case q.ch <- b:
+			return
+		default:
+		}
+		select {
+		case <-q.ch:
+			q.dropped.Add(1)
+			exportLog.Warn("output buffer full, dropped oldest batch", "output", q.backend.name())
+		default:
+		}
+	}
+}
+
+func (q *outputQueue) run() {
+	defer close(q.done)
+	bo := backoff.NewBackoff(q.backend.name(), logfOf(exportLog), time.Second*30)
+	// writeErr may contribute to bo's backoff schedule across batches, i.e.
+	// if an unrecoverable error occurs for write(ctx, A), that should be
+	// accounted against bo prior to attempting write(ctx, B).
+	var writeErr error
+	for b := range q.ch {
+		for {
+			bo.BackOff(context.Background(), writeErr)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+			writeErr = q.backend.write(ctx, b)
+			cancel()
+			var re recoverableErr
+			recoverable := errors.As(writeErr, &re)
+			if writeErr != nil {
+				exportLog.Warn("output write error", "output", q.backend.name(), "recoverable", recoverable, "err", writeErr)
+			}
+			if !recoverable {
+				// a nil err is not recoverable
+				break
+			}
+		}
+	}
+}
+
+// outputs fans batches out to a set of outputQueues.
+type outputs []*outputQueue
+
+// dropped returns the total number of batches dropped across outputs.
+func (o outputs) dropped() uint64 {
+	var n uint64
+	for _, q := range o {
+		n += q.dropped.Load()
+	}
+	return n
+}
+
+func (o outputs) enqueue(b outputBatch) {
+	for _, q := range o {
+		q.enqueue(b)
+	}
+}
+
+// close stops accepting batches and waits up to timeout for buffered
+// batches to be written.
+func (o outputs) close(timeout time.Duration) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, q := range o {
+		close(q.ch)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-ctx.Done():
+				exportLog.Warn("timed out flushing output", "output", q.backend.name(), "buffered", len(q.ch))
+			case <-q.done:
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+const outputDroppedMetricName = "stunstamp_output_dropped_batches_total"
+
+// toPromTimeSeries returns the number of batches dropped by each output.
+func (o outputs) toPromTimeSeries(instance string, at time.Time) []prompb.TimeSeries {
+	ts := make([]prompb.TimeSeries, 0, len(o))
+	for _, q := range o {
+		t := instanceTimeSeries(outputDroppedMetricName, instance, at, float64(q.dropped.Load()))
+		t.Labels = append(t.Labels, prompb.Label{Name: "output", Value: q.backend.name()})
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+// remoteWriteBackend writes time series via Prometheus remote write.
+type remoteWriteBackend struct {
+	c *remoteWriteClient
+}
+
+func (remoteWriteBackend) name() string { return "remote-write" }
+
+func (r remoteWriteBackend) write(ctx context.Context, b outputBatch) error {
+	if len(b.ts) == 0 {
+		return nil
+	}
+	return r.c.write(ctx, b.ts)
+}
+
+// storeBackend writes results to the results store. Errors are assumed to be
+// transient, e.g. a full disk, and retried.
+type storeBackend struct {
+	s *resultsStore
+	// lastLatency is the duration of the last successful write in
+	// nanoseconds.
+	lastLatency atomic.Int64
+}
+
+func (*storeBackend) name() string { return "store" }
+
+func (s *storeBackend) write(_ context.Context, b outputBatch) error {
+	start := time.Now()
+	if err := s.s.append(b.results); err != nil {
+		return recoverableErr{err}
+	}
+	s.lastLatency.Store(int64(time.Since(start)))
+	return nil
+}
+
+// webhookBackend POSTs the results of every probe window as a JSON
+// webhookPayload, or spools them for delivery by spool.
+type webhookBackend struct {
+	c        *http.Client
+	url      string
+	instance string
+	netns    string
+	privacy  *ipPrivacy    // or nil
+	spool    *webhookSpool // or nil
+}
+
+// webhookPayload is the body of webhook requests.
+type webhookPayload struct {
+	Instance string
+	// Netns is the network namespace of the results, if probed by a child
+	// of a --netns supervisor.
+	Netns   string `json:",omitempty"`
+	Results []storedResult
+}
+
+func newWebhookBackend(url, instance string) *webhookBackend {
+	return &webhookBackend{
+		c: &http.Client{
+			Timeout: time.Second * 30,
+		},
+		url:      url,
+		instance: instance,
+	}
+}
+
+func (*webhookBackend) name() string { return "webhook" }
+
+func (w *webhookBackend) write(ctx context.Context, b outputBatch) error {
+	if len(b.results) == 0 {
+		return nil
+	}
+	p := webhookPayload{Instance: w.instance, Netns: w.netns}
+	if w.privacy != nil {
+		p.Instance = w.privacy.value(p.Instance)
+	}
+	for _, r := range b.results {
+		sr := storedResultFromResult(r)
+		if w.privacy != nil {
+			sr = w.privacy.storedResult(sr)
+		}
+		p.Results = append(p.Results, sr)
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if w.spool != nil {
+		if err := w.spool.enqueue(body); err != nil {
+			return recoverableErr{err}
+		}
+		return nil
+	}
+	return w.post(ctx, body)
+}
+
+// sendSpooled delivers spooled webhookPayloads, merged into as few requests
+// as possible.
+func (w *webhookBackend) sendSpooled(ctx context.Context, payloads [][]byte) error {
+	bodies, err := mergeWebhookPayloads(payloads)
+	if err != nil {
+		return err
+	}
+	for _, body := range bodies {
+		if err := w.post(ctx, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *webhookBackend) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "stunstamp")
+	resp, err := w.c.Do(req)
+	if err != nil {
+		return recoverableErr{fmt.Errorf("error performing webhook request: %w", err)}
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("webhook %s returned HTTP status %d", w.url, resp.StatusCode)
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableErr{err}
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBackend records the batches it is asked to write, failing recoverably
+// until its unblock channel is closed.
+type fakeBackend struct {
+	unblock chan struct{}
+
+	mu      sync.Mutex
+	written []outputBatch
+}
+
+func (*fakeBackend) name() string { return "fake" }
+
+func (f *fakeBackend) write(ctx context.Context, b outputBatch) error {
+	select {
+	case <-f.unblock:
+	default:
+		return recoverableErr{errors.New("unavailable")}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.written = append(f.written, b)
+	return nil
+}
+
+func (f *fakeBackend) numWritten() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.written)
+}
+
+func TestOutputsIndependent(t *testing.T) {
+	healthy := &fakeBackend{unblock: make(chan struct{})}
+	close(healthy.unblock)
+	broken := &fakeBackend{unblock: make(chan struct{})}
+	outs := outputs{
+		newOutputQueue(healthy, 2),
+		newOutputQueue(broken, 2),
+	}
+
+	const batches = 5
+	for i := range batches {
+		outs.enqueue(outputBatch{results: make([]result, i)})
+		// Let the healthy output keep up.
+		deadline := time.Now().Add(time.Second)
+		for healthy.numWritten() < i+1 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if got := healthy.numWritten(); got != batches {
+		t.Fatalf("healthy output wrote %d batches, want %d", got, batches)
+	}
+	// The broken output holds one batch in flight and buffers two, so at
+	// least two of the oldest must have been dropped.
+	if got := outs[1].dropped.Load(); got < batches-3 {
+		t.Errorf("broken output dropped %d batches, want >= %d", got, batches-3)
+	}
+
+	close(broken.unblock)
+	outs.close(5 * time.Second)
+	if got := broken.numWritten(); got == 0 || got > 3 {
+		t.Errorf("broken output wrote %d batches after recovery, want 1-3", got)
+	}
+	if n := len(broken.written[len(broken.written)-1].results); n != batches-1 {
+		t.Errorf("broken output last wrote batch %d, want %d", n, batches-1)
+	}
+}
+
+func TestWebhookBackend(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		got      webhookPayload
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	rtt := time.Millisecond
+	q := newOutputQueue(newWebhookBackend(srv.URL, "test"), 1)
+	q.enqueue(outputBatch{results: []result{{key: resultKey{protocol: protocolSTUN}, rtt: &rtt}}})
+	outputs{q}.close(5 * time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 2 {
+		t.Errorf("got %d requests, want 2", requests)
+	}
+	if got.Instance != "test" || len(got.Results) != 1 || got.Results[0].Protocol != protocolSTUN {
+		t.Errorf("got payload %+v", got)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"maps"
+	"net/netip"
+	"slices"
+
+	"github.com/prometheus/prometheus/prompb"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/tsaddr"
+)
+
+// peerTargets holds the peers of the local tailscaled as probe targets.
+// Tailnet IPs are probed inside the tunnel with tailnetPorts, and public
+// endpoints are probed outside of it with STUN against the endpoint's port.
+//
+// Peers have no DERP region ID; their nodeMeta holds a regionID of 0 and the
+// region code of their home DERP region, if known.
+type peerTargets struct {
+	ipv6         bool
+	tailnetPorts map[protocol][]int
+
+	metaByAddr  map[netip.Addr]nodeMeta
+	portsByAddr map[netip.Addr]map[protocol][]int
+}
+
+func newPeerTargets(ipv6 bool, tailnetPorts map[protocol][]int) *peerTargets {
+	return &peerTargets{
+		ipv6:         ipv6,
+		tailnetPorts: tailnetPorts,
+		metaByAddr:   make(map[netip.Addr]nodeMeta),
+		portsByAddr:  make(map[netip.Addr]map[protocol][]int),
+	}
+}
+
+// isPublicEndpoint reports whether addr is a peer endpoint reachable outside
+// of the tunnel from anywhere, i.e. not a LAN or Tailscale address.
+func isPublicEndpoint(addr netip.Addr) bool {
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !tsaddr.IsTailscaleIP(addr)
+}
+
+// update replaces the set of targets with the online peers in st. It
+// returns stale markers for targets that went away or changed, and whether
+// the set of targets changed.
+func (p *peerTargets) update(st *ipnstate.Status, instance string) (staleMarkers []prompb.TimeSeries, changed bool) {
+	metaByAddr := make(map[netip.Addr]nodeMeta)
+	portsByAddr := make(map[netip.Addr]map[protocol][]int)
+	add := func(meta nodeMeta, proto protocol, ports ...int) {
+		if meta.addr.Is6() && !p.ipv6 {
+			return
+		}
+		if existing, ok := metaByAddr[meta.addr]; ok && existing != meta {
+			// Multiple peers behind the same public address; the first
+			// one wins.
+			return
+		}
+		metaByAddr[meta.addr] = meta
+		if portsByAddr[meta.addr] == nil {
+			portsByAddr[meta.addr] = make(map[protocol][]int)
+		}
+		for _, port := range ports {
+			if !slices.Contains(portsByAddr[meta.addr][proto], port) {
+				portsByAddr[meta.addr][proto] = append(portsByAddr[meta.addr][proto], port)
+			}
+		}
+	}
+	for _, ps := range st.Peer {
+		if !ps.Online {
+			continue
+		}
+		meta := nodeMeta{
+			regionCode: ps.Relay,
+			hostname:   ps.HostName,
+		}
+		for _, addr := range ps.TailscaleIPs {
+			meta.addr = addr
+			for proto, ports := range p.tailnetPorts {
+				add(meta, proto, ports...)
+			}
+		}
+		endpoints := ps.Addrs
+		if len(ps.CurAddr) > 0 {
+			endpoints = append(slices.Clip(endpoints), ps.CurAddr)
+		}
+		for _, ep := range endpoints {
+			ipp, err := netip.ParseAddrPort(ep)
+			if err != nil || !isPublicEndpoint(ipp.Addr()) {
+				continue
+			}
+			meta.addr = ipp.Addr()
+			add(meta, protocolSTUN, int(ipp.Port()))
+		}
+	}
+	for _, ports := range portsByAddr {
+		for _, v := range ports {
+			slices.Sort(v)
+		}
+	}
+
+	for addr, meta := range p.metaByAddr {
+		ports := p.portsByAddr[addr]
+		if metaByAddr[addr] == meta && maps.EqualFunc(portsByAddr[addr], ports, slices.Equal) {
+			continue
+		}
+		changed = true
+		staleMarkers = append(staleMarkers, staleMarkersFromNodeMeta([]nodeMeta{meta}, instance, ports)...)
+	}
+	if len(metaByAddr) != len(p.metaByAddr) {
+		changed = true
+	}
+	p.metaByAddr = metaByAddr
+	p.portsByAddr = portsByAddr
+	return staleMarkers, changed
+}
+
+// staleMarkers returns stale markers for all current targets.
+func (p *peerTargets) staleMarkers(instance string) []prompb.TimeSeries {
+	var ret []prompb.TimeSeries
+	for addr, meta := range p.metaByAddr {
+		ret = append(ret, staleMarkersFromNodeMeta([]nodeMeta{meta}, instance, p.portsByAddr[addr])...)
+	}
+	return ret
+}
+
+// merge returns the union of derpTargets and the peer targets, along with
+// the per-address ports of the peer targets. Addresses present in
+// derpTargets are probed as DERP targets.
+func (p *peerTargets) merge(derpTargets map[netip.Addr]nodeMeta) (targets map[netip.Addr]nodeMeta, portsByAddr map[netip.Addr]map[protocol][]int) {
+	targets = maps.Clone(derpTargets)
+	portsByAddr = make(map[netip.Addr]map[protocol][]int)
+	for addr, meta := range p.metaByAddr {
+		if _, ok := targets[addr]; ok {
+			continue
+		}
+		targets[addr] = meta
+		portsByAddr[addr] = p.portsByAddr[addr]
+	}
+	return targets, portsByAddr
+}
@@ -0,0 +1,85 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestPeerTargets(t *testing.T) {
+	online := &ipnstate.PeerStatus{
+		HostName:     "online",
+		Relay:        "nyc",
+		Online:       true,
+		TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd7a:115c:a1e0::1")},
+		Addrs:        []string{"192.168.1.2:41641", "203.0.113.1:41641"},
+		CurAddr:      "203.0.113.1:1234",
+	}
+	offline := &ipnstate.PeerStatus{
+		HostName:     "offline",
+		TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.2")},
+	}
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): online,
+			key.NewNode().Public(): offline,
+		},
+	}
+
+	p := newPeerTargets(false, map[protocol][]int{protocolICMP: {0}})
+	stale, changed := p.update(st, "test")
+	if !changed || len(stale) != 0 {
+		t.Errorf("update() = %d stale markers, changed %v; want 0, true", len(stale), changed)
+	}
+	wantPorts := map[netip.Addr]map[protocol][]int{
+		netip.MustParseAddr("100.64.0.1"):  {protocolICMP: {0}},
+		netip.MustParseAddr("203.0.113.1"): {protocolSTUN: {1234, 41641}},
+	}
+	if !reflect.DeepEqual(p.portsByAddr, wantPorts) {
+		t.Errorf("portsByAddr = %v, want %v", p.portsByAddr, wantPorts)
+	}
+	wantMeta := nodeMeta{regionCode: "nyc", hostname: "online", addr: netip.MustParseAddr("203.0.113.1")}
+	if got := p.metaByAddr[wantMeta.addr]; got != wantMeta {
+		t.Errorf("meta = %+v, want %+v", got, wantMeta)
+	}
+
+	if stale, changed := p.update(st, "test"); changed || len(stale) != 0 {
+		t.Errorf("unchanged update() = %d stale markers, changed %v; want 0, false", len(stale), changed)
+	}
+
+	online.Online = false
+	if stale, changed := p.update(st, "test"); !changed || len(stale) == 0 {
+		t.Errorf("update() after peer went offline = %d stale markers, changed %v; want >0, true", len(stale), changed)
+	}
+	if len(p.metaByAddr) != 0 {
+		t.Errorf("unexpected targets: %v", p.metaByAddr)
+	}
+}
+
+func TestPeerTargetsMerge(t *testing.T) {
+	derpAddr := netip.MustParseAddr("192.0.2.1")
+	derp := map[netip.Addr]nodeMeta{derpAddr: {regionID: 1, hostname: "derp", addr: derpAddr}}
+	p := newPeerTargets(false, nil)
+	p.metaByAddr[derpAddr] = nodeMeta{hostname: "peer", addr: derpAddr}
+	p.portsByAddr[derpAddr] = map[protocol][]int{protocolSTUN: {41641}}
+	peerAddr := netip.MustParseAddr("203.0.113.1")
+	p.metaByAddr[peerAddr] = nodeMeta{hostname: "peer", addr: peerAddr}
+	p.portsByAddr[peerAddr] = map[protocol][]int{protocolSTUN: {41641}}
+
+	targets, portsByAddr := p.merge(derp)
+	if len(targets) != 2 || targets[derpAddr].hostname != "derp" || targets[peerAddr].hostname != "peer" {
+		t.Errorf("unexpected targets: %v", targets)
+	}
+	if _, ok := portsByAddr[derpAddr]; ok || len(portsByAddr) != 1 {
+		t.Errorf("unexpected portsByAddr: %v", portsByAddr)
+	}
+	if len(derp) != 1 {
+		t.Error("merge modified derpTargets")
+	}
+}
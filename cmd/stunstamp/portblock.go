@@ -0,0 +1,273 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// portBlockWindows is the number of recent windows the port allocation
+	// scheme of the NAT is inferred over.
+	portBlockWindows = 64
+	// portBlockMinSamples is the number of mapped ports needed to infer the
+	// scheme.
+	portBlockMinSamples = 32
+	// portBlockSameBlock is the fraction of consecutively mapped ports that
+	// must fall into the same aligned block for blocks of that size to be
+	// in use. Blocks allocated anew account for the rest.
+	portBlockSameBlock = 0.9
+	// portBlockMaxSize is the largest block size considered. Ports mapped
+	// at random from the whole range fall into the same half of it as
+	// often as not.
+	portBlockMaxSize = 32768
+	// portBlockSequentialStep is the largest difference between
+	// consecutively mapped ports in a block considered sequential, allowing
+	// for ports mapped to other subscribers' flows in between.
+	portBlockSequentialStep = 8
+	// portBlockSequential is the fraction of consecutively mapped ports in
+	// a block that must be sequential for allocation to be.
+	portBlockSequential = 0.8
+)
+
+// portBlockScheme is the port allocation scheme of the NAT on the path to
+// targets, as inferred from the ports mapped to short-lived sockets.
+type portBlockScheme string
+
+const (
+	// portBlockSchemeBlocks is port block allocation (PBA), as common on
+	// CGNATs for logging efficiency: the subscriber is allocated aligned
+	// blocks of ports, and its flows are mapped to ports in them.
+	portBlockSchemeBlocks portBlockScheme = "port_blocks"
+	// portBlockSchemePerSession is allocation of any free port of the range
+	// per flow, e.g. deterministic or logged per session.
+	portBlockSchemePerSession   portBlockScheme = "per_session"
+	portBlockSchemeInsufficient portBlockScheme = "insufficient_data"
+)
+
+// eventKindNATPortBlocks is a change in the inferred port allocation scheme
+// of the NAT, e.g. a CGNAT reconfigured with smaller port blocks, raising
+// the risk of port exhaustion.
+const eventKindNATPortBlocks eventKind = "nat_port_blocks"
+
+// portBlockInference is the inferred port allocation scheme of the NAT, as
+// served by the API.
+type portBlockInference struct {
+	Scheme portBlockScheme
+	// BlockSize is the number of ports of the blocks allocated, if Scheme
+	// is portBlockSchemeBlocks.
+	BlockSize int `json:",omitempty"`
+	// BlockSizeLowerBound is whether BlockSize is a lower bound: ports
+	// allocated sequentially from blocks reveal only as many ports of a
+	// block as were mapped before it was released.
+	BlockSizeLowerBound bool `json:",omitempty"`
+	// Allocation is how ports are allocated from a block, "sequential" or
+	// "random", if Scheme is portBlockSchemeBlocks.
+	Allocation string `json:",omitempty"`
+	// Pooling is "paired" if all sockets were mapped to the same public
+	// address, as with RFC 4787 paired pooling, or "arbitrary" otherwise.
+	Pooling     string `json:",omitempty"`
+	PublicAddrs []netip.Addr
+	// MaxBlocksPerWindow is the largest number of blocks the ports mapped
+	// in a window fell into, i.e. were allocated to us at once, and
+	// MaxPortsPerWindow the largest number of ports mapped in a window.
+	// Their ratio to BlockSize is an indication of port exhaustion risk.
+	MaxBlocksPerWindow int `json:",omitempty"`
+	MaxPortsPerWindow  int
+	Samples            int
+	Windows            int
+}
+
+// portBlockWindow holds the public addresses mapped to the short-lived
+// sockets of a window, ordered by port, the order they were most likely
+// allocated in.
+type portBlockWindow []netip.AddrPort
+
+// inferPortBlocks infers the port allocation scheme of the NAT from the
+// addresses mapped to short-lived sockets over windows, oldest first.
+func inferPortBlocks(windows []portBlockWindow) portBlockInference {
+	inf := portBlockInference{Scheme: portBlockSchemeInsufficient, Windows: len(windows)}
+	// seqs are the ports mapped per public address, in order of mapping.
+	seqs := make(map[netip.Addr][]int)
+	for _, w := range windows {
+		inf.Samples += len(w)
+		inf.MaxPortsPerWindow = max(inf.MaxPortsPerWindow, len(w))
+		for _, ap := range w {
+			seqs[ap.Addr()] = append(seqs[ap.Addr()], int(ap.Port()))
+		}
+	}
+	for addr := range seqs {
+		inf.PublicAddrs = append(inf.PublicAddrs, addr)
+	}
+	slices.SortFunc(inf.PublicAddrs, netip.Addr.Compare)
+	if inf.Samples < portBlockMinSamples {
+		return inf
+	}
+	inf.Pooling = "paired"
+	if len(inf.PublicAddrs) > 1 {
+		inf.Pooling = "arbitrary"
+	}
+
+	// sameBlock returns the fraction of consecutively mapped ports of an
+	// address in the same aligned block of size.
+	sameBlock := func(size int) float64 {
+		var same, pairs int
+		for _, seq := range seqs {
+			for i := 1; i < len(seq); i++ {
+				pairs++
+				if seq[i]/size == seq[i-1]/size {
+					same++
+				}
+			}
+		}
+		if pairs == 0 {
+			return 0
+		}
+		return float64(same) / float64(pairs)
+	}
+	size := 0
+	for s := 64; s < portBlockMaxSize; s *= 2 {
+		if sameBlock(s) >= portBlockSameBlock {
+			size = s
+			break
+		}
+	}
+	if size == 0 {
+		inf.Scheme = portBlockSchemePerSession
+		return inf
+	}
+	inf.Scheme = portBlockSchemeBlocks
+
+	// Ports allocated at random fill their block, whose size is then the
+	// smallest one they consistently fall into. Ports allocated
+	// sequentially cross the boundaries of smaller aligned sizes as they
+	// advance, so the block spans at least as many ports as each run of
+	// sequentially mapped ports.
+	var seqPairs, inBlock int
+	for _, seq := range seqs {
+		for i := 1; i < len(seq); i++ {
+			if seq[i]/size != seq[i-1]/size {
+				continue
+			}
+			inBlock++
+			if d := seq[i] - seq[i-1]; d >= 0 && d <= portBlockSequentialStep {
+				seqPairs++
+			}
+		}
+	}
+	inf.Allocation = "random"
+	if inBlock > 0 && float64(seqPairs) >= portBlockSequential*float64(inBlock) {
+		inf.Allocation = "sequential"
+		inf.BlockSizeLowerBound = true
+		for _, seq := range seqs {
+			lo, hi := seq[0], seq[0]
+			for i := 1; i <= len(seq); i++ {
+				if i < len(seq) {
+					if d := seq[i] - seq[i-1]; d >= 0 && d <= portBlockSequentialStep {
+						hi = seq[i]
+						continue
+					}
+				}
+				// The run of lo through hi fits in one aligned block.
+				for size < portBlockMaxSize && lo/size != hi/size {
+					size *= 2
+				}
+				if i < len(seq) {
+					lo, hi = seq[i], seq[i]
+				}
+			}
+		}
+	}
+	inf.BlockSize = size
+
+	for _, w := range windows {
+		blocks := make(map[netip.AddrPort]bool)
+		for _, ap := range w {
+			blocks[netip.AddrPortFrom(ap.Addr(), uint16(int(ap.Port())/size))] = true
+		}
+		inf.MaxBlocksPerWindow = max(inf.MaxBlocksPerWindow, len(blocks))
+	}
+	return inf
+}
+
+// portBlockTracker infers the port allocation scheme of the NAT on the path
+// to targets from the public addresses STUN servers report for the
+// short-lived sockets of unstable conns over recent windows. It is safe for
+// concurrent use.
+type portBlockTracker struct {
+	mu      sync.Mutex
+	windows []portBlockWindow // up to portBlockWindows, oldest first
+	last    portBlockInference
+}
+
+func newPortBlockTracker() *portBlockTracker {
+	return &portBlockTracker{}
+}
+
+// observe accounts the results of a window, recording an event when the
+// inferred scheme or block size changes.
+func (t *portBlockTracker) observe(results []result, at time.Time) {
+	var w portBlockWindow
+	seen := make(map[netip.AddrPort]bool)
+	for _, r := range results {
+		k := r.key
+		// Only direct probes over unstable conns map a fresh socket
+		// every window.
+		if k.protocol != protocolSTUN || k.connStability != unstableConn || k.proxy != "" || k.xlat != "" || k.netns != "" {
+			continue
+		}
+		if !r.mappedAddr.IsValid() || !r.mappedAddr.Addr().Is4() || seen[r.mappedAddr] {
+			continue
+		}
+		seen[r.mappedAddr] = true
+		w = append(w, r.mappedAddr)
+	}
+	if len(w) == 0 {
+		return
+	}
+	slices.SortFunc(w, func(a, b netip.AddrPort) int {
+		return cmp.Or(a.Addr().Compare(b.Addr()), cmp.Compare(a.Port(), b.Port()))
+	})
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.windows = append(t.windows, w)
+	if len(t.windows) > portBlockWindows {
+		t.windows = slices.Delete(t.windows, 0, len(t.windows)-portBlockWindows)
+	}
+	inf := inferPortBlocks(t.windows)
+	if inf.Scheme == portBlockSchemeInsufficient {
+		return
+	}
+	last := t.last
+	t.last = inf
+	if last.Scheme == inf.Scheme && last.BlockSize == inf.BlockSize {
+		return
+	}
+	attrs := map[string]string{"scheme": string(inf.Scheme)}
+	if inf.BlockSize > 0 {
+		attrs["block_size"] = strconv.Itoa(inf.BlockSize)
+		attrs["allocation"] = inf.Allocation
+	}
+	if last.Scheme != "" {
+		attrs["previous_scheme"] = string(last.Scheme)
+		if last.BlockSize > 0 {
+			attrs["previous_block_size"] = strconv.Itoa(last.BlockSize)
+		}
+	}
+	probeLog.Info("inferred NAT port allocation", "scheme", inf.Scheme, "block_size", inf.BlockSize, "allocation", inf.Allocation, "pooling", inf.Pooling)
+	events.record(event{At: at, Kind: eventKindNATPortBlocks, Attrs: attrs})
+}
+
+// inference returns the port allocation scheme inferred over recent windows.
+func (t *portBlockTracker) inference() portBlockInference {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return inferPortBlocks(t.windows)
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// testPortBlockWindows returns n windows of perWindow ports mapped to pub by
+// next.
+func testPortBlockWindows(pub netip.Addr, n, perWindow int, next func() int) []portBlockWindow {
+	var ret []portBlockWindow
+	for range n {
+		var w portBlockWindow
+		for range perWindow {
+			w = append(w, netip.AddrPortFrom(pub, uint16(next())))
+		}
+		ret = append(ret, w)
+	}
+	return ret
+}
+
+func TestInferPortBlocks(t *testing.T) {
+	pub := netip.MustParseAddr("100.64.0.1")
+	rng := rand.New(rand.NewPCG(1, 2))
+
+	// Random ports from a 512 port block, a new block every 8 windows.
+	block := 0
+	var n int
+	randomInBlock := func() int {
+		if n++; n%(8*6) == 0 {
+			block++
+		}
+		return 1024 + (block*37%100)*512 + rng.IntN(512)
+	}
+	got := inferPortBlocks(testPortBlockWindows(pub, 32, 6, randomInBlock))
+	if got.Scheme != portBlockSchemeBlocks || got.BlockSize != 512 || got.BlockSizeLowerBound || got.Allocation != "random" || got.Pooling != "paired" {
+		t.Errorf("random in blocks = %+v", got)
+	}
+
+	// Sequential ports from 256 port blocks, each used for 100 ports.
+	port, used := 4096, 0
+	sequential := func() int {
+		if used++; used%100 == 0 {
+			port = port/256*256 + 256*3
+		}
+		port++
+		return port
+	}
+	got = inferPortBlocks(testPortBlockWindows(pub, 32, 6, sequential))
+	if got.Scheme != portBlockSchemeBlocks || got.BlockSize != 128 || !got.BlockSizeLowerBound || got.Allocation != "sequential" {
+		t.Errorf("sequential in blocks = %+v", got)
+	}
+
+	// Random ports from the whole range.
+	got = inferPortBlocks(testPortBlockWindows(pub, 32, 6, func() int { return 1024 + rng.IntN(64512) }))
+	if got.Scheme != portBlockSchemePerSession || got.BlockSize != 0 {
+		t.Errorf("per session = %+v", got)
+	}
+
+	got = inferPortBlocks(testPortBlockWindows(pub, 2, 6, func() int { return 1024 + rng.IntN(64512) }))
+	if got.Scheme != portBlockSchemeInsufficient || got.Samples != 12 {
+		t.Errorf("few samples = %+v", got)
+	}
+}
+
+func TestPortBlockTrackerObserve(t *testing.T) {
+	tr := newPortBlockTracker()
+	pub := netip.MustParseAddr("100.64.0.1")
+	rtt := time.Millisecond
+	at := time.Now()
+	for i := range 8 {
+		var results []result
+		for j := range 6 {
+			mapped := netip.AddrPortFrom(pub, uint16(2048+(i*6+j)%64))
+			results = append(results, result{
+				key:        resultKey{meta: nodeMeta{hostname: "derp1a"}, protocol: protocolSTUN, connStability: unstableConn},
+				rtt:        &rtt,
+				mappedAddr: mapped,
+			})
+		}
+		// Stable conns keep their mapping, and are ignored.
+		results = append(results, result{
+			key:        resultKey{meta: nodeMeta{hostname: "derp1a"}, protocol: protocolSTUN, connStability: stableConn},
+			rtt:        &rtt,
+			mappedAddr: netip.AddrPortFrom(pub, 60000),
+		})
+		tr.observe(results, at)
+	}
+	got := tr.inference()
+	if got.Samples != 48 || got.MaxPortsPerWindow != 6 || got.Scheme != portBlockSchemeBlocks || got.BlockSize != 64 {
+		t.Errorf("inference = %+v", got)
+	}
+	var found bool
+	for _, ev := range events.recentEvents() {
+		if ev.Kind == eventKindNATPortBlocks && ev.Attrs["block_size"] == "64" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("no nat_port_blocks event recorded")
+	}
+}
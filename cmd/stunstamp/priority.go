@@ -0,0 +1,252 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const shedTargetsMetricName = "stunstamp_shed_targets"
+
+// eventKindTargetShed is a best-effort target no longer being probed due to
+// resource pressure.
+const eventKindTargetShed eventKind = "target_shed"
+
+// Reasons for shedding best-effort targets.
+const (
+	shedReasonCPU  = "cpu"
+	shedReasonFDs  = "fds"
+	shedReasonDsts = "dsts"
+)
+
+const (
+	// shedStep is the fraction of best-effort targets additionally shed
+	// every window under CPU or file descriptor pressure, and resumed every
+	// window without.
+	shedStep = 0.25
+	// shedResumeFactor is the fraction of a limit usage must fall below
+	// before shed targets are resumed, so that shedding does not oscillate.
+	shedResumeFactor = 0.8
+	// defaultMaxFDFraction is the default schedulingConfig.MaxFDFraction.
+	defaultMaxFDFraction = 0.8
+)
+
+// schedulingConfig configures the priorities of targets. Under resource
+// pressure, best-effort targets are shed, i.e. skipped, in order to keep
+// probing critical targets at full fidelity rather than degrading all of
+// them uniformly.
+type schedulingConfig struct {
+	// Critical selects the critical targets, which are never shed. All
+	// other targets are best-effort.
+	Critical targetSelector
+	// MaxCPU is the CPU usage of this process, in CPUs, above which
+	// best-effort targets are shed, e.g. 0.5. Zero disables.
+	MaxCPU float64 `json:",omitempty"`
+	// MaxFDFraction is the fraction of the open file limit above which
+	// best-effort targets are shed. It defaults to 0.8.
+	MaxFDFraction float64 `json:",omitempty"`
+	// MaxDsts is the number of destinations, i.e. target ports by protocol,
+	// probed per window above which best-effort targets are shed, bounding
+	// the bandwidth of probing. Zero disables.
+	MaxDsts int `json:",omitempty"`
+	// MaxMessagesPerSecond is the rate of probe messages, i.e. STUN and
+	// ICMP echo requests, HTTPS requests, and TCP connects, retry attempts
+	// included, above which due probes are deferred to later windows,
+	// bounding the packet rate of probing. At least one probe is admitted
+	// per window however small the rate. Zero disables. See probeBudget.
+	MaxMessagesPerSecond float64 `json:",omitempty"`
+	// ProtocolWeights weights the shares of MaxMessagesPerSecond of
+	// protocols, which default to 1, e.g. {"stun": 4} to reserve most of
+	// it for the STUN series long-term baselines depend on.
+	ProtocolWeights map[protocol]float64 `json:",omitempty"`
+}
+
+func (c *schedulingConfig) validate() error {
+	if c.MaxCPU < 0 || math.IsNaN(c.MaxCPU) || math.IsInf(c.MaxCPU, 0) {
+		return fmt.Errorf("invalid MaxCPU %v", c.MaxCPU)
+	}
+	if !(c.MaxFDFraction >= 0 && c.MaxFDFraction <= 1) {
+		return fmt.Errorf("MaxFDFraction %v is not in [0, 1]", c.MaxFDFraction)
+	}
+	if c.MaxDsts < 0 {
+		return errors.New("negative MaxDsts")
+	}
+	if c.MaxMessagesPerSecond < 0 || math.IsNaN(c.MaxMessagesPerSecond) || math.IsInf(c.MaxMessagesPerSecond, 0) {
+		return fmt.Errorf("invalid MaxMessagesPerSecond %v", c.MaxMessagesPerSecond)
+	}
+	for p, w := range c.ProtocolWeights {
+		if !slices.Contains(allProtocols, p) {
+			return fmt.Errorf("weight of unknown protocol %q", p)
+		}
+		if !(w > 0) || math.IsInf(w, 0) {
+			return fmt.Errorf("invalid weight %v of protocol %q", w, p)
+		}
+	}
+	return nil
+}
+
+// targetScheduler decides which targets to probe every window. It is not
+// safe for concurrent use.
+type targetScheduler struct {
+	// shedFraction is the fraction of best-effort targets shed due to CPU
+	// or file descriptor pressure, in [0, 1].
+	shedFraction float64
+	shed         map[nodeMeta]bool
+	lastCPU      time.Duration
+	lastAt       time.Time // of lastCPU
+}
+
+func newTargetScheduler() *targetScheduler {
+	return &targetScheduler{shed: make(map[nodeMeta]bool)}
+}
+
+// pressure returns the resources whose usage exceeds their limit in c, and
+// whether all usage is low enough to resume shed targets.
+func (s *targetScheduler) pressure(c *schedulingConfig, now time.Time) (over []string, relieved bool) {
+	relieved = true
+	check := func(reason string, usage, limit float64) {
+		switch {
+		case usage > limit:
+			over = append(over, reason)
+			relieved = false
+		case usage >= limit*shedResumeFactor:
+			relieved = false
+		}
+	}
+	if cpu, err := processCPUTime(); err == nil {
+		if c.MaxCPU > 0 && !s.lastAt.IsZero() && now.After(s.lastAt) {
+			check(shedReasonCPU, float64(cpu-s.lastCPU)/float64(now.Sub(s.lastAt)), c.MaxCPU)
+		}
+		s.lastCPU, s.lastAt = cpu, now
+	}
+	if open, limit, err := fdUsage(); err == nil && limit > 0 {
+		check(shedReasonFDs, float64(open)/float64(limit), cmp.Or(c.MaxFDFraction, defaultMaxFDFraction))
+	}
+	return over, relieved
+}
+
+// admit returns the targets to probe in the window starting at now, shedding
+// best-effort targets under pressure per c, which may be nil to probe all
+// targets. dstsOf returns the number of destinations of a target. Newly shed
+// targets are recorded as events.
+func (s *targetScheduler) admit(targets map[netip.Addr]nodeMeta, dstsOf func(nodeMeta) int, c *schedulingConfig, now time.Time) map[netip.Addr]nodeMeta {
+	if c == nil {
+		s.resume(s.shed)
+		s.shedFraction = 0
+		return targets
+	}
+	over, relieved := s.pressure(c, now)
+	switch {
+	case len(over) > 0:
+		s.shedFraction = min(1, s.shedFraction+shedStep)
+	case relieved:
+		s.shedFraction = max(0, s.shedFraction-shedStep)
+	}
+
+	var critical, bestEffort []nodeMeta
+	dsts := 0
+	for _, meta := range targets {
+		if c.Critical.matches(meta) {
+			critical = append(critical, meta)
+		} else {
+			bestEffort = append(bestEffort, meta)
+		}
+		dsts += dstsOf(meta)
+	}
+	// Shed from the end, deterministically, so that the same targets are
+	// shed across windows.
+	slices.SortFunc(bestEffort, func(a, b nodeMeta) int {
+		return cmp.Or(
+			cmp.Compare(a.regionID, b.regionID),
+			cmp.Compare(a.hostname, b.hostname),
+			a.addr.Compare(b.addr),
+		)
+	})
+	n := int(math.Ceil(s.shedFraction * float64(len(bestEffort))))
+	if c.MaxDsts > 0 {
+		for _, meta := range bestEffort[len(bestEffort)-n:] {
+			dsts -= dstsOf(meta)
+		}
+		if dsts > c.MaxDsts && n < len(bestEffort) {
+			over = append(over, shedReasonDsts)
+		}
+		for dsts > c.MaxDsts && n < len(bestEffort) {
+			n++
+			dsts -= dstsOf(bestEffort[len(bestEffort)-n])
+		}
+		if dsts > c.MaxDsts {
+			probeLog.Warn("critical targets alone exceed MaxDsts", "dsts", dsts, "max", c.MaxDsts)
+		}
+	}
+
+	shed := make(map[nodeMeta]bool)
+	for _, meta := range bestEffort[len(bestEffort)-n:] {
+		shed[meta] = true
+	}
+	resumed := make(map[nodeMeta]bool)
+	for meta := range s.shed {
+		if !shed[meta] {
+			resumed[meta] = true
+		}
+	}
+	s.resume(resumed)
+	var newlyShed int
+	reason := strings.Join(over, ",")
+	for meta := range shed {
+		if s.shed[meta] {
+			continue
+		}
+		newlyShed++
+		s.shed[meta] = true
+		events.record(event{
+			At:         now,
+			Kind:       eventKindTargetShed,
+			Addr:       meta.addr,
+			RegionID:   meta.regionID,
+			RegionCode: meta.regionCode,
+			Hostname:   meta.hostname,
+			Attrs:      map[string]string{"reason": reason},
+		})
+	}
+	if newlyShed > 0 {
+		probeLog.Warn("shedding best-effort targets under resource pressure", "reason", reason, "shed", len(shed), "best_effort", len(bestEffort), "critical", len(critical))
+		annotations.annotateAuto(now, now, "", fmt.Sprintf("shed %d of %d best-effort targets (%s)", len(shed), len(bestEffort), reason))
+	}
+
+	if len(shed) == 0 {
+		return targets
+	}
+	ret := make(map[netip.Addr]nodeMeta, len(targets)-len(shed))
+	for addr, meta := range targets {
+		if !shed[meta] {
+			ret[addr] = meta
+		}
+	}
+	return ret
+}
+
+// resume stops shedding the targets in metas.
+func (s *targetScheduler) resume(metas map[nodeMeta]bool) {
+	if len(metas) == 0 {
+		return
+	}
+	for meta := range metas {
+		delete(s.shed, meta)
+	}
+	probeLog.Info("resuming shed targets", "resumed", len(metas), "shed", len(s.shed))
+}
+
+// toPromTimeSeries returns the number of targets shed.
+func (s *targetScheduler) toPromTimeSeries(instance string, at time.Time) prompb.TimeSeries {
+	return instanceTimeSeries(shedTargetsMetricName, instance, at, float64(len(s.shed)))
+}
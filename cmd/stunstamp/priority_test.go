@@ -0,0 +1,87 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestTargetSchedulerAdmit(t *testing.T) {
+	targets := make(map[netip.Addr]nodeMeta)
+	for i := range 6 {
+		meta := nodeMeta{regionID: i + 1, hostname: fmt.Sprintf("%da", i+1), addr: netip.AddrFrom4([4]byte{192, 0, 2, byte(i + 1)})}
+		targets[meta.addr] = meta
+	}
+	dstsOf := func(nodeMeta) int { return 2 }
+	countShed := func() int {
+		n := 0
+		for _, ev := range events.recentEvents() {
+			if ev.Kind == eventKindTargetShed && ev.Attrs["reason"] == shedReasonDsts {
+				n++
+			}
+		}
+		return n
+	}
+	before := countShed()
+
+	c := &schedulingConfig{
+		Critical: targetSelector{RegionIDs: []int{5, 6}},
+		MaxDsts:  6,
+	}
+	s := newTargetScheduler()
+	now := time.Now()
+	for range 2 {
+		got := s.admit(targets, dstsOf, c, now)
+		if len(got) != 3 {
+			t.Fatalf("admitted %d targets, want 3", len(got))
+		}
+		for _, id := range []int{1, 5, 6} {
+			addr := netip.AddrFrom4([4]byte{192, 0, 2, byte(id)})
+			if _, ok := got[addr]; !ok {
+				t.Errorf("target in region %d shed", id)
+			}
+		}
+		now = now.Add(time.Minute)
+	}
+	// Only the first window sheds targets anew.
+	if got := countShed() - before; got != 3 {
+		t.Errorf("got %d shed events, want 3", got)
+	}
+
+	// Critical targets are never shed, even if they alone exceed the limit.
+	c.MaxDsts = 1
+	if got := s.admit(targets, dstsOf, c, now); len(got) != 2 {
+		t.Errorf("admitted %d targets, want the 2 critical", len(got))
+	}
+	if got := len(s.shed); got != 4 {
+		t.Errorf("got %d shed targets, want 4", got)
+	}
+
+	// All targets resume without a config.
+	if got := s.admit(targets, dstsOf, nil, now); len(got) != len(targets) {
+		t.Errorf("admitted %d targets, want all %d", len(got), len(targets))
+	}
+	if len(s.shed) != 0 {
+		t.Errorf("still shedding %d targets", len(s.shed))
+	}
+}
+
+func TestSchedulingConfigValidate(t *testing.T) {
+	for _, c := range []schedulingConfig{
+		{MaxCPU: -1},
+		{MaxFDFraction: 1.5},
+		{MaxDsts: -1},
+	} {
+		if err := c.validate(); err == nil {
+			t.Errorf("%+v: got no error", c)
+		}
+	}
+	c := schedulingConfig{Critical: targetSelector{RegionCodes: []string{"nyc"}}, MaxCPU: 0.5, MaxDsts: 100}
+	if err := c.validate(); err != nil {
+		t.Error(err)
+	}
+}
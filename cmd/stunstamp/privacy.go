@@ -0,0 +1,150 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	ipPrivacyHash     = "hash"
+	ipPrivacyTruncate = "truncate"
+
+	// ipPrivacyBitsV4 and ipPrivacyBitsV6 are the prefix lengths addresses
+	// are truncated to, those commonly assigned to a single site.
+	ipPrivacyBitsV4 = 24
+	ipPrivacyBitsV6 = 48
+)
+
+// ipPrivacy anonymizes the IP addresses of targets, proxies, and this host in
+// remote write labels and webhook payloads, so that measurements may be
+// shared publicly or with researchers without exposing addressing, while
+// region, hostname, and address family labels are kept. Addresses are either
+// truncated to a site-sized prefix, or replaced with a keyed hash, which
+// keeps them distinguishable and stable while the key is. A nil *ipPrivacy
+// exports addresses as is.
+type ipPrivacy struct {
+	mode string
+	key  []byte // for ipPrivacyHash
+}
+
+// newIPPrivacy returns the ipPrivacy of mode, "hash" or "truncate", or nil
+// if mode is empty. Hashes are keyed with the contents of keyFile, or if it
+// is empty with a random key, so that they are stable only for the lifetime
+// of the process.
+func newIPPrivacy(mode, keyFile string) (*ipPrivacy, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case ipPrivacyTruncate:
+		return &ipPrivacy{mode: mode}, nil
+	case ipPrivacyHash:
+	default:
+		return nil, fmt.Errorf("unknown mode %q, want %s or %s", mode, ipPrivacyHash, ipPrivacyTruncate)
+	}
+	p := &ipPrivacy{mode: mode}
+	if keyFile == "" {
+		p.key = make([]byte, 32)
+		rand.Read(p.key)
+		return p, nil
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < 16 {
+		return nil, fmt.Errorf("key file %s holds %d bytes, want at least 16", keyFile, len(key))
+	}
+	p.key = key
+	return p, nil
+}
+
+// addr returns the anonymized form of a: its truncated prefix's address, or
+// its hash prefixed with "anon-".
+func (p *ipPrivacy) addr(a netip.Addr) string {
+	if p.mode == ipPrivacyTruncate {
+		return p.truncate(a).String()
+	}
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(a.Unmap().AsSlice())
+	return "anon-" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func (p *ipPrivacy) truncate(a netip.Addr) netip.Addr {
+	a = a.Unmap().WithZone("")
+	bits := ipPrivacyBitsV4
+	if a.Is6() {
+		bits = ipPrivacyBitsV6
+	}
+	return netip.PrefixFrom(a, bits).Masked().Addr()
+}
+
+// value returns v with the address anonymized if it is an address, or an
+// address and port, e.g. a proxy label; otherwise v.
+func (p *ipPrivacy) value(v string) string {
+	if a, err := netip.ParseAddr(v); err == nil {
+		return p.addr(a)
+	}
+	if ap, err := netip.ParseAddrPort(v); err == nil {
+		if p.mode == ipPrivacyTruncate {
+			return netip.AddrPortFrom(p.truncate(ap.Addr()), ap.Port()).String()
+		}
+		return p.addr(ap.Addr()) + ":" + strconv.Itoa(int(ap.Port()))
+	}
+	return v
+}
+
+// timeSeries returns ts with addresses anonymized in the values of labels,
+// sample and exemplar alike. ts is not modified.
+func (p *ipPrivacy) timeSeries(ts []prompb.TimeSeries) []prompb.TimeSeries {
+	anonymize := func(labels []prompb.Label) []prompb.Label {
+		ret := make([]prompb.Label, len(labels))
+		for i, l := range labels {
+			if l.Name != "__name__" {
+				l.Value = p.value(l.Value)
+			}
+			ret[i] = l
+		}
+		return ret
+	}
+	ret := make([]prompb.TimeSeries, len(ts))
+	for i, t := range ts {
+		t.Labels = anonymize(t.Labels)
+		if len(t.Exemplars) > 0 {
+			exemplars := make([]prompb.Exemplar, len(t.Exemplars))
+			for j, e := range t.Exemplars {
+				e.Labels = anonymize(e.Labels)
+				exemplars[j] = e
+			}
+			t.Exemplars = exemplars
+		}
+		ret[i] = t
+	}
+	return ret
+}
+
+// storedResult returns sr with its addresses anonymized. A hashed target
+// address is held by AddrHash, with Addr left invalid.
+func (p *ipPrivacy) storedResult(sr storedResult) storedResult {
+	if sr.Addr.IsValid() {
+		if p.mode == ipPrivacyTruncate {
+			sr.Addr = p.truncate(sr.Addr)
+		} else {
+			sr.AddrHash = p.addr(sr.Addr)
+			sr.Addr = netip.Addr{}
+		}
+	}
+	sr.Proxy = p.value(sr.Proxy)
+	sr.Instance = p.value(sr.Instance)
+	return sr
+}
@@ -0,0 +1,90 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestIPPrivacyTruncate(t *testing.T) {
+	p, err := newIPPrivacy(ipPrivacyTruncate, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for in, want := range map[string]string{
+		"100.64.12.34":          "100.64.12.0",
+		"2001:db8:1:2::1":       "2001:db8:1::",
+		"::ffff:192.0.2.1":      "192.0.2.0",
+		"192.0.2.7:1080":        "192.0.2.0:1080",
+		"[2001:db8:1:2::1]:443": "[2001:db8:1::]:443",
+		"nyc":                   "nyc",
+		"":                      "",
+	} {
+		if got := p.value(in); got != want {
+			t.Errorf("value(%q) = %q, want %q", in, got, want)
+		}
+	}
+	sr := p.storedResult(storedResult{Addr: netip.MustParseAddr("192.0.2.1"), Hostname: "1a"})
+	if sr.Addr != netip.MustParseAddr("192.0.2.0") || sr.AddrHash != "" || sr.Hostname != "1a" {
+		t.Errorf("got %+v", sr)
+	}
+}
+
+func TestIPPrivacyHash(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte("0123456789abcdef"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := newIPPrivacy(ipPrivacyHash, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := newIPPrivacy(ipPrivacyHash, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := p.value("192.0.2.1"), p.value("192.0.2.2")
+	if !strings.HasPrefix(a, "anon-") || a == b || strings.Contains(a, "192") {
+		t.Errorf("got hashes %q and %q", a, b)
+	}
+	if got := p2.value("192.0.2.1"); got != a {
+		t.Errorf("got %q with the same key, want %q", got, a)
+	}
+	if got := p.value("192.0.2.1:1080"); got != a+":1080" {
+		t.Errorf("got %q, want %q", got, a+":1080")
+	}
+
+	sr := p.storedResult(storedResult{Addr: netip.MustParseAddr("192.0.2.1"), Proxy: "192.0.2.1:1080"})
+	if sr.Addr.IsValid() || sr.AddrHash != a || sr.Proxy != a+":1080" {
+		t.Errorf("got %+v", sr)
+	}
+
+	ts := []prompb.TimeSeries{{
+		Labels:    []prompb.Label{{Name: "__name__", Value: "x"}, {Name: "addr", Value: "192.0.2.1"}, {Name: "hostname", Value: "1a"}},
+		Exemplars: []prompb.Exemplar{{Labels: []prompb.Label{{Name: "addr", Value: "192.0.2.2"}}}},
+	}}
+	got := p.timeSeries(ts)
+	if got[0].Labels[1].Value != a || got[0].Labels[2].Value != "1a" || got[0].Exemplars[0].Labels[0].Value != b {
+		t.Errorf("got %+v", got)
+	}
+	if ts[0].Labels[1].Value != "192.0.2.1" || ts[0].Exemplars[0].Labels[0].Value != "192.0.2.2" {
+		t.Errorf("input modified: %+v", ts)
+	}
+
+	if err := os.WriteFile(keyFile, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newIPPrivacy(ipPrivacyHash, keyFile); err == nil {
+		t.Error("got no error for short key")
+	}
+	if _, err := newIPPrivacy("redact", ""); err == nil {
+		t.Error("got no error for unknown mode")
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// protocolSlot is the share of the window's transmit jitter a protocol of a
+// target is sent in.
+type protocolSlot struct {
+	order int           // 1-based position of the slot, or zero if unslotted
+	start time.Duration // from the start of the window
+	width time.Duration
+}
+
+// offset returns a random offset from the start of the window within s.
+func (s protocolSlot) offset() time.Duration {
+	if s.width <= 0 {
+		return rand.N(maxTXJitter)
+	}
+	return s.start + rand.N(s.width)
+}
+
+// protocolSlots divides maxTXJitter into a slot per protocol of ports that is
+// due, in a random order every call. Sent in a fixed order, a later protocol
+// would systematically find the path in the queue state left by the earlier
+// ones, e.g. after ICMP has warmed up the ARP/ND cache or a TCP handshake has
+// filled a buffer, and measure a different RTT for it; randomizing the order
+// every window averages that out, and recording it, see result.order, lets
+// reports attribute differences to it.
+func protocolSlots(ports map[protocol][]int, due func(protocol) bool) map[protocol]protocolSlot {
+	var protos []protocol
+	for p, ps := range ports {
+		if len(ps) > 0 && due(p) {
+			protos = append(protos, p)
+		}
+	}
+	if len(protos) == 0 {
+		return nil
+	}
+	rand.Shuffle(len(protos), func(i, j int) {
+		protos[i], protos[j] = protos[j], protos[i]
+	})
+	width := maxTXJitter / time.Duration(len(protos))
+	ret := make(map[protocol]protocolSlot, len(protos))
+	for i, p := range protos {
+		ret[p] = protocolSlot{
+			order: i + 1,
+			start: time.Duration(i) * width,
+			width: width,
+		}
+	}
+	return ret
+}
@@ -0,0 +1,97 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestProtocolSlots(t *testing.T) {
+	ports := map[protocol][]int{
+		protocolSTUN:  {3478},
+		protocolICMP:  {0},
+		protocolHTTPS: {443},
+		protocolTCP:   nil,
+		protocolTWAMP: {862},
+	}
+	due := func(p protocol) bool { return p != protocolTWAMP }
+	firsts := make(map[protocol]int)
+	for range 200 {
+		slots := protocolSlots(ports, due)
+		if len(slots) != 3 {
+			t.Fatalf("got %d slots, want 3 for the due protocols with ports: %+v", len(slots), slots)
+		}
+		seen := make(map[int]bool)
+		for p, s := range slots {
+			if s.order < 1 || s.order > 3 || seen[s.order] {
+				t.Fatalf("slot of %s has order %d, want a distinct order in [1, 3]", p, s.order)
+			}
+			seen[s.order] = true
+			if s.width != maxTXJitter/3 || s.start != time.Duration(s.order-1)*s.width {
+				t.Errorf("slot of %s = %+v, want the %d-th third of the jitter", p, s, s.order)
+			}
+			if off := s.offset(); off < s.start || off >= s.start+s.width {
+				t.Errorf("offset %v outside of slot %+v", off, s)
+			}
+			if s.order == 1 {
+				firsts[p]++
+			}
+		}
+	}
+	// Every protocol is sent first about a third of the time.
+	for _, p := range []protocol{protocolSTUN, protocolICMP, protocolHTTPS} {
+		if firsts[p] < 20 {
+			t.Errorf("%s sent first in %d of 200 windows, want it randomized", p, firsts[p])
+		}
+	}
+
+	if slots := protocolSlots(ports, func(protocol) bool { return false }); slots != nil {
+		t.Errorf("got slots %+v with nothing due", slots)
+	}
+	if off := (protocolSlot{}).offset(); off < 0 || off >= maxTXJitter {
+		t.Errorf("unslotted offset %v outside of the jitter", off)
+	}
+}
+
+func TestReportProbeOrder(t *testing.T) {
+	addr := netip.MustParseAddr("192.0.2.1")
+	at := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	var results []storedResult
+	for i := range 10 {
+		for order, rtt := range []time.Duration{10 * time.Millisecond, 13 * time.Millisecond} {
+			ns := int64(rtt)
+			results = append(results, storedResult{
+				At:              at.Add(time.Duration(i) * time.Minute),
+				Hostname:        "derp1a",
+				Addr:            addr,
+				Protocol:        protocolSTUN,
+				TimestampSource: "kernel",
+				Order:           order + 1,
+				TXOffsetNanos:   int64(order) * int64(maxTXJitter/2),
+				RTTNanos:        &ns,
+			})
+		}
+	}
+	rep := buildReport("derp1a", at, at.Add(time.Hour), results)
+	for _, s := range rep.Sections {
+		if s.Title != "Probe order" {
+			continue
+		}
+		if len(s.Rows) != 2 || s.Rows[0].Value != "sent 1st" || s.Rows[1].Value != "sent 2nd" || s.Rows[1].Delta != "+3ms" {
+			t.Errorf("probe order rows = %+v", s.Rows)
+		}
+		return
+	}
+	t.Errorf("report lacks a probe order section: %+v", rep.Sections)
+}
+
+func TestOrdinal(t *testing.T) {
+	for n, want := range map[int]string{1: "1st", 2: "2nd", 3: "3rd", 4: "4th", 11: "11th", 12: "12th", 13: "13th", 21: "21st", 112: "112th"} {
+		if got := ordinal(n); got != want {
+			t.Errorf("ordinal(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
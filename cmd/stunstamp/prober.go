@@ -0,0 +1,1479 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/cmd/stunstamp/schedule"
+	"tailscale.com/logtail/backoff"
+	"tailscale.com/net/netmon"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime"
+	"tailscale.com/types/logger"
+)
+
+// prober is the probing loop of stunstamp. It probes targets every window,
+// follows changes to the DERP map, the config, and local links, and writes
+// results to outputs. It is created from flags by newProber, and belongs to
+// the goroutine calling run.
+type prober struct {
+	// clock is the clock windows are scheduled and timestamped with, which
+	// tests fake.
+	clock tstime.Clock
+	// netns is the network namespace probed from if this is a child of
+	// runNetnsSupervisor.
+	netns           string
+	cfg             *config
+	portsByProtocol map[protocol][]int
+	cp              *controlProber    // nil if not probing the control plane
+	peers           *peerTargets      // nil without --targets-from-peers
+	mesh            *probeMesh        // nil without --mesh-tag
+	relayPaths      *relayPathTracker // nil without --relay-penalty
+	ntpServers      []string
+	dnsResolvers    []dnsResolver
+	caps            []capability
+	privs           []privilege
+	// probed holds the protocols probed, for logging and --check-config.
+	probed []protocol
+	layout storeLayout
+
+	baselines      *baselineTracker
+	consistency    *consistencyTracker
+	portBlocks     *portBlockTracker
+	ab             *abTracker
+	home           *homeRecommender
+	intervals      *intervalScheduler
+	targetStatuses *targetTracker
+	pruner         *targetPruner
+	hops           *hopTracker
+	marks          *markingTracker
+	ecns           *ecnTracker
+	keepalives     *keepaliveTracker
+	largeUDP       *largeUDPTracker
+	fingerprints   *fingerprintTracker
+	scheduler      *targetScheduler
+	budget         *probeBudget
+	happyEyeballs  *happyEyeballsTracker
+	quality        *qualityScorer
+	funnels        *funnelTracker
+	ntp            *ntpTracker
+	dnsProbes      *dnsTracker
+	instances      *instanceTracker
+	slos           *sloTracker
+	calib          *calibrator
+	snmp           *snmpAgent         // nil without --snmp-addr
+	leader         *leaderElector     // nil without --leader-election
+	keepaliveEm    *keepaliveEmulator // nil without --keepalive-emulation
+	ready          *readiness
+
+	store *resultsStore // nil without --store-dir
+	sb    *storeBackend // nil without --store-dir
+	// Every output buffers and retries independently, so that e.g. remote
+	// write unavailability does not hold up writes to the store.
+	outs outputs
+	rwc  *remoteWriteClient // nil without --rw-url
+	// spools are the webhook spools of --webhook-spool-dir.
+	spools               []*webhookSpool
+	derpMapWebhookClient *http.Client
+	derpMapSpool         *webhookSpool // nil unless spooling DERP map changes
+
+	sigCh chan os.Signal
+	dmCh  chan *tailcfg.DERPMap
+	cfgCh chan *config
+	// closers are run in reverse order by close.
+	closers []func()
+
+	nodeMetaByAddr map[netip.Addr]nodeMeta
+	// derpSTUNPortsByHost holds the STUN ports of DERP map nodes by hostname.
+	derpSTUNPortsByHost map[string]int
+	// lastDM is the latest DERP map, before target selection, so that
+	// targets are reselected when the config changes.
+	lastDM *tailcfg.DERPMap
+	// groupKeysSeen holds the group-level timeseries we have written, so
+	// that we can mark them stale when they disappear.
+	groupKeysSeen map[groupKey]bool
+	localClient   tailscale.LocalClient
+	// annotationsExportedTo is the time up to which annotations have been
+	// exported.
+	annotationsExportedTo time.Time
+	// lastRX are the receive path counters at the end of the last window.
+	lastRX rxStats
+
+	// Re-using sockets means we get the same 5-tuple across runs. This
+	// results in a higher probability of the packets traversing the same
+	// underlay path. Comparison of stable and unstable 5-tuple results can
+	// shed light on differences between paths where hashing
+	// (multipathing/load balancing) comes into play. The inner 2 element
+	// array index is timestampSource.
+	stableConns map[stableConnKey][2]*connAndMeasureFn
+	// timeouts holds counts of timeout events. Values are persisted for the
+	// lifetime of the related node in the DERP map.
+	timeouts map[resultKey]uint64
+
+	// Probe windows start every tick, the shortest of --interval and the
+	// intervals of the config, which may change on reload.
+	tick            time.Duration
+	probeCh         <-chan time.Time
+	stopProbeTicker func()
+	suspends        *schedule.SuspendDetector
+	warm            warmUp
+	// standby is whether the last window was sat out as the standby of a
+	// redundant pair, see --leader-election.
+	standby          bool
+	localAddrChanges <-chan localAddrChange
+	linkChanges      <-chan linkChange
+	// lastTargets and lastPortsByAddr are those of the last window, which
+	// link changes probe out of cycle.
+	lastTargets     map[netip.Addr]nodeMeta
+	lastPortsByAddr map[netip.Addr]map[protocol][]int
+	lastLinkProbe   time.Time
+	// linkProbes receives the results of link change probes, which run
+	// concurrently with the loop. linkProbing is whether one is in flight.
+	linkProbes  chan linkProbe
+	linkProbing bool
+}
+
+// linkProbe is the outcome of probing out of cycle after a link change.
+type linkProbe struct {
+	at      time.Time
+	results []result
+	err     error
+}
+
+// portsByProtocolFromFlags returns the destination ports by protocol of the
+// --*-dst-ports and --icmp flags.
+func portsByProtocolFromFlags() (map[protocol][]int, error) {
+	portsByProtocol := make(map[protocol][]int)
+	for _, f := range []struct {
+		name      string
+		value     *string
+		protocols []protocol
+	}{
+		{"stun-dst-ports", flagSTUNDstPorts, []protocol{protocolSTUN}},
+		{"https-dst-ports", flagHTTPSDstPorts, []protocol{protocolHTTPS}},
+		{"tcp-dst-ports", flagTCPDstPorts, []protocol{protocolTCP}},
+		{"derp-dst-ports", flagDERPDstPorts, []protocol{protocolDERP}},
+		{"derp-ws-dst-ports", flagDERPWSDstPorts, []protocol{protocolDERPWebSocket, protocolDERPWebSocketUpgrade}},
+		{"twamp-dst-ports", flagTWAMPDstPorts, []protocol{protocolTWAMP}},
+	} {
+		ports, err := getPortsFromFlag(*f.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s flag value: %w", f.name, err)
+		}
+		if len(ports) == 0 {
+			continue
+		}
+		for _, p := range f.protocols {
+			portsByProtocol[p] = ports
+		}
+	}
+	if *flagICMP {
+		portsByProtocol[protocolICMP] = []int{0}
+	}
+	return portsByProtocol, nil
+}
+
+// tailnetPorts returns the ports of the protocols probed inside the tunnel,
+// for --targets-from-peers and --mesh-tag.
+func tailnetPorts(portsByProtocol map[protocol][]int) map[protocol][]int {
+	ret := make(map[protocol][]int)
+	for _, p := range []protocol{protocolSTUN, protocolICMP} {
+		if ports, ok := portsByProtocol[p]; ok {
+			ret[p] = ports
+		}
+	}
+	return ret
+}
+
+// newProber returns a prober configured by flags, setting up the probers of
+// the process, e.g. activeProxy, that flags enable. netns is the network
+// namespace probed from, if any.
+func newProber(netns string) (*prober, error) {
+	p := &prober{clock: tstime.StdClock{}, netns: netns}
+	var err error
+	p.portsByProtocol, err = portsByProtocolFromFlags()
+	if err != nil {
+		return nil, err
+	}
+	if len(*flagTWAMPKeys) > 0 {
+		activeTWAMPKeys, err = parseTWAMPKeys(*flagTWAMPKeys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid twamp-auth-keys flag value: %w", err)
+		}
+	}
+	if len(*flagControlURL) > 0 {
+		p.cp, err = newControlProber(*flagControlURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid control-url flag value: %w", err)
+		}
+	}
+	if len(*flagProxy) > 0 {
+		activeProxy, err = parseProbeProxy(*flagProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy flag value: %w", err)
+		}
+	}
+	if *flagNetstack {
+		activeNetstack, err = newNetstackProber()
+		if err != nil {
+			return nil, fmt.Errorf("error setting up netstack: %w", err)
+		}
+	}
+	if len(*flagRawIface) > 0 {
+		activeRawProber, err = newRawProber(*flagRawIface, *flagRawNextHopMAC)
+		if err != nil {
+			return nil, fmt.Errorf("error setting up raw-iface: %w", err)
+		}
+	}
+	p.cfg = &config{}
+	if len(*flagConfig) > 0 {
+		p.cfg, err = loadConfig(*flagConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config file: %w", err)
+		}
+	}
+	if *flagPeers {
+		p.peers = newPeerTargets(*flagIPv6, tailnetPorts(p.portsByProtocol))
+	}
+	if len(*flagMeshTag) > 0 {
+		if !strings.HasPrefix(*flagMeshTag, "tag:") {
+			return nil, fmt.Errorf("invalid mesh-tag flag value: %q", *flagMeshTag)
+		}
+		if *flagMeshDegree < 0 {
+			return nil, errors.New("mesh-degree must be >= 0")
+		}
+		ports := tailnetPorts(p.portsByProtocol)
+		if len(ports) == 0 {
+			return nil, errors.New("mesh-tag requires one or more of icmp and stun-dst-ports")
+		}
+		var httpPort string
+		if len(*flagHTTPAddr) > 0 {
+			_, httpPort, err = net.SplitHostPort(*flagHTTPAddr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid http-addr flag value: %w", err)
+			}
+		}
+		p.mesh = newProbeMesh(*flagMeshTag, *flagMeshDegree, *flagIPv6, ports, httpPort)
+	}
+	p.ntpServers, err = parseNTPServers(*flagNTPServers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ntp-servers flag value: %w", err)
+	}
+	p.dnsResolvers, err = parseDNSResolvers(*flagDNSResolvers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns-resolvers flag value: %w", err)
+	}
+	if _, _, err := dnsQuery(*flagDNSQueryName); len(p.dnsResolvers) > 0 && err != nil {
+		return nil, fmt.Errorf("invalid dns-query-name flag value: %w", err)
+	}
+	if p.nothingToProbe() {
+		if len(*flagTWAMPReflector) > 0 {
+			log.Fatal(serveTWAMPReflector(*flagTWAMPReflector, activeTWAMPKeys))
+		}
+		return nil, errors.New("nothing to probe")
+	}
+	if len(*flagTWAMPReflector) > 0 && !*flagCheckConfig {
+		go func() {
+			log.Fatal(serveTWAMPReflector(*flagTWAMPReflector, activeTWAMPKeys))
+		}()
+	}
+	p.detect()
+	if err := p.validateFlags(); err != nil {
+		return nil, err
+	}
+	if *flagRelayPenalty {
+		p.relayPaths = newRelayPathTracker()
+	}
+	return p, nil
+}
+
+// nothingToProbe reports whether flags and the config select nothing to
+// probe.
+func (p *prober) nothingToProbe() bool {
+	return len(p.portsByProtocol) == 0 && len(p.cfg.TargetPorts) == 0 && !*flagDERPSTUNPorts && p.cp == nil && len(p.cfg.Funnels) == 0 && p.peers == nil && p.mesh == nil && !*flagHopCount && len(p.ntpServers) == 0 && len(p.dnsResolvers) == 0
+}
+
+// detect detects missing capabilities and privileges up front, so that we
+// degrade to the sources we are able to measure with instead of failing probes
+// every window.
+func (p *prober) detect() {
+	caps, tps := detectCapabilities(timestampProviders, *flagIPv6)
+	timestampProviders = tps
+	p.caps = caps
+	p.probed = slices.Collect(maps.Keys(p.portsByProtocol))
+	if *flagDERPSTUNPorts {
+		p.probed = append(p.probed, protocolSTUN)
+	}
+	for _, tp := range p.cfg.TargetPorts {
+		p.probed = slices.AppendSeq(p.probed, maps.Keys(tp.Ports))
+	}
+	logCapabilities(caps, p.probed)
+	p.privs = detectPrivileges()
+	privilegesInUse := []string{"kernel timestamps"}
+	if *flagICMP {
+		privilegesInUse = append(privilegesInUse, "--icmp")
+	}
+	if *flagHopCount {
+		privilegesInUse = append(privilegesInUse, "--hop-count")
+	}
+	if len(*flagRawIface) > 0 {
+		privilegesInUse = append(privilegesInUse, "--raw-iface", "--raw-iface hardware timestamps")
+	}
+	logPrivileges(p.privs, privilegesInUse)
+}
+
+// validateFlags checks flags for values out of range and combinations
+// missing their prerequisites.
+func (p *prober) validateFlags() error {
+	if len(*flagDERPMap) < 1 {
+		return errors.New("derp-map flag is unset")
+	}
+	if *flagInterval < minInterval || *flagInterval > maxBufferDuration {
+		return fmt.Errorf("interval must be >= %s and <= %s", minInterval, maxBufferDuration)
+	}
+	if *flagRXBatch < 1 || *flagRXBatch > maxRXBatch {
+		return fmt.Errorf("rx-batch must be >= 1 and <= %d", maxRXBatch)
+	}
+	if *flagLeaderLease < time.Second {
+		return errors.New("leader-lease must be >= 1s")
+	}
+	if *flagSTUNSampleRate < 0 || *flagSTUNSampleRate > 1 {
+		return errors.New("stun-response-sample-rate must be >= 0 and <= 1")
+	}
+	if *flagECNECT1 && !*flagECN {
+		return errors.New("ecn-ect1 requires the ecn flag")
+	}
+	if *flagHappyEyeballs && !*flagIPv6 {
+		return errors.New("happy-eyeballs requires the ipv6 flag")
+	}
+	if *flagRelayPenalty && !*flagPeers {
+		return errors.New("relay-penalty requires the targets-from-peers flag")
+	}
+	if *flagArchiveAfter > 0 && len(*flagStoreDir) < 1 {
+		return errors.New("archive-after requires the store-dir flag")
+	}
+	p.layout = storeLayout(*flagStoreLayout)
+	if p.layout != storeLayoutJSONL && p.layout != storeLayoutRing && p.layout != storeLayoutSharded {
+		return fmt.Errorf("invalid store-layout flag value: %q", *flagStoreLayout)
+	}
+	if *flagArchiveAfter > 0 && p.layout != storeLayoutJSONL {
+		return errors.New("archive-after requires the jsonl store layout")
+	}
+	if len(*flagRemoteWriteURL) < 1 && len(*flagOTLPURL) < 1 && len(*flagStoreDir) < 1 && len(*flagWebhookURL) < 1 && p.netns == "" {
+		return errors.New("no outputs configured, set one or more of rw-url, otlp-url, store-dir, and webhook-url")
+	}
+	for name, v := range map[string]string{"rw-url": *flagRemoteWriteURL, "otlp-url": *flagOTLPURL, "webhook-url": *flagWebhookURL, "derp-map-webhook-url": *flagDERPMapWebhook} {
+		if _, err := url.Parse(v); err != nil {
+			return fmt.Errorf("invalid %s flag value: %w", name, err)
+		}
+	}
+	if len(*flagWebhookSpool) > 0 && *flagWebhookSpoolMB < 1 {
+		return errors.New("webhook-spool-max-mb must be >= 1")
+	}
+	return nil
+}
+
+// checkConfig runs --check-config, writing its report to stdout.
+func (p *prober) checkConfig() error {
+	return runCheckConfig(context.Background(), os.Stdout, p.cfg, p.portsByProtocol, p.caps, p.probed)
+}
+
+// start creates the trackers of p, opens the store, and starts the servers
+// flags enable. Resources are released by close.
+func (p *prober) start() {
+	p.baselines = newBaselineTracker()
+	p.consistency = newConsistencyTracker()
+	p.portBlocks = newPortBlockTracker()
+	p.ab = newABTracker()
+	p.home = newHomeRecommender()
+	p.intervals = newIntervalScheduler()
+	p.targetStatuses = newTargetTracker()
+	p.pruner = newTargetPruner()
+	p.hops = newHopTracker()
+	p.marks = newMarkingTracker()
+	p.ecns = newECNTracker()
+	p.keepalives = newKeepaliveTracker()
+	p.largeUDP = newLargeUDPTracker()
+	p.fingerprints = newFingerprintTracker()
+	p.scheduler = newTargetScheduler()
+	p.budget = newProbeBudget()
+	p.happyEyeballs = newHappyEyeballsTracker()
+	p.quality = newQualityScorer()
+	p.funnels = newFunnelTracker()
+	p.ntp = newNTPTracker()
+	p.dnsProbes = newDNSTracker()
+	p.instances = newInstanceTracker()
+	p.slos = newSLOTracker()
+	p.nodeMetaByAddr = make(map[netip.Addr]nodeMeta)
+	p.groupKeysSeen = make(map[groupKey]bool)
+	p.stableConns = make(map[stableConnKey][2]*connAndMeasureFn)
+	p.timeouts = make(map[resultKey]uint64)
+	p.linkProbes = make(chan linkProbe, 1)
+
+	if len(*flagStoreDir) > 0 {
+		p.openStore()
+	}
+
+	// Calibrate before probing, so that the floor is not inflated by probes
+	// in flight.
+	p.calib = newCalibrator(*flagCalibration)
+	p.calib.run(context.Background(), timestampProviders, *flagIPv6)
+
+	if len(*flagSNMPAddr) > 0 {
+		var err error
+		p.snmp, err = newSNMPAgent(*flagSNMPOIDPrefix, *flagSNMPCommunity)
+		if err != nil {
+			log.Fatalf("invalid snmp-oid-prefix flag value: %v", err)
+		}
+		pc, err := net.ListenPacket("udp", *flagSNMPAddr)
+		if err != nil {
+			log.Fatalf("error listening for SNMP: %v", err)
+		}
+		go func() {
+			log.Fatal(p.snmp.serve(pc))
+		}()
+	}
+
+	if len(*flagLeaderElection) > 0 {
+		backend, err := parseLeaseBackend(*flagLeaderElection)
+		if err != nil {
+			log.Fatalf("invalid leader-election flag value: %v", err)
+		}
+		p.leader = newLeaderElector(backend, leaderIdentity(), *flagLeaderLease)
+		leaderCtx, leaderCancel := context.WithCancel(context.Background())
+		leaderDone := make(chan struct{})
+		go func() {
+			defer close(leaderDone)
+			p.leader.run(leaderCtx)
+		}()
+		// Release the lease on return, so that the standby takes over at
+		// once.
+		p.closers = append(p.closers, func() {
+			leaderCancel()
+			<-leaderDone
+		})
+	}
+
+	p.ready = &readiness{interval: *flagInterval}
+	if len(*flagHTTPAddr) > 0 {
+		hs := &httpServer{
+			instance:    *flagInstance,
+			baselines:   p.baselines,
+			store:       p.store,
+			ready:       p.ready,
+			caps:        p.caps,
+			privs:       p.privs,
+			calib:       p.calib,
+			mesh:        p.mesh,
+			relay:       p.relayPaths,
+			consistency: p.consistency,
+			portBlocks:  p.portBlocks,
+			ab:          p.ab,
+			intervals:   p.intervals,
+			targets:     p.targetStatuses,
+			stream:      liveStream,
+			home:        p.home,
+			leader:      p.leader,
+		}
+		go func() {
+			log.Fatal(http.ListenAndServe(*flagHTTPAddr, hs.mux()))
+		}()
+	}
+}
+
+// openStore opens the store in --store-dir, restoring the state persisted
+// in it.
+func (p *prober) openStore() {
+	store, err := openResultsStoreLayout(*flagStoreDir, p.layout)
+	if err != nil {
+		log.Fatalf("error opening store: %v", err)
+	}
+	p.store = store
+	if *flagResultsCache > 0 && p.layout != storeLayoutRing {
+		store.cache = newResultsCache(*flagResultsCache)
+	}
+	p.closers = append(p.closers, func() { store.close() })
+	events.setStoreDir(*flagStoreDir)
+	p.closers = append(p.closers, events.close)
+	if err := annotations.open(*flagStoreDir, false); err != nil {
+		log.Fatalf("error loading annotations: %v", err)
+	}
+	if err := probeStates.open(*flagStoreDir, p.intervals, p.pruner); err != nil {
+		storeLog.Error("error restoring probe state, starting afresh", "err", err)
+	}
+	// Seed baselines from history so that restarts don't reset them.
+	now := p.clock.Now()
+	err = store.readRange(now.AddDate(0, 0, -baselineDays-1), now, func(sr storedResult) error {
+		p.baselines.add([]result{sr.toResult()})
+		return nil
+	})
+	if err != nil {
+		storeLog.Error("error loading baselines from store", "err", err)
+	}
+	if *flagArchiveAfter > 0 {
+		stopArchiving := make(chan struct{})
+		p.closers = append(p.closers, func() { close(stopArchiving) })
+		go archiveLoop(store, *flagArchiveAfter, stopArchiving)
+	}
+}
+
+// close releases the resources of p, in the reverse order of acquiring them.
+func (p *prober) close() {
+	for _, c := range slices.Backward(p.closers) {
+		c()
+	}
+	p.closers = nil
+}
+
+// waitForDERPMap fetches the DERP map, retrying until it succeeds, and
+// selects the targets of it. It reports false if stopped by a signal first.
+func (p *prober) waitForDERPMap() bool {
+	go func() {
+		bo := backoff.NewBackoff("derp-map", logfOf(probeLog), time.Second*30)
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			dm, err := getDERPMap(ctx, *flagDERPMap)
+			cancel()
+			bo.BackOff(context.Background(), err)
+			if err != nil {
+				continue
+			}
+			p.dmCh <- dm
+			return
+		}
+	}()
+	select {
+	case <-p.sigCh:
+		return false
+	case dm := <-p.dmCh:
+		p.lastDM = dm
+		_, err := nodeMetaFromDERPMap(p.cfg.Targets.apply(dm), p.nodeMetaByAddr, *flagIPv6)
+		if err != nil {
+			log.Fatalf("error parsing derp map on startup: %v", err)
+		}
+		p.derpSTUNPortsByHost = derpSTUNPorts(dm)
+		events.setTargets(p.nodeMetaByAddr)
+	}
+	return true
+}
+
+// openOutputs sets up the outputs of p.
+func (p *prober) openOutputs() {
+	outputDepth := int(maxBufferDuration / p.cfg.tick(*flagInterval))
+	privacy, err := newIPPrivacy(*flagExportIPs, *flagExportIPKey)
+	if err != nil {
+		log.Fatalf("invalid export-ip-privacy flag value: %v", err)
+	}
+	if len(*flagRemoteWriteURL) > 0 {
+		p.rwc = newRemoteWriteClient(*flagRemoteWriteURL)
+		if p.netns != "" {
+			p.rwc.labels = []prompb.Label{{Name: "netns", Value: p.netns}}
+		}
+		p.rwc.privacy = privacy
+		p.outs = append(p.outs, newOutputQueue(remoteWriteBackend{p.rwc}, outputDepth))
+	}
+	if len(*flagOTLPURL) > 0 {
+		ob := newOTLPBackend(*flagOTLPURL)
+		if p.netns != "" {
+			ob.labels = []prompb.Label{{Name: "netns", Value: p.netns}}
+		}
+		ob.privacy = privacy
+		p.outs = append(p.outs, newOutputQueue(ob, outputDepth))
+	}
+	if p.store != nil {
+		p.sb = &storeBackend{s: p.store}
+		p.outs = append(p.outs, newOutputQueue(p.sb, outputDepth))
+	}
+	if len(*flagWebhookURL) > 0 {
+		wb := newWebhookBackend(*flagWebhookURL, *flagInstance)
+		wb.netns = p.netns
+		wb.privacy = privacy
+		if len(*flagWebhookSpool) > 0 {
+			wb.spool, err = newWebhookSpool(webhookSpoolDir(*flagWebhookSpool, p.netns), "webhook", int64(*flagWebhookSpoolMB)<<20, wb.sendSpooled)
+			if err != nil {
+				log.Fatalf("error opening webhook spool: %v", err)
+			}
+			go wb.spool.run(context.Background())
+			p.spools = append(p.spools, wb.spool)
+		}
+		p.outs = append(p.outs, newOutputQueue(wb, outputDepth))
+	}
+	if p.netns != "" {
+		np := &netnsPipe{w: os.NewFile(netnsPipeFD, "netns-supervisor")}
+		go np.forwardEvents(liveStream)
+		p.outs = append(p.outs, newOutputQueue(np, outputDepth))
+	}
+	if len(*flagHTTPAddr) > 0 {
+		p.outs = append(p.outs, newOutputQueue(streamBackend{liveStream}, outputDepth))
+	}
+
+	p.derpMapWebhookClient = &http.Client{Timeout: 30 * time.Second}
+	if len(*flagDERPMapWebhook) > 0 && len(*flagWebhookSpool) > 0 {
+		p.derpMapSpool, err = newWebhookSpool(webhookSpoolDir(*flagWebhookSpool, p.netns), "derp-map-webhook", int64(*flagWebhookSpoolMB)<<20, sendSpooledDERPMapChanges(p.derpMapWebhookClient, *flagDERPMapWebhook))
+		if err != nil {
+			log.Fatalf("error opening DERP map webhook spool: %v", err)
+		}
+		go p.derpMapSpool.run(context.Background())
+		p.spools = append(p.spools, p.derpMapSpool)
+	}
+
+	if p.store != nil {
+		p.startSLOReports()
+	}
+}
+
+// startSLOReports writes the SLO reports of every month to the store once
+// its last window closes, seeding SLOs with the windows of the month before
+// startup.
+func (p *prober) startSLOReports() {
+	p.slos.onMonthEnd = func(month time.Time) {
+		defs := p.cfg.SLOs
+		go func() {
+			if err := writeSLOReportFiles(*flagStoreDir, p.store, *flagInstance, defs, month); err != nil {
+				storeLog.Error("error writing SLO reports", "month", month.Format("2006-01"), "err", err)
+			}
+		}()
+	}
+	if len(p.cfg.SLOs) > 0 {
+		defs, now := p.cfg.SLOs, p.clock.Now()
+		go func() {
+			results, err := readSLOResults(p.store, defs, monthStartOf(now), now)
+			if err != nil {
+				storeLog.Warn("error reading results to seed SLOs, error budgets count from startup", "err", err)
+				return
+			}
+			p.slos.seed(results, defs, now)
+		}()
+	}
+}
+
+// portsFor returns the destination ports by protocol to probe the DERP
+// target m with.
+func (p *prober) portsFor(m nodeMeta) map[protocol][]int {
+	ports := p.cfg.portsFor(m, p.portsByProtocol)
+	if *flagDERPSTUNPorts {
+		ports = addSTUNPort(ports, p.derpSTUNPortsByHost[m.hostname])
+	}
+	return ports
+}
+
+// derpStaleMarkers returns stale markers for the DERP targets stale, probed
+// with the ports configured for each.
+func (p *prober) derpStaleMarkers(stale []nodeMeta) []prompb.TimeSeries {
+	var ret []prompb.TimeSeries
+	for _, m := range stale {
+		ret = append(ret, staleMarkersFromNodeMeta([]nodeMeta{m}, *flagInstance, p.portsFor(m))...)
+	}
+	return ret
+}
+
+// removedPortsStaleMarkers returns stale markers for the ports of DERP
+// targets in before, by address, that are no longer probed.
+func (p *prober) removedPortsStaleMarkers(before map[netip.Addr]map[protocol][]int) []prompb.TimeSeries {
+	var ret []prompb.TimeSeries
+	for addr, ports := range before {
+		m, ok := p.nodeMetaByAddr[addr]
+		if !ok {
+			continue
+		}
+		if removed := removedPorts(ports, p.portsFor(m)); len(removed) > 0 {
+			ret = append(ret, staleMarkersFromNodeMeta([]nodeMeta{m}, *flagInstance, removed)...)
+		}
+	}
+	return ret
+}
+
+// portsByDERPAddr returns the ports of every DERP target by address.
+func (p *prober) portsByDERPAddr() map[netip.Addr]map[protocol][]int {
+	ret := make(map[netip.Addr]map[protocol][]int, len(p.nodeMetaByAddr))
+	for addr, m := range p.nodeMetaByAddr {
+		ret[addr] = p.portsFor(m)
+	}
+	return ret
+}
+
+// targetForgetter is implemented by trackers that hold state by target,
+// which is dropped once the target is no longer probed.
+type targetForgetter interface {
+	// forget drops the state of targets for which keep returns false.
+	forget(keep func(resultKey) bool)
+}
+
+// staleMarkerer is implemented by trackers of the timeseries they write,
+// which are marked stale on shutdown.
+type staleMarkerer interface {
+	// staleMarkers returns stale markers for the timeseries written.
+	staleMarkers(instance string) []prompb.TimeSeries
+}
+
+// forgetAll drops the state that every tracker holds for targets for which
+// keep returns false.
+func (p *prober) forgetAll(keep func(resultKey) bool) {
+	for _, t := range []targetForgetter{p.baselines, p.instances, p.quality, p.consistency, p.intervals, p.pruner, p.ecns, p.keepalives} {
+		t.forget(keep)
+	}
+}
+
+// isTarget reports whether k is for a current target.
+func (p *prober) isTarget(k resultKey) bool {
+	if p.peers != nil && p.peers.metaByAddr[k.meta.addr] == k.meta {
+		return true
+	}
+	if p.mesh != nil && p.mesh.isTarget(k.meta) {
+		return true
+	}
+	return p.nodeMetaByAddr[k.meta.addr] == k.meta
+}
+
+// shutdown flushes outputs, and sends stale markers for all timeseries
+// written to remote write.
+func (p *prober) shutdown() {
+	p.outs.close(time.Second * 10) // give outputs some time to flush
+	if p.rwc == nil {
+		return
+	}
+
+	// send stale markers on shutdown
+	staleMeta := make([]nodeMeta, 0, len(p.nodeMetaByAddr))
+	for _, v := range p.nodeMetaByAddr {
+		staleMeta = append(staleMeta, v)
+	}
+	staleMarkers := p.derpStaleMarkers(staleMeta)
+	for k := range p.groupKeysSeen {
+		staleMarkers = append(staleMarkers, groupStaleMarkers(k, *flagInstance, p.clock.Now())...)
+	}
+	if p.cp != nil {
+		staleMarkers = append(staleMarkers, p.cp.staleMarkers(*flagInstance)...)
+	}
+	if p.peers != nil {
+		staleMarkers = append(staleMarkers, p.peers.staleMarkers(*flagInstance)...)
+	}
+	if p.mesh != nil {
+		staleMarkers = append(staleMarkers, p.mesh.staleMarkers(*flagInstance)...)
+	}
+	for _, t := range []staleMarkerer{p.hops, p.marks, p.ab, p.largeUDP, p.fingerprints, p.happyEyeballs, p.quality, p.funnels, p.ntp, p.dnsProbes, p.slos, p.ecns, p.keepalives, p.calib} {
+		staleMarkers = append(staleMarkers, t.staleMarkers(*flagInstance)...)
+	}
+	if p.relayPaths != nil {
+		staleMarkers = append(staleMarkers, p.relayPaths.staleMarkers(*flagInstance)...)
+	}
+	if len(staleMarkers) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		p.rwc.write(ctx, staleMarkers)
+		cancel()
+	}
+}
+
+// startProbeTicker starts the ticker of probe windows starting every tick.
+func (p *prober) startProbeTicker(tick time.Duration) {
+	p.tick = tick
+	if *flagAlignWindows {
+		phase := schedule.WindowPhase(*flagInstance, tick)
+		probeLog.Info("aligning probe windows", "interval", tick, "phase", phase)
+		probeTicker := schedule.NewAlignedTicker(p.clock, tick, phase)
+		p.probeCh, p.stopProbeTicker = probeTicker.C, probeTicker.Stop
+	} else {
+		probeTicker, probeCh := p.clock.NewTicker(tick)
+		p.probeCh, p.stopProbeTicker = probeCh, probeTicker.Stop
+	}
+}
+
+// watchNetwork starts watching for the local address and link changes that
+// --rebind and --probe-on-link-change react to.
+func (p *prober) watchNetwork() {
+	if !*flagRebind && !*flagProbeOnLink {
+		return
+	}
+	mon, err := netmon.New(logger.Discard)
+	if err != nil {
+		probeLog.Warn("unable to monitor the network, stable conns will not be rebound and links not probed on changes", "err", err)
+		return
+	}
+	if *flagRebind {
+		p.localAddrChanges = watchLocalAddrs(mon)
+	}
+	if *flagProbeOnLink {
+		p.linkChanges = watchLinkChanges(mon)
+	}
+	mon.Start()
+	p.closers = append(p.closers, func() { mon.Close() })
+}
+
+// startKeepaliveEmulation starts --keepalive-emulation.
+func (p *prober) startKeepaliveEmulation() {
+	k, err := newKeepaliveEmulator(*flagKeepalivePort, *flagIPv6)
+	if err != nil {
+		probeLog.Warn("unable to emulate keepalives", "err", err)
+		return
+	}
+	keepaliveCtx, keepaliveCancel := context.WithCancel(context.Background())
+	p.closers = append(p.closers, keepaliveCancel, func() { k.close() })
+	go k.run(keepaliveCtx)
+	p.keepaliveEm = k
+}
+
+// run runs p until stopped by a signal, or an unrecoverable error while
+// probing.
+func (p *prober) run() {
+	p.sigCh = make(chan os.Signal, 1)
+	signal.Notify(p.sigCh, syscall.SIGINT, syscall.SIGTERM)
+	p.dmCh = make(chan *tailcfg.DERPMap)
+	p.cfgCh = make(chan *config)
+	if len(*flagConfig) > 0 {
+		go watchConfig(*flagConfig, p.cfgCh)
+	}
+	if !p.waitForDERPMap() {
+		return
+	}
+	p.openOutputs()
+
+	slog.Info("stunstamp started")
+	p.annotationsExportedTo = p.clock.Now()
+	annotations.annotateAuto(p.annotationsExportedTo, p.annotationsExportedTo, "", "stunstamp started")
+
+	derpMapTicker, derpMapTickerCh := p.clock.NewTicker(time.Minute * 5)
+	defer derpMapTicker.Stop()
+	p.startProbeTicker(p.cfg.tick(*flagInterval))
+	defer func() { p.stopProbeTicker() }()
+
+	p.suspends = schedule.NewSuspendDetector(p.clock.Now())
+	p.warm.reset(*flagWarmUpWindows)
+	p.watchNetwork()
+	if *flagKeepalive {
+		p.startKeepaliveEmulation()
+	}
+	for {
+		select {
+		case windowStart := <-p.probeCh:
+			if err := p.probeWindow(windowStart); err != nil {
+				probeLog.Error("unrecoverable error while probing", "err", err)
+				p.shutdown()
+				return
+			}
+		case c := <-p.cfgCh:
+			p.reloadConfig(c)
+		case dm := <-p.dmCh:
+			p.updateDERPMap(dm)
+		case c := <-p.localAddrChanges:
+			p.rebind(c)
+		case c := <-p.linkChanges:
+			p.probeLinkChange(c)
+		case lp := <-p.linkProbes:
+			if err := p.linkProbeDone(lp); err != nil {
+				probeLog.Error("unrecoverable error while probing", "err", err)
+				p.shutdown()
+				return
+			}
+		case <-derpMapTickerCh:
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+				defer cancel()
+				updatedDM, err := getDERPMap(ctx, *flagDERPMap)
+				if err == nil {
+					p.dmCh <- updatedDM
+				}
+			}()
+		case <-p.sigCh:
+			p.shutdown()
+			return
+		}
+	}
+}
+
+// windowMeasurements holds the window-level measurements started in a
+// window, which run concurrently with probing its targets. Channels are nil
+// for measurements not started.
+type windowMeasurements struct {
+	control       chan []controlResult
+	funnels       chan []funnelResult
+	ntp           chan []ntpResult
+	dns           chan []dnsResult
+	relayPaths    chan []relayPathResult
+	hops          chan []hopResult
+	markings      chan []markingResult
+	ab            chan []abResult
+	abCfg         *abConfig
+	largeUDP      chan []largeUDPResult
+	fingerprints  chan []pathFingerprint
+	happyEyeballs chan []happyEyeballsResult
+}
+
+// startTargetless starts the window-level measurements independent of the
+// targets of the window.
+func (p *prober) startTargetless(ctx context.Context, w *windowMeasurements) {
+	if p.cp != nil {
+		w.control = make(chan []controlResult, 1)
+		go func() {
+			w.control <- p.cp.probe(ctx)
+		}()
+	}
+	if len(p.cfg.Funnels) > 0 || len(p.funnels.timeouts) > 0 {
+		w.funnels = make(chan []funnelResult, 1)
+		funnels := p.cfg.Funnels
+		go func() {
+			w.funnels <- measureAllFunnels(ctx, funnels)
+		}()
+	}
+	if len(p.ntpServers) > 0 {
+		w.ntp = make(chan []ntpResult, 1)
+		go func() {
+			w.ntp <- measureAllNTP(ctx, p.ntpServers)
+		}()
+	}
+	if len(p.dnsResolvers) > 0 {
+		w.dns = make(chan []dnsResult, 1)
+		go func() {
+			w.dns <- measureAllDNS(ctx, p.dnsResolvers, *flagDNSQueryName)
+		}()
+	}
+}
+
+// startPerTarget starts the window-level measurements of targets, probed
+// with the ports of portsByAddr, or those of flags if absent.
+func (p *prober) startPerTarget(ctx context.Context, w *windowMeasurements, targets map[netip.Addr]nodeMeta, portsByAddr map[netip.Addr]map[protocol][]int) {
+	portsOf := func(m nodeMeta) map[protocol][]int {
+		if override, ok := portsByAddr[m.addr]; ok {
+			return override
+		}
+		return p.portsByProtocol
+	}
+	stunPortsOf := func(m nodeMeta) []int {
+		return portsOf(m)[protocolSTUN]
+	}
+	if *flagHopCount {
+		w.hops = make(chan []hopResult, 1)
+		go func() {
+			w.hops <- measureHopCounts(ctx, targets)
+		}()
+	}
+	if *flagMarking {
+		w.markings = make(chan []markingResult, 1)
+		go func() {
+			w.markings <- measureAllMarkings(ctx, targets, stunPortsOf)
+		}()
+	}
+	if w.abCfg = p.cfg.AB; w.abCfg != nil || p.ab.active() {
+		w.ab = make(chan []abResult, 1)
+		abCfg := w.abCfg
+		go func() {
+			w.ab <- measureAllAB(ctx, abCfg, targets, stunPortsOf)
+		}()
+	}
+	if *flagLargeUDP {
+		w.largeUDP = make(chan []largeUDPResult, 1)
+		go func() {
+			w.largeUDP <- measureAllLargeUDP(ctx, targets, stunPortsOf)
+		}()
+	}
+	if *flagFingerprint {
+		w.fingerprints = make(chan []pathFingerprint, 1)
+		go func() {
+			w.fingerprints <- measureAllPathFingerprints(ctx, targets, stunPortsOf, func(m nodeMeta) []int {
+				ports := portsOf(m)
+				return append(slices.Clone(ports[protocolHTTPS]), ports[protocolTCP]...)
+			})
+		}()
+	}
+	if *flagHappyEyeballs {
+		w.happyEyeballs = make(chan []happyEyeballsResult, 1)
+		go func() {
+			w.happyEyeballs <- measureAllHappyEyeballs(ctx, targets, func(m nodeMeta) []int {
+				return portsOf(m)[protocolHTTPS]
+			})
+		}()
+	}
+}
+
+// windowMeasurementsTimeSeries waits for the measurements of w, returning
+// their timeseries.
+func (p *prober) windowMeasurementsTimeSeries(w *windowMeasurements) []prompb.TimeSeries {
+	var ts []prompb.TimeSeries
+	if w.control != nil {
+		ts = append(ts, p.cp.toPromTimeSeries(<-w.control, *flagInstance)...)
+	}
+	if w.relayPaths != nil {
+		ts = append(ts, p.relayPaths.update(<-w.relayPaths, *flagInstance)...)
+	}
+	if w.funnels != nil {
+		ts = append(ts, p.funnels.update(<-w.funnels, *flagInstance)...)
+	}
+	if w.ntp != nil {
+		ts = append(ts, p.ntp.update(<-w.ntp, *flagInstance)...)
+	}
+	if w.dns != nil {
+		ts = append(ts, p.dnsProbes.update(<-w.dns, *flagInstance)...)
+	}
+	if w.hops != nil {
+		ts = append(ts, p.hops.update(<-w.hops, *flagInstance)...)
+	}
+	if w.markings != nil {
+		ts = append(ts, p.marks.update(<-w.markings, *flagInstance)...)
+	}
+	if w.ab != nil {
+		ts = append(ts, p.ab.update(w.abCfg, <-w.ab, *flagInstance)...)
+	}
+	if w.largeUDP != nil {
+		ts = append(ts, p.largeUDP.update(<-w.largeUDP, *flagInstance)...)
+	}
+	if w.fingerprints != nil {
+		ts = append(ts, p.fingerprints.update(<-w.fingerprints, *flagInstance)...)
+	}
+	if w.happyEyeballs != nil {
+		ts = append(ts, p.happyEyeballs.update(<-w.happyEyeballs, *flagInstance)...)
+	}
+	return ts
+}
+
+// updatePeers updates the targets of --targets-from-peers and --mesh-tag
+// from the status of the local tailscaled, returning the stale markers of
+// peers no longer probed. It starts measuring relay paths into w in full
+// windows.
+func (p *prober) updatePeers(ctx context.Context, w *windowMeasurements, full bool) []prompb.TimeSeries {
+	statusCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+	st, err := p.localClient.Status(statusCtx)
+	cancel()
+	if err != nil {
+		probeLog.Warn("error fetching tailscaled status, continuing with stale peers", "err", err)
+		return nil
+	}
+	if full && p.relayPaths != nil {
+		w.relayPaths = make(chan []relayPathResult, 1)
+		go func() {
+			w.relayPaths <- measureAllRelayPaths(ctx, &p.localClient, st)
+		}()
+	}
+	var staleMarkers []prompb.TimeSeries
+	var changed, meshChanged bool
+	if p.peers != nil {
+		staleMarkers, changed = p.peers.update(st, *flagInstance)
+	}
+	if p.mesh != nil {
+		var meshStaleMarkers []prompb.TimeSeries
+		meshStaleMarkers, meshChanged = p.mesh.update(st, *flagInstance)
+		staleMarkers = append(staleMarkers, meshStaleMarkers...)
+	}
+	if changed || meshChanged {
+		p.forgetAll(p.isTarget)
+	}
+	return staleMarkers
+}
+
+// windowTargets returns the targets of a window, their ports by address where
+// they differ from those of flags, and the stale markers of peers no longer
+// probed.
+func (p *prober) windowTargets(ctx context.Context, w *windowMeasurements, full bool) (targets map[netip.Addr]nodeMeta, portsByAddr map[netip.Addr]map[protocol][]int, peerStaleMarkers []prompb.TimeSeries) {
+	targets, portsByAddr = p.nodeMetaByAddr, p.cfg.portsByAddr(p.nodeMetaByAddr, p.portsByProtocol)
+	if *flagDERPSTUNPorts {
+		for addr, m := range p.nodeMetaByAddr {
+			if ports := p.portsFor(m); !maps.EqualFunc(ports, p.portsByProtocol, slices.Equal) {
+				portsByAddr[addr] = ports
+			}
+		}
+	}
+	if p.peers == nil && p.mesh == nil {
+		return targets, portsByAddr, nil
+	}
+	peerStaleMarkers = p.updatePeers(ctx, w, full)
+	var extraPorts map[netip.Addr]map[protocol][]int
+	if p.peers != nil {
+		targets, extraPorts = p.peers.merge(targets)
+		maps.Copy(portsByAddr, extraPorts)
+	}
+	if p.mesh != nil {
+		targets, extraPorts = p.mesh.merge(targets)
+		maps.Copy(portsByAddr, extraPorts)
+	}
+	events.setTargets(targets)
+	return targets, portsByAddr, peerStaleMarkers
+}
+
+// skipWindow reports whether the window starting at probeStart is sat out,
+// after resuming from suspend or as the standby of a redundant pair.
+func (p *prober) skipWindow(probeStart time.Time) bool {
+	if suspended := p.suspends.Check(probeStart); suspended > 0 {
+		// Stable conns' NAT mappings have likely expired, and the
+		// network may not be back yet. Mark the gap, re-establish stable
+		// conns on their local ports, and sit out this window rather than
+		// report its results as an outage.
+		probeLog.Warn("resumed from suspend or wall clock step, skipping window", "suspended", suspended.Round(time.Second))
+		events.record(suspendEvent(probeStart, suspended))
+		annotations.annotateAuto(probeStart.Add(-suspended), probeStart, "", "system suspended")
+		probeStates.retain(p.stableConns)
+		closeStableConns(p.stableConns, func(stableConnKey) bool { return true })
+		return true
+	}
+	if p.leader != nil && !p.leader.isLeader() {
+		if !p.standby {
+			// The NAT mappings of stable conns would be stale by the
+			// time of taking over.
+			probeLog.Info("standing by, not probing")
+			probeStates.retain(p.stableConns)
+			closeStableConns(p.stableConns, func(stableConnKey) bool { return true })
+			p.standby = true
+		}
+		p.outs.enqueue(outputBatch{ts: []prompb.TimeSeries{p.leader.toPromTimeSeries(*flagInstance, probeStart)}})
+		return true
+	}
+	if p.standby {
+		// Taking over is much like starting.
+		p.standby = false
+		p.warm.reset(*flagWarmUpWindows)
+	}
+	return false
+}
+
+// probeWindow probes the targets due in the window starting at windowStart,
+// and writes its results to outputs. It returns an error only if probing
+// failed unrecoverably.
+func (p *prober) probeWindow(windowStart time.Time) error {
+	probeStart := p.clock.Now()
+	if p.skipWindow(probeStart) {
+		return nil
+	}
+	// Window-level measurements, e.g. hop counts, and protocols probed at
+	// least every --interval only run in full windows, those starting every
+	// --interval.
+	full := p.intervals.full(windowStart, *flagInterval, p.tick)
+	// All probing in this window shares a deadline so that hung probes
+	// cannot delay the next window. Full windows may delay the ticks of
+	// shorter intervals.
+	windowInterval := p.tick
+	if full {
+		windowInterval = *flagInterval
+	}
+	windowCtx, windowCancel := context.WithDeadline(context.Background(), windowDeadline(windowStart, windowInterval))
+	defer windowCancel()
+	w := &windowMeasurements{}
+	if full {
+		p.startTargetless(windowCtx, w)
+	}
+	targets, portsByAddr, peerStaleMarkers := p.windowTargets(windowCtx, w, full)
+	p.targetStatuses.setTargets(targets)
+	targetPorts := func(m nodeMeta) map[protocol][]int {
+		if override, ok := portsByAddr[m.addr]; ok {
+			return override
+		}
+		return p.portsByProtocol
+	}
+	// Counters and group series outlive windows not probing them, e.g. as
+	// their protocol is not due, until their target or port is removed.
+	forgetTimeouts(p.timeouts, targets, targetPorts)
+	staleGroups := staleGroupKeys(p.groupKeysSeen, p.cfg.Groups, targets, targetPorts, *flagInstance, probeStart)
+	targets = p.scheduler.admit(targets, func(m nodeMeta) int {
+		n := 0
+		for _, ports := range targetPorts(m) {
+			n += len(ports)
+		}
+		return n
+	}, p.cfg.Scheduling, probeStart)
+	due := p.intervals.due(targets, func(m nodeMeta) []protocol {
+		return slices.Collect(maps.Keys(targetPorts(m)))
+	}, p.cfg, *flagInterval, p.tick, full, windowStart)
+	due = p.pruner.filter(due, p.cfg.Pruning, *flagInterval, full, windowStart)
+	due = p.budget.filter(due, targets, p.cfg.Scheduling, p.cfg.tick(*flagInterval))
+	p.lastTargets, p.lastPortsByAddr = targets, portsByAddr
+	if full {
+		p.startPerTarget(windowCtx, w, targets, portsByAddr)
+	}
+	if p.keepaliveEm != nil {
+		p.keepaliveEm.setTargets(targets, func(m nodeMeta) []int {
+			return targetPorts(m)[protocolSTUN]
+		})
+	}
+	var (
+		results []result
+		err     error
+	)
+	// Nothing is due e.g. when every target is demoted, or no protocol's
+	// interval elapsed.
+	if len(due) > 0 {
+		results, err = probeNodes(windowCtx, targets, p.stableConns, p.portsByProtocol, portsByAddr, func(addr netip.Addr, proto protocol) bool {
+			return due[intervalKey{addr, proto}]
+		}, p.cfg.Retry, p.cfg.HTTPSRequests)
+	}
+	if err != nil {
+		return err
+	}
+	// A signal pending after the window means it overlapped stopping.
+	phase := p.warm.next(len(p.sigCh) > 0)
+	ts := p.observeResults(results, phase, windowStart)
+	ts = append(ts, peerStaleMarkers...)
+	ts = append(ts, staleGroups...)
+	ts = append(ts, p.windowMeasurementsTimeSeries(w)...)
+	if p.calib.due(p.clock.Now()) {
+		p.calib.run(windowCtx, timestampProviders, *flagIPv6)
+	}
+	windowCancel()
+	now := p.clock.Now()
+	ts = append(ts, p.selfTimeSeries(phase, now)...)
+	health := newSelfHealth(windowStart, probeStart, now, len(results), p.outs, p.sb, p.lastRX)
+	p.lastRX = health.rx
+	ts = append(ts, health.toPromTimeSeries(*flagInstance, now)...)
+	events.persist(health.toEvent(now))
+	p.outs.enqueue(outputBatch{results: results, ts: ts})
+	p.ready.windowDone(now)
+	return nil
+}
+
+// observeResults marks the phase of the results of the window starting at
+// windowStart, feeds them to trackers, and returns the timeseries of both.
+func (p *prober) observeResults(results []result, phase lifecyclePhase, windowStart time.Time) []prompb.TimeSeries {
+	markPhase(results, phase)
+	aggregated := aggregatable(results)
+	p.baselines.add(results)
+	p.targetStatuses.observe(results)
+	if phase.inAggregates() {
+		p.consistency.observe(results, p.clock.Now())
+		p.portBlocks.observe(results, p.clock.Now())
+		p.home.update(results, p.lastDM, windowStart)
+		p.pruner.observe(results, p.cfg.Pruning, windowStart)
+		if p.snmp != nil {
+			p.snmp.update(results, p.clock.Now())
+		}
+	}
+	p.budget.observe(results)
+	probeStates.observe(results)
+	for _, ev := range p.instances.observe(results, p.clock.Now()) {
+		events.record(ev)
+		annotations.annotateAuto(ev.At, ev.At, ev.Hostname, instanceChangeText(ev))
+	}
+	if err := probeStates.save(p.stableConns); err != nil {
+		storeLog.Error("error saving probe state", "err", err)
+	}
+	ts := resultsToPromTimeSeries(results, *flagInstance, p.timeouts, *flagExemplars)
+	ts = append(ts, p.baselines.toPromTimeSeries(*flagInstance, p.clock.Now())...)
+	ts = append(ts, p.home.toPromTimeSeries(*flagInstance, p.clock.Now())...)
+	// Demoted targets are excluded from aggregates, which they would
+	// otherwise skew towards loss.
+	if grouped := p.pruner.exclude(aggregated); len(p.cfg.Groups) > 0 && len(grouped) > 0 {
+		ts = append(ts, groupsToPromTimeSeries(p.cfg.Groups, grouped, *flagInstance, grouped[0].at, p.groupKeysSeen)...)
+	}
+	if p.mesh != nil {
+		ts = append(ts, p.mesh.updateRTTs(results, *flagInstance)...)
+	}
+	if p.cfg.Scheduling != nil {
+		ts = append(ts, p.scheduler.toPromTimeSeries(*flagInstance, p.clock.Now()))
+		ts = append(ts, p.budget.toPromTimeSeries(*flagInstance, p.clock.Now())...)
+	}
+	if p.cfg.Pruning != nil {
+		ts = append(ts, p.pruner.toPromTimeSeries(*flagInstance, p.clock.Now()))
+	}
+	ts = append(ts, p.slos.update(aggregated, p.cfg.SLOs, *flagInstance, p.clock.Now())...)
+	if *flagECN {
+		ts = append(ts, p.ecns.update(results, ecnSent(), *flagInstance)...)
+	}
+	if p.keepaliveEm != nil {
+		ts = append(ts, p.keepalives.update(p.keepaliveEm.drain(), *flagInstance)...)
+	}
+	if *flagQualityScore && phase.inAggregates() {
+		ts = append(ts, p.quality.update(p.pruner.exclude(results), p.cfg.QualityScore, *flagInstance)...)
+	}
+	return ts
+}
+
+// selfTimeSeries returns the timeseries describing stunstamp itself at the
+// end of a window in phase, e.g. the state of its outputs.
+func (p *prober) selfTimeSeries(phase lifecyclePhase, now time.Time) []prompb.TimeSeries {
+	ts := annotations.toPromTimeSeries(p.annotationsExportedTo, now, *flagInstance)
+	p.annotationsExportedTo = now
+	if crossTalk, ok := crossTalkCount(); ok {
+		ts = append(ts, instanceTimeSeries(crossTalkMetricName, *flagInstance, p.clock.Now(), float64(crossTalk)))
+	}
+	ts = append(ts, p.outs.toPromTimeSeries(*flagInstance, now)...)
+	for _, s := range p.spools {
+		ts = append(ts, s.toPromTimeSeries(*flagInstance, now)...)
+	}
+	ts = append(ts, phase.toPromTimeSeries(*flagInstance, now))
+	if *flagFaultInjection {
+		ts = append(ts, faults.toPromTimeSeries(*flagInstance, now))
+	}
+	if p.leader != nil {
+		ts = append(ts, p.leader.toPromTimeSeries(*flagInstance, now))
+	}
+	ts = append(ts, p.calib.toPromTimeSeries(*flagInstance, now)...)
+	ts = append(ts, privilegesToPromTimeSeries(p.privs, *flagInstance, now)...)
+	return ts
+}
+
+// reloadConfig applies c, reloaded from --config.
+func (p *prober) reloadConfig(c *config) {
+	// Mark the series of deselected targets, removed target ports and
+	// groups stale. Deselected targets are marked with the ports of the
+	// previous config.
+	var staleMarkers []prompb.TimeSeries
+	if !c.Targets.equal(p.cfg.Targets) {
+		staleMeta, err := nodeMetaFromDERPMap(c.Targets.apply(p.lastDM), p.nodeMetaByAddr, *flagIPv6)
+		if err != nil {
+			probeLog.Warn("error selecting targets, continuing with previous targets", "err", err)
+		} else {
+			staleMarkers = p.derpStaleMarkers(staleMeta)
+			probeLog.Info("targets reselected", "targets", len(p.nodeMetaByAddr), "deselected", len(staleMeta))
+			events.setTargets(p.nodeMetaByAddr)
+			p.forgetAll(p.isTarget)
+		}
+	}
+	before := p.portsByDERPAddr()
+	p.cfg = c
+	p.warm.reset(*flagWarmUpWindows)
+	if t := p.cfg.tick(*flagInterval); t != p.tick {
+		probeLog.Info("probe interval changed", "from", p.tick, "to", t)
+		p.stopProbeTicker()
+		p.startProbeTicker(t)
+	}
+	staleMarkers = append(staleMarkers, p.removedPortsStaleMarkers(before)...)
+	now := p.clock.Now()
+	for k := range p.groupKeysSeen {
+		if !slices.ContainsFunc(p.cfg.Groups, func(g groupConfig) bool { return g.Name == k.group }) {
+			staleMarkers = append(staleMarkers, groupStaleMarkers(k, *flagInstance, now)...)
+			delete(p.groupKeysSeen, k)
+		}
+	}
+	if len(staleMarkers) > 0 {
+		p.outs.enqueue(outputBatch{ts: staleMarkers})
+	}
+}
+
+// updateDERPMap applies dm, a fetched DERP map.
+func (p *prober) updateDERPMap(dm *tailcfg.DERPMap) {
+	before, beforePorts, beforeSTUNPorts := maps.Clone(p.nodeMetaByAddr), p.portsByDERPAddr(), p.derpSTUNPortsByHost
+	staleMeta, err := nodeMetaFromDERPMap(p.cfg.Targets.apply(dm), p.nodeMetaByAddr, *flagIPv6)
+	if err != nil {
+		probeLog.Warn("error parsing DERP map, continuing with stale map", "err", err)
+		return
+	}
+	p.lastDM = dm
+	// Stale targets are marked with the ports they were probed with.
+	staleMarkers := p.derpStaleMarkers(staleMeta)
+	p.derpSTUNPortsByHost = derpSTUNPorts(dm)
+	for addr, m := range p.nodeMetaByAddr {
+		if before[addr] != m {
+			delete(beforePorts, addr) // new, or stale above
+		}
+	}
+	staleMarkers = append(staleMarkers, p.removedPortsStaleMarkers(beforePorts)...)
+	changes := derpMapChanges(before, p.nodeMetaByAddr, beforeSTUNPorts, p.derpSTUNPortsByHost, p.clock.Now())
+	for _, ev := range changes {
+		events.record(ev)
+		if text := derpMapChangeText(ev); text != "" {
+			annotations.annotateAuto(ev.At, ev.At, ev.Hostname, text)
+		}
+	}
+	p.publishDERPMapChanges(changes)
+	events.setTargets(p.nodeMetaByAddr)
+	p.forgetAll(p.isTarget)
+	if len(staleMeta) > 0 {
+		hostnames := make([]string, 0, len(staleMeta))
+		for _, m := range staleMeta {
+			hostnames = append(hostnames, m.hostname)
+		}
+		slices.Sort(hostnames)
+		now := p.clock.Now()
+		annotations.annotateAuto(now, now, "", "targets removed from DERP map: "+strings.Join(slices.Compact(hostnames), ", "))
+	}
+	if len(staleMarkers) > 0 {
+		p.outs.enqueue(outputBatch{ts: staleMarkers})
+	}
+}
+
+// publishDERPMapChanges sends changes to --derp-map-webhook-url, if set.
+func (p *prober) publishDERPMapChanges(changes []event) {
+	if len(changes) == 0 {
+		return
+	}
+	if p.derpMapSpool != nil {
+		body, err := json.Marshal(derpMapWebhookPayload{Instance: *flagInstance, Changes: changes})
+		if err == nil {
+			err = p.derpMapSpool.enqueue(body)
+		}
+		if err != nil {
+			probeLog.Error("error spooling DERP map changes", "err", err)
+		}
+		return
+	}
+	if len(*flagDERPMapWebhook) > 0 {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+			defer cancel()
+			if err := postDERPMapChanges(ctx, p.derpMapWebhookClient, *flagDERPMapWebhook, *flagInstance, changes); err != nil {
+				probeLog.Error("error posting DERP map changes", "err", err)
+			}
+		}()
+	}
+}
+
+// rebind re-establishes stable conns after local addresses changed.
+func (p *prober) rebind(c localAddrChange) {
+	// Stable conns established from a removed address would send from it
+	// until they time out. Re-establish them on their local ports in the
+	// next window.
+	probeLog.Warn("local addresses changed, rebinding stable conns", "added", c.added, "removed", c.removed, "stable_conns", len(p.stableConns))
+	events.record(rebindEvent(c, len(p.stableConns)))
+	annotations.annotateAuto(c.at, c.at, "", fmt.Sprintf("local addresses changed: removed %s, added %s", joinAddrs(c.removed), joinAddrs(c.added)))
+	probeStates.retain(p.stableConns)
+	closeStableConns(p.stableConns, func(stableConnKey) bool { return true })
+}
+
+// probeLinkChange starts probing all targets out of cycle after a link
+// change. Results are received on linkProbes.
+func (p *prober) probeLinkChange(c linkChange) {
+	// Capture the latency profile right after a failover rather than at
+	// the next window, with all targets and protocols of the last window.
+	// Flapping links are probed at most every minInterval.
+	events.record(c.event())
+	annotations.annotateAuto(c.at, c.at, "", "link changed: "+c.String())
+	now := p.clock.Now()
+	if p.lastTargets == nil || now.Sub(p.lastLinkProbe) < minInterval || p.standby || p.linkProbing {
+		probeLog.Info("link changed, not probing out of cycle", "changes", c.String())
+		return
+	}
+	p.lastLinkProbe = now
+	p.linkProbing = true
+	probeLog.Info("link changed, probing all targets out of cycle", "changes", c.String(), "targets", len(p.lastTargets))
+	// Windows keep probing while this runs. Stable conns belong to them, and
+	// their NAT mappings may not have survived the change anyway, so only
+	// fresh conns are probed over. Targets are copied, as DERP map updates
+	// modify them in place.
+	targets, portsByAddr := maps.Clone(p.lastTargets), maps.Clone(p.lastPortsByAddr)
+	retry, httpsRequests := p.cfg.Retry, p.cfg.HTTPSRequests
+	ctx, cancel := context.WithDeadline(context.Background(), windowDeadline(now, p.tick))
+	go func() {
+		defer cancel()
+		results, err := probeNodes(ctx, targets, nil, p.portsByProtocol, portsByAddr, nil, retry, httpsRequests)
+		p.linkProbes <- linkProbe{at: now, results: results, err: err}
+	}()
+}
+
+// linkProbeDone handles the outcome of a link change probe started by
+// probeLinkChange. Its results are phased, observed by trackers, and written
+// as those of windows are. It returns an error only if probing failed
+// unrecoverably.
+func (p *prober) linkProbeDone(lp linkProbe) error {
+	p.linkProbing = false
+	if lp.err != nil {
+		return lp.err
+	}
+	phase := p.warm.current(len(p.sigCh) > 0)
+	ts := p.observeResults(lp.results, phase, lp.at)
+	p.outs.enqueue(outputBatch{results: lp.results, ts: ts})
+	return nil
+}
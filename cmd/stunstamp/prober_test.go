@@ -0,0 +1,161 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"maps"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"tailscale.com/cmd/stunstamp/schedule"
+	"tailscale.com/net/stun/stuntest"
+	"tailscale.com/tstest"
+)
+
+// newTestProber returns a started prober reading time from clk, probing the
+// STUN server at port on localhost, and writing to the returned backend.
+func newTestProber(t *testing.T, clk *tstest.Clock, port int) (*prober, *fakeBackend) {
+	t.Helper()
+	p := &prober{
+		clock:           clk,
+		cfg:             &config{},
+		portsByProtocol: map[protocol][]int{protocolSTUN: {port}},
+		sigCh:           make(chan os.Signal, 1),
+	}
+	p.start()
+	t.Cleanup(p.close)
+	backend := &fakeBackend{unblock: make(chan struct{})}
+	close(backend.unblock)
+	p.outs = outputs{newOutputQueue(backend, 10)}
+	t.Cleanup(func() { p.outs.close(time.Second) })
+	m := nodeMeta{regionID: 1, regionCode: "local", hostname: "local", addr: netip.MustParseAddr("127.0.0.1")}
+	p.nodeMetaByAddr[m.addr] = m
+	p.suspends = schedule.NewSuspendDetector(clk.Now())
+	p.warm.reset(2)
+	return p, backend
+}
+
+// waitWritten waits for backend to have written n batches, returning the
+// last.
+func waitWritten(t *testing.T, backend *fakeBackend, n int) outputBatch {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for backend.numWritten() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("written %d batches, want %d", backend.numWritten(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	return backend.written[n-1]
+}
+
+func TestProberWindows(t *testing.T) {
+	stunAddr, cleanup := stuntest.Serve(t)
+	defer cleanup()
+	// Window deadlines are contexts, which expire by the real clock.
+	clk := tstest.NewClock(tstest.ClockOpts{Start: time.Now()})
+	p, backend := newTestProber(t, clk, stunAddr.Port)
+	p.startProbeTicker(*flagInterval)
+	defer p.stopProbeTicker()
+
+	if err := p.ready.check(clk.Now()); err == nil {
+		t.Error("ready before the first window")
+	}
+	for i, want := range []lifecyclePhase{phaseWarmUp, phaseWarmUp, phaseSteady} {
+		clk.Advance(*flagInterval)
+		var windowStart time.Time
+		select {
+		case windowStart = <-p.probeCh:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("window %d did not start", i)
+		}
+		if !windowStart.Equal(clk.Now()) {
+			t.Errorf("window %d started at %v, want %v", i, windowStart, clk.Now())
+		}
+		if err := p.probeWindow(windowStart); err != nil {
+			t.Fatal(err)
+		}
+		b := waitWritten(t, backend, i+1)
+		if len(b.results) == 0 {
+			t.Fatalf("window %d: no results", i)
+		}
+		for _, r := range b.results {
+			if r.phase != want {
+				t.Errorf("window %d: phase = %q, want %q", i, r.phase, want)
+			}
+			if r.rtt == nil {
+				t.Errorf("window %d: %v timed out", i, r.key)
+			}
+		}
+		if err := p.ready.check(clk.Now()); err != nil {
+			t.Errorf("window %d: not ready: %v", i, err)
+		}
+	}
+	// Readiness expires by the fake clock, without waiting.
+	clk.Advance(time.Hour)
+	if err := p.ready.check(clk.Now()); err == nil {
+		t.Error("ready an hour after the last window")
+	}
+}
+
+func TestProberLinkChange(t *testing.T) {
+	stunAddr, cleanup := stuntest.Serve(t)
+	defer cleanup()
+	clk := tstest.NewClock(tstest.ClockOpts{Start: time.Now()})
+	p, backend := newTestProber(t, clk, stunAddr.Port)
+	p.tick = *flagInterval
+
+	// Nothing is probed before the first window.
+	p.probeLinkChange(linkChange{at: clk.Now()})
+	if p.linkProbing {
+		t.Fatal("probing before the first window")
+	}
+	p.lastTargets = maps.Clone(p.nodeMetaByAddr)
+	for i, want := range []lifecyclePhase{phaseWarmUp, phaseSteady} {
+		if want == phaseSteady {
+			p.warm.reset(0)
+		}
+		p.probeLinkChange(linkChange{at: clk.Now()})
+		if !p.linkProbing {
+			t.Fatalf("link change %d not probed", i)
+		}
+		// Flapping links are probed at most every minInterval.
+		p.probeLinkChange(linkChange{at: clk.Now()})
+		var lp linkProbe
+		select {
+		case lp = <-p.linkProbes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("link change %d: probe did not complete", i)
+		}
+		if err := p.linkProbeDone(lp); err != nil {
+			t.Fatal(err)
+		}
+		b := waitWritten(t, backend, i+1)
+		if len(b.results) == 0 {
+			t.Fatalf("link change %d: no results", i)
+		}
+		for _, r := range b.results {
+			if r.key.connStability == stableConn {
+				t.Errorf("link change %d: probed over stable conn: %v", i, r.key)
+			}
+			// Link change probes don't consume warm-up windows.
+			if r.phase != want {
+				t.Errorf("link change %d: phase = %q, want %q", i, r.phase, want)
+			}
+		}
+		if updated := len(p.baselines.current) > 0; updated != want.inAggregates() {
+			t.Errorf("link change %d: baselines updated = %v in phase %q", i, updated, want)
+		}
+		select {
+		case <-p.linkProbes:
+			t.Fatalf("link change %d: flapping link probed twice", i)
+		default:
+		}
+		clk.Advance(minInterval)
+	}
+}
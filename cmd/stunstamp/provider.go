@@ -0,0 +1,125 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net"
+	"net/netip"
+)
+
+// timestampProvider creates conns for, and measures RTTs with, timestamps
+// from a single timestampSource. Platform-specific timestamping lives behind
+// this interface, keeping the probing engine OS-independent; each platform
+// supplies its providers via platformTimestampProviders.
+type timestampProvider interface {
+	// source returns the timestampSource of the provider's measurements.
+	source() timestampSource
+	// supports reports whether the provider can measure protocol p over a
+	// stable or unstable conn.
+	supports(p protocol, stable connStability) bool
+	// newConn returns a conn and measureFn for probing forDst with p. A
+	// nonzero lport is the local port (or ICMP identifier) to bind a stable
+	// conn to.
+	newConn(forDst netip.Addr, p protocol, stable connStability, lport int) (*connAndMeasureFn, error)
+}
+
+// timestampProviders holds the timestampProviders of this platform indexed by
+// timestampSource, with nil for unsupported sources. The raw source is
+// provided by activeRawProber instead, as it is opt-in and shares a single
+// socket across targets.
+var timestampProviders = platformTimestampProviders()
+
+// userspaceProvider measures RTTs with timestamps taken in userspace around
+// socket reads and writes. It is available on all platforms, though whether
+// unprivileged ICMP sockets are is detected at runtime, see
+// detectCapabilities.
+type userspaceProvider struct{}
+
+func (userspaceProvider) source() timestampSource { return timestampSourceUserspace }
+
+func (userspaceProvider) supports(p protocol, stable connStability) bool {
+	switch p {
+	case protocolSTUN, protocolHTTPS, protocolTWAMP, protocolDERP, protocolDERPWebSocket, protocolDERPWebSocketUpgrade:
+		return true
+	case protocolICMP:
+		return !bool(stable)
+	}
+	return false
+}
+
+func (userspaceProvider) newConn(forDst netip.Addr, p protocol, stable connStability, lport int) (*connAndMeasureFn, error) {
+	switch p {
+	case protocolSTUN:
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: lport})
+		if err != nil {
+			return nil, err
+		}
+		return &connAndMeasureFn{
+			conn: conn,
+			fn:   measureSTUNRTT,
+		}, nil
+	case protocolICMP:
+		conn, err := getICMPConn(forDst, timestampSourceUserspace, lport)
+		if err != nil {
+			return nil, err
+		}
+		return &connAndMeasureFn{
+			conn: conn,
+			fn:   mkICMPMeasureFn(timestampSourceUserspace),
+		}, nil
+	case protocolHTTPS:
+		return newLportConnAndMeasureFn(stable, lport, measureHTTPSRTT), nil
+	case protocolTWAMP:
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: lport})
+		if err != nil {
+			return nil, err
+		}
+		return &connAndMeasureFn{
+			conn: &twampConn{UDPConn: conn},
+			fn:   measureTWAMPRTT,
+		}, nil
+	case protocolDERP:
+		return newDERPConnAndMeasureFn(stable, lport), nil
+	case protocolDERPWebSocket:
+		return newDERPWebSocketConnAndMeasureFn(stable, lport), nil
+	case protocolDERPWebSocketUpgrade:
+		return newLportConnAndMeasureFn(stable, lport, measureDERPWebSocketUpgradeRTT), nil
+	}
+	return nil, nil
+}
+
+// newLportConnAndMeasureFn returns a connAndMeasureFn for a TCP-based
+// protocol measured by fn, holding a local port from the lports pool for
+// stable conns, preferring lport if nonzero.
+func newLportConnAndMeasureFn(stable connStability, lport int, fn measureFn) *connAndMeasureFn {
+	localPort := 0
+	if stable && lport != 0 {
+		localPort = lports.take(lport)
+	} else if stable {
+		localPort = lports.get()
+	}
+	conn := lportForTCPConn(localPort)
+	return &connAndMeasureFn{
+		conn: &conn,
+		fn:   fn,
+	}
+}
+
+// tcpInfoProvider measures TCP RTTs as estimated by the kernel, see
+// measureTCPRTT. It is the only kernel timestamp source on platforms without
+// SO_TIMESTAMPING.
+type tcpInfoProvider struct{}
+
+func (tcpInfoProvider) source() timestampSource { return timestampSourceKernel }
+
+func (tcpInfoProvider) supports(p protocol, _ connStability) bool {
+	return p == protocolTCP
+}
+
+func (tcpInfoProvider) newConn(_ netip.Addr, p protocol, stable connStability, lport int) (*connAndMeasureFn, error) {
+	if p != protocolTCP {
+		return nil, nil
+	}
+	return newLportConnAndMeasureFn(stable, lport, measureTCPRTT), nil
+}
@@ -0,0 +1,43 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestTimestampProviders(t *testing.T) {
+	for i, tp := range timestampProviders {
+		if tp != nil && tp.source() != timestampSource(i) {
+			t.Errorf("provider at index %d has source %v", i, tp.source())
+		}
+	}
+	dst := netip.MustParseAddr("127.0.0.1")
+	for _, source := range []timestampSource{timestampSourceUserspace, timestampSourceKernel} {
+		for _, p := range allProtocols {
+			for _, stable := range []connStability{unstableConn, stableConn} {
+				tp := timestampProviders[source]
+				cf, err := newConnAndMeasureFn(dst, source, p, stable, 0)
+				if err != nil {
+					// e.g. ICMP sockets are not permitted
+					t.Logf("%v %v stable=%v: %v", source, p, stable, err)
+					continue
+				}
+				if supported := tp != nil && tp.supports(p, stable); supported != (cf != nil) {
+					t.Errorf("%v %v stable=%v: supports() = %v, but got conn %v", source, p, stable, supported, cf != nil)
+				}
+				if cf != nil {
+					cf.conn.Close()
+				}
+			}
+		}
+	}
+	if tp := timestampProviders[timestampSourceUserspace]; tp == nil || tp.supports(protocolTCP, stableConn) {
+		t.Error("userspace timestamps unexpectedly support TCP")
+	}
+	if cf, err := newConnAndMeasureFn(dst, timestampSourceRaw, protocolSTUN, stableConn, 0); cf != nil || err != nil {
+		t.Errorf("raw timestamps unexpectedly provided by timestampProviders: %v, %v", cf, err)
+	}
+}
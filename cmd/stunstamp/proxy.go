@@ -0,0 +1,377 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"tailscale.com/net/stun"
+)
+
+// probeProxy is a SOCKS5 or HTTP CONNECT proxy through which targets are
+// additionally probed, in order to isolate the latency contributed by e.g. a
+// carrier-mandated proxy. Results of proxied probes carry the proxy's
+// host:port in resultKey.proxy.
+type probeProxy struct {
+	u *url.URL
+}
+
+// activeProxy is the proxy set via --proxy, or nil. It is set once at
+// startup.
+var activeProxy *probeProxy
+
+func parseProbeProxy(s string) (*probeProxy, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, want socks5 or http", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("proxy URL must include a port: %w", err)
+	}
+	return &probeProxy{u: u}, nil
+}
+
+// name returns the value of the proxy label for results of probes via p.
+func (p *probeProxy) name() string {
+	return p.u.Host
+}
+
+// supports reports whether targets may be probed with protocol via p.
+func (p *probeProxy) supports(proto protocol) bool {
+	switch proto {
+	case protocolHTTPS, protocolTCP:
+		return true
+	case protocolSTUN:
+		return p.u.Scheme == "socks5"
+	}
+	return false
+}
+
+// proxiedConn is held by the connAndMeasureFn of a proxied probe. Proxied
+// probes dial on demand, so it holds nothing.
+type proxiedConn struct{}
+
+func (proxiedConn) Read([]byte) (int, error)  { return 0, errors.New("unimplemented") }
+func (proxiedConn) Write([]byte) (int, error) { return 0, errors.New("unimplemented") }
+func (proxiedConn) Close() error              { return nil }
+
+// newProxiedConnAndMeasureFn returns a connAndMeasureFn measuring proto via
+// p. Only userspace timestamps are supported.
+func newProxiedConnAndMeasureFn(p *probeProxy, proto protocol) *connAndMeasureFn {
+	cf := &connAndMeasureFn{conn: proxiedConn{}}
+	switch proto {
+	case protocolTCP:
+		cf.fn = p.measureTCPRTT
+	case protocolHTTPS:
+		cf.fn = p.measureHTTPSRTT
+	case protocolSTUN:
+		cf.fn = p.measureSTUNRTT
+	}
+	return cf
+}
+
+// measureTCPRTT returns the time taken by the proxy to respond to a connect
+// request for dst, which spans the proxy's TCP handshake with dst.
+func (p *probeProxy) measureTCPRTT(ctx context.Context, _ io.ReadWriteCloser, _ string, dst netip.AddrPort) (measurement, error) {
+	conn, connectRTT, err := p.dial(ctx, dst)
+	if err != nil {
+		return measurement{}, tempError{err}
+	}
+	conn.Close()
+	return measurement{rtt: connectRTT}, nil
+}
+
+// measureHTTPSRTT is measureHTTPSRTT through the proxy.
+func (p *probeProxy) measureHTTPSRTT(ctx context.Context, _ io.ReadWriteCloser, hostname string, dst netip.AddrPort) (measurement, error) {
+	return measureHTTPS(ctx, hostname, dst, func(ctx context.Context) (net.Conn, error) {
+		conn, _, err := p.dial(ctx, dst)
+		return conn, err
+	})
+}
+
+// measureSTUNRTT measures STUN RTT to dst through a SOCKS5 UDP association.
+func (p *probeProxy) measureSTUNRTT(ctx context.Context, _ io.ReadWriteCloser, _ string, dst netip.AddrPort) (measurement, error) {
+	ctl, relay, err := p.udpAssociate(ctx)
+	if err != nil {
+		return measurement{}, tempError{err}
+	}
+	defer ctl.Close()
+	uconn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(relay))
+	if err != nil {
+		return measurement{}, tempError{err}
+	}
+	defer uconn.Close()
+	if err := uconn.SetDeadline(deadlineWithin(ctx, txRxTimeout)); err != nil {
+		return measurement{}, fmt.Errorf("error setting deadline: %w", err)
+	}
+	txID := stun.NewTxID()
+	hdr := append([]byte{0, 0, 0}, socksAddr(dst)...)
+	txAt := time.Now()
+	if _, err := uconn.Write(append(hdr, stun.Request(txID)...)); err != nil {
+		return measurement{}, fmt.Errorf("error writing to udp socket: %w", err)
+	}
+	b := make([]byte, 1460)
+	for {
+		n, err := uconn.Read(b)
+		rxAt := time.Now()
+		if err != nil {
+			return measurement{}, fmt.Errorf("error reading from udp socket: %w", err)
+		}
+		// The relay prepends a header addressed from dst.
+		hdrLen, ok := socksUDPHeaderLen(b[:n])
+		if !ok {
+			continue
+		}
+		gotTxID, _, err := stun.ParseResponse(b[hdrLen:n])
+		if err != nil || gotTxID != txID {
+			continue
+		}
+		return measurement{rtt: rxAt.Sub(txAt), instance: stunResponseInstance(b[hdrLen:n]), stunResponse: sampledSTUNResponse(ctx, b[hdrLen:n])}, nil
+	}
+}
+
+// dial connects to dst through the proxy, returning the tunneled conn and
+// the time between sending the connect request and receiving a successful
+// response.
+func (p *probeProxy) dial(ctx context.Context, dst netip.AddrPort) (_ net.Conn, connectRTT time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.u.Host)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+	// Bound the handshake with the proxy, but not the tunneled conn.
+	conn.SetDeadline(deadlineWithin(ctx, 5*time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if p.u.Scheme == "http" {
+		connectRTT, err = p.httpConnect(conn, dst)
+		return conn, connectRTT, err
+	}
+	if err := p.socksHandshake(conn); err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	if _, err := p.socksRequest(conn, socksCmdConnect, dst); err != nil {
+		return nil, 0, err
+	}
+	return conn, time.Since(start), nil
+}
+
+func (p *probeProxy) httpConnect(conn net.Conn, dst netip.AddrPort) (time.Duration, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: dst.String()},
+		Host:   dst.String(),
+		Header: make(http.Header),
+	}
+	if u := p.u.User; u != nil {
+		pass, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pass)))
+	}
+	start := time.Now()
+	if err := req.Write(conn); err != nil {
+		return 0, err
+	}
+	// The proxy sends nothing after the response headers until we do, so
+	// the bufio.Reader cannot consume tunneled bytes.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return 0, fmt.Errorf("proxy CONNECT failed: %s", resp.Status)
+	}
+	return time.Since(start), nil
+}
+
+// udpAssociate establishes a SOCKS5 UDP association, returning the control
+// conn, which must be held open for the lifetime of the association, and
+// the relay address.
+func (p *probeProxy) udpAssociate(ctx context.Context) (_ net.Conn, relay netip.AddrPort, err error) {
+	var d net.Dialer
+	ctl, err := d.DialContext(ctx, "tcp", p.u.Host)
+	if err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+	defer func() {
+		if err != nil {
+			ctl.Close()
+		}
+	}()
+	ctl.SetDeadline(deadlineWithin(ctx, 5*time.Second))
+	if err := p.socksHandshake(ctl); err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+	relay, err = p.socksRequest(ctl, socksCmdUDPAssociate, netip.AddrPortFrom(netip.IPv4Unspecified(), 0))
+	if err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+	if relay.Addr().IsUnspecified() {
+		// The relay is on the proxy host.
+		proxyAddr, err := netip.ParseAddrPort(ctl.RemoteAddr().String())
+		if err != nil {
+			return nil, netip.AddrPort{}, err
+		}
+		relay = netip.AddrPortFrom(proxyAddr.Addr(), relay.Port())
+	}
+	return ctl, relay, nil
+}
+
+const (
+	socksVersion         = 5
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+	socksAuthNone        = 0
+	socksAuthPassword    = 2
+	socksAtypIPv4        = 1
+	socksAtypDomain      = 3
+	socksAtypIPv6        = 4
+)
+
+// socksHandshake performs SOCKS5 method negotiation and, if the proxy URL
+// holds credentials, username/password authentication (RFC 1929).
+func (p *probeProxy) socksHandshake(conn net.Conn) error {
+	method := byte(socksAuthNone)
+	if p.u.User != nil {
+		method = socksAuthPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != socksVersion || resp[1] != method {
+		return fmt.Errorf("socks5 proxy rejected auth method %d", method)
+	}
+	if method == socksAuthNone {
+		return nil
+	}
+	user := p.u.User.Username()
+	pass, _ := p.u.User.Password()
+	b := []byte{1, byte(len(user))}
+	b = append(b, user...)
+	b = append(b, byte(len(pass)))
+	b = append(b, pass...)
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[1] != 0 {
+		return errors.New("socks5 proxy authentication failed")
+	}
+	return nil
+}
+
+// socksRequest sends a SOCKS5 request and returns the bound address from a
+// successful reply.
+func (p *probeProxy) socksRequest(conn net.Conn, cmd byte, dst netip.AddrPort) (netip.AddrPort, error) {
+	req := append([]byte{socksVersion, cmd, 0}, socksAddr(dst)...)
+	if _, err := conn.Write(req); err != nil {
+		return netip.AddrPort{}, err
+	}
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if hdr[0] != socksVersion {
+		return netip.AddrPort{}, fmt.Errorf("unexpected socks version %d", hdr[0])
+	}
+	if hdr[1] != 0 {
+		return netip.AddrPort{}, fmt.Errorf("socks5 request failed with reply code %d", hdr[1])
+	}
+	var addr netip.Addr
+	switch hdr[3] {
+	case socksAtypIPv4:
+		var b [4]byte
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return netip.AddrPort{}, err
+		}
+		addr = netip.AddrFrom4(b)
+	case socksAtypIPv6:
+		var b [16]byte
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return netip.AddrPort{}, err
+		}
+		addr = netip.AddrFrom16(b)
+	case socksAtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return netip.AddrPort{}, err
+		}
+		// We have no use for a bound domain name.
+		if _, err := io.CopyN(io.Discard, conn, int64(l[0])); err != nil {
+			return netip.AddrPort{}, err
+		}
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unexpected socks address type %d", hdr[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(port[:])), nil
+}
+
+// socksUDPHeaderLen returns the length of the SOCKS5 UDP request header
+// (RFC 1928 section 7) at the start of b. It returns false for malformed or
+// fragmented datagrams.
+func socksUDPHeaderLen(b []byte) (int, bool) {
+	if len(b) < 4 || b[2] != 0 {
+		return 0, false
+	}
+	var n int
+	switch b[3] {
+	case socksAtypIPv4:
+		n = 4 + 4 + 2
+	case socksAtypIPv6:
+		n = 4 + 16 + 2
+	case socksAtypDomain:
+		if len(b) < 5 {
+			return 0, false
+		}
+		n = 4 + 1 + int(b[4]) + 2
+	default:
+		return 0, false
+	}
+	return n, len(b) >= n
+}
+
+// socksAddr returns the SOCKS5 wire encoding of ap.
+func socksAddr(ap netip.AddrPort) []byte {
+	var b []byte
+	if ap.Addr().Is4() {
+		b = append(b, socksAtypIPv4)
+	} else {
+		b = append(b, socksAtypIPv6)
+	}
+	b = append(b, ap.Addr().AsSlice()...)
+	return binary.BigEndian.AppendUint16(b, ap.Port())
+}
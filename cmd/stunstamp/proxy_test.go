@@ -0,0 +1,125 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/net/socks5"
+	"tailscale.com/net/stun/stuntest"
+)
+
+func TestProbeProxy(t *testing.T) {
+	// A TCP target for CONNECT.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	targetAddr := netip.MustParseAddrPort(target.Addr().String())
+
+	socksLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socksLn.Close()
+	go (&socks5.Server{Logf: func(string, ...any) {}, Username: "u", Password: "p"}).Serve(socksLn)
+
+	httpProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, upstream)
+	}))
+	defer httpProxy.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, u := range []string{
+		"socks5://u:p@" + socksLn.Addr().String(),
+		"http://" + strings.TrimPrefix(httpProxy.URL, "http://"),
+	} {
+		p, err := parseProbeProxy(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cf := newProxiedConnAndMeasureFn(p, protocolTCP)
+		m, err := cf.fn(ctx, cf.conn, "", targetAddr)
+		if err != nil {
+			t.Errorf("%s: TCP via proxy: %v", u, err)
+		} else if m.rtt <= 0 {
+			t.Errorf("%s: TCP via proxy: got rtt %v", u, m.rtt)
+		}
+	}
+
+	p, err := parseProbeProxy("socks5://u:bad@" + socksLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.measureTCPRTT(ctx, nil, "", targetAddr); err == nil {
+		t.Error("unexpected success with bad credentials")
+	}
+
+	stunAddr, cleanup := stuntest.Serve(t)
+	defer cleanup()
+	p, err = parseProbeProxy("socks5://u:p@" + socksLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.supports(protocolSTUN) {
+		t.Fatal("socks5 proxy does not support STUN")
+	}
+	m, err := p.measureSTUNRTT(ctx, nil, "", netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(stunAddr.Port)))
+	if err != nil {
+		t.Fatalf("STUN via proxy: %v", err)
+	}
+	if m.rtt <= 0 {
+		t.Errorf("STUN via proxy: got rtt %v", m.rtt)
+	}
+}
+
+func TestParseProbeProxy(t *testing.T) {
+	for _, bad := range []string{"https://proxy:443", "socks5://proxy", "://"} {
+		if _, err := parseProbeProxy(bad); err == nil {
+			t.Errorf("parseProbeProxy(%q) unexpectedly succeeded", bad)
+		}
+	}
+	p, err := parseProbeProxy("http://proxy.example:3128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.name() != "proxy.example:3128" || p.supports(protocolSTUN) || !p.supports(protocolHTTPS) {
+		t.Errorf("unexpected proxy: %v %v", p.name(), p.supports(protocolSTUN))
+	}
+}
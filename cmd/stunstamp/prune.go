@@ -0,0 +1,275 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const demotedTargetsMetricName = "stunstamp_demoted_targets"
+
+// eventKindTargetDemoted is a change in whether a target is demoted to
+// rediscovery probing for having been unreachable.
+const eventKindTargetDemoted eventKind = "target_demoted"
+
+// defaultRediscoveryInterval is the default pruningConfig.RediscoveryInterval.
+const defaultRediscoveryInterval = 15 * time.Minute
+
+// pruningConfig configures the demotion of targets unreachable by every
+// protocol, e.g. decommissioned DERP nodes still in the DERP map, to slow
+// rediscovery probing, so that they neither cost full-rate probes nor count
+// towards loss aggregates. A demoted target is restored to its intervals as
+// soon as a probe of it succeeds.
+type pruningConfig struct {
+	// After is how long a target must be unreachable by every protocol to be
+	// demoted, in time.ParseDuration format, e.g. "1h".
+	After string
+	// RediscoveryInterval is the interval demoted targets are probed at, in
+	// time.ParseDuration format. It defaults to 15m.
+	RediscoveryInterval string `json:",omitempty"`
+}
+
+func (c *pruningConfig) validate() error {
+	if c.After == "" {
+		return errors.New("After is required")
+	}
+	after, err := time.ParseDuration(c.After)
+	if err != nil {
+		return fmt.Errorf("After: %w", err)
+	}
+	if after < minInterval {
+		return fmt.Errorf("After must be >= %s", minInterval)
+	}
+	if c.RediscoveryInterval != "" {
+		d, err := time.ParseDuration(c.RediscoveryInterval)
+		if err != nil {
+			return fmt.Errorf("RediscoveryInterval: %w", err)
+		}
+		if d < minInterval {
+			return fmt.Errorf("RediscoveryInterval must be >= %s", minInterval)
+		}
+	}
+	return nil
+}
+
+// durations returns the validated After and RediscoveryInterval of c.
+func (c *pruningConfig) durations() (after, rediscovery time.Duration) {
+	after, _ = time.ParseDuration(c.After)
+	rediscovery = defaultRediscoveryInterval
+	if c.RediscoveryInterval != "" {
+		rediscovery, _ = time.ParseDuration(c.RediscoveryInterval)
+	}
+	return after, rediscovery
+}
+
+// targetPruner demotes targets unreachable for pruningConfig.After to
+// rediscovery probing. It is safe for concurrent use.
+type targetPruner struct {
+	mu sync.Mutex
+	// unreachableSince holds the start of the first window of the current
+	// run of windows in which no probe of a target succeeded.
+	unreachableSince map[nodeMeta]time.Time
+	// demoted holds the start of the window demoted targets were last
+	// probed in.
+	demoted map[nodeMeta]time.Time
+}
+
+func newTargetPruner() *targetPruner {
+	return &targetPruner{
+		unreachableSince: make(map[nodeMeta]time.Time),
+		demoted:          make(map[nodeMeta]time.Time),
+	}
+}
+
+// filter returns due without the protocols of demoted targets, except in the
+// full windows in which their rediscovery interval has elapsed. c may be nil
+// if pruning is disabled. def is --interval, see intervalScheduler.
+func (p *targetPruner) filter(due map[intervalKey]bool, c *pruningConfig, def time.Duration, full bool, at time.Time) map[intervalKey]bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c == nil || len(p.demoted) == 0 {
+		return due
+	}
+	_, rediscovery := c.durations()
+	skip := make(map[netip.Addr]bool)
+	for meta, last := range p.demoted {
+		if full && intervalElapsed(last, at, rediscovery, def) {
+			p.demoted[meta] = at
+			continue
+		}
+		skip[meta.addr] = true
+	}
+	ret := make(map[intervalKey]bool, len(due))
+	for k := range due {
+		if !skip[k.addr] {
+			ret[k] = true
+		}
+	}
+	return ret
+}
+
+// observe accounts the results of the window starting at, demoting targets
+// unreachable for c.After and restoring demoted targets that were reached,
+// recording an event for either. c may be nil if pruning is disabled, which
+// restores all demoted targets.
+func (p *targetPruner) observe(results []result, c *pruningConfig, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c == nil {
+		for meta := range p.demoted {
+			p.restore(meta, at, "pruning disabled")
+		}
+		clear(p.unreachableSince)
+		return
+	}
+	after, rediscovery := c.durations()
+	reachable := make(map[nodeMeta]bool)
+	for _, r := range results {
+		reachable[r.key.meta] = reachable[r.key.meta] || r.rtt != nil
+	}
+	for meta, ok := range reachable {
+		if ok {
+			delete(p.unreachableSince, meta)
+			if _, demoted := p.demoted[meta]; demoted {
+				p.restore(meta, at, "reachable")
+			}
+			continue
+		}
+		since, seen := p.unreachableSince[meta]
+		if !seen {
+			since = at
+			p.unreachableSince[meta] = at
+		}
+		if _, demoted := p.demoted[meta]; demoted || at.Sub(since) < after {
+			continue
+		}
+		p.demoted[meta] = at
+		probeLog.Warn("demoting unreachable target to rediscovery probing", "hostname", meta.hostname, "addr", meta.addr, "unreachable_for", at.Sub(since), "rediscovery_interval", rediscovery)
+		events.record(p.event(meta, at, map[string]string{
+			"state":                "demoted",
+			"unreachable_since":    since.Format(time.RFC3339),
+			"rediscovery_interval": rediscovery.String(),
+		}))
+		annotations.annotateAuto(at, at, meta.hostname, fmt.Sprintf("demoted to rediscovery probing every %v, unreachable since %s", rediscovery, since.Format(time.RFC3339)))
+	}
+}
+
+// restore stops demoting meta. p.mu must be held.
+func (p *targetPruner) restore(meta nodeMeta, at time.Time, reason string) {
+	delete(p.demoted, meta)
+	probeLog.Info("restoring demoted target", "hostname", meta.hostname, "addr", meta.addr, "reason", reason)
+	events.record(p.event(meta, at, map[string]string{"state": "restored", "reason": reason}))
+}
+
+func (p *targetPruner) event(meta nodeMeta, at time.Time, attrs map[string]string) event {
+	return event{
+		At:         at,
+		Kind:       eventKindTargetDemoted,
+		Addr:       meta.addr,
+		RegionID:   meta.regionID,
+		RegionCode: meta.regionCode,
+		Hostname:   meta.hostname,
+		Attrs:      attrs,
+	}
+}
+
+// exclude returns results without those of demoted targets, for aggregates
+// that unreachable targets would skew, e.g. the loss of groups.
+func (p *targetPruner) exclude(results []result) []result {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.demoted) == 0 {
+		return results
+	}
+	ret := make([]result, 0, len(results))
+	for _, r := range results {
+		if _, ok := p.demoted[r.key.meta]; !ok {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// forget drops the unreachability and demotion of targets for which keep
+// returns false, so that a target re-added starts afresh.
+func (p *targetPruner) forget(keep func(resultKey) bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for meta := range p.unreachableSince {
+		if !keep(resultKey{meta: meta}) {
+			delete(p.unreachableSince, meta)
+		}
+	}
+	for meta := range p.demoted {
+		if !keep(resultKey{meta: meta}) {
+			delete(p.demoted, meta)
+		}
+	}
+}
+
+// prunedTargetState is the persisted state of a target that is unreachable
+// or demoted, see probeState. Either time is zero if not applicable.
+type prunedTargetState struct {
+	nodeMetaState
+	UnreachableSince time.Time
+	Demoted          time.Time
+}
+
+// state returns the state of every target unreachable or demoted, sorted for
+// stable output.
+func (p *targetPruner) state() []prunedTargetState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	byMeta := make(map[nodeMeta]*prunedTargetState)
+	get := func(meta nodeMeta) *prunedTargetState {
+		if byMeta[meta] == nil {
+			byMeta[meta] = &prunedTargetState{nodeMetaState: nodeMetaStateOf(meta)}
+		}
+		return byMeta[meta]
+	}
+	for meta, since := range p.unreachableSince {
+		get(meta).UnreachableSince = since
+	}
+	for meta, last := range p.demoted {
+		get(meta).Demoted = last
+	}
+	ret := make([]prunedTargetState, 0, len(byMeta))
+	for _, st := range byMeta {
+		ret = append(ret, *st)
+	}
+	slices.SortFunc(ret, func(a, b prunedTargetState) int {
+		return cmp.Or(a.Addr.Compare(b.Addr), cmp.Compare(a.Hostname, b.Hostname))
+	})
+	return ret
+}
+
+// restoreState restores the state returned by state before a restart.
+func (p *targetPruner) restoreState(st []prunedTargetState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, ps := range st {
+		meta := ps.meta()
+		if !ps.UnreachableSince.IsZero() {
+			p.unreachableSince[meta] = ps.UnreachableSince
+		}
+		if !ps.Demoted.IsZero() {
+			p.demoted[meta] = ps.Demoted
+		}
+	}
+}
+
+// toPromTimeSeries returns the number of demoted targets.
+func (p *targetPruner) toPromTimeSeries(instance string, at time.Time) prompb.TimeSeries {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return instanceTimeSeries(demotedTargetsMetricName, instance, at, float64(len(p.demoted)))
+}
@@ -0,0 +1,141 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruningConfig(t *testing.T) {
+	for _, tt := range []struct {
+		raw     string
+		wantErr string
+	}{
+		{raw: `{"Pruning": {"After": "1h"}}`},
+		{raw: `{"Pruning": {"After": "1h", "RediscoveryInterval": "30m"}}`},
+		{raw: `{"Pruning": {}}`, wantErr: "After is required"},
+		{raw: `{"Pruning": {"After": "1s"}}`, wantErr: "After must be"},
+		{raw: `{"Pruning": {"After": "1h", "RediscoveryInterval": "soon"}}`, wantErr: "invalid duration"},
+	} {
+		_, err := parseConfig([]byte(tt.raw))
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("parseConfig(%s) = %v", tt.raw, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("parseConfig(%s) = %v, want error containing %q", tt.raw, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTargetPruner(t *testing.T) {
+	dead := nodeMeta{regionID: 1, hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	live := nodeMeta{regionID: 1, hostname: "1b", addr: netip.MustParseAddr("192.0.2.2")}
+	countEvents := func(state string) int {
+		n := 0
+		for _, ev := range events.recentEvents() {
+			if ev.Kind == eventKindTargetDemoted && ev.Addr == dead.addr && ev.Attrs["state"] == state {
+				n++
+			}
+		}
+		return n
+	}
+	demotedBefore, restoredBefore := countEvents("demoted"), countEvents("restored")
+
+	c := &pruningConfig{After: "5m", RediscoveryInterval: "10m"}
+	const interval = time.Minute
+	rtt := 10 * time.Millisecond
+	window := func(deadRTT *time.Duration) []result {
+		return []result{
+			{key: resultKey{meta: dead, protocol: protocolSTUN}, rtt: deadRTT},
+			{key: resultKey{meta: dead, protocol: protocolICMP}},
+			{key: resultKey{meta: live, protocol: protocolSTUN}, rtt: &rtt},
+		}
+	}
+	due := map[intervalKey]bool{
+		{dead.addr, protocolSTUN}: true,
+		{dead.addr, protocolICMP}: true,
+		{live.addr, protocolSTUN}: true,
+	}
+
+	p := newTargetPruner()
+	start := time.Unix(1700000000, 0)
+	probed := 0
+	for i := range 30 {
+		at := start.Add(time.Duration(i) * interval)
+		if p.filter(due, c, interval, true, at)[intervalKey{dead.addr, protocolSTUN}] {
+			probed++
+			p.observe(window(nil), c, at)
+		}
+	}
+	// Probed every window until demoted after 5m, then every 10m.
+	if probed != 8 {
+		t.Errorf("dead target probed in %d windows, want 8", probed)
+	}
+	if got := countEvents("demoted") - demotedBefore; got != 1 {
+		t.Errorf("got %d demoted events, want 1", got)
+	}
+	if got := p.exclude(window(nil)); len(got) != 1 || got[0].key.meta != live {
+		t.Errorf("exclude = %+v, want results of live target only", got)
+	}
+	if got := p.filter(due, c, interval, false, start.Add(time.Hour)); len(got) != 1 {
+		t.Errorf("filter of window not full = %v, want live target only", got)
+	}
+
+	p.observe(window(&rtt), c, start.Add(time.Hour))
+	if got := countEvents("restored") - restoredBefore; got != 1 {
+		t.Errorf("got %d restored events, want 1", got)
+	}
+	if got := p.filter(due, c, interval, false, start.Add(time.Hour+interval)); len(got) != len(due) {
+		t.Errorf("filter after restore = %v, want all due", got)
+	}
+
+	p.observe(window(nil), c, start)
+	p.forget(func(resultKey) bool { return false })
+	if len(p.unreachableSince) != 0 || len(p.demoted) != 0 {
+		t.Errorf("state after forget: %v, %v", p.unreachableSince, p.demoted)
+	}
+}
+
+func TestTargetPrunerAllDemoted(t *testing.T) {
+	dead := nodeMeta{regionID: 1, hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	targets := map[netip.Addr]nodeMeta{dead.addr: dead}
+	c := &pruningConfig{After: "5m", RediscoveryInterval: "10m"}
+	const interval = time.Minute
+	due := map[intervalKey]bool{{dead.addr, protocolSTUN}: true}
+	unreachable := []result{{key: resultKey{meta: dead, protocol: protocolSTUN}}}
+
+	p := newTargetPruner()
+	start := time.Unix(1700000000, 0)
+	var at time.Time
+	for i := range 6 {
+		at = start.Add(time.Duration(i) * interval)
+		p.observe(unreachable, c, at)
+	}
+	if len(p.demoted) != 1 {
+		t.Fatalf("demoted = %v, want the target demoted", p.demoted)
+	}
+
+	// A window not rediscovering leaves nothing due, which must not wedge
+	// probing.
+	at = at.Add(interval)
+	got := p.filter(due, c, interval, true, at)
+	if len(got) != 0 {
+		t.Fatalf("filter before rediscovery = %v, want nothing due", got)
+	}
+	probeNothingDue(t, targets, got)
+
+	// The rediscovery window probes the target, restoring it once reached.
+	at = start.Add(5*interval + 10*interval)
+	if got := p.filter(due, c, interval, true, at); !got[intervalKey{dead.addr, protocolSTUN}] {
+		t.Fatalf("filter of rediscovery window = %v, want the target due", got)
+	}
+	rtt := 10 * time.Millisecond
+	p.observe([]result{{key: resultKey{meta: dead, protocol: protocolSTUN}, rtt: &rtt}}, c, at)
+	if got := p.filter(due, c, interval, false, at.Add(interval)); len(got) != 1 {
+		t.Errorf("filter after restore = %v, want the target due", got)
+	}
+}
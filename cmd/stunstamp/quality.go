@@ -0,0 +1,321 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const qualityScoreMetricName = "stunstamp_quality_score"
+
+// qualityFloorWindow is the period over which the idle latency floor of a
+// timeseries is tracked for the loaded latency component. It spans a day so
+// that the floor reflects the quietest hour rather than the busy hour.
+const qualityFloorWindow = 24 * time.Hour
+
+// qualityComponent configures a component of the quality score. Values at or
+// better than Good score 100, values at or worse than Bad score 0, and values
+// in between are interpolated linearly.
+type qualityComponent struct {
+	// Weight is the weight of the component relative to the others. Zero
+	// excludes the component.
+	Weight float64
+	Good   float64
+	Bad    float64
+}
+
+// score returns the score of v in [0, 100].
+func (c qualityComponent) score(v float64) float64 {
+	if v <= c.Good {
+		return 100
+	}
+	if v >= c.Bad {
+		return 0
+	}
+	return 100 * (c.Bad - v) / (c.Bad - c.Good)
+}
+
+func (c qualityComponent) validate() error {
+	if c.Weight < 0 || math.IsNaN(c.Weight) || math.IsInf(c.Weight, 0) {
+		return fmt.Errorf("invalid Weight %v", c.Weight)
+	}
+	if c.Good < 0 || !(c.Bad > c.Good) {
+		return fmt.Errorf("Good (%v) must be non-negative and less than Bad (%v)", c.Good, c.Bad)
+	}
+	return nil
+}
+
+// qualityScoreConfig configures the composite network quality score computed
+// per uplink with --quality-score. Latencies are in milliseconds, and loss
+// as a percentage. Unset components take their defaults, see
+// defaultQualityScoreConfig.
+type qualityScoreConfig struct {
+	// Latency is the median RTT of successful probes.
+	Latency *qualityComponent `json:",omitempty"`
+	// Jitter is the median change in RTT of every timeseries since the
+	// previous window.
+	Jitter *qualityComponent `json:",omitempty"`
+	// Loss is the percentage of probes that failed.
+	Loss *qualityComponent `json:",omitempty"`
+	// LoadedLatency is the median RTT of successful probes in excess of the
+	// lowest RTT of their timeseries over the last day, i.e. the latency
+	// added by queueing under load, or bufferbloat.
+	LoadedLatency *qualityComponent `json:",omitempty"`
+}
+
+var defaultQualityScoreConfig = qualityScoreConfig{
+	Latency:       &qualityComponent{Weight: 3, Good: 20, Bad: 200},
+	Jitter:        &qualityComponent{Weight: 2, Good: 2, Bad: 30},
+	Loss:          &qualityComponent{Weight: 3, Good: 0, Bad: 5},
+	LoadedLatency: &qualityComponent{Weight: 2, Good: 5, Bad: 100},
+}
+
+// withDefaults returns c with unset components set to their defaults. c may
+// be nil.
+func (c *qualityScoreConfig) withDefaults() qualityScoreConfig {
+	ret := defaultQualityScoreConfig
+	if c == nil {
+		return ret
+	}
+	if c.Latency != nil {
+		ret.Latency = c.Latency
+	}
+	if c.Jitter != nil {
+		ret.Jitter = c.Jitter
+	}
+	if c.Loss != nil {
+		ret.Loss = c.Loss
+	}
+	if c.LoadedLatency != nil {
+		ret.LoadedLatency = c.LoadedLatency
+	}
+	return ret
+}
+
+func (c *qualityScoreConfig) validate() error {
+	full := c.withDefaults()
+	for name, comp := range map[string]*qualityComponent{
+		"Latency":       full.Latency,
+		"Jitter":        full.Jitter,
+		"Loss":          full.Loss,
+		"LoadedLatency": full.LoadedLatency,
+	} {
+		if err := comp.validate(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if full.Latency.Weight+full.Jitter.Weight+full.Loss.Weight+full.LoadedLatency.Weight == 0 {
+		return errors.New("all weights are zero")
+	}
+	return nil
+}
+
+// uplinkKey identifies an uplink, the path probes leave this host on: direct,
+// through a proxy or netstack, or through address family translation, per
+// address family.
+type uplinkKey struct {
+	uplink        string
+	addressFamily string
+}
+
+func uplinkOf(k resultKey) uplinkKey {
+	u := uplinkKey{uplink: "direct", addressFamily: addressFamilyOf(k.meta)}
+	switch {
+	case k.proxy != "":
+		u.uplink = k.proxy
+	case k.xlat != "":
+		u.uplink = k.xlat
+	}
+	return u
+}
+
+// rttFloor tracks the lowest RTT of a timeseries per hour over
+// qualityFloorWindow.
+type rttFloor struct {
+	hours []hourMin // ascending by start
+}
+
+type hourMin struct {
+	start time.Time
+	min   time.Duration
+}
+
+// add accounts rtt at at, and returns the lowest RTT over the window.
+func (f *rttFloor) add(at time.Time, rtt time.Duration) time.Duration {
+	start := hourStartOf(at)
+	if n := len(f.hours); n > 0 && f.hours[n-1].start.Equal(start) {
+		f.hours[n-1].min = min(f.hours[n-1].min, rtt)
+	} else {
+		f.hours = append(f.hours, hourMin{start, rtt})
+	}
+	f.hours = slices.DeleteFunc(f.hours, func(h hourMin) bool {
+		return !h.start.After(at.Add(-qualityFloorWindow))
+	})
+	floor := rtt
+	for _, h := range f.hours {
+		floor = min(floor, h.min)
+	}
+	return floor
+}
+
+// qualityScorer computes the quality score of every uplink each window. It
+// is not safe for concurrent use.
+type qualityScorer struct {
+	prev   map[resultKey]time.Duration // RTT of the previous window
+	floors map[resultKey]*rttFloor
+	seen   map[uplinkKey]bool
+}
+
+func newQualityScorer() *qualityScorer {
+	return &qualityScorer{
+		prev:   make(map[resultKey]time.Duration),
+		floors: make(map[resultKey]*rttFloor),
+		seen:   make(map[uplinkKey]bool),
+	}
+}
+
+// qualityInputs holds the measurements of an uplink in a window.
+type qualityInputs struct {
+	total, failed int
+	rtts          []time.Duration
+	jitters       []time.Duration
+	excess        []time.Duration // over the floor
+}
+
+// score returns the composite score of in under c, which must have defaults
+// set, in [0, 100]. Components without measurements, e.g. latency if every
+// probe failed, are excluded.
+func (in *qualityInputs) score(c qualityScoreConfig) float64 {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	var sum, weights float64
+	add := func(comp *qualityComponent, v float64) {
+		sum += comp.Weight * comp.score(v)
+		weights += comp.Weight
+	}
+	add(c.Loss, 100*float64(in.failed)/float64(in.total))
+	if len(in.rtts) > 0 {
+		add(c.Latency, ms(medianOf(in.rtts)))
+		add(c.LoadedLatency, ms(medianOf(in.excess)))
+	}
+	if len(in.jitters) > 0 {
+		add(c.Jitter, ms(medianOf(in.jitters)))
+	}
+	if weights == 0 {
+		// Only excluded components have weight.
+		return math.NaN()
+	}
+	return sum / weights
+}
+
+// update accounts results, returning the score of every uplink in results
+// under c, and stale markers for uplinks absent from them.
+func (q *qualityScorer) update(results []result, c *qualityScoreConfig, instance string) []prompb.TimeSeries {
+	var at time.Time
+	if len(results) > 0 {
+		at = results[len(results)-1].at
+	}
+	scores := q.score(results, c)
+	var ts []prompb.TimeSeries
+	for u, score := range scores {
+		ts = append(ts, qualityTimeSeries(u, instance, at, score))
+	}
+	now := time.Now()
+	for u := range q.seen {
+		if _, ok := scores[u]; !ok {
+			ts = append(ts, qualityTimeSeries(u, instance, now, math.Float64frombits(staleNaN)))
+			delete(q.seen, u)
+		}
+	}
+	for u := range scores {
+		q.seen[u] = true
+	}
+	return ts
+}
+
+// score accounts results, returning the score of every uplink in results
+// under c.
+func (q *qualityScorer) score(results []result, c *qualityScoreConfig) map[uplinkKey]float64 {
+	inputs := make(map[uplinkKey]*qualityInputs)
+	for _, r := range results {
+		u := uplinkOf(r.key)
+		in, ok := inputs[u]
+		if !ok {
+			in = &qualityInputs{}
+			inputs[u] = in
+		}
+		in.total++
+		if r.rtt == nil {
+			in.failed++
+			delete(q.prev, r.key)
+			continue
+		}
+		rtt := *r.rtt
+		in.rtts = append(in.rtts, rtt)
+		if prev, ok := q.prev[r.key]; ok {
+			in.jitters = append(in.jitters, (rtt - prev).Abs())
+		}
+		q.prev[r.key] = rtt
+		f, ok := q.floors[r.key]
+		if !ok {
+			f = &rttFloor{}
+			q.floors[r.key] = f
+		}
+		in.excess = append(in.excess, rtt-f.add(r.at, rtt))
+	}
+
+	full := c.withDefaults()
+	scores := make(map[uplinkKey]float64, len(inputs))
+	for u, in := range inputs {
+		scores[u] = in.score(full)
+	}
+	return scores
+}
+
+// forget drops all state for keys not present in keep.
+func (q *qualityScorer) forget(keep func(resultKey) bool) {
+	for k := range q.prev {
+		if !keep(k) {
+			delete(q.prev, k)
+		}
+	}
+	for k := range q.floors {
+		if !keep(k) {
+			delete(q.floors, k)
+		}
+	}
+}
+
+// staleMarkers returns stale markers for the score of every uplink scored.
+func (q *qualityScorer) staleMarkers(instance string) []prompb.TimeSeries {
+	now := time.Now()
+	var ts []prompb.TimeSeries
+	for u := range q.seen {
+		ts = append(ts, qualityTimeSeries(u, instance, now, math.Float64frombits(staleNaN)))
+	}
+	return ts
+}
+
+func qualityTimeSeries(u uplinkKey, instance string, at time.Time, value float64) prompb.TimeSeries {
+	labels := []prompb.Label{
+		{Name: "__name__", Value: qualityScoreMetricName},
+		{Name: "instance", Value: instance},
+		{Name: "job", Value: "stunstamp-rw"},
+		{Name: "uplink", Value: u.uplink},
+		{Name: "address_family", Value: u.addressFamily},
+	}
+	slices.SortFunc(labels, func(a, b prompb.Label) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return prompb.TimeSeries{
+		Labels:  labels,
+		Samples: []prompb.Sample{{Timestamp: at.UnixMilli(), Value: value}},
+	}
+}
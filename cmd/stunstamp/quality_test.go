@@ -0,0 +1,114 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"math"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestQualityComponentScore(t *testing.T) {
+	c := qualityComponent{Weight: 1, Good: 20, Bad: 200}
+	for _, tt := range []struct {
+		v, want float64
+	}{
+		{0, 100},
+		{20, 100},
+		{110, 50},
+		{200, 0},
+		{1000, 0},
+	} {
+		if got := c.score(tt.v); got != tt.want {
+			t.Errorf("score(%v) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestQualityScoreConfig(t *testing.T) {
+	c, err := parseConfig([]byte(`{"QualityScore": {"Loss": {"Weight": 1, "Good": 0, "Bad": 10}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := c.QualityScore.withDefaults()
+	if full.Loss.Bad != 10 || full.Latency != defaultQualityScoreConfig.Latency {
+		t.Errorf("withDefaults() = %+v", full)
+	}
+	for _, raw := range []string{
+		`{"QualityScore": {"Jitter": {"Weight": 1, "Good": 5, "Bad": 5}}}`,
+		`{"QualityScore": {"Jitter": {"Weight": -1, "Good": 0, "Bad": 5}}}`,
+		`{"QualityScore": {
+			"Latency": {"Weight": 0, "Good": 0, "Bad": 1},
+			"Jitter": {"Weight": 0, "Good": 0, "Bad": 1},
+			"Loss": {"Weight": 0, "Good": 0, "Bad": 1},
+			"LoadedLatency": {"Weight": 0, "Good": 0, "Bad": 1}
+		}}`,
+	} {
+		if _, err := parseConfig([]byte(raw)); err == nil {
+			t.Errorf("parseConfig(%s) succeeded", raw)
+		}
+	}
+}
+
+func TestQualityScorer(t *testing.T) {
+	q := newQualityScorer()
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	k := resultKey{meta: meta, protocol: protocolSTUN, dstPort: 3478}
+	proxied := k
+	proxied.proxy = "proxy:1080"
+	at := time.Date(2024, 7, 1, 20, 0, 0, 0, time.Local)
+	ms := func(n int) *time.Duration {
+		d := time.Duration(n) * time.Millisecond
+		return &d
+	}
+	scores := func(ts []prompb.TimeSeries) map[string]float64 {
+		ret := make(map[string]float64)
+		for _, s := range ts {
+			for _, l := range s.Labels {
+				if l.Name == "uplink" {
+					ret[l.Value] = s.Samples[0].Value
+				}
+			}
+		}
+		return ret
+	}
+
+	// An idle, good uplink scores 100; one losing every probe scores 0.
+	got := scores(q.update([]result{
+		{key: k, at: at, rtt: ms(10)},
+		{key: proxied, at: at},
+	}, nil, "test"))
+	if got["direct"] != 100 || got["proxy:1080"] != 0 {
+		t.Errorf("scores = %v, want direct 100 and proxy 0", got)
+	}
+
+	// Under load, latency of 60ms is 50ms over the floor, with 50ms of
+	// jitter: latency, jitter, loss, and loaded latency score 77.8, 0, 100,
+	// and 52.6 respectively.
+	got = scores(q.update([]result{{key: k, at: at.Add(time.Minute), rtt: ms(60)}}, nil, "test"))
+	want := (3*(100-40*100/180.0) + 2*0 + 3*100 + 2*(100-45*100/95.0)) / 10
+	if math.Abs(got["direct"]-want) > 1e-9 {
+		t.Errorf("loaded score = %v, want %v", got["direct"], want)
+	}
+	if !math.IsNaN(got["proxy:1080"]) {
+		t.Errorf("vanished uplink score = %v, want stale marker", got["proxy:1080"])
+	}
+
+	// The floor expires after a day.
+	q.update([]result{{key: k, at: at.Add(qualityFloorWindow + time.Hour), rtt: ms(50)}}, nil, "test")
+	if got := q.floors[k].add(at.Add(qualityFloorWindow+time.Hour), 60*time.Millisecond); got != 50*time.Millisecond {
+		t.Errorf("floor after a day = %v, want 50ms", got)
+	}
+
+	if n := len(q.staleMarkers("test")); n != 1 {
+		t.Errorf("staleMarkers() = %d, want 1", n)
+	}
+	q.forget(func(resultKey) bool { return false })
+	if len(q.prev) != 0 || len(q.floors) != 0 {
+		t.Error("forget() kept state")
+	}
+}
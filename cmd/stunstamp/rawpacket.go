@@ -0,0 +1,17 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import "net/netip"
+
+// activeRawProber is the AF_PACKET prober set via --raw-iface, or nil. It is
+// set once at startup.
+var activeRawProber *rawProber
+
+// supports reports whether dst may be probed with proto by r. Packets are
+// crafted from the IP header up, which is only implemented for IPv4 ICMP and
+// STUN.
+func (r *rawProber) supports(proto protocol, dst netip.Addr) bool {
+	return dst.Is4() && (proto == protocolICMP || proto == protocolSTUN)
+}
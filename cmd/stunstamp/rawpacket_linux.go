@@ -0,0 +1,477 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+	"tailscale.com/net/ktimestamp"
+	"tailscale.com/net/stun"
+)
+
+// rawTimestampingFlags request hardware timestamps where the NIC supports
+// them, alongside software timestamps as a fallback.
+const rawTimestampingFlags = ktimestamp.Flags |
+	unix.SOF_TIMESTAMPING_TX_HARDWARE |
+	unix.SOF_TIMESTAMPING_RX_HARDWARE |
+	unix.SOF_TIMESTAMPING_RAW_HARDWARE
+
+// From linux/net_tstamp.h, absent from x/sys/unix.
+const (
+	hwtstampTXOn      = 1
+	hwtstampFilterAll = 1
+)
+
+// rawProber measures ICMP and STUN RTTs with packets crafted from the IPv4
+// header up and sent and received via an AF_PACKET socket bound to a single
+// interface. This bypasses the IP and UDP stacks on both tx and rx, and
+// allows for hardware timestamps on NICs that support them.
+//
+// All packets are addressed to the link layer address of the next hop, by
+// default the interface's IPv4 default gateway, so on-link targets are not
+// supported.
+type rawProber struct {
+	pconn   *polledConn
+	ifindex int
+	src     netip.Addr
+	nextHop net.HardwareAddr
+	// icmpID is the ICMP echo identifier of all ICMP probes.
+	icmpID uint16
+	// udpConn reserves udpPort, the source port of all STUN probes, so that
+	// the kernel does not respond to STUN responses with ICMP errors.
+	udpConn *net.UDPConn
+	udpPort uint16
+}
+
+// newRawProber returns a rawProber sending via the interface named ifName.
+// nextHopMAC overrides the link layer destination address if non-empty.
+func newRawProber(ifName, nextHopMAC string) (*rawProber, error) {
+	ifi, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, err
+	}
+	if ifi.Flags&net.FlagLoopback != 0 {
+		// Packets injected on loopback lack a route and are dropped as
+		// martians.
+		return nil, errors.New("loopback interfaces are unsupported")
+	}
+	r := &rawProber{
+		ifindex: ifi.Index,
+		icmpID:  uint16(rand.N(math.MaxUint16)),
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(ipn.IP); ok && ip.Unmap().Is4() {
+				r.src = ip.Unmap()
+				break
+			}
+		}
+	}
+	if !r.src.IsValid() {
+		return nil, fmt.Errorf("interface %s has no IPv4 address", ifName)
+	}
+	switch {
+	case len(nextHopMAC) > 0:
+		r.nextHop, err = net.ParseMAC(nextHopMAC)
+	default:
+		r.nextHop, err = defaultGatewayMAC(ifName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error determining next hop link layer address: %w", err)
+	}
+
+	r.udpConn, err = net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.AddrPortFrom(r.src, 0)))
+	if err != nil {
+		return nil, err
+	}
+	r.udpPort = uint16(r.udpConn.LocalAddr().(*net.UDPAddr).Port)
+
+	// Create the socket with protocol 0 so that it receives nothing until
+	// bound, by which point the filter is in place.
+	r.pconn, err = newPolledConn(unix.AF_PACKET, unix.SOCK_DGRAM, 0, protocolICMP)
+	if err != nil {
+		r.udpConn.Close()
+		return nil, err
+	}
+	if err := r.setup(ifName); err != nil {
+		r.close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rawProber) setup(ifName string) error {
+	fd := r.pconn.fd
+	prog, err := bpf.Assemble(rawFilter(r.icmpID, r.udpPort))
+	if err != nil {
+		return err
+	}
+	err = unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &unix.SockFprog{
+		Len:    uint16(len(prog)),
+		Filter: (*unix.SockFilter)(unsafe.Pointer(&prog[0])),
+	})
+	if err != nil {
+		return fmt.Errorf("error attaching filter: %w", err)
+	}
+	// Best effort, requires Linux 4.20+. rxMatch funcs don't match our own
+	// packets, but there is no need to wake up for them.
+	unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_IGNORE_OUTGOING, 1)
+	if err := ktimestamp.SetTimestamping(fd, rawTimestampingFlags); err != nil {
+		return fmt.Errorf("error enabling timestamping: %w", err)
+	}
+	if err := enableHWTimestamps(fd, ifName); err != nil {
+		probeLog.Warn("hardware timestamping unavailable, falling back to software timestamps", "iface", ifName, "err", err)
+	}
+	return unix.Bind(fd, &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_IP),
+		Ifindex:  r.ifindex,
+	})
+}
+
+func (r *rawProber) close() {
+	if r.pconn != nil {
+		r.pconn.Close()
+	}
+	r.udpConn.Close()
+}
+
+// rawFilter returns a classic BPF program accepting ICMP echo replies with
+// identifier icmpID, and UDP datagrams to udpPort. Packets are IPv4,
+// starting at the IP header.
+func rawFilter(icmpID, udpPort uint16) []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 9, Size: 1}, // IP protocol
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_ICMP, SkipFalse: 5},
+		bpf.LoadMemShift{Off: 0},                              // X = IP header length
+		bpf.LoadIndirect{Off: 0, Size: 1},                     // ICMP type
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipFalse: 7}, // echo reply
+		bpf.LoadIndirect{Off: 4, Size: 2},                     // ICMP echo identifier
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(icmpID), SkipTrue: 4, SkipFalse: 5},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_UDP, SkipFalse: 4},
+		bpf.LoadMemShift{Off: 0},
+		bpf.LoadIndirect{Off: 2, Size: 2}, // UDP destination port
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(udpPort), SkipFalse: 1},
+		bpf.RetConstant{Val: math.MaxUint16},
+		bpf.RetConstant{Val: 0},
+	}
+}
+
+// hwtstampConfig is struct hwtstamp_config from linux/net_tstamp.h.
+type hwtstampConfig struct {
+	flags    int32
+	txType   int32
+	rxFilter int32
+}
+
+// hwtstampIfreq is a struct ifreq holding a pointer to a hwtstampConfig.
+type hwtstampIfreq struct {
+	name [unix.IFNAMSIZ]byte
+	data unsafe.Pointer
+	_    [16]byte
+}
+
+// enableHWTimestamps enables hardware timestamping of all packets on the
+// interface named ifName via SIOCSHWTSTAMP. This requires CAP_NET_ADMIN and
+// driver support, and affects all users of the interface.
+func enableHWTimestamps(fd int, ifName string) error {
+	cfg := &hwtstampConfig{
+		txType:   hwtstampTXOn,
+		rxFilter: hwtstampFilterAll,
+	}
+	ifr := &hwtstampIfreq{data: unsafe.Pointer(cfg)}
+	copy(ifr.name[:unix.IFNAMSIZ-1], ifName)
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCSHWTSTAMP, uintptr(unsafe.Pointer(ifr)))
+	if errno != 0 {
+		return fmt.Errorf("SIOCSHWTSTAMP: %w", errno)
+	}
+	return nil
+}
+
+// parseRawTimestampFromCmsgs returns the hardware timestamp from the
+// SO_TIMESTAMPING cmsg in oob if present, otherwise the software timestamp.
+func parseRawTimestampFromCmsgs(oob []byte) (time.Time, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error parsing oob as cmsgs: %w", err)
+	}
+	for _, msg := range msgs {
+		if !ktimestamp.IsTimestampingCmsg(msg.Header) {
+			continue
+		}
+		// struct scm_timestamping64 holds software, deprecated, and raw
+		// hardware timestamps in that order.
+		var ts [3]time.Time
+		for i := range ts {
+			off := i * 16
+			if len(msg.Data) < off+16 {
+				break
+			}
+			sec := int64(binary.NativeEndian.Uint64(msg.Data[off : off+8]))
+			ns := int64(binary.NativeEndian.Uint64(msg.Data[off+8 : off+16]))
+			if sec != 0 || ns != 0 {
+				ts[i] = time.Unix(sec, ns)
+			}
+		}
+		if !ts[2].IsZero() {
+			return ts[2], nil
+		}
+		if !ts[0].IsZero() {
+			return ts[0], nil
+		}
+	}
+	return time.Time{}, errors.New("failed to parse timestamp from cmsgs")
+}
+
+// connAndMeasureFn returns a connAndMeasureFn measuring proto via r.
+func (r *rawProber) connAndMeasureFn(proto protocol) *connAndMeasureFn {
+	cf := &connAndMeasureFn{conn: proxiedConn{}}
+	switch proto {
+	case protocolICMP:
+		cf.fn = r.measureICMPRTT
+	case protocolSTUN:
+		cf.fn = r.measureSTUNRTT
+	}
+	return cf
+}
+
+func (r *rawProber) measureICMPRTT(ctx context.Context, _ io.ReadWriteCloser, _ string, dst netip.AddrPort) (measurement, error) {
+	seq := uint16(rand.N(math.MaxUint16))
+	payload := []byte("stunstamp")
+	echo := make([]byte, 8, 8+len(payload))
+	echo[0] = 8 // echo request
+	binary.BigEndian.PutUint16(echo[4:], r.icmpID)
+	binary.BigEndian.PutUint16(echo[6:], seq)
+	echo = append(echo, payload...)
+	binary.BigEndian.PutUint16(echo[2:], checksum(echo, 0))
+	pkt := ipv4Packet(r.src, dst.Addr(), unix.IPPROTO_ICMP, echo)
+
+	return r.measure(ctx, pkt, func(b []byte) bool {
+		body, ok := parseIPv4(b, dst.Addr(), unix.IPPROTO_ICMP)
+		return ok && len(body) >= 8 && body[0] == 0 &&
+			binary.BigEndian.Uint16(body[4:]) == r.icmpID &&
+			binary.BigEndian.Uint16(body[6:]) == seq &&
+			bytes.Equal(body[8:], payload)
+	})
+}
+
+func (r *rawProber) measureSTUNRTT(ctx context.Context, _ io.ReadWriteCloser, _ string, dst netip.AddrPort) (measurement, error) {
+	pkt, match := r.stunRequest(dst)
+	return r.measure(ctx, pkt, match)
+}
+
+// stunRequest returns an IPv4 packet carrying a STUN request to dst, and a
+// function matching its response.
+func (r *rawProber) stunRequest(dst netip.AddrPort) (pkt []byte, match func([]byte) bool) {
+	txID := stun.NewTxID()
+	req := stun.Request(txID)
+	udp := make([]byte, 8, 8+len(req))
+	binary.BigEndian.PutUint16(udp[0:], r.udpPort)
+	binary.BigEndian.PutUint16(udp[2:], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(req)))
+	udp = append(udp, req...)
+	binary.BigEndian.PutUint16(udp[6:], udpChecksum(r.src, dst.Addr(), udp))
+	pkt = ipv4Packet(r.src, dst.Addr(), unix.IPPROTO_UDP, udp)
+
+	return pkt, func(b []byte) bool {
+		body, ok := parseIPv4(b, dst.Addr(), unix.IPPROTO_UDP)
+		if !ok || len(body) < 8 ||
+			binary.BigEndian.Uint16(body[0:]) != dst.Port() ||
+			binary.BigEndian.Uint16(body[2:]) != r.udpPort {
+			return false
+		}
+		gotTxID, _, err := stun.ParseResponse(body[8:])
+		return err == nil && gotTxID == txID
+	}
+}
+
+// measure transmits the IPv4 packet pkt and waits for its tx timestamp and a
+// response satisfying rxMatch.
+func (r *rawProber) measure(ctx context.Context, pkt []byte, rxMatch func([]byte) bool) (measurement, error) {
+	pconn := r.pconn
+	txWaiter := pconn.poller.register(pconn, true, func(b []byte) bool {
+		// The looped packet may include a link layer header so match
+		// against the tail.
+		return len(b) >= len(pkt) && bytes.Equal(pkt, b[len(b)-len(pkt):])
+	})
+	defer pconn.poller.unregister(txWaiter)
+	rxWaiter := pconn.poller.register(pconn, false, rxMatch)
+	defer pconn.poller.unregister(rxWaiter)
+
+	to := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_IP),
+		Ifindex:  r.ifindex,
+		Halen:    uint8(len(r.nextHop)),
+	}
+	copy(to.Addr[:], r.nextHop)
+	userspaceTxAt := time.Now()
+	if err := pconn.sendto(pkt, to); err != nil {
+		return measurement{}, fmt.Errorf("sendto error: %v", err) // don't wrap
+	}
+
+	txCtx, txCancel := context.WithTimeout(ctx, txRxTimeout)
+	defer txCancel()
+	msg, err := txWaiter.wait(txCtx)
+	if err != nil {
+		return measurement{}, fmt.Errorf("MSG_ERRQUEUE wait error: %v", err) // don't wrap
+	}
+	txAt, err := parseRawTimestampFromCmsgs(msg.oob)
+	if err != nil {
+		return measurement{}, fmt.Errorf("failed to get tx timestamp: %v", err) // don't wrap
+	}
+
+	rxCtx, rxCancel := context.WithTimeout(ctx, txRxTimeout)
+	defer rxCancel()
+	msg, err = rxWaiter.wait(rxCtx)
+	if err != nil {
+		return measurement{}, fmt.Errorf("rx wait error: %w", err) // wrap for timeout-related error unwrapping
+	}
+	rxAt, err := parseRawTimestampFromCmsgs(msg.oob)
+	if err != nil {
+		return measurement{}, fmt.Errorf("failed to get rx timestamp: %v", err) // don't wrap
+	}
+	return measurement{
+		rtt:          rxAt.Sub(txAt),
+		userspaceRTT: msg.at.Sub(userspaceTxAt),
+	}, nil
+}
+
+// ipv4Packet returns an IPv4 packet from src to dst carrying payload of
+// the IP protocol proto.
+func ipv4Packet(src, dst netip.Addr, proto uint8, payload []byte) []byte {
+	const ihl = 20
+	b := make([]byte, ihl, ihl+len(payload))
+	b[0] = 4<<4 | ihl/4
+	binary.BigEndian.PutUint16(b[2:], uint16(ihl+len(payload)))
+	binary.BigEndian.PutUint16(b[4:], uint16(rand.N(math.MaxUint16)))
+	binary.BigEndian.PutUint16(b[6:], 0x4000) // DF
+	b[8] = 64                                 // TTL
+	b[9] = proto
+	s, d := src.As4(), dst.As4()
+	copy(b[12:], s[:])
+	copy(b[16:], d[:])
+	binary.BigEndian.PutUint16(b[10:], checksum(b, 0))
+	return append(b, payload...)
+}
+
+// parseIPv4 returns the payload of the IPv4 packet b if it is an
+// unfragmented packet of the IP protocol proto from src.
+func parseIPv4(b []byte, src netip.Addr, proto uint8) ([]byte, bool) {
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return nil, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:]))
+	if ihl < 20 || total < ihl || total > len(b) {
+		return nil, false
+	}
+	if b[9] != proto || binary.BigEndian.Uint16(b[6:])&0x3fff != 0 {
+		return nil, false
+	}
+	if netip.AddrFrom4([4]byte(b[12:16])) != src {
+		return nil, false
+	}
+	return b[ihl:total], true
+}
+
+// checksum returns the Internet checksum (RFC 1071) of b, starting from the
+// partial sum initial.
+func checksum(b []byte, initial uint32) uint16 {
+	sum := initial
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// udpChecksum returns the checksum of the UDP datagram udp, including the
+// IPv4 pseudo-header.
+func udpChecksum(src, dst netip.Addr, udp []byte) uint16 {
+	s, d := src.As4(), dst.As4()
+	var sum uint32
+	for _, a := range [][4]byte{s, d} {
+		sum += uint32(binary.BigEndian.Uint16(a[0:])) + uint32(binary.BigEndian.Uint16(a[2:]))
+	}
+	sum += unix.IPPROTO_UDP + uint32(len(udp))
+	c := checksum(udp, sum)
+	if c == 0 {
+		return 0xffff
+	}
+	return c
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// defaultGatewayMAC returns the link layer address of the IPv4 default
+// gateway via the interface named ifName, per /proc/net/route and
+// /proc/net/arp.
+func defaultGatewayMAC(ifName string) (net.HardwareAddr, error) {
+	routes, err := os.ReadFile("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	var gw netip.Addr
+	s := bufio.NewScanner(bytes.NewReader(routes))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) < 3 || f[0] != ifName || f[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(f[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		// The gateway is printed as a native endian (little endian in
+		// practice) uint32.
+		var a [4]byte
+		binary.NativeEndian.PutUint32(a[:], binary.BigEndian.Uint32(b))
+		gw = netip.AddrFrom4(a)
+		break
+	}
+	if !gw.IsValid() {
+		return nil, fmt.Errorf("no IPv4 default route via %s", ifName)
+	}
+	arp, err := os.ReadFile("/proc/net/arp")
+	if err != nil {
+		return nil, err
+	}
+	s = bufio.NewScanner(bytes.NewReader(arp))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) < 6 || f[0] != gw.String() || f[5] != ifName {
+			continue
+		}
+		return net.ParseMAC(f[3])
+	}
+	return nil, fmt.Errorf("no ARP entry for default gateway %v; ping it first or set --raw-next-hop-mac", gw)
+}
@@ -0,0 +1,64 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+func TestRawPacketCrafting(t *testing.T) {
+	src := netip.MustParseAddr("192.0.2.1")
+	dst := netip.MustParseAddr("198.51.100.1")
+	udp := []byte{0, 1, 0, 2, 0, 9, 0, 0, 'x'}
+	pkt := ipv4Packet(src, dst, unix.IPPROTO_UDP, udp)
+	// The checksum of a header including its checksum is zero.
+	if got := checksum(pkt[:20], 0); got != 0 {
+		t.Errorf("IPv4 header checksum does not verify: %#04x", got)
+	}
+	body, ok := parseIPv4(pkt, src, unix.IPPROTO_UDP)
+	if !ok || string(body) != string(udp) {
+		t.Fatalf("parseIPv4() = %x, %v; want %x, true", body, ok, udp)
+	}
+	if _, ok := parseIPv4(pkt, dst, unix.IPPROTO_UDP); ok {
+		t.Error("parseIPv4() accepted packet from unexpected source")
+	}
+	if _, ok := parseIPv4(pkt, src, unix.IPPROTO_ICMP); ok {
+		t.Error("parseIPv4() accepted packet of unexpected protocol")
+	}
+
+	vm, err := bpf.NewVM(rawFilter(1234, 5678))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoReply := func(id uint16) []byte {
+		return ipv4Packet(src, dst, unix.IPPROTO_ICMP, []byte{0, 0, 0, 0, byte(id >> 8), byte(id), 0, 1})
+	}
+	udpTo := func(port uint16) []byte {
+		return ipv4Packet(src, dst, unix.IPPROTO_UDP, []byte{0, 1, byte(port >> 8), byte(port), 0, 8, 0, 0})
+	}
+	for _, tt := range []struct {
+		name string
+		pkt  []byte
+		want bool
+	}{
+		{"echo reply", echoReply(1234), true},
+		{"echo reply other id", echoReply(1), false},
+		{"echo request", ipv4Packet(src, dst, unix.IPPROTO_ICMP, []byte{8, 0, 0, 0, 0x04, 0xd2, 0, 1}), false},
+		{"udp", udpTo(5678), true},
+		{"udp other port", udpTo(1), false},
+		{"tcp", ipv4Packet(src, dst, unix.IPPROTO_TCP, make([]byte, 20)), false},
+	} {
+		n, err := vm.Run(tt.pkt)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := n > 0; got != tt.want {
+			t.Errorf("%s: filter accepted = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// readOnlyLag is how far behind the current time a read-only replica
+// follows the store, so that it does not observe a probe window's results
+// while they are still being written.
+const readOnlyLag = time.Minute
+
+// runReadOnly serves the web UI and query API over the store in storeDir,
+// which is written by another stunstamp process, without probing. It
+// returns on SIGINT or SIGTERM.
+func runReadOnly(storeDir, httpAddr, instance string) {
+	store, err := openResultsStoreReadOnly(storeDir)
+	if err != nil {
+		log.Fatalf("error opening store: %v", err)
+	}
+	if err := annotations.open(storeDir, true); err != nil {
+		log.Fatalf("error loading annotations: %v", err)
+	}
+	baselines := newBaselineTracker()
+	hs := &httpServer{
+		instance:  instance,
+		baselines: baselines,
+		store:     store,
+	}
+	go func() {
+		log.Fatal(http.ListenAndServe(httpAddr, hs.mux()))
+	}()
+
+	from := time.Now().AddDate(0, 0, -baselineDays-1)
+	follow := func() {
+		if err := annotations.reload(); err != nil {
+			storeLog.Error("error reloading annotations", "err", err)
+		}
+		to := time.Now().Add(-readOnlyLag)
+		err := store.readRange(from, to, func(sr storedResult) error {
+			baselines.add([]result{sr.toResult()})
+			return nil
+		})
+		if err != nil {
+			storeLog.Error("error following store", "err", err)
+			return
+		}
+		from = to
+	}
+	follow()
+	slog.Info("stunstamp started in read-only mode", "store_dir", storeDir)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(minInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			follow()
+		case <-sigCh:
+			return
+		}
+	}
+}
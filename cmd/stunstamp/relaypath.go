@@ -0,0 +1,277 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"math"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+const (
+	peerPathRTTMetricName      = "stunstamp_peer_path_rtt_ns"
+	peerRelayPenaltyMetricName = "stunstamp_peer_relay_penalty_ns"
+
+	// relayPingSize is the size of disco pings sent to force the DERP path.
+	// magicsock sends pings larger than the MTU of the direct path via DERP
+	// only, while probing the direct path for a larger MTU, see
+	// magicsock.endpoint.addrForPingSizeLocked. It exceeds jumbo frames so
+	// that no direct path is known to fit it, and is well within the
+	// maximum DERP frame.
+	relayPingSize = 9216
+
+	// relayPingTimeout bounds a single disco ping.
+	relayPingTimeout = 5 * time.Second
+)
+
+// Paths to a peer.
+const (
+	peerPathDirect = "direct"
+	peerPathDERP   = "derp"
+)
+
+// discoPinger sends disco pings via tailscaled, see tailscale.LocalClient.
+type discoPinger interface {
+	PingWithOpts(ctx context.Context, ip netip.Addr, pingtype tailcfg.PingType, opts tailscale.PingOpts) (*ipnstate.PingResult, error)
+}
+
+// relayPathResult is the measurement of the direct and DERP-relayed paths to
+// a peer in a window. A nil RTT signifies that the path was unavailable or
+// not taken, e.g. direct to a peer behind CGNAT that blocks direct
+// connectivity, or DERP if a relayed ping was answered directly.
+type relayPathResult struct {
+	hostname string
+	at       time.Time
+	direct   *time.Duration
+	derp     *time.Duration
+	// region is the code of the DERP region the relayed ping traversed.
+	region string
+}
+
+// penalty returns the RTT added by relaying, if both paths were measured.
+func (r relayPathResult) penalty() (time.Duration, bool) {
+	if r.direct == nil || r.derp == nil {
+		return 0, false
+	}
+	return *r.derp - *r.direct, true
+}
+
+// measureRelayPath measures the RTT of the direct and the DERP-relayed path to
+// the peer at ip with disco pings, sequentially so that they do not queue
+// behind each other. Pings are only accounted to the path tailscaled
+// reports having taken.
+func measureRelayPath(ctx context.Context, p discoPinger, hostname string, ip netip.Addr) relayPathResult {
+	r := relayPathResult{hostname: hostname, at: time.Now()}
+	ping := func(size int) *ipnstate.PingResult {
+		ctx, cancel := context.WithTimeout(ctx, relayPingTimeout)
+		defer cancel()
+		pr, err := p.PingWithOpts(ctx, ip, tailcfg.PingDisco, tailscale.PingOpts{Size: size})
+		if err == nil && pr.Err != "" {
+			err = errors.New(pr.Err)
+		}
+		if err != nil {
+			probeLog.Debug("error pinging peer", "hostname", hostname, "ip", ip, "size", size, "err", err)
+			return nil
+		}
+		return pr
+	}
+	rttOf := func(pr *ipnstate.PingResult) *time.Duration {
+		rtt := time.Duration(pr.LatencySeconds * float64(time.Second))
+		return &rtt
+	}
+	if pr := ping(0); pr != nil && pr.Endpoint != "" {
+		r.direct = rttOf(pr)
+	}
+	if pr := ping(relayPingSize); pr != nil && pr.DERPRegionID != 0 {
+		r.derp = rttOf(pr)
+		r.region = pr.DERPRegionCode
+	}
+	return r
+}
+
+// measureAllRelayPaths measures the paths to every online peer in st
+// concurrently.
+func measureAllRelayPaths(ctx context.Context, p discoPinger, st *ipnstate.Status) []relayPathResult {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results []relayPathResult
+	)
+	for _, ps := range st.Peer {
+		if !ps.Online || len(ps.TailscaleIPs) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := measureRelayPath(ctx, p, ps.HostName, ps.TailscaleIPs[0])
+			mu.Lock()
+			defer mu.Unlock()
+			results = append(results, r)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// relayPathStatus is the latest measurement of the paths to a peer, as
+// served by the API.
+type relayPathStatus struct {
+	Hostname string
+	At       time.Time
+	// DirectRTT and DERPRTT are nil if the path was not measured.
+	DirectRTT *time.Duration `json:",omitempty"`
+	DERPRTT   *time.Duration `json:",omitempty"`
+	// DERPRegion is the code of the DERP region relayed through.
+	DERPRegion string `json:",omitempty"`
+	// Penalty is DERPRTT less DirectRTT, if both were measured.
+	Penalty *time.Duration `json:",omitempty"`
+}
+
+// relayPathTracker tracks the latest measurement of the paths to every peer,
+// and the timeseries written. It is safe for concurrent use.
+type relayPathTracker struct {
+	mu     sync.Mutex
+	latest map[string]relayPathResult // by hostname
+}
+
+func newRelayPathTracker() *relayPathTracker {
+	return &relayPathTracker{latest: make(map[string]relayPathResult)}
+}
+
+func relayPathTimeSeries(metricName, hostname, path, region, instance string, at time.Time, value float64) prompb.TimeSeries {
+	labels := []prompb.Label{
+		{Name: "__name__", Value: metricName},
+		{Name: "instance", Value: instance},
+		{Name: "job", Value: "stunstamp-rw"},
+		{Name: "hostname", Value: hostname},
+	}
+	if path != "" {
+		labels = append(labels, prompb.Label{Name: "path", Value: path})
+	}
+	if region != "" {
+		labels = append(labels, prompb.Label{Name: "region_code", Value: region})
+	}
+	slices.SortFunc(labels, func(a, b prompb.Label) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return prompb.TimeSeries{
+		Labels:  labels,
+		Samples: []prompb.Sample{{Timestamp: at.UnixMilli(), Value: value}},
+	}
+}
+
+// update records results, returning timeseries for them, and stale markers
+// for the peers absent from them and DERP regions no longer relayed through.
+func (t *relayPathTracker) update(results []relayPathResult, instance string) []prompb.TimeSeries {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var ts []prompb.TimeSeries
+	current := make(map[string]relayPathResult)
+	for _, r := range results {
+		current[r.hostname] = r
+		value := func(d *time.Duration) float64 {
+			if d == nil {
+				return math.NaN()
+			}
+			return float64(*d)
+		}
+		region := r.region
+		if prev, ok := t.latest[r.hostname]; ok && prev.region != "" {
+			if region == "" {
+				// Keep the series of the DERP path continuous across
+				// windows in which it was not taken.
+				region = prev.region
+				r.region = prev.region
+				current[r.hostname] = r
+			} else if region != prev.region {
+				ts = append(ts, relayPathTimeSeries(peerPathRTTMetricName, r.hostname, peerPathDERP, prev.region, instance, r.at, math.Float64frombits(staleNaN)))
+			}
+		}
+		ts = append(ts, relayPathTimeSeries(peerPathRTTMetricName, r.hostname, peerPathDirect, "", instance, r.at, value(r.direct)))
+		if region != "" {
+			ts = append(ts, relayPathTimeSeries(peerPathRTTMetricName, r.hostname, peerPathDERP, region, instance, r.at, value(r.derp)))
+		}
+		penalty := math.NaN()
+		if d, ok := r.penalty(); ok {
+			penalty = float64(d)
+		}
+		ts = append(ts, relayPathTimeSeries(peerRelayPenaltyMetricName, r.hostname, "", "", instance, r.at, penalty))
+	}
+	now := time.Now()
+	for hostname, prev := range t.latest {
+		if _, ok := current[hostname]; !ok {
+			ts = append(ts, relayPathStaleMarkers(prev, instance, now)...)
+		}
+	}
+	t.latest = current
+	return ts
+}
+
+// staleMarkers returns stale markers for the latest path of every peer.
+func (t *relayPathTracker) staleMarkers(instance string) []prompb.TimeSeries {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	var ts []prompb.TimeSeries
+	for _, r := range t.latest {
+		ts = append(ts, relayPathStaleMarkers(r, instance, now)...)
+	}
+	return ts
+}
+
+func relayPathStaleMarkers(r relayPathResult, instance string, at time.Time) []prompb.TimeSeries {
+	stale := math.Float64frombits(staleNaN)
+	ts := []prompb.TimeSeries{
+		relayPathTimeSeries(peerPathRTTMetricName, r.hostname, peerPathDirect, "", instance, at, stale),
+		relayPathTimeSeries(peerRelayPenaltyMetricName, r.hostname, "", "", instance, at, stale),
+	}
+	if r.region != "" {
+		ts = append(ts, relayPathTimeSeries(peerPathRTTMetricName, r.hostname, peerPathDERP, r.region, instance, at, stale))
+	}
+	return ts
+}
+
+// status returns the latest measurement of the paths to every peer, ordered
+// by penalty, highest first, followed by peers without one.
+func (t *relayPathTracker) status() []relayPathStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ret := make([]relayPathStatus, 0, len(t.latest))
+	for _, r := range t.latest {
+		st := relayPathStatus{
+			Hostname:   r.hostname,
+			At:         r.at,
+			DirectRTT:  r.direct,
+			DERPRTT:    r.derp,
+			DERPRegion: r.region,
+		}
+		if d, ok := r.penalty(); ok {
+			st.Penalty = &d
+		}
+		ret = append(ret, st)
+	}
+	slices.SortFunc(ret, func(a, b relayPathStatus) int {
+		switch {
+		case a.Penalty != nil && b.Penalty != nil:
+			return cmp.Or(cmp.Compare(*b.Penalty, *a.Penalty), cmp.Compare(a.Hostname, b.Hostname))
+		case a.Penalty != nil:
+			return -1
+		case b.Penalty != nil:
+			return 1
+		}
+		return cmp.Compare(a.Hostname, b.Hostname)
+	})
+	return ret
+}
@@ -0,0 +1,79 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// fakePinger answers disco pings of peers by IP: small pings directly if the
+// peer has a direct path, and pings too large for it via DERP.
+type fakePinger struct {
+	direct map[netip.Addr]bool
+}
+
+func (p *fakePinger) PingWithOpts(ctx context.Context, ip netip.Addr, pingtype tailcfg.PingType, opts tailscale.PingOpts) (*ipnstate.PingResult, error) {
+	if pingtype != tailcfg.PingDisco {
+		return nil, errors.New("unexpected ping type")
+	}
+	direct, ok := p.direct[ip]
+	if !ok {
+		return &ipnstate.PingResult{Err: "no matching peer"}, nil
+	}
+	if direct && opts.Size == 0 {
+		return &ipnstate.PingResult{LatencySeconds: 0.010, Endpoint: "192.0.2.1:41641"}, nil
+	}
+	return &ipnstate.PingResult{LatencySeconds: 0.045, DERPRegionID: 1, DERPRegionCode: "nyc"}, nil
+}
+
+func TestRelayPaths(t *testing.T) {
+	directIP, cgnatIP := netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("100.64.0.2")
+	p := &fakePinger{direct: map[netip.Addr]bool{directIP: true, cgnatIP: false}}
+	st := &ipnstate.Status{Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+		key.NewNode().Public(): {HostName: "direct", Online: true, TailscaleIPs: []netip.Addr{directIP}},
+		key.NewNode().Public(): {HostName: "cgnat", Online: true, TailscaleIPs: []netip.Addr{cgnatIP}},
+		key.NewNode().Public(): {HostName: "offline", TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.3")}},
+	}}
+	results := measureAllRelayPaths(context.Background(), p, st)
+	if len(results) != 2 {
+		t.Fatalf("measured %d peers, want 2", len(results))
+	}
+
+	tr := newRelayPathTracker()
+	// Both peers have a direct RTT, DERP RTT and penalty series.
+	if ts := tr.update(results, "test"); len(ts) != 6 {
+		t.Errorf("update() = %d timeseries, want 6", len(ts))
+	}
+	status := tr.status()
+	if len(status) != 2 || status[0].Hostname != "direct" || status[0].Penalty == nil || *status[0].Penalty != 35*time.Millisecond {
+		t.Fatalf("status() = %+v, want direct first with a penalty of 35ms", status)
+	}
+	if cgnat := status[1]; cgnat.DirectRTT != nil || cgnat.DERPRTT == nil || cgnat.DERPRegion != "nyc" || cgnat.Penalty != nil {
+		t.Errorf("status of cgnat peer = %+v", cgnat)
+	}
+
+	// Peers going away are marked stale.
+	var stale int
+	for _, ts := range tr.update(nil, "test") {
+		if math.Float64bits(ts.Samples[0].Value) == staleNaN {
+			stale++
+		}
+	}
+	if stale != 6 {
+		t.Errorf("update() without peers = %d stale markers, want 6", stale)
+	}
+	if len(tr.staleMarkers("test")) != 0 {
+		t.Error("staleMarkers() after peers went away not empty")
+	}
+}
@@ -0,0 +1,490 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const defaultReportRange = 24 * time.Hour
+
+// runReport implements the report subcommand, writing a latency attribution
+// report for a target over stored results to w. args are the subcommand's
+// arguments.
+func runReport(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	storeDir := fs.String("store-dir", "", "directory of the store to report on")
+	hostname := fs.String("hostname", "", "hostname of the target to report on")
+	from := fs.String("from", "", "start of the time range in RFC 3339 format; defaults to 24 hours before --to")
+	to := fs.String("to", "", "end of the time range in RFC 3339 format; defaults to now")
+	format := fs.String("format", "markdown", "report format, markdown or html")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(*storeDir) < 1 || len(*hostname) < 1 {
+		return errors.New("report requires the store-dir and hostname flags")
+	}
+	if *format != "markdown" && *format != "html" {
+		return fmt.Errorf("unknown report format %q", *format)
+	}
+	fromTime, toTime, err := parseTimeRange(url.Values{"from": {*from}, "to": {*to}}, defaultReportRange)
+	if err != nil {
+		return err
+	}
+	store, err := openResultsStoreReadOnly(*storeDir)
+	if err != nil {
+		return err
+	}
+	var results []storedResult
+	err = store.readRange(fromTime, toTime, func(sr storedResult) error {
+		if sr.Hostname == *hostname {
+			results = append(results, sr)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	rep := buildReport(*hostname, fromTime, toTime, results)
+	if *format == "html" {
+		return reportHTMLTemplate.Execute(w, rep)
+	}
+	return reportMarkdownTemplate.Execute(w, rep)
+}
+
+// report attributes the latency of a target over a time range to the
+// components of the path, by comparing the results of probes differing in a
+// single dimension.
+type report struct {
+	Hostname string
+	From, To time.Time
+	Results  int
+	// Attribution breaks down the RTT of the highest protocol layer probed
+	// into the contributions of the layers beneath it, by address family.
+	Attribution []reportAttribution
+	// Consistency classifies every address of the target by whether its
+	// protocols disagree persistently over the time range.
+	Consistency []consistencyStatus
+	Sections    []reportSection
+}
+
+// reportAttribution is the attribution of the RTT of an address family.
+type reportAttribution struct {
+	Family     string
+	Components []reportComponent
+}
+
+// reportComponent is the contribution of a layer to the RTT.
+type reportComponent struct {
+	Name   string
+	Median time.Duration
+	Note   string
+}
+
+// reportSection compares the results of a target by a single dimension.
+type reportSection struct {
+	Title string
+	Note  string
+	Rows  []reportRow
+}
+
+// reportRow summarizes the results of a protocol with a value of the
+// section's dimension.
+type reportRow struct {
+	Protocol protocol
+	Value    string
+	Samples  int
+	Failures int
+	Median   time.Duration
+	P90      time.Duration
+	// Delta is the difference in median from the first row of the same
+	// protocol, if any.
+	Delta string
+}
+
+// reportDimensions are the dimensions reports compare results by. Within a
+// protocol, differences in median RTT between values of a dimension are
+// attributable to it.
+var reportDimensions = []struct {
+	title string
+	note  string
+	value func(storedResult) string
+}{
+	{
+		"Address family",
+		"Differences indicate IPv4 and IPv6 taking different paths, or translation on one of them.",
+		addressFamily,
+	},
+	{
+		"Direct vs. relayed",
+		"Relayed probes traverse --proxy or address family translation; differences are the cost of the relay.",
+		func(sr storedResult) string {
+			switch {
+			case sr.Proxy != "":
+				return "proxy " + sr.Proxy
+			case sr.Xlat != "":
+				return "xlat " + sr.Xlat
+			}
+			return "direct"
+		},
+	},
+	{
+		"Local stack",
+		"Userspace timestamps include scheduling and socket overhead on this host that kernel and raw timestamps exclude.",
+		func(sr storedResult) string { return sr.TimestampSource },
+	},
+	{
+		"Connection reuse",
+		"Unstable conns use a new 5-tuple every probe, and may be hashed to different paths and server instances.",
+		func(sr storedResult) string {
+			if sr.StableConn {
+				return "stable"
+			}
+			return "unstable"
+		},
+	},
+	{
+		"First vs. steady-state transactions",
+		"The first transaction over a stable conn after it is (re)established pays session setup, e.g. a CGNAT creating a mapping, which steady-state transactions do not.",
+		func(sr storedResult) string {
+			switch {
+			case !sr.StableConn:
+				return "unstable conn"
+			case sr.First:
+				return "first"
+			}
+			return "steady state"
+		},
+	},
+	{
+		"Probe order",
+		"The protocols of a target are sent in a random order every window; differences indicate earlier protocols changing the queue state later ones measure.",
+		func(sr storedResult) string {
+			if sr.Order == 0 {
+				return "unrecorded"
+			}
+			return fmt.Sprintf("sent %s", ordinal(sr.Order))
+		},
+	},
+	{
+		"Idle vs. loaded",
+		"Peak hours are the 4 local hours of the day with the highest median RTT, off-peak hours the 4 with the lowest; differences indicate congestion.",
+		nil, // see loadValues
+	},
+}
+
+// ordinal returns n as an English ordinal, e.g. "2nd".
+func ordinal(n int) string {
+	suffix := "th"
+	switch {
+	case n%100 >= 11 && n%100 <= 13:
+	case n%10 == 1:
+		suffix = "st"
+	case n%10 == 2:
+		suffix = "nd"
+	case n%10 == 3:
+		suffix = "rd"
+	}
+	return fmt.Sprintf("%d%s", n, suffix)
+}
+
+func addressFamily(sr storedResult) string {
+	if sr.Addr.Is4() {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// buildReport returns the report of results of hostname between from and to.
+func buildReport(hostname string, from, to time.Time, results []storedResult) *report {
+	rep := &report{Hostname: hostname, From: from, To: to, Results: len(results)}
+	byFamily := make(map[string][]storedResult)
+	for _, sr := range results {
+		f := addressFamily(sr)
+		byFamily[f] = append(byFamily[f], sr)
+	}
+	for _, f := range []string{"ipv4", "ipv6"} {
+		if rs, ok := byFamily[f]; ok {
+			rep.Attribution = append(rep.Attribution, reportAttribution{Family: f, Components: attribute(rs)})
+		}
+	}
+	rep.Consistency = consistencyOf(results)
+	for _, d := range reportDimensions {
+		value := d.value
+		if value == nil {
+			value = loadValues(results)
+		}
+		if rows := compareBy(results, value); len(rows) > 0 {
+			rep.Sections = append(rep.Sections, reportSection{Title: d.title, Note: d.note, Rows: rows})
+		}
+	}
+	return rep
+}
+
+// consistencyOf classifies every target in results, see
+// classifyConsistency. Results are windowed by their time.
+func consistencyOf(results []storedResult) []consistencyStatus {
+	byWindow := make(map[time.Time][]result)
+	for _, sr := range results {
+		r := sr.toResult()
+		byWindow[r.at] = append(byWindow[r.at], r)
+	}
+	windows := make(map[nodeMeta][]protocolRTTs)
+	for _, at := range slices.SortedFunc(maps.Keys(byWindow), time.Time.Compare) {
+		for meta, rtts := range protocolRTTsByTarget(byWindow[at]) {
+			windows[meta] = append(windows[meta], rtts)
+		}
+	}
+	var ret []consistencyStatus
+	for meta, w := range windows {
+		ret = append(ret, classifyConsistency(meta, w))
+	}
+	sortConsistencyStatuses(ret)
+	return ret
+}
+
+// medianRTTOf returns the median RTT of the successful results in rs, and
+// whether there are any.
+func medianRTTOf(rs []storedResult) (time.Duration, bool) {
+	var rtts []time.Duration
+	for _, sr := range rs {
+		if sr.RTTNanos != nil {
+			rtts = append(rtts, time.Duration(*sr.RTTNanos))
+		}
+	}
+	if len(rtts) == 0 {
+		return 0, false
+	}
+	return medianOf(rtts), true
+}
+
+// attribute breaks down the RTT of results by protocol layer. Only direct
+// results are considered, as relays add their own layers.
+func attribute(results []storedResult) []reportComponent {
+	byProtocol := make(map[protocol][]storedResult)
+	for _, sr := range results {
+		if sr.Proxy == "" && sr.Xlat == "" {
+			byProtocol[sr.Protocol] = append(byProtocol[sr.Protocol], sr)
+		}
+	}
+	medians := make(map[protocol]time.Duration)
+	for p, rs := range byProtocol {
+		if m, ok := medianRTTOf(rs); ok {
+			medians[p] = m
+		}
+	}
+	ret := []reportComponent{{
+		Name: "DNS",
+		Note: "not measured: targets are probed by address from the DERP map",
+	}}
+	transport, ok := medians[protocolICMP]
+	if ok {
+		ret = append(ret, reportComponent{Name: "Transport", Median: transport, Note: "ICMP echo RTT"})
+	} else if transport, ok = medians[protocolSTUN]; ok {
+		ret = append(ret, reportComponent{Name: "Transport", Median: transport, Note: "STUN RTT, including server processing, as ICMP was not probed"})
+	} else {
+		ret = append(ret, reportComponent{Name: "Transport", Note: "not measured: probe ICMP or STUN"})
+	}
+	if m, ok := medians[protocolTCP]; ok && transport > 0 {
+		ret = append(ret, reportComponent{Name: "Connect", Median: m - transport, Note: "TCP handshake RTT over transport"})
+	} else {
+		ret = append(ret, reportComponent{Name: "Connect", Note: "not measured: probe TCP alongside ICMP or STUN"})
+	}
+	if m, ok := medians[protocolHTTPS]; ok {
+		if tcp, ok := medians[protocolTCP]; ok {
+			ret = append(ret, reportComponent{Name: "TLS and HTTP", Median: m - tcp, Note: "HTTPS RTT over TCP handshake RTT"})
+		} else {
+			ret = append(ret, reportComponent{Name: "TLS and HTTP", Note: "not measured: probe TCP alongside HTTPS"})
+		}
+	}
+	return ret
+}
+
+// loadValues returns a dimension classifying results into peak and off-peak
+// hours of the day, see reportDimensions.
+func loadValues(results []storedResult) func(storedResult) string {
+	byHour := make(map[int][]storedResult)
+	for _, sr := range results {
+		h := sr.At.Local().Hour()
+		byHour[h] = append(byHour[h], sr)
+	}
+	type hourMedian struct {
+		hour   int
+		median time.Duration
+	}
+	var hours []hourMedian
+	for h, rs := range byHour {
+		if m, ok := medianRTTOf(rs); ok {
+			hours = append(hours, hourMedian{h, m})
+		}
+	}
+	const n = 4
+	if len(hours) < 2*n {
+		return func(storedResult) string { return "" }
+	}
+	slices.SortFunc(hours, func(a, b hourMedian) int {
+		return cmp.Or(cmp.Compare(a.median, b.median), cmp.Compare(a.hour, b.hour))
+	})
+	class := make(map[int]string)
+	for _, h := range hours[:n] {
+		class[h.hour] = "off-peak"
+	}
+	for _, h := range hours[len(hours)-n:] {
+		class[h.hour] = "peak"
+	}
+	return func(sr storedResult) string { return class[sr.At.Local().Hour()] }
+}
+
+// compareBy returns rows summarizing results by protocol and value, ordered
+// by protocol and value. Results for which value
+// returns the empty string are excluded, as are protocols with a single
+// value, which offer nothing to compare.
+func compareBy(results []storedResult, value func(storedResult) string) []reportRow {
+	type key struct {
+		p protocol
+		v string
+	}
+	groups := make(map[key][]storedResult)
+	var values []string
+	for _, sr := range results {
+		v := value(sr)
+		if v == "" {
+			continue
+		}
+		if !slices.Contains(values, v) {
+			values = append(values, v)
+		}
+		k := key{sr.Protocol, v}
+		groups[k] = append(groups[k], sr)
+	}
+	slices.Sort(values)
+	var ret []reportRow
+	for _, p := range allProtocols {
+		var rows []reportRow
+		for _, v := range values {
+			rs, ok := groups[key{p, v}]
+			if !ok {
+				continue
+			}
+			rows = append(rows, summarize(p, v, rs))
+		}
+		if len(rows) < 2 {
+			continue
+		}
+		for i := range rows[1:] {
+			r := &rows[i+1]
+			if r.Samples > r.Failures && rows[0].Samples > rows[0].Failures {
+				d := r.Median - rows[0].Median
+				r.Delta = d.String()
+				if d >= 0 {
+					r.Delta = "+" + r.Delta
+				}
+			}
+		}
+		ret = append(ret, rows...)
+	}
+	return ret
+}
+
+func summarize(p protocol, v string, rs []storedResult) reportRow {
+	row := reportRow{Protocol: p, Value: v, Samples: len(rs)}
+	var rtts []time.Duration
+	for _, sr := range rs {
+		if sr.RTTNanos == nil {
+			row.Failures++
+			continue
+		}
+		rtts = append(rtts, time.Duration(*sr.RTTNanos))
+	}
+	if len(rtts) > 0 {
+		row.Median = medianOf(rtts).Round(time.Microsecond)
+		slices.Sort(rtts)
+		row.P90 = rtts[(len(rtts)-1)*9/10].Round(time.Microsecond)
+	}
+	return row
+}
+
+var reportFuncs = map[string]any{
+	"round": func(d time.Duration) time.Duration { return d.Round(time.Microsecond) },
+	"time":  func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+	"pipe":  func(s string) string { return strings.ReplaceAll(s, "|", `\|`) },
+	"medians": func(m map[protocol]time.Duration) string {
+		var parts []string
+		for _, p := range slices.Sorted(maps.Keys(m)) {
+			parts = append(parts, fmt.Sprintf("%s %v", p, m[p].Round(time.Microsecond)))
+		}
+		return strings.Join(parts, ", ")
+	},
+}
+
+var reportMarkdownTemplate = template.Must(template.New("report").Funcs(reportFuncs).Parse(`# Latency report: {{.Hostname}}
+
+{{time .From}} to {{time .To}}, {{.Results}} results.
+{{if .Results}}
+{{range .Attribution}}
+## Attribution ({{.Family}})
+
+| Component | Median | Note |
+|---|---|---|
+{{range .Components}}| {{.Name}} | {{if .Median}}{{round .Median}}{{end}} | {{pipe .Note}} |
+{{end}}{{end}}{{if .Consistency}}
+## Cross-protocol consistency
+
+Protocols persistently slower than the fastest indicate shaping specific to them, e.g. by a CGNAT.
+
+| Address | Classification | Windows | Medians | Slow |
+|---|---|---|---|---|
+{{range .Consistency}}| {{.Addr}} | {{.Classification}} | {{.Windows}} | {{medians .Medians}} | {{range $i, $p := .Slow}}{{if $i}}, {{end}}{{$p}}{{end}} |
+{{end}}{{end}}{{range .Sections}}
+## {{.Title}}
+
+{{.Note}}
+
+| Protocol | Value | Samples | Failures | Median | p90 | Δ median |
+|---|---|---|---|---|---|---|
+{{range .Rows}}| {{.Protocol}} | {{pipe .Value}} | {{.Samples}} | {{.Failures}} | {{.Median}} | {{.P90}} | {{.Delta}} |
+{{end}}{{end}}{{end}}`))
+
+var reportHTMLTemplate = htmltemplate.Must(htmltemplate.New("report").Funcs(reportFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head><title>Latency report: {{.Hostname}}</title></head>
+<body>
+<h1>Latency report: {{.Hostname}}</h1>
+<p>{{time .From}} to {{time .To}}, {{.Results}} results.</p>
+{{if .Results}}
+{{range .Attribution}}
+<h2>Attribution ({{.Family}})</h2>
+<table border="1" cellpadding="4">
+<tr><th>Component</th><th>Median</th><th>Note</th></tr>
+{{range .Components}}<tr><td>{{.Name}}</td><td>{{if .Median}}{{round .Median}}{{end}}</td><td>{{.Note}}</td></tr>
+{{end}}</table>
+{{end}}{{if .Consistency}}
+<h2>Cross-protocol consistency</h2>
+<p>Protocols persistently slower than the fastest indicate shaping specific to them, e.g. by a CGNAT.</p>
+<table border="1" cellpadding="4">
+<tr><th>Address</th><th>Classification</th><th>Windows</th><th>Medians</th><th>Slow</th></tr>
+{{range .Consistency}}<tr><td>{{.Addr}}</td><td>{{.Classification}}</td><td>{{.Windows}}</td><td>{{medians .Medians}}</td><td>{{range $i, $p := .Slow}}{{if $i}}, {{end}}{{$p}}{{end}}</td></tr>
+{{end}}</table>
+{{end}}{{range .Sections}}
+<h2>{{.Title}}</h2>
+<p>{{.Note}}</p>
+<table border="1" cellpadding="4">
+<tr><th>Protocol</th><th>Value</th><th>Samples</th><th>Failures</th><th>Median</th><th>p90</th><th>Δ median</th></tr>
+{{range .Rows}}<tr><td>{{.Protocol}}</td><td>{{.Value}}</td><td>{{.Samples}}</td><td>{{.Failures}}</td><td>{{.Median}}</td><td>{{.P90}}</td><td>{{.Delta}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,118 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildReport(t *testing.T) {
+	start := time.Date(2024, 7, 1, 0, 0, 0, 0, time.Local)
+	v4, v6 := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")
+	var results []storedResult
+	add := func(at time.Time, addr netip.Addr, p protocol, rtt time.Duration) {
+		ns := int64(rtt)
+		results = append(results, storedResult{
+			At:              at,
+			Hostname:        "derp1a",
+			Addr:            addr,
+			Protocol:        p,
+			TimestampSource: "kernel",
+			StableConn:      true,
+			RTTNanos:        &ns,
+		})
+	}
+	for h := range 24 {
+		at := start.Add(time.Duration(h) * time.Hour)
+		// Evenings are congested.
+		load := time.Duration(0)
+		if h >= 18 && h < 22 {
+			load = 5 * time.Millisecond
+		}
+		add(at, v4, protocolICMP, 10*time.Millisecond+load)
+		add(at, v4, protocolTCP, 12*time.Millisecond+load)
+		add(at, v4, protocolHTTPS, 30*time.Millisecond+load)
+		add(at, v6, protocolICMP, 15*time.Millisecond+load)
+	}
+	results = append(results, storedResult{At: start, Hostname: "derp1a", Addr: v4, Protocol: protocolICMP, TimestampSource: "kernel", StableConn: true})
+
+	rep := buildReport("derp1a", start, start.Add(24*time.Hour), results)
+	if len(rep.Attribution) != 2 || rep.Attribution[0].Family != "ipv4" || rep.Attribution[1].Family != "ipv6" {
+		t.Fatalf("got attribution %+v, want ipv4 and ipv6", rep.Attribution)
+	}
+	components := make(map[string]time.Duration)
+	for _, c := range rep.Attribution[0].Components {
+		components[c.Name] = c.Median
+	}
+	want := map[string]time.Duration{
+		"DNS":          0,
+		"Transport":    10 * time.Millisecond,
+		"Connect":      2 * time.Millisecond,
+		"TLS and HTTP": 18 * time.Millisecond,
+	}
+	for name, d := range want {
+		if got, ok := components[name]; !ok || got != d {
+			t.Errorf("ipv4 attribution of %s = %v, want %v", name, got, d)
+		}
+	}
+
+	// ICMP and TCP agree on ipv4, and ipv6 has a single protocol.
+	if len(rep.Consistency) != 2 {
+		t.Fatalf("got consistency %+v, want ipv4 and ipv6", rep.Consistency)
+	}
+	for _, st := range rep.Consistency {
+		want := consistencyConsistent
+		if st.Addr == v6.String() {
+			want = consistencyInsufficientData
+		}
+		if st.Classification != want {
+			t.Errorf("%s classified as %s, want %s", st.Addr, st.Classification, want)
+		}
+	}
+
+	sections := make(map[string]reportSection)
+	for _, s := range rep.Sections {
+		sections[s.Title] = s
+	}
+	if _, ok := sections["Local stack"]; ok {
+		t.Error("got local stack section for a single timestamp source")
+	}
+	af, ok := sections["Address family"]
+	if !ok || len(af.Rows) != 2 {
+		t.Fatalf("got address family section %+v, want ICMP rows for ipv4 and ipv6", af)
+	}
+	if r := af.Rows[0]; r.Value != "ipv4" || r.Samples != 25 || r.Failures != 1 || r.Median != 10*time.Millisecond {
+		t.Errorf("ipv4 row = %+v", r)
+	}
+	if r := af.Rows[1]; r.Value != "ipv6" || r.Delta != "+5ms" {
+		t.Errorf("ipv6 row = %+v", r)
+	}
+	load, ok := sections["Idle vs. loaded"]
+	if !ok || len(load.Rows) != 6 {
+		t.Fatalf("got load section %+v, want off-peak and peak rows of 3 protocols", load)
+	}
+	for _, r := range load.Rows {
+		if r.Value == "peak" && r.Delta != "+5ms" {
+			t.Errorf("peak row = %+v, want +5ms", r)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := reportMarkdownTemplate.Execute(&buf, rep); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# Latency report: derp1a", "## Attribution (ipv6)", "| TLS and HTTP | 18ms |", "## Address family", "| icmp | ipv6 | 24 | 0 | 15ms | 20ms | +5ms |"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("markdown report lacks %q:\n%s", want, buf.String())
+		}
+	}
+	buf.Reset()
+	if err := reportHTMLTemplate.Execute(&buf, rep); err != nil {
+		t.Fatal(err)
+	}
+}
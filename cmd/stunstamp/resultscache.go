@@ -0,0 +1,91 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	resultsCacheHits   = expvar.NewInt("counter_results_cache_hits")
+	resultsCacheMisses = expvar.NewInt("counter_results_cache_misses")
+)
+
+// resultsCache holds the results written to a store in the last window in
+// memory, so that queries of recent results, e.g. by the web UI and Grafana,
+// are served without reading the store from disk. Reads are lock-free:
+// writers publish immutable snapshots, which readers load atomically.
+type resultsCache struct {
+	window time.Duration
+
+	mu   sync.Mutex // serializes writers
+	snap atomic.Pointer[resultsCacheSnapshot]
+}
+
+// resultsCacheSnapshot is the content of a resultsCache at a point in time.
+// It is never modified once published.
+type resultsCacheSnapshot struct {
+	// since is the earliest time results are held from: every result
+	// written with an At at or after since is in results.
+	since time.Time
+	// results are in the order they were written. Writers only ever append
+	// beyond the length of published results, so they may share an array.
+	results []storedResult
+}
+
+// newResultsCache returns a cache of the results written from now on, holding
+// those of the last window.
+func newResultsCache(window time.Duration) *resultsCache {
+	c := &resultsCache{window: window}
+	c.snap.Store(&resultsCacheSnapshot{since: time.Now()})
+	return c
+}
+
+// add adds results, which have been written to the store, evicting results
+// older than the window.
+func (c *resultsCache) add(results []result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old := c.snap.Load()
+	next := &resultsCacheSnapshot{since: old.since, results: old.results}
+	cutoff := time.Now().Add(-c.window)
+	if cutoff.After(next.since) {
+		// Results are written roughly in order of At; stragglers before
+		// cutoff are left for readers to skip.
+		i := 0
+		for i < len(next.results) && next.results[i].At.Before(cutoff) {
+			i++
+		}
+		next.results = next.results[i:]
+		next.since = cutoff
+	}
+	for _, r := range results {
+		next.results = append(next.results, storedResultFromResult(r))
+	}
+	c.snap.Store(next)
+}
+
+// readRange calls fn for every cached result with from <= At < to, in the
+// order they were written, if the cache holds every result in the range. It
+// reports whether it did, counting a hit or miss.
+func (c *resultsCache) readRange(from, to time.Time, fn func(storedResult) error) (ok bool, err error) {
+	snap := c.snap.Load()
+	if from.Before(snap.since) {
+		resultsCacheMisses.Add(1)
+		return false, nil
+	}
+	resultsCacheHits.Add(1)
+	for _, sr := range snap.results {
+		if sr.At.Before(from) || !sr.At.Before(to) {
+			continue
+		}
+		if err := fn(sr); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
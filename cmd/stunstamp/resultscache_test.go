@@ -0,0 +1,92 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestResultsCache(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("open results files cannot be removed on windows")
+	}
+	dir := t.TempDir()
+	s, err := openResultsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	s.cache = newResultsCache(time.Hour)
+	start := s.cache.snap.Load().since
+	rtt := time.Millisecond
+	r := result{
+		key: resultKey{
+			meta:     nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")},
+			protocol: protocolSTUN,
+			dstPort:  3478,
+		},
+		at:  time.Now(),
+		rtt: &rtt,
+	}
+	if err := s.append([]result{r, r}); err != nil {
+		t.Fatal(err)
+	}
+	// Results held by the cache are served without reading the store.
+	if err := os.Remove(filepath.Join(dir, resultsFileName(r.at.UTC().Format(storeDayLayout)))); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(from time.Time) int {
+		t.Helper()
+		n := 0
+		if err := s.readRange(from, time.Now().Add(time.Minute), func(storedResult) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	hits, misses := resultsCacheHits.Value(), resultsCacheMisses.Value()
+	if got := count(start); got != 2 {
+		t.Errorf("cached results = %d, want 2", got)
+	}
+	if got := resultsCacheHits.Value() - hits; got != 1 {
+		t.Errorf("hits = %d, want 1", got)
+	}
+	// Ranges predating the cache are read from the store.
+	if got := count(start.Add(-time.Minute)); got != 0 {
+		t.Errorf("stored results = %d, want 0", got)
+	}
+	if got := resultsCacheMisses.Value() - misses; got != 1 {
+		t.Errorf("misses = %d, want 1", got)
+	}
+}
+
+func TestResultsCacheEviction(t *testing.T) {
+	c := newResultsCache(time.Minute)
+	c.snap.Store(&resultsCacheSnapshot{since: time.Now().Add(-time.Hour)})
+	old, recent := time.Now().Add(-10*time.Minute), time.Now()
+	c.add([]result{{at: old}, {at: recent}})
+	before := c.snap.Load()
+	c.add([]result{{at: recent}})
+	after := c.snap.Load()
+	if len(before.results) != 2 {
+		t.Errorf("published snapshot modified: %d results, want 2", len(before.results))
+	}
+	if len(after.results) != 2 || after.results[0].At.Before(old.Add(time.Second)) {
+		t.Errorf("results after eviction = %v, want 2 recent", after.results)
+	}
+	if !after.since.After(old) {
+		t.Errorf("since = %v, want after %v", after.since, old)
+	}
+	if ok, _ := c.readRange(old, time.Now(), func(storedResult) error { return nil }); ok {
+		t.Error("readRange() of evicted range succeeded")
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// retryPolicy describes how many probes are sent per window for a given
+// protocol, and how their outcomes are reduced to a single result.
+type retryPolicy struct {
+	// Attempts is the number of probes (N) sent per window. Zero is treated
+	// as 1.
+	Attempts int `json:",omitempty"`
+	// MinSuccesses is the number of successful probes (K) required for the
+	// window to be considered successful. Zero is treated as 1.
+	MinSuccesses int `json:",omitempty"`
+	// Aggregate is how successful probes are reduced to a single RTT, one of
+	// "median" (default) or "min".
+	Aggregate string `json:",omitempty"`
+}
+
+const (
+	aggregateMedian = "median"
+	aggregateMin    = "min"
+)
+
+// maxAttempts bounds retryPolicy.Attempts. Attempts are made sequentially on
+// the same conn, so this bounds the worst case duration of a window.
+const maxAttempts = 3
+
+func (p retryPolicy) attempts() int {
+	return max(p.Attempts, 1)
+}
+
+func (p retryPolicy) minSuccesses() int {
+	return max(p.MinSuccesses, 1)
+}
+
+func (p retryPolicy) validate() error {
+	if p.Attempts < 0 || p.Attempts > maxAttempts {
+		return fmt.Errorf("Attempts must be between 1 and %d", maxAttempts)
+	}
+	if p.MinSuccesses < 0 || p.minSuccesses() > p.attempts() {
+		return fmt.Errorf("MinSuccesses must be between 1 and Attempts (%d)", p.attempts())
+	}
+	switch p.Aggregate {
+	case "", aggregateMedian, aggregateMin:
+	default:
+		return fmt.Errorf("unknown Aggregate %q, want %q or %q", p.Aggregate, aggregateMedian, aggregateMin)
+	}
+	return nil
+}
+
+// reduce returns the aggregate of successes, or false if there are fewer
+// than the required number of successes.
+func (p retryPolicy) reduce(successes []time.Duration) (time.Duration, bool) {
+	if len(successes) == 0 || len(successes) < p.minSuccesses() {
+		return 0, false
+	}
+	if p.Aggregate == aggregateMin {
+		return slices.Min(successes), true
+	}
+	return medianOf(successes), true
+}
@@ -0,0 +1,62 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	ms := func(d ...int) (ret []time.Duration) {
+		for _, v := range d {
+			ret = append(ret, time.Duration(v)*time.Millisecond)
+		}
+		return ret
+	}
+	tests := []struct {
+		name      string
+		policy    retryPolicy
+		successes []time.Duration
+		want      time.Duration
+		wantOK    bool
+	}{
+		{"zero_value_single", retryPolicy{}, ms(5), 5 * time.Millisecond, true},
+		{"zero_value_none", retryPolicy{}, nil, 0, false},
+		{"median", retryPolicy{Attempts: 3, MinSuccesses: 2}, ms(9, 3, 5), 5 * time.Millisecond, true},
+		{"min", retryPolicy{Attempts: 3, MinSuccesses: 2, Aggregate: aggregateMin}, ms(9, 3, 5), 3 * time.Millisecond, true},
+		{"too_few", retryPolicy{Attempts: 3, MinSuccesses: 2}, ms(9), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.validate(); err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			got, ok := tt.policy.reduce(tt.successes)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("reduce() = %v, %v; want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseConfigRetry(t *testing.T) {
+	c, err := parseConfig([]byte(`{"Retry": {"icmp": {"Attempts": 3, "MinSuccesses": 2, "Aggregate": "min"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Retry[protocolICMP]; got.attempts() != 3 || got.minSuccesses() != 2 {
+		t.Errorf("unexpected policy: %+v", got)
+	}
+	for _, bad := range []string{
+		`{"Retry": {"quic": {"Attempts": 2}}}`,
+		`{"Retry": {"stun": {"Attempts": 2, "MinSuccesses": 3}}}`,
+		`{"Retry": {"stun": {"Attempts": 10}}}`,
+		`{"Retry": {"stun": {"Aggregate": "mean"}}}`,
+	} {
+		if _, err := parseConfig([]byte(bad)); err == nil {
+			t.Errorf("parseConfig(%s) unexpectedly succeeded", bad)
+		}
+	}
+}
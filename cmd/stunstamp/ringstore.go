@@ -0,0 +1,344 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storeLayout is the layout of results in a store directory.
+type storeLayout string
+
+const (
+	// storeLayoutJSONL stores every result in append-only daily files, see
+	// resultsStore.
+	storeLayoutJSONL storeLayout = "jsonl"
+	// storeLayoutRing stores fixed-size ring buffers of results per series,
+	// downsampled on write, see ringStore.
+	storeLayoutRing storeLayout = "ring"
+	// storeLayoutSharded stores every result in append-only daily files
+	// sharded by region, written concurrently, see shardStore.
+	storeLayoutSharded storeLayout = "sharded"
+)
+
+// storeLayoutFile is the name of the file recording the layout of a store
+// directory. Directories without it hold the jsonl layout.
+const storeLayoutFile = "layout"
+
+// readStoreLayout returns the layout of the store directory dir, and whether
+// it is recorded.
+func readStoreLayout(dir string) (storeLayout, bool, error) {
+	b, err := os.ReadFile(filepath.Join(dir, storeLayoutFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return storeLayoutJSONL, false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	l := storeLayout(strings.TrimSpace(string(b)))
+	if l != storeLayoutJSONL && l != storeLayoutRing && l != storeLayoutSharded {
+		return "", false, fmt.Errorf("unknown store layout %q in %s", l, dir)
+	}
+	return l, true, nil
+}
+
+// ringResolution is a resolution a ring holds results at.
+type ringResolution struct {
+	step  time.Duration
+	slots int
+}
+
+// retention returns how far back r holds results.
+func (r ringResolution) retention() time.Duration {
+	return r.step * time.Duration(r.slots)
+}
+
+// ringResolutions are the resolutions every series is held at, finest first.
+var ringResolutions = []ringResolution{
+	{time.Second, 60 * 60},     // an hour
+	{time.Minute, 7 * 24 * 60}, // a week
+	{time.Hour, 2 * 365 * 24},  // two years
+}
+
+const (
+	ringDirName    = "ring"
+	ringFileSuffix = ".ring"
+	// ringHeaderSize is the size of the header of a ring file holding the
+	// series as JSON, padded with NULs.
+	ringHeaderSize = 1024
+	ringSlotSize   = 24
+)
+
+// ringSlot is the aggregate of the results of a series in a step.
+type ringSlot struct {
+	start    int64 // Unix seconds, zero if empty
+	count    uint32
+	failures uint32
+	sum      int64 // of the RTTs of successes, in nanoseconds
+}
+
+func (s ringSlot) marshal(b []byte) {
+	binary.LittleEndian.PutUint64(b[0:], uint64(s.start))
+	binary.LittleEndian.PutUint32(b[8:], s.count)
+	binary.LittleEndian.PutUint32(b[12:], s.failures)
+	binary.LittleEndian.PutUint64(b[16:], uint64(s.sum))
+}
+
+func unmarshalRingSlot(b []byte) ringSlot {
+	return ringSlot{
+		start:    int64(binary.LittleEndian.Uint64(b[0:])),
+		count:    binary.LittleEndian.Uint32(b[8:]),
+		failures: binary.LittleEndian.Uint32(b[12:]),
+		sum:      int64(binary.LittleEndian.Uint64(b[16:])),
+	}
+}
+
+// add accounts sr against s.
+func (s *ringSlot) add(sr storedResult) {
+	s.count++
+	if sr.RTTNanos == nil {
+		s.failures++
+		return
+	}
+	s.sum += *sr.RTTNanos
+}
+
+// ringOffset returns the offset in a ring file of the slot holding at in the
+// resolution with index res.
+func ringOffset(res int, at time.Time) int64 {
+	off := int64(ringHeaderSize)
+	for _, r := range ringResolutions[:res] {
+		off += int64(r.slots) * ringSlotSize
+	}
+	r := ringResolutions[res]
+	slot := at.Unix() / int64(r.step/time.Second) % int64(r.slots)
+	return off + slot*ringSlotSize
+}
+
+// ringFileSize is the size of every ring file.
+func ringFileSize() int64 {
+	size := int64(ringHeaderSize)
+	for _, r := range ringResolutions {
+		size += int64(r.slots) * ringSlotSize
+	}
+	return size
+}
+
+// ringSeriesOf returns the series sr belongs to: sr without the fields of a
+// single result.
+func ringSeriesOf(sr storedResult) storedResult {
+	sr.ID = ""
+	sr.At = time.Time{}
+	sr.Instance = ""
+	sr.RTTNanos = nil
+	sr.UserspaceRTTNanos = nil
+	sr.AttemptsNanos = nil
+	return sr
+}
+
+// ringStore persists results in a fixed-size file per series, holding a ring
+// buffer per resolution in ringResolutions that results are downsampled into
+// as they are written, in place. Disk usage is constant per series, at the
+// cost of holding aggregates rather than every result, which suits
+// permanently embedded probes, e.g. on CPE, with little storage.
+//
+// Readers in other processes may observe a slot torn by a concurrent write;
+// its results are then off for that step only.
+type ringStore struct {
+	dir string
+
+	mu    sync.Mutex
+	files map[string]*os.File // by series file name, written to
+}
+
+func newRingStore(dir string) *ringStore {
+	return &ringStore{dir: filepath.Join(dir, ringDirName), files: make(map[string]*os.File)}
+}
+
+// ringFileName returns the name of the file holding series.
+func ringFileName(series []byte) string {
+	sum := sha256.Sum256(series)
+	return hex.EncodeToString(sum[:16]) + ringFileSuffix
+}
+
+// fileLocked returns the file holding series, creating it if needed.
+func (s *ringStore) fileLocked(series storedResult) (*os.File, error) {
+	header, err := json.Marshal(series)
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > ringHeaderSize {
+		return nil, fmt.Errorf("ring header of %d bytes exceeds %d", len(header), ringHeaderSize)
+	}
+	name := ringFileName(header)
+	if f, ok := s.files[name]; ok {
+		return f, nil
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Size() != ringFileSize() {
+		// New, or created with different resolutions; start afresh.
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Truncate(ringFileSize()); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if _, err := f.WriteAt(header, 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	s.files[name] = f
+	return f, nil
+}
+
+// append downsamples results into the rings of their series.
+func (s *ringStore) append(results []result) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := make([]byte, ringSlotSize)
+	for _, r := range results {
+		sr := storedResultFromResult(r)
+		f, err := s.fileLocked(ringSeriesOf(sr))
+		if err != nil {
+			return err
+		}
+		for i, res := range ringResolutions {
+			off := ringOffset(i, sr.At)
+			if _, err := f.ReadAt(b, off); err != nil {
+				return err
+			}
+			slot := unmarshalRingSlot(b)
+			if start := sr.At.Truncate(res.step).Unix(); slot.start != start {
+				slot = ringSlot{start: start}
+			}
+			slot.add(sr)
+			slot.marshal(b)
+			if _, err := f.WriteAt(b, off); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// close closes the files written to.
+func (s *ringStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for name, f := range s.files {
+		errs = append(errs, f.Close())
+		delete(s.files, name)
+	}
+	return errors.Join(errs...)
+}
+
+// readRange calls fn for every step with results with from <= start < to, as
+// a storedResult at the start of the step with the mean RTT of its
+// successes, or a failure if it has none. Steps are read at the finest
+// resolution retaining from, and are ordered by start.
+func (s *ringStore) readRange(from, to time.Time, fn func(storedResult) error) error {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res := len(ringResolutions) - 1
+	for i, r := range ringResolutions {
+		if time.Since(from) <= r.retention() {
+			res = i
+			break
+		}
+	}
+	var ret []storedResult
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.HasSuffix(e.Name(), ringFileSuffix) {
+			continue
+		}
+		srs, err := s.readFile(filepath.Join(s.dir, e.Name()), res, from, to)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, srs...)
+	}
+	slices.SortStableFunc(ret, func(a, b storedResult) int {
+		return a.At.Compare(b.At)
+	})
+	for _, sr := range ret {
+		if err := fn(sr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ringStore) readFile(path string, res int, from, to time.Time) ([]storedResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, ringHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	var series storedResult
+	if err := json.Unmarshal(bytes.TrimRight(header, "\x00"), &series); err != nil {
+		return nil, fmt.Errorf("error decoding header of %s: %w", path, err)
+	}
+	r := ringResolutions[res]
+	b := make([]byte, r.slots*ringSlotSize)
+	if _, err := f.ReadAt(b, ringOffset(res, time.Unix(0, 0))); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	var ret []storedResult
+	for off := 0; off < len(b); off += ringSlotSize {
+		slot := unmarshalRingSlot(b[off:])
+		if slot.start == 0 || slot.count == 0 {
+			continue
+		}
+		at := time.Unix(slot.start, 0).UTC()
+		if at.Before(from) || !at.Before(to) {
+			continue
+		}
+		sr := series
+		sr.At = at
+		if successes := int64(slot.count - slot.failures); successes > 0 {
+			mean := slot.sum / successes
+			sr.RTTNanos = &mean
+		}
+		ret = append(ret, sr)
+	}
+	return ret, nil
+}
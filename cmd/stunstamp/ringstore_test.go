@@ -0,0 +1,94 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRingStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openResultsStoreLayout(dir, storeLayoutRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+	add := func(at time.Time, rtt *time.Duration) {
+		t.Helper()
+		err := s.append([]result{{
+			key: resultKey{meta: meta, protocol: protocolSTUN, dstPort: 3478},
+			at:  at,
+			rtt: rtt,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ms := func(n int) *time.Duration {
+		d := time.Duration(n) * time.Millisecond
+		return &d
+	}
+	add(start, ms(10))
+	add(start.Add(100*time.Millisecond), ms(20))
+	add(start.Add(200*time.Millisecond), nil)
+	add(start.Add(time.Second), nil)
+
+	ro, err := openResultsStoreReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []storedResult
+	err = ro.readRange(start.Add(-time.Second), time.Now(), func(sr storedResult) error {
+		got = append(got, sr)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d steps, want 2: %+v", len(got), got)
+	}
+	if !got[0].At.Equal(start) || got[0].Hostname != "1a" || got[0].RTTNanos == nil || *got[0].RTTNanos != int64(15*time.Millisecond) {
+		t.Errorf("first step = %+v, want the mean of successes", got[0])
+	}
+	if got[1].RTTNanos != nil {
+		t.Errorf("second step = %+v, want failure", got[1])
+	}
+
+	// Results a ring's length later overwrite the same slots, keeping disk
+	// usage constant.
+	add(start.Add(ringResolutions[0].retention()), ms(30))
+	entries, err := os.ReadDir(filepath.Join(dir, ringDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d ring files, want 1", len(entries))
+	}
+	fi, err := entries[0].Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != ringFileSize() {
+		t.Errorf("ring file size = %d, want %d", fi.Size(), ringFileSize())
+	}
+}
+
+func TestStoreLayoutMismatch(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openResultsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+	if _, err := openResultsStoreLayout(dir, storeLayoutRing); err == nil {
+		t.Error("opened jsonl store with the ring layout")
+	}
+}
@@ -0,0 +1,564 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// rxPoller multiplexes receive operations for all polledConns across a single
+// epoll instance and goroutine. Probes register an rxWaiter before
+// transmitting, and the poller hands each received packet (or MSG_ERRQUEUE
+// message) to the first waiter on the same socket whose match func accepts
+// it. Packets accepted by no waiter are accounted as cross-talk, e.g. late
+// responses from a previous probe window. ICMP errors queued to MSG_ERRQUEUE
+// are recorded as events.
+//
+// Datagrams are read in batches of up to --rx-batch with recvmmsg(), each
+// with its own control messages and so its own kernel timestamp, so that a
+// burst of responses, e.g. to probes at short intervals, costs a single
+// syscall rather than one per datagram.
+//
+// Where epoll is unavailable, e.g. in sandboxes whose syscall filters deny
+// it, every polledConn is instead read by its own goroutine blocking in
+// recvmsg() with a SO_RCVTIMEO deadline, see readLoop, and registered
+// waiters are satisfied the same way.
+type rxPoller struct {
+	epfd  int      // -1 if epoll is unavailable
+	batch *rxBatch // nil if datagrams are read with recvmsg()
+
+	mu      sync.Mutex
+	conns   map[int32]*polledConn // by fd
+	waiters map[int32][]*rxWaiter // by fd
+
+	crossTalk     atomic.Uint64
+	wakeups       atomic.Uint64
+	recvmsgs      atomic.Uint64
+	errQueueReads atomic.Uint64
+	syscalls      atomic.Uint64
+}
+
+// rxDeadlinePoll is the SO_RCVTIMEO of polledConns where epoll is
+// unavailable: how long readLoop blocks in recvmsg() before reading the
+// error queue, which does not wake it, and checking whether the conn was
+// closed. It bounds the delay of tx timestamps.
+const rxDeadlinePoll = 5 * time.Millisecond
+
+var (
+	rxPollerOnce sync.Once
+	// rxPollerVal is the process-wide rxPoller, nil until first used.
+	// Metrics read it concurrently with its start.
+	rxPollerVal atomic.Pointer[rxPoller]
+)
+
+// getRXPoller returns the process-wide rxPoller, starting it on first use.
+func getRXPoller() *rxPoller {
+	rxPollerOnce.Do(func() {
+		epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+		if err != nil {
+			probeLog.Warn("epoll unavailable, receiving with SO_RCVTIMEO deadlines", "err", err)
+			epfd = -1
+		}
+		p := newRXPoller(epfd)
+		rxPollerVal.Store(p)
+		if epfd >= 0 {
+			go p.run()
+		}
+	})
+	return rxPollerVal.Load()
+}
+
+// newRXPoller returns an rxPoller of the epoll instance epfd, or one
+// receiving with deadlines if epfd is -1.
+func newRXPoller(epfd int) *rxPoller {
+	p := &rxPoller{
+		epfd:    epfd,
+		conns:   make(map[int32]*polledConn),
+		waiters: make(map[int32][]*rxWaiter),
+	}
+	if epfd >= 0 && *flagRXBatch > 1 {
+		p.batch = newRXBatch(min(*flagRXBatch, maxRXBatch), 1500, 1024)
+	}
+	return p
+}
+
+// crossTalkCount returns the number of packets received across all polled
+// sockets that did not match any outstanding probe. It returns false if
+// receive operations are not demultiplexed on this platform.
+func crossTalkCount() (uint64, bool) {
+	p := rxPollerVal.Load()
+	if p == nil {
+		return 0, true
+	}
+	return p.crossTalk.Load(), true
+}
+
+// getRXStats returns the receive path counters of the process-wide rxPoller.
+// It returns false if receive operations are not demultiplexed on this
+// platform.
+func getRXStats() (rxStats, bool) {
+	p := rxPollerVal.Load()
+	if p == nil {
+		return rxStats{}, true
+	}
+	return rxStats{
+		wakeups:       p.wakeups.Load(),
+		recvmsgs:      p.recvmsgs.Load(),
+		errQueueReads: p.errQueueReads.Load(),
+		syscalls:      p.syscalls.Load(),
+	}, true
+}
+
+// polledConn is a nonblocking datagram socket whose receive path is owned by
+// an rxPoller. It satisfies io.ReadWriteCloser so that it may be held by a
+// connAndMeasureFn, but Read and Write are unused; probes transmit via
+// sendto() and receive via rxPoller.register().
+type polledConn struct {
+	fd       int
+	protocol protocol
+	poller   *rxPoller
+	// quietICMPErrors suppresses recording ICMP errors as events. It must
+	// be set before the first rxPoller.register call.
+	quietICMPErrors bool
+
+	// closing and done are the signal to stop and the completion of the
+	// readLoop of the conn, if epoll is unavailable, and nil otherwise.
+	closing   atomic.Bool
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// fdMu is held for reading while the rxPoller reads fd, and for
+	// writing while Close closes it, so that the poller never reads an fd
+	// closed, and possibly reused by another socket, since epoll_wait
+	// returned it.
+	fdMu   sync.RWMutex
+	closed bool // under fdMu
+}
+
+// newPolledConn creates a socket for probing with protocol p and registers it
+// with the process-wide rxPoller.
+func newPolledConn(domain, typ, proto int, p protocol) (*polledConn, error) {
+	return getRXPoller().newConn(domain, typ, proto, p)
+}
+
+// newConn creates a socket for probing with protocol proto whose receive path
+// is owned by p: nonblocking and registered with its epoll instance, or
+// blocking for up to rxDeadlinePoll at a time and read by a readLoop if
+// epoll is unavailable.
+func (p *rxPoller) newConn(domain, typ, sockProto int, proto protocol) (*polledConn, error) {
+	flags := unix.SOCK_CLOEXEC
+	if p.epfd >= 0 {
+		flags |= unix.SOCK_NONBLOCK
+	}
+	fd, err := unix.Socket(domain, typ|flags, sockProto)
+	if err != nil {
+		return nil, err
+	}
+	c := &polledConn{
+		fd:       fd,
+		protocol: proto,
+		poller:   p,
+	}
+	if err := enableRecvErr(fd, domain); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("error enabling RECVERR: %w", err)
+	}
+	if p.epfd < 0 {
+		tv := unix.NsecToTimeval(rxDeadlinePoll.Nanoseconds())
+		if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("error setting SO_RCVTIMEO: %w", err)
+		}
+		c.done = make(chan struct{})
+	}
+	p.mu.Lock()
+	p.conns[int32(fd)] = c
+	p.mu.Unlock()
+	if c.done != nil {
+		go p.readLoop(c)
+		return c, nil
+	}
+	// EPOLLERR is always reported, which is how we learn of MSG_ERRQUEUE
+	// (tx timestamp) readiness.
+	err = unix.EpollCtl(p.epfd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{
+		Events: unix.EPOLLIN,
+		Fd:     int32(fd),
+	})
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("epoll_ctl: %w", err)
+	}
+	return c, nil
+}
+
+func (c *polledConn) sendto(b []byte, to unix.Sockaddr) error {
+	return unix.Sendto(c.fd, b, 0, to)
+}
+
+func (c *polledConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		if c.done != nil {
+			// Closing the fd does not interrupt a blocked recvmsg(),
+			// and its number may be reused once closed, so stop the
+			// readLoop first.
+			c.closing.Store(true)
+			<-c.done
+		}
+		p := c.poller
+		p.mu.Lock()
+		if p.epfd >= 0 {
+			unix.EpollCtl(p.epfd, unix.EPOLL_CTL_DEL, c.fd, nil)
+		}
+		delete(p.conns, int32(c.fd))
+		waiters := p.waiters[int32(c.fd)]
+		delete(p.waiters, int32(c.fd))
+		p.mu.Unlock()
+		for _, w := range waiters {
+			w.fail(net.ErrClosed)
+		}
+		// Wait out a read of the poller in progress.
+		c.fdMu.Lock()
+		c.closed = true
+		err = unix.Close(c.fd)
+		c.fdMu.Unlock()
+	})
+	return err
+}
+
+// acquire returns the open conn of fd, read-locked against closing until
+// released with release, or nil if there is none.
+func (p *rxPoller) acquire(fd int32) *polledConn {
+	p.mu.Lock()
+	c := p.conns[fd]
+	p.mu.Unlock()
+	if c == nil {
+		return nil
+	}
+	c.fdMu.RLock()
+	if c.closed {
+		c.fdMu.RUnlock()
+		return nil
+	}
+	return c
+}
+
+func (c *polledConn) release() {
+	c.fdMu.RUnlock()
+}
+
+func (c *polledConn) Write([]byte) (int, error) {
+	return 0, errors.New("unimplemented")
+}
+
+func (c *polledConn) Read([]byte) (int, error) {
+	return 0, errors.New("unimplemented")
+}
+
+// rxMsg is a packet (or MSG_ERRQUEUE message) handed to an rxWaiter.
+type rxMsg struct {
+	b   []byte
+	oob []byte
+	// at is the userspace time at which the poller read the message.
+	at time.Time
+}
+
+// rxWaiter is a single outstanding receive registered against a polledConn.
+type rxWaiter struct {
+	fd       int32
+	errQueue bool
+	match    func(b []byte) bool
+	ch       chan rxMsg
+	errCh    chan error
+}
+
+func (w *rxWaiter) fail(err error) {
+	select {
+	case w.errCh <- err:
+	default:
+	}
+}
+
+// register adds a waiter for the next message on c that satisfies match. If
+// errQueue is true the waiter is matched against MSG_ERRQUEUE messages,
+// otherwise against regular datagrams. Waiters must be registered before the
+// related transmit in order to avoid racing the response, and must be
+// released with unregister.
+func (p *rxPoller) register(c *polledConn, errQueue bool, match func(b []byte) bool) *rxWaiter {
+	w := &rxWaiter{
+		fd:       int32(c.fd),
+		errQueue: errQueue,
+		match:    match,
+		ch:       make(chan rxMsg, 1),
+		errCh:    make(chan error, 1),
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.waiters[w.fd] = append(p.waiters[w.fd], w)
+	return w
+}
+
+func (p *rxPoller) unregister(w *rxWaiter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ws := p.waiters[w.fd]
+	for i, v := range ws {
+		if v == w {
+			ws = append(ws[:i], ws[i+1:]...)
+			break
+		}
+	}
+	if len(ws) == 0 {
+		delete(p.waiters, w.fd)
+	} else {
+		p.waiters[w.fd] = ws
+	}
+}
+
+// wait blocks until w is satisfied, the socket is closed, or ctx is done.
+func (w *rxWaiter) wait(ctx context.Context) (rxMsg, error) {
+	select {
+	case m := <-w.ch:
+		return m, nil
+	case err := <-w.errCh:
+		return rxMsg{}, err
+	case <-ctx.Done():
+		return rxMsg{}, ctx.Err()
+	}
+}
+
+// dispatch hands m to the first unsatisfied waiter on fd that matches it. It
+// reports whether a waiter accepted m.
+func (p *rxPoller) dispatch(fd int32, errQueue bool, m rxMsg) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, w := range p.waiters[fd] {
+		if w.errQueue != errQueue || !w.match(m.b) {
+			continue
+		}
+		select {
+		case w.ch <- m:
+			return true
+		default:
+			// already satisfied, keep looking
+		}
+	}
+	return false
+}
+
+func (p *rxPoller) run() {
+	events := make([]unix.EpollEvent, 128)
+	buf := make([]byte, 1500)
+	oob := make([]byte, 1024)
+	for {
+		n, err := unix.EpollWait(p.epfd, events, -1)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			probeLog.Error("rx poller: epoll_wait error", "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		p.wakeups.Add(1)
+		for _, ev := range events[:n] {
+			// The conn may have been closed since epoll_wait returned.
+			c := p.acquire(ev.Fd)
+			if c == nil {
+				continue
+			}
+			if ev.Events&unix.EPOLLERR != 0 {
+				p.drain(c, true, buf, oob)
+			}
+			if ev.Events&unix.EPOLLIN != 0 {
+				if p.batch != nil {
+					p.drainBatch(c, p.batch)
+				} else {
+					p.drain(c, false, buf, oob)
+				}
+			}
+			c.release()
+		}
+	}
+}
+
+// readLoop is the receive path of c if epoll is unavailable. Until c is
+// closed, it blocks in recvmsg() for up to rxDeadlinePoll at a time,
+// dispatching datagrams as they are received, and drains the error queue in
+// between.
+func (p *rxPoller) readLoop(c *polledConn) {
+	defer close(c.done)
+	buf := make([]byte, 1500)
+	oob := make([]byte, 1024)
+	fd := int32(c.fd)
+	for !c.closing.Load() {
+		p.drain(c, true, buf, oob)
+		n, oobn, _, _, err := unix.Recvmsg(c.fd, buf, oob, 0)
+		at := time.Now()
+		p.syscalls.Add(1)
+		if err != nil {
+			// EAGAIN once SO_RCVTIMEO elapses is the common case,
+			// and errors queued by RECVERR are read from the error
+			// queue next.
+			continue
+		}
+		p.wakeups.Add(1)
+		p.recvmsgs.Add(1)
+		m := rxMsg{
+			b:   append([]byte(nil), buf[:n]...),
+			oob: append([]byte(nil), oob[:oobn]...),
+			at:  at,
+		}
+		if !p.dispatch(fd, false, m) {
+			p.crossTalk.Add(1)
+		}
+	}
+}
+
+// drain reads from c with recvmsg() until it would block, dispatching each
+// message. MSG_ERRQUEUE messages are always read this way, as parsing ICMP
+// errors requires their origin as a unix.Sockaddr. c must be acquired, or
+// owned by the calling readLoop.
+func (p *rxPoller) drain(c *polledConn, errQueue bool, buf, oob []byte) {
+	fd := int32(c.fd)
+	flags := unix.MSG_DONTWAIT
+	if errQueue {
+		flags |= unix.MSG_ERRQUEUE
+	}
+	for {
+		n, oobn, _, from, err := unix.Recvmsg(c.fd, buf, oob, flags)
+		at := time.Now()
+		p.syscalls.Add(1)
+		if err != nil {
+			// EAGAIN is the common case, anything else is equally a
+			// reason to stop reading this fd.
+			return
+		}
+		p.recvmsgs.Add(1)
+		if errQueue {
+			p.errQueueReads.Add(1)
+		}
+		if errQueue {
+			if ie, ok := parseICMPError(oob[:oobn], from, buf[:n]); ok {
+				if c.quietICMPErrors {
+					continue
+				}
+				ev := ie.toEvent(c.protocol)
+				ev.At = at
+				events.record(ev)
+				continue
+			}
+		}
+		m := rxMsg{
+			b:   append([]byte(nil), buf[:n]...),
+			oob: append([]byte(nil), oob[:oobn]...),
+			at:  at,
+		}
+		if !p.dispatch(fd, errQueue, m) {
+			p.crossTalk.Add(1)
+		}
+	}
+}
+
+// mmsghdr is struct mmsghdr of recvmmsg(2), which x/sys/unix does not define.
+// Its layout matches C's on both 32-bit and 64-bit platforms.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// rxBatch holds the buffers of a recvmmsg() batch. It is reused across
+// syscalls, and so owned by a single goroutine.
+type rxBatch struct {
+	hdrs []mmsghdr
+	iovs []unix.Iovec
+	bufs [][]byte
+	oobs [][]byte
+}
+
+// newRXBatch returns an rxBatch of n messages of up to size bytes with up to
+// oobSize bytes of control messages each.
+func newRXBatch(n, size, oobSize int) *rxBatch {
+	b := &rxBatch{
+		hdrs: make([]mmsghdr, n),
+		iovs: make([]unix.Iovec, n),
+		bufs: make([][]byte, n),
+		oobs: make([][]byte, n),
+	}
+	for i := range n {
+		b.bufs[i] = make([]byte, size)
+		b.oobs[i] = make([]byte, oobSize)
+		b.iovs[i].Base = &b.bufs[i][0]
+		b.iovs[i].SetLen(size)
+		b.hdrs[i].hdr.Iov = &b.iovs[i]
+		b.hdrs[i].hdr.SetIovlen(1)
+	}
+	return b
+}
+
+// recvmmsg reads up to len(b.hdrs) datagrams from fd without blocking,
+// returning the number read.
+func (b *rxBatch) recvmmsg(fd int) (int, error) {
+	for i := range b.hdrs {
+		h := &b.hdrs[i].hdr
+		h.Control = &b.oobs[i][0]
+		h.SetControllen(len(b.oobs[i]))
+		h.Flags = 0
+		b.hdrs[i].len = 0
+	}
+	n, _, errno := unix.Syscall6(unix.SYS_RECVMMSG, uintptr(fd), uintptr(unsafe.Pointer(&b.hdrs[0])), uintptr(len(b.hdrs)), unix.MSG_DONTWAIT, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+// drainBatch reads datagrams from c with recvmmsg() until it would block,
+// dispatching each. If recvmmsg() is unsupported, it falls back to drain. c
+// must be acquired.
+func (p *rxPoller) drainBatch(c *polledConn, b *rxBatch) {
+	fd := int32(c.fd)
+	for {
+		n, err := b.recvmmsg(c.fd)
+		at := time.Now()
+		p.syscalls.Add(1)
+		if errors.Is(err, unix.ENOSYS) {
+			probeLog.Warn("rx poller: recvmmsg unsupported, reading datagrams with recvmsg")
+			p.batch = nil
+			p.drain(c, false, b.bufs[0], b.oobs[0])
+			return
+		}
+		if err != nil {
+			// As in drain, EAGAIN is the common case.
+			return
+		}
+		p.recvmsgs.Add(uint64(n))
+		for i := range n {
+			h := &b.hdrs[i]
+			m := rxMsg{
+				b:   append([]byte(nil), b.bufs[i][:h.len]...),
+				oob: append([]byte(nil), b.oobs[i][:h.hdr.Controllen]...),
+				at:  at,
+			}
+			if !p.dispatch(fd, false, m) {
+				p.crossTalk.Add(1)
+			}
+		}
+		// A short batch drained the socket, saving the syscall returning
+		// EAGAIN. The socket is polled level-triggered, so datagrams
+		// arriving since are not missed.
+		if n < len(b.hdrs) {
+			return
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"tailscale.com/net/ktimestamp"
+)
+
+func TestRXBatchRecvmmsg(t *testing.T) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPING_NEW, ktimestamp.Flags); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The kernel enables rx timestamps asynchronously when the first socket
+	// requests them, so wait for a timestamped datagram.
+	warm := func() bool {
+		if err := unix.Sendto(fd, []byte("warm up"), 0, sa); err != nil {
+			t.Fatal(err)
+		}
+		buf, oob := make([]byte, 16), make([]byte, 1024)
+		for {
+			_, oobn, _, _, err := unix.Recvmsg(fd, buf, oob, 0)
+			if err == unix.EAGAIN {
+				return false
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ktimestamp.ParseTimestamp(oob[:oobn]); err == nil {
+				return true
+			}
+		}
+	}
+	for i := 0; !warm(); i++ {
+		if i == 100 {
+			t.Fatal("no rx timestamps")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b := newRXBatch(4, 1500, 1024)
+	if _, err := b.recvmmsg(fd); err != unix.EAGAIN {
+		t.Fatalf("recvmmsg of empty socket = %v, want EAGAIN", err)
+	}
+	const sent = 6
+	for i := range sent {
+		if err := unix.Sendto(fd, fmt.Appendf(nil, "datagram %d", i), 0, sa); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	for _, want := range []int{4, 2} {
+		n, err := b.recvmmsg(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Fatalf("recvmmsg read %d datagrams, want %d", n, want)
+		}
+		for i := range n {
+			h := b.hdrs[i]
+			got = append(got, string(b.bufs[i][:h.len]))
+			if _, err := ktimestamp.ParseTimestamp(b.oobs[i][:h.hdr.Controllen]); err != nil {
+				t.Errorf("datagram %q: %v", got[len(got)-1], err)
+			}
+		}
+	}
+	for i, s := range got {
+		if want := fmt.Sprintf("datagram %d", i); s != want {
+			t.Errorf("datagram %d = %q, want %q", i, s, want)
+		}
+	}
+}
+
+func TestRXPollerDeadlineFallback(t *testing.T) {
+	p := newRXPoller(-1)
+	c, err := p.newConn(unix.AF_INET, unix.SOCK_DGRAM, 0, protocolSTUN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := unix.Bind(c.fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ktimestamp.SetTimestamping(c.fd, ktimestamp.Flags); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := unix.Getsockname(c.fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ping := []byte("ping")
+	// The looped tx timestamp of ping is read from the error queue, which
+	// does not wake the readLoop.
+	tw := p.register(c, true, func(b []byte) bool { return bytes.HasSuffix(b, ping) })
+	defer p.unregister(tw)
+	w := p.register(c, false, func(b []byte) bool { return bytes.Equal(b, ping) })
+	defer p.unregister(w)
+	if err := c.sendto([]byte("cross-talk"), sa); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.sendto(ping, sa); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tm, err := tw.wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ktimestamp.ParseTimestamp(tm.oob); err != nil {
+		t.Errorf("tx timestamp: %v", err)
+	}
+	m, err := w.wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.at.IsZero() || len(m.oob) == 0 {
+		t.Errorf("msg = %+v, want control messages and a receive time", m)
+	}
+	// The cross-talk datagram and its tx timestamp.
+	if n := p.crossTalk.Load(); n != 2 {
+		t.Errorf("cross-talk = %d, want 2", n)
+	}
+
+	// Waiters time out with their context, and fail once the conn is
+	// closed, which stops its readLoop promptly.
+	w2 := p.register(c, false, func([]byte) bool { return false })
+	defer p.unregister(w2)
+	short, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := w2.wait(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait err = %v, want deadline exceeded", err)
+	}
+	start := time.Now()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Close took %v", d)
+	}
+	if _, err := w2.wait(context.Background()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("wait after close err = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func newTestEpollRXPoller(t *testing.T) *rxPoller {
+	t.Helper()
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		t.Skipf("epoll unavailable: %v", err)
+	}
+	p := newRXPoller(epfd)
+	// As the process-wide rxPoller, it runs for the lifetime of the
+	// process.
+	go p.run()
+	return p
+}
+
+// newTestPolledConn returns a conn of p bound to the loopback address, and
+// its address.
+func newTestPolledConn(t *testing.T, p *rxPoller) (*polledConn, unix.Sockaddr) {
+	t.Helper()
+	c, err := p.newConn(unix.AF_INET, unix.SOCK_DGRAM, 0, protocolSTUN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := unix.Bind(c.fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := unix.Getsockname(c.fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, sa
+}
+
+func TestRXPollerRegisterDrainClose(t *testing.T) {
+	p := newTestEpollRXPoller(t)
+	c, sa := newTestPolledConn(t, p)
+
+	ping := []byte("ping")
+	w := p.register(c, false, func(b []byte) bool { return bytes.Equal(b, ping) })
+	if err := c.sendto([]byte("cross-talk"), sa); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.sendto(ping, sa); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, err := w.wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.b, ping) || m.at.IsZero() {
+		t.Errorf("msg = %+v, want ping with a receive time", m)
+	}
+	p.unregister(w)
+	if n := p.crossTalk.Load(); n != 1 {
+		t.Errorf("cross-talk = %d, want 1", n)
+	}
+
+	// Closing fails waiters and forgets the conn, whose fd is no longer
+	// polled.
+	w = p.register(c, false, func([]byte) bool { return true })
+	fd := int32(c.fd)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.wait(ctx); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("wait after close err = %v, want %v", err, net.ErrClosed)
+	}
+	p.mu.Lock()
+	conns, waiters := len(p.conns), len(p.waiters)
+	p.mu.Unlock()
+	if conns != 0 || waiters != 0 {
+		t.Errorf("after close: %d conns and %d fds with waiters, want none", conns, waiters)
+	}
+	if p.acquire(fd) != nil {
+		t.Error("acquired closed conn")
+	}
+
+	// A conn reusing the fd is polled as itself.
+	c2, sa2 := newTestPolledConn(t, p)
+	w2 := p.register(c2, false, func(b []byte) bool { return bytes.Equal(b, ping) })
+	defer p.unregister(w2)
+	if err := c2.sendto(ping, sa2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w2.wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRXPollerCloseWaitsForDrain(t *testing.T) {
+	p := newRXPoller(-1)
+	c, _ := newTestPolledConn(t, p)
+
+	// The poller reading the conn when it is closed.
+	if p.acquire(int32(c.fd)) != c {
+		t.Fatal("acquire of open conn failed")
+	}
+	closed := make(chan error, 1)
+	go func() { closed <- c.Close() }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close() = %v while the conn was acquired", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// The fd is not closed, and so not reused, under the poller.
+	if _, err := unix.FcntlInt(uintptr(c.fd), unix.F_GETFD, 0); err != nil {
+		t.Fatalf("fd closed while acquired: %v", err)
+	}
+	c.release()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() did not return once released")
+	}
+	if p.acquire(int32(c.fd)) != nil {
+		t.Error("acquired closed conn")
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"tailscale.com/tailcfg"
+)
+
+// scaffoldRegionID is the ID of the region of the reflector in the DERP map
+// written by scaffold, chosen from the range reserved for custom regions.
+const scaffoldRegionID = 900
+
+// scaffoldProberDERPMap is the path of the DERP map written by scaffold on
+// the prober, in the stunstamp command printed by scaffold.
+const scaffoldProberDERPMap = "/etc/stunstamp/derpmap.json"
+
+// runScaffold implements the scaffold subcommand, writing the configuration
+// of a reflector for lab setups to --out-dir: a Dockerfile building stund
+// and stunstamp, and a compose file running stund as the STUN responder and
+// stunstamp as the TWAMP-light reflector. With --derp-map, it also writes a
+// DERP map of the reflector alone, to probe it from another VM with the
+// stunstamp command printed to w.
+func runScaffold(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("scaffold", flag.ContinueOnError)
+	outDir := fs.String("out-dir", "stunstamp-lab", "directory to write the configuration to, created if needed")
+	addr := fs.String("addr", "", "IPv4 address probers reach the reflector at, required with --derp-map")
+	addr6 := fs.String("addr6", "", "IPv6 address probers reach the reflector at, if any")
+	hostname := fs.String("hostname", "reflector", "hostname of the reflector in the DERP map")
+	stunPort := fs.Int("stun-port", 3478, "UDP port of the STUN responder")
+	twampPort := fs.Int("twamp-port", twampDefaultPort, "UDP port of the TWAMP-light reflector, or 0 for none")
+	ref := fs.String("ref", "main", "version of tailscale.com to build stund and stunstamp from, e.g. a tag, commit, or branch")
+	derpMap := fs.Bool("derp-map", false, "also write a DERP map of the reflector, derpmap.json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("usage: stunstamp scaffold [--out-dir=DIR] [--derp-map --addr=IP] [--stun-port=N] [--twamp-port=N]")
+	}
+	if *stunPort < 1 || *stunPort > 65535 {
+		return fmt.Errorf("invalid stun-port %d", *stunPort)
+	}
+	if *twampPort < 0 || *twampPort > 65535 {
+		return fmt.Errorf("invalid twamp-port %d", *twampPort)
+	}
+	var v4, v6 netip.Addr
+	if *addr != "" {
+		var err error
+		if v4, err = netip.ParseAddr(*addr); err != nil || !v4.Is4() {
+			return fmt.Errorf("invalid addr flag value %q, want an IPv4 address", *addr)
+		}
+	}
+	if *addr6 != "" {
+		var err error
+		if v6, err = netip.ParseAddr(*addr6); err != nil || !v6.Is6() {
+			return fmt.Errorf("invalid addr6 flag value %q, want an IPv6 address", *addr6)
+		}
+	}
+	if *derpMap && !v4.IsValid() {
+		return errors.New("derp-map requires the addr flag")
+	}
+
+	files := make(map[string][]byte)
+	data := map[string]any{
+		"Ref":       *ref,
+		"STUNPort":  *stunPort,
+		"TWAMPPort": *twampPort,
+	}
+	for name, tmpl := range map[string]*template.Template{
+		"Dockerfile":   scaffoldDockerfile,
+		"compose.yaml": scaffoldCompose,
+	} {
+		var sb strings.Builder
+		if err := tmpl.Execute(&sb, data); err != nil {
+			return err
+		}
+		files[name] = []byte(sb.String())
+	}
+	if *derpMap {
+		b, err := json.MarshalIndent(scaffoldDERPMap(*hostname, v4, v6, *stunPort), "", "\t")
+		if err != nil {
+			return err
+		}
+		files["derpmap.json"] = append(b, '\n')
+	}
+
+	// Refuse to clobber a configuration that may have been edited since.
+	for name := range files {
+		if _, err := os.Stat(filepath.Join(*outDir, name)); !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%s already exists", filepath.Join(*outDir, name))
+		}
+	}
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		return err
+	}
+	for name, b := range files {
+		if err := writeFileAtomic(filepath.Join(*outDir, name), b); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(w, "Wrote the reflector configuration to %s. On the reflector, run:\n\n", *outDir)
+	fmt.Fprintf(w, "\tcd %s && docker compose up -d --build\n\n", *outDir)
+	if !*derpMap {
+		return nil
+	}
+	probe := []string{
+		"stunstamp",
+		"--derp-map=file://" + scaffoldProberDERPMap,
+		"--stun-dst-ports=" + strconv.Itoa(*stunPort),
+	}
+	if *twampPort > 0 {
+		probe = append(probe, "--twamp-dst-ports="+strconv.Itoa(*twampPort))
+	}
+	if v6.IsValid() {
+		probe = append(probe, "--ipv6")
+	}
+	probe = append(probe, "--rw-url=...")
+	fmt.Fprintf(w, "Then copy derpmap.json to %s on the prober, and there run:\n\n\t%s\n", scaffoldProberDERPMap, strings.Join(probe, " "))
+	return nil
+}
+
+// scaffoldDERPMap returns a DERP map of a single STUN-only node, the
+// reflector at v4, and v6 if valid.
+func scaffoldDERPMap(hostname string, v4, v6 netip.Addr, stunPort int) *tailcfg.DERPMap {
+	node := &tailcfg.DERPNode{
+		Name:     strconv.Itoa(scaffoldRegionID) + "a",
+		RegionID: scaffoldRegionID,
+		HostName: hostname,
+		IPv4:     v4.String(),
+		IPv6:     "none",
+		STUNPort: stunPort,
+		STUNOnly: true,
+	}
+	if v6.IsValid() {
+		node.IPv6 = v6.String()
+	}
+	return &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			scaffoldRegionID: {
+				RegionID:   scaffoldRegionID,
+				RegionCode: "lab",
+				RegionName: "Lab reflector",
+				Nodes:      []*tailcfg.DERPNode{node},
+			},
+		},
+		OmitDefaultRegions: true,
+	}
+}
+
+var scaffoldDockerfile = template.Must(template.New("Dockerfile").Parse(`# Reflector for stunstamp lab setups, generated by "stunstamp scaffold".
+FROM golang:1.23-alpine AS build-env
+ARG TAILSCALE_REF={{.Ref}}
+RUN CGO_ENABLED=0 go install \
+    tailscale.com/cmd/stund@${TAILSCALE_REF} \
+    tailscale.com/cmd/stunstamp@${TAILSCALE_REF}
+
+FROM alpine:3.18
+COPY --from=build-env /go/bin/* /usr/local/bin/
+`))
+
+var scaffoldCompose = template.Must(template.New("compose").Parse(`# Reflector for stunstamp lab setups, generated by "stunstamp scaffold".
+# Start it with:
+#
+#   docker compose up -d --build
+#
+# Both services use the host network, so that probes measure the path to the
+# host rather than that of the container network, and so that the reflector
+# is reachable at the host's addresses.
+services:
+  stund:
+    build: .
+    image: stunstamp-reflector
+    network_mode: host
+    restart: unless-stopped
+    command: ["stund", "--stun=:{{.STUNPort}}", "--http=127.0.0.1:3479"]
+{{- if .TWAMPPort}}
+  twamp:
+    build: .
+    image: stunstamp-reflector
+    network_mode: host
+    restart: unless-stopped
+    # With nothing to probe, stunstamp only reflects.
+    command: ["stunstamp", "--twamp-reflector-addr=:{{.TWAMPPort}}"]
+{{- end}}
+`))
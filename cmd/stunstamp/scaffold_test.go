@@ -0,0 +1,64 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScaffold(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "lab")
+	var buf bytes.Buffer
+	if err := runScaffold([]string{"--out-dir=" + dir, "--derp-map", "--addr=192.0.2.10", "--stun-port=3479", "--twamp-port=8620"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "--stun-dst-ports=3479 --twamp-dst-ports=8620") {
+		t.Errorf("output = %q, want the prober command", buf.String())
+	}
+	compose, err := os.ReadFile(filepath.Join(dir, "compose.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"--stun=:3479"`, `"--twamp-reflector-addr=:8620"`} {
+		if !bytes.Contains(compose, []byte(want)) {
+			t.Errorf("compose.yaml lacks %s:\n%s", want, compose)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Dockerfile")); err != nil {
+		t.Error(err)
+	}
+
+	// The DERP map written is usable by the prober.
+	dm, err := getDERPMap(context.Background(), "file://"+filepath.Join(dir, "derpmap.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metas := make(map[netip.Addr]nodeMeta)
+	if _, err := nodeMetaFromDERPMap(dm, metas, false); err != nil {
+		t.Fatal(err)
+	}
+	if m := metas[netip.MustParseAddr("192.0.2.10")]; m.hostname != "reflector" || m.regionID != scaffoldRegionID || len(metas) != 1 {
+		t.Errorf("targets = %v", metas)
+	}
+
+	// Existing configuration is not clobbered.
+	if err := runScaffold([]string{"--out-dir=" + dir}, &buf); err == nil {
+		t.Error("scaffold over an existing configuration unexpectedly succeeded")
+	}
+	for _, args := range [][]string{
+		{"--out-dir=" + t.TempDir(), "--derp-map"},
+		{"--out-dir=" + t.TempDir(), "--addr=2001:db8::1"},
+		{"--out-dir=" + t.TempDir(), "--stun-port=0"},
+	} {
+		if err := runScaffold(args, &buf); err == nil {
+			t.Errorf("scaffold %v unexpectedly succeeded", args)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package schedule schedules the probe windows of stunstamp: it aligns them
+// to the wall clock, and detects suspension of the system between them.
+package schedule
+
+import (
+	"hash/fnv"
+	"time"
+
+	"tailscale.com/tstime"
+)
+
+// WindowPhase returns the deterministic sub-second offset of aligned probe
+// windows for instance, so that a fleet of instances aligned to the same
+// boundaries does not transmit in a single burst. It is capped at a tenth
+// of interval to leave the window's probing time mostly intact.
+func WindowPhase(instance string, interval time.Duration) time.Duration {
+	h := fnv.New64a()
+	h.Write([]byte(instance))
+	return time.Duration(h.Sum64() % uint64(min(time.Second, interval/10)))
+}
+
+// NextAlignedWindow returns the start of the first window after now when
+// windows start at phase past every multiple of interval since the Unix
+// epoch, e.g. phase past every minute for an interval of one minute.
+func NextAlignedWindow(now time.Time, interval, phase time.Duration) time.Time {
+	next := now.Truncate(interval).Add(phase)
+	for !next.After(now) {
+		next = next.Add(interval)
+	}
+	return next
+}
+
+// AlignedTicker delivers the start time of wall-clock aligned probe windows
+// on C, as described by NextAlignedWindow. Unlike a time.Ticker it
+// re-aligns after every tick, so that it does not drift from the wall clock.
+type AlignedTicker struct {
+	C    <-chan time.Time
+	stop chan struct{}
+}
+
+// NewAlignedTicker returns an AlignedTicker reading time from clock.
+func NewAlignedTicker(clock tstime.Clock, interval, phase time.Duration) *AlignedTicker {
+	c := make(chan time.Time, 1)
+	t := &AlignedTicker{C: c, stop: make(chan struct{})}
+	go func() {
+		for {
+			now := clock.Now()
+			next := NextAlignedWindow(now, interval, phase)
+			timer, timerCh := clock.NewTimer(next.Sub(now))
+			select {
+			case <-timerCh:
+			case <-t.stop:
+				timer.Stop()
+				return
+			}
+			// Drop the tick if the receiver is behind, as time.Ticker does.
+			select {
+			case c <- next:
+			default:
+			}
+		}
+	}()
+	return t
+}
+
+// Stop turns off t.
+func (t *AlignedTicker) Stop() {
+	close(t.stop)
+}
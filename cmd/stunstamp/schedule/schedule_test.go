@@ -0,0 +1,79 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"tailscale.com/tstest"
+)
+
+func TestNextAlignedWindow(t *testing.T) {
+	base := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	phase := 250 * time.Millisecond
+	for _, tt := range []struct {
+		now      time.Time
+		interval time.Duration
+		want     time.Time
+	}{
+		{base.Add(10 * time.Second), time.Minute, base.Add(time.Minute + phase)},
+		{base, time.Minute, base.Add(phase)},
+		{base.Add(phase), time.Minute, base.Add(time.Minute + phase)},
+		{base.Add(100 * time.Millisecond), time.Minute, base.Add(phase)},
+		{base.Add(25 * time.Second), 10 * time.Second, base.Add(30*time.Second + phase)},
+	} {
+		if got := NextAlignedWindow(tt.now, tt.interval, phase); !got.Equal(tt.want) {
+			t.Errorf("NextAlignedWindow(%v, %v) = %v, want %v", tt.now, tt.interval, got, tt.want)
+		}
+	}
+}
+
+func TestWindowPhase(t *testing.T) {
+	const minInterval = 10 * time.Second // stunstamp's
+	a, b := WindowPhase("a", time.Minute), WindowPhase("b", time.Minute)
+	if a == b {
+		t.Errorf("instances a and b share phase %v", a)
+	}
+	if a != WindowPhase("a", time.Minute) {
+		t.Error("WindowPhase is not deterministic")
+	}
+	for _, p := range []time.Duration{a, b, WindowPhase("a", minInterval)} {
+		if p < 0 || p >= time.Second {
+			t.Errorf("phase %v out of range", p)
+		}
+	}
+	if p := WindowPhase("a", minInterval); p >= minInterval/10 {
+		t.Errorf("phase %v not capped to a tenth of the interval", p)
+	}
+}
+
+func TestAlignedTicker(t *testing.T) {
+	start := time.Date(2024, 7, 1, 12, 0, 10, 0, time.UTC)
+	clock := tstest.NewClock(tstest.ClockOpts{Start: start})
+	phase := 250 * time.Millisecond
+	ticker := NewAlignedTicker(clock, time.Minute, phase)
+	defer ticker.Stop()
+
+	// Advance the clock in steps, giving the ticker goroutine time to
+	// re-arm its timer in between.
+	var got []time.Time
+	for len(got) < 3 && clock.PeekNow().Before(start.Add(5*time.Minute)) {
+		clock.Advance(time.Second)
+		time.Sleep(time.Millisecond)
+		select {
+		case tick := <-ticker.C:
+			got = append(got, tick)
+		default:
+		}
+	}
+	if len(got) != 3 {
+		t.Fatalf("got %d ticks, want 3", len(got))
+	}
+	for i, tick := range got {
+		if want := time.Date(2024, 7, 1, 12, 1+i, 0, 0, time.UTC).Add(phase); !tick.Equal(want) {
+			t.Errorf("tick %d = %v, want %v", i, tick, want)
+		}
+	}
+}
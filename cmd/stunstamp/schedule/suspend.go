@@ -0,0 +1,50 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package schedule
+
+import (
+	"time"
+)
+
+// MinSuspend is the minimum divergence between the wall and monotonic clocks
+// considered a suspension. It is well above the drift corrected by NTP
+// slewing over a probe interval.
+const MinSuspend = 10 * time.Second
+
+// SuspendDetector detects suspension of the system between successive
+// checks. The monotonic clock does not advance while the system is suspended
+// on Linux and macOS, whereas the wall clock does, so a suspension appears as
+// the wall clock jumping ahead of the monotonic clock. A step of the wall
+// clock, e.g. by NTP, is indistinguishable and is treated the same.
+type SuspendDetector struct {
+	start    time.Time // with monotonic clock reading
+	lastWall time.Time
+	lastMono time.Duration // since start
+}
+
+// NewSuspendDetector returns a SuspendDetector started at now, which should
+// carry a monotonic clock reading.
+func NewSuspendDetector(now time.Time) *SuspendDetector {
+	return &SuspendDetector{
+		start:    now,
+		lastWall: now.Round(0),
+	}
+}
+
+// Check returns the duration the system was suspended for since the last
+// check, or zero if it was not.
+func (d *SuspendDetector) Check(now time.Time) time.Duration {
+	return d.checkAt(now.Round(0), now.Sub(d.start))
+}
+
+// checkAt is Check for a wall clock reading of wall and a monotonic clock
+// reading of mono since d.start.
+func (d *SuspendDetector) checkAt(wall time.Time, mono time.Duration) time.Duration {
+	suspended := wall.Sub(d.lastWall) - (mono - d.lastMono)
+	d.lastWall, d.lastMono = wall, mono
+	if suspended < MinSuspend {
+		return 0
+	}
+	return suspended
+}
@@ -0,0 +1,48 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSuspendDetector(t *testing.T) {
+	start := time.Now()
+	d := NewSuspendDetector(start)
+	wall := start.Round(0)
+	var mono time.Duration
+
+	steps := []struct {
+		name       string
+		wallStep   time.Duration
+		monoStep   time.Duration
+		wantResult time.Duration
+	}{
+		{"steady", time.Minute, time.Minute, 0},
+		{"slewed", time.Minute, time.Minute - 5*time.Millisecond, 0},
+		{"wall stepped back", time.Minute - time.Hour, time.Minute, 0},
+		{"suspended", time.Hour + time.Minute, time.Minute, time.Hour},
+		{"steady after resume", time.Minute, time.Minute, 0},
+		{"below threshold", time.Minute + MinSuspend - time.Second, time.Minute, 0},
+		{"at threshold", time.Minute + MinSuspend, time.Minute, MinSuspend},
+	}
+	for _, s := range steps {
+		wall = wall.Add(s.wallStep)
+		mono += s.monoStep
+		if got := d.checkAt(wall, mono); got != s.wantResult {
+			t.Errorf("%s: got %v, want %v", s.name, got, s.wantResult)
+		}
+	}
+}
+
+func TestSuspendDetectorCheck(t *testing.T) {
+	start := time.Now()
+	d := NewSuspendDetector(start)
+	// Adding to a time with a monotonic clock reading advances both clocks
+	// equally.
+	if got := d.Check(start.Add(time.Hour)); got != 0 {
+		t.Errorf("got %v, want 0", got)
+	}
+}
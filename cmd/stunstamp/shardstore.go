@@ -0,0 +1,285 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	shardsDirName     = "shards"
+	shardManifestFile = "manifest.json"
+)
+
+// shardStore stores results as the jsonl layout does, but sharded into a
+// directory per region, each written by a goroutine of its own, which
+// removes the bottleneck of marshaling and writing the results of very large
+// target sets through a single file. A manifest lists the shards and the
+// regions they hold, tying them together for readers. This is the sharded
+// layout; like the ring layout, it does not support archiving or db
+// maintenance.
+type shardStore struct {
+	dir string // the shards directory of the store
+
+	mu     sync.Mutex // guards shards and writes of the manifest
+	shards map[string]*resultsShard
+}
+
+// resultsShard is the daily results files of a region, see shardStore.
+type resultsShard struct {
+	dir string
+
+	mu  sync.Mutex
+	f   *os.File // current day's file, or nil
+	day string   // day of f
+}
+
+// shardManifest is the manifest of a shardStore.
+type shardManifest struct {
+	Shards []shardManifestEntry
+}
+
+// shardManifestEntry is a shard of a shardStore.
+type shardManifestEntry struct {
+	Name       string // of its directory
+	RegionID   int
+	RegionCode string
+}
+
+func newShardStore(dir string) *shardStore {
+	return &shardStore{dir: filepath.Join(dir, shardsDirName), shards: make(map[string]*resultsShard)}
+}
+
+// shardName returns the name of the shard holding the results of meta.
+func shardName(meta nodeMeta) string {
+	code := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, meta.regionCode)
+	return fmt.Sprintf("%d-%s", meta.regionID, code)
+}
+
+// loadManifest returns the manifest of the store, which is empty if no
+// results have been written.
+func (s *shardStore) loadManifest() (*shardManifest, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, shardManifestFile))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &shardManifest{}, nil
+		}
+		return nil, err
+	}
+	m := &shardManifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("error parsing shard manifest: %w", err)
+	}
+	return m, nil
+}
+
+// shardsLocked returns the shards holding the results of metas, creating
+// them and adding them to the manifest if needed.
+func (s *shardStore) shardsLocked(metas map[string]nodeMeta) (map[string]*resultsShard, error) {
+	var added []shardManifestEntry
+	ret := make(map[string]*resultsShard, len(metas))
+	for name, meta := range metas {
+		if sh, ok := s.shards[name]; ok {
+			ret[name] = sh
+			continue
+		}
+		dir := filepath.Join(s.dir, name)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		sh := &resultsShard{dir: dir}
+		s.shards[name] = sh
+		ret[name] = sh
+		added = append(added, shardManifestEntry{Name: name, RegionID: meta.regionID, RegionCode: meta.regionCode})
+	}
+	if len(added) == 0 {
+		return ret, nil
+	}
+	m, err := s.loadManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range added {
+		if !slices.ContainsFunc(m.Shards, func(got shardManifestEntry) bool { return got.Name == e.Name }) {
+			m.Shards = append(m.Shards, e)
+		}
+	}
+	slices.SortFunc(m.Shards, func(a, b shardManifestEntry) int {
+		return cmp.Or(cmp.Compare(a.RegionID, b.RegionID), cmp.Compare(a.Name, b.Name))
+	})
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, shardManifestFile), b); err != nil {
+		// Drop the shards so that adding them is retried with the next
+		// batch, as readers cannot find them without the manifest.
+		for _, e := range added {
+			delete(s.shards, e.Name)
+		}
+		return nil, err
+	}
+	return ret, nil
+}
+
+// append writes results to the shards of their regions concurrently.
+func (s *shardStore) append(results []result) error {
+	batches := make(map[string][]result)
+	metas := make(map[string]nodeMeta)
+	for _, r := range results {
+		name := shardName(r.key.meta)
+		batches[name] = append(batches[name], r)
+		metas[name] = r.key.meta
+	}
+	s.mu.Lock()
+	shards, err := s.shardsLocked(metas)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, 0, len(batches))
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for name, batch := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := shards[name].append(batch); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("shard %s: %w", name, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// append writes results to the shard with a single write call.
+func (sh *resultsShard) append(results []result) error {
+	var buf []byte
+	for _, r := range results {
+		b, err := json.Marshal(storedResultFromResult(r))
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b...)
+		buf = append(buf, '\n')
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	day := results[0].at.UTC().Format(storeDayLayout)
+	if sh.f == nil || sh.day != day {
+		if sh.f != nil {
+			sh.f.Close()
+			sh.f = nil
+		}
+		f, err := os.OpenFile(filepath.Join(sh.dir, resultsFileName(day)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		sh.f = f
+		sh.day = day
+	}
+	_, err := sh.f.Write(buf)
+	return err
+}
+
+// close closes the files of the shards written to.
+func (s *shardStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for name, sh := range s.shards {
+		sh.mu.Lock()
+		if sh.f != nil {
+			errs = append(errs, sh.f.Close())
+			sh.f = nil
+		}
+		sh.mu.Unlock()
+		delete(s.shards, name)
+	}
+	return errors.Join(errs...)
+}
+
+// days returns the days held by any shard in ascending order.
+func (s *shardStore) days(m *shardManifest) ([]string, error) {
+	seen := make(map[string]bool)
+	for _, e := range m.Shards {
+		days, err := resultsFileDaysIn(filepath.Join(s.dir, e.Name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, day := range days {
+			seen[day] = true
+		}
+	}
+	return slices.Sorted(maps.Keys(seen)), nil
+}
+
+// readRange calls fn for every stored result with from <= at < to. Results
+// are read a day at a time from every shard listed in the manifest, and
+// ordered by time within the day.
+func (s *shardStore) readRange(from, to time.Time, fn func(storedResult) error) error {
+	// The manifest is reloaded on every read, as a writer in another
+	// process may have added shards since.
+	m, err := s.loadManifest()
+	if err != nil {
+		return err
+	}
+	days, err := s.days(m)
+	if err != nil {
+		return err
+	}
+	fromDay := from.UTC().Format(storeDayLayout)
+	toDay := to.UTC().Format(storeDayLayout)
+	for _, day := range days {
+		if day < fromDay || day > toDay {
+			continue
+		}
+		var srs []storedResult
+		for _, e := range m.Shards {
+			err := readResultsFile(filepath.Join(s.dir, e.Name, resultsFileName(day)), func(sr storedResult) error {
+				if !sr.At.Before(from) && sr.At.Before(to) {
+					srs = append(srs, sr)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		slices.SortStableFunc(srs, func(a, b storedResult) int {
+			return a.At.Compare(b.At)
+		})
+		for _, sr := range srs {
+			if err := fn(sr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShardStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openResultsStoreLayout(dir, storeLayoutSharded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	rtt := 10 * time.Millisecond
+	var want int
+	for i := range 4 {
+		var batch []result
+		for region := 1; region <= 3; region++ {
+			meta := nodeMeta{regionID: region, regionCode: fmt.Sprintf("R%d", region), hostname: fmt.Sprintf("%da", region), addr: netip.AddrFrom4([4]byte{192, 0, 2, byte(region)})}
+			batch = append(batch, result{
+				key: resultKey{meta: meta, protocol: protocolSTUN, dstPort: 3478},
+				// Later regions sort first within a batch.
+				at:  start.Add(time.Duration(i)*time.Minute - time.Duration(region)*time.Second),
+				rtt: &rtt,
+			})
+		}
+		if err := s.append(batch); err != nil {
+			t.Fatal(err)
+		}
+		want += len(batch)
+	}
+
+	m, err := s.shards.loadManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Shards) != 3 || m.Shards[0].Name != "1-r1" || m.Shards[2].RegionCode != "R3" {
+		t.Fatalf("manifest = %+v", m.Shards)
+	}
+	for _, e := range m.Shards {
+		if _, err := os.Stat(filepath.Join(dir, shardsDirName, e.Name)); err != nil {
+			t.Errorf("shard %s: %v", e.Name, err)
+		}
+	}
+
+	ro, err := openResultsStoreReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ro.layout() != storeLayoutSharded {
+		t.Fatalf("layout = %q, want %q", ro.layout(), storeLayoutSharded)
+	}
+	var got []storedResult
+	err = ro.readRange(start.Add(-time.Minute), time.Now(), func(sr storedResult) error {
+		got = append(got, sr)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != want {
+		t.Fatalf("read %d results, want %d", len(got), want)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i].At.Before(got[i-1].At) {
+			t.Fatalf("results out of order at %d: %v before %v", i, got[i].At, got[i-1].At)
+		}
+	}
+	if got[0].Hostname != "3a" {
+		t.Errorf("first result = %+v, want of 3a", got[0])
+	}
+
+	if _, err := openStoreForMaintenance(dir); err == nil {
+		t.Error("opened sharded store for db maintenance")
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"time"
+)
+
+const defaultSimulateRange = 7 * 24 * time.Hour
+
+// Detectors evaluated by the simulate subcommand.
+const (
+	detectorBaselineDeviation = "baseline_deviation"
+	detectorQualityScore      = "quality_score"
+	detectorGroupReachability = "group_reachability"
+)
+
+// simulateThresholds are the thresholds of the detectors evaluated by the
+// simulate subcommand.
+type simulateThresholds struct {
+	// deviation is the baseline deviation in percent above which a
+	// timeseries breaches.
+	deviation float64
+	// quality is the quality score below which an uplink breaches.
+	quality float64
+	// reachable is the reachable ratio below which a group breaches.
+	reachable float64
+	// forDuration is how long a breach must last to be an incident, as with
+	// the for clause of a Prometheus alerting rule.
+	forDuration time.Duration
+}
+
+// incident is a contiguous run of windows in which a detector breached its
+// threshold for a subject.
+type incident struct {
+	Detector string
+	Subject  string
+	Start    time.Time
+	End      time.Time // of the last breaching window
+	Windows  int
+	// Worst is the value furthest past the threshold.
+	Worst float64
+}
+
+func (i *incident) duration() time.Duration {
+	return i.End.Sub(i.Start)
+}
+
+// runSimulate implements the simulate subcommand, replaying stored results
+// through the baseline, quality score, and group aggregation pipelines window
+// by window, as fast as possible or at --speed times real time, and writing
+// the incidents the detectors would have raised with the given thresholds to
+// w. Results in the warmup preceding the range prime baselines without
+// raising incidents. args are the subcommand's arguments.
+func runSimulate(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	storeDir := fs.String("store-dir", "", "directory of the store to replay")
+	configPath := fs.String("config", "", "path to the HuJSON config file whose Groups and QualityScore to replay with")
+	hostname := fs.String("hostname", "", "if set, replay only the results of the target with this hostname")
+	from := fs.String("from", "", "start of the time range in RFC 3339 format; defaults to 7 days before --to")
+	to := fs.String("to", "", "end of the time range in RFC 3339 format; defaults to now")
+	warmup := fs.Duration("warmup", baselineDays*24*time.Hour, "duration of results before --from replayed to prime baselines, without raising incidents")
+	speed := fs.Float64("speed", 0, "replay at this multiple of real time, e.g. 3600 for an hour per second, or as fast as possible if 0")
+	var th simulateThresholds
+	fs.Float64Var(&th.deviation, "deviation-threshold", 50, "baseline deviation in percent above which a timeseries breaches")
+	fs.Float64Var(&th.quality, "quality-threshold", 50, "quality score below which an uplink breaches")
+	fs.Float64Var(&th.reachable, "reachable-threshold", 0.5, "reachable ratio below which a group breaches")
+	fs.DurationVar(&th.forDuration, "for", 0, "minimum duration of a breach to count as an incident")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(*storeDir) < 1 {
+		return errors.New("simulate requires the store-dir flag")
+	}
+	if *speed < 0 || *warmup < 0 || th.forDuration < 0 {
+		return errors.New("speed, warmup, and for must not be negative")
+	}
+	fromTime, toTime, err := parseTimeRange(url.Values{"from": {*from}, "to": {*to}}, defaultSimulateRange)
+	if err != nil {
+		return err
+	}
+	cfg := &config{}
+	if len(*configPath) > 0 {
+		cfg, err = loadConfig(*configPath)
+		if err != nil {
+			return fmt.Errorf("invalid config file: %w", err)
+		}
+	}
+	store, err := openResultsStoreReadOnly(*storeDir)
+	if err != nil {
+		return err
+	}
+	var windows [][]result
+	err = store.readRange(fromTime.Add(-*warmup), toTime, func(sr storedResult) error {
+		if len(*hostname) > 0 && sr.Hostname != *hostname {
+			return nil
+		}
+		r := sr.toResult()
+		if n := len(windows); n > 0 && windows[n-1][0].at.Equal(r.at) {
+			windows[n-1] = append(windows[n-1], r)
+		} else {
+			windows = append(windows, []result{r})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.SortStableFunc(windows, func(a, b []result) int {
+		return a[0].at.Compare(b[0].at)
+	})
+
+	sim := newSimulation(cfg, th)
+	results := 0
+	for i, window := range windows {
+		if *speed > 0 && i > 0 {
+			time.Sleep(time.Duration(float64(window[0].at.Sub(windows[i-1][0].at)) / *speed))
+		}
+		sim.replay(window, !window[0].at.Before(fromTime))
+		results += len(window)
+	}
+	incidents := sim.finish()
+	writeIncidents(w, fromTime, toTime, len(windows), results, incidents)
+	return nil
+}
+
+// simulation replays windows of results through the pipelines, tracking
+// incidents. It is not safe for concurrent use.
+type simulation struct {
+	cfg       *config
+	th        simulateThresholds
+	baselines *baselineTracker
+	quality   *qualityScorer
+	open      map[[2]string]*incident // by detector and subject
+	closed    []*incident
+}
+
+func newSimulation(cfg *config, th simulateThresholds) *simulation {
+	return &simulation{
+		cfg:       cfg,
+		th:        th,
+		baselines: newBaselineTracker(),
+		quality:   newQualityScorer(),
+		open:      make(map[[2]string]*incident),
+	}
+}
+
+// replay replays the results of a window, evaluating detectors if detect is
+// set.
+func (s *simulation) replay(results []result, detect bool) {
+	at := results[0].at
+	results = aggregatable(results)
+	s.baselines.add(results)
+	scores := s.quality.score(results, s.cfg.QualityScore)
+	aggs := aggregateGroups(s.cfg.Groups, results)
+	if !detect {
+		return
+	}
+	breaching := make(map[[2]string]bool)
+	breach := func(detector, subject string, value float64, worse func(a, b float64) bool) {
+		k := [2]string{detector, subject}
+		breaching[k] = true
+		inc, ok := s.open[k]
+		if !ok {
+			inc = &incident{Detector: detector, Subject: subject, Start: at, Worst: value}
+			s.open[k] = inc
+		}
+		inc.End = at
+		inc.Windows++
+		if worse(value, inc.Worst) {
+			inc.Worst = value
+		}
+	}
+	higher := func(a, b float64) bool { return a > b }
+	lower := func(a, b float64) bool { return a < b }
+	for _, st := range s.baselines.statuses() {
+		if d := st.deviationPercent(); d > s.th.deviation {
+			breach(detectorBaselineDeviation, resultKeySubject(st.key), d, higher)
+		}
+	}
+	for u, score := range scores {
+		if score < s.th.quality {
+			breach(detectorQualityScore, u.uplink+" "+u.addressFamily, score, lower)
+		}
+	}
+	for k, agg := range aggs {
+		if ratio := float64(agg.reachable) / float64(agg.total); ratio < s.th.reachable {
+			subject := fmt.Sprintf("%s %s %s/%d %s stable=%v", k.group, k.addressFamily, k.protocol, k.dstPort, k.timestampSource, k.connStability)
+			breach(detectorGroupReachability, subject, ratio, lower)
+		}
+	}
+	for k, inc := range s.open {
+		if !breaching[k] {
+			s.close(k, inc)
+		}
+	}
+}
+
+// close ends the open incident inc, keeping it if it lasted long enough.
+func (s *simulation) close(k [2]string, inc *incident) {
+	delete(s.open, k)
+	if inc.duration() >= s.th.forDuration {
+		s.closed = append(s.closed, inc)
+	}
+}
+
+// finish closes all open incidents, and returns all incidents in order of
+// start.
+func (s *simulation) finish() []*incident {
+	for k, inc := range s.open {
+		s.close(k, inc)
+	}
+	slices.SortFunc(s.closed, func(a, b *incident) int {
+		return cmp.Or(
+			a.Start.Compare(b.Start),
+			cmp.Compare(a.Detector, b.Detector),
+			cmp.Compare(a.Subject, b.Subject),
+		)
+	})
+	return s.closed
+}
+
+func resultKeySubject(k resultKey) string {
+	s := fmt.Sprintf("%s %s %s/%d %s stable=%v", k.meta.hostname, addressFamilyOf(k.meta), k.protocol, k.dstPort, k.timestampSource, k.connStability)
+	if k.proxy != "" {
+		s += " proxy=" + k.proxy
+	}
+	if k.xlat != "" {
+		s += " xlat=" + k.xlat
+	}
+	return s
+}
+
+// writeIncidents writes incidents as a markdown report to w.
+func writeIncidents(w io.Writer, from, to time.Time, windows, results int, incidents []*incident) {
+	fmt.Fprintf(w, "# Simulation %s to %s\n\n", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	fmt.Fprintf(w, "Replayed %d results in %d windows.\n\n", results, windows)
+	if len(incidents) == 0 {
+		fmt.Fprintf(w, "No incidents.\n")
+		return
+	}
+	counts := make(map[string]int)
+	for _, inc := range incidents {
+		counts[inc.Detector]++
+	}
+	for _, d := range []string{detectorBaselineDeviation, detectorQualityScore, detectorGroupReachability} {
+		if counts[d] > 0 {
+			fmt.Fprintf(w, "- %s: %d incidents\n", d, counts[d])
+		}
+	}
+	fmt.Fprintf(w, "\n| Start | Duration | Windows | Detector | Subject | Worst |\n")
+	fmt.Fprintf(w, "|---|---|---|---|---|---|\n")
+	for _, inc := range incidents {
+		fmt.Fprintf(w, "| %s | %s | %d | %s | %s | %.2f |\n", inc.Start.Format(time.RFC3339), inc.duration(), inc.Windows, inc.Detector, inc.Subject, inc.Worst)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSimulate(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openResultsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := resultKey{
+		meta:     nodeMeta{regionID: 1, regionCode: "nyc", hostname: "derp1a", addr: netip.MustParseAddr("192.0.2.1")},
+		protocol: protocolSTUN,
+		dstPort:  3478,
+	}
+	mk := func(at time.Time, rtt time.Duration) []result {
+		return []result{{key: key, at: at, rtt: &rtt}}
+	}
+	// 10ms every minute of 20:00-20:30 on the previous 4 days, and 30ms
+	// from 20:10 on the day replayed.
+	start := time.Date(2024, 6, 10, 20, 0, 0, 0, time.UTC)
+	for day := 4; day >= 1; day-- {
+		for m := range 30 {
+			if err := s.append(mk(start.AddDate(0, 0, -day).Add(time.Duration(m)*time.Minute), 10*time.Millisecond)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for m := range 30 {
+		rtt := 10 * time.Millisecond
+		if m >= 10 {
+			rtt = 30 * time.Millisecond
+		}
+		if err := s.append(mk(start.Add(time.Duration(m)*time.Minute), rtt)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.close()
+
+	run := func(args ...string) string {
+		t.Helper()
+		var buf bytes.Buffer
+		args = append([]string{"--store-dir=" + dir, "--from=" + start.Format(time.RFC3339), "--to=" + start.Add(time.Hour).Format(time.RFC3339)}, args...)
+		if err := runSimulate(args, &buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	// The median of the hour deviates by 100% at 20:19, and 200% from
+	// 20:20.
+	got := run()
+	if !strings.Contains(got, "- baseline_deviation: 1 incidents") || !strings.Contains(got, "| 2024-06-10T20:19:00Z | 10m0s | 11 | baseline_deviation | derp1a ipv4 stun/3478") {
+		t.Errorf("missing baseline deviation incident:\n%s", got)
+	}
+	if !strings.Contains(got, "Replayed 150 results in 150 windows.") {
+		t.Errorf("unexpected replay summary:\n%s", got)
+	}
+	if got := run("--deviation-threshold=150"); !strings.Contains(got, "| 2024-06-10T20:20:00Z | 9m0s | 10 |") {
+		t.Errorf("missing incident above 150%%:\n%s", got)
+	}
+	if got := run("--for=15m"); !strings.Contains(got, "No incidents.") {
+		t.Errorf("got incidents shorter than --for:\n%s", got)
+	}
+}
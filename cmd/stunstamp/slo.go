@@ -0,0 +1,665 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	sloComplianceMetricName = "stunstamp_slo_compliance_ratio"
+	sloBudgetMetricName     = "stunstamp_slo_error_budget_remaining_ratio"
+	sloBurnRateMetricName   = "stunstamp_slo_burn_rate"
+	sloWindowGoodMetricName = "stunstamp_slo_window_good"
+)
+
+const (
+	// defaultSLOWindow is the default sloConfig.Window.
+	defaultSLOWindow = 5 * time.Minute
+	// sloBurnRateWindow is the time range the burn rate of an SLO is
+	// computed over.
+	sloBurnRateWindow = time.Hour
+	// sloReportsDir is the directory of --store-dir monthly SLO reports are
+	// written to.
+	sloReportsDir = "slo-reports"
+	// sloReportWorstWindows is the number of worst windows listed per SLO
+	// in reports.
+	sloReportWorstWindows = 10
+)
+
+// sloConfig defines a latency service level objective over the selected
+// targets, or all targets if no selectors are set: the Percentile of the RTTs
+// of direct probes in every Window must be below Threshold in Objective
+// percent of windows, e.g. "p95 RTT to the home DERP region below 60ms in
+// 99.5% of 5-minute windows". Failed probes count as infinite RTTs, and
+// windows without probes do not count.
+type sloConfig struct {
+	// Name identifies the SLO in metrics and reports.
+	Name string
+	targetSelector
+	// Protocol restricts the SLO to the probes of a protocol, if set.
+	Protocol protocol `json:",omitempty"`
+	// Percentile is the percentile of RTTs in a window, e.g. 95.
+	Percentile float64
+	// Threshold is the RTT the percentile must be below, in
+	// time.ParseDuration format, e.g. "60ms".
+	Threshold string
+	// Window is the duration of windows in time.ParseDuration format. Windows
+	// are aligned to multiples of it in UTC. It defaults to 5m.
+	Window string `json:",omitempty"`
+	// Objective is the percentage of windows that must be good, e.g. 99.5.
+	Objective float64
+}
+
+func (c *sloConfig) validate() error {
+	if c.Name == "" {
+		return errors.New("Name is required")
+	}
+	if c.Protocol != "" && !slices.Contains(allProtocols, c.Protocol) {
+		return fmt.Errorf("unknown protocol %q", c.Protocol)
+	}
+	if !(c.Percentile > 0 && c.Percentile <= 100) {
+		return fmt.Errorf("Percentile %v is not in (0, 100]", c.Percentile)
+	}
+	if !(c.Objective > 0 && c.Objective < 100) {
+		return fmt.Errorf("Objective %v is not in (0, 100)", c.Objective)
+	}
+	threshold, err := time.ParseDuration(c.Threshold)
+	if err != nil {
+		return fmt.Errorf("Threshold: %w", err)
+	}
+	if threshold <= 0 {
+		return errors.New("Threshold must be positive")
+	}
+	if c.Window != "" {
+		window, err := time.ParseDuration(c.Window)
+		if err != nil {
+			return fmt.Errorf("Window: %w", err)
+		}
+		if window < minInterval || window > 24*time.Hour {
+			return fmt.Errorf("Window must be >= %s and <= 24h", minInterval)
+		}
+	}
+	return nil
+}
+
+// threshold returns the validated Threshold of c.
+func (c *sloConfig) threshold() time.Duration {
+	d, _ := time.ParseDuration(c.Threshold)
+	return d
+}
+
+// window returns the validated Window of c.
+func (c *sloConfig) window() time.Duration {
+	if c.Window == "" {
+		return defaultSLOWindow
+	}
+	d, _ := time.ParseDuration(c.Window)
+	return d
+}
+
+// matches reports whether r counts towards c.
+func (c *sloConfig) matches(r result) bool {
+	return r.key.proxy == "" && r.key.xlat == "" &&
+		(c.Protocol == "" || r.key.protocol == c.Protocol) &&
+		(c.targetSelector.empty() || c.targetSelector.matches(r.key.meta))
+}
+
+// String describes c, e.g. "p95 stun RTT of region nyc below 60ms in 99.5%
+// of 5m0s windows".
+func (c *sloConfig) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "p%v ", c.Percentile)
+	if c.Protocol != "" {
+		fmt.Fprintf(&b, "%s ", c.Protocol)
+	}
+	b.WriteString("RTT")
+	var sel []string
+	for _, id := range c.RegionIDs {
+		sel = append(sel, fmt.Sprintf("region %d", id))
+	}
+	for _, code := range c.RegionCodes {
+		sel = append(sel, "region "+code)
+	}
+	sel = append(sel, c.Hostnames...)
+	if len(sel) > 0 {
+		fmt.Fprintf(&b, " of %s", strings.Join(sel, ", "))
+	}
+	fmt.Fprintf(&b, " below %v in %v%% of %v windows", c.threshold(), c.Objective, c.window())
+	return b.String()
+}
+
+// sloWindow is the evaluation of an SLO over a window.
+type sloWindow struct {
+	Start    time.Time
+	Samples  int
+	Failures int
+	// Percentile is the percentile RTT, valid unless Lost.
+	Percentile time.Duration
+	// Lost is whether the percentile falls on a failed probe.
+	Lost bool
+	Good bool
+}
+
+// evaluateSLOWindow evaluates c over the RTTs of the window starting at
+// start, with nil signifying failure.
+func evaluateSLOWindow(c *sloConfig, start time.Time, rtts []*time.Duration) sloWindow {
+	w := sloWindow{Start: start, Samples: len(rtts)}
+	var ok []time.Duration
+	for _, rtt := range rtts {
+		if rtt == nil {
+			w.Failures++
+			continue
+		}
+		ok = append(ok, *rtt)
+	}
+	slices.Sort(ok)
+	// The nearest-rank percentile, with failures ranked last.
+	rank := max(1, int(math.Ceil(c.Percentile/100*float64(len(rtts)))))
+	if rank > len(ok) {
+		w.Lost = true
+		return w
+	}
+	w.Percentile = ok[rank-1]
+	w.Good = w.Percentile < c.threshold()
+	return w
+}
+
+// evaluateSLO evaluates c over every window of results, in order.
+func evaluateSLO(c *sloConfig, results []result) []sloWindow {
+	window := c.window()
+	byWindow := make(map[time.Time][]*time.Duration)
+	for _, r := range results {
+		if c.matches(r) {
+			start := r.at.UTC().Truncate(window)
+			byWindow[start] = append(byWindow[start], r.rtt)
+		}
+	}
+	ret := make([]sloWindow, 0, len(byWindow))
+	for start, rtts := range byWindow {
+		ret = append(ret, evaluateSLOWindow(c, start, rtts))
+	}
+	slices.SortFunc(ret, func(a, b sloWindow) int { return a.Start.Compare(b.Start) })
+	return ret
+}
+
+// monthStartOf returns the start of the month of t in UTC.
+func monthStartOf(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// sloBudget returns the number of bad windows c allows in the month starting
+// at month, its error budget.
+func sloBudget(c *sloConfig, month time.Time) float64 {
+	windows := float64(month.AddDate(0, 1, 0).Sub(month)) / float64(c.window())
+	return windows * (100 - c.Objective) / 100
+}
+
+// sloMonth counts the windows of an SLO in a month.
+type sloMonth struct {
+	start   time.Time
+	windows int
+	good    int
+}
+
+// sloAccumulator holds the RTTs of the current window of an SLO.
+type sloAccumulator struct {
+	start time.Time
+	rtts  []*time.Duration
+}
+
+// sloTracker evaluates SLOs continuously as results arrive, exporting their
+// compliance, error budget, and burn rate. It is safe for concurrent use.
+type sloTracker struct {
+	mu      sync.Mutex
+	current map[string]*sloAccumulator // by SLO name
+	months  map[string]*sloMonth
+	// recent holds the windows of the last sloBurnRateWindow, oldest first.
+	recent   map[string][]sloWindow
+	lastGood map[string]bool
+	// month is the month windows were last closed in.
+	month time.Time
+	// onMonthEnd, if set, is called with the start of a month when the
+	// first window of a later month closes.
+	onMonthEnd func(month time.Time)
+}
+
+func newSLOTracker() *sloTracker {
+	return &sloTracker{
+		current:  make(map[string]*sloAccumulator),
+		months:   make(map[string]*sloMonth),
+		recent:   make(map[string][]sloWindow),
+		lastGood: make(map[string]bool),
+	}
+}
+
+// update accounts the results of a window processed at now against slos,
+// returning the timeseries of every SLO with closed windows this month, and
+// stale markers for those of SLOs removed from slos.
+func (t *sloTracker) update(results []result, slos []sloConfig, instance string, now time.Time) []prompb.TimeSeries {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var ts []prompb.TimeSeries
+	names := make(map[string]bool)
+	for i := range slos {
+		c := &slos[i]
+		names[c.Name] = true
+		window := c.window()
+		acc := t.current[c.Name]
+		for _, r := range results {
+			if !c.matches(r) {
+				continue
+			}
+			start := r.at.UTC().Truncate(window)
+			if acc == nil || start.After(acc.start) {
+				if acc != nil {
+					t.close(c, acc)
+				}
+				acc = &sloAccumulator{start: start}
+				t.current[c.Name] = acc
+			}
+			if start.Equal(acc.start) {
+				acc.rtts = append(acc.rtts, r.rtt)
+			}
+		}
+		// Close the window once it has ended, rather than when the next
+		// one starts, in case it never does.
+		if acc != nil && !now.Before(acc.start.Add(window)) {
+			t.close(c, acc)
+			delete(t.current, c.Name)
+		}
+		if m := t.months[c.Name]; m != nil && m.windows > 0 {
+			ts = append(ts, t.toPromTimeSeries(c, m, instance, now)...)
+		}
+	}
+	for name := range t.months {
+		if !names[name] {
+			ts = append(ts, sloStaleMarkers(name, instance, now)...)
+			t.forgetSLO(name)
+		}
+	}
+	for name := range t.current {
+		if !names[name] {
+			t.forgetSLO(name)
+		}
+	}
+	return ts
+}
+
+// close evaluates acc and accounts it against c. t.mu must be held.
+func (t *sloTracker) close(c *sloConfig, acc *sloAccumulator) {
+	t.add(c, evaluateSLOWindow(c, acc.start, acc.rtts))
+}
+
+// add accounts w against c. t.mu must be held.
+func (t *sloTracker) add(c *sloConfig, w sloWindow) {
+	month := monthStartOf(w.Start)
+	if month.After(t.month) {
+		if !t.month.IsZero() && t.onMonthEnd != nil {
+			t.onMonthEnd(t.month)
+		}
+		t.month = month
+	}
+	m := t.months[c.Name]
+	if m == nil || month.After(m.start) {
+		m = &sloMonth{start: month}
+		t.months[c.Name] = m
+	}
+	if month.Equal(m.start) {
+		m.windows++
+		if w.Good {
+			m.good++
+		}
+	}
+	recent := append(t.recent[c.Name], w)
+	for len(recent) > 0 && !recent[0].Start.After(w.Start.Add(-sloBurnRateWindow)) {
+		recent = recent[1:]
+	}
+	t.recent[c.Name] = recent
+	t.lastGood[c.Name] = w.Good
+}
+
+// forgetSLO drops all state of the SLO name. t.mu must be held.
+func (t *sloTracker) forgetSLO(name string) {
+	delete(t.current, name)
+	delete(t.months, name)
+	delete(t.recent, name)
+	delete(t.lastGood, name)
+}
+
+// seed accounts the windows of slos over stored results, e.g. those of the
+// current month before a restart, that start before the window of before,
+// which live results may already be accounted in.
+func (t *sloTracker) seed(results []result, slos []sloConfig, before time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Windows accounted live are preserved, following the seeded ones.
+	months, recent, lastGood := t.months, t.recent, maps.Clone(t.lastGood)
+	t.months, t.recent = make(map[string]*sloMonth), make(map[string][]sloWindow)
+	onMonthEnd := t.onMonthEnd
+	t.onMonthEnd = nil
+	defer func() { t.onMonthEnd = onMonthEnd }()
+	for i := range slos {
+		c := &slos[i]
+		for _, w := range evaluateSLO(c, results) {
+			if w.Start.Before(before.UTC().Truncate(c.window())) {
+				t.add(c, w)
+			}
+		}
+	}
+	for name, m := range months {
+		if s := t.months[name]; s != nil && s.start.Equal(m.start) {
+			m.windows += s.windows
+			m.good += s.good
+		}
+		t.months[name] = m
+	}
+	for name, ws := range recent {
+		t.recent[name] = append(t.recent[name], ws...)
+	}
+	maps.Copy(t.lastGood, lastGood)
+}
+
+func sloTimeSeries(metricName, name, instance string, at time.Time, value float64) prompb.TimeSeries {
+	ts := instanceTimeSeries(metricName, instance, at, value)
+	ts.Labels = append(ts.Labels, prompb.Label{Name: "slo", Value: name})
+	return ts
+}
+
+// toPromTimeSeries returns the timeseries of c, whose windows this month are
+// counted in m. t.mu must be held.
+func (t *sloTracker) toPromTimeSeries(c *sloConfig, m *sloMonth, instance string, at time.Time) []prompb.TimeSeries {
+	budget := sloBudget(c, m.start)
+	ts := []prompb.TimeSeries{
+		sloTimeSeries(sloComplianceMetricName, c.Name, instance, at, float64(m.good)/float64(m.windows)),
+		sloTimeSeries(sloBudgetMetricName, c.Name, instance, at, 1-float64(m.windows-m.good)/budget),
+		sloTimeSeries(sloWindowGoodMetricName, c.Name, instance, at, boolToFloat(t.lastGood[c.Name])),
+	}
+	if recent := t.recent[c.Name]; len(recent) > 0 {
+		bad := 0
+		for _, w := range recent {
+			if !w.Good {
+				bad++
+			}
+		}
+		// The burn rate is the rate the error budget is spent at relative
+		// to the rate that spends it exactly by the end of the month.
+		rate := float64(bad) / float64(len(recent)) / ((100 - c.Objective) / 100)
+		ts = append(ts, sloTimeSeries(sloBurnRateMetricName, c.Name, instance, at, rate))
+	}
+	return ts
+}
+
+func sloStaleMarkers(name, instance string, at time.Time) []prompb.TimeSeries {
+	var ts []prompb.TimeSeries
+	for _, metric := range []string{sloComplianceMetricName, sloBudgetMetricName, sloWindowGoodMetricName, sloBurnRateMetricName} {
+		ts = append(ts, sloTimeSeries(metric, name, instance, at, math.Float64frombits(staleNaN)))
+	}
+	return ts
+}
+
+// staleMarkers returns stale markers for the budget series of every SLO
+// evaluated.
+func (t *sloTracker) staleMarkers(instance string) []prompb.TimeSeries {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	var ts []prompb.TimeSeries
+	for name := range t.months {
+		ts = append(ts, sloStaleMarkers(name, instance, now)...)
+	}
+	return ts
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// sloReport is the compliance of SLOs over a month, to send to ISPs.
+type sloReport struct {
+	Instance string
+	Month    string
+	From, To time.Time
+	SLOs     []sloSummary
+}
+
+// sloSummary is the compliance of an SLO over a month.
+type sloSummary struct {
+	Name        string
+	Description string
+	Objective   float64
+	// Windows is the number of windows with probes, of Expected in the
+	// month.
+	Windows  int
+	Expected int
+	Good     int
+	// Compliance is the percentage of good windows.
+	Compliance float64
+	Met        bool
+	// BudgetUsed is the percentage of the error budget spent.
+	BudgetUsed float64
+	// Worst are the worst bad windows.
+	Worst []sloWindow
+}
+
+// buildSLOReport returns the report of slos over results in the month
+// starting at month.
+func buildSLOReport(instance string, month time.Time, slos []sloConfig, results []result) *sloReport {
+	rep := &sloReport{
+		Instance: instance,
+		Month:    month.Format("2006-01"),
+		From:     month,
+		To:       month.AddDate(0, 1, 0),
+	}
+	for i := range slos {
+		c := &slos[i]
+		s := sloSummary{
+			Name:        c.Name,
+			Description: c.String(),
+			Objective:   c.Objective,
+			Expected:    int(rep.To.Sub(rep.From) / c.window()),
+		}
+		var bad []sloWindow
+		for _, w := range evaluateSLO(c, results) {
+			if w.Start.Before(rep.From) || !w.Start.Before(rep.To) {
+				continue
+			}
+			s.Windows++
+			if w.Good {
+				s.Good++
+			} else {
+				bad = append(bad, w)
+			}
+		}
+		if s.Windows > 0 {
+			s.Compliance = 100 * float64(s.Good) / float64(s.Windows)
+			s.Met = s.Compliance >= c.Objective
+		}
+		s.BudgetUsed = 100 * float64(len(bad)) / sloBudget(c, month)
+		slices.SortStableFunc(bad, func(a, b sloWindow) int {
+			return cmp.Or(
+				-compareBool(a.Lost, b.Lost),
+				-cmp.Compare(a.Percentile, b.Percentile),
+			)
+		})
+		s.Worst = bad[:min(len(bad), sloReportWorstWindows)]
+		rep.SLOs = append(rep.SLOs, s)
+	}
+	return rep
+}
+
+// readSLOResults returns the results in store between from and to that count
+// towards any of slos.
+func readSLOResults(store *resultsStore, slos []sloConfig, from, to time.Time) ([]result, error) {
+	var ret []result
+	err := store.readRange(from, to, func(sr storedResult) error {
+		r := sr.toResult()
+		for i := range slos {
+			if slos[i].matches(r) {
+				ret = append(ret, r)
+				break
+			}
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// writeSLOReportFiles writes the markdown and HTML reports of slos over the
+// month starting at month to the sloReportsDir of the store in dir.
+func writeSLOReportFiles(dir string, store *resultsStore, instance string, slos []sloConfig, month time.Time) error {
+	results, err := readSLOResults(store, slos, month, month.AddDate(0, 1, 0))
+	if err != nil {
+		return err
+	}
+	rep := buildSLOReport(instance, month, slos, results)
+	dir = filepath.Join(dir, sloReportsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for ext, tmpl := range map[string]interface {
+		Execute(io.Writer, any) error
+	}{".md": sloReportMarkdownTemplate, ".html": sloReportHTMLTemplate} {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, rep); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, "slo-"+rep.Month+ext), []byte(b.String()), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runSLOReport implements the slo-report subcommand, writing the report of
+// the SLOs in --config over a month of stored results to w. args are the
+// subcommand's arguments.
+func runSLOReport(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("slo-report", flag.ContinueOnError)
+	storeDir := fs.String("store-dir", "", "directory of the store to report on")
+	configPath := fs.String("config", "", "path to the HuJSON config file defining the SLOs")
+	monthFlag := fs.String("month", "", "month to report on in YYYY-MM format; defaults to the previous month")
+	format := fs.String("format", "markdown", "report format, markdown or html")
+	instance := fs.String("instance", "", "instance to name in the report; defaults to hostname")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(*storeDir) < 1 || len(*configPath) < 1 {
+		return errors.New("slo-report requires the store-dir and config flags")
+	}
+	if *format != "markdown" && *format != "html" {
+		return fmt.Errorf("unknown report format %q", *format)
+	}
+	month := monthStartOf(time.Now()).AddDate(0, -1, 0)
+	if *monthFlag != "" {
+		m, err := time.Parse("2006-01", *monthFlag)
+		if err != nil {
+			return fmt.Errorf("invalid month: %w", err)
+		}
+		month = m
+	}
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if len(cfg.SLOs) == 0 {
+		return errors.New("config defines no SLOs")
+	}
+	if *instance == "" {
+		*instance, _ = os.Hostname()
+	}
+	store, err := openResultsStoreReadOnly(*storeDir)
+	if err != nil {
+		return err
+	}
+	results, err := readSLOResults(store, cfg.SLOs, month, month.AddDate(0, 1, 0))
+	if err != nil {
+		return err
+	}
+	rep := buildSLOReport(*instance, month, cfg.SLOs, results)
+	if *format == "html" {
+		return sloReportHTMLTemplate.Execute(w, rep)
+	}
+	return sloReportMarkdownTemplate.Execute(w, rep)
+}
+
+var sloReportFuncs = map[string]any{
+	"time": func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+	"pct":  func(f float64) string { return fmt.Sprintf("%.3f%%", f) },
+	"met": func(b bool) string {
+		if b {
+			return "met"
+		}
+		return "MISSED"
+	},
+	"p": func(w sloWindow) string {
+		if w.Lost {
+			return "lost"
+		}
+		return w.Percentile.Round(time.Microsecond).String()
+	},
+}
+
+var sloReportMarkdownTemplate = template.Must(template.New("slo-report").Funcs(sloReportFuncs).Parse(`# Latency SLO report: {{.Month}}
+
+Measured by {{.Instance}} from {{time .From}} to {{time .To}}. Percentiles are of the RTTs of direct probes in every window, with failed probes counting as infinite RTTs. Windows without probes do not count.
+{{range .SLOs}}
+## {{.Name}}: {{met .Met}}
+
+Objective: {{.Description}}.
+
+| Compliance | Objective | Good windows | Windows | Expected windows | Error budget used |
+|---|---|---|---|---|---|
+| {{pct .Compliance}} | {{.Objective}}% | {{.Good}} | {{.Windows}} | {{.Expected}} | {{pct .BudgetUsed}} |
+{{if .Worst}}
+Worst windows:
+
+| Start | Percentile | Samples | Failures |
+|---|---|---|---|
+{{range .Worst}}| {{time .Start}} | {{p .}} | {{.Samples}} | {{.Failures}} |
+{{end}}{{end}}{{end}}`))
+
+var sloReportHTMLTemplate = htmltemplate.Must(htmltemplate.New("slo-report").Funcs(sloReportFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head><title>Latency SLO report: {{.Month}}</title></head>
+<body>
+<h1>Latency SLO report: {{.Month}}</h1>
+<p>Measured by {{.Instance}} from {{time .From}} to {{time .To}}. Percentiles are of the RTTs of direct probes in every window, with failed probes counting as infinite RTTs. Windows without probes do not count.</p>
+{{range .SLOs}}
+<h2>{{.Name}}: {{met .Met}}</h2>
+<p>Objective: {{.Description}}.</p>
+<table border="1" cellpadding="4">
+<tr><th>Compliance</th><th>Objective</th><th>Good windows</th><th>Windows</th><th>Expected windows</th><th>Error budget used</th></tr>
+<tr><td>{{pct .Compliance}}</td><td>{{.Objective}}%</td><td>{{.Good}}</td><td>{{.Windows}}</td><td>{{.Expected}}</td><td>{{pct .BudgetUsed}}</td></tr>
+</table>
+{{if .Worst}}
+<p>Worst windows:</p>
+<table border="1" cellpadding="4">
+<tr><th>Start</th><th>Percentile</th><th>Samples</th><th>Failures</th></tr>
+{{range .Worst}}<tr><td>{{time .Start}}</td><td>{{p .}}</td><td>{{.Samples}}</td><td>{{.Failures}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,214 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestSLOConfig(t *testing.T) {
+	for _, tt := range []struct {
+		raw     string
+		wantErr string
+	}{
+		{raw: `{"SLOs": [{"Name": "home", "RegionCodes": ["nyc"], "Percentile": 95, "Threshold": "60ms", "Objective": 99.5}]}`},
+		{raw: `{"SLOs": [{"Name": "stun", "Protocol": "stun", "Percentile": 50, "Threshold": "20ms", "Window": "1m", "Objective": 99}]}`},
+		{raw: `{"SLOs": [{"Percentile": 95, "Threshold": "60ms", "Objective": 99.5}]}`, wantErr: "Name is required"},
+		{raw: `{"SLOs": [{"Name": "a", "Percentile": 0, "Threshold": "60ms", "Objective": 99.5}]}`, wantErr: "Percentile"},
+		{raw: `{"SLOs": [{"Name": "a", "Percentile": 95, "Threshold": "60ms", "Objective": 100}]}`, wantErr: "Objective"},
+		{raw: `{"SLOs": [{"Name": "a", "Percentile": 95, "Threshold": "fast", "Objective": 99}]}`, wantErr: "Threshold"},
+		{raw: `{"SLOs": [{"Name": "a", "Percentile": 95, "Threshold": "60ms", "Window": "1s", "Objective": 99}]}`, wantErr: "Window must be"},
+		{raw: `{"SLOs": [{"Name": "a", "Percentile": 95, "Threshold": "60ms", "Objective": 99}, {"Name": "a", "Percentile": 50, "Threshold": "60ms", "Objective": 99}]}`, wantErr: "duplicate SLO name"},
+	} {
+		_, err := parseConfig([]byte(tt.raw))
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("parseConfig(%s) = %v", tt.raw, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("parseConfig(%s) = %v, want error containing %q", tt.raw, err, tt.wantErr)
+		}
+	}
+}
+
+func durationPtrs(ds ...time.Duration) []*time.Duration {
+	var ret []*time.Duration
+	for _, d := range ds {
+		if d < 0 {
+			ret = append(ret, nil)
+			continue
+		}
+		ret = append(ret, &d)
+	}
+	return ret
+}
+
+func TestEvaluateSLOWindow(t *testing.T) {
+	c := &sloConfig{Name: "a", Percentile: 90, Threshold: "60ms", Objective: 99}
+	ms := time.Millisecond
+	for _, tt := range []struct {
+		rtts     []*time.Duration
+		wantP    time.Duration
+		wantLost bool
+		wantGood bool
+	}{
+		{durationPtrs(10*ms, 20*ms, 30*ms, 40*ms, 50*ms, 10*ms, 20*ms, 30*ms, 40*ms, 100*ms), 50 * ms, false, true},
+		{durationPtrs(10*ms, 20*ms, 30*ms, 40*ms, 50*ms, 10*ms, 20*ms, 30*ms, 70*ms, 100*ms), 70 * ms, false, false},
+		// A failure ranks above every RTT, but the p90 of 10 samples is the
+		// 9th.
+		{durationPtrs(10*ms, 10*ms, 10*ms, 10*ms, 10*ms, 10*ms, 10*ms, 10*ms, 10*ms, -1), 10 * ms, false, true},
+		{durationPtrs(10*ms, 10*ms, 10*ms, 10*ms, 10*ms, 10*ms, 10*ms, 10*ms, -1, -1), 0, true, false},
+	} {
+		w := evaluateSLOWindow(c, time.Time{}, tt.rtts)
+		if w.Percentile != tt.wantP || w.Lost != tt.wantLost || w.Good != tt.wantGood {
+			t.Errorf("evaluateSLOWindow = %+v, want percentile %v, lost %v, good %v", w, tt.wantP, tt.wantLost, tt.wantGood)
+		}
+	}
+}
+
+// sloValues returns the values of the SLO timeseries in ts by metric name.
+func sloValues(ts []prompb.TimeSeries) map[string]float64 {
+	ret := make(map[string]float64)
+	for _, s := range ts {
+		ret[labelValue(s.Labels, "__name__")] = s.Samples[0].Value
+	}
+	return ret
+}
+
+func TestSLOTracker(t *testing.T) {
+	home := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	other := nodeMeta{regionID: 2, regionCode: "fra", hostname: "2a", addr: netip.MustParseAddr("192.0.2.2")}
+	slos := []sloConfig{{Name: "home", targetSelector: targetSelector{RegionCodes: []string{"nyc"}}, Percentile: 50, Threshold: "60ms", Window: "10m", Objective: 99}}
+	window := func(at time.Time, homeRTT time.Duration) []result {
+		far := time.Second
+		return []result{
+			{key: resultKey{meta: home, protocol: protocolSTUN}, at: at, rtt: &homeRTT},
+			{key: resultKey{meta: home, protocol: protocolSTUN, proxy: "socks5"}, at: at, rtt: &far},
+			{key: resultKey{meta: other, protocol: protocolSTUN}, at: at, rtt: &far},
+		}
+	}
+
+	var ended []time.Time
+	tr := newSLOTracker()
+	tr.onMonthEnd = func(month time.Time) { ended = append(ended, month) }
+	// The last hour of August, with the last 10-minute window bad, and the
+	// first windows of September, the first of which closes at 00:10.
+	start := time.Date(2024, 8, 31, 23, 0, 0, 0, time.UTC)
+	var values map[string]float64
+	for i := range 80 {
+		at := start.Add(time.Duration(i) * time.Minute)
+		rtt := 20 * time.Millisecond
+		if i >= 50 && i < 60 {
+			rtt = 80 * time.Millisecond
+		}
+		ts := tr.update(window(at, rtt), slos, "i", at.Add(30*time.Second))
+		if i == 60 {
+			values = sloValues(ts)
+		}
+	}
+	if m := tr.months["home"]; m == nil || m.windows != 1 || m.good != 1 {
+		t.Errorf("September = %+v, want 1 good window", m)
+	}
+	if len(ended) != 1 || !ended[0].Equal(time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("months ended = %v, want August", ended)
+	}
+	// At the end of August: 6 windows, 5 good.
+	if got := values[sloComplianceMetricName]; math.Abs(got-5.0/6) > 1e-9 {
+		t.Errorf("compliance = %v, want 5/6", got)
+	}
+	// The budget of 31 days of 10-minute windows at 99% is 44.64 windows.
+	if got, want := values[sloBudgetMetricName], 1-1/(31*144*0.01); math.Abs(got-want) > 1e-9 {
+		t.Errorf("error budget remaining = %v, want %v", got, want)
+	}
+	if got := values[sloBurnRateMetricName]; math.Abs(got-100.0/6) > 1e-9 {
+		t.Errorf("burn rate = %v, want %v", got, 100.0/6)
+	}
+	if got := values[sloWindowGoodMetricName]; got != 0 {
+		t.Errorf("last window good = %v, want 0", got)
+	}
+
+	// Seeding accounts windows before the first live one.
+	seeded := newSLOTracker()
+	seeded.update(window(start.Add(time.Hour), 20*time.Millisecond), slos, "i", start.Add(time.Hour+15*time.Minute))
+	var stored []result
+	for i := range 60 {
+		stored = append(stored, window(start.Add(time.Duration(i)*time.Minute), 80*time.Millisecond)...)
+	}
+	seeded.seed(stored, slos, start.Add(time.Hour))
+	if m := seeded.months["home"]; m == nil || m.windows != 1 || m.good != 1 {
+		t.Errorf("seeded September = %+v, want the live window only", m)
+	}
+	if got := len(seeded.recent["home"]); got != 7 {
+		t.Errorf("seeded %d recent windows, want 7", got)
+	}
+
+	// Removed SLOs are marked stale.
+	ts := tr.update(nil, nil, "i", start.Add(2*time.Hour))
+	if len(ts) != 4 || math.Float64bits(ts[0].Samples[0].Value) != staleNaN {
+		t.Errorf("got %d timeseries after removing SLO, want 4 stale markers", len(ts))
+	}
+	if len(tr.months) != 0 {
+		t.Errorf("state of removed SLO retained")
+	}
+}
+
+func TestSLOReport(t *testing.T) {
+	home := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	slos := []sloConfig{{Name: "home", Protocol: protocolSTUN, Percentile: 95, Threshold: "60ms", Window: "1h", Objective: 99.5}}
+	month := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	var results []result
+	for i := range 30 * 24 {
+		rtt := 20 * time.Millisecond
+		if i%100 == 0 {
+			rtt = 90 * time.Millisecond
+		}
+		var p *time.Duration
+		if i != 7 {
+			p = &rtt
+		}
+		results = append(results, result{key: resultKey{meta: home, protocol: protocolSTUN}, at: month.Add(time.Duration(i) * time.Hour), rtt: p})
+	}
+	rep := buildSLOReport("i", month, slos, results)
+	s := rep.SLOs[0]
+	if s.Windows != 720 || s.Expected != 720 || s.Good != 711 || s.Met {
+		t.Errorf("summary = %+v, want 711 of 720 windows good, missed", s)
+	}
+	if len(s.Worst) != 9 || !s.Worst[0].Lost || s.Worst[1].Percentile != 90*time.Millisecond {
+		t.Errorf("worst windows = %+v", s.Worst)
+	}
+	var b bytes.Buffer
+	if err := sloReportMarkdownTemplate.Execute(&b, rep); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# Latency SLO report: 2024-06", "## home: MISSED", "p95 stun RTT below 60ms in 99.5% of 1h0m0s windows", "| 98.750% | 99.5% | 711 | 720 | 720 | 250.000% |", "| lost |"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("report does not contain %q:\n%s", want, b.String())
+		}
+	}
+
+	dir := t.TempDir()
+	store, err := openResultsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.append(results); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSLOReportFiles(dir, store, "i", slos, month); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"slo-2024-06.md", "slo-2024-06.html"} {
+		if b, err := os.ReadFile(filepath.Join(dir, sloReportsDir, name)); err != nil || !bytes.Contains(b, []byte("711")) {
+			t.Errorf("%s: %v, %q", name, err, b)
+		}
+	}
+}
@@ -0,0 +1,630 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The SNMP agent in this file exposes per-target summaries over SNMPv1 and
+// SNMPv2c, as described by STUNSTAMP-MIB.txt, for network management systems
+// that only ingest SNMP. It is read-only and implements the Get, GetNext and
+// GetBulk operations, which is all walking a table takes.
+
+// defaultSNMPOIDPrefix is the OID of the stunstamp MIB module, under the
+// experimental arc. Deployments with a private enterprise number should
+// register the module under it instead.
+const defaultSNMPOIDPrefix = "1.3.6.1.3.7847"
+
+// snmpSummaryWindow is the window loss and availability are summarized over.
+const snmpSummaryWindow = 5 * time.Minute
+
+// Columns of stunstampTargetTable, see STUNSTAMP-MIB.txt.
+const (
+	snmpColIndex = iota + 1
+	snmpColHostname
+	snmpColRegionCode
+	snmpColAddress
+	snmpColProtocol
+	snmpColDstPort
+	snmpColLastRTT
+	snmpColLossPerMille
+	snmpColStatus
+	snmpNumCols = snmpColStatus
+)
+
+// Values of stunstampTargetStatus.
+const (
+	snmpStatusUp   = 1
+	snmpStatusDown = 2
+)
+
+// snmpRowKey identifies a row of the target table: a target, protocol and
+// port, summarizing every timestamp source and conn stability.
+type snmpRowKey struct {
+	meta     nodeMeta
+	protocol protocol
+	dstPort  int
+}
+
+type snmpSample struct {
+	at time.Time
+	ok bool
+}
+
+type snmpRow struct {
+	lastRTT time.Duration // of the latest success
+	samples []snmpSample  // within snmpSummaryWindow, oldest first
+}
+
+// snmpAgent summarizes results per target and serves them over SNMP. It is
+// safe for concurrent use.
+type snmpAgent struct {
+	prefix    snmpOID
+	community string
+
+	mu   sync.Mutex
+	rows map[snmpRowKey]*snmpRow
+}
+
+func newSNMPAgent(prefix, community string) (*snmpAgent, error) {
+	oid, err := parseSNMPOID(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &snmpAgent{prefix: oid, community: community, rows: make(map[snmpRowKey]*snmpRow)}, nil
+}
+
+// update adds results at now, and forgets rows without results in the
+// summary window.
+func (a *snmpAgent) update(results []result, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, r := range results {
+		k := snmpRowKey{r.key.meta, r.key.protocol, r.key.dstPort}
+		row, ok := a.rows[k]
+		if !ok {
+			row = &snmpRow{}
+			a.rows[k] = row
+		}
+		row.samples = append(row.samples, snmpSample{at: r.at, ok: r.rtt != nil})
+		if r.rtt != nil {
+			row.lastRTT = *r.rtt
+		}
+	}
+	cutoff := now.Add(-snmpSummaryWindow)
+	for k, row := range a.rows {
+		i := 0
+		for i < len(row.samples) && row.samples[i].at.Before(cutoff) {
+			i++
+		}
+		row.samples = row.samples[i:]
+		if len(row.samples) == 0 {
+			delete(a.rows, k)
+		}
+	}
+}
+
+// snmpVarBind is an OID and its value.
+type snmpVarBind struct {
+	oid   snmpOID
+	value snmpValue
+}
+
+// view returns the OIDs served, in lexicographic order. Rows are indexed by
+// their order by hostname, address, protocol and port, so indexes change as
+// targets do; the index column is only stable between such changes.
+func (a *snmpAgent) view() []snmpVarBind {
+	a.mu.Lock()
+	keys := make([]snmpRowKey, 0, len(a.rows))
+	rows := make(map[snmpRowKey]snmpRow, len(a.rows))
+	for k, row := range a.rows {
+		keys = append(keys, k)
+		rows[k] = snmpRow{lastRTT: row.lastRTT, samples: slices.Clone(row.samples)}
+	}
+	a.mu.Unlock()
+	slices.SortFunc(keys, func(x, y snmpRowKey) int {
+		return cmp.Or(
+			cmp.Compare(x.meta.hostname, y.meta.hostname),
+			x.meta.addr.Compare(y.meta.addr),
+			cmp.Compare(x.protocol, y.protocol),
+			cmp.Compare(x.dstPort, y.dstPort),
+		)
+	})
+
+	// stunstampTargetEntry, ordered column by column.
+	entry := append(slices.Clone(a.prefix), 1, 1)
+	var ret []snmpVarBind
+	for col := 1; col <= snmpNumCols; col++ {
+		for i, k := range keys {
+			row := rows[k]
+			var v snmpValue
+			switch col {
+			case snmpColIndex:
+				v = snmpInteger(int64(i + 1))
+			case snmpColHostname:
+				v = snmpOctetString(k.meta.hostname)
+			case snmpColRegionCode:
+				v = snmpOctetString(k.meta.regionCode)
+			case snmpColAddress:
+				v = snmpOctetString(k.meta.addr.String())
+			case snmpColProtocol:
+				v = snmpOctetString(string(k.protocol))
+			case snmpColDstPort:
+				v = snmpInteger(int64(k.dstPort))
+			case snmpColLastRTT:
+				v = snmpGauge32(uint32(min(row.lastRTT.Microseconds(), 1<<32-1)))
+			case snmpColLossPerMille:
+				failures := 0
+				for _, s := range row.samples {
+					if !s.ok {
+						failures++
+					}
+				}
+				v = snmpGauge32(uint32(failures * 1000 / len(row.samples)))
+			case snmpColStatus:
+				v = snmpInteger(snmpStatusDown)
+				if slices.ContainsFunc(row.samples, func(s snmpSample) bool { return s.ok }) {
+					v = snmpInteger(snmpStatusUp)
+				}
+			}
+			ret = append(ret, snmpVarBind{oid: append(slices.Clone(entry), uint32(col), uint32(i+1)), value: v})
+		}
+	}
+	// stunstampTargetCount.0
+	ret = append(ret, snmpVarBind{oid: append(slices.Clone(a.prefix), 2, 0), value: snmpInteger(int64(len(keys)))})
+	return ret
+}
+
+// serve answers SNMP requests on pc until it is closed.
+func (a *snmpAgent) serve(pc net.PacketConn) error {
+	b := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			return err
+		}
+		resp, err := a.handle(b[:n])
+		if err != nil {
+			apiLog.Debug("invalid SNMP request", "remote_addr", addr, "err", err)
+			continue
+		}
+		if resp != nil {
+			pc.WriteTo(resp, addr)
+		}
+	}
+}
+
+// SNMP message versions and PDU types.
+const (
+	snmpVersion1  = 0
+	snmpVersion2c = 1
+
+	snmpPDUGet      = 0xa0
+	snmpPDUGetNext  = 0xa1
+	snmpPDUResponse = 0xa2
+	snmpPDUGetBulk  = 0xa5
+)
+
+// SNMP error statuses.
+const (
+	snmpErrTooBig     = 1
+	snmpErrNoSuchName = 2
+)
+
+// maxSNMPResponseSize is the size responses are limited to, leaving room for
+// headers in a single datagram of the minimum size agents must support.
+const maxSNMPResponseSize = 1400
+
+// maxSNMPBulkVarBinds bounds the size of GetBulk responses.
+const maxSNMPBulkVarBinds = 1000
+
+// handle returns the response to the SNMP request req, or nil if it is not
+// to be answered, e.g. for a wrong community.
+func (a *snmpAgent) handle(req []byte) ([]byte, error) {
+	msg, err := berReadAll(req, berSequence)
+	if err != nil {
+		return nil, err
+	}
+	version, err := msg.readInt()
+	if err != nil {
+		return nil, err
+	}
+	if version != snmpVersion1 && version != snmpVersion2c {
+		return nil, fmt.Errorf("unsupported SNMP version %d", version)
+	}
+	community, err := msg.read(berOctetString)
+	if err != nil {
+		return nil, err
+	}
+	if string(community) != a.community {
+		return nil, errors.New("wrong community")
+	}
+	pduType, pduBytes, err := msg.next()
+	if err != nil {
+		return nil, err
+	}
+	pdu := &berReader{b: pduBytes}
+	requestID, err := pdu.readInt()
+	if err != nil {
+		return nil, err
+	}
+	// Error status and index, or non-repeaters and max-repetitions for
+	// GetBulk.
+	p1, err := pdu.readInt()
+	if err != nil {
+		return nil, err
+	}
+	p2, err := pdu.readInt()
+	if err != nil {
+		return nil, err
+	}
+	vbsBytes, err := pdu.read(berSequence)
+	if err != nil {
+		return nil, err
+	}
+	var oids []snmpOID
+	vbs := &berReader{b: vbsBytes}
+	for !vbs.done() {
+		vb, err := vbs.read(berSequence)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := (&berReader{b: vb}).read(berOID)
+		if err != nil {
+			return nil, err
+		}
+		oid, err := decodeSNMPOID(raw)
+		if err != nil {
+			return nil, err
+		}
+		oids = append(oids, oid)
+	}
+
+	view := a.view()
+	var (
+		out                   []snmpVarBind
+		errStatus, errIndex   int64
+		nonRepeaters, maxReps = int(p1), int(p2)
+	)
+	switch pduType {
+	case snmpPDUGet:
+		for i, oid := range oids {
+			vb, ok := snmpGet(view, oid)
+			if !ok {
+				if version == snmpVersion1 {
+					errStatus, errIndex = snmpErrNoSuchName, int64(i+1)
+					out = nil
+					break
+				}
+				vb = snmpVarBind{oid: oid, value: snmpValue{tag: berNoSuchObject}}
+			}
+			out = append(out, vb)
+		}
+	case snmpPDUGetNext:
+		for i, oid := range oids {
+			vb, ok := snmpGetNext(view, oid)
+			if !ok {
+				if version == snmpVersion1 {
+					errStatus, errIndex = snmpErrNoSuchName, int64(i+1)
+					out = nil
+					break
+				}
+				vb = snmpVarBind{oid: oid, value: snmpValue{tag: berEndOfMIBView}}
+			}
+			out = append(out, vb)
+		}
+	case snmpPDUGetBulk:
+		if version == snmpVersion1 {
+			return nil, errors.New("GetBulk in SNMPv1")
+		}
+		nonRepeaters = max(min(nonRepeaters, len(oids)), 0)
+		maxReps = max(maxReps, 0)
+		for _, oid := range oids[:nonRepeaters] {
+			vb, ok := snmpGetNext(view, oid)
+			if !ok {
+				vb = snmpVarBind{oid: oid, value: snmpValue{tag: berEndOfMIBView}}
+			}
+			out = append(out, vb)
+		}
+		repeaters := slices.Clone(oids[nonRepeaters:])
+		for range maxReps {
+			if len(out) >= maxSNMPBulkVarBinds || len(repeaters) == 0 {
+				break
+			}
+			allEnd := true
+			for j, oid := range repeaters {
+				vb, ok := snmpGetNext(view, oid)
+				if !ok {
+					vb = snmpVarBind{oid: oid, value: snmpValue{tag: berEndOfMIBView}}
+				} else {
+					allEnd = false
+				}
+				repeaters[j] = vb.oid
+				out = append(out, vb)
+			}
+			if allEnd {
+				break
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PDU type %#x", pduType)
+	}
+	if errStatus != 0 {
+		// Responses with errors echo the request's varbinds.
+		out = out[:0]
+		for _, oid := range oids {
+			out = append(out, snmpVarBind{oid: oid, value: snmpValue{tag: berNull}})
+		}
+	}
+
+	resp := encodeSNMPResponse(version, community, requestID, errStatus, errIndex, out)
+	for pduType == snmpPDUGetBulk && len(resp) > maxSNMPResponseSize && len(out) > 1 {
+		// GetBulk responses are truncated rather than failing.
+		out = out[:len(out)/2]
+		resp = encodeSNMPResponse(version, community, requestID, 0, 0, out)
+	}
+	if len(resp) > maxSNMPResponseSize {
+		resp = encodeSNMPResponse(version, community, requestID, snmpErrTooBig, 0, nil)
+	}
+	return resp, nil
+}
+
+func encodeSNMPResponse(version int64, community []byte, requestID, errStatus, errIndex int64, vbs []snmpVarBind) []byte {
+	var list []byte
+	for _, vb := range vbs {
+		list = append(list, berTLV(berSequence, append(berTLV(berOID, encodeSNMPOID(vb.oid)), berTLV(vb.value.tag, vb.value.b)...))...)
+	}
+	var pdu []byte
+	pdu = append(pdu, berTLV(berInteger, berEncodeInt(requestID))...)
+	pdu = append(pdu, berTLV(berInteger, berEncodeInt(errStatus))...)
+	pdu = append(pdu, berTLV(berInteger, berEncodeInt(errIndex))...)
+	pdu = append(pdu, berTLV(berSequence, list)...)
+	var msg []byte
+	msg = append(msg, berTLV(berInteger, berEncodeInt(version))...)
+	msg = append(msg, berTLV(berOctetString, community)...)
+	msg = append(msg, berTLV(snmpPDUResponse, pdu)...)
+	return berTLV(berSequence, msg)
+}
+
+// snmpGet returns the varbind of oid in view, which is ordered.
+func snmpGet(view []snmpVarBind, oid snmpOID) (snmpVarBind, bool) {
+	i, ok := slices.BinarySearchFunc(view, oid, func(vb snmpVarBind, oid snmpOID) int {
+		return slices.Compare(vb.oid, oid)
+	})
+	if !ok {
+		return snmpVarBind{}, false
+	}
+	return view[i], true
+}
+
+// snmpGetNext returns the first varbind in view, which is ordered, following
+// oid.
+func snmpGetNext(view []snmpVarBind, oid snmpOID) (snmpVarBind, bool) {
+	i, ok := slices.BinarySearchFunc(view, oid, func(vb snmpVarBind, oid snmpOID) int {
+		return slices.Compare(vb.oid, oid)
+	})
+	if ok {
+		i++
+	}
+	if i >= len(view) {
+		return snmpVarBind{}, false
+	}
+	return view[i], true
+}
+
+// snmpOID is an object identifier.
+type snmpOID []uint32
+
+func (o snmpOID) String() string {
+	parts := make([]string, len(o))
+	for i, v := range o {
+		parts[i] = strconv.FormatUint(uint64(v), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// parseSNMPOID parses an OID in dotted form, e.g. "1.3.6.1".
+func parseSNMPOID(s string) (snmpOID, error) {
+	var oid snmpOID
+	for _, p := range strings.Split(strings.TrimPrefix(s, "."), ".") {
+		v, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid = append(oid, uint32(v))
+	}
+	if len(oid) < 2 || oid[0] > 2 || oid[0] < 2 && oid[1] >= 40 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	return oid, nil
+}
+
+func encodeSNMPOID(oid snmpOID) []byte {
+	if len(oid) < 2 {
+		return []byte{0}
+	}
+	b := berAppendBase128(nil, oid[0]*40+oid[1])
+	for _, v := range oid[2:] {
+		b = berAppendBase128(b, v)
+	}
+	return b
+}
+
+func decodeSNMPOID(b []byte) (snmpOID, error) {
+	var oid snmpOID
+	var v uint64
+	for i, c := range b {
+		v = v<<7 | uint64(c&0x7f)
+		if v > 1<<32-1 {
+			return nil, errors.New("OID component overflow")
+		}
+		if c&0x80 != 0 {
+			if i == len(b)-1 {
+				return nil, errors.New("truncated OID")
+			}
+			continue
+		}
+		if len(oid) == 0 {
+			first := min(v/40, 2)
+			oid = append(oid, uint32(first), uint32(v-first*40))
+		} else {
+			oid = append(oid, uint32(v))
+		}
+		v = 0
+	}
+	if len(oid) == 0 {
+		return nil, errors.New("empty OID")
+	}
+	return oid, nil
+}
+
+// BER tags used by SNMP.
+const (
+	berInteger      = 0x02
+	berOctetString  = 0x04
+	berNull         = 0x05
+	berOID          = 0x06
+	berSequence     = 0x30
+	berGauge32      = 0x42
+	berNoSuchObject = 0x80
+	berEndOfMIBView = 0x82
+)
+
+// snmpValue is a BER-encoded SNMP value.
+type snmpValue struct {
+	tag byte
+	b   []byte // contents
+}
+
+func snmpInteger(v int64) snmpValue      { return snmpValue{berInteger, berEncodeInt(v)} }
+func snmpOctetString(s string) snmpValue { return snmpValue{berOctetString, []byte(s)} }
+
+func snmpGauge32(v uint32) snmpValue {
+	// Unsigned, so a leading zero octet is needed if the high bit is set.
+	return snmpValue{berGauge32, berEncodeInt(int64(v))}
+}
+
+// berEncodeInt returns the minimal two's complement encoding of v.
+func berEncodeInt(v int64) []byte {
+	n := 1
+	for ; n < 8; n++ {
+		if v >= -(1<<(8*n-1)) && v < 1<<(8*n-1) {
+			break
+		}
+	}
+	b := make([]byte, n)
+	for i := range n {
+		b[n-1-i] = byte(v >> (8 * i))
+	}
+	return b
+}
+
+func berAppendBase128(b []byte, v uint32) []byte {
+	n := 1
+	for t := v >> 7; t > 0; t >>= 7 {
+		n++
+	}
+	for i := n - 1; i >= 0; i-- {
+		c := byte(v>>(7*i)) & 0x7f
+		if i > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// berTLV returns the encoding of a value with tag and contents.
+func berTLV(tag byte, contents []byte) []byte {
+	b := []byte{tag}
+	switch l := len(contents); {
+	case l < 0x80:
+		b = append(b, byte(l))
+	case l <= 0xff:
+		b = append(b, 0x81, byte(l))
+	default:
+		b = append(b, 0x82, byte(l>>8), byte(l))
+	}
+	return append(b, contents...)
+}
+
+// berReader reads consecutive BER values.
+type berReader struct {
+	b []byte
+}
+
+// berReadAll returns a reader of the contents of the single value with tag
+// in b.
+func berReadAll(b []byte, tag byte) (*berReader, error) {
+	r := &berReader{b: b}
+	contents, err := r.read(tag)
+	if err != nil {
+		return nil, err
+	}
+	return &berReader{b: contents}, nil
+}
+
+func (r *berReader) done() bool { return len(r.b) == 0 }
+
+// next returns the tag and contents of the next value.
+func (r *berReader) next() (tag byte, contents []byte, err error) {
+	if len(r.b) < 2 {
+		return 0, nil, errors.New("truncated BER value")
+	}
+	tag = r.b[0]
+	l, off := int(r.b[1]), 2
+	if l&0x80 != 0 {
+		n := l & 0x7f
+		if n == 0 || n > 3 || len(r.b) < 2+n {
+			return 0, nil, errors.New("invalid BER length")
+		}
+		l = 0
+		for _, c := range r.b[2 : 2+n] {
+			l = l<<8 | int(c)
+		}
+		off += n
+	}
+	if len(r.b)-off < l {
+		return 0, nil, errors.New("truncated BER value")
+	}
+	contents = r.b[off : off+l]
+	r.b = r.b[off+l:]
+	return tag, contents, nil
+}
+
+// read returns the contents of the next value, which must have tag.
+func (r *berReader) read(tag byte) ([]byte, error) {
+	t, contents, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+	if t != tag {
+		return nil, fmt.Errorf("unexpected BER tag %#x, want %#x", t, tag)
+	}
+	return contents, nil
+}
+
+func (r *berReader) readInt() (int64, error) {
+	b, err := r.read(berInteger)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) == 0 || len(b) > 8 {
+		return 0, errors.New("invalid BER integer")
+	}
+	v := int64(int8(b[0]))
+	for _, c := range b[1:] {
+		v = v<<8 | int64(c)
+	}
+	return v, nil
+}
@@ -0,0 +1,212 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+// snmpRequest encodes a request of pduType with the varbinds oids.
+func snmpRequest(version int64, community string, pduType byte, p1, p2 int64, oids ...snmpOID) []byte {
+	var list []byte
+	for _, oid := range oids {
+		list = append(list, berTLV(berSequence, append(berTLV(berOID, encodeSNMPOID(oid)), berTLV(berNull, nil)...))...)
+	}
+	var pdu []byte
+	pdu = append(pdu, berTLV(berInteger, berEncodeInt(42))...)
+	pdu = append(pdu, berTLV(berInteger, berEncodeInt(p1))...)
+	pdu = append(pdu, berTLV(berInteger, berEncodeInt(p2))...)
+	pdu = append(pdu, berTLV(berSequence, list)...)
+	var msg []byte
+	msg = append(msg, berTLV(berInteger, berEncodeInt(version))...)
+	msg = append(msg, berTLV(berOctetString, []byte(community))...)
+	msg = append(msg, berTLV(pduType, pdu)...)
+	return berTLV(berSequence, msg)
+}
+
+// parseSNMPResponse returns the error status and varbinds of resp.
+func parseSNMPResponse(t *testing.T, resp []byte) (errStatus int64, vbs []snmpVarBind) {
+	t.Helper()
+	msg, err := berReadAll(resp, berSequence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.readInt()
+	msg.read(berOctetString)
+	b, err := msg.read(snmpPDUResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdu := &berReader{b: b}
+	if id, _ := pdu.readInt(); id != 42 {
+		t.Fatalf("request ID = %d, want 42", id)
+	}
+	errStatus, _ = pdu.readInt()
+	pdu.readInt()
+	list, err := pdu.read(berSequence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &berReader{b: list}
+	for !r.done() {
+		vb, err := r.read(berSequence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vr := &berReader{b: vb}
+		raw, _ := vr.read(berOID)
+		oid, err := decodeSNMPOID(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tag, contents, err := vr.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		vbs = append(vbs, snmpVarBind{oid: oid, value: snmpValue{tag, contents}})
+	}
+	return errStatus, vbs
+}
+
+func TestSNMPAgent(t *testing.T) {
+	a, err := newSNMPAgent(defaultSNMPOIDPrefix, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rtt := 1500 * time.Microsecond
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "derp1a", addr: netip.MustParseAddr("192.0.2.1")}
+	a.update([]result{
+		{key: resultKey{meta: meta, protocol: protocolSTUN, dstPort: 3478}, at: now, rtt: &rtt},
+		{key: resultKey{meta: meta, protocol: protocolSTUN, dstPort: 3478, connStability: stableConn}, at: now},
+		{key: resultKey{meta: meta, protocol: protocolICMP}, at: now},
+	}, now)
+
+	if _, err := a.handle(snmpRequest(snmpVersion2c, "public", snmpPDUGet, 0, 0, a.prefix)); err == nil {
+		t.Error("request with wrong community answered")
+	}
+
+	// Walk the MIB with GetNext.
+	var walked []snmpVarBind
+	oid := a.prefix
+	for {
+		resp, err := a.handle(snmpRequest(snmpVersion2c, "secret", snmpPDUGetNext, 0, 0, oid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, vbs := parseSNMPResponse(t, resp)
+		if len(vbs) != 1 {
+			t.Fatalf("got %d varbinds, want 1", len(vbs))
+		}
+		if vbs[0].value.tag == berEndOfMIBView {
+			break
+		}
+		walked = append(walked, vbs[0])
+		oid = vbs[0].oid
+	}
+	if want := 2*snmpNumCols + 1; len(walked) != want {
+		t.Fatalf("walked %d OIDs, want %d", len(walked), want)
+	}
+	col := func(c uint32, row uint32) snmpValue {
+		t.Helper()
+		want := append(slices.Clone(a.prefix), 1, 1, c, row)
+		for _, vb := range walked {
+			if slices.Equal(vb.oid, want) {
+				return vb.value
+			}
+		}
+		t.Fatalf("OID %v not walked", want)
+		return snmpValue{}
+	}
+	// Row 1 is ICMP, ordered before STUN.
+	if v := col(snmpColProtocol, 1); string(v.b) != "icmp" {
+		t.Errorf("protocol of row 1 = %q, want icmp", v.b)
+	}
+	if v := col(snmpColStatus, 1); !bytes.Equal(v.b, berEncodeInt(snmpStatusDown)) {
+		t.Errorf("status of row 1 = %v, want down", v.b)
+	}
+	if v := col(snmpColLastRTT, 2); v.tag != berGauge32 || !bytes.Equal(v.b, berEncodeInt(1500)) {
+		t.Errorf("last RTT of row 2 = %#x %v, want 1500", v.tag, v.b)
+	}
+	if v := col(snmpColLossPerMille, 2); !bytes.Equal(v.b, berEncodeInt(500)) {
+		t.Errorf("loss of row 2 = %v, want 500", v.b)
+	}
+	if v := col(snmpColStatus, 2); !bytes.Equal(v.b, berEncodeInt(snmpStatusUp)) {
+		t.Errorf("status of row 2 = %v, want up", v.b)
+	}
+
+	// GetBulk returns the same walk at once.
+	resp, err := a.handle(snmpRequest(snmpVersion2c, "secret", snmpPDUGetBulk, 0, 50, a.prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, bulk := parseSNMPResponse(t, resp)
+	if len(bulk) != len(walked)+1 || bulk[len(bulk)-1].value.tag != berEndOfMIBView {
+		t.Errorf("GetBulk returned %d varbinds, want %d and endOfMibView", len(bulk), len(walked)+1)
+	}
+
+	// SNMPv1 Get of a missing OID fails with noSuchName.
+	resp, err = a.handle(snmpRequest(snmpVersion1, "secret", snmpPDUGet, 0, 0, append(slices.Clone(a.prefix), 9, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := parseSNMPResponse(t, resp); status != snmpErrNoSuchName {
+		t.Errorf("error status = %d, want noSuchName", status)
+	}
+
+	// Rows expire with the summary window.
+	a.update(nil, now.Add(snmpSummaryWindow+time.Second))
+	if got := len(a.view()); got != 1 {
+		t.Errorf("view after expiry has %d OIDs, want 1", got)
+	}
+}
+
+func TestSNMPOIDRoundTrip(t *testing.T) {
+	for _, s := range []string{"1.3.6.1.3.7847.1.1.7.1", "2.999.3", "0.39"} {
+		oid, err := parseSNMPOID(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeSNMPOID(encodeSNMPOID(oid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != s {
+			t.Errorf("round trip of %s = %s", s, got)
+		}
+	}
+	for _, s := range []string{"", "1", "1.x", "3.1", "1.40"} {
+		if _, err := parseSNMPOID(s); err == nil {
+			t.Errorf("parseSNMPOID(%q) succeeded", s)
+		}
+	}
+}
+
+func TestBEREncodeInt(t *testing.T) {
+	tests := []struct {
+		v    int64
+		want []byte
+	}{
+		{0, []byte{0}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x00, 0x80}},
+		{-1, []byte{0xff}},
+		{-129, []byte{0xff, 0x7f}},
+		{1<<32 - 1, []byte{0x00, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, tt := range tests {
+		got := berEncodeInt(tt.v)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("berEncodeInt(%d) = %x, want %x", tt.v, got, tt.want)
+		}
+		v, err := (&berReader{b: berTLV(berInteger, got)}).readInt()
+		if err != nil || v != tt.v {
+			t.Errorf("readInt() = %d, %v; want %d", v, err, tt.v)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const probeStateFileName = "state.json"
+
+// probeState is the per-target state persisted across restarts, so that a
+// restart does not reset the NAT mappings of stable conns, nor the adaptive
+// decisions of the intervalScheduler and targetPruner.
+type probeState struct {
+	SavedAt time.Time
+	Conns   []stableConnState
+	// LastFullWindow and Intervals are the state of the intervalScheduler,
+	// so that a restart does not probe protocols with long intervals ahead
+	// of time.
+	LastFullWindow time.Time
+	Intervals      []intervalState `json:",omitempty"`
+	// Pruned is the state of the targetPruner, so that a restart neither
+	// restores demoted targets to full-rate probing nor resets how long
+	// targets have been unreachable.
+	Pruned []prunedTargetState `json:",omitempty"`
+}
+
+// nodeMetaState is the persisted form of a nodeMeta.
+type nodeMetaState struct {
+	RegionID   int
+	RegionCode string
+	Hostname   string
+	Addr       netip.Addr
+}
+
+func nodeMetaStateOf(m nodeMeta) nodeMetaState {
+	return nodeMetaState{RegionID: m.regionID, RegionCode: m.regionCode, Hostname: m.hostname, Addr: m.addr}
+}
+
+func (s nodeMetaState) meta() nodeMeta {
+	return nodeMeta{regionID: s.RegionID, regionCode: s.RegionCode, hostname: s.Hostname, addr: s.Addr}
+}
+
+// stableConnState is the persisted state of the stable conns for a
+// stableConnKey. Arrays are indexed by timestampSource.
+type stableConnState struct {
+	Addr     netip.Addr
+	Protocol protocol
+	Port     int
+	// LocalPorts holds the local port, or ICMP identifier, of each conn.
+	LocalPorts [2]int
+	// MappedAddrs holds the reflexive address last reported by a STUN
+	// server to each conn.
+	MappedAddrs [2]netip.AddrPort
+}
+
+func (s stableConnState) key() stableConnKey {
+	return stableConnKey{node: s.Addr, protocol: s.Protocol, port: s.Port}
+}
+
+// probeStateStore restores and persists probeState in the store directory,
+// if configured. It is not safe for concurrent use; it belongs to the probing
+// loop.
+type probeStateStore struct {
+	path     string // empty if not persisting
+	restored map[stableConnKey]stableConnState
+	mapped   map[stableConnKey][2]netip.AddrPort
+	// intervals and pruner, if non-nil, have their state restored and
+	// persisted along with that of stable conns.
+	intervals *intervalScheduler
+	pruner    *targetPruner
+	// lastSaved is the state last written, without SavedAt, to avoid
+	// rewriting unchanged state.
+	lastSaved []byte
+}
+
+// probeStates is the process-wide probeStateStore.
+var probeStates = &probeStateStore{}
+
+// open loads the probeState persisted in the store directory dir, restoring
+// the state of intervals and pruner, either of which may be nil, and
+// configures s to persist to it.
+func (s *probeStateStore) open(dir string, intervals *intervalScheduler, pruner *targetPruner) error {
+	s.path = filepath.Join(dir, probeStateFileName)
+	s.intervals = intervals
+	s.pruner = pruner
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var st probeState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return fmt.Errorf("error decoding %s: %w", s.path, err)
+	}
+	s.restored = make(map[stableConnKey]stableConnState, len(st.Conns))
+	for _, c := range st.Conns {
+		s.restored[c.key()] = c
+	}
+	if intervals != nil {
+		intervals.restore(st.LastFullWindow, st.Intervals)
+	}
+	if pruner != nil {
+		pruner.restoreState(st.Pruned)
+	}
+	storeLog.Info("restored probe state", "conns", len(st.Conns), "intervals", len(st.Intervals), "pruned", len(st.Pruned), "saved_at", st.SavedAt)
+	return nil
+}
+
+// restoredLocalPorts returns the local ports persisted for the stable conns
+// of k, with zero for those not persisted.
+func (s *probeStateStore) restoredLocalPorts(k stableConnKey) [2]int {
+	return s.restored[k].LocalPorts
+}
+
+// observe records the mapped addresses of stable conn results, logging those
+// that differ from the addresses before a restart or resume.
+func (s *probeStateStore) observe(results []result) {
+	for _, r := range results {
+		k := r.key
+		if !r.mappedAddr.IsValid() || k.connStability != stableConn || k.proxy != "" || k.timestampSource > timestampSourceKernel {
+			continue
+		}
+		key := stableConnKey{node: k.meta.addr, protocol: k.protocol, port: k.dstPort}
+		if s.mapped == nil {
+			s.mapped = make(map[stableConnKey][2]netip.AddrPort)
+		}
+		mapped := s.mapped[key]
+		if restored := s.restored[key].MappedAddrs[k.timestampSource]; restored.IsValid() && !mapped[k.timestampSource].IsValid() {
+			if restored == r.mappedAddr {
+				storeLog.Debug("mapping preserved across restart or resume", "hostname", k.meta.hostname, "addr", k.meta.addr, "port", k.dstPort, "mapped", r.mappedAddr)
+			} else {
+				storeLog.Info("mapping changed across restart or resume", "hostname", k.meta.hostname, "addr", k.meta.addr, "port", k.dstPort, "before", restored, "after", r.mappedAddr)
+			}
+		}
+		mapped[k.timestampSource] = r.mappedAddr
+		s.mapped[key] = mapped
+	}
+}
+
+func (s *probeStateStore) stateOf(k stableConnKey, cfs [2]*connAndMeasureFn) stableConnState {
+	c := stableConnState{
+		Addr:        k.node,
+		Protocol:    k.protocol,
+		Port:        k.port,
+		MappedAddrs: s.mapped[k],
+	}
+	for i, cf := range cfs {
+		if cf != nil {
+			c.LocalPorts[i] = localPortOf(cf.conn)
+		}
+	}
+	return c
+}
+
+// retain replaces the restored state with that of stableConns, so that
+// stable conns re-established after being closed, e.g. on resume from
+// suspend, rebind the same local ports.
+func (s *probeStateStore) retain(stableConns map[stableConnKey][2]*connAndMeasureFn) {
+	s.restored = make(map[stableConnKey]stableConnState, len(stableConns))
+	for k, cfs := range stableConns {
+		s.restored[k] = s.stateOf(k, cfs)
+	}
+	// Compare the first mapped addresses of re-established conns to
+	// those before.
+	s.mapped = nil
+}
+
+// save persists the state of stableConns, and that of s.intervals and
+// s.pruner, if it has changed since the last call. Mapped addresses of conns
+// no longer in stableConns are forgotten.
+func (s *probeStateStore) save(stableConns map[stableConnKey][2]*connAndMeasureFn) error {
+	if s.path == "" {
+		return nil
+	}
+	st := probeState{
+		Conns: make([]stableConnState, 0, len(stableConns)),
+	}
+	if s.intervals != nil {
+		st.LastFullWindow, st.Intervals = s.intervals.state()
+	}
+	if s.pruner != nil {
+		st.Pruned = s.pruner.state()
+	}
+	for k, cfs := range stableConns {
+		st.Conns = append(st.Conns, s.stateOf(k, cfs))
+	}
+	for k := range s.mapped {
+		if _, ok := stableConns[k]; !ok {
+			delete(s.mapped, k)
+		}
+	}
+	slices.SortFunc(st.Conns, func(a, b stableConnState) int {
+		if c := a.Addr.Compare(b.Addr); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.Protocol, b.Protocol); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Port, b.Port)
+	})
+	saved, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(saved, s.lastSaved) {
+		return nil
+	}
+	st.SavedAt = time.Now()
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write then rename so that a crash mid-write does not lose the
+	// previous state.
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.lastSaved = saved
+	return nil
+}
+
+// localPortOf returns the local port, or ICMP identifier, conn is bound to,
+// or zero if unknown.
+func localPortOf(conn io.ReadWriteCloser) int {
+	switch c := conn.(type) {
+	case *net.UDPConn:
+		if addr, ok := c.LocalAddr().(*net.UDPAddr); ok {
+			return addr.Port
+		}
+	case *lportForTCPConn:
+		return int(*c)
+	case *twampConn:
+		return localPortOf(c.UDPConn)
+	case *derpConn:
+		return int(c.lport)
+	case *derpWSConn:
+		return int(c.lport)
+	}
+	return polledConnLocalPort(conn)
+}
@@ -0,0 +1,145 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestProbeStateStore(t *testing.T) {
+	dir := t.TempDir()
+	s := &probeStateStore{}
+	if err := s.open(dir, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := netip.MustParseAddr("192.0.2.1")
+	stunKey := stableConnKey{node: addr, protocol: protocolSTUN, port: 3478}
+	tcpKey := stableConnKey{node: addr, protocol: protocolTCP, port: 443}
+	stun, err := newConnAndMeasureFn(addr, timestampSourceUserspace, protocolSTUN, stableConn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := newConnAndMeasureFn(addr, timestampSourceKernel, protocolTCP, stableConn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stableConns := map[stableConnKey][2]*connAndMeasureFn{
+		stunKey: {stun},
+		tcpKey:  {nil, tcp},
+	}
+	stunPort, tcpPort := localPortOf(stun.conn), localPortOf(tcp.conn)
+	if stunPort == 0 || tcpPort == 0 {
+		t.Fatalf("local ports = %d, %d; want nonzero", stunPort, tcpPort)
+	}
+
+	mapped := netip.MustParseAddrPort("198.51.100.1:40000")
+	s.observe([]result{{
+		key: resultKey{
+			meta:            nodeMeta{addr: addr},
+			timestampSource: timestampSourceUserspace,
+			connStability:   stableConn,
+			protocol:        protocolSTUN,
+			dstPort:         3478,
+		},
+		mappedAddr: mapped,
+	}})
+	if err := s.save(stableConns); err != nil {
+		t.Fatal(err)
+	}
+	stun.conn.Close()
+	tcp.conn.Close()
+
+	restored := &probeStateStore{}
+	if err := restored.open(dir, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.restoredLocalPorts(stunKey); got != [2]int{stunPort, 0} {
+		t.Errorf("restored STUN local ports = %v, want [%d 0]", got, stunPort)
+	}
+	if got := restored.restored[stunKey].MappedAddrs[timestampSourceUserspace]; got != mapped {
+		t.Errorf("restored mapped addr = %v, want %v", got, mapped)
+	}
+	if got := restored.restoredLocalPorts(tcpKey); got != [2]int{0, tcpPort} {
+		t.Errorf("restored TCP local ports = %v, want [0 %d]", got, tcpPort)
+	}
+
+	// Conns created with the restored ports bind them.
+	stun, err = newConnAndMeasureFn(addr, timestampSourceUserspace, protocolSTUN, stableConn, stunPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stun.conn.Close()
+	if got := localPortOf(stun.conn); got != stunPort {
+		t.Errorf("restored STUN conn bound port %d, want %d", got, stunPort)
+	}
+	tcp, err = newConnAndMeasureFn(addr, timestampSourceKernel, protocolTCP, stableConn, tcpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.conn.Close()
+	if got := localPortOf(tcp.conn); got != tcpPort {
+		t.Errorf("restored TCP conn bound port %d, want %d", got, tcpPort)
+	}
+
+	// Targets removed from stableConns are forgotten.
+	if err := restored.save(map[stableConnKey][2]*connAndMeasureFn{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.open(dir, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.restored) != 0 {
+		t.Errorf("got %d restored conns after removal, want 0", len(restored.restored))
+	}
+}
+
+func TestProbeStateStoreAdaptive(t *testing.T) {
+	dir := t.TempDir()
+	meta := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "1a", addr: netip.MustParseAddr("192.0.2.1")}
+	gone := nodeMeta{regionID: 2, regionCode: "sfo", hostname: "2a", addr: netip.MustParseAddr("192.0.2.2")}
+	targets := map[netip.Addr]nodeMeta{meta.addr: meta, gone.addr: gone}
+	protocols := func(nodeMeta) []protocol { return []protocol{protocolSTUN, protocolHTTPS} }
+	c := &config{Intervals: []intervalConfig{{Intervals: map[protocol]string{protocolHTTPS: "30m"}}}}
+	pc := &pruningConfig{After: "1m"}
+	start := time.Unix(1700000000, 0)
+
+	intervals, pruner := newIntervalScheduler(), newTargetPruner()
+	s := &probeStateStore{}
+	if err := s.open(dir, intervals, pruner); err != nil {
+		t.Fatal(err)
+	}
+	full := intervals.full(start, time.Minute, time.Minute)
+	intervals.due(targets, protocols, c, time.Minute, time.Minute, full, start)
+	// gone is unreachable for longer than After, and demoted.
+	pruner.observe([]result{{key: resultKey{meta: gone}}}, pc, start)
+	pruner.observe([]result{{key: resultKey{meta: gone}}}, pc, start.Add(time.Minute))
+	if err := s.save(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	intervals, pruner = newIntervalScheduler(), newTargetPruner()
+	if err := (&probeStateStore{}).open(dir, intervals, pruner); err != nil {
+		t.Fatal(err)
+	}
+	// In the next window, STUN is due again but HTTPS is not.
+	at := start.Add(2 * time.Minute)
+	if !intervals.full(at, time.Minute, time.Minute) {
+		t.Error("window after restore not full")
+	}
+	due := intervals.due(targets, protocols, c, time.Minute, time.Minute, true, at)
+	if !due[intervalKey{meta.addr, protocolSTUN}] || due[intervalKey{meta.addr, protocolHTTPS}] {
+		t.Errorf("due after restore = %v, want STUN only", due)
+	}
+	// gone remains demoted.
+	due = pruner.filter(due, pc, time.Minute, true, at)
+	if due[intervalKey{gone.addr, protocolSTUN}] {
+		t.Errorf("demoted target due after restore: %v", due)
+	}
+	if got := pruner.state(); len(got) != 1 || got[0].meta() != gone || !got[0].UnreachableSince.Equal(start) {
+		t.Errorf("restored pruner state = %+v", got)
+	}
+}
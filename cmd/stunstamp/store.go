@@ -0,0 +1,534 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resultsStore persists results on disk as newline-delimited JSON, one file
+// per UTC day, named results-YYYY-MM-DD.jsonl. Files are append-only and
+// never rewritten, which keeps writes cheap and makes partially written
+// trailing lines (e.g. after power loss) easy to detect and skip. This is
+// the jsonl layout; stores may hold the ring or sharded layout instead, see
+// ringStore and shardStore.
+//
+// A single process may write to a store directory at a time, enforced with an
+// advisory lock. Any number of read-only stores may be opened against the same
+// directory concurrently.
+type resultsStore struct {
+	dir      string
+	readOnly bool
+	lock     *os.File // nil if readOnly
+
+	mu  sync.Mutex
+	f   *os.File // current day's file, or nil
+	day string   // day of f
+
+	// ring holds results instead if the store has the ring layout.
+	ring *ringStore
+	// shards holds results instead if the store has the sharded layout.
+	shards *shardStore
+	// cache holds recently written results, or is nil if disabled. It is
+	// set before the store is used.
+	cache *resultsCache
+	// digests holds the latency digests of the windows being written if the
+	// store is open for writing with the jsonl layout, or is nil.
+	digests *digestWindows
+}
+
+const (
+	resultsFilePrefix = "results-"
+	resultsFileSuffix = ".jsonl"
+	storeDayLayout    = "2006-01-02"
+	// storeLockFile is the name of the advisory lock file held by the
+	// process writing to a store directory.
+	storeLockFile = "store.lock"
+)
+
+// storedResult is the on-disk representation of a result.
+type storedResult struct {
+	ID              string `json:",omitempty"`
+	At              time.Time
+	RegionID        int
+	RegionCode      string
+	Hostname        string
+	Addr            netip.Addr
+	Protocol        protocol
+	DstPort         int
+	TimestampSource string
+	StableConn      bool
+	Proxy           string `json:",omitempty"`
+	// Xlat is the address family translation on the path, if any.
+	Xlat string `json:",omitempty"`
+	// Instance identifies the server instance that answered, if known.
+	Instance string `json:",omitempty"`
+	// Netns is the network namespace the result was probed from, if probed
+	// by a child of a --netns supervisor.
+	Netns string `json:",omitempty"`
+	// AddrHash replaces Addr in exports with hashed addresses, see
+	// ipPrivacy. It is never stored.
+	AddrHash string `json:",omitempty"`
+	// RTTNanos is nil for failures, e.g. timeout.
+	RTTNanos *int64 `json:",omitempty"`
+	// UserspaceRTTNanos is the userspace-timestamped RTT of the same
+	// transaction for kernel- and raw-timestamped results, if available.
+	UserspaceRTTNanos *int64 `json:",omitempty"`
+	// AttemptsNanos holds the raw RTT of every attempt, with null
+	// signifying failure, when more than one attempt was made.
+	AttemptsNanos []*int64 `json:",omitempty"`
+	// First is whether the result is of the first transaction over a stable
+	// conn after it was (re)established.
+	First bool `json:",omitempty"`
+	// Source is where the result was imported from by db import, e.g.
+	// smokeping, or empty if it was probed by stunstamp.
+	Source string `json:",omitempty"`
+	// Phase is the phase of the prober's lifecycle the result was probed
+	// in, see lifecyclePhase, or empty in steady state.
+	Phase lifecyclePhase `json:",omitempty"`
+	// Order is the 1-based position of the protocol in the randomized
+	// order the protocols of the target were sent in during the window,
+	// and TXOffsetNanos the time from the start of the window to the first
+	// attempt. Both are zero if unknown.
+	Order         int   `json:",omitempty"`
+	TXOffsetNanos int64 `json:",omitempty"`
+	// STUNResponse is the complete parsed STUN response of results sampled
+	// by --stun-response-sample-rate.
+	STUNResponse *stunResponse `json:",omitempty"`
+}
+
+func storedResultFromResult(r result) storedResult {
+	s := storedResult{
+		ID:              r.id,
+		At:              r.at.UTC(),
+		RegionID:        r.key.meta.regionID,
+		RegionCode:      r.key.meta.regionCode,
+		Hostname:        r.key.meta.hostname,
+		Addr:            r.key.meta.addr,
+		Protocol:        r.key.protocol,
+		DstPort:         r.key.dstPort,
+		TimestampSource: r.key.timestampSource.String(),
+		StableConn:      bool(r.key.connStability),
+		Proxy:           r.key.proxy,
+		Xlat:            r.key.xlat,
+		Instance:        r.instance,
+		Netns:           r.key.netns,
+		First:           r.first,
+		Phase:           r.phase,
+		Order:           r.order,
+		TXOffsetNanos:   int64(r.txOffset),
+		STUNResponse:    r.stunResponse,
+	}
+	if r.rtt != nil {
+		ns := int64(*r.rtt)
+		s.RTTNanos = &ns
+	}
+	if r.userspaceRTT != nil {
+		ns := int64(*r.userspaceRTT)
+		s.UserspaceRTTNanos = &ns
+	}
+	for _, a := range r.attempts {
+		var ns *int64
+		if a != nil {
+			ns = new(int64)
+			*ns = int64(*a)
+		}
+		s.AttemptsNanos = append(s.AttemptsNanos, ns)
+	}
+	return s
+}
+
+func (s storedResult) toResult() result {
+	r := result{
+		key: resultKey{
+			meta: nodeMeta{
+				regionID:   s.RegionID,
+				regionCode: s.RegionCode,
+				hostname:   s.Hostname,
+				addr:       s.Addr,
+			},
+			connStability: connStability(s.StableConn),
+			protocol:      s.Protocol,
+			dstPort:       s.DstPort,
+			proxy:         s.Proxy,
+			xlat:          s.Xlat,
+			netns:         s.Netns,
+		},
+		at:           s.At,
+		instance:     s.Instance,
+		first:        s.First,
+		phase:        s.Phase,
+		order:        s.Order,
+		txOffset:     time.Duration(s.TXOffsetNanos),
+		stunResponse: s.STUNResponse,
+	}
+	switch s.TimestampSource {
+	case timestampSourceKernel.String():
+		r.key.timestampSource = timestampSourceKernel
+	case timestampSourceRaw.String():
+		r.key.timestampSource = timestampSourceRaw
+	}
+	if s.RTTNanos != nil {
+		rtt := time.Duration(*s.RTTNanos)
+		r.rtt = &rtt
+	}
+	if s.UserspaceRTTNanos != nil {
+		rtt := time.Duration(*s.UserspaceRTTNanos)
+		r.userspaceRTT = &rtt
+	}
+	for _, ns := range s.AttemptsNanos {
+		var a *time.Duration
+		if ns != nil {
+			a = new(time.Duration)
+			*a = time.Duration(*ns)
+		}
+		r.attempts = append(r.attempts, a)
+	}
+	return r
+}
+
+// openResultsStore opens the results store rooted at dir for writing with
+// the jsonl layout, see openResultsStoreLayout.
+func openResultsStore(dir string) (*resultsStore, error) {
+	return openResultsStoreLayout(dir, storeLayoutJSONL)
+}
+
+// openResultsStoreLayout opens the results store rooted at dir for writing
+// with layout, creating dir if it does not exist, and migrating its schema
+// if it is older, see migrateStore. It fails if another process has the
+// store open for writing, if dir holds results in another layout, or if it
+// was written by a newer version of stunstamp.
+func openResultsStoreLayout(dir string, layout storeLayout) (*resultsStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := lockStoreDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateStore(dir, storeMigrations); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	s := &resultsStore{dir: dir, lock: lock}
+	if err := s.setLayout(layout); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// setLayout records layout as the layout of the store, unless the store
+// already holds results in another.
+func (s *resultsStore) setLayout(layout storeLayout) error {
+	existing, recorded, err := readStoreLayout(s.dir)
+	if err != nil {
+		return err
+	}
+	if !recorded {
+		// Stores predating layouts hold jsonl results, if any.
+		days, err := s.days()
+		if err != nil {
+			return err
+		}
+		if len(days) == 0 {
+			existing = layout
+		}
+		if err := os.WriteFile(filepath.Join(s.dir, storeLayoutFile), []byte(existing+"\n"), 0600); err != nil {
+			return err
+		}
+	}
+	if existing != layout {
+		return fmt.Errorf("store directory %s holds results in the %s layout, not %s", s.dir, existing, layout)
+	}
+	switch layout {
+	case storeLayoutRing:
+		s.ring = newRingStore(s.dir)
+		return nil
+	case storeLayoutSharded:
+		s.shards = newShardStore(s.dir)
+		return nil
+	}
+	s.digests = newDigestWindows(s.dir)
+	if err := s.backfillDigestsLocked(time.Now()); err != nil {
+		// Queries fall back to results for windows without digests.
+		storeLog.Error("error backfilling latency digests", "err", err)
+	}
+	return nil
+}
+
+// openResultsStoreReadOnly opens the existing results store rooted at dir for
+// reading. It may be used concurrently with a writer in another process. It
+// fails if the schema of the store needs migrating, see checkStoreSchema.
+func openResultsStoreReadOnly(dir string) (*resultsStore, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	if err := checkStoreSchema(dir, storeMigrations); err != nil {
+		return nil, err
+	}
+	layout, _, err := readStoreLayout(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &resultsStore{dir: dir, readOnly: true}
+	switch layout {
+	case storeLayoutRing:
+		s.ring = newRingStore(dir)
+	case storeLayoutSharded:
+		s.shards = newShardStore(dir)
+	}
+	return s, nil
+}
+
+// layout returns the layout of the store.
+func (s *resultsStore) layout() storeLayout {
+	switch {
+	case s.ring != nil:
+		return storeLayoutRing
+	case s.shards != nil:
+		return storeLayoutSharded
+	}
+	return storeLayoutJSONL
+}
+
+func resultsFileName(day string) string {
+	return resultsFilePrefix + day + resultsFileSuffix
+}
+
+// append writes results to the store.
+func (s *resultsStore) append(results []result) error {
+	if s.readOnly {
+		return errors.New("store is read-only")
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	if s.ring != nil {
+		return s.ring.append(results)
+	}
+	if s.shards != nil {
+		if err := s.shards.append(results); err != nil {
+			return err
+		}
+		if s.cache != nil {
+			s.cache.add(results)
+		}
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	day := results[0].at.UTC().Format(storeDayLayout)
+	if s.f == nil || s.day != day {
+		if s.f != nil {
+			s.f.Close()
+			s.f = nil
+		}
+		f, err := os.OpenFile(filepath.Join(s.dir, resultsFileName(day)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		s.f = f
+		s.day = day
+	}
+	// Write the whole batch with a single write call.
+	var buf []byte
+	for _, r := range results {
+		b, err := json.Marshal(storedResultFromResult(r))
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b...)
+		buf = append(buf, '\n')
+	}
+	if _, err := s.f.Write(buf); err != nil {
+		return err
+	}
+	for _, r := range results {
+		s.digests.add(storedResultFromResult(r))
+	}
+	if err := s.digests.flush(false); err != nil {
+		// Results were written, so the batch must not be retried.
+		storeLog.Error("error writing latency digests", "err", err)
+	}
+	if s.cache != nil {
+		s.cache.add(results)
+	}
+	return nil
+}
+
+// close closes the currently open file, if any, and releases the lock.
+func (s *resultsStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if s.f != nil {
+		err = s.f.Close()
+		s.f = nil
+	}
+	if s.ring != nil {
+		err = errors.Join(err, s.ring.close())
+	}
+	if s.shards != nil {
+		err = errors.Join(err, s.shards.close())
+	}
+	if s.digests != nil {
+		err = errors.Join(err, s.digests.flush(true))
+	}
+	if s.lock != nil {
+		s.lock.Close()
+		s.lock = nil
+	}
+	return err
+}
+
+// days returns the days held by the store in ascending order, including
+// archived days.
+func (s *resultsStore) days() ([]string, error) {
+	days, err := s.resultsFileDays()
+	if err != nil {
+		return nil, err
+	}
+	idx, err := s.loadArchiveIndex()
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range idx.Segments {
+		days = append(days, seg.Day)
+	}
+	slices.Sort(days)
+	return slices.Compact(days), nil
+}
+
+// resultsFileDays returns the days held in results files in ascending order.
+func (s *resultsStore) resultsFileDays() ([]string, error) {
+	return resultsFileDaysIn(s.dir)
+}
+
+// resultsFileDaysIn returns the days held in the results files in dir in
+// ascending order.
+func resultsFileDaysIn(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || !strings.HasPrefix(name, resultsFilePrefix) || !strings.HasSuffix(name, resultsFileSuffix) {
+			continue
+		}
+		day := strings.TrimSuffix(strings.TrimPrefix(name, resultsFilePrefix), resultsFileSuffix)
+		if _, err := time.Parse(storeDayLayout, day); err != nil {
+			continue
+		}
+		days = append(days, day)
+	}
+	slices.Sort(days)
+	return days, nil
+}
+
+// readRange calls fn for every stored result with from <= at < to, in the
+// order they were written. Lines that fail to parse, e.g. a torn trailing
+// write, are skipped. Archived days are read from their segments. Stores
+// with the ring layout call fn with downsampled results instead, see
+// ringStore.readRange, and stores with the sharded layout call it in time
+// order within each day. Ranges held by the cache, if any, are read from it.
+func (s *resultsStore) readRange(from, to time.Time, fn func(storedResult) error) error {
+	if s.ring != nil {
+		return s.ring.readRange(from, to, fn)
+	}
+	if s.cache != nil {
+		if ok, err := s.cache.readRange(from, to, fn); ok {
+			return err
+		}
+	}
+	if s.shards != nil {
+		return s.shards.readRange(from, to, fn)
+	}
+	days, err := s.days()
+	if err != nil {
+		return err
+	}
+	fromDay := from.UTC().Format(storeDayLayout)
+	toDay := to.UTC().Format(storeDayLayout)
+	for _, day := range days {
+		if day < fromDay || day > toDay {
+			continue
+		}
+		err := s.readDay(day, func(sr storedResult) error {
+			if sr.At.Before(from) || !sr.At.Before(to) {
+				return nil
+			}
+			return fn(sr)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDay calls fn for every stored result of day, from its results file or,
+// if it has been sealed, its archive segment.
+func (s *resultsStore) readDay(day string, fn func(storedResult) error) error {
+	path := filepath.Join(s.dir, resultsFileName(day))
+	if _, err := os.Stat(path); err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return readResultsFile(path, fn)
+	}
+	// The index is reloaded on every read, as a writer in another process
+	// may have sealed the day since.
+	idx, err := s.loadArchiveIndex()
+	if err != nil {
+		return err
+	}
+	seg, ok := idx.segment(day)
+	if !ok {
+		return nil
+	}
+	return s.readSegment(seg, fn)
+}
+
+// readResultsFile calls fn for every stored result in the results file at
+// path, skipping lines that fail to parse. A missing file holds no results.
+func readResultsFile(path string, fn func(storedResult) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var sr storedResult
+		if err := json.Unmarshal(scanner.Bytes(), &sr); err != nil {
+			continue
+		}
+		if err := fn(sr); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockStoreDir takes an exclusive advisory lock on dir, ensuring only a
+// single writer. Readers do not take the lock; the store's files are
+// append-only and torn trailing lines are skipped, so reading while a
+// writer holds the lock is safe.
+func lockStoreDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, storeLockFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, fmt.Errorf("store directory %s is in use by another process", dir)
+		}
+		return nil, fmt.Errorf("error locking store directory: %w", err)
+	}
+	return f, nil
+}
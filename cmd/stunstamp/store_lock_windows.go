@@ -0,0 +1,10 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import "os"
+
+func lockStoreDir(dir string) (*os.File, error) {
+	return nil, nil
+}
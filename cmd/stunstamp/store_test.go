@@ -0,0 +1,101 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestResultsStoreLocking(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no advisory locking on windows")
+	}
+	dir := t.TempDir()
+	w, err := openResultsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openResultsStore(dir); err == nil {
+		t.Fatal("second writer unexpectedly opened the store")
+	}
+	ro, err := openResultsStoreReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ro.append([]result{{at: time.Now()}}); err == nil {
+		t.Error("append to read-only store unexpectedly succeeded")
+	}
+	w.close()
+	w, err = openResultsStore(dir)
+	if err != nil {
+		t.Fatalf("reopening after close: %v", err)
+	}
+	w.close()
+}
+
+func TestResultsAPI(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openResultsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+	now := time.Now()
+	rtt := time.Millisecond
+	var results []result
+	for _, hostname := range []string{"1a", "1b", "1a"} {
+		results = append(results, result{
+			key: resultKey{
+				meta:     nodeMeta{regionID: 1, regionCode: "nyc", hostname: hostname, addr: netip.MustParseAddr("192.0.2.1")},
+				protocol: protocolSTUN,
+				dstPort:  3478,
+			},
+			at:  now.Add(-time.Minute),
+			rtt: &rtt,
+		})
+	}
+	if err := w.append(results); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := openResultsStoreReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := (&httpServer{store: ro}).mux()
+	for _, tt := range []struct {
+		query string
+		want  int
+	}{
+		{"", 3},
+		{"?hostname=1a", 2},
+		{"?hostname=1a&limit=1", 1},
+		{"?protocol=icmp", 0},
+		{"?to=" + now.Add(-time.Hour).Format(time.RFC3339), 0},
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/results"+tt.query, nil))
+		if rec.Code != 200 {
+			t.Fatalf("%q: status %d: %s", tt.query, rec.Code, rec.Body)
+		}
+		got := 0
+		sc := bufio.NewScanner(rec.Body)
+		for sc.Scan() {
+			var sr storedResult
+			if err := json.Unmarshal(sc.Bytes(), &sr); err != nil {
+				t.Fatal(err)
+			}
+			got++
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %d results, want %d", tt.query, got, tt.want)
+		}
+	}
+}
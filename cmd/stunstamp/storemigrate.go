@@ -0,0 +1,204 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Store directories are stamped with the version of their schema, the
+// format of the files in them, in storeSchemaFile. Opening a store for
+// writing migrates it from older versions automatically, one version at a
+// time, backing it up first, so that long-running probers can be upgraded
+// across releases without manual steps. Stores stamped with a version newer
+// than storeSchemaVersion, written by a newer stunstamp, are refused rather
+// than risk corrupting them.
+const (
+	storeSchemaFile = "schema"
+	// storeSchemaVersion is the schema version of stores written by this
+	// version of stunstamp, that of the last of storeMigrations.
+	storeSchemaVersion = 1
+	// storeBackupInfix separates the store directory from the version and
+	// time of its backups, which are siblings of it.
+	storeBackupInfix = ".backup-v"
+)
+
+// storeMigration migrates a store directory to version from the version
+// before.
+type storeMigration struct {
+	version int
+	desc    string
+	// migrate migrates the store rooted at dir, holding results in layout.
+	// It is nil if stamping the version suffices, i.e. the files of the
+	// previous version are valid in this one, and readers of this version
+	// may read them unmigrated.
+	//
+	// Migrations must tolerate having been interrupted before, e.g. by
+	// writing files anew and renaming them into place.
+	migrate func(dir string, layout storeLayout) error
+}
+
+// storeMigrations are the migrations of the store schema, in order of
+// version. Version 0 is that of stores predating schema versions.
+var storeMigrations = []storeMigration{
+	{version: 1, desc: "stamp stores predating schema versions"},
+}
+
+// readStoreSchema returns the schema version of the store rooted at dir. It
+// returns 0 for stores predating schema versions and for new stores, which
+// hold no files but the lock file, and reports which of the two it is.
+func readStoreSchema(dir string) (version int, empty bool, err error) {
+	b, err := os.ReadFile(filepath.Join(dir, storeSchemaFile))
+	if err == nil {
+		v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil || v < 0 {
+			return 0, false, fmt.Errorf("invalid store schema version %q in %s", strings.TrimSpace(string(b)), dir)
+		}
+		return v, false, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return 0, false, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, e := range entries {
+		if e.Name() != storeLockFile {
+			return 0, false, nil
+		}
+	}
+	return 0, true, nil
+}
+
+// checkStoreSchema returns an error if the store rooted at dir cannot be
+// read by this version of stunstamp without migrating it: if it was written
+// by a newer version, or holds files an older one wrote that pending
+// migrations of migrations rewrite.
+func checkStoreSchema(dir string, migrations []storeMigration) error {
+	version, _, err := readStoreSchema(dir)
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+	if version > latest {
+		return fmt.Errorf("store directory %s has schema version %d, newer than version %d of this stunstamp; upgrade stunstamp, or restore a backup of the store made before it was migrated (%s%d-*)", dir, version, latest, filepath.Base(dir)+storeBackupInfix, latest)
+	}
+	for _, m := range migrations {
+		if m.version > version && m.migrate != nil {
+			return fmt.Errorf("store directory %s has schema version %d, which needs migrating to version %d by opening it for writing, e.g. by running stunstamp with --store-dir", dir, version, latest)
+		}
+	}
+	return nil
+}
+
+// migrateStore migrates the store rooted at dir, which the caller holds the
+// lock of, to the last of migrations, backing it up first if any migration
+// is to rewrite its files. New stores are stamped with the last version.
+func migrateStore(dir string, migrations []storeMigration) error {
+	version, empty, err := readStoreSchema(dir)
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+	if empty {
+		return writeStoreSchema(dir, latest)
+	}
+	if version > latest {
+		return checkStoreSchema(dir, migrations)
+	}
+	var pending []storeMigration
+	backup := false
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+			backup = backup || m.migrate != nil
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	layout, _, err := readStoreLayout(dir)
+	if err != nil {
+		return err
+	}
+	if backup {
+		dst := fmt.Sprintf("%s%s%d-%s", filepath.Clean(dir), storeBackupInfix, version, time.Now().UTC().Format("20060102T150405Z"))
+		storeLog.Info("backing up store before migrating it", "dir", dir, "backup", dst, "from", version, "to", latest)
+		if err := copyStoreDir(dir, dst); err != nil {
+			return fmt.Errorf("error backing up store before migrating it: %w", err)
+		}
+	}
+	for _, m := range pending {
+		if m.migrate != nil {
+			if err := m.migrate(dir, layout); err != nil {
+				return fmt.Errorf("error migrating store directory %s to schema version %d (%s): %w", dir, m.version, m.desc, err)
+			}
+		}
+		// Stamping every version resumes interrupted migrations from the
+		// first incomplete one.
+		if err := writeStoreSchema(dir, m.version); err != nil {
+			return err
+		}
+		storeLog.Info("migrated store schema", "dir", dir, "version", m.version, "migration", m.desc)
+	}
+	return nil
+}
+
+func writeStoreSchema(dir string, version int) error {
+	return writeFileAtomic(filepath.Join(dir, storeSchemaFile), []byte(strconv.Itoa(version)+"\n"))
+}
+
+// copyStoreDir copies the store rooted at src to dst, which must not exist,
+// omitting the lock file.
+func copyStoreDir(src, dst string) error {
+	if _, err := os.Stat(dst); !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0700)
+		case rel == storeLockFile || !d.Type().IsRegular():
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenResultsStoreStampsSchema(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openResultsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+	if v, _, err := readStoreSchema(dir); err != nil || v != storeSchemaVersion {
+		t.Errorf("schema version = %v, %v, want %d", v, err, storeSchemaVersion)
+	}
+
+	// Stores written by a newer stunstamp are refused.
+	if err := writeStoreSchema(dir, storeSchemaVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openResultsStore(dir); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("opening a newer store = %v, want downgrade refused", err)
+	}
+	if _, err := openResultsStoreReadOnly(dir); err == nil {
+		t.Error("opened a newer store read-only")
+	}
+}
+
+func TestMigrateStore(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "store")
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// A store predating schema versions.
+	for name, data := range map[string]string{
+		resultsFileName("2024-06-01"): "v0\n",
+		"sub/f":                       "nested\n",
+		storeLockFile:                 "",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results := filepath.Join(dir, resultsFileName("2024-06-01"))
+	rewrite := func(from, to string) func(string, storeLayout) error {
+		return func(dir string, layout storeLayout) error {
+			if layout != storeLayoutJSONL {
+				t.Errorf("layout = %q", layout)
+			}
+			b, err := os.ReadFile(results)
+			if err != nil {
+				return err
+			}
+			return writeFileAtomic(results, []byte(strings.Replace(string(b), from, to, 1)))
+		}
+	}
+	failing := errors.New("interrupted")
+	migrations := []storeMigration{
+		{version: 1, desc: "stamp"},
+		{version: 2, desc: "v1 to v2", migrate: rewrite("v0", "v2")},
+		{version: 3, desc: "fails", migrate: func(string, storeLayout) error { return failing }},
+	}
+
+	if err := checkStoreSchema(dir, migrations[:1]); err != nil {
+		t.Errorf("store needing only a stamp unreadable: %v", err)
+	}
+	if err := checkStoreSchema(dir, migrations); err == nil {
+		t.Error("store needing migration readable")
+	}
+	if err := migrateStore(dir, migrations); !errors.Is(err, failing) {
+		t.Fatalf("migrateStore = %v, want %v", err, failing)
+	}
+	// The migrations preceding the failing one are stamped, and resumed
+	// from.
+	if v, _, _ := readStoreSchema(dir); v != 2 {
+		t.Errorf("schema version after interrupted migration = %d, want 2", v)
+	}
+	if b, _ := os.ReadFile(results); string(b) != "v2\n" {
+		t.Errorf("migrated results = %q", b)
+	}
+	migrations[2].migrate = rewrite("v2", "v3")
+	if err := migrateStore(dir, migrations); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(results); string(b) != "v3\n" {
+		t.Errorf("migrated results = %q, want migration 2 not rerun", b)
+	}
+
+	// Every migration run was preceded by a backup of the store as it was.
+	backups, err := filepath.Glob(filepath.Join(parent, "store"+storeBackupInfix+"*"))
+	if err != nil || len(backups) != 2 {
+		t.Fatalf("backups = %v, %v, want 2", backups, err)
+	}
+	for _, b := range backups {
+		from := "0"
+		if strings.HasPrefix(filepath.Base(b), "store"+storeBackupInfix+"2-") {
+			from = "2"
+		}
+		got, err := os.ReadFile(filepath.Join(b, resultsFileName("2024-06-01")))
+		if err != nil || string(got) != "v"+from+"\n" {
+			t.Errorf("backup %s holds %q, %v, want v%s", b, got, err, from)
+		}
+		if _, err := os.Stat(filepath.Join(b, "sub", "f")); err != nil {
+			t.Errorf("backup %s lacks nested file: %v", b, err)
+		}
+		if _, err := os.Stat(filepath.Join(b, storeLockFile)); err == nil {
+			t.Errorf("backup %s holds the lock file", b)
+		}
+	}
+
+	// New stores are stamped without migrating.
+	fresh := t.TempDir()
+	if err := migrateStore(fresh, migrations); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := readStoreSchema(fresh); v != 3 {
+		t.Errorf("new store schema version = %d, want 3", v)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// streamBufferSize is the number of messages buffered per subscriber of
+	// a streamHub. Messages to a subscriber whose buffer is full are
+	// dropped rather than delay probing.
+	streamBufferSize = 1024
+	// streamKeepalive is the interval at which idle streams are sent a
+	// comment, so that proxies do not time them out.
+	streamKeepalive = 15 * time.Second
+)
+
+// streamFilter selects the messages of a stream subscriber. Empty fields
+// match all messages.
+type streamFilter struct {
+	results    bool
+	events     bool
+	hostname   string
+	regionCode string
+	protocol   protocol
+	eventKind  eventKind
+}
+
+// parseStreamFilter returns the filter in the query parameters of r, see
+// serveStream.
+func parseStreamFilter(r *http.Request) (streamFilter, error) {
+	q := r.URL.Query()
+	f := streamFilter{
+		results:    true,
+		events:     true,
+		hostname:   q.Get("hostname"),
+		regionCode: q.Get("region_code"),
+		protocol:   protocol(q.Get("protocol")),
+		eventKind:  eventKind(q.Get("event_kind")),
+	}
+	if v := q.Get("types"); v != "" {
+		f.results, f.events = false, false
+		for _, t := range strings.Split(v, ",") {
+			switch t {
+			case "results":
+				f.results = true
+			case "events":
+				f.events = true
+			default:
+				return f, fmt.Errorf("invalid type %q, want results or events", t)
+			}
+		}
+	}
+	return f, nil
+}
+
+func (f streamFilter) matchResult(sr storedResult) bool {
+	return f.results && f.eventKind == "" &&
+		(f.hostname == "" || sr.Hostname == f.hostname) &&
+		(f.regionCode == "" || sr.RegionCode == f.regionCode) &&
+		(f.protocol == "" || sr.Protocol == f.protocol)
+}
+
+func (f streamFilter) matchEvent(ev event) bool {
+	return f.events &&
+		(f.eventKind == "" || ev.Kind == f.eventKind) &&
+		(f.hostname == "" || ev.Hostname == f.hostname) &&
+		(f.regionCode == "" || ev.RegionCode == f.regionCode) &&
+		(f.protocol == "" || ev.Protocol == f.protocol)
+}
+
+// streamMessage is a Server-Sent Event.
+type streamMessage struct {
+	event string // "result" or "event"
+	data  []byte // JSON
+}
+
+type streamSubscriber struct {
+	filter  streamFilter
+	ch      chan streamMessage
+	dropped int // guarded by streamHub.mu
+}
+
+// streamHub fans out results and events to the subscribers of live streams.
+// It is safe for concurrent use.
+type streamHub struct {
+	mu   sync.Mutex
+	subs map[*streamSubscriber]bool
+}
+
+// liveStream is the process-wide streamHub.
+var liveStream = &streamHub{subs: make(map[*streamSubscriber]bool)}
+
+func (h *streamHub) subscribe(f streamFilter) *streamSubscriber {
+	s := &streamSubscriber{filter: f, ch: make(chan streamMessage, streamBufferSize)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[s] = true
+	return s
+}
+
+func (h *streamHub) unsubscribe(s *streamSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, s)
+}
+
+// takeDropped returns and resets the number of messages dropped for s.
+func (h *streamHub) takeDropped(s *streamSubscriber) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := s.dropped
+	s.dropped = 0
+	return n
+}
+
+// publish sends a message to the subscribers match reports true for. The
+// message is marshaled from v only if there are any.
+func (h *streamHub) publish(name string, v any, match func(streamFilter) bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var m streamMessage
+	for s := range h.subs {
+		if !match(s.filter) {
+			continue
+		}
+		if m.data == nil {
+			b, err := json.Marshal(v)
+			if err != nil {
+				apiLog.Error("error marshaling stream message", "err", err)
+				return
+			}
+			m = streamMessage{event: name, data: b}
+		}
+		select {
+		case s.ch <- m:
+		default:
+			s.dropped++
+		}
+	}
+}
+
+func (h *streamHub) publishResults(results []result) {
+	for _, r := range results {
+		sr := storedResultFromResult(r)
+		h.publish("result", sr, func(f streamFilter) bool { return f.matchResult(sr) })
+	}
+}
+
+func (h *streamHub) publishEvent(ev event) {
+	h.publish("event", ev, func(f streamFilter) bool { return f.matchEvent(ev) })
+}
+
+// streamBackend publishes the results of probe windows to liveStream.
+type streamBackend struct {
+	hub *streamHub
+}
+
+func (streamBackend) name() string { return "stream" }
+
+func (s streamBackend) write(_ context.Context, b outputBatch) error {
+	s.hub.publishResults(b.results)
+	return nil
+}
+
+// serveStream streams results and events as they occur as Server-Sent
+// Events, "result" events holding results in the format of /api/results and
+// "event" events holding events. Messages a client is too slow to receive
+// are dropped, which is signaled by a "dropped" event holding their number.
+// Query parameters:
+//
+//   - types: comma-separated types of messages, results and/or events,
+//     defaulting to both
+//   - hostname, region_code, protocol: optional exact match filters
+//   - event_kind: optional exact match filter of events, excluding results
+func (s *httpServer) serveStream(w http.ResponseWriter, r *http.Request) {
+	if s.stream == nil {
+		http.Error(w, "not probing", http.StatusNotFound)
+		return
+	}
+	f, err := parseStreamFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rc := http.NewResponseController(w)
+	sub := s.stream.subscribe(f)
+	defer s.stream.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case m := <-sub.ch:
+			if n := s.stream.takeDropped(sub); n > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", n)
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", m.event, m.data)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	hub := &streamHub{subs: make(map[*streamSubscriber]bool)}
+	srv := httptest.NewServer((&httpServer{stream: hub}).mux())
+	defer srv.Close()
+
+	if resp, err := http.Get(srv.URL + "/api/stream?types=metrics"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid types: %v, %v", resp, err)
+	}
+	resp, err := http.Get(srv.URL + "/api/stream?hostname=1a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	for {
+		hub.mu.Lock()
+		n := len(hub.subs)
+		hub.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rtt := time.Millisecond
+	mk := func(hostname string) result {
+		return result{key: resultKey{meta: nodeMeta{regionID: 1, regionCode: "nyc", hostname: hostname, addr: netip.MustParseAddr("192.0.2.1")}, protocol: protocolSTUN, dstPort: 3478}, at: time.Now(), rtt: &rtt}
+	}
+	hub.publishResults([]result{mk("1b"), mk("1a")})
+	hub.publishEvent(event{Kind: eventKindSuspend})
+	hub.publishEvent(event{Kind: eventKindHopCountChange, Hostname: "1a"})
+
+	sc := bufio.NewScanner(resp.Body)
+	var got []string
+	for len(got) < 4 && sc.Scan() {
+		if line := sc.Text(); line != "" {
+			got = append(got, line)
+		}
+	}
+	if len(got) != 4 ||
+		got[0] != "event: result" || !strings.Contains(got[1], `"Hostname":"1a"`) ||
+		got[2] != "event: event" || !strings.Contains(got[3], `"Kind":"hop_count_change"`) {
+		t.Errorf("stream = %q", got)
+	}
+
+	// Messages to slow subscribers are dropped.
+	sub := hub.subscribe(streamFilter{events: true})
+	defer hub.unsubscribe(sub)
+	for range streamBufferSize + 3 {
+		hub.publishEvent(event{Kind: eventKindSuspend})
+	}
+	if n := hub.takeDropped(sub); n != 3 {
+		t.Errorf("dropped %d messages, want 3", n)
+	}
+}
+
+func TestStreamFilter(t *testing.T) {
+	for _, tt := range []struct {
+		query       string
+		wantResults bool
+		wantEvents  bool
+	}{
+		{"", true, true},
+		{"types=results", true, false},
+		{"types=events,results", true, true},
+		{"protocol=stun", true, true},
+		{"protocol=icmp", false, false},
+		{"event_kind=suspend", false, false},
+		{"event_kind=hop_count_change", false, true},
+	} {
+		f, err := parseStreamFilter(httptest.NewRequest("GET", "/api/stream?"+tt.query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sr := storedResult{Hostname: "1a", RegionCode: "nyc", Protocol: protocolSTUN}
+		ev := event{Kind: eventKindHopCountChange, Hostname: "1a", RegionCode: "nyc", Protocol: protocolSTUN}
+		if got := f.matchResult(sr); got != tt.wantResults {
+			t.Errorf("%q: matchResult = %v, want %v", tt.query, got, tt.wantResults)
+		}
+		if got := f.matchEvent(ev); got != tt.wantEvents {
+			t.Errorf("%q: matchEvent = %v, want %v", tt.query, got, tt.wantEvents)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"strings"
+
+	"tailscale.com/util/ctxkey"
+)
+
+const stunMagicCookie = 0x2112a442
+
+// stunAttrNames are the names of the STUN attributes servers are known to
+// send in binding responses.
+var stunAttrNames = map[uint16]string{
+	0x0001:                 "MAPPED-ADDRESS",
+	0x0020:                 "XOR-MAPPED-ADDRESS",
+	0x8020:                 "XOR-MAPPED-ADDRESS-LEGACY", // pre-RFC 5389 servers
+	stunAttrSoftware:       "SOFTWARE",
+	0x8023:                 "ALTERNATE-SERVER",
+	0x8028:                 "FINGERPRINT",
+	stunAttrResponseOrigin: "RESPONSE-ORIGIN",
+	0x802c:                 "OTHER-ADDRESS",
+}
+
+// stunResponse is the complete parsed STUN response of a sampled probe, see
+// --stun-response-sample-rate, recorded so that changes to server behavior,
+// e.g. a new SOFTWARE string or added attributes after a deploy, can be
+// analyzed after the fact.
+type stunResponse struct {
+	Type   string // message type, e.g. "0x0101" for a binding success
+	Length int    // message length from the header, excluding it
+	Cookie string `json:",omitempty"` // hex, if not the RFC 5389 magic cookie
+	TxID   string // hex
+	Attrs  []stunResponseAttr
+	// Trailing holds the hex of bytes past the last complete attribute,
+	// which well-formed responses have none of.
+	Trailing string `json:",omitempty"`
+}
+
+// stunResponseAttr is an attribute of a stunResponse.
+type stunResponseAttr struct {
+	Type  string // e.g. "0x8022"
+	Name  string `json:",omitempty"` // if known, see stunAttrNames
+	Value string // hex
+	// Padding holds the hex of the padding to a multiple of 4 bytes, which
+	// servers should zero but are not required to.
+	Padding string `json:",omitempty"`
+	// Decoded is Value decoded for known attributes, e.g. the address of
+	// XOR-MAPPED-ADDRESS or the text of SOFTWARE.
+	Decoded string `json:",omitempty"`
+}
+
+// parseSTUNResponse parses the STUN message b, keeping whatever it can of a
+// malformed one. It returns nil if b is shorter than a STUN header.
+func parseSTUNResponse(b []byte) *stunResponse {
+	if len(b) < stunHeaderLen {
+		return nil
+	}
+	resp := &stunResponse{
+		Type:   fmt.Sprintf("%#04x", binary.BigEndian.Uint16(b)),
+		Length: int(binary.BigEndian.Uint16(b[2:])),
+		TxID:   hex.EncodeToString(b[8:stunHeaderLen]),
+	}
+	if cookie := binary.BigEndian.Uint32(b[4:]); cookie != stunMagicCookie {
+		resp.Cookie = hex.EncodeToString(b[4:8])
+	}
+	header := b[:stunHeaderLen]
+	for b = b[stunHeaderLen:]; len(b) >= 4; {
+		typ := binary.BigEndian.Uint16(b)
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			break
+		}
+		v := b[4 : 4+n]
+		padded := min(len(b), 4+(n+3)&^3)
+		resp.Attrs = append(resp.Attrs, stunResponseAttr{
+			Type:    fmt.Sprintf("%#04x", typ),
+			Name:    stunAttrNames[typ],
+			Value:   hex.EncodeToString(v),
+			Padding: hex.EncodeToString(b[4+n : padded]),
+			Decoded: decodeSTUNAttr(typ, v, header),
+		})
+		b = b[padded:]
+	}
+	if len(b) > 0 {
+		resp.Trailing = hex.EncodeToString(b)
+	}
+	return resp
+}
+
+// decodeSTUNAttr returns the value v of the attribute of type typ of the
+// message with header in readable form, or "" if typ is unknown or v is
+// malformed.
+func decodeSTUNAttr(typ uint16, v, header []byte) string {
+	switch typ {
+	case 0x0001, 0x8023, stunAttrResponseOrigin, 0x802c:
+		if ap, ok := parseSTUNAddr(v, nil); ok {
+			return ap.String()
+		}
+	case 0x0020, 0x8020:
+		// XORed with the magic cookie and, for IPv6, the transaction ID,
+		// which follow it in the header.
+		if ap, ok := parseSTUNAddr(v, header[4:stunHeaderLen]); ok {
+			return ap.String()
+		}
+	case stunAttrSoftware:
+		return strings.TrimRight(string(v), "\x00")
+	case 0x8028:
+		if len(v) == 4 {
+			return fmt.Sprintf("%#08x", binary.BigEndian.Uint32(v))
+		}
+	}
+	return ""
+}
+
+// parseSTUNAddr parses the address attribute value v, with the family at
+// v[1], the port at v[2:4], and the address following, XORed with key if
+// non-nil.
+func parseSTUNAddr(v, key []byte) (netip.AddrPort, bool) {
+	if len(v) != 8 && len(v) != 20 {
+		return netip.AddrPort{}, false
+	}
+	port := binary.BigEndian.Uint16(v[2:])
+	addr := append([]byte(nil), v[4:]...)
+	if key != nil {
+		port ^= binary.BigEndian.Uint16(key)
+		for i := range addr {
+			addr[i] ^= key[i]
+		}
+	}
+	ip, ok := netip.AddrFromSlice(addr)
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ip.Unmap(), port), true
+}
+
+// sampleSTUNResponseKey is the context key marking a STUN probe whose
+// response is to be recorded in full.
+var sampleSTUNResponseKey = ctxkey.New("stunstamp.sampleSTUNResponse", false)
+
+// sampleSTUNResponse reports whether to record the response of the next
+// STUN probe in full, for a fraction --stun-response-sample-rate of probes.
+func sampleSTUNResponse() bool {
+	rate := *flagSTUNSampleRate
+	return rate > 0 && rand.Float64() < rate
+}
+
+// sampledSTUNResponse returns the parsed STUN response b if the probe
+// measuring it was sampled, otherwise nil.
+func sampledSTUNResponse(ctx context.Context, b []byte) *stunResponse {
+	if !sampleSTUNResponseKey.Value(ctx) {
+		return nil
+	}
+	return parseSTUNResponse(b)
+}
@@ -0,0 +1,61 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"testing"
+
+	"tailscale.com/net/stun"
+)
+
+func TestParseSTUNResponse(t *testing.T) {
+	for _, mapped := range []string{"198.51.100.1:1234", "[2001:db8::1]:41641"} {
+		b := stun.Response(stun.NewTxID(), netip.MustParseAddrPort(mapped))
+		// SOFTWARE with garbage padding, and a truncated attribute.
+		b = append(b, 0x80, 0x22, 0, 5, 'd', 'e', 'r', 'p', '1', 0xaa, 0, 0)
+		b = append(b, 0x80, 0x2b, 0, 8, 0, 1)
+
+		got := parseSTUNResponse(b)
+		if got == nil {
+			t.Fatalf("%s: parseSTUNResponse = nil", mapped)
+		}
+		if got.Type != "0x0101" || got.Cookie != "" || got.Trailing != "802b00080001" {
+			t.Errorf("%s: header and trailing = %+v", mapped, got)
+		}
+		if len(got.Attrs) != 2 {
+			t.Fatalf("%s: attrs = %+v, want 2", mapped, got.Attrs)
+		}
+		if a := got.Attrs[0]; a.Name != "XOR-MAPPED-ADDRESS" || a.Decoded != mapped || a.Padding != "" {
+			t.Errorf("%s: XOR-MAPPED-ADDRESS = %+v", mapped, a)
+		}
+		if a := got.Attrs[1]; a.Type != "0x8022" || a.Decoded != "derp1" || a.Value != "6465727031" || a.Padding != "aa0000" {
+			t.Errorf("%s: SOFTWARE = %+v", mapped, a)
+		}
+		if _, err := json.Marshal(got); err != nil {
+			t.Error(err)
+		}
+	}
+	if got := parseSTUNResponse(make([]byte, stunHeaderLen-1)); got != nil {
+		t.Errorf("parseSTUNResponse(short) = %+v, want nil", got)
+	}
+}
+
+func TestSampledSTUNResponse(t *testing.T) {
+	b := stun.Response(stun.NewTxID(), netip.MustParseAddrPort("198.51.100.1:1234"))
+	if got := sampledSTUNResponse(context.Background(), b); got != nil {
+		t.Errorf("unsampled probe recorded response %+v", got)
+	}
+	ctx := sampleSTUNResponseKey.WithValue(context.Background(), true)
+	if got := sampledSTUNResponse(ctx, b); got == nil || len(got.Attrs) != 1 {
+		t.Errorf("sampled probe recorded response %+v", got)
+	}
+
+	r := result{stunResponse: parseSTUNResponse(b)}
+	if got := storedResultFromResult(r).toResult(); got.stunResponse != r.stunResponse {
+		t.Errorf("stored result lost STUN response")
+	}
+}
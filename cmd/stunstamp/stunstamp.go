@@ -2,6 +2,9 @@
 // SPDX-License-Identifier: BSD-3-Clause
 
 // The stunstamp binary measures round-trip latency with DERPs.
+//
+// See README.md for its features and subcommands, and daemonset.yaml for an
+// example of running it on every node of a Kubernetes cluster.
 package main
 
 import (
@@ -15,15 +18,12 @@
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"math"
-	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/netip"
-	"net/url"
 	"os"
-	"os/signal"
-	"runtime"
 	"slices"
 	"strconv"
 	"strings"
@@ -34,22 +34,86 @@
 	"github.com/golang/snappy"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/tcnksm/go-httpstat"
-	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/stun"
 	"tailscale.com/net/tcpinfo"
 	"tailscale.com/tailcfg"
 )
 
 var (
-	flagDERPMap        = flag.String("derp-map", "https://login.tailscale.com/derpmap/default", "URL to DERP map")
-	flagInterval       = flag.Duration("interval", time.Minute, "interval to probe at in time.ParseDuration() format")
-	flagIPv6           = flag.Bool("ipv6", false, "probe IPv6 addresses")
-	flagRemoteWriteURL = flag.String("rw-url", "", "prometheus remote write URL")
-	flagInstance       = flag.String("instance", "", "instance label value; defaults to hostname if unspecified")
-	flagSTUNDstPorts   = flag.String("stun-dst-ports", "", "comma-separated list of STUN destination ports to monitor")
-	flagHTTPSDstPorts  = flag.String("https-dst-ports", "", "comma-separated list of HTTPS destination ports to monitor")
-	flagTCPDstPorts    = flag.String("tcp-dst-ports", "", "comma-separated list of TCP destination ports to monitor")
-	flagICMP           = flag.Bool("icmp", false, "probe ICMP")
+	flagDERPMap         = flag.String("derp-map", "https://login.tailscale.com/derpmap/default", "URL to DERP map, or file:// URL of a local DERP map file")
+	flagInterval        = flag.Duration("interval", time.Minute, "interval to probe at in time.ParseDuration() format")
+	flagAlignWindows    = flag.Bool("align-windows", false, "start probe windows on wall-clock multiples of --interval")
+	flagIPv6            = flag.Bool("ipv6", false, "probe IPv6 addresses")
+	flagRemoteWriteURL  = flag.String("rw-url", "", "prometheus remote write URL")
+	flagOTLPURL         = flag.String("otlp-url", "", "if set, export the timeseries of rw-url as OTLP/HTTP JSON metrics to this URL")
+	flagInstance        = flag.String("instance", "", "instance label value; defaults to hostname if unspecified")
+	flagSTUNDstPorts    = flag.String("stun-dst-ports", "", "comma-separated list of STUN destination ports to monitor")
+	flagHTTPSDstPorts   = flag.String("https-dst-ports", "", "comma-separated list of HTTPS destination ports to monitor")
+	flagTCPDstPorts     = flag.String("tcp-dst-ports", "", "comma-separated list of TCP destination ports to monitor")
+	flagICMP            = flag.Bool("icmp", false, "probe ICMP")
+	flagDERPDstPorts    = flag.String("derp-dst-ports", "", "comma-separated list of DERP destination ports to monitor with DERP ping frames")
+	flagDERPWSDstPorts  = flag.String("derp-ws-dst-ports", "", "comma-separated list of DERP destination ports to monitor over WebSockets")
+	flagTWAMPDstPorts   = flag.String("twamp-dst-ports", "", fmt.Sprintf("comma-separated list of TWAMP-light reflector destination ports to monitor, typically %d", twampDefaultPort))
+	flagTWAMPReflector  = flag.String("twamp-reflector-addr", "", "if set, run a TWAMP-light reflector on this address, e.g. :862")
+	flagTWAMPKeys       = flag.String("twamp-auth-keys", "", "if set, use TWAMP-light authenticated mode with keys AES-KEY:HMAC-KEY in hex")
+	flagConfig          = flag.String("config", "", "path to optional HuJSON config file, or comma-separated paths of its layers")
+	flagControlURL      = flag.String("control-url", "", "if set, probe latency of the control plane (coordination server) at this URL")
+	flagStoreDir        = flag.String("store-dir", "", "if set, persist results and probe state to this directory")
+	flagStoreLayout     = flag.String("store-layout", string(storeLayoutJSONL), "layout of results in --store-dir: jsonl, ring, or sharded")
+	flagResultsCache    = flag.Duration("results-cache", 15*time.Minute, "duration of recent results held in memory to serve queries; 0 disables")
+	flagArchiveAfter    = flag.Duration("archive-after", 0, "if set, archive days of results in --store-dir older than this")
+	flagHTTPAddr        = flag.String("http-addr", "", "if set, serve the web UI, API, and debug handlers on this address")
+	flagLogLevels       = flag.String("log-levels", "", "comma-separated subsystem=level pairs, e.g. probe=debug,export=warn")
+	flagPeers           = flag.Bool("targets-from-peers", false, "probe the online peers of the local tailscaled")
+	flagRelayPenalty    = flag.Bool("relay-penalty", false, "with --targets-from-peers, measure the RTT penalty of DERP-relayed paths")
+	flagMeshTag         = flag.String("mesh-tag", "", "if set, form a probe mesh with the peers tagged with this ACL tag")
+	flagMeshDegree      = flag.Int("mesh-degree", 0, "with --mesh-tag, the number of members every member is paired with, or 0 for a full mesh")
+	flagSNMPAddr        = flag.String("snmp-addr", "", "if set, serve per-target summaries over SNMPv1/v2c on this UDP address")
+	flagSNMPCommunity   = flag.String("snmp-community", "public", "SNMP community required by --snmp-addr")
+	flagSNMPOIDPrefix   = flag.String("snmp-oid-prefix", defaultSNMPOIDPrefix, "OID the MIB served by --snmp-addr is rooted at")
+	flagHappyEyeballs   = flag.Bool("happy-eyeballs", false, "race IPv4 and IPv6 connections to dual-stack targets")
+	flagQualityScore    = flag.Bool("quality-score", false, "compute a network quality score from 0 to 100 per uplink")
+	flagHopCount        = flag.Bool("hop-count", false, "measure the hop count to every target")
+	flagCalibration     = flag.Duration("calibration-interval", time.Hour, "interval to recalibrate the latency floor of this host at, or 0 for startup only")
+	flagLargeUDP        = flag.Bool("large-udp", false, fmt.Sprintf("additionally send %d-byte STUN probes, recording loss by size", largeUDPSize))
+	flagMarking         = flag.Bool("marking", false, "additionally send STUN probes with varying ECN, DSCP, and DF markings")
+	flagFingerprint     = flag.Bool("path-fingerprint", false, "fingerprint the device returning responses from every target")
+	flagNTPServers      = flag.String("ntp-servers", "", "if set, query these comma-separated NTP servers, host[:port], for delay and offset")
+	flagDNSResolvers    = flag.String("dns-resolvers", "", "if set, query these comma-separated DNS resolvers, transport://host[:port][#servername]")
+	flagDNSQueryName    = flag.String("dns-query-name", "tailscale.com", "name whose A records are queried of --dns-resolvers")
+	flagCheckConfig     = flag.Bool("check-config", false, "do not probe; validate the configuration, print it as JSON, and exit")
+	flagPrintSchema     = flag.Bool("print-schema", false, "do not probe; print the JSON Schema of the --config file and exit")
+	flagReadOnly        = flag.Bool("read-only", false, "do not probe; serve the web UI and API over --store-dir")
+	flagProxy           = flag.String("proxy", "", "if set, additionally probe through this socks5:// or http:// proxy")
+	flagNetstack        = flag.Bool("netstack", false, "additionally probe STUN, HTTPS, and TCP targets through gVisor's netstack")
+	flagRawIface        = flag.String("raw-iface", "", "if set, additionally probe with packets crafted and timestamped on this interface")
+	flagRawNextHopMAC   = flag.String("raw-next-hop-mac", "", "link layer address to send --raw-iface packets to; defaults to the default gateway's")
+	flagAnnotate        = flag.String("annotate", "", "if set, do not probe; add an annotation with this text via --http-addr and exit")
+	flagAnnotateFrom    = flag.String("annotate-from", "", "start of the --annotate time range in RFC 3339 format; defaults to now")
+	flagAnnotateTo      = flag.String("annotate-to", "", "end of the --annotate time range in RFC 3339 format; defaults to --annotate-from")
+	flagAnnotateHost    = flag.String("annotate-hostname", "", "if set, scope the --annotate annotation to the target with this hostname")
+	flagWebhookURL      = flag.String("webhook-url", "", "if set, POST the results of every probe window as JSON to this URL")
+	flagDERPSTUNPorts   = flag.Bool("derp-stun-ports", false, "additionally probe STUN on the port of every node in the DERP map")
+	flagDERPMapWebhook  = flag.String("derp-map-webhook-url", "", "if set, POST changes to the targets of the DERP map as JSON to this URL")
+	flagWebhookSpool    = flag.String("webhook-spool-dir", "", "if set, spool webhook payloads to this directory and deliver them in batches")
+	flagWebhookSpoolMB  = flag.Int("webhook-spool-max-mb", 256, "maximum size of the spool of each webhook in MiB")
+	flagRXBatch         = flag.Int("rx-batch", 64, "on Linux, the maximum number of datagrams read per recvmmsg() syscall")
+	flagECN             = flag.Bool("ecn", false, "on Linux, record the ECN codepoints of ICMP and kernel-timestamped STUN replies")
+	flagECNECT1         = flag.Bool("ecn-ect1", false, "with --ecn, send ICMP and kernel-timestamped STUN probes with ECT(1)")
+	flagProbeOnLink     = flag.Bool("probe-on-link-change", false, "probe all targets out of cycle on link changes")
+	flagRebind          = flag.Bool("rebind", true, "re-establish stable conns when local addresses are removed")
+	flagKeepalive       = flag.Bool("keepalive-emulation", false, "additionally emulate tailscaled's STUN keepalives, recording NAT mapping stability")
+	flagKeepalivePort   = flag.Int("keepalive-port", defaultKeepalivePort, "UDP port for --keepalive-emulation to bind to")
+	flagNetns           = flag.String("netns", "", "on Linux, comma-separated list of named network namespaces to probe from")
+	flagExportIPs       = flag.String("export-ip-privacy", "", "if set, anonymize exported IP addresses: truncate or hash")
+	flagExportIPKey     = flag.String("export-ip-hash-key-file", "", "file holding the key of --export-ip-privacy=hash; a random key is used if unset")
+	flagExemplars       = flag.Bool("exemplars", false, "attach measurement ID exemplars to RTT samples written to rw-url and otlp-url")
+	flagWarmUpWindows   = flag.Int("warm-up-windows", 2, "number of probe windows after start and config reload excluded from aggregates")
+	flagAggregateWarmUp = flag.Bool("aggregate-warm-up", false, "include warm-up and cool-down windows in aggregates and alerting")
+	flagFaultInjection  = flag.Bool("fault-injection", false, "allow faults to be injected into probes via the API of --http-addr")
+	flagLeaderElection  = flag.String("leader-election", "", "if set, elect a leader of a redundant pair via a lease in file:PATH or kube:NAME")
+	flagLeaderLease     = flag.Duration("leader-lease", 10*time.Second, "with --leader-election, the duration of the leader's lease")
+	flagSTUNSampleRate  = flag.Float64("stun-response-sample-rate", 0, "fraction of STUN probes whose complete response is stored, between 0 and 1")
 )
 
 const (
@@ -64,9 +128,24 @@
 	// *flagInterval steps worth) of buffered data that can be held in memory
 	// before data loss occurs around prometheus unavailability.
 	maxBufferDuration = time.Hour
+	// maxRXBatch is the maximum of --rx-batch.
+	maxRXBatch = 1024
 )
 
+// getDERPMap fetches the DERP map at url, which may be a file:// URL of a
+// local file, e.g. the DERP map of a lab reflector written by scaffold.
 func getDERPMap(ctx context.Context, url string) (*tailcfg.DERPMap, error) {
+	if path, ok := strings.CutPrefix(url, "file://"); ok {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		dm := tailcfg.DERPMap{}
+		if err := json.Unmarshal(b, &dm); err != nil {
+			return nil, fmt.Errorf("failed to decode derp map file: %v", err)
+		}
+		return &dm, nil
+	}
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -92,6 +171,9 @@ func getDERPMap(ctx context.Context, url string) (*tailcfg.DERPMap, error) {
 const (
 	timestampSourceUserspace timestampSource = iota
 	timestampSourceKernel
+	// timestampSourceRaw is kernel or hardware timestamps of packets sent
+	// and received via an AF_PACKET socket, see rawProber.
+	timestampSourceRaw
 )
 
 func (t timestampSource) String() string {
@@ -100,6 +182,8 @@ func (t timestampSource) String() string {
 		return "userspace"
 	case timestampSourceKernel:
 		return "kernel"
+	case timestampSourceRaw:
+		return "raw"
 	default:
 		return "unknown"
 	}
@@ -112,8 +196,19 @@ func (t timestampSource) String() string {
 	protocolICMP  protocol = "icmp"
 	protocolHTTPS protocol = "https"
 	protocolTCP   protocol = "tcp"
+	protocolTWAMP protocol = "twamp"
+	// protocolDERP measures DERP ping frames, see measureDERPRTT.
+	protocolDERP protocol = "derp"
+	// protocolDERPWebSocket measures DERP ping frames over a WebSocket, see
+	// measureDERPWebSocketRTT.
+	protocolDERPWebSocket protocol = "derp_ws"
+	// protocolDERPWebSocketUpgrade measures the WebSocket upgrade of DERP,
+	// see measureDERPWebSocketUpgradeRTT.
+	protocolDERPWebSocketUpgrade protocol = "derp_ws_upgrade"
 )
 
+var allProtocols = []protocol{protocolSTUN, protocolICMP, protocolHTTPS, protocolTCP, protocolTWAMP, protocolDERP, protocolDERPWebSocket, protocolDERPWebSocketUpgrade}
+
 // resultKey contains the stable dimensions and their values for a given
 // timeseries, i.e. not time and not rtt/timeout.
 type resultKey struct {
@@ -122,12 +217,58 @@ type resultKey struct {
 	connStability   connStability
 	protocol        protocol
 	dstPort         int
+	// proxy is the host:port of the proxy probed through, netstackProxyName
+	// for probes through netstack, or empty for direct probes.
+	proxy string
+	// xlat is the address family translation on the path to the target,
+	// e.g. xlatCLAT, or empty if none.
+	xlat string
+	// netns is the network namespace probed from, if received by
+	// runNetnsSupervisor from a child, or empty.
+	netns string
 }
 
 type result struct {
 	key resultKey
 	at  time.Time
 	rtt *time.Duration // nil signifies failure, e.g. timeout
+	// userspaceRTT is the userspace-timestamped RTT of the same transaction
+	// for kernel and raw timestamped results, if available.
+	userspaceRTT *time.Duration
+	// attempts holds the raw outcome of every attempt in the window when
+	// the retryPolicy makes more than one, with nil signifying failure.
+	attempts []*time.Duration
+	// id uniquely identifies the result, linking exemplars to the stored
+	// result.
+	id string
+	// mappedAddr is the reflexive address last reported by a STUN server
+	// in the window, if any.
+	mappedAddr netip.AddrPort
+	// instance identifies the server instance that last answered in the
+	// window, if known, see stunResponseInstance and httpsResponseInstance.
+	instance string
+	// first is whether the first attempt of a stable conn result was the
+	// first transaction after the conn was (re)established. Such
+	// transactions pay session setup penalties, e.g. of CGNATs creating
+	// mappings, that steady-state transactions do not, and are recorded
+	// apart from them.
+	first bool
+	// ecn is the ECN codepoint of the reply last received in the window, if
+	// observed, see --ecn.
+	ecn ecnCodepoint
+	// phase is the phase of the prober's lifecycle the window was probed
+	// in, see lifecyclePhase.
+	phase lifecyclePhase
+	// order is the 1-based position of the protocol in the randomized
+	// order the protocols of the target were sent in during the window,
+	// see protocolSlots, or zero if unknown.
+	order int
+	// txOffset is the time from the start of the window to the first
+	// attempt, or zero if unknown.
+	txOffset time.Duration
+	// stunResponse is the STUN response last received in the window in
+	// full, if the result was sampled by --stun-response-sample-rate.
+	stunResponse *stunResponse
 }
 
 type lportsPool struct {
@@ -143,6 +284,20 @@ func (l *lportsPool) get() int {
 	return ret
 }
 
+// take removes port from the pool and returns it, or returns another port
+// from the pool if port is not available.
+func (l *lportsPool) take(port int) int {
+	l.Lock()
+	defer l.Unlock()
+	i := slices.Index(l.ports, port)
+	if i < 0 {
+		i = 0
+	}
+	ret := l.ports[i]
+	l.ports = slices.Delete(l.ports, i, i+1)
+	return ret
+}
+
 func (l *lportsPool) put(i int) {
 	l.Lock()
 	defer l.Unlock()
@@ -194,7 +349,7 @@ func addrInUse(err error, lport *lportForTCPConn) bool {
 		old := int(*lport)
 		// abandon port, don't return it to pool
 		*lport = lportForTCPConn(lports.get()) // get a new port
-		log.Printf("EADDRINUSE: %v old: %d new: %d", err, old, *lport)
+		probeLog.Debug("EADDRINUSE, abandoning port", "err", err, "old", old, "new", *lport)
 		return true
 	}
 	return false
@@ -202,6 +357,9 @@ func addrInUse(err error, lport *lportForTCPConn) bool {
 
 func tcpDial(ctx context.Context, lport *lportForTCPConn, dst netip.AddrPort) (net.Conn, error) {
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		var opErr error
 		dialer := &net.Dialer{
 			LocalAddr: &net.TCPAddr{
@@ -236,20 +394,20 @@ func (t tempError) Temporary() bool {
 	return true
 }
 
-func measureTCPRTT(conn io.ReadWriteCloser, _ string, dst netip.AddrPort) (rtt time.Duration, err error) {
+func measureTCPRTT(ctx context.Context, conn io.ReadWriteCloser, _ string, dst netip.AddrPort) (m measurement, err error) {
 	lport, ok := conn.(*lportForTCPConn)
 	if !ok {
-		return 0, fmt.Errorf("unexpected conn type: %T", conn)
+		return measurement{}, fmt.Errorf("unexpected conn type: %T", conn)
 	}
 	// Set a dial timeout < 1s (TCP_TIMEOUT_INIT on Linux) as a means to avoid
 	// SYN retries, which can contribute to tcpi->rtt below. This simply limits
 	// retries from the initiator, but SYN+ACK on the reverse path can also
 	// time out and be retransmitted.
-	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*750)
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond*750)
 	defer cancel()
 	tcpConn, err := tcpDial(ctx, lport, dst)
 	if err != nil {
-		return 0, tempError{err}
+		return measurement{}, tempError{err}
 	}
 	defer tcpConn.Close()
 	// This is an unreliable method to measure TCP RTT. The Linux kernel
@@ -258,34 +416,45 @@ func measureTCPRTT(conn io.ReadWriteCloser, _ string, dst netip.AddrPort) (rtt t
 	// actually use this elsewhere as an input to some decision it warrants a
 	// deeper study and consideration for alternative methods. Its usefulness
 	// here is as a point of comparison against the other methods.
-	rtt, err = tcpinfo.RTT(tcpConn)
+	rtt, err := tcpinfo.RTT(tcpConn)
 	if err != nil {
-		return 0, tempError{err}
+		return measurement{}, tempError{err}
 	}
-	return rtt, nil
+	return measurement{rtt: rtt}, nil
 }
 
-func measureHTTPSRTT(conn io.ReadWriteCloser, hostname string, dst netip.AddrPort) (rtt time.Duration, err error) {
+func measureHTTPSRTT(ctx context.Context, conn io.ReadWriteCloser, hostname string, dst netip.AddrPort) (m measurement, err error) {
 	lport, ok := conn.(*lportForTCPConn)
 	if !ok {
-		return 0, fmt.Errorf("unexpected conn type: %T", conn)
+		return measurement{}, fmt.Errorf("unexpected conn type: %T", conn)
 	}
+	return measureHTTPS(ctx, hostname, dst, func(ctx context.Context) (net.Conn, error) {
+		// 1.5s mirrors derp/derphttp.dialnodeTimeout used in derp/derphttp.DialNode().
+		dialCtx, dialCancel := context.WithTimeout(ctx, time.Millisecond*1500)
+		defer dialCancel()
+		return tcpDial(dialCtx, lport, dst)
+	})
+}
+
+// measureHTTPS measures the HTTPS RTT to the DERP node at dst over the conn
+// returned by dial, with DERP's latency check or the request customized by
+// the httpsRequestKey of ctx.
+func measureHTTPS(ctx context.Context, hostname string, dst netip.AddrPort, dial func(context.Context) (net.Conn, error)) (m measurement, err error) {
 	var httpResult httpstat.Result
 	// 5s mirrors net/netcheck.overallProbeTimeout used in net/netcheck.Client.measureHTTPSLatency.
-	reqCtx, cancel := context.WithTimeout(httpstat.WithHTTPStat(context.Background(), &httpResult), time.Second*5)
+	reqCtx, cancel := context.WithTimeout(httpstat.WithHTTPStat(ctx, &httpResult), time.Second*5)
 	defer cancel()
-	reqURL := "https://" + dst.String() + "/derp/latency-check"
-	req, err := http.NewRequestWithContext(reqCtx, "GET", reqURL, nil)
+	req, err := newHTTPSRequest(reqCtx, dst)
 	if err != nil {
-		return 0, err
+		return measurement{}, err
+	}
+	if id := measurementIDKey.Value(ctx); id != "" {
+		req.Header.Set(measurementIDHeader, id)
 	}
 	client := &http.Client{}
-	// 1.5s mirrors derp/derphttp.dialnodeTimeout used in derp/derphttp.DialNode().
-	dialCtx, dialCancel := context.WithTimeout(reqCtx, time.Millisecond*1500)
-	defer dialCancel()
-	tcpConn, err := tcpDial(dialCtx, lport, dst)
+	tcpConn, err := dial(reqCtx)
 	if err != nil {
-		return 0, tempError{err}
+		return measurement{}, tempError{err}
 	}
 	defer tcpConn.Close()
 	tlsConn := tls.Client(tcpConn, &tls.Config{
@@ -293,9 +462,10 @@ func measureHTTPSRTT(conn io.ReadWriteCloser, hostname string, dst netip.AddrPor
 	})
 	// Mirror client/netcheck behavior, which handshakes before handing the
 	// tlsConn over to the http.Client via http.Transport
-	err = tlsConn.Handshake()
+	err = tlsConn.HandshakeContext(reqCtx)
+	tlsCerts.observe(protocolHTTPS, hostname, dst, tlsConn.ConnectionState(), err, time.Now())
 	if err != nil {
-		return 0, tempError{err}
+		return measurement{}, tempError{err}
 	}
 	tlsConnCh := make(chan net.Conn, 1)
 	tlsConnCh <- tlsConn
@@ -312,28 +482,28 @@ func measureHTTPSRTT(conn io.ReadWriteCloser, hostname string, dst netip.AddrPor
 	client.Transport = tr
 	resp, err := client.Do(req)
 	if err != nil {
-		return 0, tempError{err}
+		return measurement{}, tempError{err}
 	}
-	if resp.StatusCode/100 != 2 {
-		return 0, tempError{fmt.Errorf("unexpected status code: %d", resp.StatusCode)}
+	if !httpsRequestKey.Value(ctx).expectsStatus(resp.StatusCode) {
+		return measurement{}, tempError{fmt.Errorf("unexpected status code: %d", resp.StatusCode)}
 	}
 	defer resp.Body.Close()
 	_, err = io.Copy(io.Discard, io.LimitReader(resp.Body, 8<<10))
 	if err != nil {
-		return 0, tempError{err}
+		return measurement{}, tempError{err}
 	}
 	httpResult.End(time.Now())
-	return httpResult.ServerProcessing, nil
+	return measurement{rtt: httpResult.ServerProcessing, instance: httpsResponseInstance(resp, tlsConn.ConnectionState())}, nil
 }
 
-func measureSTUNRTT(conn io.ReadWriteCloser, _ string, dst netip.AddrPort) (rtt time.Duration, err error) {
+func measureSTUNRTT(ctx context.Context, conn io.ReadWriteCloser, _ string, dst netip.AddrPort) (m measurement, err error) {
 	uconn, ok := conn.(*net.UDPConn)
 	if !ok {
-		return 0, fmt.Errorf("unexpected conn type: %T", conn)
+		return measurement{}, fmt.Errorf("unexpected conn type: %T", conn)
 	}
-	err = uconn.SetReadDeadline(time.Now().Add(txRxTimeout))
+	err = uconn.SetDeadline(deadlineWithin(ctx, txRxTimeout))
 	if err != nil {
-		return 0, fmt.Errorf("error setting read deadline: %w", err)
+		return measurement{}, fmt.Errorf("error setting deadline: %w", err)
 	}
 	txID := stun.NewTxID()
 	req := stun.Request(txID)
@@ -343,20 +513,20 @@ func measureSTUNRTT(conn io.ReadWriteCloser, _ string, dst netip.AddrPort) (rtt
 		Port: int(dst.Port()),
 	})
 	if err != nil {
-		return 0, fmt.Errorf("error writing to udp socket: %w", err)
+		return measurement{}, fmt.Errorf("error writing to udp socket: %w", err)
 	}
 	b := make([]byte, 1460)
 	for {
 		n, err := uconn.Read(b)
 		rxAt := time.Now()
 		if err != nil {
-			return 0, fmt.Errorf("error reading from udp socket: %w", err)
+			return measurement{}, fmt.Errorf("error reading from udp socket: %w", err)
 		}
-		gotTxID, _, err := stun.ParseResponse(b[:n])
+		gotTxID, mapped, err := stun.ParseResponse(b[:n])
 		if err != nil || gotTxID != txID {
 			continue
 		}
-		return rxAt.Sub(txAt), nil
+		return measurement{rtt: rxAt.Sub(txAt), mappedAddr: mapped, instance: stunResponseInstance(b[:n]), stunResponse: sampledSTUNResponse(ctx, b[:n])}, nil
 	}
 
 }
@@ -378,7 +548,47 @@ type nodeMeta struct {
 	addr       netip.Addr
 }
 
-type measureFn func(conn io.ReadWriteCloser, hostname string, dst netip.AddrPort) (rtt time.Duration, err error)
+// measurement is the outcome of a successful measureFn call.
+type measurement struct {
+	rtt time.Duration
+	// userspaceRTT is the RTT of the same transaction derived from userspace
+	// timestamps when rtt is derived from kernel or raw timestamps, otherwise zero.
+	// It allows us to quantify userspace timestamping error per platform.
+	userspaceRTT time.Duration
+	// mappedAddr is the reflexive address reported by a STUN server, if any.
+	mappedAddr netip.AddrPort
+	// instance identifies the server instance that answered, if known.
+	instance string
+	// first is whether the transaction was the first over a connection the
+	// measureFn (re)established, e.g. a DERP client reconnected by a stable
+	// conn, see result.first.
+	first bool
+	// ecn is the ECN codepoint of the reply, if observed, see --ecn.
+	ecn ecnCodepoint
+	// stunResponse is the parsed STUN response if the probe was sampled,
+	// see sampleSTUNResponseKey.
+	stunResponse *stunResponse
+}
+
+// measureFn measures the RTT to dst over conn. It must return no later than
+// shortly after the deadline of ctx, if any.
+type measureFn func(ctx context.Context, conn io.ReadWriteCloser, hostname string, dst netip.AddrPort) (m measurement, err error)
+
+// windowDeadline returns the deadline for probing in the window starting at
+// start, leaving headroom to export results before the next window.
+func windowDeadline(start time.Time, interval time.Duration) time.Time {
+	return start.Add(interval * 9 / 10)
+}
+
+// deadlineWithin returns the time d from now, or the deadline of ctx if that
+// is sooner.
+func deadlineWithin(ctx context.Context, d time.Duration) time.Time {
+	deadline := time.Now().Add(d)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		return ctxDeadline
+	}
+	return deadline
+}
 
 // nodeMetaFromDERPMap parses the provided DERP map in order to update nodeMeta
 // in the provided nodeMetaByAddr. It returns a slice of nodeMeta containing
@@ -434,6 +644,7 @@ func nodeMetaFromDERPMap(dm *tailcfg.DERPMap, nodeMetaByAddr map[netip.Addr]node
 		_, ok := updated[addr]
 		if !ok {
 			stale = append(stale, potentialStale)
+			delete(nodeMetaByAddr, addr)
 		}
 	}
 
@@ -443,74 +654,24 @@ func nodeMetaFromDERPMap(dm *tailcfg.DERPMap, nodeMetaByAddr map[netip.Addr]node
 type connAndMeasureFn struct {
 	conn io.ReadWriteCloser
 	fn   measureFn
+	// probed is whether a stable conn has been probed over, see
+	// result.first.
+	probed bool
 }
 
 // newConnAndMeasureFn returns a connAndMeasureFn or an error. It may return
 // nil for both if some combination of the supplied timestampSource, protocol,
-// or connStability is unsupported.
-func newConnAndMeasureFn(forDst netip.Addr, source timestampSource, protocol protocol, stable connStability) (*connAndMeasureFn, error) {
-	info := getProtocolSupportInfo(protocol)
-	if !info.stableConn && bool(stable) {
+// or connStability is unsupported. A nonzero lport is the local port (or ICMP
+// identifier) to bind a stable conn to.
+func newConnAndMeasureFn(forDst netip.Addr, source timestampSource, protocol protocol, stable connStability, lport int) (*connAndMeasureFn, error) {
+	if int(source) >= len(timestampProviders) {
 		return nil, nil
 	}
-	if !info.userspaceTS && source == timestampSourceUserspace {
+	tp := timestampProviders[source]
+	if tp == nil || !tp.supports(protocol, stable) {
 		return nil, nil
 	}
-	if !info.kernelTS && source == timestampSourceKernel {
-		return nil, nil
-	}
-	switch protocol {
-	case protocolSTUN:
-		if source == timestampSourceKernel {
-			conn, err := getUDPConnKernelTimestamp()
-			if err != nil {
-				return nil, err
-			}
-			return &connAndMeasureFn{
-				conn: conn,
-				fn:   measureSTUNRTTKernel,
-			}, nil
-		} else {
-			conn, err := net.ListenUDP("udp", &net.UDPAddr{})
-			if err != nil {
-				return nil, err
-			}
-			return &connAndMeasureFn{
-				conn: conn,
-				fn:   measureSTUNRTT,
-			}, nil
-		}
-	case protocolICMP:
-		conn, err := getICMPConn(forDst, source)
-		if err != nil {
-			return nil, err
-		}
-		return &connAndMeasureFn{
-			conn: conn,
-			fn:   mkICMPMeasureFn(source),
-		}, nil
-	case protocolHTTPS:
-		localPort := 0
-		if stable {
-			localPort = lports.get()
-		}
-		conn := lportForTCPConn(localPort)
-		return &connAndMeasureFn{
-			conn: &conn,
-			fn:   measureHTTPSRTT,
-		}, nil
-	case protocolTCP:
-		localPort := 0
-		if stable {
-			localPort = lports.get()
-		}
-		conn := lportForTCPConn(localPort)
-		return &connAndMeasureFn{
-			conn: &conn,
-			fn:   measureTCPRTT,
-		}, nil
-	}
-	return nil, errors.New("unknown protocol")
+	return tp.newConn(forDst, protocol, stable, lport)
 }
 
 type stableConnKey struct {
@@ -519,12 +680,6 @@ type stableConnKey struct {
 	port     int
 }
 
-type protocolSupportInfo struct {
-	kernelTS    bool
-	userspaceTS bool
-	stableConn  bool
-}
-
 func getConns(
 	stableConns map[stableConnKey][2]*connAndMeasureFn,
 	addr netip.Addr,
@@ -549,10 +704,15 @@ func getConns(
 
 	var ok bool
 	stable, ok = stableConns[key]
-	if !ok {
+	if !ok && stableConns != nil {
+		restored := probeStates.restoredLocalPorts(key)
 		for _, source := range []timestampSource{timestampSourceUserspace, timestampSourceKernel} {
 			var cf *connAndMeasureFn
-			cf, err = newConnAndMeasureFn(addr, source, protocol, stableConn)
+			cf, err = newConnAndMeasureFn(addr, source, protocol, stableConn, restored[source])
+			if err != nil && restored[source] != 0 {
+				probeLog.Warn("unable to restore stable conn local port", "addr", addr, "protocol", protocol, "port", dstPort, "lport", restored[source], "err", err)
+				cf, err = newConnAndMeasureFn(addr, source, protocol, stableConn, 0)
+			}
 			if err != nil {
 				return
 			}
@@ -563,7 +723,7 @@ func getConns(
 
 	for _, source := range []timestampSource{timestampSourceUserspace, timestampSourceKernel} {
 		var cf *connAndMeasureFn
-		cf, err = newConnAndMeasureFn(addr, source, protocol, unstableConn)
+		cf, err = newConnAndMeasureFn(addr, source, protocol, unstableConn, 0)
 		if err != nil {
 			return
 		}
@@ -572,12 +732,35 @@ func getConns(
 	return stable, unstable, nil
 }
 
+// closeStableConns closes and removes the stableConns for which drop returns
+// true.
+func closeStableConns(stableConns map[stableConnKey][2]*connAndMeasureFn, drop func(stableConnKey) bool) {
+	for k, cfs := range stableConns {
+		if !drop(k) {
+			continue
+		}
+		for _, cf := range cfs {
+			if cf != nil {
+				cf.conn.Close()
+			}
+		}
+		delete(stableConns, k)
+	}
+}
+
 // probeNodes measures the round-trip time for the protocols and ports described
-// by portsByProtocol against the DERP nodes described by nodeMetaByAddr.
+// by portsByProtocol against the nodes described by nodeMetaByAddr, making
+// attempts per window as described by retryPolicies. Nodes present in
+// portsByAddr are probed with the protocols and ports held there instead.
+// If due is non-nil, only the protocols of a node it reports due are probed
+// in this window; the stable conns of the others are retained.
+// Probes in flight when the deadline of ctx passes fail as timeouts, and
+// remaining attempts are abandoned.
 // stableConns are used to recycle connections across calls to probeNodes.
-// probeNodes is also responsible for trimming stableConns based on node
-// lifetime in nodeMetaByAddr. It returns the results or an error if one occurs.
-func probeNodes(nodeMetaByAddr map[netip.Addr]nodeMeta, stableConns map[stableConnKey][2]*connAndMeasureFn, portsByProtocol map[protocol][]int) ([]result, error) {
+// If stableConns is nil, only unstable conns are probed over.
+// probeNodes is also responsible for trimming stableConns of nodes, protocols,
+// and ports no longer probed. It returns the results or an error if one occurs.
+func probeNodes(ctx context.Context, nodeMetaByAddr map[netip.Addr]nodeMeta, stableConns map[stableConnKey][2]*connAndMeasureFn, portsByProtocol map[protocol][]int, portsByAddr map[netip.Addr]map[protocol][]int, due func(netip.Addr, protocol) bool, retryPolicies map[protocol]retryPolicy, httpsRequests []httpsRequestConfig) ([]result, error) {
 	wg := sync.WaitGroup{}
 	results := make([]result, 0)
 	resultsCh := make(chan result)
@@ -585,9 +768,11 @@ func probeNodes(nodeMetaByAddr map[netip.Addr]nodeMeta, stableConns map[stableCo
 	doneCh := make(chan struct{})
 	numProbes := 0
 	at := time.Now()
-	addrsToProbe := make(map[netip.Addr]bool)
+	connsToProbe := make(map[stableConnKey]bool)
 
-	doProbe := func(cf *connAndMeasureFn, meta nodeMeta, source timestampSource, stable connStability, protocol protocol, dstPort int) {
+	// first is whether cf is a stable conn not probed over before. slot is
+	// the protocol's slot of the window on the target.
+	doProbe := func(cf *connAndMeasureFn, meta nodeMeta, source timestampSource, stable connStability, protocol protocol, dstPort int, proxy, xlat string, first bool, slot protocolSlot) {
 		defer wg.Done()
 		r := result{
 			key: resultKey{
@@ -596,26 +781,83 @@ func probeNodes(nodeMetaByAddr map[netip.Addr]nodeMeta, stableConns map[stableCo
 				connStability:   stable,
 				dstPort:         dstPort,
 				protocol:        protocol,
+				proxy:           proxy,
+				xlat:            xlat,
 			},
-			at: at,
+			at:    at,
+			id:    newMeasurementID(),
+			order: slot.order,
+		}
+		jitter := time.NewTimer(slot.offset()) // jitter across tx
+		select {
+		case <-jitter.C:
+		case <-ctx.Done():
+			jitter.Stop()
 		}
-		time.Sleep(rand.N(maxTXJitter)) // jitter across tx
+		r.txOffset = time.Since(at)
 		addrPort := netip.AddrPortFrom(meta.addr, uint16(dstPort))
-		rtt, err := cf.fn(cf.conn, meta.hostname, addrPort)
-		if err != nil {
-			if isTemporaryOrTimeoutErr(err) {
-				r.rtt = nil
-				log.Printf("%s: temp error measuring RTT to %s(%s): %v", protocol, meta.hostname, addrPort, err)
-			} else {
-				select {
-				case <-doneCh:
-					return
-				case errCh <- fmt.Errorf("%s: %v", protocol, err):
-					return
+		// All attempts carry the result's ID.
+		probeCtx := measurementIDKey.WithValue(ctx, r.id)
+		if protocol == protocolSTUN && sampleSTUNResponse() {
+			probeCtx = sampleSTUNResponseKey.WithValue(probeCtx, true)
+		}
+		if protocol == protocolHTTPS {
+			if req := httpsRequestFor(httpsRequests, meta); req != nil {
+				probeCtx = httpsRequestKey.WithValue(probeCtx, req)
+			}
+		}
+		policy := retryPolicies[protocol]
+		var rtts, userspaceRTTs []time.Duration
+		r.first = first
+		for i := range policy.attempts() {
+			if ctx.Err() != nil {
+				break
+			}
+			m, err := faults.measure(probeCtx, protocol, cf.fn, cf.conn, meta.hostname, addrPort)
+			if i == 0 && m.first {
+				r.first = true
+			}
+			if err != nil {
+				// Any error after the window deadline is a consequence of it.
+				if !isTemporaryOrTimeoutErr(err) && ctx.Err() == nil {
+					select {
+					case <-doneCh:
+						return
+					case errCh <- fmt.Errorf("%s: %v", protocol, err):
+						return
+					}
 				}
+				probeLog.Warn("temp error measuring RTT", "protocol", protocol, "hostname", meta.hostname, "addr", meta.addr, "port", dstPort, "err", err)
+				if policy.attempts() > 1 {
+					r.attempts = append(r.attempts, nil)
+				}
+				continue
 			}
-		} else {
+			rtts = append(rtts, m.rtt)
+			if m.mappedAddr.IsValid() {
+				r.mappedAddr = m.mappedAddr
+			}
+			if m.instance != "" {
+				r.instance = m.instance
+			}
+			if m.stunResponse != nil {
+				r.stunResponse = m.stunResponse
+			}
+			if m.ecn != ecnUnobserved {
+				r.ecn = m.ecn
+			}
+			if source != timestampSourceUserspace && m.userspaceRTT != 0 {
+				userspaceRTTs = append(userspaceRTTs, m.userspaceRTT)
+			}
+			if policy.attempts() > 1 {
+				r.attempts = append(r.attempts, &m.rtt)
+			}
+		}
+		if rtt, ok := policy.reduce(rtts); ok {
 			r.rtt = &rtt
+			if usRTT, ok := policy.reduce(userspaceRTTs); ok {
+				r.userspaceRTT = &usRTT
+			}
 		}
 		select {
 		case <-doneCh:
@@ -623,10 +865,27 @@ func probeNodes(nodeMetaByAddr map[netip.Addr]nodeMeta, stableConns map[stableCo
 		}
 	}
 
+	clatIf, clat := detectCLAT()
+	if clat && !clatSeen.Swap(true) {
+		probeLog.Info("464XLAT CLAT detected, tagging IPv4 results routed via it", "interface", clatIf)
+	}
+
 	for _, meta := range nodeMetaByAddr {
-		addrsToProbe[meta.addr] = true
-		for p, ports := range portsByProtocol {
+		xlat := xlatOf(meta.addr, clat)
+		nodePorts := portsByProtocol
+		if override, ok := portsByAddr[meta.addr]; ok {
+			nodePorts = override
+		}
+		slots := protocolSlots(nodePorts, func(p protocol) bool {
+			return due == nil || due(meta.addr, p)
+		})
+		for p, ports := range nodePorts {
+			slot := slots[p]
 			for _, port := range ports {
+				connsToProbe[stableConnKey{meta.addr, p, port}] = true
+				if due != nil && !due(meta.addr, p) {
+					continue
+				}
 				stable, unstable, err := getConns(stableConns, meta.addr, p, port)
 				if err != nil {
 					close(doneCh)
@@ -638,7 +897,9 @@ func probeNodes(nodeMetaByAddr map[netip.Addr]nodeMeta, stableConns map[stableCo
 					if cf != nil {
 						wg.Add(1)
 						numProbes++
-						go doProbe(cf, meta, timestampSource(i), stableConn, p, port)
+						first := !cf.probed
+						cf.probed = true
+						go doProbe(cf, meta, timestampSource(i), stableConn, p, port, "", xlat, first, slot)
 					}
 				}
 
@@ -646,22 +907,41 @@ func probeNodes(nodeMetaByAddr map[netip.Addr]nodeMeta, stableConns map[stableCo
 					if cf != nil {
 						wg.Add(1)
 						numProbes++
-						go doProbe(cf, meta, timestampSource(i), unstableConn, p, port)
+						go doProbe(cf, meta, timestampSource(i), unstableConn, p, port, "", xlat, false, slot)
 					}
 				}
+
+				if activeProxy != nil && activeProxy.supports(p) {
+					wg.Add(1)
+					numProbes++
+					go doProbe(newProxiedConnAndMeasureFn(activeProxy, p), meta, timestampSourceUserspace, unstableConn, p, port, activeProxy.name(), "", false, slot)
+				}
+
+				if activeNetstack != nil && activeNetstack.supports(p) {
+					wg.Add(1)
+					numProbes++
+					go doProbe(activeNetstack.connAndMeasureFn(p), meta, timestampSourceUserspace, unstableConn, p, port, activeNetstack.name(), "", false, slot)
+				}
+
+				if activeRawProber != nil && activeRawProber.supports(p, meta.addr) {
+					// The raw prober uses a single socket, ICMP identifier,
+					// and UDP source port for all probes.
+					wg.Add(1)
+					numProbes++
+					go doProbe(activeRawProber.connAndMeasureFn(p), meta, timestampSourceRaw, stableConn, p, port, "", "", false, slot)
+				}
 			}
 		}
 	}
 
 	// cleanup conns we no longer need
-	for k, cf := range stableConns {
-		if !addrsToProbe[k.node] {
-			if cf[timestampSourceKernel] != nil {
-				cf[timestampSourceKernel].conn.Close()
-			}
-			cf[timestampSourceUserspace].conn.Close()
-			delete(stableConns, k)
-		}
+	closeStableConns(stableConns, func(k stableConnKey) bool {
+		return !connsToProbe[k]
+	})
+	if numProbes == 0 {
+		// Nothing is due, e.g. as Intervals only shortens the interval of
+		// protocols not probed.
+		return nil, nil
 	}
 
 	for {
@@ -689,6 +969,14 @@ func probeNodes(nodeMetaByAddr map[netip.Addr]nodeMeta, stableConns map[stableCo
 const (
 	rttMetricName      = "stunstamp_derp_rtt_ns"
 	timeoutsMetricName = "stunstamp_derp_timeouts_total"
+	// firstRTTMetricName is the RTT of the first transaction over a stable
+	// conn after it was (re)established, which is excluded from
+	// rttMetricName, see result.first.
+	firstRTTMetricName = "stunstamp_derp_first_rtt_ns"
+	// userspaceErrMetricName is the userspace-timestamped RTT minus the
+	// kernel- or raw-timestamped RTT of the same transaction.
+	userspaceErrMetricName = "stunstamp_derp_userspace_rtt_error_ns"
+	crossTalkMetricName    = "stunstamp_rx_crosstalk_total"
 )
 
 func timeSeriesLabels(metricName string, meta nodeMeta, instance string, source timestampSource, stability connStability, protocol protocol, dstPort int) []prompb.Label {
@@ -748,6 +1036,61 @@ func timeSeriesLabels(metricName string, meta nodeMeta, instance string, source
 	return labels
 }
 
+// resultKeyLabels returns the labels for the timeseries of metricName
+// described by k.
+func resultKeyLabels(metricName string, k resultKey, instance string) []prompb.Label {
+	labels := timeSeriesLabels(metricName, k.meta, instance, k.timestampSource, k.connStability, k.protocol, k.dstPort)
+	// Label values must not be empty, and direct, untranslated results
+	// predate these labels.
+	if len(k.proxy) == 0 && len(k.xlat) == 0 {
+		return labels
+	}
+	if len(k.proxy) > 0 {
+		labels = append(labels, prompb.Label{
+			Name:  "proxy",
+			Value: k.proxy,
+		})
+	}
+	if len(k.xlat) > 0 {
+		labels = append(labels, prompb.Label{
+			Name:  "xlat",
+			Value: k.xlat,
+		})
+	}
+	slices.SortFunc(labels, func(a, b prompb.Label) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return labels
+}
+
+// instanceTimeSeries returns a single sample TimeSeries for a metric
+// describing the stunstamp instance as a whole, rather than a node.
+func instanceTimeSeries(metricName, instance string, at time.Time, value float64) prompb.TimeSeries {
+	labels := []prompb.Label{
+		{
+			Name:  "__name__",
+			Value: metricName,
+		},
+		{
+			Name:  "instance",
+			Value: instance,
+		},
+		{
+			Name:  "job",
+			Value: "stunstamp-rw",
+		},
+	}
+	return prompb.TimeSeries{
+		Labels: labels,
+		Samples: []prompb.Sample{
+			{
+				Timestamp: at.UnixMilli(),
+				Value:     value,
+			},
+		},
+	}
+}
+
 const (
 	// https://prometheus.io/docs/concepts/remote_write_spec/#stale-markers
 	staleNaN uint64 = 0x7ff0000000000002
@@ -758,6 +1101,13 @@ func staleMarkersFromNodeMeta(stale []nodeMeta, instance string, portsByProtocol
 	now := time.Now()
 
 	for p, ports := range portsByProtocol {
+		proxies := []string{""}
+		if activeProxy != nil && activeProxy.supports(p) {
+			proxies = append(proxies, activeProxy.name())
+		}
+		if activeNetstack != nil && activeNetstack.supports(p) {
+			proxies = append(proxies, activeNetstack.name())
+		}
 		for _, port := range ports {
 			for _, s := range stale {
 				samples := []prompb.Sample{
@@ -768,13 +1118,40 @@ func staleMarkersFromNodeMeta(stale []nodeMeta, instance string, portsByProtocol
 				}
 				// We send stale markers for all combinations in the interest
 				// of simplicity.
-				for _, name := range []string{rttMetricName, timeoutsMetricName} {
-					for _, source := range []timestampSource{timestampSourceUserspace, timestampSourceKernel} {
+				sources := []timestampSource{timestampSourceUserspace, timestampSourceKernel}
+				if activeRawProber != nil && activeRawProber.supports(p, s.addr) {
+					sources = append(sources, timestampSourceRaw)
+				}
+				// Direct results may have been translated.
+				xlats := []string{""}
+				if s.addr.Is4() && clatSeen.Load() {
+					xlats = append(xlats, xlatCLAT)
+				} else if s.addr.Is6() && xlatOf(s.addr, false) != "" {
+					xlats = append(xlats, xlatNAT64)
+				}
+				for _, name := range []string{rttMetricName, firstRTTMetricName, timeoutsMetricName, userspaceErrMetricName, baselineMetricName, deviationMetricName} {
+					for _, source := range sources {
 						for _, stable := range []connStability{unstableConn, stableConn} {
-							staleMarkers = append(staleMarkers, prompb.TimeSeries{
-								Labels:  timeSeriesLabels(name, s, instance, source, stable, p, port),
-								Samples: samples,
-							})
+							for _, proxy := range proxies {
+								for _, xlat := range xlats {
+									if proxy != "" && xlat != "" {
+										continue
+									}
+									k := resultKey{
+										meta:            s,
+										timestampSource: source,
+										connStability:   stable,
+										protocol:        p,
+										dstPort:         port,
+										proxy:           proxy,
+										xlat:            xlat,
+									}
+									staleMarkers = append(staleMarkers, prompb.TimeSeries{
+										Labels:  resultKeyLabels(name, k, instance),
+										Samples: samples,
+									})
+								}
+							}
 						}
 					}
 				}
@@ -787,15 +1164,19 @@ func staleMarkersFromNodeMeta(stale []nodeMeta, instance string, portsByProtocol
 
 // resultsToPromTimeSeries returns a slice of prometheus TimeSeries for the
 // provided results and instance. timeouts is updated based on results, i.e.
-// all result.key's are added to timeouts if they do not exist, and removed
-// from timeouts if they are not present in results.
-func resultsToPromTimeSeries(results []result, instance string, timeouts map[resultKey]uint64) []prompb.TimeSeries {
+// all result.key's are added to timeouts if they do not exist. Keys not
+// present in results are kept, as their protocol may merely not have been due,
+// and are removed by forgetTimeouts once no longer probed. If exemplars is true
+// RTT samples carry an exemplar holding the result's ID.
+func resultsToPromTimeSeries(results []result, instance string, timeouts map[resultKey]uint64, exemplars bool) []prompb.TimeSeries {
 	all := make([]prompb.TimeSeries, 0, len(results)*2)
-	seenKeys := make(map[resultKey]bool)
 	for _, r := range results {
 		timeoutsCount := timeouts[r.key] // a non-existent key will return a zero val
-		seenKeys[r.key] = true
-		rttLabels := timeSeriesLabels(rttMetricName, r.key.meta, instance, r.key.timestampSource, r.key.connStability, r.key.protocol, r.key.dstPort)
+		name := rttMetricName
+		if r.first {
+			name = firstRTTMetricName
+		}
+		rttLabels := resultKeyLabels(name, r.key, instance)
 		rttSamples := make([]prompb.Sample, 1)
 		rttSamples[0].Timestamp = r.at.UnixMilli()
 		if r.rtt != nil {
@@ -808,9 +1189,12 @@ func resultsToPromTimeSeries(results []result, instance string, timeouts map[res
 			Labels:  rttLabels,
 			Samples: rttSamples,
 		}
+		if exemplars {
+			rttTS.Exemplars = rttExemplars(r)
+		}
 		all = append(all, rttTS)
 		timeouts[r.key] = timeoutsCount
-		timeoutsLabels := timeSeriesLabels(timeoutsMetricName, r.key.meta, instance, r.key.timestampSource, r.key.connStability, r.key.protocol, r.key.dstPort)
+		timeoutsLabels := resultKeyLabels(timeoutsMetricName, r.key, instance)
 		timeoutsSamples := make([]prompb.Sample, 1)
 		timeoutsSamples[0].Timestamp = r.at.UnixMilli()
 		timeoutsSamples[0].Value = float64(timeoutsCount)
@@ -819,18 +1203,41 @@ func resultsToPromTimeSeries(results []result, instance string, timeouts map[res
 			Samples: timeoutsSamples,
 		}
 		all = append(all, timeoutsTS)
+		if r.rtt != nil && r.userspaceRTT != nil {
+			all = append(all, prompb.TimeSeries{
+				Labels: resultKeyLabels(userspaceErrMetricName, r.key, instance),
+				Samples: []prompb.Sample{
+					{
+						Timestamp: r.at.UnixMilli(),
+						Value:     float64(*r.userspaceRTT - *r.rtt),
+					},
+				},
+			})
+		}
 	}
+	return all
+}
+
+// forgetTimeouts removes the timeout counts of keys whose target is no longer
+// in targets, or no longer probed on the key's protocol and destination port
+// per portsOf.
+func forgetTimeouts(timeouts map[resultKey]uint64, targets map[netip.Addr]nodeMeta, portsOf func(nodeMeta) map[protocol][]int) {
 	for k := range timeouts {
-		if !seenKeys[k] {
+		m, ok := targets[k.meta.addr]
+		if !ok || m != k.meta || !slices.Contains(portsOf(m)[k.protocol], k.dstPort) {
 			delete(timeouts, k)
 		}
 	}
-	return all
 }
 
 type remoteWriteClient struct {
 	c   *http.Client
 	url string
+	// labels are added to every timeseries written, e.g. the netns label of
+	// children of runNetnsSupervisor.
+	labels []prompb.Label
+	// privacy anonymizes the addresses in labels written, if non-nil.
+	privacy *ipPrivacy
 }
 
 type recoverableErr struct {
@@ -847,6 +1254,17 @@ func newRemoteWriteClient(url string) *remoteWriteClient {
 }
 
 func (r *remoteWriteClient) write(ctx context.Context, ts []prompb.TimeSeries) error {
+	if len(r.labels) > 0 {
+		labeled := make([]prompb.TimeSeries, len(ts))
+		for i, t := range ts {
+			t.Labels = append(slices.Clip(t.Labels), r.labels...)
+			labeled[i] = t
+		}
+		ts = labeled
+	}
+	if r.privacy != nil {
+		ts = r.privacy.timeSeries(ts)
+	}
 	wr := &prompb.WriteRequest{
 		Timeseries: ts,
 	}
@@ -876,32 +1294,6 @@ func (r *remoteWriteClient) write(ctx context.Context, ts []prompb.TimeSeries) e
 	return err
 }
 
-func remoteWriteTimeSeries(client *remoteWriteClient, tsCh chan []prompb.TimeSeries) {
-	bo := backoff.NewBackoff("remote-write", log.Printf, time.Second*30)
-	// writeErr may contribute to bo's backoff schedule across tsCh read ops,
-	// i.e. if an unrecoverable error occurs for client.write(ctx, A), that
-	// should be accounted against bo prior to attempting to
-	// client.write(ctx, B).
-	var writeErr error
-	for ts := range tsCh {
-		for {
-			bo.BackOff(context.Background(), writeErr)
-			reqCtx, cancel := context.WithTimeout(context.Background(), time.Second*30)
-			writeErr = client.write(reqCtx, ts)
-			cancel()
-			var re recoverableErr
-			recoverable := errors.As(writeErr, &re)
-			if writeErr != nil {
-				log.Printf("remote write error(recoverable=%v): %v", recoverable, writeErr)
-			}
-			if !recoverable {
-				// a nil err is not recoverable
-				break
-			}
-		}
-	}
-}
-
 func getPortsFromFlag(f string) ([]int, error) {
 	if len(f) == 0 {
 		return nil, nil
@@ -921,191 +1313,136 @@ func getPortsFromFlag(f string) ([]int, error) {
 }
 
 func main() {
-	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
-		log.Fatal("unsupported platform")
-	}
 	flag.Parse()
 
-	portsByProtocol := make(map[protocol][]int)
-	stunPorts, err := getPortsFromFlag(*flagSTUNDstPorts)
-	if err != nil {
-		log.Fatalf("invalid stun-dst-ports flag value: %v", err)
-	}
-	if len(stunPorts) > 0 {
-		portsByProtocol[protocolSTUN] = stunPorts
+	slog.SetDefault(slog.New(baseLogHandler))
+	levels, err := parseLogLevels(*flagLogLevels)
+	if err == nil {
+		err = setLogLevels(levels)
 	}
-	httpsPorts, err := getPortsFromFlag(*flagHTTPSDstPorts)
 	if err != nil {
-		log.Fatalf("invalid https-dst-ports flag value: %v", err)
+		log.Fatalf("invalid log-levels flag value: %v", err)
 	}
-	if len(httpsPorts) > 0 {
-		portsByProtocol[protocolHTTPS] = httpsPorts
+
+	if len(*flagInstance) < 1 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("failed to get hostname: %v", err)
+		}
+		*flagInstance = hostname
 	}
-	tcpPorts, err := getPortsFromFlag(*flagTCPDstPorts)
-	if err != nil {
-		log.Fatalf("invalid tcp-dst-ports flag value: %v", err)
+
+	if *flagPrintSchema {
+		if err := runPrintSchema(os.Stdout); err != nil {
+			log.Fatalf("error printing schema: %v", err)
+		}
+		return
 	}
-	if len(tcpPorts) > 0 {
-		portsByProtocol[protocolTCP] = tcpPorts
+
+	if flag.Arg(0) == "report" {
+		if err := runReport(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("error generating report: %v", err)
+		}
+		return
 	}
-	if *flagICMP {
-		portsByProtocol[protocolICMP] = []int{0}
+	if flag.Arg(0) == "simulate" {
+		if err := runSimulate(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("error simulating: %v", err)
+		}
+		return
 	}
-	if len(portsByProtocol) == 0 {
-		log.Fatal("nothing to probe")
+	if flag.Arg(0) == "bundle" {
+		if err := runBundle(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("error bundling: %v", err)
+		}
+		return
 	}
-
-	if len(*flagDERPMap) < 1 {
-		log.Fatal("derp-map flag is unset")
+	if flag.Arg(0) == "slo-report" {
+		if err := runSLOReport(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("error generating SLO report: %v", err)
+		}
+		return
 	}
-	if *flagInterval < minInterval || *flagInterval > maxBufferDuration {
-		log.Fatalf("interval must be >= %s and <= %s", minInterval, maxBufferDuration)
+	if flag.Arg(0) == "targets" {
+		if err := runTargets(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("targets: %v", err)
+		}
+		return
 	}
-	if len(*flagRemoteWriteURL) < 1 {
-		log.Fatal("rw-url flag is unset")
+	if flag.Arg(0) == "completion" {
+		if err := runCompletion(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("completion: %v", err)
+		}
+		return
 	}
-	_, err = url.Parse(*flagRemoteWriteURL)
-	if err != nil {
-		log.Fatalf("invalid rw-url flag value: %v", err)
+	if flag.Arg(0) == "scaffold" {
+		if err := runScaffold(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("scaffold: %v", err)
+		}
+		return
 	}
-	if len(*flagInstance) < 1 {
-		hostname, err := os.Hostname()
-		if err != nil {
-			log.Fatalf("failed to get hostname: %v", err)
+	if flag.Arg(0) == "loaded-latency" {
+		if err := runLoadedLatency(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("loaded-latency: %v", err)
 		}
-		*flagInstance = hostname
+		return
 	}
-
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	dmCh := make(chan *tailcfg.DERPMap)
-
-	go func() {
-		bo := backoff.NewBackoff("derp-map", log.Printf, time.Second*30)
-		for {
-			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-			dm, err := getDERPMap(ctx, *flagDERPMap)
-			cancel()
-			bo.BackOff(context.Background(), err)
-			if err != nil {
-				continue
-			}
-			dmCh <- dm
-			return
+	if flag.Arg(0) == "config" {
+		if err := runConfig(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("config: %v", err)
 		}
-	}()
-
-	nodeMetaByAddr := make(map[netip.Addr]nodeMeta)
-	select {
-	case <-sigCh:
 		return
-	case dm := <-dmCh:
-		_, err := nodeMetaFromDERPMap(dm, nodeMetaByAddr, *flagIPv6)
-		if err != nil {
-			log.Fatalf("error parsing derp map on startup: %v", err)
+	}
+	if flag.Arg(0) == "db" {
+		if err := runDB(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("db: %v", err)
 		}
+		return
 	}
 
-	tsCh := make(chan []prompb.TimeSeries, maxBufferDuration / *flagInterval)
-	remoteWriteDoneCh := make(chan struct{})
-	rwc := newRemoteWriteClient(*flagRemoteWriteURL)
-	go func() {
-		remoteWriteTimeSeries(rwc, tsCh)
-		close(remoteWriteDoneCh)
-	}()
+	if len(*flagAnnotate) > 0 {
+		if len(*flagHTTPAddr) < 1 {
+			log.Fatal("annotate requires the http-addr flag")
+		}
+		if err := runAnnotate(*flagHTTPAddr, *flagAnnotate, *flagAnnotateFrom, *flagAnnotateTo, *flagAnnotateHost); err != nil {
+			log.Fatalf("error adding annotation: %v", err)
+		}
+		return
+	}
 
-	shutdown := func() {
-		close(tsCh)
-		select {
-		case <-time.After(time.Second * 10): // give goroutine some time to flush
-		case <-remoteWriteDoneCh:
+	if *flagReadOnly {
+		if len(*flagStoreDir) < 1 || len(*flagHTTPAddr) < 1 {
+			log.Fatal("read-only mode requires store-dir and http-addr flags")
 		}
+		runReadOnly(*flagStoreDir, *flagHTTPAddr, *flagInstance)
+		return
+	}
 
-		// send stale markers on shutdown
-		staleMeta := make([]nodeMeta, 0, len(nodeMetaByAddr))
-		for _, v := range nodeMetaByAddr {
-			staleMeta = append(staleMeta, v)
+	// netns is the network namespace probed from if this is a child of
+	// runNetnsSupervisor.
+	netns := os.Getenv(netnsEnv)
+	if len(*flagNetns) > 0 && netns == "" {
+		names, err := parseNetnsFlag(*flagNetns)
+		if err != nil {
+			log.Fatalf("invalid netns flag value: %v", err)
 		}
-		staleMarkers := staleMarkersFromNodeMeta(staleMeta, *flagInstance, portsByProtocol)
-		if len(staleMarkers) > 0 {
-			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-			rwc.write(ctx, staleMarkers)
-			cancel()
+		if err := runNetnsSupervisor(names, *flagStoreDir, storeLayout(*flagStoreLayout), *flagHTTPAddr, *flagInstance); err != nil {
+			log.Fatalf("error supervising network namespaces: %v", err)
 		}
-
 		return
 	}
 
-	log.Println("stunstamp started")
-
-	// Re-using sockets means we get the same 5-tuple across runs. This results
-	// in a higher probability of the packets traversing the same underlay path.
-	// Comparison of stable and unstable 5-tuple results can shed light on
-	// differences between paths where hashing (multipathing/load balancing)
-	// comes into play. The inner 2 element array index is timestampSource.
-	stableConns := make(map[stableConnKey][2]*connAndMeasureFn)
-
-	// timeouts holds counts of timeout events. Values are persisted for the
-	// lifetime of the related node in the DERP map.
-	timeouts := make(map[resultKey]uint64)
-
-	derpMapTicker := time.NewTicker(time.Minute * 5)
-	defer derpMapTicker.Stop()
-	probeTicker := time.NewTicker(*flagInterval)
-	defer probeTicker.Stop()
-
-	for {
-		select {
-		case <-probeTicker.C:
-			results, err := probeNodes(nodeMetaByAddr, stableConns, portsByProtocol)
-			if err != nil {
-				log.Printf("unrecoverable error while probing: %v", err)
-				shutdown()
-				return
-			}
-			ts := resultsToPromTimeSeries(results, *flagInstance, timeouts)
-			select {
-			case tsCh <- ts:
-			default:
-				select {
-				case <-tsCh:
-					log.Println("prometheus remote-write buffer full, dropped measurements")
-				default:
-					tsCh <- ts
-				}
-			}
-		case dm := <-dmCh:
-			staleMeta, err := nodeMetaFromDERPMap(dm, nodeMetaByAddr, *flagIPv6)
-			if err != nil {
-				log.Printf("error parsing DERP map, continuing with stale map: %v", err)
-				continue
-			}
-			staleMarkers := staleMarkersFromNodeMeta(staleMeta, *flagInstance, portsByProtocol)
-			if len(staleMarkers) < 1 {
-				continue
-			}
-			select {
-			case tsCh <- staleMarkers:
-			default:
-				select {
-				case <-tsCh:
-					log.Println("prometheus remote-write buffer full, dropped measurements")
-				default:
-					tsCh <- staleMarkers
-				}
-			}
-		case <-derpMapTicker.C:
-			go func() {
-				ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-				defer cancel()
-				updatedDM, err := getDERPMap(ctx, *flagDERPMap)
-				if err == nil {
-					dmCh <- updatedDM
-				}
-			}()
-		case <-sigCh:
-			shutdown()
-			return
+	p, err := newProber(netns)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *flagCheckConfig {
+		if err := p.checkConfig(); err != nil {
+			log.Fatalf("check-config: %v", err)
 		}
+		return
 	}
+	p.start()
+	defer p.close()
+	p.run()
 }
@@ -0,0 +1,13 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+// platformTimestampProviders returns the providers of darwin, where kernel
+// timestamps are limited to TCP RTTs from TCP_CONNECTION_INFO.
+func platformTimestampProviders() [2]timestampProvider {
+	return [2]timestampProvider{
+		timestampSourceUserspace: userspaceProvider{},
+		timestampSourceKernel:    tcpInfoProvider{},
+	}
+}
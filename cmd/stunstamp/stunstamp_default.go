@@ -6,60 +6,90 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/netip"
+	"os/exec"
 	"time"
 )
 
-func getUDPConnKernelTimestamp() (io.ReadWriteCloser, error) {
-	return nil, errors.New("unimplemented")
-}
-
-func measureSTUNRTTKernel(conn io.ReadWriteCloser, hostname string, dst netip.AddrPort) (rtt time.Duration, err error) {
-	return 0, errors.New("unimplemented")
-}
-
-func getProtocolSupportInfo(p protocol) protocolSupportInfo {
-	switch p {
-	case protocolSTUN:
-		return protocolSupportInfo{
-			kernelTS:    false,
-			userspaceTS: true,
-			stableConn:  true,
-		}
-	case protocolHTTPS:
-		return protocolSupportInfo{
-			kernelTS:    false,
-			userspaceTS: true,
-			stableConn:  true,
-		}
-	case protocolTCP:
-		return protocolSupportInfo{
-			kernelTS:    true,
-			userspaceTS: false,
-			stableConn:  true,
-		}
-	case protocolICMP:
-		return protocolSupportInfo{
-			kernelTS:    false,
-			userspaceTS: false,
-			stableConn:  false,
-		}
+func getICMPConn(forDst netip.Addr, source timestampSource, ident int) (io.ReadWriteCloser, error) {
+	return nil, fmt.Errorf("ICMP datagram sockets: %w", errors.ErrUnsupported)
+}
+
+func mkICMPMeasureFn(source timestampSource) measureFn {
+	return func(ctx context.Context, conn io.ReadWriteCloser, hostname string, dst netip.AddrPort) (m measurement, err error) {
+		return measurement{}, errors.New("platform unsupported")
 	}
-	return protocolSupportInfo{}
 }
 
-func getICMPConn(forDst netip.Addr, source timestampSource) (io.ReadWriteCloser, error) {
-	return nil, errors.New("platform unsupported")
+func setSOReuseAddr(fd uintptr) error {
+	return nil
 }
 
-func mkICMPMeasureFn(source timestampSource) measureFn {
-	return func(conn io.ReadWriteCloser, hostname string, dst netip.AddrPort) (rtt time.Duration, err error) {
-		return 0, errors.New("platform unsupported")
+func crossTalkCount() (uint64, bool) {
+	return 0, false
+}
+
+func getRXStats() (rxStats, bool) {
+	return rxStats{}, false
+}
+
+func measureHopCount(ctx context.Context, dst netip.Addr) (int, error) {
+	return 0, errors.New("platform unsupported")
+}
+
+func setDontFragment(c *net.UDPConn, df bool) error {
+	if df {
+		return errors.ErrUnsupported
 	}
+	return nil
 }
 
-func setSOReuseAddr(fd uintptr) error {
+func setSocketMark(c *net.UDPConn, mark int) error {
+	if mark != 0 {
+		return errors.ErrUnsupported
+	}
+	return nil
+}
+
+type rawProber struct{}
+
+func newRawProber(ifName, nextHopMAC string) (*rawProber, error) {
+	return nil, errors.New("platform unsupported")
+}
+
+func (r *rawProber) connAndMeasureFn(proto protocol) *connAndMeasureFn {
 	return nil
 }
+
+func (r *rawProber) measureIPIDs(ctx context.Context, dst netip.AddrPort) ([2]uint16, error) {
+	return [2]uint16{}, errors.New("platform unsupported")
+}
+
+func tcpMSS(c *net.TCPConn) (int, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func polledConnLocalPort(conn io.ReadWriteCloser) int {
+	return 0
+}
+
+func detectPrivileges() []privilege {
+	return nil
+}
+
+func processCPUTime() (time.Duration, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func fdUsage() (open, limit int, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
+
+func startInNetns(cmd *exec.Cmd, name string) error {
+	return errors.New("platform unsupported")
+}
@@ -6,8 +6,6 @@
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -16,62 +14,47 @@
 	"syscall"
 	"time"
 
-	"github.com/mdlayher/socket"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 	"golang.org/x/sys/unix"
+	"tailscale.com/net/ktimestamp"
 	"tailscale.com/net/stun"
 )
 
-const (
-	timestampingFlags = unix.SOF_TIMESTAMPING_TX_SOFTWARE | // tx timestamp generation in device driver
-		unix.SOF_TIMESTAMPING_RX_SOFTWARE | // rx timestamp generation in the kernel
-		unix.SOF_TIMESTAMPING_SOFTWARE // report software timestamps
-)
-
-func getUDPConnKernelTimestamp() (io.ReadWriteCloser, error) {
-	sconn, err := socket.Socket(unix.AF_INET6, unix.SOCK_DGRAM, unix.IPPROTO_UDP, "udp", nil)
+func getUDPConnKernelTimestamp(lport int) (io.ReadWriteCloser, error) {
+	pconn, err := newPolledConn(unix.AF_INET6, unix.SOCK_DGRAM, unix.IPPROTO_UDP, protocolSTUN)
 	if err != nil {
 		return nil, err
 	}
-	sa := unix.SockaddrInet6{}
-	err = sconn.Bind(&sa)
+	sa := unix.SockaddrInet6{Port: lport}
+	err = unix.Bind(pconn.fd, &sa)
 	if err != nil {
+		pconn.Close()
 		return nil, err
 	}
-	err = sconn.SetsockoptInt(unix.SOL_SOCKET, unix.SO_TIMESTAMPING_NEW, timestampingFlags)
+	err = ktimestamp.SetTimestamping(pconn.fd, ktimestamp.Flags)
 	if err != nil {
+		pconn.Close()
 		return nil, err
 	}
-	return sconn, nil
-}
-
-func parseTimestampFromCmsgs(oob []byte) (time.Time, error) {
-	msgs, err := unix.ParseSocketControlMessage(oob)
-	if err != nil {
-		return time.Time{}, fmt.Errorf("error parsing oob as cmsgs: %w", err)
-	}
-	for _, msg := range msgs {
-		if msg.Header.Level == unix.SOL_SOCKET && msg.Header.Type == unix.SO_TIMESTAMPING_NEW && len(msg.Data) >= 16 {
-			sec := int64(binary.NativeEndian.Uint64(msg.Data[:8]))
-			ns := int64(binary.NativeEndian.Uint64(msg.Data[8:16]))
-			return time.Unix(sec, ns), nil
-		}
+	if err := enableECN(pconn.fd, unix.AF_INET6); err != nil {
+		pconn.Close()
+		return nil, fmt.Errorf("error enabling ECN: %w", err)
 	}
-	return time.Time{}, errors.New("failed to parse timestamp from cmsgs")
+	return pconn, nil
 }
 
 func mkICMPMeasureFn(source timestampSource) measureFn {
-	return func(conn io.ReadWriteCloser, hostname string, dst netip.AddrPort) (rtt time.Duration, err error) {
-		return measureICMPRTT(source, conn, hostname, dst)
+	return func(ctx context.Context, conn io.ReadWriteCloser, hostname string, dst netip.AddrPort) (m measurement, err error) {
+		return measureICMPRTT(ctx, source, conn, hostname, dst)
 	}
 }
 
-func measureICMPRTT(source timestampSource, conn io.ReadWriteCloser, _ string, dst netip.AddrPort) (rtt time.Duration, err error) {
-	sconn, ok := conn.(*socket.Conn)
+func measureICMPRTT(ctx context.Context, source timestampSource, conn io.ReadWriteCloser, _ string, dst netip.AddrPort) (m measurement, err error) {
+	pconn, ok := conn.(*polledConn)
 	if !ok {
-		return 0, fmt.Errorf("conn of unexpected type: %T", conn)
+		return measurement{}, fmt.Errorf("conn of unexpected type: %T", conn)
 	}
 	txBody := &icmp.Echo{
 		// The kernel overrides this and routes appropriately so there is no
@@ -98,95 +81,96 @@ func measureICMPRTT(source timestampSource, conn io.ReadWriteCloser, _ string, d
 	}
 	txBuf, err := txMsg.Marshal(nil)
 	if err != nil {
-		return 0, err
+		return measurement{}, err
 	}
-	txAt := time.Now()
-	err = sconn.Sendto(context.Background(), txBuf, 0, to)
-	if err != nil {
-		return 0, fmt.Errorf("sendto error: %v", err)
-	}
-
-	if source == timestampSourceKernel {
-		txCtx, txCancel := context.WithTimeout(context.Background(), txRxTimeout)
-		defer txCancel()
 
-		buf := make([]byte, 1024)
-		oob := make([]byte, 1024)
-
-		for {
-			n, oobn, _, _, err := sconn.Recvmsg(txCtx, buf, oob, unix.MSG_ERRQUEUE)
-			if err != nil {
-				return 0, fmt.Errorf("recvmsg (MSG_ERRQUEUE) error: %v", err) // don't wrap
-			}
-
-			buf = buf[:n]
-			// Spin until we find the message we sent. We get the full packet
-			// looped including eth header so match against the tail.
-			if n < len(txBuf) {
-				continue
-			}
-			txLoopedMsg, err := icmp.ParseMessage(txMsg.Type.Protocol(), buf[len(buf)-len(txBuf):])
-			if err != nil {
-				continue
-			}
-			txLoopedBody, ok := txLoopedMsg.Body.(*icmp.Echo)
-			if !ok || txLoopedBody.Seq != txBody.Seq || txLoopedMsg.Code != txMsg.Code ||
-				txLoopedMsg.Type != txLoopedMsg.Type || !bytes.Equal(txLoopedBody.Data, txBody.Data) {
-				continue
-			}
-			txAt, err = parseTimestampFromCmsgs(oob[:oobn])
-			if err != nil {
-				return 0, fmt.Errorf("failed to get tx timestamp: %v", err) // don't wrap
-			}
-			break
+	// We get the full packet looped including eth header so match against
+	// the tail.
+	txMatch := func(b []byte) bool {
+		if len(b) < len(txBuf) {
+			return false
 		}
-	}
-
-	rxCtx, rxCancel := context.WithTimeout(context.Background(), txRxTimeout)
-	defer rxCancel()
-
-	rxBuf := make([]byte, 1024)
-	oob := make([]byte, 1024)
-	for {
-		n, oobn, _, _, err := sconn.Recvmsg(rxCtx, rxBuf, oob, 0)
+		txLoopedMsg, err := icmp.ParseMessage(txMsg.Type.Protocol(), b[len(b)-len(txBuf):])
 		if err != nil {
-			return 0, fmt.Errorf("recvmsg error: %w", err)
+			return false
 		}
-		rxAt := time.Now()
-		rxMsg, err := icmp.ParseMessage(txMsg.Type.Protocol(), rxBuf[:n])
+		txLoopedBody, ok := txLoopedMsg.Body.(*icmp.Echo)
+		return ok && txLoopedBody.Seq == txBody.Seq && txLoopedMsg.Code == txMsg.Code &&
+			txLoopedMsg.Type == txMsg.Type && bytes.Equal(txLoopedBody.Data, txBody.Data)
+	}
+	rxMatch := func(b []byte) bool {
+		rxMsg, err := icmp.ParseMessage(txMsg.Type.Protocol(), b)
 		if err != nil {
-			continue
+			return false
 		}
 		if txMsg.Type == ipv4.ICMPTypeEcho {
 			if rxMsg.Type != ipv4.ICMPTypeEchoReply {
-				continue
+				return false
 			}
 		} else {
 			if rxMsg.Type != ipv6.ICMPTypeEchoReply {
-				continue
+				return false
 			}
 		}
 		if rxMsg.Code != txMsg.Code {
-			continue
+			return false
 		}
 		rxBody, ok := rxMsg.Body.(*icmp.Echo)
-		if !ok || rxBody.Seq != txBody.Seq || !bytes.Equal(rxBody.Data, txBody.Data) {
-			continue
+		return ok && rxBody.Seq == txBody.Seq && bytes.Equal(rxBody.Data, txBody.Data)
+	}
+
+	var txWaiter *rxWaiter
+	if source == timestampSourceKernel {
+		txWaiter = pconn.poller.register(pconn, true, txMatch)
+		defer pconn.poller.unregister(txWaiter)
+	}
+	rxWaiter := pconn.poller.register(pconn, false, rxMatch)
+	defer pconn.poller.unregister(rxWaiter)
+
+	txAt := time.Now()
+	err = pconn.sendto(txBuf, to)
+	if err != nil {
+		return measurement{}, fmt.Errorf("sendto error: %v", err)
+	}
+	userspaceTxAt := txAt
+
+	if source == timestampSourceKernel {
+		txCtx, txCancel := context.WithTimeout(ctx, txRxTimeout)
+		defer txCancel()
+		msg, err := txWaiter.wait(txCtx)
+		if err != nil {
+			return measurement{}, fmt.Errorf("MSG_ERRQUEUE wait error: %v", err) // don't wrap
 		}
-		if source == timestampSourceKernel {
-			rxAt, err = parseTimestampFromCmsgs(oob[:oobn])
-			if err != nil {
-				return 0, fmt.Errorf("failed to get rx timestamp: %v", err)
-			}
+		txAt, err = ktimestamp.ParseTimestamp(msg.oob)
+		if err != nil {
+			return measurement{}, fmt.Errorf("failed to get tx timestamp: %v", err) // don't wrap
 		}
-		return rxAt.Sub(txAt), nil
 	}
+
+	rxCtx, rxCancel := context.WithTimeout(ctx, txRxTimeout)
+	defer rxCancel()
+	msg, err := rxWaiter.wait(rxCtx)
+	if err != nil {
+		return measurement{}, fmt.Errorf("rx wait error: %w", err)
+	}
+	if source == timestampSourceUserspace {
+		return measurement{rtt: msg.at.Sub(txAt), ecn: parseECNFromCmsgs(msg.oob)}, nil
+	}
+	rxAt, err := ktimestamp.ParseTimestamp(msg.oob)
+	if err != nil {
+		return measurement{}, fmt.Errorf("failed to get rx timestamp: %v", err)
+	}
+	return measurement{
+		rtt:          rxAt.Sub(txAt),
+		userspaceRTT: msg.at.Sub(userspaceTxAt),
+		ecn:          parseECNFromCmsgs(msg.oob),
+	}, nil
 }
 
-func measureSTUNRTTKernel(conn io.ReadWriteCloser, _ string, dst netip.AddrPort) (rtt time.Duration, err error) {
-	sconn, ok := conn.(*socket.Conn)
+func measureSTUNRTTKernel(ctx context.Context, conn io.ReadWriteCloser, _ string, dst netip.AddrPort) (m measurement, err error) {
+	pconn, ok := conn.(*polledConn)
 	if !ok {
-		return 0, fmt.Errorf("conn of unexpected type: %T", conn)
+		return measurement{}, fmt.Errorf("conn of unexpected type: %T", conn)
 	}
 
 	var to unix.Sockaddr
@@ -205,113 +189,164 @@ func measureSTUNRTTKernel(conn io.ReadWriteCloser, _ string, dst netip.AddrPort)
 	txID := stun.NewTxID()
 	req := stun.Request(txID)
 
-	err = sconn.Sendto(context.Background(), req, 0, to)
+	txWaiter := pconn.poller.register(pconn, true, func(b []byte) bool {
+		// We get the full packet looped including eth header so match
+		// against the tail.
+		return len(b) >= len(req) && bytes.Equal(req, b[len(b)-len(req):])
+	})
+	defer pconn.poller.unregister(txWaiter)
+	rxWaiter := pconn.poller.register(pconn, false, func(b []byte) bool {
+		// We may receive extremely late arriving responses from previous
+		// intervals. The poller accounts those as cross-talk when they match
+		// no outstanding txID.
+		gotTxID, _, err := stun.ParseResponse(b)
+		return err == nil && gotTxID == txID
+	})
+	defer pconn.poller.unregister(rxWaiter)
+
+	userspaceTxAt := time.Now()
+	err = pconn.sendto(req, to)
 	if err != nil {
-		return 0, fmt.Errorf("sendto error: %v", err) // don't wrap
+		return measurement{}, fmt.Errorf("sendto error: %v", err) // don't wrap
 	}
 
-	txCtx, txCancel := context.WithTimeout(context.Background(), txRxTimeout)
+	txCtx, txCancel := context.WithTimeout(ctx, txRxTimeout)
 	defer txCancel()
-
-	buf := make([]byte, 1024)
-	oob := make([]byte, 1024)
-	var txAt time.Time
-
-	for {
-		n, oobn, _, _, err := sconn.Recvmsg(txCtx, buf, oob, unix.MSG_ERRQUEUE)
-		if err != nil {
-			return 0, fmt.Errorf("recvmsg (MSG_ERRQUEUE) error: %v", err) // don't wrap
-		}
-
-		buf = buf[:n]
-		if n < len(req) || !bytes.Equal(req, buf[len(buf)-len(req):]) {
-			// Spin until we find the message we sent. We get the full packet
-			// looped including eth header so match against the tail.
-			continue
-		}
-		txAt, err = parseTimestampFromCmsgs(oob[:oobn])
-		if err != nil {
-			return 0, fmt.Errorf("failed to get tx timestamp: %v", err) // don't wrap
-		}
-		break
+	msg, err := txWaiter.wait(txCtx)
+	if err != nil {
+		return measurement{}, fmt.Errorf("MSG_ERRQUEUE wait error: %v", err) // don't wrap
+	}
+	txAt, err := ktimestamp.ParseTimestamp(msg.oob)
+	if err != nil {
+		return measurement{}, fmt.Errorf("failed to get tx timestamp: %v", err) // don't wrap
 	}
 
-	rxCtx, rxCancel := context.WithTimeout(context.Background(), txRxTimeout)
+	rxCtx, rxCancel := context.WithTimeout(ctx, txRxTimeout)
 	defer rxCancel()
-
-	for {
-		n, oobn, _, _, err := sconn.Recvmsg(rxCtx, buf, oob, 0)
-		if err != nil {
-			return 0, fmt.Errorf("recvmsg error: %w", err) // wrap for timeout-related error unwrapping
-		}
-
-		gotTxID, _, err := stun.ParseResponse(buf[:n])
-		if err != nil || gotTxID != txID {
-			// Spin until we find the txID we sent. We may end up reading
-			// extremely late arriving responses from previous intervals. As
-			// such, we can't be certain if we're parsing the "current"
-			// response, so spin for parse errors too.
-			continue
-		}
-
-		rxAt, err := parseTimestampFromCmsgs(oob[:oobn])
-		if err != nil {
-			return 0, fmt.Errorf("failed to get rx timestamp: %v", err) // don't wrap
-		}
-
-		return rxAt.Sub(txAt), nil
+	msg, err = rxWaiter.wait(rxCtx)
+	if err != nil {
+		return measurement{}, fmt.Errorf("rx wait error: %w", err) // wrap for timeout-related error unwrapping
 	}
-
+	rxAt, err := ktimestamp.ParseTimestamp(msg.oob)
+	if err != nil {
+		return measurement{}, fmt.Errorf("failed to get rx timestamp: %v", err) // don't wrap
+	}
+	_, mapped, _ := stun.ParseResponse(msg.b)
+	return measurement{
+		rtt:          rxAt.Sub(txAt),
+		userspaceRTT: msg.at.Sub(userspaceTxAt),
+		mappedAddr:   mapped,
+		instance:     stunResponseInstance(msg.b),
+		stunResponse: sampledSTUNResponse(ctx, msg.b),
+		ecn:          parseECNFromCmsgs(msg.oob),
+	}, nil
 }
 
-func getICMPConn(forDst netip.Addr, source timestampSource) (io.ReadWriteCloser, error) {
+// getICMPConn returns an ICMP datagram ("ping") socket. A nonzero ident is
+// bound as its echo identifier.
+func getICMPConn(forDst netip.Addr, source timestampSource, ident int) (io.ReadWriteCloser, error) {
 	domain := unix.AF_INET
 	proto := unix.IPPROTO_ICMP
+	var sa unix.Sockaddr = &unix.SockaddrInet4{Port: ident}
 	if forDst.Is6() {
 		domain = unix.AF_INET6
 		proto = unix.IPPROTO_ICMPV6
+		sa = &unix.SockaddrInet6{Port: ident}
 	}
-	conn, err := socket.Socket(domain, unix.SOCK_DGRAM, proto, "icmp", nil)
+	conn, err := newPolledConn(domain, unix.SOCK_DGRAM, proto, protocolICMP)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error creating ICMP datagram socket: %w", err)
+	}
+	if ident != 0 {
+		if err := unix.Bind(conn.fd, sa); err != nil {
+			conn.Close()
+			return nil, err
+		}
 	}
 	if source == timestampSourceKernel {
-		err = conn.SetsockoptInt(unix.SOL_SOCKET, unix.SO_TIMESTAMPING_NEW, timestampingFlags)
+		err = ktimestamp.SetTimestamping(conn.fd, ktimestamp.Flags)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if err := enableECN(conn.fd, domain); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error enabling ECN: %w", err)
 	}
-	return conn, err
+	return conn, nil
 }
 
-func getProtocolSupportInfo(p protocol) protocolSupportInfo {
+func platformTimestampProviders() [2]timestampProvider {
+	return [2]timestampProvider{
+		timestampSourceUserspace: userspaceProvider{},
+		timestampSourceKernel:    kernelProvider{},
+	}
+}
+
+// kernelProvider measures RTTs with SO_TIMESTAMPING kernel timestamps, and
+// TCP RTTs as estimated by the kernel.
+type kernelProvider struct{}
+
+func (kernelProvider) source() timestampSource { return timestampSourceKernel }
+
+func (kernelProvider) supports(p protocol, stable connStability) bool {
+	switch p {
+	case protocolSTUN, protocolTCP:
+		return true
+	case protocolICMP:
+		return !bool(stable)
+	}
+	return false
+}
+
+func (kernelProvider) newConn(forDst netip.Addr, p protocol, stable connStability, lport int) (*connAndMeasureFn, error) {
 	switch p {
 	case protocolSTUN:
-		return protocolSupportInfo{
-			kernelTS:    true,
-			userspaceTS: true,
-			stableConn:  true,
-		}
-	case protocolHTTPS:
-		return protocolSupportInfo{
-			kernelTS:    false,
-			userspaceTS: true,
-			stableConn:  true,
-		}
-	case protocolTCP:
-		return protocolSupportInfo{
-			kernelTS:    true,
-			userspaceTS: false,
-			stableConn:  true,
+		conn, err := getUDPConnKernelTimestamp(lport)
+		if err != nil {
+			return nil, err
 		}
+		return &connAndMeasureFn{
+			conn: conn,
+			fn:   measureSTUNRTTKernel,
+		}, nil
 	case protocolICMP:
-		return protocolSupportInfo{
-			kernelTS:    true,
-			userspaceTS: true,
-			stableConn:  false,
+		conn, err := getICMPConn(forDst, timestampSourceKernel, lport)
+		if err != nil {
+			return nil, err
 		}
+		return &connAndMeasureFn{
+			conn: conn,
+			fn:   mkICMPMeasureFn(timestampSourceKernel),
+		}, nil
+	case protocolTCP:
+		return newLportConnAndMeasureFn(stable, lport, measureTCPRTT), nil
 	}
-	return protocolSupportInfo{}
+	return nil, nil
 }
 
 func setSOReuseAddr(fd uintptr) error {
 	// we may restart faster than TIME_WAIT can clear
 	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
 }
+
+// polledConnLocalPort returns the local port (or ICMP identifier) conn is
+// bound to, or zero if conn is not a *polledConn or is unbound.
+func polledConnLocalPort(conn io.ReadWriteCloser) int {
+	pconn, ok := conn.(*polledConn)
+	if !ok {
+		return 0
+	}
+	sa, err := unix.Getsockname(pconn.fd)
+	if err != nil {
+		return 0
+	}
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return sa.Port
+	case *unix.SockaddrInet6:
+		return sa.Port
+	}
+	return 0
+}
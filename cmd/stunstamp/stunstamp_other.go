@@ -0,0 +1,14 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux && !darwin && !windows
+
+package main
+
+// platformTimestampProviders returns the providers of platforms without
+// kernel timestamps, on which only userspace timestamps are available.
+func platformTimestampProviders() [2]timestampProvider {
+	return [2]timestampProvider{
+		timestampSourceUserspace: userspaceProvider{},
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+// platformTimestampProviders returns the providers of windows, where kernel
+// timestamps are limited to TCP RTTs from SIO_TCP_INFO, available since
+// Windows 10 1703. Unprivileged ICMP sockets are unavailable.
+func platformTimestampProviders() [2]timestampProvider {
+	return [2]timestampProvider{
+		timestampSourceUserspace: userspaceProvider{},
+		timestampSourceKernel:    tcpInfoProvider{},
+	}
+}
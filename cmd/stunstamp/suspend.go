@@ -0,0 +1,25 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"time"
+)
+
+// eventKindSuspend is a detected suspension of the system, e.g. a laptop
+// sleeping, see schedule.SuspendDetector.
+const eventKindSuspend eventKind = "suspend"
+
+// suspendEvent returns an event for a suspension of suspended detected at
+// resumed.
+func suspendEvent(resumed time.Time, suspended time.Duration) event {
+	return event{
+		At:   resumed,
+		Kind: eventKindSuspend,
+		Attrs: map[string]string{
+			"suspended_at": resumed.Add(-suspended).UTC().Format(time.RFC3339),
+			"duration":     suspended.Round(time.Second).String(),
+		},
+	}
+}
@@ -0,0 +1,356 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"tailscale.com/tailcfg"
+)
+
+// targetFilter selects the DERP map nodes to probe with expressions over their
+// attributes, so that a deployment's targets are described declaratively
+// rather than by node names, which change as the DERP map is updated. A node
+// is probed if it matches any Include expression, or Include is empty, and
+// matches no Exclude expression.
+//
+// Expressions compare the attributes in targetAttrNames with ==, !=, =~ and
+// !~ (the latter two against a regular expression), and combine comparisons
+// and boolean attributes with !, &&, || and parentheses, e.g.:
+//
+//	region_code == "nyc" || hostname =~ "^derp1[0-9]"
+//	!has_ipv6
+type targetFilter struct {
+	Include []string `json:",omitempty"`
+	Exclude []string `json:",omitempty"`
+
+	include, exclude []targetExpr // parsed by validate
+}
+
+// validate parses the expressions of f.
+func (f *targetFilter) validate() error {
+	f.include, f.exclude = nil, nil
+	for _, s := range f.Include {
+		e, err := parseTargetExpr(s)
+		if err != nil {
+			return fmt.Errorf("invalid include expression %q: %w", s, err)
+		}
+		f.include = append(f.include, e)
+	}
+	for _, s := range f.Exclude {
+		e, err := parseTargetExpr(s)
+		if err != nil {
+			return fmt.Errorf("invalid exclude expression %q: %w", s, err)
+		}
+		f.exclude = append(f.exclude, e)
+	}
+	return nil
+}
+
+// equal reports whether f and o select the same nodes by construction.
+func (f *targetFilter) equal(o *targetFilter) bool {
+	if f == nil || o == nil {
+		return f == o
+	}
+	return slices.Equal(f.Include, o.Include) && slices.Equal(f.Exclude, o.Exclude)
+}
+
+// selects reports whether the node with attrs is selected by f. A nil f
+// selects every node.
+func (f *targetFilter) selects(attrs targetAttrs) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.include) > 0 && !slices.ContainsFunc(f.include, func(e targetExpr) bool { return e.eval(attrs) }) {
+		return false
+	}
+	return !slices.ContainsFunc(f.exclude, func(e targetExpr) bool { return e.eval(attrs) })
+}
+
+// apply returns dm holding only the nodes selected by f. dm is not modified.
+func (f *targetFilter) apply(dm *tailcfg.DERPMap) *tailcfg.DERPMap {
+	if f == nil {
+		return dm
+	}
+	ret := *dm
+	ret.Regions = make(map[int]*tailcfg.DERPRegion, len(dm.Regions))
+	for regionID, region := range dm.Regions {
+		r := *region
+		r.Nodes = nil
+		for _, node := range region.Nodes {
+			if f.selects(targetAttrsOf(regionID, region, node)) {
+				r.Nodes = append(r.Nodes, node)
+			}
+		}
+		ret.Regions[regionID] = &r
+	}
+	return &ret
+}
+
+// targetAttrNames are the attributes of a DERP map node expressions refer to,
+// and whether each is boolean.
+var targetAttrNames = map[string]bool{
+	"region_id":   false,
+	"region_code": false,
+	"region_name": false,
+	"hostname":    false,
+	"ipv4":        false,
+	"ipv6":        false,
+	"has_ipv6":    true,
+	"stun_only":   true,
+}
+
+// targetAttrs holds the attributes of a DERP map node by name, booleans as
+// "true" or "false".
+type targetAttrs map[string]string
+
+func targetAttrsOf(regionID int, region *tailcfg.DERPRegion, node *tailcfg.DERPNode) targetAttrs {
+	v6, err := netip.ParseAddr(node.IPv6)
+	return targetAttrs{
+		"region_id":   strconv.Itoa(regionID),
+		"region_code": region.RegionCode,
+		"region_name": region.RegionName,
+		"hostname":    node.HostName,
+		"ipv4":        node.IPv4,
+		"ipv6":        node.IPv6,
+		"has_ipv6":    strconv.FormatBool(err == nil && v6.Is6()),
+		"stun_only":   strconv.FormatBool(node.STUNOnly),
+	}
+}
+
+// targetExpr is a parsed target filter expression.
+type targetExpr interface {
+	eval(targetAttrs) bool
+}
+
+type (
+	targetOrExpr  struct{ l, r targetExpr }
+	targetAndExpr struct{ l, r targetExpr }
+	targetNotExpr struct{ e targetExpr }
+	// targetBoolExpr is a boolean attribute.
+	targetBoolExpr struct{ attr string }
+	// targetCmpExpr compares an attribute with a string, or matches it
+	// against a regular expression if re is set.
+	targetCmpExpr struct {
+		attr   string
+		value  string
+		re     *regexp.Regexp
+		negate bool
+	}
+)
+
+func (e targetOrExpr) eval(a targetAttrs) bool   { return e.l.eval(a) || e.r.eval(a) }
+func (e targetAndExpr) eval(a targetAttrs) bool  { return e.l.eval(a) && e.r.eval(a) }
+func (e targetNotExpr) eval(a targetAttrs) bool  { return !e.e.eval(a) }
+func (e targetBoolExpr) eval(a targetAttrs) bool { return a[e.attr] == "true" }
+
+func (e targetCmpExpr) eval(a targetAttrs) bool {
+	v := a[e.attr]
+	if e.re != nil {
+		return e.re.MatchString(v) != e.negate
+	}
+	return (v == e.value) != e.negate
+}
+
+// parseTargetExpr parses a target filter expression, see targetFilter. The
+// grammar is:
+//
+//	expr    = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | primary
+//	primary = "(" expr ")" | attr | attr op value
+//	op      = "==" | "!=" | "=~" | "!~"
+//
+// where values are double-quoted Go strings, or integers.
+func parseTargetExpr(s string) (targetExpr, error) {
+	toks, err := tokenizeTargetExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &targetExprParser{toks: toks}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t != "" {
+		return nil, fmt.Errorf("unexpected %q", t)
+	}
+	return e, nil
+}
+
+// tokenizeTargetExpr splits s into operators, parentheses, identifiers,
+// integers and quoted strings, the latter including their quotes.
+func tokenizeTargetExpr(s string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			toks = append(toks, s[i:i+1])
+			i++
+		case strings.HasPrefix(s[i:], "&&"), strings.HasPrefix(s[i:], "||"),
+			strings.HasPrefix(s[i:], "=="), strings.HasPrefix(s[i:], "!="),
+			strings.HasPrefix(s[i:], "=~"), strings.HasPrefix(s[i:], "!~"):
+			toks = append(toks, s[i:i+2])
+			i += 2
+		case c == '!':
+			toks = append(toks, "!")
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			toks = append(toks, s[i:j+1])
+			i = j + 1
+		case isTargetExprIdentByte(c):
+			j := i
+			for j < len(s) && isTargetExprIdentByte(s[j]) {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+		}
+	}
+	return toks, nil
+}
+
+func isTargetExprIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+type targetExprParser struct {
+	toks []string
+}
+
+// peek returns the next token, or "" at the end of input.
+func (p *targetExprParser) peek() string {
+	if len(p.toks) == 0 {
+		return ""
+	}
+	return p.toks[0]
+}
+
+func (p *targetExprParser) next() string {
+	t := p.peek()
+	if len(p.toks) > 0 {
+		p.toks = p.toks[1:]
+	}
+	return t
+}
+
+func (p *targetExprParser) parseOr() (targetExpr, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = targetOrExpr{l, r}
+	}
+	return l, nil
+}
+
+func (p *targetExprParser) parseAnd() (targetExpr, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = targetAndExpr{l, r}
+	}
+	return l, nil
+}
+
+func (p *targetExprParser) parseUnary() (targetExpr, error) {
+	if p.peek() == "!" {
+		p.next()
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return targetNotExpr{e}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *targetExprParser) parsePrimary() (targetExpr, error) {
+	t := p.next()
+	if t == "" {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	if t == "(" {
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return e, nil
+	}
+	isBool, ok := targetAttrNames[t]
+	if !ok {
+		return nil, fmt.Errorf("unknown attribute %q, want one of %s", t, strings.Join(slices.Sorted(maps.Keys(targetAttrNames)), ", "))
+	}
+	op := p.peek()
+	if op != "==" && op != "!=" && op != "=~" && op != "!~" {
+		if !isBool {
+			return nil, fmt.Errorf("attribute %q must be compared", t)
+		}
+		return targetBoolExpr{t}, nil
+	}
+	p.next()
+	raw := p.next()
+	var value string
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		var err error
+		value, err = strconv.Unquote(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s: %w", raw, err)
+		}
+	case raw != "" && isTargetExprIdentByte(raw[0]):
+		// Integers, and true and false for boolean attributes.
+		if _, err := strconv.Atoi(raw); err != nil && raw != "true" && raw != "false" {
+			return nil, fmt.Errorf("invalid value %q, strings must be quoted", raw)
+		}
+		value = raw
+	default:
+		return nil, fmt.Errorf("missing value after %s", op)
+	}
+	e := targetCmpExpr{attr: t, value: value, negate: op == "!=" || op == "!~"}
+	if op == "=~" || op == "!~" {
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		e.re = re
+	}
+	return e, nil
+}
@@ -0,0 +1,96 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestParseTargetExpr(t *testing.T) {
+	region := &tailcfg.DERPRegion{RegionID: 1, RegionCode: "nyc", RegionName: "New York City"}
+	node := &tailcfg.DERPNode{Name: "1a", HostName: "derp1a.tailscale.com", IPv4: "192.0.2.1"}
+	attrs := targetAttrsOf(1, region, node)
+	tests := []struct {
+		expr    string
+		want    bool
+		wantErr bool
+	}{
+		{expr: `region_code == "nyc"`, want: true},
+		{expr: `region_code != "nyc"`, want: false},
+		{expr: `region_id == 1`, want: true},
+		{expr: `hostname =~ "^derp1[a-z]\\."`, want: true},
+		{expr: `hostname !~ "^derp1"`, want: false},
+		{expr: `has_ipv6`, want: false},
+		{expr: `!has_ipv6 && !stun_only`, want: true},
+		{expr: `has_ipv6 == false`, want: true},
+		{expr: `region_code == "fra" || region_name =~ "York"`, want: true},
+		{expr: `!(region_code == "nyc" || has_ipv6)`, want: false},
+		{expr: `region_code == "fra" || region_code == "nyc" && has_ipv6`, want: false},
+		{expr: `hostname`, wantErr: true},
+		{expr: `region == "nyc"`, wantErr: true},
+		{expr: `region_code == nyc`, wantErr: true},
+		{expr: `region_code ==`, wantErr: true},
+		{expr: `region_code == "nyc`, wantErr: true},
+		{expr: `hostname =~ "("`, wantErr: true},
+		{expr: `(has_ipv6`, wantErr: true},
+		{expr: `has_ipv6 stun_only`, wantErr: true},
+		{expr: ``, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			e, err := parseTargetExpr(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTargetExpr() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := e.eval(attrs); got != tt.want {
+				t.Errorf("eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetFilterApply(t *testing.T) {
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, RegionCode: "nyc", Nodes: []*tailcfg.DERPNode{
+			{Name: "1a", HostName: "derp1a", IPv4: "192.0.2.1", IPv6: "2001:db8::1"},
+			{Name: "1b", HostName: "derp1b", IPv4: "192.0.2.2"},
+		}},
+		4: {RegionID: 4, RegionCode: "fra", Nodes: []*tailcfg.DERPNode{
+			{Name: "4a", HostName: "derp4a", IPv4: "192.0.2.4", IPv6: "2001:db8::4"},
+		}},
+	}}
+	c, err := parseConfig([]byte(`{"Targets": {"Include": ["region_code == \"nyc\"", "hostname =~ \"^derp4\""], "Exclude": ["!has_ipv6"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := c.Targets.apply(dm)
+	var hostnames []string
+	for _, id := range []int{1, 4} {
+		for _, n := range got.Regions[id].Nodes {
+			hostnames = append(hostnames, n.HostName)
+		}
+	}
+	if want := []string{"derp1a", "derp4a"}; !slices.Equal(hostnames, want) {
+		t.Errorf("selected %v, want %v", hostnames, want)
+	}
+	if len(dm.Regions[1].Nodes) != 2 {
+		t.Errorf("apply() modified the DERP map")
+	}
+
+	// Every node is selected without a filter.
+	var none *targetFilter
+	if got := none.apply(dm); got != dm {
+		t.Errorf("nil filter apply() = %v, want dm", got)
+	}
+
+	if _, err := parseConfig([]byte(`{"Targets": {"Exclude": ["region_code = \"nyc\""]}}`)); err == nil {
+		t.Errorf("parseConfig() with invalid expression succeeded")
+	}
+}
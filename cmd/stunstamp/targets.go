@@ -0,0 +1,318 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Statuses of a protocol of a target.
+const (
+	targetStatusOK      = "ok"      // the last probe succeeded
+	targetStatusFailing = "failing" // the last probe failed
+	targetStatusPending = "pending" // not probed yet
+)
+
+// targetStatus is a target and the status of each of its protocols, as
+// served by the API and listed by the targets subcommand.
+type targetStatus struct {
+	RegionID   int
+	RegionCode string
+	Hostname   string
+	Addr       string
+	Protocols  []targetProtocolStatus
+}
+
+// targetProtocolStatus is the status of a protocol on a destination port of
+// a target.
+type targetProtocolStatus struct {
+	Protocol protocol
+	DstPort  int           `json:",omitempty"` // zero for ICMP
+	Interval time.Duration `json:",omitempty"` // zero until probed
+	Status   string        // targetStatusOK, targetStatusFailing, or targetStatusPending
+	// LastRTT is the lowest RTT of the last window the protocol
+	// succeeded in.
+	LastRTT     time.Duration `json:",omitempty"`
+	LastSuccess time.Time
+	LastFailure time.Time
+	// ConsecutiveFailures is the number of windows the protocol has failed
+	// in since it last succeeded.
+	ConsecutiveFailures int `json:",omitempty"`
+}
+
+type targetProtocolKey struct {
+	addr     netip.Addr
+	protocol protocol
+	dstPort  int
+}
+
+// targetTracker tracks the targets being probed and the outcome of the last
+// probes of each of their protocols. It is safe for concurrent use.
+type targetTracker struct {
+	mu      sync.Mutex
+	targets map[netip.Addr]nodeMeta
+	status  map[targetProtocolKey]*targetProtocolStatus
+}
+
+func newTargetTracker() *targetTracker {
+	return &targetTracker{
+		targets: make(map[netip.Addr]nodeMeta),
+		status:  make(map[targetProtocolKey]*targetProtocolStatus),
+	}
+}
+
+// setTargets replaces the set of targets, dropping the status of those no
+// longer present.
+func (t *targetTracker) setTargets(targets map[netip.Addr]nodeMeta) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.targets = maps.Clone(targets)
+	for k := range t.status {
+		if _, ok := t.targets[k.addr]; !ok {
+			delete(t.status, k)
+		}
+	}
+}
+
+// observe records the outcome of the results of a window. A protocol
+// succeeded in the window if any of its results did, whatever their
+// timestamp source, conn stability, or proxy.
+func (t *targetTracker) observe(results []result) {
+	type outcome struct {
+		at  time.Time
+		rtt time.Duration
+		ok  bool
+	}
+	window := make(map[targetProtocolKey]outcome)
+	for _, r := range results {
+		k := targetProtocolKey{r.key.meta.addr, r.key.protocol, r.key.dstPort}
+		o := window[k]
+		if r.at.After(o.at) {
+			o.at = r.at
+		}
+		if r.rtt != nil && (!o.ok || *r.rtt < o.rtt) {
+			o.rtt, o.ok = *r.rtt, true
+		}
+		window[k] = o
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, o := range window {
+		st, ok := t.status[k]
+		if !ok {
+			st = &targetProtocolStatus{Protocol: k.protocol, DstPort: k.dstPort}
+			t.status[k] = st
+		}
+		if o.ok {
+			st.Status = targetStatusOK
+			st.LastRTT = o.rtt
+			st.LastSuccess = o.at
+			st.ConsecutiveFailures = 0
+		} else {
+			st.Status = targetStatusFailing
+			st.LastFailure = o.at
+			st.ConsecutiveFailures++
+		}
+	}
+}
+
+// statuses returns the status of every target, sorted by region and
+// hostname. intervals, if non-nil, supplies the interval of every protocol
+// probed.
+func (t *targetTracker) statuses(intervals []intervalStatus) []targetStatus {
+	type intervalKey struct {
+		addr     string
+		protocol protocol
+	}
+	byKey := make(map[intervalKey]time.Duration, len(intervals))
+	for _, is := range intervals {
+		byKey[intervalKey{is.Addr, is.Protocol}] = is.Interval
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	byAddr := make(map[netip.Addr]*targetStatus, len(t.targets))
+	for addr, meta := range t.targets {
+		byAddr[addr] = &targetStatus{
+			RegionID:   meta.regionID,
+			RegionCode: meta.regionCode,
+			Hostname:   meta.hostname,
+			Addr:       addr.String(),
+		}
+	}
+	for k, st := range t.status {
+		ts, ok := byAddr[k.addr]
+		if !ok {
+			continue
+		}
+		ps := *st
+		ps.Interval = byKey[intervalKey{ts.Addr, k.protocol}]
+		ts.Protocols = append(ts.Protocols, ps)
+	}
+	// Protocols scheduled but without results yet are pending.
+	for _, is := range intervals {
+		addr, err := netip.ParseAddr(is.Addr)
+		if err != nil {
+			continue
+		}
+		ts, ok := byAddr[addr]
+		if !ok || slices.ContainsFunc(ts.Protocols, func(ps targetProtocolStatus) bool { return ps.Protocol == is.Protocol }) {
+			continue
+		}
+		ts.Protocols = append(ts.Protocols, targetProtocolStatus{
+			Protocol: is.Protocol,
+			Interval: is.Interval,
+			Status:   targetStatusPending,
+		})
+	}
+
+	ret := make([]targetStatus, 0, len(byAddr))
+	for _, ts := range byAddr {
+		slices.SortFunc(ts.Protocols, func(a, b targetProtocolStatus) int {
+			return cmp.Or(cmp.Compare(a.Protocol, b.Protocol), cmp.Compare(a.DstPort, b.DstPort))
+		})
+		ret = append(ret, *ts)
+	}
+	slices.SortFunc(ret, func(a, b targetStatus) int {
+		return cmp.Or(
+			cmp.Compare(a.RegionID, b.RegionID),
+			cmp.Compare(a.Hostname, b.Hostname),
+			cmp.Compare(a.Addr, b.Addr),
+		)
+	})
+	return ret
+}
+
+// serveTargets serves the status of every target as JSON, see targetStatus.
+func (s *httpServer) serveTargets(w http.ResponseWriter, r *http.Request) {
+	if s.targets == nil {
+		http.Error(w, "not probing", http.StatusNotFound)
+		return
+	}
+	var intervals []intervalStatus
+	if s.intervals != nil {
+		intervals = s.intervals.statuses()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.targets.statuses(intervals))
+}
+
+// runTargets implements the targets subcommand, which lists the targets of
+// the stunstamp process serving on --http-addr, with the status of each of
+// their protocols, for scripts and shell completion. args are the
+// subcommand's arguments, output is written to w.
+func runTargets(args []string, w io.Writer) error {
+	if len(args) < 1 || args[0] != "list" {
+		return errors.New("usage: stunstamp targets list [flags]")
+	}
+	fs := flag.NewFlagSet("targets list", flag.ContinueOnError)
+	httpAddr := fs.String("http-addr", *flagHTTPAddr, "address the stunstamp process to query serves on")
+	asJSON := fs.Bool("json", false, "print targets as JSON")
+	names := fs.Bool("names", false, "print the hostname of every target, one per line, as used by shell completion")
+	proto := fs.String("protocol", "", "if set, list only targets probed with this protocol")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if len(*httpAddr) < 1 {
+		return errors.New("targets list requires the http-addr flag")
+	}
+	if *proto != "" && !slices.Contains(allProtocols, protocol(*proto)) {
+		return fmt.Errorf("unknown protocol %q", *proto)
+	}
+	targets, err := fetchTargets(*httpAddr)
+	if err != nil {
+		return err
+	}
+	if *proto != "" {
+		var filtered []targetStatus
+		for _, ts := range targets {
+			ts.Protocols = slices.DeleteFunc(ts.Protocols, func(ps targetProtocolStatus) bool { return ps.Protocol != protocol(*proto) })
+			if len(ts.Protocols) > 0 {
+				filtered = append(filtered, ts)
+			}
+		}
+		targets = filtered
+	}
+
+	switch {
+	case *asJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(targets)
+	case *names:
+		seen := make(map[string]bool)
+		for _, ts := range targets {
+			if !seen[ts.Hostname] {
+				seen[ts.Hostname] = true
+				fmt.Fprintln(w, ts.Hostname)
+			}
+		}
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "REGION\tHOSTNAME\tADDR\tPROTOCOL\tPORT\tSTATUS\tRTT\tLAST SUCCESS")
+	for _, ts := range targets {
+		region := fmt.Sprintf("%d-%s", ts.RegionID, ts.RegionCode)
+		if len(ts.Protocols) == 0 {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\t%s\t-\t-\n", region, ts.Hostname, ts.Addr, targetStatusPending)
+			continue
+		}
+		for _, ps := range ts.Protocols {
+			port, rtt, last := "-", "-", "-"
+			if ps.DstPort != 0 {
+				port = fmt.Sprint(ps.DstPort)
+			}
+			if ps.LastRTT > 0 {
+				rtt = ps.LastRTT.Round(time.Microsecond).String()
+			}
+			if !ps.LastSuccess.IsZero() {
+				last = ps.LastSuccess.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", region, ts.Hostname, ts.Addr, ps.Protocol, port, ps.Status, rtt, last)
+		}
+	}
+	return tw.Flush()
+}
+
+// fetchTargets returns the targets of the stunstamp process serving on
+// httpAddr.
+func fetchTargets(httpAddr string) ([]targetStatus, error) {
+	host, port, err := net.SplitHostPort(httpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid http-addr: %w", err)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	c := &http.Client{Timeout: 10 * time.Second}
+	resp, err := c.Get("http://" + net.JoinHostPort(host, port) + "/api/targets")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var targets []targetStatus
+	if err := json.NewDecoder(resp.Body).Decode(&targets); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
@@ -0,0 +1,142 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTargetTracker(t *testing.T) {
+	a := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "derp1a", addr: netip.MustParseAddr("192.0.2.1")}
+	b := nodeMeta{regionID: 2, regionCode: "sfo", hostname: "derp2a", addr: netip.MustParseAddr("192.0.2.2")}
+	tt := newTargetTracker()
+	tt.setTargets(map[netip.Addr]nodeMeta{a.addr: a, b.addr: b})
+
+	at := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	fast, slow := 10*time.Millisecond, 30*time.Millisecond
+	stun := func(m nodeMeta, ts timestampSource, rtt *time.Duration) result {
+		return result{key: resultKey{meta: m, protocol: protocolSTUN, dstPort: 3478, timestampSource: ts}, at: at, rtt: rtt}
+	}
+	tt.observe([]result{
+		stun(a, timestampSourceKernel, &fast),
+		stun(a, timestampSourceUserspace, &slow),
+		stun(b, timestampSourceKernel, nil),
+	})
+	at = at.Add(time.Minute)
+	tt.observe([]result{stun(b, timestampSourceKernel, nil)})
+
+	intervals := []intervalStatus{
+		{Hostname: "derp1a", Addr: "192.0.2.1", Protocol: protocolSTUN, Interval: time.Minute},
+		{Hostname: "derp1a", Addr: "192.0.2.1", Protocol: protocolICMP, Interval: 5 * time.Second},
+	}
+	got := tt.statuses(intervals)
+	if len(got) != 2 || got[0].Hostname != "derp1a" || got[1].Hostname != "derp2a" {
+		t.Fatalf("statuses = %+v, want derp1a and derp2a", got)
+	}
+	if ps := got[0].Protocols; len(ps) != 2 ||
+		ps[0].Protocol != protocolICMP || ps[0].Status != targetStatusPending || ps[0].Interval != 5*time.Second ||
+		ps[1].Protocol != protocolSTUN || ps[1].Status != targetStatusOK || ps[1].LastRTT != fast || ps[1].Interval != time.Minute {
+		t.Errorf("derp1a protocols = %+v", ps)
+	}
+	if ps := got[1].Protocols; len(ps) != 1 || ps[0].Status != targetStatusFailing || ps[0].ConsecutiveFailures != 2 || !ps[0].LastSuccess.IsZero() {
+		t.Errorf("derp2a protocols = %+v", ps)
+	}
+
+	tt.observe([]result{stun(b, timestampSourceKernel, &slow)})
+	if ps := tt.statuses(nil)[1].Protocols; ps[0].Status != targetStatusOK || ps[0].ConsecutiveFailures != 0 || ps[0].LastFailure.IsZero() {
+		t.Errorf("derp2a protocols after recovery = %+v", ps)
+	}
+
+	tt.setTargets(map[netip.Addr]nodeMeta{a.addr: a})
+	tt.setTargets(map[netip.Addr]nodeMeta{a.addr: a, b.addr: b})
+	if ps := tt.statuses(nil)[1].Protocols; len(ps) != 0 {
+		t.Errorf("status of a deselected target was retained: %+v", ps)
+	}
+}
+
+func TestTargetsList(t *testing.T) {
+	a := nodeMeta{regionID: 1, regionCode: "nyc", hostname: "derp1a", addr: netip.MustParseAddr("192.0.2.1")}
+	tt := newTargetTracker()
+	tt.setTargets(map[netip.Addr]nodeMeta{a.addr: a})
+	rtt := 10 * time.Millisecond
+	tt.observe([]result{
+		{key: resultKey{meta: a, protocol: protocolSTUN, dstPort: 3478}, at: time.Now(), rtt: &rtt},
+		{key: resultKey{meta: a, protocol: protocolICMP}, at: time.Now()},
+	})
+	srv := httptest.NewServer((&httpServer{baselines: newBaselineTracker(), targets: tt}).mux())
+	defer srv.Close()
+	httpAddr := strings.TrimPrefix(srv.URL, "http://")
+
+	var buf bytes.Buffer
+	if err := runTargets([]string{"list", "--http-addr=" + httpAddr, "--json"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var got []targetStatus
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Hostname != "derp1a" || len(got[0].Protocols) != 2 {
+		t.Fatalf("targets list --json = %+v", got)
+	}
+
+	buf.Reset()
+	if err := runTargets([]string{"list", "--http-addr=" + httpAddr, "--protocol=icmp"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); !strings.Contains(out, "failing") || strings.Contains(out, "stun") {
+		t.Errorf("targets list --protocol=icmp =\n%s", out)
+	}
+
+	buf.Reset()
+	if err := runTargets([]string{"list", "--http-addr=" + httpAddr, "--names"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "derp1a\n" {
+		t.Errorf("targets list --names = %q, want %q", got, "derp1a\n")
+	}
+
+	if err := runTargets([]string{"list", "--http-addr=" + httpAddr, "--protocol=quic"}, &buf); err == nil {
+		t.Error("listing an unknown protocol unexpectedly succeeded")
+	}
+	if err := runTargets([]string{"show"}, &buf); err == nil {
+		t.Error("unknown targets command unexpectedly succeeded")
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh"} {
+		var buf bytes.Buffer
+		if err := runCompletion([]string{shell}, &buf); err != nil {
+			t.Fatal(err)
+		}
+		script := buf.String()
+		for _, want := range []string{"--stun-dst-ports", "targets", "derp_ws_upgrade", "complete -F _stunstamp stunstamp"} {
+			if !strings.Contains(script, want) {
+				t.Errorf("%s completion lacks %q", shell, want)
+			}
+		}
+		if shell != "bash" {
+			continue
+		}
+		if _, err := exec.LookPath("bash"); err != nil {
+			t.Log("skipping syntax check without bash")
+			continue
+		}
+		cmd := exec.Command("bash", "-n")
+		cmd.Stdin = &buf
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("bash completion is invalid: %v\n%s", err, out)
+		}
+	}
+	if err := runCompletion([]string{"fish"}, &bytes.Buffer{}); err == nil {
+		t.Error("completion for an unsupported shell unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// eventKindTLSCertChange is a change in the leaf certificate presented
+	// by a target, e.g. a DERP certificate rotation, or a TLS-intercepting
+	// middlebox starting or ceasing to present its own.
+	eventKindTLSCertChange eventKind = "tls_cert_change"
+	// eventKindTLSCertUntrusted is a leaf certificate failing verification
+	// first seen on a target, the hallmark of a TLS-intercepting middlebox
+	// injected on the path.
+	eventKindTLSCertUntrusted eventKind = "tls_cert_untrusted"
+)
+
+// tlsCertKey identifies the TLS endpoint of a target probed by a protocol.
+type tlsCertKey struct {
+	protocol protocol
+	hostname string
+	dst      netip.AddrPort
+}
+
+// tlsCertObservation is the leaf certificate last presented by a TLS
+// endpoint of a target, as served by the API.
+type tlsCertObservation struct {
+	Protocol protocol
+	Hostname string
+	Addr     netip.AddrPort
+	// SHA256 is the hex-encoded SHA-256 fingerprint of the certificate.
+	SHA256    string
+	Subject   string
+	Issuer    string
+	NotBefore time.Time
+	NotAfter  time.Time
+	// Verified is whether the certificate verified for the hostname, and
+	// VerifyError why not.
+	Verified    bool
+	VerifyError string `json:",omitempty"`
+	// FirstSeen is when the certificate was first presented in a row, and
+	// LastSeen when last.
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Changes is the number of times the certificate changed since
+	// startup.
+	Changes int
+}
+
+// tlsCertTracker tracks the leaf certificates presented by targets to TLS
+// probes, recording events on change. It is safe for concurrent use.
+type tlsCertTracker struct {
+	mu    sync.Mutex
+	certs map[tlsCertKey]*tlsCertObservation
+}
+
+func newTLSCertTracker() *tlsCertTracker {
+	return &tlsCertTracker{certs: make(map[tlsCertKey]*tlsCertObservation)}
+}
+
+// tlsCerts is the process-wide tlsCertTracker, observed by the TLS
+// handshakes of probes.
+var tlsCerts = newTLSCertTracker()
+
+// observe accounts the outcome of a TLS handshake with the target hostname
+// at dst by a probe of protocol: state if it succeeded, or err if it failed.
+// Handshakes failing before a certificate was presented are ignored.
+func (t *tlsCertTracker) observe(proto protocol, hostname string, dst netip.AddrPort, state tls.ConnectionState, err error, at time.Time) {
+	certs, verified, verifyErr := state.PeerCertificates, err == nil, ""
+	if err != nil {
+		var cve *tls.CertificateVerificationError
+		if !errors.As(err, &cve) {
+			return
+		}
+		certs, verifyErr = cve.UnverifiedCertificates, cve.Err.Error()
+	}
+	if len(certs) == 0 {
+		return
+	}
+	leaf := certs[0]
+	sum := sha256.Sum256(leaf.Raw)
+	obs := tlsCertObservation{
+		Protocol:    proto,
+		Hostname:    hostname,
+		Addr:        dst,
+		SHA256:      hex.EncodeToString(sum[:]),
+		Subject:     leaf.Subject.String(),
+		Issuer:      leaf.Issuer.String(),
+		NotBefore:   leaf.NotBefore,
+		NotAfter:    leaf.NotAfter,
+		Verified:    verified,
+		VerifyError: verifyErr,
+		FirstSeen:   at,
+		LastSeen:    at,
+	}
+
+	k := tlsCertKey{proto, hostname, dst}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last, ok := t.certs[k]
+	if ok && last.SHA256 == obs.SHA256 {
+		last.LastSeen = at
+		// The certificate may expire, or its issuer become trusted.
+		last.Verified, last.VerifyError = obs.Verified, obs.VerifyError
+		return
+	}
+	t.certs[k] = &obs
+	attrs := tlsCertAttrs(&obs, dst)
+	if ok {
+		obs.Changes = last.Changes + 1
+		attrs["previous_sha256"] = last.SHA256
+		attrs["previous_issuer"] = last.Issuer
+		attrs["previous_not_after"] = last.NotAfter.UTC().Format(time.RFC3339)
+		probeLog.Info("TLS certificate changed", "protocol", proto, "hostname", hostname, "addr", dst, "sha256", obs.SHA256, "issuer", obs.Issuer, "previous_issuer", last.Issuer, "verified", verified)
+		events.record(event{At: at, Kind: eventKindTLSCertChange, Addr: dst.Addr(), Hostname: hostname, Protocol: proto, Attrs: attrs})
+	}
+	if !verified {
+		probeLog.Warn("untrusted TLS certificate", "protocol", proto, "hostname", hostname, "addr", dst, "sha256", obs.SHA256, "issuer", obs.Issuer, "err", verifyErr)
+		events.record(event{At: at, Kind: eventKindTLSCertUntrusted, Addr: dst.Addr(), Hostname: hostname, Protocol: proto, Attrs: tlsCertAttrs(&obs, dst)})
+	}
+}
+
+func tlsCertAttrs(obs *tlsCertObservation, dst netip.AddrPort) map[string]string {
+	attrs := map[string]string{
+		"sha256":    obs.SHA256,
+		"subject":   obs.Subject,
+		"issuer":    obs.Issuer,
+		"not_after": obs.NotAfter.UTC().Format(time.RFC3339),
+		"port":      strconv.Itoa(int(dst.Port())),
+		"verified":  strconv.FormatBool(obs.Verified),
+	}
+	if obs.VerifyError != "" {
+		attrs["verify_error"] = obs.VerifyError
+	}
+	return attrs
+}
+
+// observations returns the certificates last presented by every TLS
+// endpoint probed.
+func (t *tlsCertTracker) observations() []tlsCertObservation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ret := make([]tlsCertObservation, 0, len(t.certs))
+	for _, obs := range t.certs {
+		ret = append(ret, *obs)
+	}
+	slices.SortFunc(ret, func(a, b tlsCertObservation) int {
+		return cmp.Or(
+			cmp.Compare(a.Hostname, b.Hostname),
+			a.Addr.Compare(b.Addr),
+			cmp.Compare(a.Protocol, b.Protocol),
+		)
+	})
+	return ret
+}
@@ -0,0 +1,114 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func testCert(t *testing.T, cn string) *x509.Certificate {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestTLSCertTracker(t *testing.T) {
+	dst := netip.MustParseAddrPort("192.0.2.1:443")
+	countEvents := func(kind eventKind) int {
+		n := 0
+		for _, ev := range events.recentEvents() {
+			if ev.Kind == kind && ev.Addr == dst.Addr() {
+				n++
+			}
+		}
+		return n
+	}
+	changes, untrusted := countEvents(eventKindTLSCertChange), countEvents(eventKindTLSCertUntrusted)
+	tr := newTLSCertTracker()
+	derp, mitm := testCert(t, "derp1a"), testCert(t, "carrier proxy")
+	ok := func(c *x509.Certificate) tls.ConnectionState {
+		return tls.ConnectionState{PeerCertificates: []*x509.Certificate{c}}
+	}
+	intercepted := &tls.CertificateVerificationError{UnverifiedCertificates: []*x509.Certificate{mitm}, Err: x509.UnknownAuthorityError{}}
+
+	tr.observe(protocolHTTPS, "derp1a", dst, ok(derp), nil, time.Now())
+	tr.observe(protocolHTTPS, "derp1a", dst, ok(derp), nil, time.Now())
+	// Handshakes failing without a certificate are not observations.
+	tr.observe(protocolHTTPS, "derp1a", dst, tls.ConnectionState{}, errors.New("connection reset"), time.Now())
+	tr.observe(protocolHTTPS, "derp1a", dst, tls.ConnectionState{}, intercepted, time.Now())
+	tr.observe(protocolHTTPS, "derp1a", dst, tls.ConnectionState{}, intercepted, time.Now())
+	// Other protocols are tracked separately.
+	tr.observe(protocolDERP, "derp1a", dst, ok(derp), nil, time.Now())
+
+	if got := countEvents(eventKindTLSCertChange) - changes; got != 1 {
+		t.Errorf("got %d change events, want 1", got)
+	}
+	if got := countEvents(eventKindTLSCertUntrusted) - untrusted; got != 1 {
+		t.Errorf("got %d untrusted events, want 1", got)
+	}
+	obs := tr.observations()
+	if len(obs) != 2 {
+		t.Fatalf("got %d observations, want 2: %+v", len(obs), obs)
+	}
+	if o := obs[1]; o.Protocol != protocolHTTPS || o.Verified || o.Changes != 1 || o.Subject != "CN=carrier proxy" || o.VerifyError == "" {
+		t.Errorf("https observation = %+v, want the untrusted certificate", o)
+	}
+	if o := obs[0]; o.Protocol != protocolDERP || !o.Verified || o.Changes != 0 {
+		t.Errorf("derp observation = %+v", o)
+	}
+}
+
+func TestTLSCertTrackerHandshake(t *testing.T) {
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+	dst := netip.MustParseAddrPort(srv.Listener.Addr().String())
+	tr := newTLSCertTracker()
+	for _, roots := range []*x509.CertPool{nil, func() *x509.CertPool {
+		p := x509.NewCertPool()
+		p.AddCert(srv.Certificate())
+		return p
+	}()} {
+		c, err := net.Dial("tcp", dst.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc := tls.Client(c, &tls.Config{ServerName: "example.com", RootCAs: roots})
+		err = tc.Handshake()
+		tr.observe(protocolHTTPS, "example.com", dst, tc.ConnectionState(), err, time.Now())
+		c.Close()
+		obs := tr.observations()
+		if len(obs) != 1 || obs[0].Verified != (roots != nil) || obs[0].Changes != 0 {
+			t.Errorf("roots %v: observations = %+v", roots != nil, obs)
+		}
+	}
+}
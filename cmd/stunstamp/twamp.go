@@ -0,0 +1,392 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// This file implements the Session-Sender and a stateless Session-Reflector
+// of TWAMP-light (RFC 5357 Appendix I): TWAMP-Test packets exchanged without
+// TWAMP-Control, with any keys configured out of band. Both unauthenticated
+// and authenticated modes are supported. In authenticated mode the first
+// 16-octet block of every packet, which holds the sequence number, is
+// encrypted with AES-ECB, and the packet is protected by a truncated
+// HMAC-SHA1.
+
+const (
+	// twampDefaultPort is the well-known TWAMP-Test port.
+	twampDefaultPort = 862
+
+	twampSenderLen        = 14  // unauthenticated Session-Sender packet, unpadded
+	twampReflectorLen     = 41  // unauthenticated Session-Reflector packet
+	twampAuthSenderLen    = 48  // authenticated Session-Sender packet, unpadded
+	twampAuthReflectorLen = 112 // authenticated Session-Reflector packet
+	twampHMACLen          = 16
+
+	// twampErrorEstimate is the Error Estimate of our timestamps without
+	// --ntp-servers: S=0, as clocks are not assumed to be synchronized to
+	// UTC, with the nonzero multiplier RFC 4656 requires. See
+	// twampErrorEstimateAt.
+	twampErrorEstimate = 0x0001
+)
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900) and
+// the Unix epoch.
+const ntpEpochOffset = 2208988800
+
+func toNTPTimestamp(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return secs<<32 | frac
+}
+
+func fromNTPTimestamp(ts uint64) time.Time {
+	secs := int64(ts>>32) - ntpEpochOffset
+	nsecs := int64((ts & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(secs, nsecs)
+}
+
+// twampKeys are the out of band configured keys of authenticated mode.
+type twampKeys struct {
+	block   cipher.Block
+	hmacKey []byte
+}
+
+// parseTWAMPKeys parses keys in the form AES-KEY:HMAC-KEY, where AES-KEY is
+// 16 hex-encoded octets and HMAC-KEY is 32 hex-encoded octets.
+func parseTWAMPKeys(s string) (*twampKeys, error) {
+	aesHex, hmacHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, errors.New("want AES-KEY:HMAC-KEY")
+	}
+	aesKey, err := hex.DecodeString(aesHex)
+	if err != nil || len(aesKey) != 16 {
+		return nil, errors.New("AES-KEY must be 16 hex-encoded octets")
+	}
+	hmacKey, err := hex.DecodeString(hmacHex)
+	if err != nil || len(hmacKey) != 32 {
+		return nil, errors.New("HMAC-KEY must be 32 hex-encoded octets")
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	return &twampKeys{block: block, hmacKey: hmacKey}, nil
+}
+
+// activeTWAMPKeys are the keys of authenticated mode, or nil for
+// unauthenticated mode.
+var activeTWAMPKeys *twampKeys
+
+func (k *twampKeys) mac(b []byte) []byte {
+	h := hmac.New(sha1.New, k.hmacKey)
+	h.Write(b)
+	return h.Sum(nil)[:twampHMACLen]
+}
+
+// seal sets the HMAC at hmacOff over the preceding octets of b, then encrypts
+// the first block.
+func (k *twampKeys) seal(b []byte, hmacOff int) {
+	copy(b[hmacOff:], k.mac(b[:hmacOff]))
+	k.block.Encrypt(b[:aes.BlockSize], b[:aes.BlockSize])
+}
+
+// open decrypts the first block of b in place, then verifies the HMAC at
+// hmacOff.
+func (k *twampKeys) open(b []byte, hmacOff int) bool {
+	k.block.Decrypt(b[:aes.BlockSize], b[:aes.BlockSize])
+	return hmac.Equal(b[hmacOff:hmacOff+twampHMACLen], k.mac(b[:hmacOff]))
+}
+
+// twampSenderPacket is the content of a Session-Sender packet.
+type twampSenderPacket struct {
+	seq uint32
+	ts  uint64
+	// errEst is the Error Estimate.
+	errEst uint16
+}
+
+// marshal returns p in the format of keys' mode, padded to the length of a
+// reflected packet so that both directions carry packets of equal size.
+func (p twampSenderPacket) marshal(keys *twampKeys) []byte {
+	if keys == nil {
+		b := make([]byte, twampReflectorLen)
+		binary.BigEndian.PutUint32(b[0:], p.seq)
+		binary.BigEndian.PutUint64(b[4:], p.ts)
+		binary.BigEndian.PutUint16(b[12:], p.errEst)
+		return b
+	}
+	b := make([]byte, twampAuthReflectorLen)
+	binary.BigEndian.PutUint32(b[0:], p.seq)
+	binary.BigEndian.PutUint64(b[16:], p.ts)
+	binary.BigEndian.PutUint16(b[24:], p.errEst)
+	keys.seal(b, 32)
+	return b
+}
+
+func parseTWAMPSenderPacket(b []byte, keys *twampKeys) (twampSenderPacket, error) {
+	if keys == nil {
+		if len(b) < twampSenderLen {
+			return twampSenderPacket{}, errors.New("short packet")
+		}
+		return twampSenderPacket{
+			seq:    binary.BigEndian.Uint32(b[0:]),
+			ts:     binary.BigEndian.Uint64(b[4:]),
+			errEst: binary.BigEndian.Uint16(b[12:]),
+		}, nil
+	}
+	if len(b) < twampAuthSenderLen {
+		return twampSenderPacket{}, errors.New("short packet")
+	}
+	if !keys.open(b, 32) {
+		return twampSenderPacket{}, errors.New("HMAC mismatch")
+	}
+	return twampSenderPacket{
+		seq:    binary.BigEndian.Uint32(b[0:]),
+		ts:     binary.BigEndian.Uint64(b[16:]),
+		errEst: binary.BigEndian.Uint16(b[24:]),
+	}, nil
+}
+
+// twampReflectorPacket is the content of a Session-Reflector packet.
+type twampReflectorPacket struct {
+	seq    uint32
+	ts     uint64 // transmit timestamp
+	errEst uint16
+	rxTS   uint64 // receive timestamp
+	sender twampSenderPacket
+	// senderTTL is the TTL (or hop limit) of the Session-Sender packet as
+	// received, or zero if unknown.
+	senderTTL uint8
+}
+
+// marshal returns p in the format of keys' mode, padded to padTo octets.
+func (p twampReflectorPacket) marshal(keys *twampKeys, padTo int) []byte {
+	n := twampReflectorLen
+	if keys != nil {
+		n = twampAuthReflectorLen
+	}
+	b := make([]byte, max(n, padTo))
+	if keys == nil {
+		binary.BigEndian.PutUint32(b[0:], p.seq)
+		binary.BigEndian.PutUint64(b[4:], p.ts)
+		binary.BigEndian.PutUint16(b[12:], p.errEst)
+		binary.BigEndian.PutUint64(b[16:], p.rxTS)
+		binary.BigEndian.PutUint32(b[24:], p.sender.seq)
+		binary.BigEndian.PutUint64(b[28:], p.sender.ts)
+		binary.BigEndian.PutUint16(b[36:], p.sender.errEst)
+		b[40] = p.senderTTL
+		return b
+	}
+	binary.BigEndian.PutUint32(b[0:], p.seq)
+	binary.BigEndian.PutUint64(b[16:], p.ts)
+	binary.BigEndian.PutUint16(b[24:], p.errEst)
+	binary.BigEndian.PutUint64(b[32:], p.rxTS)
+	binary.BigEndian.PutUint32(b[48:], p.sender.seq)
+	binary.BigEndian.PutUint64(b[64:], p.sender.ts)
+	binary.BigEndian.PutUint16(b[72:], p.sender.errEst)
+	b[80] = p.senderTTL
+	keys.seal(b, 96)
+	return b
+}
+
+func parseTWAMPReflectorPacket(b []byte, keys *twampKeys) (twampReflectorPacket, error) {
+	if keys == nil {
+		if len(b) < twampReflectorLen {
+			return twampReflectorPacket{}, errors.New("short packet")
+		}
+		return twampReflectorPacket{
+			seq:    binary.BigEndian.Uint32(b[0:]),
+			ts:     binary.BigEndian.Uint64(b[4:]),
+			errEst: binary.BigEndian.Uint16(b[12:]),
+			rxTS:   binary.BigEndian.Uint64(b[16:]),
+			sender: twampSenderPacket{
+				seq:    binary.BigEndian.Uint32(b[24:]),
+				ts:     binary.BigEndian.Uint64(b[28:]),
+				errEst: binary.BigEndian.Uint16(b[36:]),
+			},
+			senderTTL: b[40],
+		}, nil
+	}
+	if len(b) < twampAuthReflectorLen {
+		return twampReflectorPacket{}, errors.New("short packet")
+	}
+	if !keys.open(b, 96) {
+		return twampReflectorPacket{}, errors.New("HMAC mismatch")
+	}
+	return twampReflectorPacket{
+		seq:    binary.BigEndian.Uint32(b[0:]),
+		ts:     binary.BigEndian.Uint64(b[16:]),
+		errEst: binary.BigEndian.Uint16(b[24:]),
+		rxTS:   binary.BigEndian.Uint64(b[32:]),
+		sender: twampSenderPacket{
+			seq:    binary.BigEndian.Uint32(b[48:]),
+			ts:     binary.BigEndian.Uint64(b[64:]),
+			errEst: binary.BigEndian.Uint16(b[72:]),
+		},
+		senderTTL: b[80],
+	}, nil
+}
+
+// twampConn is the UDP socket of a TWAMP-light test session, i.e. a 5-tuple.
+type twampConn struct {
+	*net.UDPConn
+	// seq is the sequence number of the next packet.
+	seq atomic.Uint32
+}
+
+// measureTWAMPRTT measures the round-trip time to the Session-Reflector at dst
+// as defined by RFC 5357: the time between transmission and receipt at the
+// Session-Sender, less the time between receipt and transmission at the
+// Session-Reflector.
+func measureTWAMPRTT(ctx context.Context, conn io.ReadWriteCloser, _ string, dst netip.AddrPort) (m measurement, err error) {
+	tconn, ok := conn.(*twampConn)
+	if !ok {
+		return measurement{}, fmt.Errorf("unexpected conn type: %T", conn)
+	}
+	err = tconn.SetDeadline(deadlineWithin(ctx, txRxTimeout))
+	if err != nil {
+		return measurement{}, fmt.Errorf("error setting deadline: %w", err)
+	}
+	keys := activeTWAMPKeys
+	seq := tconn.seq.Add(1) - 1
+	txAt := time.Now()
+	req := twampSenderPacket{
+		seq:    seq,
+		ts:     toNTPTimestamp(txAt),
+		errEst: twampErrorEstimateAt(txAt),
+	}.marshal(keys)
+	_, err = tconn.WriteToUDPAddrPort(req, dst)
+	if err != nil {
+		return measurement{}, fmt.Errorf("error writing to udp socket: %w", err)
+	}
+	b := make([]byte, 1460)
+	for {
+		n, err := tconn.Read(b)
+		rxAt := time.Now()
+		if err != nil {
+			return measurement{}, fmt.Errorf("error reading from udp socket: %w", err)
+		}
+		resp, err := parseTWAMPReflectorPacket(b[:n], keys)
+		if err != nil || resp.sender.seq != seq {
+			// Unauthenticated, or a late reply from a previous window.
+			continue
+		}
+		rtt := rxAt.Sub(txAt)
+		// Reflector timestamps are only subtracted from each other, so
+		// need not be synchronized with ours.
+		if dwell := fromNTPTimestamp(resp.ts).Sub(fromNTPTimestamp(resp.rxTS)); dwell > 0 && dwell < rtt {
+			rtt -= dwell
+		}
+		return measurement{rtt: rtt}, nil
+	}
+}
+
+// twampReflectorNetwork returns the network to listen on for addr: "udp6"
+// for IPv6 addresses, otherwise "udp4", as TTLs are read via the control
+// messages of a single address family.
+func twampReflectorNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err == nil {
+		if ip, err := netip.ParseAddr(host); err == nil && ip.Is6() {
+			return "udp6"
+		}
+	}
+	return "udp4"
+}
+
+// serveTWAMPReflector runs a stateless TWAMP-light Session-Reflector on addr
+// in the mode of keys, returning only on error. Packets that fail
+// authentication are dropped.
+func serveTWAMPReflector(addr string, keys *twampKeys) error {
+	network := twampReflectorNetwork(addr)
+	uaddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP(network, uaddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return reflectTWAMP(conn, keys)
+}
+
+func reflectTWAMP(conn *net.UDPConn, keys *twampKeys) error {
+	// readFrom reads a packet and the TTL it was received with, if known.
+	var readFrom func(b []byte) (n int, ttl uint8, src net.Addr, err error)
+	if conn.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		pc := ipv4.NewPacketConn(conn)
+		if err := pc.SetControlMessage(ipv4.FlagTTL, true); err != nil {
+			probeLog.Warn("unable to read TTLs of TWAMP packets", "err", err)
+		}
+		readFrom = func(b []byte) (int, uint8, net.Addr, error) {
+			n, cm, src, err := pc.ReadFrom(b)
+			if cm == nil {
+				return n, 0, src, err
+			}
+			return n, uint8(cm.TTL), src, err
+		}
+	} else {
+		pc := ipv6.NewPacketConn(conn)
+		if err := pc.SetControlMessage(ipv6.FlagHopLimit, true); err != nil {
+			probeLog.Warn("unable to read hop limits of TWAMP packets", "err", err)
+		}
+		readFrom = func(b []byte) (int, uint8, net.Addr, error) {
+			n, cm, src, err := pc.ReadFrom(b)
+			if cm == nil {
+				return n, 0, src, err
+			}
+			return n, uint8(cm.HopLimit), src, err
+		}
+	}
+	b := make([]byte, 1500)
+	for {
+		n, ttl, src, err := readFrom(b)
+		rxAt := time.Now()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		req, err := parseTWAMPSenderPacket(b[:n], keys)
+		if err != nil {
+			probeLog.Debug("dropping TWAMP packet", "src", src, "err", err)
+			continue
+		}
+		resp := twampReflectorPacket{
+			// Being stateless, we reflect the Session-Sender's sequence
+			// number as our own.
+			seq:       req.seq,
+			errEst:    twampErrorEstimateAt(rxAt),
+			rxTS:      toNTPTimestamp(rxAt),
+			sender:    req,
+			senderTTL: ttl,
+		}
+		resp.ts = toNTPTimestamp(time.Now())
+		if _, err := conn.WriteTo(resp.marshal(keys, n), src); err != nil {
+			probeLog.Warn("error writing TWAMP reply", "dst", src, "err", err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNTPTimestamp(t *testing.T) {
+	now := time.Now()
+	if got := fromNTPTimestamp(toNTPTimestamp(now)); got.Sub(now).Abs() > time.Nanosecond {
+		t.Errorf("fromNTPTimestamp(toNTPTimestamp(%v)) = %v", now, got)
+	}
+	if got := toNTPTimestamp(time.Unix(0, 0)) >> 32; got != ntpEpochOffset {
+		t.Errorf("NTP seconds at Unix epoch = %d, want %d", got, ntpEpochOffset)
+	}
+}
+
+func TestTWAMP(t *testing.T) {
+	keys, err := parseTWAMPKeys(strings.Repeat("ab", 16) + ":" + strings.Repeat("cd", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeys, err := parseTWAMPKeys(strings.Repeat("ab", 16) + ":" + strings.Repeat("ef", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseTWAMPKeys("abab:cdcd"); err == nil {
+		t.Error("parseTWAMPKeys of short keys unexpectedly succeeded")
+	}
+
+	for _, tt := range []struct {
+		name           string
+		reflectorKeys  *twampKeys
+		senderKeys     *twampKeys
+		wantReflection bool
+	}{
+		{"unauthenticated", nil, nil, true},
+		{"authenticated", keys, keys, true},
+		{"wrong-keys", keys, otherKeys, false},
+		{"unauthenticated-sender", keys, nil, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rconn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rconn.Close()
+			go reflectTWAMP(rconn, tt.reflectorKeys)
+
+			old := activeTWAMPKeys
+			activeTWAMPKeys = tt.senderKeys
+			defer func() { activeTWAMPKeys = old }()
+			cf, err := newConnAndMeasureFn(rconn.LocalAddr().(*net.UDPAddr).AddrPort().Addr(), timestampSourceUserspace, protocolTWAMP, stableConn, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cf.conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			for i := range 2 {
+				m, err := cf.fn(ctx, cf.conn, "", rconn.LocalAddr().(*net.UDPAddr).AddrPort())
+				if !tt.wantReflection {
+					if err == nil {
+						t.Fatal("unexpectedly measured RTT")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("probe %d: %v", i, err)
+				}
+				if m.rtt <= 0 || m.rtt > time.Second {
+					t.Errorf("probe %d: implausible RTT %v", i, m.rtt)
+				}
+			}
+			if got := cf.conn.(*twampConn).seq.Load(); got != 2 {
+				t.Errorf("next sequence number = %d, want 2", got)
+			}
+		})
+	}
+}
+
+func TestTWAMPReflectorPacket(t *testing.T) {
+	keys, err := parseTWAMPKeys(strings.Repeat("01", 16) + ":" + strings.Repeat("02", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []*twampKeys{nil, keys} {
+		want := twampReflectorPacket{
+			seq:       7,
+			ts:        toNTPTimestamp(time.Now()),
+			errEst:    twampErrorEstimate,
+			rxTS:      toNTPTimestamp(time.Now().Add(-time.Millisecond)),
+			sender:    twampSenderPacket{seq: 7, ts: 1 << 40, errEst: twampErrorEstimate},
+			senderTTL: 63,
+		}
+		b := want.marshal(k, 200)
+		if len(b) != 200 {
+			t.Errorf("marshaled %d octets, want padding to 200", len(b))
+		}
+		got, err := parseTWAMPReflectorPacket(b, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
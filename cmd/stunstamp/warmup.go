@@ -0,0 +1,103 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"slices"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// warmUpMetricName is 1 while the results of windows are excluded from
+// aggregates as warm-up or cool-down, see lifecyclePhase, and 0 otherwise,
+// so that alerting rules on raw results can be suppressed alike.
+const warmUpMetricName = "stunstamp_warm_up"
+
+// lifecyclePhase is the phase of the prober's lifecycle a window was probed
+// in.
+type lifecyclePhase string
+
+const (
+	phaseSteady lifecyclePhase = ""
+	// phaseWarmUp marks the first --warm-up-windows windows after start
+	// and config reload, whose samples are skewed by connection
+	// establishment, ARP/ND resolution, and NAT mapping creation.
+	phaseWarmUp lifecyclePhase = "warm-up"
+	// phaseCoolDown marks the window in flight when stopping, e.g. as a
+	// pod's network is torn down around its termination.
+	phaseCoolDown lifecyclePhase = "cool-down"
+)
+
+// inAggregates reports whether results probed in phase are included in
+// aggregates and alerting, which those of warm-up and cool-down windows are
+// not unless --aggregate-warm-up.
+func (p lifecyclePhase) inAggregates() bool {
+	return p == phaseSteady || *flagAggregateWarmUp
+}
+
+// warmUp counts down the warm-up windows after start and config reload. It
+// belongs to the probing loop.
+type warmUp struct {
+	remaining int
+}
+
+// reset starts a warm-up of n windows.
+func (w *warmUp) reset(n int) {
+	w.remaining = max(n, 0)
+}
+
+// next returns the phase of the next window, consuming a warm-up window if
+// any remain. stopping is whether the prober is stopping.
+func (w *warmUp) next(stopping bool) lifecyclePhase {
+	warm := w.remaining > 0
+	if warm {
+		w.remaining--
+	}
+	switch {
+	case stopping:
+		return phaseCoolDown
+	case warm:
+		return phaseWarmUp
+	}
+	return phaseSteady
+}
+
+// current returns the phase of probes out of cycle, between windows, without
+// consuming a warm-up window. stopping is whether the prober is stopping.
+func (w *warmUp) current(stopping bool) lifecyclePhase {
+	switch {
+	case stopping:
+		return phaseCoolDown
+	case w.remaining > 0:
+		return phaseWarmUp
+	}
+	return phaseSteady
+}
+
+// toPromTimeSeries returns the warmUpMetricName timeseries of a window
+// probed in phase.
+func (p lifecyclePhase) toPromTimeSeries(instance string, at time.Time) prompb.TimeSeries {
+	var v float64
+	if !p.inAggregates() {
+		v = 1
+	}
+	return instanceTimeSeries(warmUpMetricName, instance, at, v)
+}
+
+// markPhase sets the phase results were probed in.
+func markPhase(results []result, p lifecyclePhase) {
+	for i := range results {
+		results[i].phase = p
+	}
+}
+
+// aggregatable returns the results to include in aggregates and alerting,
+// see lifecyclePhase.inAggregates.
+func aggregatable(results []result) []result {
+	if !slices.ContainsFunc(results, func(r result) bool { return !r.phase.inAggregates() }) {
+		return results
+	}
+	return slices.DeleteFunc(slices.Clone(results), func(r result) bool { return !r.phase.inAggregates() })
+}
@@ -0,0 +1,68 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestWarmUp(t *testing.T) {
+	var w warmUp
+	w.reset(2)
+	for i, want := range []lifecyclePhase{phaseWarmUp, phaseWarmUp, phaseSteady, phaseSteady} {
+		if got := w.next(false); got != want {
+			t.Errorf("window %d phase = %q, want %q", i, got, want)
+		}
+	}
+	w.reset(1)
+	if got := w.next(true); got != phaseCoolDown {
+		t.Errorf("stopping window phase = %q, want %q", got, phaseCoolDown)
+	}
+	if got := w.next(false); got != phaseSteady {
+		t.Errorf("cool-down did not consume the warm-up window, next phase = %q", got)
+	}
+	w.reset(-1)
+	if got := w.next(false); got != phaseSteady {
+		t.Errorf("negative warm-up phase = %q, want steady", got)
+	}
+}
+
+func TestWarmUpExcludedFromAggregates(t *testing.T) {
+	meta := nodeMeta{regionID: 1, hostname: "derp1a", addr: netip.MustParseAddr("192.0.2.1")}
+	key := resultKey{meta: meta, protocol: protocolSTUN, timestampSource: timestampSourceKernel}
+	at := time.Now()
+	warmRTT, steadyRTT := 50*time.Millisecond, 10*time.Millisecond
+	results := []result{
+		{key: key, at: at, rtt: &warmRTT},
+		{key: key, at: at.Add(time.Second), rtt: &steadyRTT},
+	}
+	markPhase(results[:1], phaseWarmUp)
+
+	got := aggregatable(results)
+	if len(got) != 1 || got[0].phase != phaseSteady {
+		t.Errorf("aggregatable = %+v, want the steady result", got)
+	}
+	if results[0].phase != phaseWarmUp {
+		t.Error("aggregatable modified its argument")
+	}
+
+	b := newBaselineTracker()
+	b.add(results)
+	if cur := b.current[key]; cur == nil || len(cur.samples) != 1 || cur.samples[0] != steadyRTT {
+		t.Errorf("baseline samples = %+v, want only the steady RTT", cur)
+	}
+
+	if sr := storedResultFromResult(results[0]); sr.Phase != phaseWarmUp || sr.toResult().phase != phaseWarmUp {
+		t.Errorf("stored phase = %q, want %q", sr.Phase, phaseWarmUp)
+	}
+
+	old := *flagAggregateWarmUp
+	*flagAggregateWarmUp = true
+	defer func() { *flagAggregateWarmUp = old }()
+	if got := aggregatable(results); len(got) != 2 {
+		t.Errorf("aggregatable with --aggregate-warm-up = %d results, want 2", len(got))
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"tailscale.com/logtail/backoff"
+)
+
+// With --webhook-spool-dir, the payloads of webhooks are spooled to disk
+// before delivery rather than buffered in memory, and delivered from the
+// spool by a goroutine per webhook in batches of up to webhookSpoolBatch
+// payloads, oldest first, backing off up to webhookSpoolMaxBackoff while the
+// receiver is down. Payloads thereby survive receivers' maintenance windows
+// and restarts of stunstamp, which replays the spool on start. Delivery is at
+// least once: a batch whose request timed out after the receiver processed it
+// is delivered again.
+const (
+	webhookSpoolBatch = 100
+	// webhookSpoolMaxBackoff bounds the backoff between delivery attempts,
+	// and thereby the delay of replaying the spool once the receiver
+	// recovers.
+	webhookSpoolMaxBackoff = 5 * time.Minute
+	// webhookSpoolTimeout bounds every delivery attempt.
+	webhookSpoolTimeout = 30 * time.Second
+	webhookSpoolExt     = ".json"
+)
+
+// webhookSpool is the disk spool of the payloads of a webhook. It is safe for
+// concurrent use.
+type webhookSpool struct {
+	name string
+	dir  string
+	// maxBytes bounds the size of the spool, the oldest payloads being
+	// dropped to stay within it.
+	maxBytes int64
+	// send delivers a batch of payloads, oldest first, returning a
+	// recoverableErr if it should be retried. Payloads of batches failing
+	// with other errors are dropped.
+	send func(ctx context.Context, payloads [][]byte) error
+	wake chan struct{}
+
+	mu      sync.Mutex // serializes the naming of payloads
+	seq     int64
+	dropped atomic.Uint64
+}
+
+// newWebhookSpool returns the spool of the webhook name in a subdirectory of
+// dir, creating it if necessary. Payloads already in it are delivered once
+// run is called.
+func newWebhookSpool(dir, name string, maxBytes int64, send func(ctx context.Context, payloads [][]byte) error) (*webhookSpool, error) {
+	s := &webhookSpool{
+		name:     name,
+		dir:      filepath.Join(dir, name),
+		maxBytes: maxBytes,
+		send:     send,
+		wake:     make(chan struct{}, 1),
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, err
+	}
+	entries, err := s.entries()
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		s.seq = entries[len(entries)-1].seq
+		exportLog.Info("replaying webhook spool", "webhook", name, "payloads", len(entries))
+	}
+	return s, nil
+}
+
+// webhookSpoolDir returns the directory of the webhook spools in dir of the
+// process probing from the network namespace netns, if any, so that the
+// children of a --netns supervisor do not deliver each other's payloads.
+func webhookSpoolDir(dir, netns string) string {
+	if netns == "" {
+		return dir
+	}
+	return filepath.Join(dir, "netns-"+netns)
+}
+
+// spoolEntry is a payload in a webhookSpool.
+type spoolEntry struct {
+	seq  int64
+	size int64
+}
+
+func (s *webhookSpool) path(seq int64) string {
+	// Zero-padding sorts the files of payloads in order.
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, webhookSpoolExt))
+}
+
+// entries returns the payloads in the spool, oldest first.
+func (s *webhookSpool) entries() ([]spoolEntry, error) {
+	des, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ret []spoolEntry
+	for _, de := range des {
+		seq, err := strconv.ParseInt(strings.TrimSuffix(de.Name(), webhookSpoolExt), 10, 64)
+		if err != nil || !strings.HasSuffix(de.Name(), webhookSpoolExt) {
+			// e.g. the temporary file of a payload being written
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+		ret = append(ret, spoolEntry{seq: seq, size: fi.Size()})
+	}
+	return ret, nil
+}
+
+// enqueue spools payload for delivery, dropping the oldest payloads if the
+// spool would exceed maxBytes.
+func (s *webhookSpool) enqueue(payload []byte) error {
+	s.mu.Lock()
+	// Sequence numbers are times, so that payloads spooled after a restart
+	// sort after those spooled before.
+	s.seq = max(s.seq+1, time.Now().UnixNano())
+	seq := s.seq
+	s.mu.Unlock()
+	if err := writeFileAtomic(s.path(seq), payload); err != nil {
+		return fmt.Errorf("error spooling %s payload: %w", s.name, err)
+	}
+	if s.maxBytes > 0 {
+		entries, err := s.entries()
+		if err != nil {
+			return err
+		}
+		var total int64
+		for _, e := range entries {
+			total += e.size
+		}
+		for _, e := range entries {
+			if total <= s.maxBytes || e.seq == seq {
+				break
+			}
+			if err := os.Remove(s.path(e.seq)); err == nil {
+				s.dropped.Add(1)
+				exportLog.Warn("webhook spool full, dropped oldest payload", "webhook", s.name)
+			}
+			total -= e.size
+		}
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// run delivers the spool until ctx is done.
+func (s *webhookSpool) run(ctx context.Context) {
+	bo := backoff.NewBackoff(s.name+"-spool", logfOf(exportLog), webhookSpoolMaxBackoff)
+	var err error
+	for {
+		bo.BackOff(ctx, err)
+		if ctx.Err() != nil {
+			return
+		}
+		var n int
+		n, err = s.deliver(ctx)
+		if err != nil || n > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		}
+	}
+}
+
+// deliver sends the oldest batch of payloads, removing them from the spool
+// unless delivery failed with a recoverableErr. It returns the number of
+// payloads removed.
+func (s *webhookSpool) deliver(ctx context.Context) (int, error) {
+	entries, err := s.entries()
+	if err != nil {
+		return 0, recoverableErr{err}
+	}
+	entries = entries[:min(len(entries), webhookSpoolBatch)]
+	var payloads [][]byte
+	var sent []spoolEntry
+	for _, e := range entries {
+		b, err := os.ReadFile(s.path(e.seq))
+		if errors.Is(err, fs.ErrNotExist) {
+			// dropped by enqueue
+			continue
+		} else if err != nil {
+			return 0, recoverableErr{err}
+		}
+		payloads = append(payloads, b)
+		sent = append(sent, e)
+	}
+	if len(sent) == 0 {
+		return 0, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, webhookSpoolTimeout)
+	err = s.send(ctx, payloads)
+	cancel()
+	var re recoverableErr
+	if errors.As(err, &re) {
+		exportLog.Warn("webhook delivery error, keeping payloads spooled", "webhook", s.name, "payloads", len(sent), "err", err)
+		return 0, err
+	}
+	if err != nil {
+		s.dropped.Add(uint64(len(sent)))
+		exportLog.Error("webhook delivery error, dropped payloads", "webhook", s.name, "payloads", len(sent), "err", err)
+	}
+	for _, e := range sent {
+		os.Remove(s.path(e.seq))
+	}
+	return len(sent), nil
+}
+
+const (
+	webhookSpoolPayloadsMetricName = "stunstamp_webhook_spool_payloads"
+	webhookSpoolBytesMetricName    = "stunstamp_webhook_spool_bytes"
+	webhookSpoolDroppedMetricName  = "stunstamp_webhook_spool_dropped_payloads_total"
+)
+
+// toPromTimeSeries returns the number and size of the payloads awaiting
+// delivery in the spool, and the number dropped.
+func (s *webhookSpool) toPromTimeSeries(instance string, at time.Time) []prompb.TimeSeries {
+	entries, _ := s.entries()
+	var size int64
+	for _, e := range entries {
+		size += e.size
+	}
+	ts := []prompb.TimeSeries{
+		instanceTimeSeries(webhookSpoolPayloadsMetricName, instance, at, float64(len(entries))),
+		instanceTimeSeries(webhookSpoolBytesMetricName, instance, at, float64(size)),
+		instanceTimeSeries(webhookSpoolDroppedMetricName, instance, at, float64(s.dropped.Load())),
+	}
+	for i := range ts {
+		ts[i].Labels = append(ts[i].Labels, prompb.Label{Name: "webhook", Value: s.name})
+	}
+	return ts
+}
+
+// mergeWebhookPayloads returns the webhookPayloads in payloads merged into
+// as few as possible, those of consecutive payloads of the same instance and
+// network namespace concatenated.
+func mergeWebhookPayloads(payloads [][]byte) ([][]byte, error) {
+	var merged []webhookPayload
+	for _, b := range payloads {
+		var p webhookPayload
+		if err := json.Unmarshal(b, &p); err != nil {
+			return nil, err
+		}
+		if n := len(merged); n > 0 && merged[n-1].Instance == p.Instance && merged[n-1].Netns == p.Netns {
+			merged[n-1].Results = append(merged[n-1].Results, p.Results...)
+			continue
+		}
+		merged = append(merged, p)
+	}
+	return marshalAll(merged)
+}
+
+// mergeDERPMapWebhookPayloads returns the derpMapWebhookPayloads in payloads
+// merged into as few as possible, those of consecutive payloads of the same
+// instance concatenated.
+func mergeDERPMapWebhookPayloads(payloads [][]byte) ([][]byte, error) {
+	var merged []derpMapWebhookPayload
+	for _, b := range payloads {
+		var p derpMapWebhookPayload
+		if err := json.Unmarshal(b, &p); err != nil {
+			return nil, err
+		}
+		if n := len(merged); n > 0 && merged[n-1].Instance == p.Instance {
+			merged[n-1].Changes = append(merged[n-1].Changes, p.Changes...)
+			continue
+		}
+		merged = append(merged, p)
+	}
+	return marshalAll(merged)
+}
+
+func marshalAll[T any](vs []T) ([][]byte, error) {
+	ret := make([][]byte, 0, len(vs))
+	for _, v := range vs {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, b)
+	}
+	return ret, nil
+}
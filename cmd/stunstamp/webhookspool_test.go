@@ -0,0 +1,145 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookSpoolReplaysBatched(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		up       bool
+		requests int
+		got      []webhookPayload
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if !up {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		var p webhookPayload
+		json.NewDecoder(r.Body).Decode(&p)
+		got = append(got, p)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	wb := newWebhookBackend(srv.URL, "test")
+	var err error
+	wb.spool, err = newWebhookSpool(dir, "webhook", 1<<20, wb.sendSpooled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtt := time.Millisecond
+	for range 3 {
+		if err := wb.write(context.Background(), outputBatch{results: []result{{key: resultKey{protocol: protocolSTUN}, rtt: &rtt}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := wb.spool.deliver(context.Background()); n != 0 || err == nil {
+		t.Fatalf("deliver() while receiver down = %d, %v; want recoverable error", n, err)
+	}
+
+	// A restarted stunstamp replays the spool.
+	mu.Lock()
+	up = true
+	mu.Unlock()
+	spool, err := newWebhookSpool(dir, "webhook", 1<<20, wb.sendSpooled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go spool.run(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, err := spool.entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d payloads still spooled", len(entries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 2 {
+		t.Errorf("got %d requests, want 2", requests)
+	}
+	if len(got) != 1 || got[0].Instance != "test" || len(got[0].Results) != 3 {
+		t.Errorf("got payloads %+v, want one batch of 3 results", got)
+	}
+}
+
+func TestWebhookSpoolDrops(t *testing.T) {
+	var sends int
+	spool, err := newWebhookSpool(t.TempDir(), "webhook", 10, func(ctx context.Context, payloads [][]byte) error {
+		sends++
+		if len(payloads) != 1 || string(payloads[0]) != `"012345"` {
+			t.Errorf("send(%q), want the newest payload only", payloads)
+		}
+		return errors.New("bad request")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{`"0123"`, `"012345"`} {
+		if err := spool.enqueue([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := spool.dropped.Load(); got != 1 {
+		t.Errorf("dropped %d payloads beyond maxBytes, want 1", got)
+	}
+
+	// Payloads failing unrecoverably are dropped.
+	if n, err := spool.deliver(context.Background()); n != 1 || err != nil {
+		t.Errorf("deliver() = %d, %v; want 1, nil", n, err)
+	}
+	if entries, _ := spool.entries(); len(entries) != 0 || sends != 1 || spool.dropped.Load() != 2 {
+		t.Errorf("after deliver: %d spooled, %d sends, %d dropped; want 0, 1, 2", len(entries), sends, spool.dropped.Load())
+	}
+}
+
+func TestMergeWebhookPayloads(t *testing.T) {
+	var payloads [][]byte
+	for _, p := range []webhookPayload{
+		{Instance: "a", Results: []storedResult{{Hostname: "h1"}}},
+		{Instance: "a", Results: []storedResult{{Hostname: "h2"}}},
+		{Instance: "b", Results: []storedResult{{Hostname: "h3"}}},
+	} {
+		b, _ := json.Marshal(p)
+		payloads = append(payloads, b)
+	}
+	bodies, err := mergeWebhookPayloads(payloads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("got %d bodies, want 2", len(bodies))
+	}
+	var first webhookPayload
+	if err := json.Unmarshal(bodies[0], &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Instance != "a" || len(first.Results) != 2 {
+		t.Errorf("first body = %+v, want both results of instance a", first)
+	}
+}
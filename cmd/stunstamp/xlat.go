@@ -0,0 +1,93 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+)
+
+// Values of resultKey.xlat, describing address family translation on the
+// path to a target. Translation adds latency that would otherwise be
+// misattributed to the target.
+const (
+	// xlatCLAT is IPv4 traffic translated to IPv6 by a local 464XLAT
+	// customer-side translator (CLAT, RFC 6877).
+	xlatCLAT = "clat"
+	// xlatNAT64 is IPv6 traffic to an IPv4-embedded address (RFC 6052),
+	// i.e. an IPv4 target reached via NAT64.
+	xlatNAT64 = "nat64"
+)
+
+var (
+	// clatPrefix is reserved for the IPv4 addresses of CLATs (RFC 7335).
+	clatPrefix = netip.MustParsePrefix("192.0.0.0/29")
+	// nat64Prefixes are the well-known and local-use NAT64 prefixes
+	// (RFC 6052, RFC 8215).
+	nat64Prefixes = []netip.Prefix{
+		netip.MustParsePrefix("64:ff9b::/96"),
+		netip.MustParsePrefix("64:ff9b:1::/48"),
+	}
+)
+
+// clatSeen is set once a CLAT has been detected, after which stale markers
+// cover CLAT-tagged series.
+var clatSeen atomic.Bool
+
+// detectCLAT returns the name of the interface holding a CLAT address, if
+// any.
+func detectCLAT() (ifName string, ok bool) {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return "", false
+	}
+	for _, iface := range ifs {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip, ok := netip.AddrFromSlice(ipNet.IP); ok && clatPrefix.Contains(ip.Unmap()) {
+				return iface.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// viaCLAT reports whether the host sources IPv4 traffic to dst from a CLAT
+// address, i.e. whether it is routed via the CLAT. No packets are sent.
+func viaCLAT(dst netip.Addr) bool {
+	conn, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(dst, 9)))
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	return clatPrefix.Contains(conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap())
+}
+
+// xlatOf returns the translation traffic to dst undergoes, or the empty
+// string if none. clat is whether a CLAT is present.
+func xlatOf(dst netip.Addr, clat bool) string {
+	if dst.Is4() {
+		if clat && viaCLAT(dst) {
+			return xlatCLAT
+		}
+		return ""
+	}
+	for _, p := range nat64Prefixes {
+		if p.Contains(dst) {
+			return xlatNAT64
+		}
+	}
+	return ""
+}
@@ -0,0 +1,43 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestXlat(t *testing.T) {
+	for _, tt := range []struct {
+		dst  string
+		want string
+	}{
+		{"192.0.2.1", ""},
+		{"2001:db8::1", ""},
+		{"64:ff9b::c000:201", xlatNAT64},
+		{"64:ff9b:1::c000:201", xlatNAT64},
+	} {
+		if got := xlatOf(netip.MustParseAddr(tt.dst), false); got != tt.want {
+			t.Errorf("xlatOf(%s) = %q, want %q", tt.dst, got, tt.want)
+		}
+	}
+
+	k := resultKey{meta: nodeMeta{addr: netip.MustParseAddr("192.0.2.1")}, protocol: protocolSTUN, xlat: xlatCLAT}
+	var got string
+	labels := resultKeyLabels(rttMetricName, k, "i")
+	for i, l := range labels {
+		if i > 0 && labels[i-1].Name > l.Name {
+			t.Errorf("labels not sorted: %v", labels)
+		}
+		if l.Name == "xlat" {
+			got = l.Value
+		}
+	}
+	if got != xlatCLAT {
+		t.Errorf("xlat label = %q, want %q", got, xlatCLAT)
+	}
+	if r := storedResultFromResult(result{key: k}).toResult(); r.key.xlat != xlatCLAT {
+		t.Errorf("stored result xlat = %q, want %q", r.key.xlat, xlatCLAT)
+	}
+}
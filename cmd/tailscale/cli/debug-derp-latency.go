@@ -0,0 +1,215 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"tailscale.com/net/ktimestamp"
+	"tailscale.com/net/tlsdial"
+	"tailscale.com/tailcfg"
+)
+
+var debugDERPLatencyArgs struct {
+	count   int
+	timeout time.Duration
+	json    bool
+}
+
+// derpLatencyRow is one row of "tailscale debug derp-latency": the STUN
+// latency of one address family of one DERP node. Its Name is the node name
+// and its Target the STUN address probed.
+type derpLatencyRow struct {
+	RegionID   int
+	RegionCode string
+	Family     string // "IPv4" or "IPv6"
+	// Kernel is whether RTTs are timed by kernel timestamps.
+	Kernel bool `json:",omitempty"`
+	latencyCheck
+
+	node *tailcfg.DERPNode
+}
+
+// runDebugDERPLatency probes every STUN-capable node of the current DERP map
+// over IPv4 and IPv6 and prints their latency, fastest first.
+func runDebugDERPLatency(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	if debugDERPLatencyArgs.count < 1 {
+		return errors.New("-c must be positive")
+	}
+	dm, err := localClient.CurrentDERPMap(ctx)
+	if err != nil || len(dm.Regions) == 0 {
+		log.Printf("No DERP map from tailscaled; using default.")
+		hc := &http.Client{
+			Transport: tlsdial.NewTransport(),
+			Timeout:   10 * time.Second,
+		}
+		if dm, err = prodDERPMap(ctx, hc); err != nil {
+			return err
+		}
+	}
+
+	var rows []*derpLatencyRow
+	for _, r := range dm.Regions {
+		for _, n := range r.Nodes {
+			for _, family := range []string{"IPv4", "IPv6"} {
+				rows = append(rows, &derpLatencyRow{
+					RegionID:     r.RegionID,
+					RegionCode:   r.RegionCode,
+					Family:       family,
+					latencyCheck: latencyCheck{Name: n.Name},
+					node:         n,
+				})
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 16)
+	for _, row := range rows {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			row.probe(ctx)
+		}()
+	}
+	wg.Wait()
+	// Nodes without an address of a family, or with STUN disabled, are
+	// not worth a row.
+	rows = slices.DeleteFunc(rows, func(r *derpLatencyRow) bool { return r.Sent == 0 && r.Err == "" })
+	slices.SortFunc(rows, func(a, b *derpLatencyRow) int {
+		aLost, bLost := a.Lost == a.Sent || a.Err != "", b.Lost == b.Sent || b.Err != ""
+		if aLost != bLost {
+			if aLost {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Or(
+			cmp.Compare(a.MedianMs, b.MedianMs),
+			cmp.Compare(a.RegionID, b.RegionID),
+			cmp.Compare(a.Name, b.Name),
+			cmp.Compare(a.Family, b.Family),
+		)
+	})
+
+	if debugDERPLatencyArgs.json {
+		j, err := json.MarshalIndent(struct{ Nodes []*derpLatencyRow }{rows}, "", "  ")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+		return nil
+	}
+	w := tabwriter.NewWriter(Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "REGION\tNODE\tFAMILY\tADDRESS\tMIN\tMEDIAN\tMAX\tLOSS")
+	for _, r := range rows {
+		region := fmt.Sprintf("%d-%s", r.RegionID, r.RegionCode)
+		switch {
+		case r.Err != "":
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\terror: %s\n", region, r.Name, r.Family, r.Target, r.Err)
+		case r.Lost == r.Sent:
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t-\t-\t-\t100%%\n", region, r.Name, r.Family, r.Target)
+		default:
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%.2fms\t%.2fms\t%.2fms\t%.0f%%\n", region, r.Name, r.Family, r.Target,
+				r.MinMs, r.MedianMs, r.MaxMs, 100*float64(r.Lost)/float64(r.Sent))
+		}
+	}
+	return nil
+}
+
+// probe measures the STUN RTT of the address of r's node of r's family, if
+// any, count times, timed by kernel timestamps where available.
+func (r *derpLatencyRow) probe(ctx context.Context) {
+	network := "udp4"
+	if r.Family == "IPv6" {
+		network = "udp6"
+	}
+	dst, err := derpNodeSTUNAddr(ctx, r.node, network)
+	if err != nil {
+		r.Err = err.Error()
+		return
+	}
+	if !dst.IsValid() {
+		return
+	}
+	r.Target = dst.String()
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		r.Err = err.Error()
+		return
+	}
+	defer conn.Close()
+	p := ktimestamp.NewProber(conn)
+	r.Kernel = p.Kernel()
+
+	var rtts []time.Duration
+	for range debugDERPLatencyArgs.count {
+		r.Sent++
+		pctx, cancel := context.WithTimeout(ctx, debugDERPLatencyArgs.timeout)
+		m, err := p.Probe(pctx, dst)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				r.Err = ctx.Err().Error()
+				return
+			}
+			continue // counted as lost
+		}
+		rtts = append(rtts, m.RTT)
+	}
+	r.summarize(rtts)
+}
+
+// derpNodeSTUNAddr returns the STUN address of n for network "udp4" or
+// "udp6", or the zero value if it has none, resolving its hostname if its
+// address of the family is not set.
+func derpNodeSTUNAddr(ctx context.Context, n *tailcfg.DERPNode, network string) (netip.AddrPort, error) {
+	port := cmp.Or(n.STUNPort, 3478)
+	if port < 0 || port > 1<<16-1 {
+		return netip.AddrPort{}, nil
+	}
+	is4 := network == "udp4"
+	s := n.IPv6
+	if is4 {
+		s = n.IPv4
+	}
+	if s != "" {
+		ip, err := netip.ParseAddr(s)
+		if err != nil || ip.Is4() != is4 {
+			// Such as "none", to disable the family.
+			return netip.AddrPort{}, nil
+		}
+		return netip.AddrPortFrom(ip, uint16(port)), nil
+	}
+	ipNetwork := "ip6"
+	if is4 {
+		ipNetwork = "ip4"
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, ipNetwork, n.HostName)
+	if err != nil {
+		if !is4 {
+			// Nodes without AAAA records are common.
+			return netip.AddrPort{}, nil
+		}
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(ips[0].Unmap(), uint16(port)), nil
+}
@@ -0,0 +1,39 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"tailscale.com/net/stun/stuntest"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+)
+
+func TestDERPLatencyRowProbe(t *testing.T) {
+	stunAddr, cleanup := stuntest.Serve(t)
+	defer cleanup()
+	tstest.Replace(t, &debugDERPLatencyArgs.count, 3)
+	tstest.Replace(t, &debugDERPLatencyArgs.timeout, 2*time.Second)
+
+	n := &tailcfg.DERPNode{Name: "1a", IPv4: "127.0.0.1", IPv6: "none", STUNPort: stunAddr.Port}
+	r := &derpLatencyRow{Family: "IPv4", node: n}
+	r.probe(context.Background())
+	if r.Err != "" || r.Sent != 3 || r.Lost != 0 || r.MinMs <= 0 {
+		t.Errorf("got %+v", r.latencyCheck)
+	}
+	if want := fmt.Sprintf("127.0.0.1:%d", stunAddr.Port); r.Target != want {
+		t.Errorf("got target %q, want %q", r.Target, want)
+	}
+
+	// IPv6 is disabled on the node, so it is not probed.
+	r = &derpLatencyRow{Family: "IPv6", node: n}
+	r.probe(context.Background())
+	if r.Sent != 0 || r.Err != "" {
+		t.Errorf("got %+v for disabled IPv6", r.latencyCheck)
+	}
+}
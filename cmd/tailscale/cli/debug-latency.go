@@ -0,0 +1,286 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netmon"
+	"tailscale.com/net/ping"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+)
+
+var debugLatencyArgs struct {
+	count    int
+	timeout  time.Duration
+	maxPeers int
+	json     bool
+}
+
+// latencyCheck is the outcome of one check of "tailscale debug latency".
+type latencyCheck struct {
+	Name   string
+	Target string `json:",omitempty"`
+	Sent   int
+	Lost   int
+	// MinMs, MedianMs, and MaxMs summarize the RTTs of successful probes.
+	MinMs    float64 `json:",omitempty"`
+	MedianMs float64 `json:",omitempty"`
+	MaxMs    float64 `json:",omitempty"`
+	Err      string  `json:",omitempty"`
+}
+
+func (c *latencyCheck) summarize(rtts []time.Duration) {
+	c.Lost = c.Sent - len(rtts)
+	if len(rtts) == 0 {
+		return
+	}
+	slices.Sort(rtts)
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	c.MinMs = ms(rtts[0])
+	c.MaxMs = ms(rtts[len(rtts)-1])
+	if len(rtts)%2 == 1 {
+		c.MedianMs = ms(rtts[len(rtts)/2])
+	} else {
+		c.MedianMs = ms((rtts[len(rtts)/2-1] + rtts[len(rtts)/2]) / 2)
+	}
+}
+
+func (c *latencyCheck) String() string {
+	s := c.Name
+	if c.Target != "" {
+		s += " (" + c.Target + ")"
+	}
+	if c.Err != "" {
+		return s + ": error: " + c.Err
+	}
+	if c.Lost == c.Sent {
+		return fmt.Sprintf("%s: %d/%d lost", s, c.Lost, c.Sent)
+	}
+	return fmt.Sprintf("%s: min %.2fms, median %.2fms, max %.2fms, %d/%d lost", s, c.MinMs, c.MedianMs, c.MaxMs, c.Lost, c.Sent)
+}
+
+// runDebugLatency runs a one-shot latency assessment: STUN to the current
+// home DERP region, ICMP to the likely home router, and an in-tunnel ping to
+// the slowest of the online peers.
+func runDebugLatency(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	if debugLatencyArgs.count < 1 {
+		return errors.New("-c must be positive")
+	}
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	checks := []*latencyCheck{
+		latencyCheckDERPHome(ctx, st),
+		latencyCheckGateway(ctx),
+		latencyCheckSlowestPeer(ctx, st),
+	}
+	if debugLatencyArgs.json {
+		j, err := json.MarshalIndent(struct{ Checks []*latencyCheck }{checks}, "", "  ")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+		return nil
+	}
+	for _, c := range checks {
+		outln(c.String())
+	}
+	return nil
+}
+
+// latencyCheckDERPHome measures the STUN RTT to the first STUN-capable node
+// in the home DERP region.
+func latencyCheckDERPHome(ctx context.Context, st *ipnstate.Status) *latencyCheck {
+	c := &latencyCheck{Name: "STUN to home DERP"}
+	if st.Self == nil || st.Self.Relay == "" {
+		c.Err = "no home DERP region"
+		return c
+	}
+	dm, err := localClient.CurrentDERPMap(ctx)
+	if err != nil {
+		c.Err = err.Error()
+		return c
+	}
+	var node *tailcfg.DERPNode
+	for _, r := range dm.Regions {
+		if r.RegionCode != st.Self.Relay {
+			continue
+		}
+		for _, n := range r.Nodes {
+			if n.STUNPort >= 0 {
+				node = n
+				break
+			}
+		}
+	}
+	if node == nil {
+		c.Err = fmt.Sprintf("no STUN node in home DERP region %q", st.Self.Relay)
+		return c
+	}
+	host := node.HostName
+	if node.IPv4 != "" && node.IPv4 != "none" {
+		host = node.IPv4
+	}
+	port := node.STUNPort
+	if port == 0 {
+		port = 3478
+	}
+	dst, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		c.Err = err.Error()
+		return c
+	}
+	c.Target = fmt.Sprintf("%s, %s", node.Name, dst)
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		c.Err = err.Error()
+		return c
+	}
+	defer conn.Close()
+
+	var rtts []time.Duration
+	buf := make([]byte, 1500)
+	for range debugLatencyArgs.count {
+		c.Sent++
+		txID := stun.NewTxID()
+		start := time.Now()
+		if _, err := conn.WriteTo(stun.Request(txID), dst); err != nil {
+			c.Err = err.Error()
+			return c
+		}
+		conn.SetReadDeadline(start.Add(debugLatencyArgs.timeout))
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break // timeout, counted as lost
+			}
+			if got, _, err := stun.ParseResponse(buf[:n]); err == nil && got == txID {
+				rtts = append(rtts, time.Since(start))
+				break
+			}
+		}
+	}
+	c.summarize(rtts)
+	return c
+}
+
+// latencyCheckGateway measures the ICMP RTT to the likely home router. It
+// typically requires elevated privileges.
+func latencyCheckGateway(ctx context.Context) *latencyCheck {
+	c := &latencyCheck{Name: "ICMP to gateway"}
+	gw, _, ok := netmon.LikelyHomeRouterIP()
+	if !ok {
+		c.Err = "no gateway found"
+		return c
+	}
+	c.Target = gw.String()
+	p := ping.New(ctx, nil, &net.ListenConfig{})
+	defer p.Close()
+	var rtts []time.Duration
+	for range debugLatencyArgs.count {
+		c.Sent++
+		pctx, cancel := context.WithTimeout(ctx, debugLatencyArgs.timeout)
+		rtt, err := p.Send(pctx, &net.IPAddr{IP: gw.AsSlice()}, nil)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, context.DeadlineExceeded) {
+				c.Err = err.Error()
+				return c
+			}
+			continue
+		}
+		rtts = append(rtts, rtt)
+	}
+	c.summarize(rtts)
+	return c
+}
+
+// latencyCheckSlowestPeer pings up to maxPeers online peers once through the
+// tunnel, then pings the slowest of them count times.
+func latencyCheckSlowestPeer(ctx context.Context, st *ipnstate.Status) *latencyCheck {
+	c := &latencyCheck{Name: "ping to slowest peer"}
+	type peer struct {
+		name string
+		ip   netip.Addr
+		rtt  time.Duration
+	}
+	var peers []*peer
+	for _, ps := range st.Peer {
+		if !ps.Online || len(ps.TailscaleIPs) == 0 || len(peers) == debugLatencyArgs.maxPeers {
+			continue
+		}
+		peers = append(peers, &peer{name: ps.HostName, ip: ps.TailscaleIPs[0]})
+	}
+	if len(peers) == 0 {
+		c.Err = "no online peers"
+		return c
+	}
+
+	pingOnce := func(ip netip.Addr) (time.Duration, error) {
+		pctx, cancel := context.WithTimeout(ctx, debugLatencyArgs.timeout)
+		defer cancel()
+		pr, err := localClient.Ping(pctx, ip, tailcfg.PingICMP)
+		if err != nil {
+			return 0, err
+		}
+		if pr.Err != "" {
+			return 0, errors.New(pr.Err)
+		}
+		return time.Duration(pr.LatencySeconds * float64(time.Second)), nil
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 8)
+	for _, p := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			rtt, err := pingOnce(p.ip)
+			if err != nil {
+				// Unreachable peers are not candidates; their loss is
+				// not a latency measurement.
+				rtt = -1
+			}
+			p.rtt = rtt
+		}()
+	}
+	wg.Wait()
+	slowest := slices.MaxFunc(peers, func(a, b *peer) int {
+		return cmp.Compare(a.rtt, b.rtt)
+	})
+	if slowest.rtt < 0 {
+		c.Err = fmt.Sprintf("none of %d online peers responded", len(peers))
+		return c
+	}
+	c.Target = fmt.Sprintf("%s, %s", slowest.name, slowest.ip)
+
+	var rtts []time.Duration
+	for range debugLatencyArgs.count {
+		c.Sent++
+		if rtt, err := pingOnce(slowest.ip); err == nil {
+			rtts = append(rtts, rtt)
+		}
+	}
+	c.summarize(rtts)
+	return c
+}
@@ -271,6 +271,25 @@
 				return fs
 			})(),
 		},
+		{
+			Name:       "derp-latency",
+			ShortUsage: "tailscale debug derp-latency",
+			Exec:       runDebugDERPLatency,
+			ShortHelp:  "Print the STUN latency of every DERP node",
+			LongHelp: strings.TrimSpace(`
+The 'tailscale debug derp-latency' command probes every node of the current
+DERP map over STUN, on IPv4 and IPv6, and prints a table of their latency and
+packet loss, fastest first. RTTs are timed by kernel timestamps where the
+platform supports them.
+`),
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("derp-latency")
+				fs.IntVar(&debugDERPLatencyArgs.count, "c", 5, "number of probes per node and address family")
+				fs.DurationVar(&debugDERPLatencyArgs.timeout, "timeout", 2*time.Second, "timeout of each probe")
+				fs.BoolVar(&debugDERPLatencyArgs.json, "json", false, "output in JSON format")
+				return fs
+			})(),
+		},
 		{
 			Name:       "derp",
 			ShortUsage: "tailscale debug derp",
@@ -331,6 +350,26 @@
 				return fs
 			})(),
 		},
+		{
+			Name:       "latency",
+			ShortUsage: "tailscale debug latency",
+			Exec:       runDebugLatency,
+			ShortHelp:  "Run a one-shot latency assessment",
+			LongHelp: strings.TrimSpace(`
+The 'tailscale debug latency' command measures the STUN RTT to the home DERP
+region, the ICMP RTT to the likely home router (typically requires elevated
+privileges), and the in-tunnel ICMP RTT to the slowest of the online peers,
+and prints a summary of each.
+`),
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("latency")
+				fs.IntVar(&debugLatencyArgs.count, "c", 5, "number of probes per check")
+				fs.DurationVar(&debugLatencyArgs.timeout, "timeout", 2*time.Second, "timeout of each probe")
+				fs.IntVar(&debugLatencyArgs.maxPeers, "max-peers", 32, "maximum number of online peers to consider when finding the slowest")
+				fs.BoolVar(&debugLatencyArgs.json, "json", false, "output in JSON format")
+				return fs
+			})(),
+		},
 		{
 			Name:       "go-buildinfo",
 			ShortUsage: "tailscale debug go-buildinfo",
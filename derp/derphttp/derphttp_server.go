@@ -10,6 +10,7 @@
 	"strings"
 
 	"tailscale.com/derp"
+	"tailscale.com/types/logger"
 )
 
 // fastStartHeader is the header (with value "1") that signals to the HTTP
@@ -73,9 +74,29 @@ func Handler(s *derp.Server) http.Handler {
 // ProbeHandler is the endpoint that clients without UDP access (including js/wasm) hit to measure
 // DERP latency, as a replacement for UDP STUN queries.
 func ProbeHandler(w http.ResponseWriter, r *http.Request) {
+	probe(w, r, nil)
+}
+
+// ProbeHandlerWithLogf is like ProbeHandler, but also logs the measurement
+// IDs of probes carrying one to logf, along with the client's address.
+// Probes are unauthenticated, so logf should be rate limited, e.g. with
+// logger.RateLimitedFn.
+func ProbeHandlerWithLogf(logf logger.Logf) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		probe(w, r, logf)
+	}
+}
+
+func probe(w http.ResponseWriter, r *http.Request, logf logger.Logf) {
 	switch r.Method {
 	case "HEAD", "GET":
 		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if id := r.Header.Get(ProbeMeasurementIDHeader); id != "" && isSafeHeaderToken(id) {
+			w.Header().Set(ProbeMeasurementIDHeader, id)
+			if logf != nil {
+				logf("derp probe measurement %s from %s", id, r.RemoteAddr)
+			}
+		}
 	default:
 		http.Error(w, "bogus probe method", http.StatusMethodNotAllowed)
 	}
@@ -85,16 +106,21 @@ func ProbeHandler(w http.ResponseWriter, r *http.Request) {
 // captive portal detection.
 func ServeNoContent(w http.ResponseWriter, r *http.Request) {
 	if challenge := r.Header.Get(NoContentChallengeHeader); challenge != "" {
-		badChar := strings.IndexFunc(challenge, func(r rune) bool {
-			return !isChallengeChar(r)
-		}) != -1
-		if len(challenge) <= 64 && !badChar {
+		if isSafeHeaderToken(challenge) {
 			w.Header().Set(NoContentResponseHeader, "response "+challenge)
 		}
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// isSafeHeaderToken reports whether s is short and made of characters safe
+// to echo in a header or log.
+func isSafeHeaderToken(s string) bool {
+	return len(s) <= 64 && strings.IndexFunc(s, func(r rune) bool {
+		return !isChallengeChar(r)
+	}) == -1
+}
+
 func isChallengeChar(c rune) bool {
 	// Semi-randomly chosen as a limited set of valid characters
 	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') ||
@@ -105,4 +131,11 @@ func isChallengeChar(c rune) bool {
 const (
 	NoContentChallengeHeader = "X-Tailscale-Challenge"
 	NoContentResponseHeader  = "X-Tailscale-Response"
+
+	// ProbeMeasurementIDHeader is the optional header of probe requests
+	// carrying a client-side measurement ID, e.g. from cmd/stunstamp.
+	// ProbeHandler echoes valid IDs in the response, and
+	// ProbeHandlerWithLogf also logs them along with the client's address, so
+	// that server-side logs can be joined with client-side measurements.
+	ProbeMeasurementIDHeader = "X-Tailscale-Measurement-Id"
 )
@@ -11,6 +11,8 @@
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -485,3 +487,41 @@ func TestProbe(t *testing.T) {
 		}
 	}
 }
+
+func TestProbeMeasurementID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"", ""},
+		{"0123456789abcdef", "0123456789abcdef"},
+		{"bad id\r\n", ""},
+		{strings.Repeat("a", 65), ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/derp/latency-check", nil)
+		req.Header.Set(ProbeMeasurementIDHeader, tt.id)
+		ProbeHandler(rec, req)
+		if got := rec.Result().Header.Get(ProbeMeasurementIDHeader); got != tt.want {
+			t.Errorf("for ID %q got echoed ID %q; want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestProbeHandlerWithLogf(t *testing.T) {
+	var logged []string
+	h := ProbeHandlerWithLogf(func(format string, args ...any) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	})
+	for _, id := range []string{"", "0123456789abcdef", "bad id\r\n"} {
+		req := httptest.NewRequest("GET", "/derp/probe", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set(ProbeMeasurementIDHeader, id)
+		h(httptest.NewRecorder(), req)
+	}
+	want := []string{"derp probe measurement 0123456789abcdef from 192.0.2.1:1234"}
+	if !slices.Equal(logged, want) {
+		t.Errorf("logged %q; want %q", logged, want)
+	}
+}
@@ -30,6 +30,9 @@
 	// "relay server 10 failed to connect".
 	ArgDERPRegionName Arg = "derp-region-name"
 
+	// ArgLatencyIncrease provides a Warnable with how much a latency exceeds its baseline.
+	ArgLatencyIncrease Arg = "latency-increase"
+
 	// ArgServerName provides a Warnable with the hostname of a server involved in the unhealthy state.
 	ArgServerName Arg = "server-name"
 
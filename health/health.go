@@ -101,6 +101,7 @@ type Tracker struct {
 	derpRegionConnected     map[int]bool
 	derpRegionHealthProblem map[int]string
 	derpRegionLastFrame     map[int]time.Time
+	derpRegionLatency       map[int]*derpLatencyStats
 	derpMap                 *tailcfg.DERPMap // last DERP map from control, could be nil if never received one
 	lastMapRequestHeard     time.Time        // time we got a 200 from control for a MapRequest
 	ipnState                string
@@ -831,6 +832,11 @@ func (t *Tracker) SetAnyInterfaceUp(up bool) {
 	}
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	if wasUp, ok := t.anyInterfaceUp.Get(); !up || (ok && !wasUp) {
+		// The network the baselines were measured on may not be the one
+		// coming back up.
+		t.resetDERPRegionLatencyLocked()
+	}
 	t.anyInterfaceUp.Set(up)
 	t.selfCheckLocked()
 }
@@ -1057,6 +1063,20 @@ func (t *Tracker) updateBuiltinWarnablesLocked() {
 		})
 	}
 
+	if s := t.derpRegionLatency[homeDERP]; s != nil && homeDERP != 0 {
+		if increase, degraded := s.degradation(); degraded {
+			t.setUnhealthyLocked(derpLatencyDegradedWarnable, Args{
+				ArgDERPRegionID:    fmt.Sprint(homeDERP),
+				ArgDERPRegionName:  t.derpRegionNameLocked(homeDERP),
+				ArgLatencyIncrease: increase.Round(time.Millisecond).String(),
+			})
+		} else {
+			t.setHealthyLocked(derpLatencyDegradedWarnable)
+		}
+	} else {
+		t.setHealthyLocked(derpLatencyDegradedWarnable)
+	}
+
 	if !t.ipnWantRunning {
 		t.setUnhealthyLocked(IPNStateWarnable, Args{
 			"State": t.ipnState,
@@ -348,3 +348,96 @@ func TestShowUpdateWarnable(t *testing.T) {
 		})
 	}
 }
+
+func TestDERPLatencyDegraded(t *testing.T) {
+	var s derpLatencyStats
+	for range derpLatencyMinSamples - 1 {
+		s.add(30 * time.Millisecond)
+	}
+	if _, degraded := s.degradation(); degraded {
+		t.Fatal("degraded before baseline established")
+	}
+	s.add(30 * time.Millisecond)
+	// A single slow sample is not a degradation.
+	s.add(300 * time.Millisecond)
+	if _, degraded := s.degradation(); degraded {
+		t.Error("degraded after a single slow sample")
+	}
+	for range derpLatencyRecentSamples {
+		s.add(70 * time.Millisecond)
+	}
+	increase, degraded := s.degradation()
+	if !degraded || increase < 30*time.Millisecond || increase > 40*time.Millisecond {
+		t.Errorf("degradation() = %v, %v; want ~+35ms, true", increase, degraded)
+	}
+
+	ht := Tracker{}
+	ht.SetIPNState("Running", true)
+	ht.SetMagicSockDERPHome(1, false)
+	ht.SetDERPRegionConnectedState(1, true)
+	for range derpLatencyMinSamples {
+		ht.NoteDERPRegionLatencies(map[int]time.Duration{1: 30 * time.Millisecond, 2: 30 * time.Millisecond})
+	}
+	// The warning is not visible for a while, so inspect it directly.
+	isDegraded := func() bool {
+		ht.mu.Lock()
+		defer ht.mu.Unlock()
+		return ht.warnableVal[derpLatencyDegradedWarnable] != nil
+	}
+	if isDegraded() {
+		t.Fatal("unexpected degraded warning at baseline")
+	}
+	// Only the home region is warned about.
+	for range derpLatencyRecentSamples {
+		ht.NoteDERPRegionLatencies(map[int]time.Duration{1: 30 * time.Millisecond, 2: 100 * time.Millisecond})
+	}
+	if isDegraded() {
+		t.Fatal("unexpected degraded warning for non-home region")
+	}
+	for range derpLatencyRecentSamples {
+		ht.NoteDERPRegionLatencies(map[int]time.Duration{1: 100 * time.Millisecond})
+	}
+	if !isDegraded() {
+		t.Fatal("no degraded warning for home region")
+	}
+}
+
+func TestDERPLatencyBaselineResetOnLinkChange(t *testing.T) {
+	ht := Tracker{}
+	ht.SetIPNState("Running", true)
+	ht.SetMagicSockDERPHome(1, false)
+	ht.SetDERPRegionConnectedState(1, true)
+	isDegraded := func() bool {
+		ht.mu.Lock()
+		defer ht.mu.Unlock()
+		return ht.warnableVal[derpLatencyDegradedWarnable] != nil
+	}
+	noteLatencies := func(d time.Duration, n int) {
+		for range n {
+			ht.NoteDERPRegionLatencies(map[int]time.Duration{1: d})
+		}
+	}
+	noteLatencies(30*time.Millisecond, derpLatencyMinSamples)
+
+	// A new network with a slower path to the home region is not a
+	// degradation of the old one.
+	ht.NoteMajorLinkChange()
+	noteLatencies(100*time.Millisecond, derpLatencyMinSamples+derpLatencyRecentSamples)
+	if isDegraded() {
+		t.Fatal("unexpected degraded warning after major link change")
+	}
+
+	// Nor is the network coming back up after being down.
+	ht.SetAnyInterfaceUp(false)
+	ht.SetAnyInterfaceUp(true)
+	noteLatencies(200*time.Millisecond, derpLatencyMinSamples+derpLatencyRecentSamples)
+	if isDegraded() {
+		t.Fatal("unexpected degraded warning after network down and up")
+	}
+
+	// Without a change, the same increase is.
+	noteLatencies(400*time.Millisecond, derpLatencyRecentSamples)
+	if !isDegraded() {
+		t.Fatal("no degraded warning without link change")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package health
+
+import (
+	"slices"
+	"time"
+
+	"tailscale.com/util/mak"
+)
+
+const (
+	// derpLatencyMinSamples is the number of samples of a region's latency
+	// required before its baseline is trusted.
+	derpLatencyMinSamples = 10
+	// derpLatencyRecentSamples is the number of most recent samples whose
+	// median is compared against the baseline, so that a single slow
+	// netcheck does not trigger a warning.
+	derpLatencyRecentSamples = 5
+	// derpLatencyBaselineWeight is the weight of each new sample in the
+	// exponentially weighted moving average baseline. With netchecks every
+	// ~25s, a sustained change becomes the new baseline over about an hour.
+	derpLatencyBaselineWeight = 0.02
+	// derpLatencyMinIncrease and derpLatencyMinIncreaseRatio are the
+	// absolute and relative increases over baseline that are both required
+	// for a path to be considered degraded.
+	derpLatencyMinIncrease      = 20 * time.Millisecond
+	derpLatencyMinIncreaseRatio = 0.5
+)
+
+// derpLatencyStats tracks the latency of a DERP region against its baseline.
+type derpLatencyStats struct {
+	n        int
+	baseline float64         // nanoseconds
+	recent   []time.Duration // most recent first, up to derpLatencyRecentSamples
+}
+
+func (s *derpLatencyStats) add(d time.Duration) {
+	s.n++
+	// Average the first samples evenly, so that the baseline is established
+	// quickly.
+	w := derpLatencyBaselineWeight
+	if s.n <= derpLatencyMinSamples {
+		w = 1 / float64(s.n)
+	}
+	s.baseline += w * (float64(d) - s.baseline)
+	s.recent = slices.Insert(s.recent, 0, d)
+	s.recent = s.recent[:min(len(s.recent), derpLatencyRecentSamples)]
+}
+
+// degradation returns how much recent latency exceeds the baseline, and
+// whether that amounts to a degraded path.
+func (s *derpLatencyStats) degradation() (increase time.Duration, degraded bool) {
+	if s.n < derpLatencyMinSamples {
+		return 0, false
+	}
+	sorted := slices.Clone(s.recent)
+	slices.Sort(sorted)
+	baseline := time.Duration(s.baseline)
+	increase = sorted[len(sorted)/2] - baseline
+	return increase, increase >= max(derpLatencyMinIncrease, time.Duration(float64(baseline)*derpLatencyMinIncreaseRatio))
+}
+
+// NoteDERPRegionLatencies notes the latencies of DERP regions measured by
+// netcheck. The latency of the home region is tracked against a moving
+// baseline, and derpLatencyDegradedWarnable raised when recent latency
+// exceeds it significantly.
+func (t *Tracker) NoteDERPRegionLatencies(latencies map[int]time.Duration) {
+	if t.nil() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for region, d := range latencies {
+		s := t.derpRegionLatency[region]
+		if s == nil {
+			s = new(derpLatencyStats)
+			mak.Set(&t.derpRegionLatency, region, s)
+		}
+		s.add(d)
+	}
+	t.selfCheckLocked()
+}
+
+// NoteMajorLinkChange notes a major change of the network, e.g. to another
+// Wi-Fi network or from Wi-Fi to cellular. DERP latencies are tracked against
+// new baselines afterwards, as those of the previous network say nothing
+// about this one.
+func (t *Tracker) NoteMajorLinkChange() {
+	if t.nil() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.resetDERPRegionLatencyLocked()
+	t.selfCheckLocked()
+}
+
+// resetDERPRegionLatencyLocked forgets the latency baselines of all DERP
+// regions. t.mu must be held.
+func (t *Tracker) resetDERPRegionLatencyLocked() {
+	clear(t.derpRegionLatency)
+}
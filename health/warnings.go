@@ -176,6 +176,26 @@
 	},
 })
 
+// derpLatencyDegradedWarnable is a Warnable that warns the user that the latency to the home DERP region
+// significantly exceeds its baseline, as measured by netcheck.
+var derpLatencyDegradedWarnable = Register(&Warnable{
+	Code:     "derp-latency-degraded",
+	Title:    "Degraded path to relay server",
+	Severity: SeverityLow,
+	DependsOn: []*Warnable{
+		NetworkStatusWarnable,
+		noDERPConnectionWarnable,
+	},
+	Text: func(args Args) string {
+		if n := args[ArgDERPRegionName]; n != "" {
+			return fmt.Sprintf("Degraded path to the '%s' relay server (+%s over baseline). Relayed connections might experience higher latency.", n, args[ArgLatencyIncrease])
+		} else {
+			return fmt.Sprintf("Degraded path to the relay server with ID '%s' (+%s over baseline). Relayed connections might experience higher latency.", args[ArgDERPRegionID], args[ArgLatencyIncrease])
+		}
+	},
+	TimeToVisible: time.Minute,
+})
+
 // noUDP4BindWarnable is a Warnable that warns the user that Tailscale couldn't listen for incoming UDP connections.
 var noUDP4BindWarnable = Register(&Warnable{
 	Code:                "no-udp4-bind",
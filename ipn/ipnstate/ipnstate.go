@@ -53,6 +53,10 @@ type Status struct {
 	// If nil, an exit node is not in use.
 	ExitNodeStatus *ExitNodeStatus `json:"ExitNodeStatus,omitempty"`
 
+	// Hairpin describes whether the NAT of the current network
+	// hairpins. If nil, it has not been determined.
+	Hairpin *HairpinStatus `json:",omitempty"`
+
 	// Health contains health check problems.
 	// Empty means everything is good. (or at least that no known
 	// problems are detected)
@@ -188,6 +192,51 @@ type ExitNodeStatus struct {
 	TailscaleIPs []netip.Prefix
 }
 
+// CandidateStatus describes a candidate direct endpoint of a peer and the
+// latency measured to it by disco pings, whether or not it is the endpoint
+// in use.
+type CandidateStatus struct {
+	Addr netip.AddrPort
+
+	// Best is whether Addr is the endpoint currently in use.
+	Best bool `json:",omitempty"`
+
+	// Latency is the most recently measured latency to Addr, and
+	// MinLatency the lowest of the recent measurements. Both are zero
+	// if Addr has not replied to a ping.
+	Latency    time.Duration `json:",omitempty"`
+	MinLatency time.Duration `json:",omitempty"`
+
+	// Pongs is the number of recent measurements.
+	Pongs int `json:",omitempty"`
+
+	// LastPing is when Addr was last pinged, and LastPong when it last
+	// replied.
+	LastPing time.Time
+	LastPong time.Time
+}
+
+// HairpinStatus describes whether the NAT of a network hairpins, i.e. forwards
+// packets sent from inside it to its own public address back inside. Without
+// hairpinning, peers behind the same NAT (commonly a CGNAT) cannot reach each
+// other at their public addresses, and must find a LAN path or use DERP.
+type HairpinStatus struct {
+	// Network identifies the network: the default route interface and the
+	// public IPv4 address of this node on it.
+	Network string
+
+	// HairPinning is whether a packet sent to the public address of this
+	// node came back to it.
+	HairPinning bool
+
+	// Since is when HairPinning was first determined to be its current
+	// value on Network.
+	Since time.Time
+
+	// LastChecked is when HairPinning was last determined.
+	LastChecked time.Time
+}
+
 func (s *Status) Peers() []key.NodePublic {
 	kk := make([]key.NodePublic, 0, len(s.Peer))
 	for k := range s.Peer {
@@ -250,6 +299,11 @@ type PeerStatus struct {
 	CurAddr string // one of Addrs, or unique if roaming
 	Relay   string // DERP region
 
+	// Candidates are the direct endpoints of the node being considered
+	// by magicsock, with their most recently measured latency, sorted by
+	// address.
+	Candidates []CandidateStatus `json:",omitempty"`
+
 	RxBytes        int64
 	TxBytes        int64
 	Created        time.Time // time registered with tailcontrol
@@ -455,6 +509,9 @@ func (sb *StatusBuilder) AddPeer(peer key.NodePublic, st *PeerStatus) {
 	if v := st.CurAddr; v != "" {
 		e.CurAddr = v
 	}
+	if v := st.Candidates; v != nil {
+		e.Candidates = v
+	}
 	if v := st.RxBytes; v != 0 {
 		e.RxBytes = v
 	}
@@ -744,6 +801,33 @@ type DebugDERPRegionReport struct {
 	Errors   []string
 }
 
+// DebugNetcheckKernelReport is the result of a netcheck timed by kernel
+// RX/TX timestamps, as returned by the LocalAPI's
+// debug-kernel-netcheck method.
+type DebugNetcheckKernelReport struct {
+	// KernelTimestamps is whether RTTs are timed by kernel timestamps. If
+	// false, they are unavailable on this platform and RTTs are timed in
+	// userspace, as by netcheck.
+	KernelTimestamps bool
+	// Regions holds the regions that responded to STUN, fastest first.
+	Regions []DebugNetcheckKernelRegion
+	Errors  []string
+}
+
+// DebugNetcheckKernelRegion is the STUN RTT of a DERP region.
+type DebugNetcheckKernelRegion struct {
+	RegionID   int
+	RegionCode string
+	// Node and Addr are the node and address of the fastest response.
+	Node string
+	Addr netip.AddrPort
+	// RTT is the fastest round-trip time, timed by kernel timestamps if
+	// the report's KernelTimestamps is set.
+	RTT time.Duration
+	// UserspaceRTT is the same round trip as timed in userspace.
+	UserspaceRTT time.Duration
+}
+
 type SelfUpdateStatus string
 
 const (
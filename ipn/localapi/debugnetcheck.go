@@ -0,0 +1,175 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package localapi
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/ktimestamp"
+	"tailscale.com/net/netns"
+	"tailscale.com/tailcfg"
+)
+
+// kernelNetcheckProbes is the number of STUN probes sent to each address of
+// a DERP node by serveDebugNetcheckKernel, the fastest of which is its RTT.
+const kernelNetcheckProbes = 3
+
+// serveDebugNetcheckKernel runs a netcheck of the STUN RTT of every DERP
+// region, timed by kernel RX/TX timestamps where available. Those exclude
+// the scheduling latency of tailscaled, which netcheck's userspace-timed
+// report includes.
+func (h *Handler) serveDebugNetcheckKernel(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var st ipnstate.DebugNetcheckKernelReport
+	defer func() {
+		j, _ := json.Marshal(st)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(j)
+	}()
+
+	dm := h.b.DERPMap()
+	if dm == nil {
+		st.Errors = append(st.Errors, "no DERP map (not connected?)")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	st.KernelTimestamps = true
+	for _, reg := range dm.Regions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			best, kernel, errs := h.probeRegionKernel(ctx, reg)
+			mu.Lock()
+			defer mu.Unlock()
+			st.Errors = append(st.Errors, errs...)
+			if best == nil {
+				return
+			}
+			st.KernelTimestamps = st.KernelTimestamps && kernel
+			st.Regions = append(st.Regions, *best)
+		}()
+	}
+	wg.Wait()
+	if len(st.Regions) == 0 {
+		st.KernelTimestamps = false
+	}
+	slices.SortFunc(st.Regions, func(a, b ipnstate.DebugNetcheckKernelRegion) int {
+		return cmp.Or(cmp.Compare(a.RTT, b.RTT), cmp.Compare(a.RegionID, b.RegionID))
+	})
+	slices.Sort(st.Errors)
+}
+
+// probeRegionKernel returns the fastest STUN RTT of the nodes of reg, or nil
+// if none responded, and whether it is timed by kernel timestamps.
+func (h *Handler) probeRegionKernel(ctx context.Context, reg *tailcfg.DERPRegion) (best *ipnstate.DebugNetcheckKernelRegion, kernel bool, errs []string) {
+	for _, network := range []string{"udp4", "udp6"} {
+		pc, err := netns.Listener(h.logf, h.b.NetMon()).ListenPacket(ctx, network, ":0")
+		if err != nil {
+			if network == "udp4" {
+				errs = append(errs, fmt.Sprintf("Error creating IPv4 STUN listener: %v", err))
+			}
+			continue
+		}
+		defer pc.Close()
+		conn, ok := pc.(*net.UDPConn)
+		if !ok {
+			errs = append(errs, fmt.Sprintf("STUN listener of unexpected type %T", pc))
+			continue
+		}
+		p := ktimestamp.NewProber(conn)
+		for _, n := range reg.Nodes {
+			addr, err := stunAddr(ctx, n, network)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("Error resolving node %q: %v", n.HostName, err))
+				continue
+			}
+			if !addr.IsValid() {
+				continue
+			}
+			for range kernelNetcheckProbes {
+				m, err := p.Probe(ctx, addr)
+				if err != nil {
+					// Hosts without IPv6 connectivity fail all IPv6 probes.
+					if network == "udp4" {
+						errs = append(errs, fmt.Sprintf("STUN probe of node %q at %v: %v", n.HostName, addr, err))
+					}
+					break
+				}
+				if best == nil || m.RTT < best.RTT {
+					best = &ipnstate.DebugNetcheckKernelRegion{
+						RegionID:     reg.RegionID,
+						RegionCode:   reg.RegionCode,
+						Node:         n.Name,
+						Addr:         addr,
+						RTT:          m.RTT,
+						UserspaceRTT: m.UserspaceRTT,
+					}
+					kernel = m.Kernel
+				}
+			}
+		}
+	}
+	return best, kernel, errs
+}
+
+// stunAddr returns the STUN address of n for network "udp4" or "udp6", or
+// the zero value if it has none, resolving its hostname like netcheck if its
+// address is not set.
+func stunAddr(ctx context.Context, n *tailcfg.DERPNode, network string) (netip.AddrPort, error) {
+	port := firstNonzero(n.STUNPort, 3478)
+	if port < 0 || port > 1<<16-1 {
+		return netip.AddrPort{}, nil
+	}
+	is4 := network == "udp4"
+	s := n.IPv6
+	if is4 {
+		s = n.IPv4
+	}
+	if n.STUNTestIP != "" {
+		s = n.STUNTestIP
+	}
+	if s != "" {
+		ip, err := netip.ParseAddr(s)
+		if err != nil || ip.Is4() != is4 {
+			return netip.AddrPort{}, nil
+		}
+		return netip.AddrPortFrom(ip, uint16(port)), nil
+	}
+	ipNetwork := "ip6"
+	if is4 {
+		ipNetwork = "ip4"
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, ipNetwork, n.HostName)
+	if err != nil {
+		if !is4 {
+			// Nodes without AAAA records are common.
+			return netip.AddrPort{}, nil
+		}
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(ips[0].Unmap(), uint16(port)), nil
+}
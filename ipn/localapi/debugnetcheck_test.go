@@ -0,0 +1,63 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package localapi
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"tailscale.com/net/stun/stuntest"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+func TestProbeRegionKernel(t *testing.T) {
+	stunAddr, cleanup := stuntest.Serve(t)
+	defer cleanup()
+	dm := stuntest.DERPMapOf(stunAddr.String())
+
+	h := &Handler{logf: logger.Discard, b: newTestLocalBackend(t)}
+	for _, reg := range dm.Regions {
+		best, _, errs := h.probeRegionKernel(context.Background(), reg)
+		if len(errs) > 0 {
+			t.Errorf("got errors %q", errs)
+		}
+		if best == nil {
+			t.Fatalf("region %d: no RTT", reg.RegionID)
+		}
+		if best.RegionID != reg.RegionID || best.Addr.Port() != uint16(stunAddr.Port) || best.RTT <= 0 {
+			t.Errorf("got %+v", best)
+		}
+	}
+}
+
+func TestSTUNAddr(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		n       *tailcfg.DERPNode
+		network string
+		want    string
+	}{
+		{"ipv4", &tailcfg.DERPNode{IPv4: "192.0.2.1"}, "udp4", "192.0.2.1:3478"},
+		{"ipv6", &tailcfg.DERPNode{IPv4: "192.0.2.1", IPv6: "2001:db8::1", STUNPort: 3479}, "udp6", "[2001:db8::1]:3479"},
+		{"ipv6 disabled", &tailcfg.DERPNode{IPv4: "192.0.2.1", IPv6: "none"}, "udp6", ""},
+		{"stun disabled", &tailcfg.DERPNode{IPv4: "192.0.2.1", STUNPort: -1}, "udp4", ""},
+		{"test ip", &tailcfg.DERPNode{IPv4: "192.0.2.1", STUNTestIP: "127.0.0.1"}, "udp4", "127.0.0.1:3478"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := stunAddr(context.Background(), tt.n, tt.network)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want netip.AddrPort
+			if tt.want != "" {
+				want = netip.MustParseAddrPort(tt.want)
+			}
+			if got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package ktimestamp measures STUN round-trip times using kernel RX/TX
+// timestamps (SO_TIMESTAMPING on linux) where available, which exclude the
+// scheduling and runtime latency that userspace timestamps include. Platform
+// support varies; on unsupported platforms measurements fall back to
+// userspace timestamps.
+package ktimestamp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/net/stun"
+)
+
+// probeTimeout is the maximum time a Prober waits for a response, absent a
+// sooner context deadline.
+const probeTimeout = 5 * time.Second
+
+// Measurement is the result of a STUN probe.
+type Measurement struct {
+	// RTT is the round-trip time between the kernel timestamps of the
+	// request and response if Kernel, else UserspaceRTT.
+	RTT time.Duration
+	// UserspaceRTT is the round-trip time as timed in userspace.
+	UserspaceRTT time.Duration
+	// Kernel is whether RTT is timed by kernel timestamps.
+	Kernel bool
+	// Mapped is the address the STUN server saw the request from.
+	Mapped netip.AddrPort
+}
+
+// Prober sends STUN requests on a UDP conn and measures their RTT. Probes are
+// sent one at a time, as kernel TX timestamps are matched to requests in
+// order. It is safe for concurrent use.
+type Prober struct {
+	conn *net.UDPConn
+
+	mu     sync.Mutex // serializes probes
+	kernel bool       // kernel timestamps enabled on conn
+}
+
+// NewProber returns a Prober of conn, enabling kernel timestamps on it if
+// supported. The Prober must be the only reader of conn.
+func NewProber(conn *net.UDPConn) *Prober {
+	p := &Prober{conn: conn}
+	p.kernel = enable(conn) == nil
+	return p
+}
+
+// Kernel reports whether p times probes with kernel timestamps.
+func (p *Prober) Kernel() bool {
+	return p.kernel
+}
+
+// Probe sends a STUN binding request to dst and waits for its response, for
+// at most 5 seconds or until ctx is done.
+func (p *Prober) Probe(ctx context.Context, dst netip.AddrPort) (Measurement, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	p.conn.SetReadDeadline(deadline)
+	defer p.conn.SetReadDeadline(time.Time{})
+	stop := context.AfterFunc(ctx, func() {
+		p.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	txID := stun.NewTxID()
+	req := stun.Request(txID)
+	var m Measurement
+	var err error
+	if p.kernel {
+		m, err = p.probeKernel(txID, req, dst, deadline)
+	} else {
+		m, err = p.probeUserspace(txID, req, dst)
+	}
+	if err != nil && ctx.Err() != nil {
+		return Measurement{}, ctx.Err()
+	}
+	return m, err
+}
+
+// probeUserspace sends req to dst and times its response in userspace.
+func (p *Prober) probeUserspace(txID stun.TxID, req []byte, dst netip.AddrPort) (Measurement, error) {
+	txAt := time.Now()
+	if _, err := p.conn.WriteToUDPAddrPort(req, dst); err != nil {
+		return Measurement{}, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := p.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return Measurement{}, err
+		}
+		rxAt := time.Now()
+		// Skip late responses to earlier probes.
+		gotTxID, mapped, err := stun.ParseResponse(buf[:n])
+		if err != nil || gotTxID != txID {
+			continue
+		}
+		return Measurement{
+			RTT:          rxAt.Sub(txAt),
+			UserspaceRTT: rxAt.Sub(txAt),
+			Mapped:       mapped,
+		}, nil
+	}
+}
+
+var errNoTimestamp = errors.New("no timestamp in control messages")
@@ -0,0 +1,23 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package ktimestamp
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"tailscale.com/net/stun"
+)
+
+func enable(conn *net.UDPConn) error {
+	return errors.ErrUnsupported
+}
+
+func (p *Prober) probeKernel(txID stun.TxID, req []byte, dst netip.AddrPort, deadline time.Time) (Measurement, error) {
+	return Measurement{}, errors.ErrUnsupported
+}
@@ -0,0 +1,211 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ktimestamp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"tailscale.com/net/stun"
+)
+
+// Flags are the SO_TIMESTAMPING flags requesting software RX and TX
+// timestamps.
+const Flags = unix.SOF_TIMESTAMPING_TX_SOFTWARE | // tx timestamp generation in device driver
+	unix.SOF_TIMESTAMPING_RX_SOFTWARE | // rx timestamp generation in the kernel
+	unix.SOF_TIMESTAMPING_SOFTWARE // report software timestamps
+
+// timestampingOpt is the SO_TIMESTAMPING socket option negotiated with the
+// kernel by SetTimestamping, or zero until it is.
+var timestampingOpt struct {
+	sync.Mutex
+	opt int
+}
+
+// SetTimestamping enables kernel timestamps with flags on fd. The socket
+// option is negotiated with the kernel on first use and cached: kernels
+// before 5.1 lack SO_TIMESTAMPING_NEW, and on 64-bit architectures fall back
+// to SO_TIMESTAMPING_OLD, whose timestamps are laid out identically. On
+// 32-bit architectures those are not y2038-safe, so they are not used.
+func SetTimestamping(fd, flags int) error {
+	timestampingOpt.Lock()
+	defer timestampingOpt.Unlock()
+	if opt := timestampingOpt.opt; opt != 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, opt, flags); err != nil {
+			return fmt.Errorf("setsockopt %s: %w", timestampingOptName(opt), err)
+		}
+		return nil
+	}
+	err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPING_NEW, flags)
+	if err == nil {
+		timestampingOpt.opt = unix.SO_TIMESTAMPING_NEW
+		return nil
+	}
+	if errors.Is(err, unix.ENOPROTOOPT) && strconv.IntSize == 64 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPING_OLD, flags); err == nil {
+			timestampingOpt.opt = unix.SO_TIMESTAMPING_OLD
+			return nil
+		}
+	}
+	return fmt.Errorf("setsockopt SO_TIMESTAMPING_NEW: %w", err)
+}
+
+// NegotiatedOpt returns the name of the socket option negotiated by
+// SetTimestamping, negotiating it if need be.
+func NegotiatedOpt() (string, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(fd)
+	if err := SetTimestamping(fd, Flags); err != nil {
+		return "", err
+	}
+	timestampingOpt.Lock()
+	defer timestampingOpt.Unlock()
+	return timestampingOptName(timestampingOpt.opt), nil
+}
+
+func timestampingOptName(opt int) string {
+	if opt == unix.SO_TIMESTAMPING_OLD {
+		return "SO_TIMESTAMPING_OLD"
+	}
+	return "SO_TIMESTAMPING_NEW"
+}
+
+// IsTimestampingCmsg reports whether h is the header of a control message
+// holding timestamps requested by SetTimestamping.
+func IsTimestampingCmsg(h unix.Cmsghdr) bool {
+	return h.Level == unix.SOL_SOCKET &&
+		(h.Type == unix.SO_TIMESTAMPING_NEW || (h.Type == unix.SO_TIMESTAMPING_OLD && strconv.IntSize == 64))
+}
+
+// ParseTimestamp returns the software timestamp held by the control messages
+// oob.
+func ParseTimestamp(oob []byte) (time.Time, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error parsing oob as cmsgs: %w", err)
+	}
+	for _, msg := range msgs {
+		if IsTimestampingCmsg(msg.Header) && len(msg.Data) >= 16 {
+			sec := int64(binary.NativeEndian.Uint64(msg.Data[:8]))
+			ns := int64(binary.NativeEndian.Uint64(msg.Data[8:16]))
+			return time.Unix(sec, ns), nil
+		}
+	}
+	return time.Time{}, errNoTimestamp
+}
+
+func enable(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if cerr := rc.Control(func(fd uintptr) {
+		err = SetTimestamping(int(fd), Flags)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// probeKernel sends req to dst and times its response by the kernel
+// timestamps of both, waiting until deadline at most.
+func (p *Prober) probeKernel(txID stun.TxID, req []byte, dst netip.AddrPort, deadline time.Time) (Measurement, error) {
+	rc, err := p.conn.SyscallConn()
+	if err != nil {
+		return Measurement{}, err
+	}
+	buf, oob := make([]byte, 1500), make([]byte, 1024)
+	// Discard TX timestamps of earlier probes that timed out.
+	rc.Control(func(fd uintptr) {
+		for {
+			if _, _, _, _, err := unix.Recvmsg(int(fd), buf, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT); err != nil {
+				return
+			}
+		}
+	})
+
+	userspaceTxAt := time.Now()
+	if _, err := p.conn.WriteToUDPAddrPort(req, dst); err != nil {
+		return Measurement{}, err
+	}
+
+	// The error queue only signals POLLERR, which the runtime poller does
+	// not wait for, so poll it directly. The TX timestamp is queued as the
+	// request leaves, so this blocks only briefly.
+	var txAt time.Time
+	if cerr := rc.Control(func(fd uintptr) {
+		for {
+			n, oobn, _, _, rerr := unix.Recvmsg(int(fd), buf, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+			switch {
+			case rerr == unix.EAGAIN:
+				wait := time.Until(deadline)
+				if wait <= 0 {
+					err = errors.New("timed out waiting for tx timestamp")
+					return
+				}
+				unix.Poll([]unix.PollFd{{Fd: int32(fd)}}, int(wait.Milliseconds())+1)
+			case rerr != nil:
+				err = rerr
+				return
+			// The looped request includes headers, so match its tail.
+			case bytes.HasSuffix(buf[:n], req):
+				txAt, err = ParseTimestamp(oob[:oobn])
+				return
+			}
+		}
+	}); cerr != nil {
+		return Measurement{}, cerr
+	}
+	if err != nil {
+		return Measurement{}, fmt.Errorf("tx timestamp: %w", err)
+	}
+
+	var m Measurement
+	var rerr error
+	err = rc.Read(func(fd uintptr) bool {
+		for {
+			n, oobn, _, _, err := unix.Recvmsg(int(fd), buf, oob, 0)
+			if err == unix.EAGAIN {
+				return false
+			}
+			if err != nil {
+				rerr = err
+				return true
+			}
+			userspaceRxAt := time.Now()
+			// Skip late responses to earlier probes.
+			gotTxID, mapped, err := stun.ParseResponse(buf[:n])
+			if err != nil || gotTxID != txID {
+				continue
+			}
+			rxAt, err := ParseTimestamp(oob[:oobn])
+			if err != nil {
+				rerr = fmt.Errorf("rx timestamp: %w", err)
+				return true
+			}
+			m = Measurement{
+				RTT:          rxAt.Sub(txAt),
+				UserspaceRTT: userspaceRxAt.Sub(userspaceTxAt),
+				Kernel:       true,
+				Mapped:       mapped,
+			}
+			return true
+		}
+	})
+	if err == nil {
+		err = rerr
+	}
+	return m, err
+}
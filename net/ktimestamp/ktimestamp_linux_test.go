@@ -0,0 +1,45 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ktimestamp
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSetTimestamping(t *testing.T) {
+	opt, err := NegotiatedOpt()
+	if err != nil {
+		t.Skipf("kernel timestamps unavailable: %v", err)
+	}
+	if opt != "SO_TIMESTAMPING_NEW" && opt != "SO_TIMESTAMPING_OLD" {
+		t.Errorf("negotiated %q", opt)
+	}
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	if err := SetTimestamping(fd, Flags); err != nil {
+		t.Errorf("SetTimestamping with negotiated %s: %v", opt, err)
+	}
+}
+
+func TestIsTimestampingCmsg(t *testing.T) {
+	tests := []struct {
+		h    unix.Cmsghdr
+		want bool
+	}{
+		{unix.Cmsghdr{Level: unix.SOL_SOCKET, Type: unix.SO_TIMESTAMPING_NEW}, true},
+		{unix.Cmsghdr{Level: unix.SOL_SOCKET, Type: unix.SO_TIMESTAMPING_OLD}, unix.SizeofPtr == 8},
+		{unix.Cmsghdr{Level: unix.SOL_SOCKET, Type: unix.SO_TIMESTAMP}, false},
+		{unix.Cmsghdr{Level: unix.IPPROTO_IP, Type: unix.SO_TIMESTAMPING_NEW}, false},
+	}
+	for _, tt := range tests {
+		if got := IsTimestampingCmsg(tt.h); got != tt.want {
+			t.Errorf("IsTimestampingCmsg(%+v) = %v, want %v", tt.h, got, tt.want)
+		}
+	}
+}
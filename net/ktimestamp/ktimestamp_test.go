@@ -0,0 +1,45 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ktimestamp
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"tailscale.com/net/stun/stuntest"
+)
+
+func TestProber(t *testing.T) {
+	stunAddr, cleanup := stuntest.Serve(t)
+	defer cleanup()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p := NewProber(conn)
+	for range 3 {
+		m, err := p.Probe(context.Background(), stunAddr.AddrPort())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Kernel != p.Kernel() {
+			t.Errorf("got Kernel %v, prober has %v", m.Kernel, p.Kernel())
+		}
+		if m.RTT <= 0 || m.UserspaceRTT <= 0 {
+			t.Errorf("got RTT %v, userspace RTT %v", m.RTT, m.UserspaceRTT)
+		}
+		if m.Mapped.Port() != uint16(conn.LocalAddr().(*net.UDPAddr).Port) {
+			t.Errorf("got mapped address %v, want port of %v", m.Mapped, conn.LocalAddr())
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.Probe(ctx, stunAddr.AddrPort()); err == nil {
+		t.Error("got no error with canceled context")
+	}
+}
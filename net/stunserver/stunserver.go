@@ -11,12 +11,26 @@
 	"expvar"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/netip"
 	"time"
 
 	"tailscale.com/metrics"
 	"tailscale.com/net/stun"
+	"tailscale.com/tstime/rate"
+	"tailscale.com/util/lru"
+)
+
+const (
+	// maxRateLimitedClients is the maximum number of clients whose rate
+	// limiters are kept; the least recently seen are forgotten first.
+	maxRateLimitedClients = 64 << 10
+
+	// maxClientPrefixes is the maximum number of client prefixes counted
+	// separately by SetClientMetrics; requests from others are counted as
+	// "other".
+	maxClientPrefixes = 1024
 )
 
 var (
@@ -27,6 +41,9 @@
 	stunNotSTUN     = stunDisposition.Get("not_stun")
 	stunWriteError  = stunDisposition.Get("write_error")
 	stunSuccess     = stunDisposition.Get("success")
+	stunRateLimited = stunDisposition.Get("rate_limited")
+
+	stunClientPrefix = &metrics.LabelMap{Label: "client_prefix"}
 
 	stunIPv4 = stunAddrFamily.Get("ipv4")
 	stunIPv6 = stunAddrFamily.Get("ipv6")
@@ -35,12 +52,23 @@
 func init() {
 	stats.Set("counter_requests", stunDisposition)
 	stats.Set("counter_addrfamily", stunAddrFamily)
+	stats.Set("counter_requests_by_client_prefix", stunClientPrefix)
 	expvar.Publish("stun", stats)
 }
 
 type STUNServer struct {
 	ctx context.Context // ctx signals service shutdown
 	pc  *net.UDPConn    // pc is the UDP listener
+
+	// The following are only accessed by Serve, after being set by
+	// SetRateLimit and SetClientMetrics.
+
+	limit    rate.Limit // per client; zero means unlimited
+	burst    int
+	limiters lru.Cache[netip.Addr, *rate.Limiter] // by rateLimitKey
+
+	clientMetrics  bool
+	clientPrefixes map[netip.Prefix]bool // those counted separately
 }
 
 // New creates a new STUN server. The server is shutdown when ctx is done.
@@ -48,6 +76,77 @@ func New(ctx context.Context) *STUNServer {
 	return &STUNServer{ctx: ctx}
 }
 
+// SetRateLimit limits the requests answered per client to limit per second,
+// with bursts of up to burst requests. Requests over the limit are dropped
+// unanswered, so that the server cannot be used to reflect traffic at a
+// spoofed source. A client is a single IPv4 address, or an IPv6 /64 as hosts
+// are commonly assigned whole /64s. A zero limit, the default, or an infinite
+// one disables rate limiting. It must be called before Serve.
+func (s *STUNServer) SetRateLimit(limit rate.Limit, burst int) {
+	if math.IsInf(float64(limit), +1) {
+		limit = 0
+	}
+	s.limit, s.burst = limit, max(burst, 1)
+	s.limiters.MaxEntries = maxRateLimitedClients
+}
+
+// SetClientMetrics sets whether to count requests by client prefix, a /24
+// for IPv4 and a /56 for IPv6, in the counter_requests_by_client_prefix
+// expvar. Only the first 1024 prefixes seen are counted separately, to bound
+// the number of metrics. It must be called before Serve.
+func (s *STUNServer) SetClientMetrics(v bool) {
+	s.clientMetrics = v
+}
+
+// rateLimitKey returns the key of the rate limiter of addr.
+func rateLimitKey(addr netip.Addr) netip.Addr {
+	if addr.Is4() {
+		return addr
+	}
+	return netip.PrefixFrom(addr, 64).Masked().Addr()
+}
+
+// clientPrefix returns the prefix of addr counted by SetClientMetrics.
+func clientPrefix(addr netip.Addr) netip.Prefix {
+	if addr.Is4() {
+		return netip.PrefixFrom(addr, 24).Masked()
+	}
+	return netip.PrefixFrom(addr, 56).Masked()
+}
+
+// allow reports whether to answer a request from addr.
+func (s *STUNServer) allow(addr netip.Addr) bool {
+	if s.limit == 0 {
+		return true
+	}
+	key := rateLimitKey(addr)
+	lim, ok := s.limiters.GetOk(key)
+	if !ok {
+		lim = rate.NewLimiter(s.limit, s.burst)
+		s.limiters.Set(key, lim)
+	}
+	return lim.Allow()
+}
+
+// countClient counts a request from addr if SetClientMetrics is enabled.
+func (s *STUNServer) countClient(addr netip.Addr) {
+	if !s.clientMetrics {
+		return
+	}
+	p := clientPrefix(addr)
+	if !s.clientPrefixes[p] {
+		if len(s.clientPrefixes) >= maxClientPrefixes {
+			stunClientPrefix.Add("other", 1)
+			return
+		}
+		if s.clientPrefixes == nil {
+			s.clientPrefixes = make(map[netip.Prefix]bool)
+		}
+		s.clientPrefixes[p] = true
+	}
+	stunClientPrefix.Add(p.String(), 1)
+}
+
 // Listen binds the listen socket for the server at listenAddr.
 func (s *STUNServer) Listen(listenAddr string) error {
 	uaddr, err := net.ResolveUDPAddr("udp", listenAddr)
@@ -102,6 +201,11 @@ func (s *STUNServer) Serve() error {
 			stunIPv6.Add(1)
 		}
 		addr, _ := netip.AddrFromSlice(ua.IP)
+		s.countClient(addr.Unmap())
+		if !s.allow(addr.Unmap()) {
+			stunRateLimited.Add(1)
+			continue
+		}
 		res := stun.Response(txid, netip.AddrPortFrom(addr, uint16(ua.Port)))
 		_, err = s.pc.WriteTo(res, ua)
 		if err != nil {
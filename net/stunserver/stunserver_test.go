@@ -6,11 +6,13 @@
 import (
 	"context"
 	"net"
+	"net/netip"
 	"sync"
 	"testing"
 	"time"
 
 	"tailscale.com/net/stun"
+	"tailscale.com/tstime/rate"
 	"tailscale.com/util/must"
 )
 
@@ -86,3 +88,67 @@ func BenchmarkServerSTUN(b *testing.B) {
 		}
 	}
 }
+
+func TestSTUNServerRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := New(ctx)
+	s.SetRateLimit(rate.Every(time.Hour), 2)
+	s.SetClientMetrics(true)
+	must.Do(s.Listen("127.0.0.1:0"))
+	go s.Serve()
+
+	c := must.Get(net.DialUDP("udp", nil, s.LocalAddr().(*net.UDPAddr)))
+	defer c.Close()
+	prefixBefore := stunClientPrefix.Get("127.0.0.0/24").Value()
+	limitedBefore := stunRateLimited.Value()
+	var buf [64 << 10]byte
+	for i := range 3 {
+		txid := stun.NewTxID()
+		must.Get(c.Write(stun.Request(txid)))
+		// The third request is over the burst and dropped.
+		timeout := 5 * time.Second
+		if i == 2 {
+			timeout = 100 * time.Millisecond
+		}
+		c.SetReadDeadline(time.Now().Add(timeout))
+		n, err := c.Read(buf[:])
+		if i == 2 {
+			if err == nil {
+				t.Fatal("got response over rate limit")
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if tid, _, err := stun.ParseResponse(buf[:n]); err != nil || tid != txid {
+			t.Fatalf("request %d: got response %v, %v", i, tid, err)
+		}
+	}
+	if got := stunRateLimited.Value() - limitedBefore; got != 1 {
+		t.Errorf("got %d rate limited requests, want 1", got)
+	}
+	if got := stunClientPrefix.Get("127.0.0.0/24").Value() - prefixBefore; got != 3 {
+		t.Errorf("got %d requests counted for 127.0.0.0/24, want 3", got)
+	}
+}
+
+func TestClientKeys(t *testing.T) {
+	for _, tt := range []struct {
+		addr      string
+		limitKey  string
+		prefixKey string
+	}{
+		{"192.0.2.77", "192.0.2.77", "192.0.2.0/24"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::", "2001:db8:1::/56"},
+	} {
+		addr := netip.MustParseAddr(tt.addr)
+		if got := rateLimitKey(addr).String(); got != tt.limitKey {
+			t.Errorf("rateLimitKey(%v) = %v, want %v", addr, got, tt.limitKey)
+		}
+		if got := clientPrefix(addr).String(); got != tt.prefixKey {
+			t.Errorf("clientPrefix(%v) = %v, want %v", addr, got, tt.prefixKey)
+		}
+	}
+}
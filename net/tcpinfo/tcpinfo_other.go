@@ -1,7 +1,7 @@
 // Copyright (c) Tailscale Inc & AUTHORS
 // SPDX-License-Identifier: BSD-3-Clause
 
-//go:build !linux && !darwin
+//go:build !linux && !darwin && !windows
 
 package tcpinfo
 
@@ -13,7 +13,7 @@
 
 func TestRTT(t *testing.T) {
 	switch runtime.GOOS {
-	case "linux", "darwin":
+	case "linux", "darwin", "windows":
 	default:
 		t.Skipf("not currently supported on %s", runtime.GOOS)
 	}
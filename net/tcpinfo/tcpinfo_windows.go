@@ -0,0 +1,65 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tcpinfo
+
+import (
+	"net"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// sioTCPInfo is SIO_TCP_INFO, available since Windows 10 1703.
+const sioTCPInfo = 0xd8000027
+
+// tcpInfoV0 is TCP_INFO_v0 from mstcpip.h.
+type tcpInfoV0 struct {
+	State             uint32
+	Mss               uint32
+	ConnectionTimeMs  uint64
+	TimestampsEnabled uint8
+	RttUs             uint32
+	MinRttUs          uint32
+	BytesInFlight     uint32
+	Cwnd              uint32
+	SndWnd            uint32
+	RcvWnd            uint32
+	RcvBuf            uint32
+	BytesOut          uint64
+	BytesIn           uint64
+	BytesReordered    uint32
+	BytesRetrans      uint32
+	FastRetrans       uint32
+	DupAcksIn         uint32
+	TimeoutEpisodes   uint32
+	SynRetrans        uint8
+}
+
+func rttImpl(conn *net.TCPConn) (time.Duration, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		version uint32 // TCP_INFO_v0
+		tcpInfo tcpInfoV0
+		n       uint32
+		sysErr  error
+	)
+	err = rawConn.Control(func(fd uintptr) {
+		sysErr = windows.WSAIoctl(windows.Handle(fd), sioTCPInfo,
+			(*byte)(unsafe.Pointer(&version)), uint32(unsafe.Sizeof(version)),
+			(*byte)(unsafe.Pointer(&tcpInfo)), uint32(unsafe.Sizeof(tcpInfo)),
+			&n, nil, 0)
+	})
+	if err != nil {
+		return 0, err
+	} else if sysErr != nil {
+		return 0, sysErr
+	}
+
+	return time.Duration(tcpInfo.RttUs) * time.Microsecond, nil
+}
@@ -1597,7 +1597,9 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netip
 	if !isDerp {
 		thisPong := addrQuality{sp.to, latency, tstun.WireMTU(pingSizeToPktLen(sp.size, sp.to.Addr().Is6()))}
 		if betterAddr(thisPong, de.bestAddr) {
-			de.c.logf("magicsock: disco: node %v %v now using %v mtu=%v tx=%x", de.publicKey.ShortString(), de.discoShort(), sp.to, thisPong.wireMTU, m.TxID[:6])
+			de.c.logf("magicsock: disco: node %v %v now using %v mtu=%v tx=%x latency=%v%v", de.publicKey.ShortString(), de.discoShort(), sp.to, thisPong.wireMTU, m.TxID[:6], latency.Round(time.Millisecond/10), logger.ArgWriter(func(bw *bufio.Writer) {
+				de.writeCandidateLatenciesLocked(bw, sp.to)
+			}))
 			de.debugUpdates.Add(EndpointChange{
 				When: time.Now(),
 				What: "handlePingLocked-bestAddr-update",
@@ -1784,6 +1786,7 @@ func (de *endpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	defer de.mu.Unlock()
 
 	ps.Relay = de.c.derpRegionCodeOfIDLocked(int(de.derpAddr.Port()))
+	ps.Candidates = de.candidatesLocked()
 
 	if de.lastSendExt.IsZero() {
 		return
@@ -1798,6 +1801,62 @@ func (de *endpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	}
 }
 
+// candidatesLocked returns the status of each of de's candidate direct
+// endpoints, sorted by address, or nil if it has none.
+// de.mu must be held.
+func (de *endpoint) candidatesLocked() []ipnstate.CandidateStatus {
+	if len(de.endpointState) == 0 {
+		return nil
+	}
+	ret := make([]ipnstate.CandidateStatus, 0, len(de.endpointState))
+	for ipp, st := range de.endpointState {
+		cs := ipnstate.CandidateStatus{
+			Addr:  ipp,
+			Best:  ipp == de.bestAddr.AddrPort,
+			Pongs: len(st.recentPongs),
+		}
+		if !st.lastPing.IsZero() {
+			cs.LastPing = st.lastPing.WallTime()
+		}
+		if len(st.recentPongs) > 0 {
+			last := st.recentPongs[st.recentPong]
+			cs.Latency = last.latency
+			cs.LastPong = last.pongAt.WallTime()
+			cs.MinLatency = last.latency
+			for _, pr := range st.recentPongs {
+				cs.MinLatency = min(cs.MinLatency, pr.latency)
+			}
+		}
+		ret = append(ret, cs)
+	}
+	slices.SortFunc(ret, func(a, b ipnstate.CandidateStatus) int {
+		return a.Addr.Compare(b.Addr)
+	})
+	return ret
+}
+
+// writeCandidateLatenciesLocked writes the most recent latency of each of
+// de's candidate direct endpoints other than skip to bw, for logging why an
+// endpoint was selected.
+// de.mu must be held.
+func (de *endpoint) writeCandidateLatenciesLocked(bw *bufio.Writer, skip netip.AddrPort) {
+	first := true
+	for _, cs := range de.candidatesLocked() {
+		if cs.Addr == skip {
+			continue
+		}
+		if first {
+			bw.WriteString(" others:")
+			first = false
+		}
+		if cs.Pongs == 0 {
+			fmt.Fprintf(bw, " %v=none", cs.Addr)
+		} else {
+			fmt.Fprintf(bw, " %v=%v", cs.Addr, cs.Latency.Round(time.Millisecond/10))
+		}
+	}
+}
+
 // stopAndReset stops timers associated with de and resets its state back to zero.
 // It's called when a discovery endpoint is no longer present in the
 // NetworkMap, or when magicsock is transitioning from running to
@@ -9,6 +9,7 @@
 	"time"
 
 	"github.com/dsnet/try"
+	"tailscale.com/tstime/mono"
 	"tailscale.com/types/key"
 )
 
@@ -324,3 +325,42 @@ func(lifetime *probeUDPLifetime) time.Duration {
 		})
 	}
 }
+
+func Test_endpoint_candidatesLocked(t *testing.T) {
+	a := netip.MustParseAddrPort("1.2.3.4:41641")
+	b := netip.MustParseAddrPort("5.6.7.8:41641")
+	c := netip.MustParseAddrPort("[2001:db8::1]:41641")
+	now := mono.Now()
+	de := &endpoint{
+		endpointState: map[netip.AddrPort]*endpointState{
+			c: {},
+			b: {lastPing: now},
+			a: {lastPing: now},
+		},
+		bestAddr: addrQuality{AddrPort: a, latency: 5 * time.Millisecond},
+	}
+	for _, lat := range []time.Duration{3, 8, 5} {
+		de.endpointState[a].addPongReplyLocked(pongReply{latency: lat * time.Millisecond, pongAt: now, from: a})
+	}
+	de.endpointState[b].addPongReplyLocked(pongReply{latency: 20 * time.Millisecond, pongAt: now, from: b})
+
+	got := de.candidatesLocked()
+	if len(got) != 3 {
+		t.Fatalf("got %d candidates; want 3", len(got))
+	}
+	if got[0].Addr != a || got[1].Addr != b || got[2].Addr != c {
+		t.Errorf("candidates not sorted by address: %v, %v, %v", got[0].Addr, got[1].Addr, got[2].Addr)
+	}
+	if !got[0].Best || got[1].Best || got[2].Best {
+		t.Errorf("Best = %v, %v, %v; want only %v", got[0].Best, got[1].Best, got[2].Best, a)
+	}
+	if got[0].Latency != 5*time.Millisecond || got[0].MinLatency != 3*time.Millisecond || got[0].Pongs != 3 {
+		t.Errorf("candidate %v = %+v; want latency 5ms, min 3ms, 3 pongs", a, got[0])
+	}
+	if got[1].Latency != 20*time.Millisecond || got[1].Pongs != 1 || got[1].LastPong.IsZero() {
+		t.Errorf("candidate %v = %+v; want latency 20ms, 1 pong", b, got[1])
+	}
+	if got[2].Pongs != 0 || got[2].Latency != 0 || !got[2].LastPing.IsZero() {
+		t.Errorf("unprobed candidate %v = %+v; want zero measurements", c, got[2])
+	}
+}
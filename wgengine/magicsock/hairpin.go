@@ -0,0 +1,165 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/net/stun"
+)
+
+// hairpinCheckTimeout is how long checkHairpin waits for its probe to come
+// back. Hairpinned packets never leave the NAT, so they are quick.
+const hairpinCheckTimeout = 100 * time.Millisecond
+
+// maxHairpinNetworks is the maximum number of networks hairpinState
+// remembers, as the public address of a network, and thus its key, may change
+// whenever its NAT restarts.
+const maxHairpinNetworks = 16
+
+// hairpinState tracks whether the NAT of each network the Conn has been on
+// hairpins. Behind a CGNAT, peers on the same carrier network share a public
+// address, and can only reach each other at it if the CGNAT hairpins; when
+// it does not, they are left with LAN paths and DERP.
+type hairpinState struct {
+	mu      sync.Mutex
+	txID    stun.TxID     // of the check in flight
+	got     chan struct{} // closed when txID comes back; nil if no check is in flight
+	current string        // network of the last check
+	// networks holds the determination of every network checked, so that
+	// changes of a network's determination are logged even if the Conn
+	// moved between networks in the meantime.
+	networks map[string]*ipnstate.HairpinStatus
+}
+
+// receive reports whether b is the probe of the hairpin check in flight,
+// and records that it came back if so.
+func (h *hairpinState) receive(b []byte) bool {
+	txID, err := stun.ParseBindingRequest(b)
+	if err != nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.got == nil || txID != h.txID {
+		return false
+	}
+	close(h.got)
+	h.got = nil
+	return true
+}
+
+// status returns the determination of the current network, or nil if it
+// has not been checked.
+func (h *hairpinState) status() *ipnstate.HairpinStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, ok := h.networks[h.current]
+	if !ok {
+		return nil
+	}
+	ret := *st
+	return &ret
+}
+
+// forgetOldestLocked forgets the network checked least recently.
+// h.mu must be held.
+func (h *hairpinState) forgetOldestLocked() {
+	var oldest string
+	for network, st := range h.networks {
+		if oldest == "" || st.LastChecked.Before(h.networks[oldest].LastChecked) {
+			oldest = network
+		}
+	}
+	delete(h.networks, oldest)
+}
+
+// hairpinNetwork returns the network of report as keyed by hairpinState, or
+// the empty string if the public IPv4 address of report is unknown.
+func (c *Conn) hairpinNetwork(report *netcheck.Report) string {
+	if !report.GlobalV4.IsValid() {
+		return ""
+	}
+	var ifName string
+	if c.netMon != nil {
+		ifName = c.netMon.InterfaceState().DefaultRouteInterface
+	}
+	if ifName == "" {
+		ifName = "unknown"
+	}
+	return ifName + "/" + report.GlobalV4.Addr().String()
+}
+
+// checkHairpin determines whether the NAT of the network of report
+// hairpins, by sending a STUN binding request from our IPv4 socket to our
+// own public address and waiting for it to come back, and logs changes of
+// the determination. It returns the determination, or false and false if
+// the network could not be checked.
+func (c *Conn) checkHairpin(ctx context.Context, report *netcheck.Report) (hairpins, ok bool) {
+	network := c.hairpinNetwork(report)
+	if network == "" {
+		c.hairpin.mu.Lock()
+		c.hairpin.current = ""
+		c.hairpin.mu.Unlock()
+		return false, false
+	}
+	txID := stun.NewTxID()
+	got := make(chan struct{})
+	c.hairpin.mu.Lock()
+	if c.hairpin.got != nil {
+		// A check is in flight already.
+		c.hairpin.mu.Unlock()
+		return false, false
+	}
+	c.hairpin.txID, c.hairpin.got = txID, got
+	c.hairpin.mu.Unlock()
+	defer func() {
+		c.hairpin.mu.Lock()
+		if c.hairpin.got == got {
+			c.hairpin.got = nil
+		}
+		c.hairpin.mu.Unlock()
+	}()
+
+	if _, err := c.pconn4.WriteToUDPAddrPort(stun.Request(txID), report.GlobalV4); err != nil {
+		c.dlogf("[v1] magicsock: hairpin check: %v", err)
+		return false, false
+	}
+	t := time.NewTimer(hairpinCheckTimeout)
+	defer t.Stop()
+	select {
+	case <-got:
+		hairpins = true
+	case <-t.C:
+	case <-ctx.Done():
+		return false, false
+	}
+
+	now := time.Now()
+	c.hairpin.mu.Lock()
+	defer c.hairpin.mu.Unlock()
+	c.hairpin.current = network
+	st, ok := c.hairpin.networks[network]
+	switch {
+	case !ok:
+		c.logf("magicsock: hairpinning on network %s: %v", network, hairpins)
+		st = &ipnstate.HairpinStatus{Network: network, HairPinning: hairpins, Since: now}
+		if c.hairpin.networks == nil {
+			c.hairpin.networks = make(map[string]*ipnstate.HairpinStatus)
+		}
+		if len(c.hairpin.networks) >= maxHairpinNetworks {
+			c.hairpin.forgetOldestLocked()
+		}
+		c.hairpin.networks[network] = st
+	case st.HairPinning != hairpins:
+		c.logf("magicsock: hairpinning on network %s changed from %v to %v", network, st.HairPinning, hairpins)
+		st.HairPinning, st.Since = hairpins, now
+	}
+	st.LastChecked = now
+	return hairpins, true
+}
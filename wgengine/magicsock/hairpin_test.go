@@ -0,0 +1,65 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"tailscale.com/net/netcheck"
+)
+
+func TestCheckHairpin(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	go func() {
+		receive := c.receiveIPv4()
+		bufs := [][]byte{make([]byte, 1500)}
+		sizes := make([]int, 1)
+		eps := make([]conn.Endpoint, 1)
+		for {
+			if _, err := receive(bufs, sizes, eps); err != nil {
+				return
+			}
+		}
+	}()
+
+	if st := c.hairpin.status(); st != nil {
+		t.Fatalf("got status %+v before any check", st)
+	}
+	ctx := context.Background()
+	self := c.pconn4.LocalAddr().AddrPort()
+	if hairpins, ok := c.checkHairpin(ctx, &netcheck.Report{GlobalV4: self}); !ok || !hairpins {
+		t.Fatalf("got hairpins %v, ok %v; want true, true", hairpins, ok)
+	}
+	first := c.hairpin.status()
+	if first == nil || !first.HairPinning || first.Since.IsZero() {
+		t.Fatalf("got status %+v", first)
+	}
+
+	// A socket that does not forward the probe back, with the same public
+	// address and thus on the same network.
+	other, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if hairpins, ok := c.checkHairpin(ctx, &netcheck.Report{GlobalV4: other.LocalAddr().(*net.UDPAddr).AddrPort()}); !ok || hairpins {
+		t.Fatalf("got hairpins %v, ok %v; want false, true", hairpins, ok)
+	}
+	st := c.hairpin.status()
+	if st == nil || st.Network != first.Network || st.HairPinning || !st.Since.After(first.Since) {
+		t.Errorf("got status %+v after change from %+v", st, first)
+	}
+
+	// Without a public IPv4 address, the network is unknown.
+	if _, ok := c.checkHairpin(ctx, &netcheck.Report{}); ok {
+		t.Error("checked hairpinning without a public address")
+	}
+	if st := c.hairpin.status(); st != nil {
+		t.Errorf("got status %+v without a public address", st)
+	}
+}
@@ -136,6 +136,9 @@ type Conn struct {
 	// cloudInfo is used to query cloud metadata services.
 	cloudInfo *cloudInfo
 
+	// hairpin tracks whether the NAT of the current network hairpins.
+	hairpin hairpinState
+
 	// ============================================================
 	// Fields that must be accessed via atomic load/stores.
 
@@ -703,6 +706,7 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 	}
 
 	c.lastNetCheckReport.Store(report)
+	c.health.NoteDERPRegionLatencies(report.RegionLatency)
 	c.noV4.Store(!report.IPv4)
 	c.noV6.Store(!report.IPv6)
 	c.noV4Send.Store(!report.IPv4CanSend)
@@ -725,6 +729,9 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 	ni.OSHasIPv6.Set(report.OSHasIPv6)
 	ni.WorkingUDP.Set(report.UDP)
 	ni.WorkingICMPv4.Set(report.ICMPv4)
+	if hairpins, ok := c.checkHairpin(ctx, report); ok {
+		ni.HairPinning.Set(hairpins)
+	}
 	ni.PreferredDERP = c.maybeSetNearestDERP(report)
 	ni.FirewallMode = hostinfo.FirewallMode()
 
@@ -1351,6 +1358,9 @@ func (c *Conn) mkReceiveFunc(ruc *RebindingUDPConn, healthItem *health.ReceiveFu
 func (c *Conn) receiveIP(b []byte, ipp netip.AddrPort, cache *ippEndpointCache) (_ conn.Endpoint, ok bool) {
 	var ep *endpoint
 	if stun.Is(b) {
+		if c.hairpin.receive(b) {
+			return nil, false
+		}
 		c.netChecker.ReceiveSTUNPacket(b, ipp)
 		return nil, false
 	}
@@ -2723,6 +2733,9 @@ func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	sb.MutateStatus(func(st *ipnstate.Status) {
+		st.Hairpin = c.hairpin.status()
+	})
 	sb.MutateSelfStatus(func(ss *ipnstate.PeerStatus) {
 		ss.Addrs = make([]string, 0, len(c.lastEndpoints))
 		for _, ep := range c.lastEndpoints {
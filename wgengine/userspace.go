@@ -1221,6 +1221,9 @@ func (e *userspaceEngine) linkChange(delta *netmon.ChangeDelta) {
 	}
 
 	e.health.SetAnyInterfaceUp(up)
+	if changed {
+		e.health.NoteMajorLinkChange()
+	}
 	e.magicConn.SetNetworkUp(up)
 	if !up || changed {
 		if err := e.dns.FlushCaches(); err != nil {